@@ -0,0 +1,437 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package agerange implements a collection
+// of age-specific distribution ranges.
+//
+// In a collection of ranges
+// (as implemented in github.com/js-arias/ranges)
+// each taxon has a single range at a single age.
+// In an age-specific collection,
+// a taxon can have several ranges,
+// each one at a different age
+// (for example,
+// the fossils of a lineage
+// found at different time slices).
+package agerange
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/js-arias/earth"
+	"github.com/js-arias/ranges"
+)
+
+// A Collection is a collection
+// of age-specific distribution ranges
+// with an associated pixelation.
+type Collection struct {
+	pix  *earth.Pixelation
+	taxa map[string]map[int64]*entry
+}
+
+// An entry is a range of a taxon
+// at a given age.
+type entry struct {
+	tp  ranges.Type
+	rng map[int]float64
+}
+
+// New creates a new empty collection
+// using an isolatitude pixelation.
+func New(pix *earth.Pixelation) *Collection {
+	return &Collection{
+		pix:  pix,
+		taxa: make(map[string]map[int64]*entry),
+	}
+}
+
+// AddPixel adds a pixel,
+// using the pixel ID in the underlying pixelation,
+// to a taxon at an specific age
+// (in years).
+//
+// To add a pixel the range of the taxon at the given age
+// must be defined as 'points'
+// (i.e., a presence-absence pixelation).
+func (c *Collection) AddPixel(name string, age int64, pixID int) {
+	name = canon(name)
+	if name == "" {
+		return
+	}
+
+	e := c.entry(name, age, ranges.Points)
+	if e.tp != ranges.Points {
+		return
+	}
+	e.rng[pixID] = 1
+}
+
+// Ages returns the ages
+// (in years)
+// with a defined range for a taxon,
+// sorted from youngest to oldest.
+func (c *Collection) Ages(name string) []int64 {
+	name = canon(name)
+	if name == "" {
+		return nil
+	}
+
+	tax, ok := c.taxa[name]
+	if !ok {
+		return nil
+	}
+
+	ages := make([]int64, 0, len(tax))
+	for a := range tax {
+		ages = append(ages, a)
+	}
+	slices.Sort(ages)
+	return ages
+}
+
+// Pixelation returns the underlying pixelation
+// of the collection.
+func (c *Collection) Pixelation() *earth.Pixelation {
+	return c.pix
+}
+
+// Range returns a range map of a taxon
+// at a given age
+// (in years).
+func (c *Collection) Range(name string, age int64) map[int]float64 {
+	name = canon(name)
+	if name == "" {
+		return nil
+	}
+
+	e, ok := c.taxa[name][age]
+	if !ok {
+		return nil
+	}
+
+	rng := make(map[int]float64, len(e.rng))
+	for px, p := range e.rng {
+		rng[px] = p
+	}
+	return rng
+}
+
+// Set sets a continuous range map
+// for a taxon at a given age
+// (in years).
+// A previous range of the taxon
+// at the same age will be replaced.
+func (c *Collection) Set(name string, age int64, rng map[int]float64) {
+	name = canon(name)
+	if name == "" {
+		return
+	}
+
+	var max float64
+	for _, p := range rng {
+		if p > max {
+			max = p
+		}
+	}
+	if max == 0 {
+		return
+	}
+
+	tax, ok := c.taxa[name]
+	if !ok {
+		tax = make(map[int64]*entry)
+		c.taxa[name] = tax
+	}
+	e := &entry{
+		tp:  ranges.Range,
+		rng: make(map[int]float64, len(rng)),
+	}
+	for px, p := range rng {
+		if p <= 0 {
+			continue
+		}
+		e.rng[px] = p / max
+	}
+	tax[age] = e
+}
+
+// Taxa returns an sorted slice
+// with the names of the taxa
+// in the collection.
+func (c *Collection) Taxa() []string {
+	taxa := make([]string, 0, len(c.taxa))
+	for name := range c.taxa {
+		taxa = append(taxa, name)
+	}
+	slices.Sort(taxa)
+	return taxa
+}
+
+// Type returns the type of the range map
+// of a taxon at a given age.
+func (c *Collection) Type(name string, age int64) ranges.Type {
+	name = canon(name)
+	if name == "" {
+		return ""
+	}
+
+	e, ok := c.taxa[name][age]
+	if !ok {
+		return ""
+	}
+	return e.tp
+}
+
+func (c *Collection) entry(name string, age int64, tp ranges.Type) *entry {
+	tax, ok := c.taxa[name]
+	if !ok {
+		tax = make(map[int64]*entry)
+		c.taxa[name] = tax
+	}
+	e, ok := tax[age]
+	if !ok {
+		e = &entry{
+			tp:  tp,
+			rng: make(map[int]float64),
+		}
+		tax[age] = e
+	}
+	return e
+}
+
+var headerFields = []string{
+	"taxon",
+	"type",
+	"age",
+	"equator",
+	"pixel",
+	"density",
+}
+
+// ReadTSV reads a collection of age-specific range maps
+// from a TSV file.
+//
+// The format is the same as the one used
+// by the ranges files
+// (see github.com/js-arias/ranges),
+// but a taxon can have ranges at different ages.
+// The TSV must contain the following columns:
+//
+//   - taxon, the name of the taxon
+//   - type, the type of the range model.
+//     Can be "points" (for presence-absence pixelation),
+//     or "range" (for a pixelated range map).
+//   - age, for the age stage of the pixels
+//     (in years)
+//   - equator, for the number of pixels in the equator
+//   - pixel, the ID of a pixel (from the pixelation)
+//   - density, the density for the presence at that pixel
+//
+// Here is an example file:
+//
+//	# age-specific range distribution models
+//	taxon	type	age	equator	pixel	density
+//	Brontostoma discus	points	0	360	17319	1.000000
+//	Brontostoma discus	points	5000000	360	19117	1.000000
+//	Brontostoma discus	points	12000000	360	20113	1.000000
+func ReadTSV(r io.Reader, pix *earth.Pixelation) (*Collection, error) {
+	tab := csv.NewReader(r)
+	tab.Comma = '\t'
+	tab.Comment = '#'
+
+	head, err := tab.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range headerFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	var c *Collection
+	for {
+		row, err := tab.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tab.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "equator"
+		eq, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if pix == nil {
+			pix = earth.NewPixelation(eq)
+		}
+		if pix.Equator() != eq {
+			return nil, fmt.Errorf("on row %d: field %q: got %d, want %d", ln, f, eq, pix.Equator())
+		}
+
+		if c == nil {
+			c = New(pix)
+		}
+
+		f = "type"
+		var tp ranges.Type
+		switch strings.ToLower(row[fields[f]]) {
+		case string(ranges.Points):
+			tp = ranges.Points
+		case string(ranges.Range):
+			tp = ranges.Range
+		case "":
+			tp = ranges.Points
+		default:
+			return nil, fmt.Errorf("on row %d: field %q: invalid type %q", ln, f, row[fields[f]])
+		}
+
+		f = "age"
+		age, err := strconv.ParseInt(row[fields[f]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+
+		f = "taxon"
+		nm := canon(row[fields[f]])
+		if nm == "" {
+			continue
+		}
+		e := c.entry(nm, age, tp)
+		if e.tp != tp {
+			return nil, fmt.Errorf("on row %d: field %q: invalid type: got %q, want %q", ln, f, tp, e.tp)
+		}
+
+		f = "pixel"
+		px, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if px >= pix.Len() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, px)
+		}
+
+		density := float64(1)
+		if e.tp == ranges.Range {
+			f = "density"
+			d, err := strconv.ParseFloat(row[fields[f]], 64)
+			if err != nil {
+				return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+			}
+			density = d
+		}
+		e.rng[px] = density
+	}
+	if c == nil {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+
+	// scale values
+	for _, tax := range c.taxa {
+		for _, e := range tax {
+			if e.tp == ranges.Points {
+				continue
+			}
+			var max float64
+			for _, p := range e.rng {
+				if p > max {
+					max = p
+				}
+			}
+			if max == 0 || max == 1 {
+				continue
+			}
+			for px, p := range e.rng {
+				e.rng[px] = p / max
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// TSV encodes the age-specific range maps
+// of a collection
+// to a TSV file.
+func (c *Collection) TSV(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# age-specific range distribution models\n")
+	fmt.Fprintf(bw, "# data save on: %s\n", time.Now().Format(time.RFC3339))
+
+	tab := csv.NewWriter(bw)
+	tab.Comma = '\t'
+	tab.UseCRLF = true
+
+	if err := tab.Write(headerFields); err != nil {
+		return fmt.Errorf("unable to write header: %v", err)
+	}
+
+	eq := strconv.Itoa(c.pix.Equator())
+	for _, nm := range c.Taxa() {
+		for _, age := range c.Ages(nm) {
+			e := c.taxa[nm][age]
+			pixels := make([]int, 0, len(e.rng))
+			for px := range e.rng {
+				pixels = append(pixels, px)
+			}
+			slices.Sort(pixels)
+
+			for _, px := range pixels {
+				row := []string{
+					nm,
+					string(e.tp),
+					strconv.FormatInt(age, 10),
+					eq,
+					strconv.Itoa(px),
+					strconv.FormatFloat(e.rng[px], 'f', 6, 64),
+				}
+				if err := tab.Write(row); err != nil {
+					return fmt.Errorf("unable to write data: %v", err)
+				}
+			}
+		}
+	}
+
+	tab.Flush()
+	if err := tab.Error(); err != nil {
+		return fmt.Errorf("unable to write data: %v", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("unable to write data: %v", err)
+	}
+	return nil
+}
+
+// Canon returns a taxon name
+// in its canonical form
+// (i.e., the same form used
+// by a ranges collection).
+func canon(name string) string {
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" {
+		return ""
+	}
+	name = strings.ToLower(name)
+	r, n := utf8.DecodeRuneInString(name)
+	return string(unicode.ToUpper(r)) + name[n:]
+}
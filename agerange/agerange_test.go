@@ -0,0 +1,95 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package agerange_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/js-arias/earth"
+	"github.com/js-arias/phygeo/agerange"
+	"github.com/js-arias/ranges"
+)
+
+func TestReadTSV(t *testing.T) {
+	data := `# age-specific ranges
+taxon	type	age	equator	pixel	density
+brontostoma discus	points	0	360	17319	1.000000
+Brontostoma discus	points	5000000	360	19117	1.000000
+Brontostoma discus	points	5000000	360	19118	1.000000
+Eoraptor lunensis	range	230000000	360	34661	0.200000
+Eoraptor lunensis	range	230000000	360	34662	0.400000
+`
+	c, err := agerange.ReadTSV(strings.NewReader(data), nil)
+	if err != nil {
+		t.Fatalf("unable to read data: %v", err)
+	}
+	testCollection(t, "read", c)
+
+	var buf bytes.Buffer
+	if err := c.TSV(&buf); err != nil {
+		t.Fatalf("unable to write data: %v", err)
+	}
+	c, err = agerange.ReadTSV(&buf, nil)
+	if err != nil {
+		t.Fatalf("unable to read written data: %v", err)
+	}
+	testCollection(t, "write", c)
+}
+
+func TestReadTSVError(t *testing.T) {
+	data := `taxon	type	age	equator	pixel	density
+Brontostoma discus	points	0	360	17319	1.000000
+Brontostoma discus	range	0	360	19117	1.000000
+`
+	if _, err := agerange.ReadTSV(strings.NewReader(data), nil); err == nil {
+		t.Errorf("mixed types: expecting error")
+	}
+}
+
+func TestSet(t *testing.T) {
+	c := agerange.New(earth.NewPixelation(360))
+	c.AddPixel("Brontostoma discus", 0, 17319)
+	c.Set("Brontostoma discus", 5_000_000, map[int]float64{19117: 2, 19118: 1, 19119: 0})
+
+	if got, want := c.Ages("brontostoma discus"), []int64{0, 5_000_000}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ages: got %v, want %v", got, want)
+	}
+	if tp := c.Type("Brontostoma discus", 5_000_000); tp != ranges.Range {
+		t.Errorf("type: got %q, want %q", tp, ranges.Range)
+	}
+	want := map[int]float64{19117: 1, 19118: 0.5}
+	if got := c.Range("Brontostoma discus", 5_000_000); !reflect.DeepEqual(got, want) {
+		t.Errorf("range: got %v, want %v", got, want)
+	}
+	if rng := c.Range("Brontostoma discus", 1_000_000); rng != nil {
+		t.Errorf("range at undefined age: got %v, want nil", rng)
+	}
+}
+
+func testCollection(t testing.TB, name string, c *agerange.Collection) {
+	t.Helper()
+
+	if got, want := c.Taxa(), []string{"Brontostoma discus", "Eoraptor lunensis"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: taxa: got %v, want %v", name, got, want)
+	}
+	if got, want := c.Ages("Brontostoma discus"), []int64{0, 5_000_000}; !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: ages: got %v, want %v", name, got, want)
+	}
+
+	want := map[int]float64{19117: 1, 19118: 1}
+	if got := c.Range("Brontostoma discus", 5_000_000); !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: range at 5 Ma: got %v, want %v", name, got, want)
+	}
+	if tp := c.Type("Eoraptor lunensis", 230_000_000); tp != ranges.Range {
+		t.Errorf("%s: type: got %q, want %q", name, tp, ranges.Range)
+	}
+	want = map[int]float64{34661: 0.5, 34662: 1}
+	if got := c.Range("Eoraptor lunensis", 230_000_000); !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: range at 230 Ma: got %v, want %v", name, got, want)
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package bundle implements reading and writing
+// of reconstruction bundles.
+//
+// A reconstruction bundle is a single zip file
+// that contains one or more reconstructions
+// (for example, a pixel frequency file),
+// together with the project datasets
+// required to draw or summarize them
+// (e.g., the trees, the landscape,
+// and the plate motion model),
+// and optionally,
+// a color key,
+// so the results can be rendered again
+// without the original project files.
+//
+// Inside the bundle,
+// the project file is stored as "project.tab",
+// the datasets are stored in the "data" directory,
+// the reconstructions in the "rec" directory,
+// and the color key as "key.tab".
+// The paths of the project file
+// are the names of the datasets inside the bundle.
+package bundle
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/version"
+)
+
+// Names of the files
+// and directories
+// inside a bundle.
+const (
+	ProjectFile = "project.tab"
+	KeyFile     = "key.tab"
+	DataDir     = "data"
+	RecDir      = "rec"
+)
+
+// Is returns true if the file is a zip file,
+// and then, a possible reconstruction bundle.
+func Is(name string) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, []byte("PK\x03\x04"))
+}
+
+// A Bundle is a reconstruction bundle
+// open for reading.
+type Bundle struct {
+	zr    *zip.ReadCloser
+	files map[string]*zip.File
+	p     *project.Project
+}
+
+// Open opens a reconstruction bundle.
+func Open(name string) (*Bundle, error) {
+	zr, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Bundle{
+		zr:    zr,
+		files: make(map[string]*zip.File, len(zr.File)),
+	}
+	for _, f := range zr.File {
+		b.files[f.Name] = f
+	}
+
+	pf, err := b.Open(ProjectFile)
+	if err != nil {
+		zr.Close()
+		return nil, fmt.Errorf("on bundle %q: %v", name, err)
+	}
+	defer pf.Close()
+
+	b.p, err = project.ReadTSV(pf)
+	if err != nil {
+		zr.Close()
+		return nil, fmt.Errorf("on bundle %q: file %q: %v", name, ProjectFile, err)
+	}
+	return b, nil
+}
+
+// Close closes the bundle.
+func (b *Bundle) Close() error {
+	return b.zr.Close()
+}
+
+// Project returns the project stored in the bundle.
+// The paths of the project
+// are the names of the files inside the bundle.
+func (b *Bundle) Project() *project.Project {
+	return b.p
+}
+
+// Open opens a file stored in the bundle.
+func (b *Bundle) Open(name string) (io.ReadCloser, error) {
+	f, ok := b.files[name]
+	if !ok {
+		return nil, fmt.Errorf("file %q not found in bundle", name)
+	}
+	return f.Open()
+}
+
+// Key returns the name of the color key
+// stored in the bundle.
+// If the bundle does not have a key,
+// it returns an empty string.
+func (b *Bundle) Key() string {
+	if _, ok := b.files[KeyFile]; !ok {
+		return ""
+	}
+	return KeyFile
+}
+
+// Recs returns the names of the reconstruction files
+// stored in the bundle.
+func (b *Bundle) Recs() []string {
+	var recs []string
+	for name := range b.files {
+		if strings.HasPrefix(name, RecDir+"/") {
+			recs = append(recs, name)
+		}
+	}
+	slices.Sort(recs)
+	return recs
+}
+
+// Rec returns the name in the bundle
+// of a reconstruction file,
+// using the base name of the file.
+func (b *Bundle) Rec(name string) (string, bool) {
+	rn := path.Join(RecDir, filepath.Base(name))
+	if _, ok := b.files[rn]; !ok {
+		return "", false
+	}
+	return rn, true
+}
+
+// A Writer writes a reconstruction bundle.
+type Writer struct {
+	zw    *zip.Writer
+	p     *project.Project
+	names map[string]bool
+}
+
+// NewWriter creates a new bundle writer.
+func NewWriter(w io.Writer) *Writer {
+	zw := zip.NewWriter(w)
+	zw.SetComment(fmt.Sprintf("phygeo reconstruction bundle (phygeo %s)", version.String()))
+	return &Writer{
+		zw:    zw,
+		p:     project.New(),
+		names: make(map[string]bool),
+	}
+}
+
+// AddData adds a dataset of the project to the bundle,
+// reading its content from r.
+func (w *Writer) AddData(set project.Dataset, name string, r io.Reader) error {
+	bn := path.Join(DataDir, string(set), filepath.Base(name))
+	if err := w.add(bn, r); err != nil {
+		return err
+	}
+	w.p.Add(set, bn)
+	return nil
+}
+
+// AddRec adds a reconstruction file to the bundle,
+// reading its content from r.
+// The reconstruction will be stored
+// using the base name of the file.
+func (w *Writer) AddRec(name string, r io.Reader) error {
+	return w.add(path.Join(RecDir, filepath.Base(name)), r)
+}
+
+// AddKey adds a color key to the bundle,
+// reading its content from r.
+func (w *Writer) AddKey(r io.Reader) error {
+	return w.add(KeyFile, r)
+}
+
+func (w *Writer) add(name string, r io.Reader) error {
+	if w.names[name] {
+		return fmt.Errorf("file %q already in bundle", name)
+	}
+	w.names[name] = true
+
+	f, err := w.zw.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("while writing %q in bundle: %v", name, err)
+	}
+	return nil
+}
+
+// Close writes the project file of the bundle
+// and closes the writer.
+// It does not close the underlying writer.
+func (w *Writer) Close() error {
+	f, err := w.zw.Create(ProjectFile)
+	if err != nil {
+		return err
+	}
+	if err := w.p.TSV(f); err != nil {
+		return fmt.Errorf("while writing %q in bundle: %v", ProjectFile, err)
+	}
+	return w.zw.Close()
+}
@@ -0,0 +1,101 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package bundle_test
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/js-arias/phygeo/bundle"
+	"github.com/js-arias/phygeo/project"
+)
+
+func TestBundle(t *testing.T) {
+	name := "tmp-bundle-for-test.zip"
+	defer os.Remove(name)
+
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatalf("unable to create file: %v", err)
+	}
+	w := bundle.NewWriter(f)
+	if err := w.AddData(project.Trees, "data/trees.tab", strings.NewReader("trees")); err != nil {
+		t.Fatalf("error when adding trees: %v", err)
+	}
+	if err := w.AddData(project.Landscape, "landscape.tab", strings.NewReader("landscape")); err != nil {
+		t.Fatalf("error when adding landscape: %v", err)
+	}
+	if err := w.AddRec("out/freq-rec.tab", strings.NewReader("freq")); err != nil {
+		t.Fatalf("error when adding reconstruction: %v", err)
+	}
+	if err := w.AddRec("freq-rec.tab", strings.NewReader("freq")); err == nil {
+		t.Errorf("adding a repeated reconstruction: expecting error")
+	}
+	if err := w.AddKey(strings.NewReader("key")); err != nil {
+		t.Fatalf("error when adding key: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("error when closing bundle: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("error when closing file: %v", err)
+	}
+
+	if !bundle.Is(name) {
+		t.Fatalf("file %q: expecting a bundle", name)
+	}
+
+	b, err := bundle.Open(name)
+	if err != nil {
+		t.Fatalf("error when opening bundle: %v", err)
+	}
+	defer b.Close()
+
+	p := b.Project()
+	testContent(t, b, p.Path(project.Trees), "trees")
+	testContent(t, b, p.Path(project.Landscape), "landscape")
+	if path := p.Path(project.Ranges); path != "" {
+		t.Errorf("set %s: got path %q, want %q", project.Ranges, path, "")
+	}
+
+	if b.Key() != bundle.KeyFile {
+		t.Errorf("key: got %q, want %q", b.Key(), bundle.KeyFile)
+	}
+	testContent(t, b, b.Key(), "key")
+
+	want := []string{"rec/freq-rec.tab"}
+	if recs := b.Recs(); !reflect.DeepEqual(recs, want) {
+		t.Errorf("reconstructions: got %v, want %v", recs, want)
+	}
+	rn, ok := b.Rec("some/path/freq-rec.tab")
+	if !ok {
+		t.Fatalf("reconstruction %q not found", "freq-rec.tab")
+	}
+	testContent(t, b, rn, "freq")
+	if _, ok := b.Rec("kde-rec.tab"); ok {
+		t.Errorf("reconstruction %q: found, want not found", "kde-rec.tab")
+	}
+}
+
+func testContent(t testing.TB, b *bundle.Bundle, name, want string) {
+	t.Helper()
+
+	f, err := b.Open(name)
+	if err != nil {
+		t.Fatalf("file %q: %v", name, err)
+	}
+	defer f.Close()
+
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("file %q: %v", name, err)
+	}
+	if string(got) != want {
+		t.Errorf("file %q: got %q, want %q", name, got, want)
+	}
+}
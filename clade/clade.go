@@ -0,0 +1,305 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package clade implements a collection
+// of clade labels.
+//
+// A clade label is a name
+// assigned to the most recent common ancestor
+// of a set of terminals,
+// so a node can be identified
+// without using its ID,
+// which might change after a tree is edited,
+// and the same label can be used
+// in different trees.
+package clade
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/js-arias/timetree"
+)
+
+// A Label is a name of a clade.
+type Label struct {
+	// Name of the label
+	Name string
+
+	// Terms are the terminals
+	// that define the clade
+	// as its most recent common ancestor
+	Terms []string
+}
+
+// A Collection is a collection of clade labels.
+type Collection struct {
+	labels map[string]*Label
+}
+
+// New creates a new empty collection.
+func New() *Collection {
+	return &Collection{
+		labels: make(map[string]*Label),
+	}
+}
+
+// Add adds a label to the collection.
+// If a label with the same name
+// is already in the collection,
+// it will be replaced.
+//
+// As labels are used in place of node IDs,
+// a label can not be a number.
+func (c *Collection) Add(name string, terms []string) error {
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" {
+		return errors.New("empty label name")
+	}
+	if _, err := strconv.Atoi(name); err == nil {
+		return fmt.Errorf("label %q: a label can not be a number", name)
+	}
+	if strings.Contains(name, ",") {
+		return fmt.Errorf("label %q: a label can not contain commas", name)
+	}
+
+	ts := canonTerms(terms)
+	if len(ts) == 0 {
+		return fmt.Errorf("label %q: without terminals", name)
+	}
+
+	c.labels[strings.ToLower(name)] = &Label{
+		Name:  name,
+		Terms: ts,
+	}
+	return nil
+}
+
+// Delete removes a label from the collection.
+func (c *Collection) Delete(name string) {
+	name = strings.ToLower(strings.Join(strings.Fields(name), " "))
+	delete(c.labels, name)
+}
+
+// Label returns a label of the collection.
+// Labels are case insensitive.
+func (c *Collection) Label(name string) *Label {
+	name = strings.ToLower(strings.Join(strings.Fields(name), " "))
+	lb, ok := c.labels[name]
+	if !ok {
+		return nil
+	}
+	return &Label{
+		Name:  lb.Name,
+		Terms: slices.Clone(lb.Terms),
+	}
+}
+
+// Names returns the names of the labels
+// in the collection,
+// sorted alphabetically.
+func (c *Collection) Names() []string {
+	names := make([]string, 0, len(c.labels))
+	for _, lb := range c.labels {
+		names = append(names, lb.Name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+	})
+	return names
+}
+
+// Node returns the ID of the node of a label
+// in a tree.
+// It returns -1 if the label is not defined,
+// or if the terminals of the label
+// are not in the tree.
+func (c *Collection) Node(t *timetree.Tree, name string) int {
+	name = strings.ToLower(strings.Join(strings.Fields(name), " "))
+	lb, ok := c.labels[name]
+	if !ok {
+		return -1
+	}
+	return t.MRCA(lb.Terms...)
+}
+
+// Nodes returns the IDs of the nodes of a tree
+// from a list of node IDs
+// or clade labels,
+// separated by commas
+// (for example, "0,felids,12").
+// Labels with terminals not in the tree
+// are ignored.
+// The collection can be nil,
+// in which case only node IDs are accepted.
+// The tree can be nil
+// if the list has only node IDs.
+func Nodes(c *Collection, t *timetree.Tree, list string) ([]int, error) {
+	var nodes []int
+	for _, v := range strings.Split(list, ",") {
+		v = strings.Join(strings.Fields(v), " ")
+		if v == "" {
+			continue
+		}
+		if id, err := strconv.Atoi(v); err == nil {
+			nodes = append(nodes, id)
+			continue
+		}
+		if c == nil || c.Label(v) == nil {
+			return nil, fmt.Errorf("label %q not defined", v)
+		}
+		if t == nil {
+			return nil, fmt.Errorf("label %q: undefined tree", v)
+		}
+		if id := c.Node(t, v); id >= 0 {
+			nodes = append(nodes, id)
+		}
+	}
+	slices.Sort(nodes)
+	return slices.Compact(nodes), nil
+}
+
+var headerFields = []string{
+	"clade",
+	"taxon",
+}
+
+// ReadTSV reads a collection of clade labels
+// from a TSV file.
+//
+// The TSV must contain the following columns:
+//
+//   - clade, the name of the label
+//   - taxon, the name of a terminal of the clade
+//
+// Each row is a terminal of the clade,
+// so the same file can be used
+// to define the clades of commands
+// that aggregate the results by clade.
+// A file without rows
+// is read as an empty collection.
+//
+// Here is an example file:
+//
+//	# clade labels
+//	clade	taxon
+//	felids	Panthera leo
+//	felids	Felis catus
+//	canids	Canis lupus
+//	canids	Vulpes vulpes
+func ReadTSV(r io.Reader) (*Collection, error) {
+	tab := csv.NewReader(r)
+	tab.Comma = '\t'
+	tab.Comment = '#'
+
+	head, err := tab.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range headerFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	var names []string
+	terms := make(map[string][]string)
+	for {
+		row, err := tab.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tab.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "clade"
+		name := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if name == "" {
+			continue
+		}
+
+		f = "taxon"
+		tax := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if tax == "" {
+			continue
+		}
+
+		key := strings.ToLower(name)
+		if _, ok := terms[key]; !ok {
+			names = append(names, name)
+		}
+		terms[key] = append(terms[key], tax)
+	}
+	c := New()
+	for _, name := range names {
+		if err := c.Add(name, terms[strings.ToLower(name)]); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// TSV encodes the labels of a collection
+// to a TSV file.
+func (c *Collection) TSV(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# clade labels\n")
+	fmt.Fprintf(bw, "# data save on: %s\n", time.Now().Format(time.RFC3339))
+
+	tab := csv.NewWriter(bw)
+	tab.Comma = '\t'
+	tab.UseCRLF = true
+
+	if err := tab.Write(headerFields); err != nil {
+		return fmt.Errorf("unable to write header: %v", err)
+	}
+
+	for _, nm := range c.Names() {
+		lb := c.labels[strings.ToLower(nm)]
+		for _, tax := range lb.Terms {
+			if err := tab.Write([]string{lb.Name, tax}); err != nil {
+				return fmt.Errorf("unable to write data: %v", err)
+			}
+		}
+	}
+
+	tab.Flush()
+	if err := tab.Error(); err != nil {
+		return fmt.Errorf("unable to write data: %v", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("unable to write data: %v", err)
+	}
+	return nil
+}
+
+// CanonTerms returns the terminal names
+// in its canonical form,
+// sorted and without duplicates.
+func canonTerms(terms []string) []string {
+	ts := make([]string, 0, len(terms))
+	for _, t := range terms {
+		t = strings.Join(strings.Fields(t), " ")
+		if t == "" {
+			continue
+		}
+		ts = append(ts, t)
+	}
+	slices.Sort(ts)
+	return slices.Compact(ts)
+}
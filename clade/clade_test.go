@@ -0,0 +1,105 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package clade_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/js-arias/phygeo/clade"
+	"github.com/js-arias/timetree"
+)
+
+func TestReadTSV(t *testing.T) {
+	data := `# clade labels
+clade	taxon
+felids	Panthera leo
+felids	Felis catus
+Carnivora	Felis catus
+Carnivora	Canis lupus
+`
+	c, err := clade.ReadTSV(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("unable to read data: %v", err)
+	}
+	testCollection(t, "read", c)
+
+	var buf bytes.Buffer
+	if err := c.TSV(&buf); err != nil {
+		t.Fatalf("unable to write data: %v", err)
+	}
+	c, err = clade.ReadTSV(&buf)
+	if err != nil {
+		t.Fatalf("unable to read written data: %v", err)
+	}
+	testCollection(t, "write", c)
+}
+
+func testCollection(t testing.TB, name string, c *clade.Collection) {
+	t.Helper()
+
+	names := []string{"Carnivora", "felids"}
+	if got := c.Names(); !reflect.DeepEqual(got, names) {
+		t.Errorf("%s: names: got %v, want %v", name, got, names)
+	}
+
+	lb := c.Label("FELIDS")
+	if lb == nil {
+		t.Fatalf("%s: label %q not found", name, "felids")
+	}
+	terms := []string{"Felis catus", "Panthera leo"}
+	if !reflect.DeepEqual(lb.Terms, terms) {
+		t.Errorf("%s: label %q: terms: got %v, want %v", name, lb.Name, lb.Terms, terms)
+	}
+}
+
+func TestAddError(t *testing.T) {
+	tests := map[string]struct {
+		name  string
+		terms []string
+	}{
+		"empty name":      {"", []string{"Felis catus"}},
+		"number":          {"12", []string{"Felis catus"}},
+		"comma":           {"felids,canids", []string{"Felis catus"}},
+		"empty terminals": {"felids", []string{" "}},
+	}
+	c := clade.New()
+	for name, test := range tests {
+		if err := c.Add(test.name, test.terms); err == nil {
+			t.Errorf("%s: expecting error", name)
+		}
+	}
+}
+
+func TestNodes(t *testing.T) {
+	tc, err := timetree.Newick(strings.NewReader("((Panthera_leo:10,Felis_catus:10):20,Canis_lupus:30);"), "carnivores", 30_000_000)
+	if err != nil {
+		t.Fatalf("unable to build tree: %v", err)
+	}
+	tree := tc.Tree("carnivores")
+
+	c := clade.New()
+	c.Add("felids", []string{"Panthera leo", "Felis catus"})
+	c.Add("bears", []string{"Ursus arctos", "Ursus americanus"})
+
+	felids := tree.MRCA("Panthera leo", "Felis catus")
+	got, err := clade.Nodes(c, tree, "0, felids,bears,0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []int{0, felids}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("nodes: got %v, want %v", got, want)
+	}
+
+	if _, err := clade.Nodes(c, tree, "0,canids"); err == nil {
+		t.Errorf("undefined label: expecting error")
+	}
+	if _, err := clade.Nodes(nil, tree, "felids"); err == nil {
+		t.Errorf("nil collection: expecting error")
+	}
+}
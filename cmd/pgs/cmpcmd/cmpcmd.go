@@ -10,7 +10,6 @@ import (
 	"encoding/csv"
 	"errors"
 	"fmt"
-	"image/color"
 	"io"
 	"math"
 	"os"
@@ -22,9 +21,10 @@ import (
 	"github.com/js-arias/command"
 	"github.com/js-arias/earth"
 	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/internal/chart"
 	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/version"
 	"github.com/js-arias/timetree"
-	"gonum.org/v1/plot"
 	"gonum.org/v1/plot/plotter"
 	"gonum.org/v1/plot/vg"
 )
@@ -32,7 +32,7 @@ import (
 var Command = &command.Command{
 	Usage: `cmp --got <file> --want <file>
 	--trees <file> [-o|--output <file>]
-	[--plot <file>]
+	[--plot <file>] [--theme <theme>] [--format <format>] [--plot-size <size>]
 	[--bound <value>]
 	<project>`,
 	Short: "compare two reconstructions",
@@ -60,7 +60,12 @@ as terminal nodes, are ignored.
 
 If the flag --plot is defined, a plot with the proportion of nodes in which
 the number of correct pixels is greater than the 45%, will be saved in the
-indicated file.
+indicated file. By default, the plot is a PNG image of 5x3 inches, with a
+light theme. Use the flag --format to define the output format ("png", "svg",
+or "pdf"; the extension of the format is added to the file name, if it is
+missing), the flag --plot-size to define the size of the plot, in inches, as
+"<width>x<height>" (for example "8x5"), and the flag --theme to define the
+color theme ("light" or "dark").
 	`,
 	SetFlags: setFlags,
 	Run:      run,
@@ -71,6 +76,9 @@ var wantFile string
 var treeFile string
 var output string
 var plotFile string
+var themeFlag string
+var formatFlag string
+var plotSize string
 var bound float64
 
 func setFlags(c *command.Command) {
@@ -80,6 +88,9 @@ func setFlags(c *command.Command) {
 	c.Flags().StringVar(&output, "output", "", "")
 	c.Flags().StringVar(&output, "o", "", "")
 	c.Flags().StringVar(&plotFile, "plot", "", "")
+	c.Flags().StringVar(&themeFlag, "theme", "light", "")
+	c.Flags().StringVar(&formatFlag, "format", chart.PNG, "")
+	c.Flags().StringVar(&plotSize, "plot-size", "", "")
 	c.Flags().Float64Var(&bound, "bound", 0.95, "")
 }
 
@@ -100,6 +111,13 @@ func run(c *command.Command, args []string) (err error) {
 	if output == "" {
 		output = fmt.Sprintf("%s-pixel-results.tab", args[0])
 	}
+	var style chart.Style
+	if plotFile != "" {
+		style, err = chart.NewStyle(themeFlag, formatFlag, plotSize, 5*vg.Inch, 3*vg.Inch)
+		if err != nil {
+			return c.UsageError(err.Error())
+		}
+	}
 
 	p, err := project.Read(args[0])
 	if err != nil {
@@ -147,6 +165,7 @@ func run(c *command.Command, args []string) (err error) {
 	date := time.Now().Format(time.RFC3339)
 	fmt.Fprintf(f, "# results from simulated data from project %q\n", args[0])
 	fmt.Fprintf(f, "# date: %s\n", date)
+	fmt.Fprintf(f, "# pgs: %s\n", version.String())
 	fmt.Fprintf(f, "tree\tnode\tage\tpixels\tfarthest\n")
 	for _, tn := range tc.Names() {
 		gt, ok := got[tn]
@@ -225,7 +244,7 @@ func run(c *command.Command, args []string) (err error) {
 	}
 
 	if plotFile != "" {
-		if err := makePlot(freq); err != nil {
+		if err := makePlot(freq, style); err != nil {
 			return err
 		}
 	}
@@ -451,8 +470,8 @@ func readRecon(name string, landscape *model.TimePix, coll *timetree.Collection)
 	return rt, nil
 }
 
-func makePlot(freq map[string][]int) error {
-	p := plot.New()
+func makePlot(freq map[string][]int, style chart.Style) error {
+	p := style.New()
 	p.Y.Label.Text = "nodes (proportion)"
 
 	// width of each column
@@ -502,7 +521,7 @@ func makePlot(freq map[string][]int) error {
 			return fmt.Errorf("while building chart: %v", err)
 		}
 		bars.LineStyle.Width = vg.Length(0)
-		bars.Color = color.Gray{grayScale[i]}
+		bars.Color = style.Theme.Ramp(1 - float64(grayScale[i])/255)
 
 		if prev != nil {
 			bars.StackOn(prev)
@@ -513,7 +532,7 @@ func makePlot(freq map[string][]int) error {
 	p.Y.Min = 0
 	p.Y.Max = 1
 
-	if err := p.Save(5*vg.Inch, 3*vg.Inch, plotFile); err != nil {
+	if err := style.Save(p, plotFile); err != nil {
 		return err
 	}
 	return nil
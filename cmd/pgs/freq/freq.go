@@ -27,6 +27,7 @@ import (
 	"github.com/js-arias/earth/stat/dist"
 	"github.com/js-arias/earth/stat/pixweight"
 	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/version"
 )
 
 var Command = &command.Command{
@@ -391,6 +392,7 @@ func writeFrequencies(rt map[string]*recTree, name, p, tp string, numPix, eq int
 		fmt.Fprintf(w, "# KDE smoothing: lambda %.6f * 1/radian^2\n", kdeLambda)
 	}
 	fmt.Fprintf(w, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "# pgs: %s\n", version.String())
 
 	tsv := csv.NewWriter(w)
 	tsv.Comma = '\t'
@@ -11,6 +11,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/rand/v2"
 	"os"
 	"runtime"
 	"strconv"
@@ -23,16 +25,21 @@ import (
 	"github.com/js-arias/earth/stat/dist"
 	"github.com/js-arias/earth/stat/pixweight"
 	"github.com/js-arias/phygeo/infer/diffusion"
+	"github.com/js-arias/phygeo/internal/chart"
 	"github.com/js-arias/phygeo/project"
 	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/phygeo/version"
 	"github.com/js-arias/ranges"
 	"github.com/js-arias/timetree"
+	"gonum.org/v1/plot/vg"
 )
 
 var Command = &command.Command{
 	Usage: `infer -i|--input <prefix> [-o|--output <prefix>]
-	[--cpu <number>]
+	[--cpu <number>] [--starts <number>] [--tol <value>]
 	[-p|--particles <number>]
+	[--bins <number>] [--plot]
+	[--theme <theme>] [--format <format>] [--plot-size <size>]
 	<project-file>`,
 	Short: "infer parameters from simulated data",
 	Long: `
@@ -54,6 +61,52 @@ stochastic mapping for the lambda value estimated with maximum likelihood. The
 lambda values are stored in '<prefix>-infer-lambda.tab'. If no prefix is
 defined, the command will use the prefix used for the input.
 
+The maximum likelihood estimate of lambda is searched with a stepwise hill
+climbing that starts at lambda = 100, and halves the step size each time the
+likelihood cannot be improved. As the search can stall on flat likelihood
+surfaces, the flag --starts defines the number of starting points of the
+search (by default, 1). The first start is always at lambda = 100, the others
+are random values taken from a log-uniform distribution between 1 and 1000.
+The search of each start stops when the step size is smaller than the
+tolerance value (in lambda units). By default, the tolerance is 0.5; use the
+flag --tol to change it.
+
+For each tree, the likelihood interval of lambda (i.e., the lambda values
+with a log-likelihood within 1.92 units of the maximum, an approximate 95%
+confidence interval) is searched by doubling (or halving) lambda from the
+estimated value until the likelihood falls below the interval, and then
+bisecting the bound up to the tolerance value. If the upper bound is beyond
+the biggest lambda value that can be used with the pixelation, it will be
+reported as '+Inf'.
+
+Besides the simulated and estimated lambda values, and the bounds of the
+likelihood interval ('ci-low' and 'ci-high'), the file with the lambda values
+includes the following convergence diagnostics for each tree:
+
+	logLike  the log likelihood of the estimated lambda
+	starts   the number of starting points of the search
+	hits     the number of starts that converge into the estimated lambda
+	         (i.e., the difference is smaller than twice the tolerance)
+	evals    the total number of likelihood evaluations
+	step     the final step size of the best start (if it is greater than
+	         the tolerance, the search stopped because lambda was too big)
+
+To evaluate if a design has enough signal to estimate lambda, a power summary
+is stored in '<prefix>-infer-power.tab'. For each design variable (the number
+of terminals 'terms', the root age in million years 'rootAge', and the
+simulated 'lambda'), the trees are grouped in intervals of equal width, and
+the mean relative error of the lambda estimates, as well as the proportion of
+trees in which the simulated lambda is inside the likelihood interval (the
+coverage) are reported. By default, five intervals are used for each
+variable; use the flag --bins to change the number of intervals. If the flag
+--plot is defined, a plot of the error and coverage will be stored for each
+design variable, in files named '<prefix>-power-<variable>.png'. By default,
+the plots are PNG images of 5x3 inches with a light theme; use the flag
+--format to define a different format ("png", "svg", or "pdf", that will be
+used as the file extension), the flag --plot-size to define the size, in
+inches, as "<width>x<height>" (for example "8x5"), and the flag --theme to
+define the color theme ("light" or "dark").
+
 By default, the calculations will use all available CPUs. Use the flag --cpu
 to change the number of processors.
 
@@ -69,6 +122,13 @@ var input string
 var output string
 var numParticles int
 var numCPU int
+var numStarts int
+var tolerance float64
+var numBins int
+var plotFlag bool
+var themeFlag string
+var formatFlag string
+var plotSize string
 
 func setFlags(c *command.Command) {
 	c.Flags().StringVar(&input, "input", "", "")
@@ -78,6 +138,13 @@ func setFlags(c *command.Command) {
 	c.Flags().IntVar(&numParticles, "p", 1000, "")
 	c.Flags().IntVar(&numParticles, "particles", 1000, "")
 	c.Flags().IntVar(&numCPU, "cpu", runtime.GOMAXPROCS(0), "")
+	c.Flags().IntVar(&numStarts, "starts", 1, "")
+	c.Flags().Float64Var(&tolerance, "tol", 0.5, "")
+	c.Flags().IntVar(&numBins, "bins", 5, "")
+	c.Flags().BoolVar(&plotFlag, "plot", false, "")
+	c.Flags().StringVar(&themeFlag, "theme", "light", "")
+	c.Flags().StringVar(&formatFlag, "format", chart.PNG, "")
+	c.Flags().StringVar(&plotSize, "plot-size", "", "")
 }
 
 func run(c *command.Command, args []string) (err error) {
@@ -90,6 +157,22 @@ func run(c *command.Command, args []string) (err error) {
 	if output == "" {
 		output = input
 	}
+	if numStarts < 1 {
+		return c.UsageError("flag --starts: expecting at least one start")
+	}
+	if tolerance <= 0 {
+		return c.UsageError("flag --tol: value must be greater than 0")
+	}
+	if numBins < 1 {
+		return c.UsageError("flag --bins: expecting at least one interval")
+	}
+	var style chart.Style
+	if plotFlag {
+		style, err = chart.NewStyle(themeFlag, formatFlag, plotSize, 5*vg.Inch, 3*vg.Inch)
+		if err != nil {
+			return c.UsageError(err.Error())
+		}
+	}
 
 	p, err := project.Read(args[0])
 	if err != nil {
@@ -170,7 +253,8 @@ func run(c *command.Command, args []string) (err error) {
 	date := time.Now().Format(time.RFC3339)
 	fmt.Fprintf(f, "# results from simulated data from project %q\n", args[0])
 	fmt.Fprintf(f, "# date: %s\n", date)
-	fmt.Fprintf(f, "tree\tterms\trootAge\tlambda\tml-lambda\n")
+	fmt.Fprintf(f, "# pgs: %s\n", version.String())
+	fmt.Fprintf(f, "tree\tterms\trootAge\tlambda\tml-lambda\tci-low\tci-high\tlogLike\tstarts\thits\tevals\tstep\n")
 
 	pName := fmt.Sprintf("%s-infer-particles.tab", output)
 	ff, err := os.Create(pName)
@@ -190,6 +274,7 @@ func run(c *command.Command, args []string) (err error) {
 
 	diffusion.SetCPU(numCPU)
 
+	var done []*simResults
 	for _, tn := range tc.Names() {
 		r, ok := res[tn]
 		if !ok {
@@ -199,26 +284,11 @@ func run(c *command.Command, args []string) (err error) {
 		param.Stem = stem
 		param.Ranges = r.rng
 
-		param.Lambda = 100.0
-		r.df = diffusion.New(r.tree, param)
-		r.mlLambda = param.Lambda
-		r.logLike = r.df.DownPass()
-		r.goUp(param, 500.0)
+		r.multiStart(param)
+		r.interval(param)
+		done = append(done, r)
 
-		for step := 250.0; ; step = step / 2 {
-			r.search(param, step)
-			if step < 0.5 {
-				break
-			}
-
-			n := dist.NewNormal(r.mlLambda/5.0, param.Landscape.Pixelation())
-			if n.Prob(0) > 0.99 {
-				// the lambda value is too big
-				break
-			}
-		}
-
-		fmt.Fprintf(f, "%s\t%d\t%.3f\t%.6f\t%.6f\n", r.tree.Name(), len(r.tree.Terms()), float64(r.tree.Age(r.tree.Root()))/1_000_000, r.lambda, r.mlLambda)
+		fmt.Fprintf(f, "%s\t%d\t%.3f\t%.6f\t%.6f\t%.6f\t%.6f\t%.6f\t%d\t%d\t%d\t%.6f\n", r.tree.Name(), len(r.tree.Terms()), float64(r.tree.Age(r.tree.Root()))/1_000_000, r.lambda, r.mlLambda, r.ciLow, r.ciHigh, r.logLike, numStarts, r.hits, r.evals, r.step)
 		r.df.Simulate(numParticles)
 		for i := 0; i < numParticles; i++ {
 			if err := writeParticles(tsv, i, r.df, landscape.Pixelation().Equator()); err != nil {
@@ -231,6 +301,15 @@ func run(c *command.Command, args []string) (err error) {
 		return fmt.Errorf("while writing data on %q: %v", pName, err)
 	}
 
+	if err := writePower(fmt.Sprintf("%s-infer-power.tab", output), args[0], done); err != nil {
+		return err
+	}
+	if plotFlag {
+		if err := powerPlots(output, done, style); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -239,8 +318,85 @@ type simResults struct {
 	lambda   float64
 	mlLambda float64
 	logLike  float64
+	ciLow    float64
+	ciHigh   float64
 	rng      *ranges.Collection
 	df       *diffusion.Tree
+
+	// convergence diagnostics
+	evals int
+	step  float64
+	hits  int
+}
+
+// MultiStart searches the maximum likelihood estimate of lambda
+// from several starting points,
+// and keeps the best result.
+func (sr *simResults) multiStart(p diffusion.Param) {
+	type start struct {
+		lambda  float64
+		logLike float64
+		df      *diffusion.Tree
+		step    float64
+	}
+
+	var best start
+	found := make([]float64, 0, numStarts)
+	for i := 0; i < numStarts; i++ {
+		l := 100.0
+		if i > 0 {
+			// log-uniform between 1 and 1000
+			l = math.Pow(10, 3*rand.Float64())
+		}
+		sr.climb(p, l)
+		found = append(found, sr.mlLambda)
+		if i == 0 || sr.logLike > best.logLike {
+			best = start{
+				lambda:  sr.mlLambda,
+				logLike: sr.logLike,
+				df:      sr.df,
+				step:    sr.step,
+			}
+		}
+	}
+
+	sr.mlLambda = best.lambda
+	sr.logLike = best.logLike
+	sr.df = best.df
+	sr.step = best.step
+	sr.hits = 0
+	for _, l := range found {
+		if math.Abs(l-best.lambda) < 2*tolerance {
+			sr.hits++
+		}
+	}
+}
+
+// Climb performs a stepwise hill climbing
+// starting from the given lambda value.
+// The initial step size is proportional
+// to the starting lambda,
+// and it is halved until it is smaller than the tolerance.
+func (sr *simResults) climb(p diffusion.Param, lambda float64) {
+	p.Lambda = lambda
+	sr.df = diffusion.New(sr.tree, p)
+	sr.mlLambda = p.Lambda
+	sr.logLike = sr.df.DownPass()
+	sr.evals++
+	sr.goUp(p, lambda*5)
+
+	for sr.step = lambda * 2.5; ; sr.step = sr.step / 2 {
+		sr.search(p, sr.step)
+		if sr.step < tolerance {
+			break
+		}
+
+		n := dist.NewNormal(sr.mlLambda/5.0, p.Landscape.Pixelation())
+		if n.Prob(0) > 0.99 {
+			// the lambda value is too big
+			break
+		}
+	}
 }
 
 func (sr *simResults) goUp(p diffusion.Param, step float64) {
@@ -248,6 +404,7 @@ func (sr *simResults) goUp(p diffusion.Param, step float64) {
 		p.Lambda = sr.mlLambda + step
 		df := diffusion.New(sr.tree, p)
 		like := df.DownPass()
+		sr.evals++
 		if like < sr.logLike {
 			// we fail to improve
 			return
@@ -276,6 +433,7 @@ func (sr *simResults) search(p diffusion.Param, step float64) {
 	p.Lambda = sr.mlLambda + step
 	df := diffusion.New(sr.tree, p)
 	like := df.DownPass()
+	sr.evals++
 	if like > sr.logLike {
 		// we found an improvement
 		sr.mlLambda = p.Lambda
@@ -291,6 +449,7 @@ func (sr *simResults) search(p diffusion.Param, step float64) {
 	p.Lambda = sr.mlLambda - step
 	df = diffusion.New(sr.tree, p)
 	like = df.DownPass()
+	sr.evals++
 	if like > sr.logLike {
 		// we found an improvement
 		sr.mlLambda = p.Lambda
@@ -554,6 +713,7 @@ func outHeader(w io.Writer, p, date string) (*csv.Writer, error) {
 	fmt.Fprintf(w, "# stochastic mapping on simulated data from project %q\n", p)
 	fmt.Fprintf(w, "# up-pass particles: %d\n", numParticles)
 	fmt.Fprintf(w, "# date: %s\n", date)
+	fmt.Fprintf(w, "# pgs: %s\n", version.String())
 
 	tsv := csv.NewWriter(w)
 	tsv.Comma = '\t'
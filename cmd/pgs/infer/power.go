@@ -0,0 +1,272 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package infer
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/js-arias/earth/stat/dist"
+	"github.com/js-arias/phygeo/infer/diffusion"
+	"github.com/js-arias/phygeo/internal/chart"
+	"github.com/js-arias/phygeo/version"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+)
+
+// CIDelta is the difference in log-likelihood
+// from the maximum
+// of the bounds of the likelihood interval.
+// It is the half of the 0.95 quantile
+// of a chi-square distribution with one degree of freedom.
+const ciDelta = 1.92
+
+// Interval calculates the likelihood interval of lambda,
+// i.e., the lambda values with a log-likelihood
+// within ciDelta units of the maximum,
+// which is an approximate 95% confidence interval.
+func (sr *simResults) interval(p diffusion.Param) {
+	min := sr.logLike - ciDelta
+	like := func(l float64) float64 {
+		p.Lambda = l
+		df := diffusion.New(sr.tree, p)
+		sr.evals++
+		return df.DownPass()
+	}
+	bisect := func(in, out float64) float64 {
+		for math.Abs(out-in) > tolerance {
+			mid := (in + out) / 2
+			if like(mid) >= min {
+				in = mid
+				continue
+			}
+			out = mid
+		}
+		return (in + out) / 2
+	}
+
+	// lower bound
+	sr.ciLow = 0
+	for in, out := sr.mlLambda, sr.mlLambda/2; out >= tolerance; in, out = out, out/2 {
+		if like(out) < min {
+			sr.ciLow = bisect(in, out)
+			break
+		}
+	}
+
+	// upper bound
+	sr.ciHigh = math.Inf(1)
+	for in, out := sr.mlLambda, sr.mlLambda*2; ; in, out = out, out*2 {
+		n := dist.NewNormal(out/5.0, p.Landscape.Pixelation())
+		if n.Prob(0) > 0.99 {
+			// the lambda value is too big
+			break
+		}
+		if like(out) < min {
+			sr.ciHigh = bisect(in, out)
+			break
+		}
+	}
+}
+
+// Covered returns true if the simulated lambda
+// is inside the likelihood interval.
+func (sr *simResults) covered() bool {
+	return sr.lambda >= sr.ciLow && sr.lambda <= sr.ciHigh
+}
+
+// RelErr returns the relative error
+// of the lambda estimate.
+func (sr *simResults) relErr() float64 {
+	if sr.lambda == 0 {
+		return 0
+	}
+	return math.Abs(sr.mlLambda-sr.lambda) / sr.lambda
+}
+
+// A powerVar is a design variable
+// used in the power summary.
+type powerVar struct {
+	name  string
+	label string
+	value func(sr *simResults) float64
+}
+
+var powerVars = []powerVar{
+	{
+		name:  "terms",
+		label: "terminals",
+		value: func(sr *simResults) float64 { return float64(len(sr.tree.Terms())) },
+	},
+	{
+		name:  "rootAge",
+		label: "root age (Ma)",
+		value: func(sr *simResults) float64 { return float64(sr.tree.Age(sr.tree.Root())) / 1_000_000 },
+	},
+	{
+		name:  "lambda",
+		label: "lambda",
+		value: func(sr *simResults) float64 { return sr.lambda },
+	},
+}
+
+// A powerBin is an interval of a design variable.
+type powerBin struct {
+	from, to float64
+	trees    int
+	err      float64
+	covered  int
+}
+
+// Bins returns the results of the trees
+// aggregated in equal width intervals
+// of a design variable.
+func (pv powerVar) bins(res []*simResults, n int) []powerBin {
+	if len(res) == 0 {
+		return nil
+	}
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, sr := range res {
+		v := pv.value(sr)
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+	}
+	if max == min {
+		n = 1
+	}
+	width := (max - min) / float64(n)
+
+	bins := make([]powerBin, n)
+	for i := range bins {
+		bins[i].from = min + float64(i)*width
+		bins[i].to = min + float64(i+1)*width
+	}
+	bins[n-1].to = max
+
+	for _, sr := range res {
+		i := n - 1
+		if width > 0 {
+			i = int((pv.value(sr) - min) / width)
+		}
+		if i >= n {
+			i = n - 1
+		}
+		bins[i].trees++
+		bins[i].err += sr.relErr()
+		if sr.covered() {
+			bins[i].covered++
+		}
+	}
+	for i := range bins {
+		if bins[i].trees == 0 {
+			continue
+		}
+		bins[i].err /= float64(bins[i].trees)
+	}
+	return bins
+}
+
+// WritePower writes a table with the relative error
+// and the coverage of the likelihood interval of lambda
+// as functions of the design variables.
+func writePower(name, p string, res []*simResults) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	fmt.Fprintf(f, "# power summary of lambda estimates on simulated data from project %q\n", p)
+	fmt.Fprintf(f, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(f, "# pgs: %s\n", version.String())
+	tsv := csv.NewWriter(f)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	if err := tsv.Write([]string{"variable", "from", "to", "trees", "error", "coverage"}); err != nil {
+		return err
+	}
+	for _, pv := range powerVars {
+		for _, b := range pv.bins(res, numBins) {
+			if b.trees == 0 {
+				continue
+			}
+			row := []string{
+				pv.name,
+				strconv.FormatFloat(b.from, 'f', 3, 64),
+				strconv.FormatFloat(b.to, 'f', 3, 64),
+				strconv.Itoa(b.trees),
+				strconv.FormatFloat(b.err, 'f', 6, 64),
+				strconv.FormatFloat(float64(b.covered)/float64(b.trees), 'f', 6, 64),
+			}
+			if err := tsv.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	return nil
+}
+
+// PowerPlots writes a plot for each design variable
+// with the relative error
+// and the coverage of the likelihood interval.
+func powerPlots(prefix string, res []*simResults, style chart.Style) error {
+	for _, pv := range powerVars {
+		bins := pv.bins(res, numBins)
+
+		var errXY, covXY plotter.XYs
+		for _, b := range bins {
+			if b.trees == 0 {
+				continue
+			}
+			x := (b.from + b.to) / 2
+			errXY = append(errXY, plotter.XY{X: x, Y: b.err})
+			covXY = append(covXY, plotter.XY{X: x, Y: float64(b.covered) / float64(b.trees)})
+		}
+		if len(errXY) == 0 {
+			continue
+		}
+
+		p := style.New()
+		p.X.Label.Text = pv.label
+		p.Y.Label.Text = "relative error / coverage"
+
+		el, ep, err := plotter.NewLinePoints(errXY)
+		if err != nil {
+			return fmt.Errorf("variable %q: %v", pv.name, err)
+		}
+		cl, cp, err := plotter.NewLinePoints(covXY)
+		if err != nil {
+			return fmt.Errorf("variable %q: %v", pv.name, err)
+		}
+		el.Color = style.Theme.Foreground
+		ep.Color = style.Theme.Foreground
+		cl.Color = style.Theme.Secondary
+		cl.Dashes = []vg.Length{vg.Points(4), vg.Points(2)}
+		cp.Color = style.Theme.Secondary
+		p.Add(el, ep, cl, cp)
+		p.Legend.Add("error", el, ep)
+		p.Legend.Add("coverage", cl, cp)
+		p.Legend.Top = true
+
+		out := fmt.Sprintf("%s-power-%s", prefix, pv.name)
+		if err := style.Save(p, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
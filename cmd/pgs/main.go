@@ -13,6 +13,7 @@ import (
 	"github.com/js-arias/phygeo/cmd/pgs/freq"
 	"github.com/js-arias/phygeo/cmd/pgs/infer"
 	"github.com/js-arias/phygeo/cmd/pgs/sim"
+	"github.com/js-arias/phygeo/cmd/pgs/study"
 	"github.com/js-arias/phygeo/cmd/pgs/unrot"
 )
 
@@ -26,6 +27,7 @@ func init() {
 	app.Add(freq.Command)
 	app.Add(infer.Command)
 	app.Add(sim.Command)
+	app.Add(study.Command)
 	app.Add(unrot.Command)
 }
 
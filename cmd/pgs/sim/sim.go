@@ -24,8 +24,10 @@ import (
 	"github.com/js-arias/earth/model"
 	"github.com/js-arias/earth/stat/pixweight"
 	"github.com/js-arias/phygeo/infer/diffusion"
+	"github.com/js-arias/phygeo/internal/geobox"
 	"github.com/js-arias/phygeo/project"
 	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/phygeo/version"
 	"github.com/js-arias/timetree"
 	"github.com/js-arias/timetree/simulate"
 )
@@ -34,7 +36,9 @@ var Command = &command.Command{
 	Usage: `sim [-o|--output <file>]
 	[--trees <number>] [--terms <range>] [-p|--particles <number>]
 	[--name <string>]
-	--age <range> --lambda <range> <project-file>`,
+	[--root-box <lat,lon,lat,lon>] [--root-values <value-list>]
+	[--fossils <value>] [--use-project-trees]
+	[--age <range>] --lambda <range> <project-file>`,
 	Short: "simulate data",
 	Long: `
 Command sim creates one or more random trees with its biogeographic data.
@@ -70,9 +74,38 @@ default, the particles that make the range will be spread around the centroid
 of the distribution, using a spherical normal of lambda 100. Use the flag
 --spread to change the spreading of the particles.
 
+By default, the simulation of each tree starts at a random pixel (using the
+pixel weights) at the start of the root. The starting pixel can be restricted
+with the following flags. The flag --root-box defines a box using the latitude
+and longitude of two opposite corners, in present coordinates, for example
+"-10,-80,-40,-50". The first corner is the western corner, and the second
+corner is the eastern corner, so a box that crosses the antimeridian is
+defined with a western longitude greater than the eastern longitude, for
+example "-10,170,-30,-170". The pixels of the box are rotated to the time
+stage of the start of the root. The flag --root-values defines the landscape
+values of the pixels that can be used as starting points, at the time stage
+of the start of the root. The format is the values separated by commas, for
+example, "1,2" will use all the pixels with the values 1 or 2. If both flags
+are defined, only the pixels in the box with the given landscape values will
+be used. The pixels with a pixel weight of zero are always excluded. If no
+pixel is valid for a tree, the simulation will fail.
+
+By default, all terminals are sampled at the present. Use the flag --fossils
+to define the fraction of terminals that will be simulated as fossils. The
+age of a fossil terminal is a random age between the age of its parent node
+and the present, and the data of the terminal will be simulated at that age.
+
 By default, trees will be named as "random-<number>". Use the flag --name to
 set a different tree name prefix.
 
+If the flag --use-project-trees is set, instead of random trees, the data will
+be simulated on the trees of the project, so the simulations will have the
+same topology, and node ages, of the empirical trees (for example, to make a
+parametric bootstrap). In this case, the flag --trees defines the number of
+simulations for each tree of the project, and each simulated tree will be
+named as "<tree>-<number>". As the trees are not simulated, the flags --age,
+--terms, --fossils, and --name are ignored.
+
 	`,
 	SetFlags: setFlags,
 	Run:      run,
@@ -84,6 +117,10 @@ var termFlag string
 var lambdaFlag string
 var treeName string
 var spread float64
+var fossils float64
+var rootBox string
+var rootValues string
+var projTrees bool
 var numTrees int
 var numParticles int
 
@@ -98,6 +135,10 @@ func setFlags(c *command.Command) {
 	c.Flags().IntVar(&numParticles, "p", 100, "")
 	c.Flags().IntVar(&numParticles, "particles", 100, "")
 	c.Flags().Float64Var(&spread, "spread", 100, "")
+	c.Flags().Float64Var(&fossils, "fossils", 0, "")
+	c.Flags().StringVar(&rootBox, "root-box", "", "")
+	c.Flags().StringVar(&rootValues, "root-values", "", "")
+	c.Flags().BoolVar(&projTrees, "use-project-trees", false, "")
 }
 
 func run(c *command.Command, args []string) (err error) {
@@ -105,9 +146,29 @@ func run(c *command.Command, args []string) (err error) {
 		return c.UsageError("expecting project file")
 	}
 
-	if ageFlag == "" {
+	if ageFlag == "" && !projTrees {
 		return c.UsageError("flag --age undefined")
 	}
+	if fossils < 0 || fossils > 1 {
+		return c.UsageError("flag --fossils: value must be between 0 and 1")
+	}
+
+	var bx *geobox.Box
+	if rootBox != "" {
+		b, err := geobox.Parse(rootBox)
+		if err != nil {
+			return fmt.Errorf("on flag --root-box: %v", err)
+		}
+		bx = &b
+	}
+	var values map[int]bool
+	if rootValues != "" {
+		var err error
+		values, err = parseValues(rootValues)
+		if err != nil {
+			return err
+		}
+	}
 
 	p, err := project.Read(args[0])
 	if err != nil {
@@ -140,6 +201,14 @@ func run(c *command.Command, args []string) (err error) {
 		return err
 	}
 
+	var tot *model.Total
+	if bx != nil {
+		tot, err = readTotal(rotF, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+
 	dm, err := earth.NewDistMatRingScale(landscape.Pixelation())
 	if err != nil {
 		return err
@@ -155,18 +224,35 @@ func run(c *command.Command, args []string) (err error) {
 		return err
 	}
 
-	min, max, err := parseFloatRange(ageFlag)
-	if err != nil {
-		return err
-	}
-	minAge := int64(min * timestage.MillionYears)
-	maxAge := int64(max * timestage.MillionYears)
+	var src *timetree.Collection
+	var minAge, maxAge int64
+	var minTerm, maxTerm int
+	if projTrees {
+		tf := p.Path(project.Trees)
+		if tf == "" {
+			msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+			return c.UsageError(msg)
+		}
+		src, err = readTreeFile(tf)
+		if err != nil {
+			return err
+		}
+		if len(src.Names()) == 0 {
+			return fmt.Errorf("no trees defined in project %q", args[0])
+		}
+	} else {
+		min, max, err := parseFloatRange(ageFlag)
+		if err != nil {
+			return err
+		}
+		minAge = int64(min * timestage.MillionYears)
+		maxAge = int64(max * timestage.MillionYears)
 
-	minTerm, maxTerm, err := parseIntRange(termFlag)
-	if err != nil {
-		return err
+		minTerm, maxTerm, err = parseIntRange(termFlag)
+		if err != nil {
+			return err
+		}
 	}
-	avgTerm := minTerm + (maxTerm-minTerm)/2
 
 	minLambda, maxLambda, err := parseFloatRange(lambdaFlag)
 	if err != nil {
@@ -189,26 +275,26 @@ func run(c *command.Command, args []string) (err error) {
 		return fmt.Errorf("while writing header on %q: %v", outFile, err)
 	}
 
-	coll := timetree.NewCollection()
-	vals := make(map[string]float64, numTrees)
-	for i := 0; i < numTrees; i++ {
-		name := fmt.Sprintf("%s-%d", treeName, i)
+	total := numTrees
+	if src != nil {
+		total = numTrees * len(src.Names())
+	}
 
-		// simulate the tree
+	coll := timetree.NewCollection()
+	vals := make(map[string]float64, total)
+	for i := 0; i < total; i++ {
 		var t *timetree.Tree
-		for {
-			root := maxAge
-			if d := maxAge - minAge; d > 0 {
-				root = rand.Int64N(d) + minAge
-			}
-
-			spRate := (math.Log(float64(avgTerm)) - math.Log(2)) / (float64(root) / timestage.MillionYears)
-			t, _ = simulate.Yule(name, spRate, root, maxTerm*2)
-			if tm := len(t.Terms()); tm >= minTerm && tm <= maxTerm {
-				break
+		if src != nil {
+			// copy the empirical tree
+			et := src.Tree(src.Names()[i/numTrees])
+			t = et.SubTree(et.Root(), fmt.Sprintf("%s-%d", et.Name(), i%numTrees))
+		} else {
+			name := fmt.Sprintf("%s-%d", treeName, i)
+			t = yuleTree(name, minAge, maxAge, minTerm, maxTerm)
+			if fossils > 0 {
+				setFossils(t, fossils)
 			}
 		}
-		t.Format()
 		coll.Add(t)
 
 		lambda := maxLambda
@@ -229,8 +315,19 @@ func run(c *command.Command, args []string) (err error) {
 			Lambda:    lambda,
 			Stages:    stages.Stages(),
 		}
+		if bx != nil || values != nil {
+			age := landscape.ClosestStageAge(rootAge + param.Stem)
+			start := startRegion(landscape, tot, bx, values, pw, age)
+			if len(start) == 0 {
+				return fmt.Errorf("tree %q: no valid root pixels at %.3f Ma", t.Name(), float64(age)/timestage.MillionYears)
+			}
+			param.SimStart = start
+		}
 
-		sim := diffusion.NewSimData(t, param, spread)
+		sim, err := diffusion.NewSimData(t, param, spread)
+		if err != nil {
+			return fmt.Errorf("tree %q: %v", t.Name(), err)
+		}
 		sim.Simulate(numParticles)
 		if err := writeSimulation(tsv, sim, landscape.Pixelation().Equator()); err != nil {
 			return fmt.Errorf("while writing data on %q: %v", outFile, err)
@@ -284,6 +381,35 @@ func readRotation(name string, pix *earth.Pixelation) (*model.StageRot, error) {
 	return rot, nil
 }
 
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func readTotal(name string, pix *earth.Pixelation) (*model.Total, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rot, err := model.ReadTotal(f, pix, false)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return rot, nil
+}
+
 func readStages(name string, rot *model.StageRot, landscape *model.TimePix) (timestage.Stages, error) {
 	stages := timestage.New()
 	stages.Add(rot)
@@ -384,6 +510,89 @@ func parseIntRange(s string) (min, max int, err error) {
 	return min, max, nil
 }
 
+func parseValues(val string) (map[int]bool, error) {
+	vs := strings.Split(val, ",")
+	values := make(map[int]bool, len(vs))
+	for _, v := range vs {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("on flag --root-values: %v", err)
+		}
+		values[n] = true
+	}
+	return values, nil
+}
+
+// StartRegion returns the pixels
+// that can be used as the starting point
+// of a simulation
+// at a time stage.
+func startRegion(landscape *model.TimePix, tot *model.Total, bx *geobox.Box, values map[int]bool, pw pixweight.Pixel, age int64) map[int]bool {
+	var inBox map[int]bool
+	if bx != nil {
+		inBox = bx.Region(landscape.Pixelation(), tot, age)
+	}
+
+	region := make(map[int]bool)
+	for px, v := range landscape.Stage(age) {
+		if pw.Weight(v) == 0 {
+			continue
+		}
+		if inBox != nil && !inBox[px] {
+			continue
+		}
+		if values != nil && !values[v] {
+			continue
+		}
+		region[px] = true
+	}
+	return region
+}
+
+// YuleTree simulates a tree using a Yule process,
+// with a random root age,
+// and a number of terminals
+// inside the indicated range.
+func yuleTree(name string, minAge, maxAge int64, minTerm, maxTerm int) *timetree.Tree {
+	avgTerm := minTerm + (maxTerm-minTerm)/2
+
+	var t *timetree.Tree
+	for {
+		root := maxAge
+		if d := maxAge - minAge; d > 0 {
+			root = rand.Int64N(d) + minAge
+		}
+
+		spRate := (math.Log(float64(avgTerm)) - math.Log(2)) / (float64(root) / timestage.MillionYears)
+		t, _ = simulate.Yule(name, spRate, root, maxTerm*2)
+		if tm := len(t.Terms()); tm >= minTerm && tm <= maxTerm {
+			break
+		}
+	}
+	t.Format()
+	return t
+}
+
+// SetFossils sets a random fraction of terminals
+// of a tree as fossils,
+// with an age between the age of its parent
+// and the present.
+func setFossils(t *timetree.Tree, fraction float64) {
+	for _, id := range t.Nodes() {
+		if !t.IsTerm(id) {
+			continue
+		}
+		if rand.Float64() >= fraction {
+			continue
+		}
+		pAge := t.Age(t.Parent(id))
+		if pAge < 2 {
+			continue
+		}
+		t.Set(id, rand.Int64N(pAge-1)+1)
+	}
+}
+
 func writeTrees(coll *timetree.Collection) (err error) {
 	name := fmt.Sprintf("%s-trees.tab", output)
 	f, err := os.Create(name)
@@ -406,8 +615,12 @@ func writeTrees(coll *timetree.Collection) (err error) {
 
 func outHeader(w io.Writer, p string) (*csv.Writer, error) {
 	fmt.Fprintf(w, "# simulated data of project %q\n", p)
+	if projTrees {
+		fmt.Fprintf(w, "# simulated on the trees of the project\n")
+	}
 	fmt.Fprintf(w, "# simulated particles: %d\n", numParticles)
 	fmt.Fprintf(w, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "# pgs: %s\n", version.String())
 
 	tsv := csv.NewWriter(w)
 	tsv.Comma = '\t'
@@ -471,6 +684,7 @@ func writeLambdaVals(lv map[string]float64, p string) (err error) {
 
 	fmt.Fprintf(f, "# simulated lambda of project %q\n", p)
 	fmt.Fprintf(f, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(f, "# pgs: %s\n", version.String())
 
 	tsv := csv.NewWriter(f)
 	tsv.Comma = '\t'
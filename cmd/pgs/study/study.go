@@ -0,0 +1,477 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package study implements a command to run
+// a full simulation study
+// from a design table.
+package study
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/phygeo/cmd/pgs/cmpcmd"
+	"github.com/js-arias/phygeo/cmd/pgs/freq"
+	"github.com/js-arias/phygeo/cmd/pgs/infer"
+	"github.com/js-arias/phygeo/cmd/pgs/sim"
+	"github.com/js-arias/phygeo/version"
+)
+
+var Command = &command.Command{
+	Usage: `study -d|--design <file>
+	[--dir <directory>] [-o|--output <file>]
+	[--cpu <number>] [--kde <value>]
+	<project-file>`,
+	Short: "run a simulation study from a design table",
+	Long: `
+Command study reads a design table, and for each cell of the design, runs the
+commands sim, infer, freq, and cmp, and then aggregates the comparison of the
+inferred and simulated reconstructions into a single table.
+
+The argument of the command is the name of the default project file. It is
+used for the cells that do not define a project.
+
+The flag --design, or -d, is required and indicates the design table. The
+design table is a tab-delimited file with the following columns:
+
+	-cell       the name of the cell, required
+	-project    the project file used in the cell (for example, to use
+	            different landscapes or pixelations)
+	-lambda     the range of the lambda parameter, required
+	-age        the range of root ages, required
+	-terms      the range of the number of terminals
+	-trees      the number of trees
+	-particles  the number of particles of the simulation
+
+Range values use the same format as in the command sim. If a column is not
+defined, or the value is empty, the default values of the respective commands
+will be used.
+
+Each cell will be run in its own directory, named after the cell. By default,
+the cell directories are created in the current directory. Use the flag
+--dir to define a different base directory. The files of each cell use the
+prefix "sim", so for example, the simulated trees will be stored at
+"<cell>/sim-trees.tab". If the results file of a cell ("<cell>/results.tab")
+already exists, the cell will be skipped, so an interrupted study can be
+continued.
+
+By default, the frequencies of the particles will be used for the
+comparisons. If the flag --kde is defined, the particles will be smoothed
+using a KDE with the given concentration parameter.
+
+By default, the calculations will use all available CPUs. Use the flag --cpu
+to change the number of processors.
+
+By default, the aggregated results will be stored in "study-results.tab". Use
+the flag --output, or -o, to define a different file name. The aggregated
+table has the following columns:
+
+	-cell      the name of the cell
+	-trees     the number of simulated trees
+	-lambda    the mean relative error of the lambda estimates
+	-coverage  the proportion of trees in which the simulated lambda is
+	           inside the likelihood interval of the estimate
+	-nodes     the number of compared nodes
+	-pixels    the mean proportion of the simulated pixels recovered in
+	           the inference
+	-farthest  the mean distance (in radians) of the farthest simulated
+	           pixel not recovered in the inference
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var numCPU int
+var kdeLambda float64
+var designFile string
+var baseDir string
+var output string
+
+func setFlags(c *command.Command) {
+	c.Flags().IntVar(&numCPU, "cpu", runtime.GOMAXPROCS(0), "")
+	c.Flags().Float64Var(&kdeLambda, "kde", 0, "")
+	c.Flags().StringVar(&designFile, "design", "", "")
+	c.Flags().StringVar(&designFile, "d", "", "")
+	c.Flags().StringVar(&baseDir, "dir", "", "")
+	c.Flags().StringVar(&output, "output", "study-results.tab", "")
+	c.Flags().StringVar(&output, "o", "study-results.tab", "")
+}
+
+func run(c *command.Command, args []string) (err error) {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if designFile == "" {
+		return c.UsageError("expecting design file, flag --design")
+	}
+	// copy the flag values
+	// as they will be reset by the executed commands
+	proj := args[0]
+	cpu := strconv.Itoa(numCPU)
+	kde := kdeLambda
+	dir := baseDir
+	out := output
+
+	cells, err := readDesign(designFile, proj)
+	if err != nil {
+		return err
+	}
+
+	for _, cl := range cells {
+		cd := filepath.Join(dir, cl.name)
+		if _, err := os.Stat(filepath.Join(cd, "results.tab")); err == nil {
+			fmt.Fprintf(c.Stderr(), "# cell %q: already done\n", cl.name)
+			continue
+		}
+		if err := os.MkdirAll(cd, 0o755); err != nil {
+			return err
+		}
+		if err := cl.run(cd, cpu, kde); err != nil {
+			return fmt.Errorf("on cell %q: %v", cl.name, err)
+		}
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	fmt.Fprintf(f, "# simulation study of design %q\n", designFile)
+	fmt.Fprintf(f, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(f, "# pgs: %s\n", version.String())
+	tsv := csv.NewWriter(f)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	if err := tsv.Write([]string{"cell", "trees", "lambda", "coverage", "nodes", "pixels", "farthest"}); err != nil {
+		return err
+	}
+	for _, cl := range cells {
+		cd := filepath.Join(dir, cl.name)
+		r, err := cl.results(cd)
+		if err != nil {
+			return fmt.Errorf("on cell %q: %v", cl.name, err)
+		}
+		row := []string{
+			cl.name,
+			strconv.Itoa(r.trees),
+			strconv.FormatFloat(r.lambda, 'f', 6, 64),
+			strconv.FormatFloat(r.coverage, 'f', 6, 64),
+			strconv.Itoa(r.nodes),
+			strconv.FormatFloat(r.pixels, 'f', 6, 64),
+			strconv.FormatFloat(r.farthest, 'f', 6, 64),
+		}
+		if err := tsv.Write(row); err != nil {
+			return err
+		}
+	}
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", out, err)
+	}
+	return nil
+}
+
+// A Cell is a cell of the study design.
+type cell struct {
+	name      string
+	project   string
+	lambda    string
+	age       string
+	terms     string
+	trees     string
+	particles string
+}
+
+// Run runs the full pipeline of a cell
+// in the given directory.
+func (cl cell) run(dir, cpu string, kde float64) error {
+	prefix := filepath.Join(dir, "sim")
+
+	simArgs := []string{"-o", prefix, "--lambda", cl.lambda, "--age", cl.age}
+	if cl.terms != "" {
+		simArgs = append(simArgs, "--terms", cl.terms)
+	}
+	if cl.trees != "" {
+		simArgs = append(simArgs, "--trees", cl.trees)
+	}
+	if cl.particles != "" {
+		simArgs = append(simArgs, "--particles", cl.particles)
+	}
+	if err := sim.Command.Execute(append(simArgs, cl.project)); err != nil {
+		return err
+	}
+
+	inferArgs := []string{"-i", prefix, "--cpu", cpu}
+	if cl.particles != "" {
+		inferArgs = append(inferArgs, "--particles", cl.particles)
+	}
+	if err := infer.Command.Execute(append(inferArgs, cl.project)); err != nil {
+		return err
+	}
+
+	want := prefix + "-freq-particles.tab"
+	got := prefix + "-freq-infer-particles.tab"
+	freqArgs := []string{"--cpu", cpu}
+	if kde > 0 {
+		freqArgs = append(freqArgs, "--kde", strconv.FormatFloat(kde, 'f', -1, 64))
+	}
+	wArgs := append([]string{"-i", prefix + "-particles.tab", "-o", want}, freqArgs...)
+	if err := freq.Command.Execute(append(wArgs, cl.project)); err != nil {
+		return err
+	}
+	gArgs := append([]string{"-i", prefix + "-infer-particles.tab", "-o", got}, freqArgs...)
+	if err := freq.Command.Execute(append(gArgs, cl.project)); err != nil {
+		return err
+	}
+
+	cmpArgs := []string{
+		"--got", got,
+		"--want", want,
+		"--trees", prefix + "-trees.tab",
+		"-o", filepath.Join(dir, "results.tab"),
+		cl.project,
+	}
+	if err := cmpcmd.Command.Execute(cmpArgs); err != nil {
+		return err
+	}
+	return nil
+}
+
+type cellResult struct {
+	trees    int
+	lambda   float64
+	coverage float64
+	nodes    int
+	pixels   float64
+	farthest float64
+}
+
+// Results reads the comparison results of a cell.
+func (cl cell) results(dir string) (cellResult, error) {
+	var r cellResult
+
+	var intervals int
+	lf := filepath.Join(dir, "sim-infer-lambda.tab")
+	rows, err := readTable(lf, []string{"lambda", "ml-lambda"})
+	if err != nil {
+		return r, err
+	}
+	for _, row := range rows {
+		want, err := strconv.ParseFloat(row["lambda"], 64)
+		if err != nil {
+			return r, fmt.Errorf("on file %q: field %q: %v", lf, "lambda", err)
+		}
+		got, err := strconv.ParseFloat(row["ml-lambda"], 64)
+		if err != nil {
+			return r, fmt.Errorf("on file %q: field %q: %v", lf, "ml-lambda", err)
+		}
+		r.trees++
+		if want > 0 {
+			r.lambda += math.Abs(got-want) / want
+		}
+
+		// cells from previous versions
+		// do not have likelihood intervals
+		if row["ci-low"] == "" || row["ci-high"] == "" {
+			continue
+		}
+		low, err := strconv.ParseFloat(row["ci-low"], 64)
+		if err != nil {
+			return r, fmt.Errorf("on file %q: field %q: %v", lf, "ci-low", err)
+		}
+		high, err := strconv.ParseFloat(row["ci-high"], 64)
+		if err != nil {
+			return r, fmt.Errorf("on file %q: field %q: %v", lf, "ci-high", err)
+		}
+		intervals++
+		if want >= low && want <= high {
+			r.coverage++
+		}
+	}
+	if r.trees > 0 {
+		r.lambda /= float64(r.trees)
+	}
+	if intervals > 0 {
+		r.coverage /= float64(intervals)
+	}
+
+	rf := filepath.Join(dir, "results.tab")
+	rows, err = readTable(rf, []string{"pixels", "farthest"})
+	if err != nil {
+		return r, err
+	}
+	for _, row := range rows {
+		px, err := strconv.ParseFloat(row["pixels"], 64)
+		if err != nil {
+			return r, fmt.Errorf("on file %q: field %q: %v", rf, "pixels", err)
+		}
+		far, err := strconv.ParseFloat(row["farthest"], 64)
+		if err != nil {
+			return r, fmt.Errorf("on file %q: field %q: %v", rf, "farthest", err)
+		}
+		r.nodes++
+		r.pixels += px
+		r.farthest += far
+	}
+	if r.nodes > 0 {
+		r.pixels /= float64(r.nodes)
+		r.farthest /= float64(r.nodes)
+	}
+	return r, nil
+}
+
+var designFields = []string{
+	"cell",
+	"lambda",
+	"age",
+}
+
+func readDesign(name, proj string) ([]cell, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tsv := csv.NewReader(f)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: while reading header: %v", name, err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range designFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("on file %q: expecting field %q", name, h)
+		}
+	}
+
+	field := func(row []string, f string) string {
+		i, ok := fields[f]
+		if !ok {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+
+	var cells []cell
+	names := make(map[string]bool)
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on file %q: row %d: %v", name, ln, err)
+		}
+
+		cl := cell{
+			name:      field(row, "cell"),
+			project:   field(row, "project"),
+			lambda:    field(row, "lambda"),
+			age:       field(row, "age"),
+			terms:     field(row, "terms"),
+			trees:     field(row, "trees"),
+			particles: field(row, "particles"),
+		}
+		if cl.name == "" {
+			continue
+		}
+		if names[cl.name] {
+			return nil, fmt.Errorf("on file %q: row %d: field %q: repeated cell %q", name, ln, "cell", cl.name)
+		}
+		names[cl.name] = true
+		if cl.lambda == "" {
+			return nil, fmt.Errorf("on file %q: row %d: field %q: expecting value", name, ln, "lambda")
+		}
+		if cl.age == "" {
+			return nil, fmt.Errorf("on file %q: row %d: field %q: expecting value", name, ln, "age")
+		}
+		if cl.project == "" {
+			cl.project = proj
+		}
+		cells = append(cells, cl)
+	}
+	if len(cells) == 0 {
+		return nil, fmt.Errorf("on file %q: while reading data: %v", name, io.EOF)
+	}
+	return cells, nil
+}
+
+// ReadTable reads a tab-delimited table
+// and returns the rows as maps of field to value.
+func readTable(name string, req []string) ([]map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tsv := csv.NewReader(f)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: while reading header: %v", name, err)
+	}
+	for i, h := range head {
+		head[i] = strings.ToLower(h)
+	}
+	for _, h := range req {
+		found := false
+		for _, f := range head {
+			if f == h {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("on file %q: expecting field %q", name, h)
+		}
+	}
+
+	var rows []map[string]string
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on file %q: row %d: %v", name, ln, err)
+		}
+		r := make(map[string]string, len(head))
+		for i, h := range head {
+			if i < len(row) {
+				r[h] = row[i]
+			}
+		}
+		rows = append(rows, r)
+	}
+	return rows, nil
+}
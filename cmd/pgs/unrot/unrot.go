@@ -22,6 +22,7 @@ import (
 	"github.com/js-arias/earth"
 	"github.com/js-arias/earth/model"
 	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/version"
 )
 
 var Command = &command.Command{
@@ -307,6 +308,7 @@ func writeFrequencies(rt map[string]*recTree, name, p, tp string, numPix, eq int
 		fmt.Fprintf(w, "# KDE smoothing\n")
 	}
 	fmt.Fprintf(w, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "# pgs: %s\n", version.String())
 
 	tsv := csv.NewWriter(w)
 	tsv.Comma = '\t'
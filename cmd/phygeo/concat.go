@@ -0,0 +1,164 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/phygeo/internal/input"
+)
+
+var concatCommand = &command.Command{
+	Usage: `concat [-o|--output <file>] <file>...`,
+	Short: "concatenate the outputs of sharded jobs",
+	Long: `
+Command concat reads two or more tab-delimited files, for example, the outputs
+of the jobs of a command run with the flag --shard, and concatenates them into
+a single file. It does not combine the values of the files (to build a
+consensus of the reconstructions of different trees, use the command
+'phygeo diff merge').
+
+The arguments of the command are the names of the files to be concatenated.
+All the files must have the same header (i.e., the first line that is not a
+comment). The comments at the start of the first file will be kept, and the
+header will be written only once. Then, the data rows of each file will be
+written in the order of the files. Files compressed with gzip are detected
+automatically.
+
+By default, the concatenated file will be written in the standard output. Use
+the flag --output, or -o, to define an output file. If the name of the output
+file ends with ".gz", the output will be compressed with gzip.
+	`,
+	SetFlags: concatFlags,
+	Run:      runConcat,
+}
+
+var concatOutput string
+
+func concatFlags(c *command.Command) {
+	c.Flags().StringVar(&concatOutput, "output", "", "")
+	c.Flags().StringVar(&concatOutput, "o", "", "")
+}
+
+func runConcat(c *command.Command, args []string) (err error) {
+	if len(args) < 1 {
+		return c.UsageError("expecting files to concatenate")
+	}
+
+	if concatOutput == "" || concatOutput == "-" {
+		bw := bufio.NewWriter(c.Stdout())
+		if err := concatFiles(bw, args); err != nil {
+			return err
+		}
+		if err := bw.Flush(); err != nil {
+			return fmt.Errorf("while writing on standard output: %v", err)
+		}
+		return nil
+	}
+
+	f, err := os.Create(concatOutput)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	var w io.Writer = f
+	var zw *gzip.Writer
+	if strings.HasSuffix(concatOutput, ".gz") {
+		zw = gzip.NewWriter(f)
+		w = zw
+	}
+	bw := bufio.NewWriter(w)
+	if err := concatFiles(bw, args); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", concatOutput, err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("while writing data on %q: %v", concatOutput, err)
+		}
+	}
+	return nil
+}
+
+func concatFiles(w *bufio.Writer, files []string) error {
+	var header string
+	for i, name := range files {
+		h, err := concatFile(w, name, i == 0, header)
+		if err != nil {
+			return err
+		}
+		header = h
+	}
+	return nil
+}
+
+// MergeFile copies the data rows of a file.
+// If first is true,
+// it also copies the initial comments
+// and the header.
+// It returns the header of the file.
+func concatFile(w *bufio.Writer, name string, first bool, header string) (string, error) {
+	r, err := input.Open(name, nil)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	inHead := true
+	ln := 0
+	for s.Scan() {
+		ln++
+		line := s.Text()
+		if inHead {
+			if strings.HasPrefix(line, "#") {
+				if first {
+					fmt.Fprintf(w, "%s\n", line)
+				}
+				continue
+			}
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			inHead = false
+			h := strings.TrimRight(line, "\r")
+			if first {
+				header = h
+				fmt.Fprintf(w, "%s\n", line)
+				continue
+			}
+			if h != header {
+				return "", fmt.Errorf("on file %q: on row %d: header %q different from %q", name, ln, h, header)
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fmt.Fprintf(w, "%s\n", line)
+	}
+	if err := s.Err(); err != nil {
+		return "", fmt.Errorf("on file %q: %v", name, err)
+	}
+	if inHead {
+		return "", fmt.Errorf("on file %q: header not found", name)
+	}
+	return header, nil
+}
@@ -0,0 +1,853 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package ages implements a command to integrate
+// the uncertainty of node ages
+// in a stochastic mapping.
+package ages
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/agerange"
+	"github.com/js-arias/phygeo/constraint"
+	"github.com/js-arias/phygeo/infer/diffusion"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/phygeo/version"
+	"github.com/js-arias/ranges"
+	"github.com/js-arias/timetree"
+)
+
+var Command = &command.Command{
+	Usage: `ages --lambda <value> [--stem <age>]
+	[--jitter <fraction>] [--ages <file>] [--trees <file>]
+	[-r|--replicates <number>] [-p|--particles <number>]
+	[-o|--output <file>] [--float32] [--cpu <number>] <project-file>`,
+	Short: "integrate node age uncertainty",
+	Long: `
+Command ages reads a PhyGeo project, and performs a stochastic mapping on
+replicates of each tree with different node ages, so the uncertainty of the
+ages of the nodes is integrated into the reconstruction.
+
+The argument of the command is the name of the project file.
+
+The flag --lambda is required and defines the concentration parameter of the
+spherical normal (equivalent to the kappa parameter of von Mises-Fisher
+distribution), in 1/radians^2, used for all the replicates.
+
+The replicates can be built by changing the ages of the nodes of the trees of
+the project at random, or read from a file with a set of dated trees.
+
+With the flag --jitter, the age of each internal node will be sampled
+uniformly from an interval defined as a fraction of the node age. For example,
+'--jitter 0.1' will sample the age of a node of 10 million years between 9 and
+11 million years. With the flag --ages, the intervals of the node ages are
+read from a file (for example, the confidence intervals of a dating
+analysis). The ages file is a TSV file without a header with the following
+columns:
+
+	-tree  the name of the tree
+	-node  the ID of the node
+	-min   the youngest age (in million years) of the node
+	-max   the oldest age (in million years) of the node
+
+If both flags are defined, the intervals of the file take precedence. The
+interval of a node is truncated so it is always older than its descendants and
+younger than its ancestor. The nodes without an interval keep their age. The
+flag --replicates, or -r, defines the number of replicates. The default value
+is 100.
+
+With the flag --trees, the replicates are read from a file with a set of
+dated trees (for example, a sample of the posterior of a dating analysis), in
+the tree format used by PhyGeo. Each tree of the file is matched to the tree
+of the project with the same terminals, and it must have the same topology.
+
+By default, an stem branch will be added to each tree using the 10% of the root
+age. To set a different stem age use the flag --stem, the value should be in
+million years.
+
+The flag --particles, or -p, defines the number of particles of the
+stochastic mapping of each replicate. The default value is 100.
+
+The particles of all replicates are combined into a single stochastic mapping
+file for each tree, using the nodes and time stages of the tree in the
+project, so it can be used as input for other commands (for example, 'diff
+freq'). For each time stage of the tree in the project, the particle is taken
+from the time stage of the replicate at the same relative position in the
+branch. As the location of the particle is the pixel at the age of the time
+stage in the replicate, it might be slightly displaced if the ages differ in
+the plate motion model. The particle IDs are unique among replicates.
+
+The output file will be named "<project>-<tree>-<lambda>-ages-<replicates>x
+<particles>.tab". With the flag --output, or -o, a prefix for the file name
+can be defined.
+
+The log-likelihood of each replicate will be written in the standard output,
+as a TSV table with the following columns:
+
+	- tree       the name of the tree
+	- replicate  the replicate number
+	- rootAge    the age of the root in the replicate (in million years)
+	- logLike    the log-likelihood of the replicate
+
+If the flag --float32 is given, the conditional likelihoods will be stored in
+single precision (with a rescaling constant for each time stage), and pixels
+with vanishing likelihoods will be ignored. Each stored value uses about a
+quarter less memory, so the savings are modest, and mostly come from the
+ignored pixels at high resolutions.
+
+By default, all available CPUs will be used in the processing. Set --cpu flag
+to use a different number of CPUs.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var float32Flag bool
+var lambdaFlag float64
+var stemAge float64
+var jitterFlag float64
+var agesFile string
+var treesFile string
+var numReps int
+var numParticles int
+var numCPU int
+var output string
+
+func setFlags(c *command.Command) {
+	c.Flags().BoolVar(&float32Flag, "float32", false, "")
+	c.Flags().Float64Var(&lambdaFlag, "lambda", 0, "")
+	c.Flags().Float64Var(&stemAge, "stem", 0, "")
+	c.Flags().Float64Var(&jitterFlag, "jitter", 0, "")
+	c.Flags().StringVar(&agesFile, "ages", "", "")
+	c.Flags().StringVar(&treesFile, "trees", "", "")
+	c.Flags().IntVar(&numReps, "replicates", 100, "")
+	c.Flags().IntVar(&numReps, "r", 100, "")
+	c.Flags().IntVar(&numParticles, "particles", 100, "")
+	c.Flags().IntVar(&numParticles, "p", 100, "")
+	c.Flags().IntVar(&numCPU, "cpu", runtime.GOMAXPROCS(0), "")
+	c.Flags().StringVar(&output, "output", "", "")
+	c.Flags().StringVar(&output, "o", "", "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if lambdaFlag <= 0 {
+		return c.UsageError("flag --lambda must be defined")
+	}
+	if treesFile == "" && jitterFlag <= 0 && agesFile == "" {
+		return c.UsageError("expecting flag --jitter, --ages, or --trees")
+	}
+	if treesFile != "" && (jitterFlag > 0 || agesFile != "") {
+		return c.UsageError("flag --trees cannot be used with flags --jitter or --ages")
+	}
+	if jitterFlag >= 1 {
+		return c.UsageError("flag --jitter must be smaller than 1")
+	}
+	if numParticles < 1 {
+		return c.UsageError("flag --particles must be greater than 0")
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	tf := p.Path(project.Trees)
+	if tf == "" {
+		msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	tc, err := readTreeFile(tf)
+	if err != nil {
+		return err
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("paleolandscape not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	landscape, err := readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	rotF := p.Path(project.GeoMotion)
+	if rotF == "" {
+		msg := fmt.Sprintf("plate motion model not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	rot, err := readRotation(rotF, landscape.Pixelation())
+	if err != nil {
+		return err
+	}
+
+	stF := p.Path(project.Stages)
+	stages, err := readStages(stF, rot, landscape)
+	if err != nil {
+		return err
+	}
+
+	pwF := p.Path(project.PixWeight)
+	if pwF == "" {
+		msg := fmt.Sprintf("pixel weights not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	pw, err := readPixWeights(pwF)
+	if err != nil {
+		return err
+	}
+
+	rf := p.Path(project.Ranges)
+	rc, err := readRanges(rf)
+	if err != nil {
+		return err
+	}
+	var ar *agerange.Collection
+	if af := p.Path(project.AgeRanges); af != "" {
+		ar, err = readAgeRanges(af, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+	var cn *constraint.Collection
+	if cf := p.Path(project.Constraints); cf != "" {
+		cn, err = readConstraints(cf, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+
+	// check if all terminals have defined ranges
+	for _, tn := range tc.Names() {
+		t := tc.Tree(tn)
+		for _, term := range t.Terms() {
+			if !rc.HasTaxon(term) {
+				return fmt.Errorf("taxon %q of tree %q has no defined range", term, tn)
+			}
+		}
+	}
+
+	reps := make(map[string][]*replicate)
+	if treesFile != "" {
+		dc, err := readTreeFile(treesFile)
+		if err != nil {
+			return err
+		}
+		reps, err = matchTrees(tc, dc)
+		if err != nil {
+			return fmt.Errorf("on file %q: %v", treesFile, err)
+		}
+	} else {
+		intervals := make(map[string]map[int]interval)
+		if agesFile != "" {
+			intervals, err = readIntervals(agesFile, tc)
+			if err != nil {
+				return err
+			}
+		}
+		for _, tn := range tc.Names() {
+			t := tc.Tree(tn)
+			rs, err := jitterTrees(t, intervals[tn])
+			if err != nil {
+				return fmt.Errorf("tree %q: %v", tn, err)
+			}
+			reps[tn] = rs
+		}
+	}
+
+	// Set the number of parallel processors
+	diffusion.SetCPU(numCPU)
+
+	dm, _ := earth.NewDistMatRingScale(landscape.Pixelation())
+
+	param := diffusion.Param{
+		Landscape:   landscape,
+		Rot:         rot,
+		DM:          dm,
+		PW:          pw,
+		Ranges:      rc,
+		AgeRanges:   ar,
+		Constraints: cn,
+		Stages:      stages.Stages(),
+		Lambda:      lambdaFlag,
+		Float32:     float32Flag,
+		Cache:       diffusion.NewPDFCache(landscape.Pixelation()),
+	}
+
+	fmt.Fprintf(c.Stdout(), "tree\treplicate\trootAge\tlogLike\n")
+	for _, tn := range tc.Names() {
+		if len(reps[tn]) == 0 {
+			fmt.Fprintf(c.Stderr(), "WARNING: tree %q: no replicates\n", tn)
+			continue
+		}
+		if err := sampleTree(c.Stdout(), args[0], tc.Tree(tn), reps[tn], param); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A replicate is a tree with different node ages.
+type replicate struct {
+	tree *timetree.Tree
+
+	// nodes maps the node IDs of the tree in the project
+	// to the node IDs of the replicate
+	nodes map[int]int
+}
+
+// SampleTree performs the stochastic mapping
+// of the replicates of a tree
+// and writes the particles
+// using the nodes and time stages of the tree in the project.
+func sampleTree(w io.Writer, p string, t *timetree.Tree, reps []*replicate, param diffusion.Param) (err error) {
+	param.Stem = stemLen(t)
+	ref := diffusion.New(t, param)
+
+	name := fmt.Sprintf("%s-%s-%.6f-ages-%dx%d.tab", p, t.Name(), lambdaFlag, len(reps), numParticles)
+	if output != "" {
+		name = output + "-" + name
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if err == nil && e != nil {
+			err = e
+		}
+	}()
+
+	bw := bufio.NewWriter(f)
+	tsv, err := outHeader(bw, t.Name(), p, len(reps))
+	if err != nil {
+		return fmt.Errorf("while writing header on %q: %v", name, err)
+	}
+
+	eq := param.Landscape.Pixelation().Equator()
+	for k, r := range reps {
+		param.Stem = stemLen(r.tree)
+		df := diffusion.New(r.tree, param)
+		like := df.DownPass()
+		rootAge := float64(r.tree.Age(r.tree.Root())) / timestage.MillionYears
+		fmt.Fprintf(w, "%s\t%d\t%.6f\t%.6f\n", t.Name(), k, rootAge, like)
+
+		df.Simulate(numParticles)
+		for i := 0; i < numParticles; i++ {
+			id := k*numParticles + i
+			if err := writeParticle(tsv, id, i, t, ref, r, df, eq); err != nil {
+				return fmt.Errorf("while writing data on %q: %v", name, err)
+			}
+		}
+	}
+
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	return nil
+}
+
+// StemLen returns the length of the stem branch
+// of a tree.
+func stemLen(t *timetree.Tree) int64 {
+	stem := int64(stemAge * timestage.MillionYears)
+	if stem == 0 {
+		stem = t.Age(t.Root()) / 10
+	}
+	return stem
+}
+
+func outHeader(w io.Writer, t, p string, reps int) (*csv.Writer, error) {
+	fmt.Fprintf(w, "# stochastic mapping on tree %q of project %q\n", t, p)
+	fmt.Fprintf(w, "# lambda: %.6f * 1/radian^2\n", lambdaFlag)
+	switch {
+	case treesFile != "":
+		fmt.Fprintf(w, "# node age replicates: %d: from trees file %q\n", reps, treesFile)
+	case agesFile != "":
+		fmt.Fprintf(w, "# node age replicates: %d: intervals from file %q: jitter %.6f\n", reps, agesFile, jitterFlag)
+	default:
+		fmt.Fprintf(w, "# node age replicates: %d: jitter %.6f\n", reps, jitterFlag)
+	}
+	fmt.Fprintf(w, "# up-pass particles: %d\n", reps*numParticles)
+	fmt.Fprintf(w, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "# phygeo: %s\n", version.String())
+
+	tsv := csv.NewWriter(w)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	if err := tsv.Write([]string{"tree", "particle", "node", "age", "lambda", "equator", "from", "to"}); err != nil {
+		return nil, err
+	}
+
+	return tsv, nil
+}
+
+// WriteParticle writes the particle p
+// of a replicate,
+// using id as the particle ID.
+// The particle is written using the nodes and time stages
+// of the tree in the project.
+func writeParticle(tsv *csv.Writer, id, p int, t *timetree.Tree, ref *diffusion.Tree, r *replicate, df *diffusion.Tree, eq int) error {
+	for _, n := range ref.Nodes() {
+		rn, ok := r.nodes[n]
+		if !ok {
+			continue
+		}
+		stages := ref.Stages(n)
+		rStages := df.Stages(rn)
+		if len(stages) < 2 || len(rStages) < 2 {
+			continue
+		}
+
+		young, old := t.Age(n), stages[0]
+		rYoung, rOld := r.tree.Age(rn), rStages[0]
+
+		// skip the first stage
+		// (i.e. the post-split stage)
+		for i := 1; i < len(stages); i++ {
+			a := stages[i]
+			ra := rYoung
+			if old > young {
+				ra += int64(float64(a-young) / float64(old-young) * float64(rOld-rYoung))
+			}
+			st := df.SrcDest(rn, p, closest(rStages[1:], ra))
+			if st.From == -1 {
+				continue
+			}
+			row := []string{
+				t.Name(),
+				strconv.Itoa(id),
+				strconv.Itoa(n),
+				strconv.FormatInt(a, 10),
+				strconv.FormatFloat(lambdaFlag, 'f', 6, 64),
+				strconv.Itoa(eq),
+				strconv.Itoa(st.From),
+				strconv.Itoa(st.To),
+			}
+			if err := tsv.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Closest returns the age closest to a given age.
+func closest(ages []int64, age int64) int64 {
+	c := ages[0]
+	for _, a := range ages[1:] {
+		if abs(a-age) < abs(c-age) {
+			c = a
+		}
+	}
+	return c
+}
+
+func abs(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// An interval is the range of possible ages
+// of a node.
+type interval struct {
+	min, max int64
+}
+
+// ReadIntervals reads the intervals of the node ages
+// from a file.
+func readIntervals(name string, tc *timetree.Collection) (map[string]map[int]interval, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tab := csv.NewReader(f)
+	tab.Comma = '\t'
+	tab.Comment = '#'
+
+	fields := map[string]int{
+		"tree": 0,
+		"node": 1,
+		"min":  2,
+		"max":  3,
+	}
+	intervals := make(map[string]map[int]interval)
+	for {
+		row, err := tab.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tab.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("%q: on row %d: %v", name, ln, err)
+		}
+		if len(row) < len(fields) {
+			return nil, fmt.Errorf("%q: on row %d: got %d fields, want %d", name, ln, len(row), len(fields))
+		}
+
+		f := "tree"
+		tn := strings.ToLower(strings.Join(strings.Fields(row[fields[f]]), " "))
+		if tn == "" {
+			continue
+		}
+		t := tc.Tree(tn)
+		if t == nil {
+			continue
+		}
+
+		f = "node"
+		id, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("%q: on row %d: field %q: %v", name, ln, f, err)
+		}
+		if !slices.Contains(t.Nodes(), id) {
+			return nil, fmt.Errorf("%q: on row %d: field %q: node %d not in tree %q", name, ln, f, id, tn)
+		}
+
+		f = "min"
+		minAge, err := strconv.ParseFloat(row[fields[f]], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q: on row %d: field %q: %v", name, ln, f, err)
+		}
+		f = "max"
+		maxAge, err := strconv.ParseFloat(row[fields[f]], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q: on row %d: field %q: %v", name, ln, f, err)
+		}
+		if minAge < 0 || maxAge < minAge {
+			return nil, fmt.Errorf("%q: on row %d: invalid interval [%.6f, %.6f]", name, ln, minAge, maxAge)
+		}
+
+		in, ok := intervals[tn]
+		if !ok {
+			in = make(map[int]interval)
+			intervals[tn] = in
+		}
+		in[id] = interval{
+			min: int64(minAge * timestage.MillionYears),
+			max: int64(maxAge * timestage.MillionYears),
+		}
+	}
+	return intervals, nil
+}
+
+// JitterTrees returns the replicates of a tree
+// with node ages sampled from the age intervals.
+func jitterTrees(t *timetree.Tree, intervals map[int]interval) ([]*replicate, error) {
+	bounds := make(map[int]interval, len(t.Nodes()))
+	for _, n := range t.Nodes() {
+		a := t.Age(n)
+		in := interval{min: a, max: a}
+		if jitterFlag > 0 && !t.IsTerm(n) {
+			d := int64(float64(a) * jitterFlag)
+			in = interval{min: a - d, max: a + d}
+		}
+		if v, ok := intervals[n]; ok {
+			in = v
+		}
+		bounds[n] = in
+	}
+
+	// the youngest possible age of a node
+	// is the oldest minimum age of its descendants
+	var youngest func(n int) int64
+	youngest = func(n int) int64 {
+		y := bounds[n].min
+		for _, c := range t.Children(n) {
+			cy := youngest(c)
+			if cy > y {
+				y = cy
+			}
+		}
+		b := bounds[n]
+		b.min = y
+		bounds[n] = b
+		return y
+	}
+	youngest(t.Root())
+	for _, n := range t.Nodes() {
+		if b := bounds[n]; b.max < b.min {
+			return nil, fmt.Errorf("node %d: age interval incompatible with descendant ages", n)
+		}
+	}
+
+	reps := make([]*replicate, 0, numReps)
+	for i := 0; i < numReps; i++ {
+		ages := make(map[int]int64, len(bounds))
+		var sample func(n int, parent int64)
+		sample = func(n int, parent int64) {
+			b := bounds[n]
+			hi := min(b.max, parent)
+			ages[n] = b.min + rand.Int64N(hi-b.min+1)
+			for _, c := range t.Children(n) {
+				sample(c, ages[n])
+			}
+		}
+		sample(t.Root(), math.MaxInt64)
+
+		r, err := buildReplicate(t, fmt.Sprintf("%s:rep-%d", t.Name(), i), ages)
+		if err != nil {
+			return nil, err
+		}
+		reps = append(reps, r)
+	}
+	return reps, nil
+}
+
+// BuildReplicate builds a replicate of a tree
+// using the indicated node ages.
+func buildReplicate(t *timetree.Tree, name string, ages map[int]int64) (*replicate, error) {
+	root := t.Root()
+	r := &replicate{
+		tree:  timetree.New(name, ages[root]),
+		nodes: map[int]int{root: 0},
+	}
+
+	var add func(n int) error
+	add = func(n int) error {
+		for _, c := range t.Children(n) {
+			id, err := r.tree.Add(r.nodes[n], ages[n]-ages[c], t.Taxon(c))
+			if err != nil {
+				return err
+			}
+			r.nodes[c] = id
+			if err := add(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := add(root); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// MatchTrees matches each tree of a set of dated trees
+// with a tree of the project
+// with the same terminals and topology.
+func matchTrees(tc, dc *timetree.Collection) (map[string][]*replicate, error) {
+	// index the project trees by its terminals
+	byTerms := make(map[string]*timetree.Tree)
+	for _, tn := range tc.Names() {
+		t := tc.Tree(tn)
+		byTerms[cladeKey(t.Terms())] = t
+	}
+
+	reps := make(map[string][]*replicate)
+	for _, dn := range dc.Names() {
+		d := dc.Tree(dn)
+		t, ok := byTerms[cladeKey(d.Terms())]
+		if !ok {
+			return nil, fmt.Errorf("tree %q: terminals do not match any tree of the project", dn)
+		}
+
+		dClades := clades(d, d.Root(), make(map[string]int))
+		tClades := clades(t, t.Root(), make(map[string]int))
+		if len(dClades) != len(tClades) {
+			return nil, fmt.Errorf("tree %q: topology differs from tree %q", dn, t.Name())
+		}
+		ages := make(map[int]int64, len(tClades))
+		for k, n := range tClades {
+			dID, ok := dClades[k]
+			if !ok {
+				return nil, fmt.Errorf("tree %q: topology differs from tree %q", dn, t.Name())
+			}
+			ages[n] = d.Age(dID)
+		}
+
+		r, err := buildReplicate(t, d.Name(), ages)
+		if err != nil {
+			return nil, fmt.Errorf("tree %q: %v", dn, err)
+		}
+		reps[t.Name()] = append(reps[t.Name()], r)
+	}
+	return reps, nil
+}
+
+// Clades returns the nodes of a tree
+// indexed by the terminals of each node.
+func clades(t *timetree.Tree, n int, cl map[string]int) map[string]int {
+	cl[cladeKey(terms(t, n))] = n
+	for _, c := range t.Children(n) {
+		clades(t, c, cl)
+	}
+	return cl
+}
+
+// Terms returns the terminals descendant of a node.
+func terms(t *timetree.Tree, n int) []string {
+	if t.IsTerm(n) {
+		return []string{t.Taxon(n)}
+	}
+	var ts []string
+	for _, c := range t.Children(n) {
+		ts = append(ts, terms(t, c)...)
+	}
+	return ts
+}
+
+// CladeKey returns a key for a set of terminals.
+func cladeKey(terms []string) string {
+	ts := slices.Clone(terms)
+	slices.Sort(ts)
+	return strings.Join(ts, "\t")
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readRotation(name string, pix *earth.Pixelation) (*model.StageRot, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rot, err := model.ReadStageRot(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return rot, nil
+}
+
+func readStages(name string, rot *model.StageRot, landscape *model.TimePix) (timestage.Stages, error) {
+	stages := timestage.New()
+	stages.Add(rot)
+	stages.Add(landscape)
+
+	if name == "" {
+		return stages, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := timestage.Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+	stages.Add(st)
+
+	return stages, nil
+}
+
+func readPixWeights(name string) (pixweight.Pixel, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pw, err := pixweight.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return pw, nil
+}
+
+func readRanges(name string) (*ranges.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := ranges.ReadTSV(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func readAgeRanges(name string, pix *earth.Pixelation) (*agerange.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := agerange.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func readConstraints(name string, pix *earth.Pixelation) (*constraint.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := constraint.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
@@ -0,0 +1,644 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package arrival implements a command to estimate
+// the time of arrival of the lineages of a tree
+// to a region.
+package arrival
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/clade"
+	"github.com/js-arias/phygeo/internal/geobox"
+	"github.com/js-arias/phygeo/internal/input"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/version"
+	"github.com/js-arias/timetree"
+	"gonum.org/v1/gonum/stat"
+)
+
+var Command = &command.Command{
+	Usage: `arrival [--box <lat,lon,lat,lon>] [--values <value-list>]
+	-i|--input <file> [-o|--output <file>] <project-file>`,
+	Short: "time of arrival of the lineages to a region",
+	Long: `
+Command arrival reads a file with sampled pixels from a stochastic mapping of
+one or more trees in a project, and for each node, estimates the posterior
+distribution of the first time in which the lineage of the node entered a
+region.
+
+The argument of the command is the name of the project file.
+
+The flag --input, or -i, is required and indicates the input file. If the
+input is "-", the file will be read from the standard input.
+
+The region must be defined with one of the following flags. The flag --box
+defines a box using the latitude and longitude of two opposite corners, in
+present coordinates, for example "-10,-80,-40,-50". The first corner is the
+western corner, and the second corner is the eastern corner, so a box that
+crosses the antimeridian is defined with a western longitude greater than the
+eastern longitude, for example "-10,170,-30,-170". The pixels of the box are
+rotated to each time stage using the plate motion model of the project. The
+flag --values defines the region using the landscape values of the pixels at
+each time stage. The format is the values separated by commas, for example,
+"1,2" will use all the pixels with the values 1 or 2.
+
+The lineage of a node is the path of the particle from the root of the tree
+up to the node (i.e., the node, and all of its ancestors). In each particle,
+the time of arrival of a node is the age of the oldest time stage of the
+lineage in which the particle is inside the region. If the particle never
+enters the region before the age of the node, the lineage is counted as never
+arriving to the region.
+
+If clade labels are defined in the project (see 'phygeo tree label'), the
+time of arrival will also be reported for each labeled clade. The time of
+arrival of a clade is the oldest time of arrival of any of its lineages (i.e.,
+the first time that the clade, or an ancestor of the clade, entered the
+region).
+
+The output is a tab-delimited file with the following columns:
+
+	tree     the name of the tree
+	node     the ID of the node (the MRCA for a clade)
+	label    the clade label ("--" for a node)
+	age      the age of the node, in years
+	arrived  the posterior probability of arriving to the region
+	never    the posterior probability of never arriving to the region
+	mean     the mean time of arrival, in years
+	median   the median time of arrival, in years
+	min95    the 2.5% quantile of the time of arrival, in years
+	max95    the 97.5% quantile of the time of arrival, in years
+
+The times of arrival are conditional on arriving to the region. If no particle
+of a node enters the region, the time columns will be "--".
+
+If the stochastic mapping file has a "weight" column (for example, when the
+particles were produced from several lambda values), the probabilities and
+times will be weighted by the weight of each particle.
+
+By default, the output is printed in the standard output. Use the flag
+--output, or -o, to define an output file.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var boxFlag string
+var valuesFlag string
+var inputFile string
+var output string
+
+func setFlags(c *command.Command) {
+	c.Flags().StringVar(&boxFlag, "box", "", "")
+	c.Flags().StringVar(&valuesFlag, "values", "", "")
+	c.Flags().StringVar(&inputFile, "input", "", "")
+	c.Flags().StringVar(&inputFile, "i", "", "")
+	c.Flags().StringVar(&output, "output", "", "")
+	c.Flags().StringVar(&output, "o", "", "")
+}
+
+func run(c *command.Command, args []string) (err error) {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if inputFile == "" {
+		return c.UsageError("expecting input file, flag --input")
+	}
+	if (boxFlag == "") == (valuesFlag == "") {
+		return c.UsageError("expecting a region, flag --box or flag --values")
+	}
+
+	reg := &region{
+		stages: make(map[int64]map[int]bool),
+	}
+	if boxFlag != "" {
+		bx, err := geobox.Parse(boxFlag)
+		if err != nil {
+			return fmt.Errorf("on flag --box: %v", err)
+		}
+		reg.box = &bx
+	} else {
+		reg.values, err = parseValues(valuesFlag)
+		if err != nil {
+			return err
+		}
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("landscape not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	reg.landscape, err = readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	if boxFlag != "" {
+		rotF := p.Path(project.GeoMotion)
+		if rotF == "" {
+			msg := fmt.Sprintf("plate motion model not defined in project %q", args[0])
+			return c.UsageError(msg)
+		}
+		reg.tot, err = readRotation(rotF, reg.landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+
+	tf := p.Path(project.Trees)
+	if tf == "" {
+		msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	tc, err := readTreeFile(tf)
+	if err != nil {
+		return err
+	}
+
+	labels := clade.New()
+	if lf := p.Path(project.Clades); lf != "" {
+		labels, err = readLabels(lf)
+		if err != nil {
+			return err
+		}
+	}
+
+	rt, err := getRec(inputFile, c.Stdin(), tc, reg)
+	if err != nil {
+		return err
+	}
+
+	w := c.Stdout()
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			e := f.Close()
+			if err == nil && e != nil {
+				err = e
+			}
+		}()
+		w = f
+	} else {
+		output = "stdout"
+	}
+	if err := writeArrival(w, args[0], tc, rt, labels); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", output, err)
+	}
+	return nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readRotation(name string, pix *earth.Pixelation) (*model.Total, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rot, err := model.ReadTotal(f, pix, false)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return rot, nil
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func readLabels(name string) (*clade.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := clade.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func getRec(name string, stdin io.Reader, tc *timetree.Collection, reg *region) (map[string]*recTree, error) {
+	f, err := input.Open(name, stdin)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rt, err := readRecon(f, tc, reg)
+	if err != nil {
+		return nil, fmt.Errorf("on input file %q: %v", name, err)
+	}
+	return rt, nil
+}
+
+// NoArrival is the age used
+// for a lineage that never enters the region.
+const noArrival = -1
+
+// A recTree stores the oldest age
+// in which each node of each particle
+// is inside the region.
+type recTree struct {
+	name string
+	tree *timetree.Tree
+
+	// weight of each particle
+	particles map[int]float64
+
+	// oldest age in the region
+	// of each node,
+	// for each particle
+	inside map[int]map[int]int64
+}
+
+// Arrival returns the time of arrival
+// of each node of a particle.
+func (t *recTree) arrival(p int) map[int]int64 {
+	inside := t.inside[p]
+	arr := make(map[int]int64, len(t.tree.Nodes()))
+
+	nodes := []int{t.tree.Root()}
+	for len(nodes) > 0 {
+		n := nodes[0]
+		nodes = nodes[1:]
+
+		a := int64(noArrival)
+		if !t.tree.IsRoot(n) {
+			a = arr[t.tree.Parent(n)]
+		}
+		if in, ok := inside[n]; ok && in > a {
+			a = in
+		}
+		arr[n] = a
+		nodes = append(nodes, t.tree.Children(n)...)
+	}
+	return arr
+}
+
+// SortedParticles returns the IDs of the particles
+// of the tree.
+func (t *recTree) sortedParticles() []int {
+	ps := make([]int, 0, len(t.particles))
+	for p := range t.particles {
+		ps = append(ps, p)
+	}
+	slices.Sort(ps)
+	return ps
+}
+
+var headerFields = []string{
+	"tree",
+	"particle",
+	"node",
+	"age",
+	"to",
+}
+
+func readRecon(r io.Reader, tc *timetree.Collection, reg *region) (map[string]*recTree, error) {
+	tsv := csv.NewReader(r)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range headerFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	_, hasWeight := fields["weight"]
+
+	pix := reg.landscape.Pixelation()
+	rt := make(map[string]*recTree)
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "tree"
+		tn := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if tn == "" {
+			continue
+		}
+		tn = strings.ToLower(tn)
+		tv := tc.Tree(tn)
+		if tv == nil {
+			continue
+		}
+		t, ok := rt[tn]
+		if !ok {
+			t = &recTree{
+				name:      tn,
+				tree:      tv,
+				particles: make(map[int]float64),
+				inside:    make(map[int]map[int]int64),
+			}
+			rt[tn] = t
+		}
+
+		f = "particle"
+		pN, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		w := 1.0
+		if hasWeight {
+			f = "weight"
+			w, err = strconv.ParseFloat(row[fields[f]], 64)
+			if err != nil {
+				return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+			}
+		}
+		t.particles[pN] = w
+
+		f = "node"
+		id, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+
+		f = "age"
+		age, err := strconv.ParseInt(row[fields[f]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+
+		f = "to"
+		px, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if px >= pix.Len() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, px)
+		}
+
+		if !reg.in(age, px) {
+			continue
+		}
+		inside, ok := t.inside[pN]
+		if !ok {
+			inside = make(map[int]int64)
+			t.inside[pN] = inside
+		}
+		if a, ok := inside[id]; !ok || age > a {
+			inside[id] = age
+		}
+	}
+
+	if len(rt) == 0 {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+
+	return rt, nil
+}
+
+// An arrival is the distribution
+// of the time of arrival
+// of a node or a clade.
+type arrival struct {
+	node  int
+	label string
+
+	// sum of weights of all particles
+	sum float64
+
+	// times of arrival,
+	// and weights,
+	// of the particles that arrived
+	ages    []float64
+	weights []float64
+}
+
+func (a *arrival) add(age int64, w float64) {
+	a.sum += w
+	if age == noArrival {
+		return
+	}
+	a.ages = append(a.ages, float64(age))
+	a.weights = append(a.weights, w)
+}
+
+func (a *arrival) row(t *timetree.Tree) []string {
+	label := "--"
+	if a.label != "" {
+		label = a.label
+	}
+
+	var in float64
+	for _, w := range a.weights {
+		in += w
+	}
+	row := []string{
+		t.Name(),
+		strconv.Itoa(a.node),
+		label,
+		strconv.FormatInt(t.Age(a.node), 10),
+		strconv.FormatFloat(in/a.sum, 'f', 6, 64),
+		strconv.FormatFloat(1-in/a.sum, 'f', 6, 64),
+	}
+	if len(a.ages) == 0 {
+		return append(row, "--", "--", "--", "--")
+	}
+
+	idx := make([]int, len(a.ages))
+	for i := range idx {
+		idx[i] = i
+	}
+	slices.SortFunc(idx, func(x, y int) int {
+		if a.ages[x] < a.ages[y] {
+			return -1
+		}
+		if a.ages[x] > a.ages[y] {
+			return 1
+		}
+		return 0
+	})
+	v := make([]float64, 0, len(idx))
+	w := make([]float64, 0, len(idx))
+	for _, i := range idx {
+		v = append(v, a.ages[i])
+		w = append(w, a.weights[i])
+	}
+
+	return append(row,
+		strconv.FormatFloat(stat.Mean(v, w), 'f', 0, 64),
+		strconv.FormatFloat(stat.Quantile(0.5, stat.Empirical, v, w), 'f', 0, 64),
+		strconv.FormatFloat(stat.Quantile(0.025, stat.Empirical, v, w), 'f', 0, 64),
+		strconv.FormatFloat(stat.Quantile(0.975, stat.Empirical, v, w), 'f', 0, 64),
+	)
+}
+
+// TreeArrival returns the time of arrival
+// of the nodes of a tree,
+// and of the clades with a label.
+func treeArrival(t *recTree, labels *clade.Collection) []*arrival {
+	nodes := t.tree.Nodes()
+	arr := make(map[int]*arrival, len(nodes))
+	for _, n := range nodes {
+		arr[n] = &arrival{node: n}
+	}
+
+	var cl []*arrival
+	desc := make(map[string][]int)
+	for _, name := range labels.Names() {
+		n := labels.Node(t.tree, name)
+		if n < 0 {
+			continue
+		}
+		cl = append(cl, &arrival{
+			node:  n,
+			label: name,
+		})
+		desc[name] = descendants(t.tree, n)
+	}
+
+	for _, p := range t.sortedParticles() {
+		w := t.particles[p]
+		pa := t.arrival(p)
+		for n, a := range pa {
+			arr[n].add(a, w)
+		}
+		for _, c := range cl {
+			a := int64(noArrival)
+			for _, n := range desc[c.label] {
+				if pa[n] > a {
+					a = pa[n]
+				}
+			}
+			c.add(a, w)
+		}
+	}
+
+	res := make([]*arrival, 0, len(nodes)+len(cl))
+	for _, n := range nodes {
+		res = append(res, arr[n])
+	}
+	return append(res, cl...)
+}
+
+// Descendants returns a node
+// and all of its descendants.
+func descendants(t *timetree.Tree, n int) []int {
+	desc := []int{n}
+	for i := 0; i < len(desc); i++ {
+		desc = append(desc, t.Children(desc[i])...)
+	}
+	return desc
+}
+
+func writeArrival(w io.Writer, p string, tc *timetree.Collection, rt map[string]*recTree, labels *clade.Collection) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# time of arrival, project %q\n", p)
+	if boxFlag != "" {
+		fmt.Fprintf(bw, "# region: box %s\n", boxFlag)
+	} else {
+		fmt.Fprintf(bw, "# region: values %s\n", valuesFlag)
+	}
+	fmt.Fprintf(bw, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(bw, "# phygeo: %s\n", version.String())
+
+	tsv := csv.NewWriter(bw)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	header := []string{
+		"tree",
+		"node",
+		"label",
+		"age",
+		"arrived",
+		"never",
+		"mean",
+		"median",
+		"min95",
+		"max95",
+	}
+	if err := tsv.Write(header); err != nil {
+		return err
+	}
+
+	for _, name := range tc.Names() {
+		t, ok := rt[name]
+		if !ok {
+			continue
+		}
+		for _, a := range treeArrival(t, labels) {
+			if err := tsv.Write(a.row(t.tree)); err != nil {
+				return err
+			}
+		}
+	}
+
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return nil
+}
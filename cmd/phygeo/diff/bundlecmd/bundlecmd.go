@@ -0,0 +1,129 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package bundlecmd implements a command to build
+// a self-contained reconstruction bundle.
+package bundlecmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/phygeo/bundle"
+	"github.com/js-arias/phygeo/project"
+)
+
+var Command = &command.Command{
+	Usage: `bundle [--key <key-file>] [-o|--output <file>]
+	<project-file> <reconstruction-file>...`,
+	Short: "build a self-contained reconstruction bundle",
+	Long: `
+Command bundle reads a PhyGeo project and one or more reconstruction files,
+and stores them in a single bundle file, so the results can be drawn or
+summarized again without the original project files.
+
+The first argument of the command is the name of the project file. All the
+datasets defined in the project (for example, the trees, the landscape, and
+the plate motion model) will be stored in the bundle. Only the datasets used
+by the analysis are stored (i.e., datasets at alternative resolutions are
+ignored).
+
+The following arguments are the reconstruction files to be stored in the
+bundle, for example, the pixel frequency files produced by 'diff freq', or
+the particle files produced by 'diff particles'. The files are stored using
+their base name, so two files with the same base name cannot be stored in
+the same bundle.
+
+If the flag --key is defined, the indicated color key will be also stored in
+the bundle, and it will be used by default when drawing the maps.
+
+By default, the bundle will be named "<project-file>-bundle.zip". Use the
+flag --output, or -o, to define a different name.
+
+The bundle is a zip file, and it can be used instead of the project file in
+the commands 'diff cmp', 'diff map', and 'diff speed'. In that case, the input
+file, if it is not given, is the reconstruction stored in the bundle (if there
+is a single reconstruction; or, in 'diff cmp', the two reconstructions stored
+in the bundle, if there are exactly two).
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var keyFile string
+var output string
+
+func setFlags(c *command.Command) {
+	c.Flags().StringVar(&keyFile, "key", "", "")
+	c.Flags().StringVar(&output, "output", "", "")
+	c.Flags().StringVar(&output, "o", "", "")
+}
+
+func run(c *command.Command, args []string) (err error) {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if len(args) < 2 {
+		return c.UsageError("expecting reconstruction files")
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	if output == "" {
+		output = args[0] + "-bundle.zip"
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if err == nil && e != nil {
+			err = e
+		}
+	}()
+
+	w := bundle.NewWriter(f)
+	for _, set := range p.Sets() {
+		name := p.Path(set)
+		if err := addFile(name, func(r *os.File) error { return w.AddData(set, name, r) }); err != nil {
+			return err
+		}
+	}
+	for _, name := range args[1:] {
+		if err := addFile(name, func(r *os.File) error { return w.AddRec(name, r) }); err != nil {
+			return err
+		}
+	}
+	if keyFile != "" {
+		if err := addFile(keyFile, func(r *os.File) error { return w.AddKey(r) }); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("on bundle %q: %v", output, err)
+	}
+	return nil
+}
+
+// AddFile opens a file
+// and adds it to the bundle.
+func addFile(name string, add func(r *os.File) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := add(f); err != nil {
+		return fmt.Errorf("on bundle %q: %v", output, err)
+	}
+	return nil
+}
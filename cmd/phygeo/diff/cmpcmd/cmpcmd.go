@@ -0,0 +1,621 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package cmpcmd implements a command to compare
+// two reconstructions of the same trees.
+package cmpcmd
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/version"
+	"github.com/js-arias/timetree"
+)
+
+var Command = &command.Command{
+	Usage: `cmp [--first <file> --second <file>] [--bound <value>]
+	[--all-stages] [-o|--output <file>] <project-file>`,
+	Short: "compare two reconstructions",
+	Long: `
+Command cmp reads two pixel probability files with reconstructions of the
+trees of a project (for example, produced with different models, or different
+settings), and for each node, reports how much the two reconstructions
+overlap. It is the empirical version of the command 'pgs cmp': none of the
+reconstructions is taken as the true reconstruction, so all the statistics
+are reported for both reconstructions.
+
+The argument of the command is the name of the project file. It can also be
+a reconstruction bundle built with the command 'diff bundle'; in that case,
+all the datasets will be read from the bundle.
+
+The flags --first and --second indicate the files with the reconstructions to
+be compared. The files can be of different types (e.g., a KDE reconstruction
+and a likelihood reconstruction). Compressed files (with gzip) are accepted.
+The flags are required, unless a bundle with exactly two reconstructions is
+used (in that case, the reconstructions are compared in the order of their
+names). If a bundle is used, the input files will be searched first in the
+bundle, using the base name of the files.
+
+At each node, the values of each reconstruction are scaled so they sum 1 (in
+"log-like" files, the exponential of the values are used). The credible set of
+a reconstruction is the smallest set of pixels that contains a given
+proportion of the probability (in "kde" files, the pixels inside the bound of
+the CDF). By default the bound is 0.95, use the flag --bound to define a
+different value.
+
+By default, only the cladogenetic (or split) nodes are compared, using the
+time stage at the age of the node. Terminal nodes are ignored. If the flag
+--all-stages is set, all the time stages of all nodes present in both files
+will be compared.
+
+The output is a tab-delimited file with the following columns:
+
+	tree      the name of the tree
+	node      the ID of the node
+	age       the age of the time stage, in years
+	d         the Schoener's D of the two reconstructions (0 when there is
+	          no overlap, 1 when both reconstructions are identical)
+	jaccard   the Jaccard index of the credible sets (the number of shared
+	          pixels, divided by the number of pixels in any of the sets)
+	first     the probability of the first reconstruction inside the
+	          credible set of the second reconstruction
+	second    the probability of the second reconstruction inside the
+	          credible set of the first reconstruction
+	distance  the Hausdorff distance between the credible sets, in Km (the
+	          largest distance from a pixel of a credible set to the
+	          closest pixel of the other credible set)
+
+By default, the output is printed in the standard output. Use the flag
+--output, or -o, to define an output file.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var allStages bool
+var bound float64
+var firstFile string
+var secondFile string
+var output string
+
+func setFlags(c *command.Command) {
+	c.Flags().BoolVar(&allStages, "all-stages", false, "")
+	c.Flags().Float64Var(&bound, "bound", 0.95, "")
+	c.Flags().StringVar(&firstFile, "first", "", "")
+	c.Flags().StringVar(&secondFile, "second", "", "")
+	c.Flags().StringVar(&output, "output", "", "")
+	c.Flags().StringVar(&output, "o", "", "")
+}
+
+func run(c *command.Command, args []string) (err error) {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if (firstFile == "") != (secondFile == "") {
+		return c.UsageError("expecting input files, flags --first and --second")
+	}
+	if bound <= 0 || bound > 1 {
+		return c.UsageError("flag --bound: value must be between 0 and 1")
+	}
+
+	p, err := openProject(args[0])
+	if err != nil {
+		return err
+	}
+	defer closeBundle()
+
+	if firstFile == "" {
+		firstFile, secondFile, err = bundleInputs()
+		if err != nil {
+			return c.UsageError(err.Error())
+		}
+	}
+
+	tf := p.Path(project.Trees)
+	if tf == "" {
+		msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	tc, err := readTreeFile(tf)
+	if err != nil {
+		return err
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("landscape not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	landscape, err := readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	first, err := getRec(firstFile, landscape, tc)
+	if err != nil {
+		return err
+	}
+	second, err := getRec(secondFile, landscape, tc)
+	if err != nil {
+		return err
+	}
+
+	w := c.Stdout()
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			e := f.Close()
+			if err == nil && e != nil {
+				err = e
+			}
+		}()
+		w = f
+	} else {
+		output = "stdout"
+	}
+	if err := writeCmp(w, args[0], tc, landscape.Pixelation(), first, second); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", output, err)
+	}
+	return nil
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := openFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := openFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func getRec(name string, landscape *model.TimePix, tc *timetree.Collection) (map[string]*recTree, error) {
+	r, err := openRecFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	rt, err := readRecon(r, landscape, tc)
+	if err != nil {
+		return nil, fmt.Errorf("on input file %q: %v", name, err)
+	}
+	return rt, nil
+}
+
+type recTree struct {
+	name  string
+	nodes map[int]*recNode
+}
+
+type recNode struct {
+	id     int
+	tree   *recTree
+	stages map[int64]*recStage
+}
+
+type recStage struct {
+	node *recNode
+	age  int64
+
+	// scaled probability of each pixel
+	rec map[int]float64
+
+	// pixels in the credible set
+	set map[int]bool
+}
+
+var headerFields = []string{
+	"tree",
+	"node",
+	"age",
+	"type",
+	"equator",
+	"pixel",
+	"value",
+}
+
+func readRecon(r io.Reader, landscape *model.TimePix, coll *timetree.Collection) (map[string]*recTree, error) {
+	tsv := csv.NewReader(r)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range headerFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	var tp string
+	rt := make(map[string]*recTree)
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "tree"
+		tn := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if tn == "" {
+			continue
+		}
+
+		tt := coll.Tree(tn)
+		if tt == nil {
+			continue
+		}
+		tn = tt.Name()
+
+		f = "node"
+		id, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+
+		f = "age"
+		age, err := strconv.ParseInt(row[fields[f]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+
+		if !allStages {
+			if tt.IsTerm(id) {
+				continue
+			}
+			if tt.Age(id) != age {
+				continue
+			}
+		}
+
+		t, ok := rt[tn]
+		if !ok {
+			t = &recTree{
+				name:  tn,
+				nodes: make(map[int]*recNode),
+			}
+			rt[tn] = t
+		}
+
+		n, ok := t.nodes[id]
+		if !ok {
+			n = &recNode{
+				id:     id,
+				tree:   t,
+				stages: make(map[int64]*recStage),
+			}
+			t.nodes[id] = n
+		}
+
+		st, ok := n.stages[age]
+		if !ok {
+			st = &recStage{
+				node: n,
+				age:  age,
+				rec:  make(map[int]float64),
+			}
+			n.stages[age] = st
+		}
+
+		f = "type"
+		tpV := strings.ToLower(strings.Join(strings.Fields(row[fields[f]]), " "))
+		if tpV == "" {
+			return nil, fmt.Errorf("on row %d: field %q: expecting reconstruction type", ln, f)
+		}
+		if tp == "" {
+			tp = tpV
+		}
+		if tp != tpV {
+			return nil, fmt.Errorf("on row %d: field %q: got %q want %q", ln, f, tpV, tp)
+		}
+
+		f = "equator"
+		eq, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if eq != landscape.Pixelation().Equator() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid equator value %d", ln, f, eq)
+		}
+
+		f = "pixel"
+		px, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if px >= landscape.Pixelation().Len() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, px)
+		}
+
+		f = "value"
+		v, err := strconv.ParseFloat(row[fields[f]], 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if tp == "kde" && v < 1-bound {
+			continue
+		}
+		st.rec[px] = v
+	}
+	if len(rt) == 0 {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+
+	for _, t := range rt {
+		for _, n := range t.nodes {
+			for _, s := range n.stages {
+				s.scale(tp)
+			}
+		}
+	}
+
+	return rt, nil
+}
+
+// Scale scales the values of a time stage
+// so they sum 1,
+// and sets the credible set.
+func (s *recStage) scale(tp string) {
+	if tp == "log-like" {
+		max := -math.MaxFloat64
+		for _, p := range s.rec {
+			if p > max {
+				max = p
+			}
+		}
+		for px, p := range s.rec {
+			s.rec[px] = math.Exp(p - max)
+		}
+	}
+
+	var sum float64
+	for _, p := range s.rec {
+		sum += p
+	}
+	if sum > 0 {
+		for px, p := range s.rec {
+			s.rec[px] = p / sum
+		}
+	}
+
+	s.set = make(map[int]bool, len(s.rec))
+	if tp == "kde" {
+		// the values outside the bound
+		// were already removed
+		for px := range s.rec {
+			s.set[px] = true
+		}
+		return
+	}
+
+	pixels := make([]int, 0, len(s.rec))
+	for px := range s.rec {
+		pixels = append(pixels, px)
+	}
+	slices.SortFunc(pixels, func(a, b int) int {
+		if s.rec[a] > s.rec[b] {
+			return -1
+		}
+		if s.rec[a] < s.rec[b] {
+			return 1
+		}
+		return a - b
+	})
+
+	var cum float64
+	for _, px := range pixels {
+		if cum >= bound {
+			break
+		}
+		s.set[px] = true
+		cum += s.rec[px]
+	}
+}
+
+// A comparison stores the statistics
+// of the comparison of two reconstructions
+// at a time stage.
+type comparison struct {
+	d         float64
+	jaccard   float64
+	first     float64
+	second    float64
+	hausdorff float64
+}
+
+func compare(pix *earth.Pixelation, a, b *recStage) comparison {
+	var c comparison
+
+	var diff float64
+	for px, p := range a.rec {
+		diff += math.Abs(p - b.rec[px])
+	}
+	for px, q := range b.rec {
+		if _, ok := a.rec[px]; ok {
+			continue
+		}
+		diff += q
+	}
+	c.d = 1 - diff/2
+
+	shared := 0
+	for px := range a.set {
+		if b.set[px] {
+			shared++
+		}
+	}
+	if union := len(a.set) + len(b.set) - shared; union > 0 {
+		c.jaccard = float64(shared) / float64(union)
+	}
+
+	for px, p := range a.rec {
+		if b.set[px] {
+			c.first += p
+		}
+	}
+	for px, q := range b.rec {
+		if a.set[px] {
+			c.second += q
+		}
+	}
+
+	c.hausdorff = math.Max(farthest(pix, a.set, b.set), farthest(pix, b.set, a.set))
+	return c
+}
+
+// Farthest returns the largest distance,
+// in radians,
+// from a pixel of a set
+// to the closest pixel of the other set.
+func farthest(pix *earth.Pixelation, from, to map[int]bool) float64 {
+	if len(from) == 0 || len(to) == 0 {
+		return 0
+	}
+
+	var far float64
+	for px := range from {
+		if to[px] {
+			continue
+		}
+		pt1 := pix.ID(px).Point()
+		dist := math.Pi
+		for p2 := range to {
+			d := earth.Distance(pt1, pix.ID(p2).Point())
+			if d < dist {
+				dist = d
+			}
+		}
+		if dist > far {
+			far = dist
+		}
+	}
+	return far
+}
+
+func writeCmp(w io.Writer, p string, tc *timetree.Collection, pix *earth.Pixelation, first, second map[string]*recTree) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# comparison of reconstructions, project %q\n", p)
+	fmt.Fprintf(bw, "# first: %s\n", firstFile)
+	fmt.Fprintf(bw, "# second: %s\n", secondFile)
+	fmt.Fprintf(bw, "# bound: %.6f\n", bound)
+	fmt.Fprintf(bw, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(bw, "# phygeo: %s\n", version.String())
+
+	tsv := csv.NewWriter(bw)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	if err := tsv.Write([]string{"tree", "node", "age", "d", "jaccard", "first", "second", "distance"}); err != nil {
+		return err
+	}
+
+	for _, tn := range tc.Names() {
+		ft, ok := first[tn]
+		if !ok {
+			continue
+		}
+		st, ok := second[tn]
+		if !ok {
+			continue
+		}
+
+		nodes := make([]int, 0, len(ft.nodes))
+		for id := range ft.nodes {
+			nodes = append(nodes, id)
+		}
+		slices.Sort(nodes)
+
+		for _, id := range nodes {
+			fn := ft.nodes[id]
+			sn, ok := st.nodes[id]
+			if !ok {
+				continue
+			}
+
+			ages := make([]int64, 0, len(fn.stages))
+			for a := range fn.stages {
+				ages = append(ages, a)
+			}
+			slices.Sort(ages)
+
+			for i := len(ages) - 1; i >= 0; i-- {
+				a := ages[i]
+				ss, ok := sn.stages[a]
+				if !ok {
+					continue
+				}
+				c := compare(pix, fn.stages[a], ss)
+				row := []string{
+					tn,
+					strconv.Itoa(id),
+					strconv.FormatInt(a, 10),
+					strconv.FormatFloat(c.d, 'f', 6, 64),
+					strconv.FormatFloat(c.jaccard, 'f', 6, 64),
+					strconv.FormatFloat(c.first, 'f', 6, 64),
+					strconv.FormatFloat(c.second, 'f', 6, 64),
+					strconv.FormatFloat(c.hausdorff*earth.Radius/1000, 'f', 3, 64),
+				}
+				if err := tsv.Write(row); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return nil
+}
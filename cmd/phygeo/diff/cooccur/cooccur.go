@@ -0,0 +1,515 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package cooccur implements a command to build
+// the co-occurrence matrix of the lineages
+// alive at a time stage.
+package cooccur
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/internal/input"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/version"
+	"github.com/js-arias/timetree"
+)
+
+var Command = &command.Command{
+	Usage: `cooccur --age <value> [--tree <tree>] [--names]
+	-i|--input <file> [-o|--output <file>] <project-file>`,
+	Short: "co-occurrence matrix of the lineages at a time stage",
+	Long: `
+Command cooccur reads a file with a probability reconstruction for the nodes
+of a tree in a project, and for a given time stage, measures the pairwise
+geographic overlap (co-occurrence) of all the lineages alive at that time
+stage. The resulting matrix can be used, for example, for community
+phylogenetics analyses of the inferred paleo-communities.
+
+The argument of the command is the name of the project file.
+
+The flag --input, or -i, is required and indicates the input file. The input
+file is a pixel probability file.
+
+The flag --age is required and indicates the age of the time stage, in million
+years. The time stage used will be the stage of the reconstruction closest to
+the indicated age. A lineage is alive at a time stage if the stage is at or
+older than the age of its node, and younger than the age of its parent node.
+If a lineage does not have a reconstruction at that time stage, the
+reconstruction of the closest time stage of the lineage will be used.
+
+If the project has more than one tree, the flag --tree is required to indicate
+the tree to be used.
+
+The reconstruction of each lineage is scaled so the sum of all pixels is one.
+Then, the co-occurrence of each pair of lineages is measured using Schoener's
+D:
+
+	D = 1 - 1/2 sum |p1(x) - p2(x)|
+
+which is 0 when there is no overlap, and 1 when both reconstructions are
+identical.
+
+The output is a tab-delimited square matrix. The first column and the header
+contain the IDs of the nodes of the lineages. If the flag --names is given,
+the name of the taxon will be used for the terminals. By default, the output
+is printed in the standard output. Use the flag --output, or -o, to define an
+output file.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var namesFlag bool
+var ageFlag float64
+var treeName string
+var inputFile string
+var output string
+
+func setFlags(c *command.Command) {
+	c.Flags().BoolVar(&namesFlag, "names", false, "")
+	c.Flags().Float64Var(&ageFlag, "age", -1, "")
+	c.Flags().StringVar(&treeName, "tree", "", "")
+	c.Flags().StringVar(&inputFile, "input", "", "")
+	c.Flags().StringVar(&inputFile, "i", "", "")
+	c.Flags().StringVar(&output, "output", "", "")
+	c.Flags().StringVar(&output, "o", "", "")
+}
+
+func run(c *command.Command, args []string) (err error) {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if inputFile == "" {
+		return c.UsageError("expecting input file, flag --input")
+	}
+	if ageFlag < 0 {
+		return c.UsageError("expecting time stage age, flag --age")
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	tf := p.Path(project.Trees)
+	if tf == "" {
+		msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	tc, err := readTreeFile(tf)
+	if err != nil {
+		return err
+	}
+	if treeName == "" {
+		names := tc.Names()
+		if len(names) != 1 {
+			return c.UsageError("expecting tree name, flag --tree")
+		}
+		treeName = names[0]
+	}
+	treeName = strings.ToLower(strings.Join(strings.Fields(treeName), " "))
+	t := tc.Tree(treeName)
+	if t == nil {
+		return fmt.Errorf("tree %q not found in project %q", treeName, args[0])
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("landscape not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	landscape, err := readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	rt, err := getRec(inputFile, landscape)
+	if err != nil {
+		return err
+	}
+	rec, ok := rt[treeName]
+	if !ok {
+		return fmt.Errorf("tree %q not found in input file %q", treeName, inputFile)
+	}
+
+	age := rec.closestAge(int64(ageFlag * 1_000_000))
+	lineages := rec.alive(t, age)
+	if len(lineages) == 0 {
+		return fmt.Errorf("tree %q: no lineages at %.6f My", treeName, float64(age)/1_000_000)
+	}
+
+	w := c.Stdout()
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			e := f.Close()
+			if err == nil && e != nil {
+				err = e
+			}
+		}()
+		w = f
+	}
+	if err := writeMatrix(w, t, args[0], age, lineages); err != nil {
+		if output != "" {
+			return fmt.Errorf("while writing data on %q: %v", output, err)
+		}
+		return err
+	}
+	return nil
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func getRec(name string, landscape *model.TimePix) (map[string]*recTree, error) {
+	r, err := input.Open(name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	rt, err := readRecon(r, landscape)
+	if err != nil {
+		return nil, fmt.Errorf("on input file %q: %v", name, err)
+	}
+	return rt, nil
+}
+
+type recTree struct {
+	name  string
+	nodes map[int]*recNode
+}
+
+type recNode struct {
+	id     int
+	tree   *recTree
+	stages map[int64]*recStage
+}
+
+type recStage struct {
+	node *recNode
+	age  int64
+	rec  map[int]float64
+}
+
+// ClosestAge returns the age of the time stage
+// closest to the given age.
+func (t *recTree) closestAge(age int64) int64 {
+	closest := int64(-1)
+	var diff int64 = math.MaxInt64
+	for _, n := range t.nodes {
+		for a := range n.stages {
+			d := absDiff(a, age)
+			if d < diff || (d == diff && a < closest) {
+				closest = a
+				diff = d
+			}
+		}
+	}
+	return closest
+}
+
+// Alive returns the stages of the lineages
+// alive at the given age,
+// sorted by node ID.
+func (t *recTree) alive(tv *timetree.Tree, age int64) []*recStage {
+	var lineages []*recStage
+	for id, n := range t.nodes {
+		if tv.Age(id) > age {
+			continue
+		}
+		if !tv.IsRoot(id) && tv.Age(tv.Parent(id)) <= age {
+			continue
+		}
+		// use the closest stage of the lineage
+		var st *recStage
+		for a, s := range n.stages {
+			if st == nil || absDiff(a, age) < absDiff(st.age, age) {
+				st = s
+			}
+		}
+		if st == nil {
+			continue
+		}
+		lineages = append(lineages, st)
+	}
+	slices.SortFunc(lineages, func(a, b *recStage) int {
+		return a.node.id - b.node.id
+	})
+	return lineages
+}
+
+func absDiff(a, b int64) int64 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// SchoenerD returns the Schoener's D
+// of two reconstructions.
+func schoenerD(r1, r2 map[int]float64) float64 {
+	var diff float64
+	for px, p := range r1 {
+		diff += math.Abs(p - r2[px])
+	}
+	for px, q := range r2 {
+		if _, ok := r1[px]; ok {
+			continue
+		}
+		diff += q
+	}
+	return 1 - diff/2
+}
+
+var headerFields = []string{
+	"tree",
+	"node",
+	"age",
+	"type",
+	"equator",
+	"pixel",
+	"value",
+}
+
+// ReadRecon reads a pixel probability file
+// and scales the values of each stage
+// so they sum 1.
+func readRecon(r io.Reader, landscape *model.TimePix) (map[string]*recTree, error) {
+	tsv := csv.NewReader(r)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range headerFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	var tp string
+	rt := make(map[string]*recTree)
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "tree"
+		tn := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if tn == "" {
+			continue
+		}
+		tn = strings.ToLower(tn)
+		t, ok := rt[tn]
+		if !ok {
+			t = &recTree{
+				name:  tn,
+				nodes: make(map[int]*recNode),
+			}
+			rt[tn] = t
+		}
+
+		f = "node"
+		id, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		n, ok := t.nodes[id]
+		if !ok {
+			n = &recNode{
+				id:     id,
+				tree:   t,
+				stages: make(map[int64]*recStage),
+			}
+			t.nodes[id] = n
+		}
+
+		f = "age"
+		age, err := strconv.ParseInt(row[fields[f]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		st, ok := n.stages[age]
+		if !ok {
+			st = &recStage{
+				node: n,
+				age:  age,
+				rec:  make(map[int]float64),
+			}
+			n.stages[age] = st
+		}
+
+		f = "type"
+		tpV := strings.ToLower(strings.Join(strings.Fields(row[fields[f]]), " "))
+		if tpV == "" {
+			return nil, fmt.Errorf("on row %d: field %q: expecting reconstruction type", ln, f)
+		}
+		if tp == "" {
+			tp = tpV
+		}
+		if tp != tpV {
+			return nil, fmt.Errorf("on row %d: field %q: got %q want %q", ln, f, tpV, tp)
+		}
+
+		f = "equator"
+		eq, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if eq != landscape.Pixelation().Equator() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid equator value %d", ln, f, eq)
+		}
+
+		f = "pixel"
+		px, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if px >= landscape.Pixelation().Len() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, px)
+		}
+
+		f = "value"
+		v, err := strconv.ParseFloat(row[fields[f]], 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		st.rec[px] = v
+	}
+	if len(rt) == 0 {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+
+	for _, t := range rt {
+		for _, n := range t.nodes {
+			for _, s := range n.stages {
+				if tp == "log-like" {
+					max := -math.MaxFloat64
+					for _, p := range s.rec {
+						if p > max {
+							max = p
+						}
+					}
+					for px, p := range s.rec {
+						s.rec[px] = math.Exp(p - max)
+					}
+				}
+
+				var sum float64
+				for _, p := range s.rec {
+					sum += p
+				}
+				if sum == 0 {
+					continue
+				}
+				for px, p := range s.rec {
+					s.rec[px] = p / sum
+				}
+			}
+		}
+	}
+
+	return rt, nil
+}
+
+func writeMatrix(w io.Writer, t *timetree.Tree, p string, age int64, lineages []*recStage) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# lineage co-occurrence, tree %q, project %q\n", t.Name(), p)
+	fmt.Fprintf(bw, "# age: %d\n", age)
+	fmt.Fprintf(bw, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(bw, "# phygeo: %s\n", version.String())
+
+	tsv := csv.NewWriter(bw)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+
+	names := make([]string, len(lineages))
+	for i, l := range lineages {
+		names[i] = strconv.Itoa(l.node.id)
+		if namesFlag && t.IsTerm(l.node.id) {
+			names[i] = t.Taxon(l.node.id)
+		}
+	}
+	if err := tsv.Write(append([]string{"node"}, names...)); err != nil {
+		return err
+	}
+
+	for i, l1 := range lineages {
+		row := make([]string, 0, len(lineages)+1)
+		row = append(row, names[i])
+		for j, l2 := range lineages {
+			d := 1.0
+			if i != j {
+				d = schoenerD(l1.rec, l2.rec)
+			}
+			row = append(row, strconv.FormatFloat(d, 'f', 6, 64))
+		}
+		if err := tsv.Write(row); err != nil {
+			return err
+		}
+	}
+
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return nil
+}
@@ -9,13 +9,34 @@ package diff
 
 import (
 	"github.com/js-arias/command"
+	"github.com/js-arias/phygeo/cmd/phygeo/diff/ages"
+	"github.com/js-arias/phygeo/cmd/phygeo/diff/arrival"
+	"github.com/js-arias/phygeo/cmd/phygeo/diff/bundlecmd"
+	"github.com/js-arias/phygeo/cmd/phygeo/diff/cmpcmd"
+	"github.com/js-arias/phygeo/cmd/phygeo/diff/cooccur"
+	"github.com/js-arias/phygeo/cmd/phygeo/diff/displace"
+	"github.com/js-arias/phygeo/cmd/phygeo/diff/equilibrium"
+	"github.com/js-arias/phygeo/cmd/phygeo/diff/filter"
 	"github.com/js-arias/phygeo/cmd/phygeo/diff/freq"
+	"github.com/js-arias/phygeo/cmd/phygeo/diff/hostile"
 	"github.com/js-arias/phygeo/cmd/phygeo/diff/integrate"
+	"github.com/js-arias/phygeo/cmd/phygeo/diff/latband"
+	"github.com/js-arias/phygeo/cmd/phygeo/diff/ldd"
 	"github.com/js-arias/phygeo/cmd/phygeo/diff/like"
+	"github.com/js-arias/phygeo/cmd/phygeo/diff/loo"
 	"github.com/js-arias/phygeo/cmd/phygeo/diff/mapcmd"
+	"github.com/js-arias/phygeo/cmd/phygeo/diff/merge"
 	"github.com/js-arias/phygeo/cmd/phygeo/diff/ml"
+	"github.com/js-arias/phygeo/cmd/phygeo/diff/overlap"
 	"github.com/js-arias/phygeo/cmd/phygeo/diff/particles"
+	"github.com/js-arias/phygeo/cmd/phygeo/diff/presence"
+	"github.com/js-arias/phygeo/cmd/phygeo/diff/realm"
+	"github.com/js-arias/phygeo/cmd/phygeo/diff/rose"
+	"github.com/js-arias/phygeo/cmd/phygeo/diff/shift"
+	"github.com/js-arias/phygeo/cmd/phygeo/diff/simmap"
+	"github.com/js-arias/phygeo/cmd/phygeo/diff/size"
 	"github.com/js-arias/phygeo/cmd/phygeo/diff/speed"
+	"github.com/js-arias/phygeo/cmd/phygeo/diff/stem"
 )
 
 var Command = &command.Command{
@@ -24,13 +45,34 @@ var Command = &command.Command{
 }
 
 func init() {
+	Command.Add(ages.Command)
+	Command.Add(arrival.Command)
+	Command.Add(bundlecmd.Command)
+	Command.Add(cmpcmd.Command)
+	Command.Add(cooccur.Command)
+	Command.Add(displace.Command)
+	Command.Add(equilibrium.Command)
+	Command.Add(filter.Command)
 	Command.Add(freq.Command)
+	Command.Add(hostile.Command)
 	Command.Add(integrate.Command)
+	Command.Add(latband.Command)
+	Command.Add(ldd.Command)
 	Command.Add(like.Command)
+	Command.Add(loo.Command)
 	Command.Add(mapcmd.Command)
+	Command.Add(merge.Command)
 	Command.Add(ml.Command)
+	Command.Add(overlap.Command)
 	Command.Add(particles.Command)
+	Command.Add(presence.Command)
+	Command.Add(realm.Command)
+	Command.Add(rose.Command)
+	Command.Add(shift.Command)
+	Command.Add(simmap.Command)
+	Command.Add(size.Command)
 	Command.Add(speed.Command)
+	Command.Add(stem.Command)
 
 	// help topics
 	Command.Add(pixProbGuide)
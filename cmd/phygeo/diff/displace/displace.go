@@ -0,0 +1,341 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package displace implements a command to measure
+// the displacement between ancestor and descendant nodes
+// in a reconstruction.
+package displace
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/internal/input"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/timetree"
+	"gonum.org/v1/gonum/stat"
+)
+
+var Command = &command.Command{
+	Usage: `displace -i|--input <file> <project-file>`,
+	Short: "calculate ancestor-descendant displacements",
+	Long: `
+Command displace reads a file with sampled pixels from a stochastic mapping of
+one or more trees in a project, and calculates, for each pair of parent and
+child nodes, the great circle distance between the reconstructed location of
+the parent node (at the age of the parent split) and the reconstructed
+location of the child node (at the age of the child split, or the terminal
+age).
+
+In contrast with the distance reported by the command speed, which is the sum
+of the distances traveled in each time segment of a branch, the displacement
+is the net distance between the ends of a branch. The locations are taken as
+reconstructed at each age, that is, using the paleogeographic coordinates of
+each time stage.
+
+The argument of the command is the name of the project file.
+
+The flag --input, or -i, is required and indicates the input file. If the
+input is "-", the file will be read from the standard input.
+
+The output will be printed in the standard output, as a tab-delimited table
+with the following columns:
+
+	tree      the name of the tree
+	parent    the ID of the parent node
+	node      the ID of the child node
+	age       the age of the child node, in million years
+	brLen     the length of the branch in million years
+	distance  the median of the displacement in kilometers
+	d-025     the 2.5% of the empirical CDF of the displacement in Km
+	d-975     the 97.5% of the empirical CDF of the displacement in Km
+	dist-rad  the median of the displacement in radians
+	dr-025    the 2.5% of the empirical CDF of the displacement in radians
+	dr-975    the 97.5% of the empirical CDF of the displacement in radians
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var inputFile string
+
+func setFlags(c *command.Command) {
+	c.Flags().StringVar(&inputFile, "input", "", "")
+	c.Flags().StringVar(&inputFile, "i", "", "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if inputFile == "" {
+		return c.UsageError("expecting input file, flag --input")
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("landscape not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	landscape, err := readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	tf := p.Path(project.Trees)
+	if tf == "" {
+		msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	tc, err := readTreeFile(tf)
+	if err != nil {
+		return err
+	}
+
+	rt, err := getRec(inputFile, c.Stdin(), tc, landscape)
+	if err != nil {
+		return err
+	}
+
+	if err := writeDisplacement(c.Stdout(), tc, rt); err != nil {
+		return fmt.Errorf("while writing on standard output: %v", err)
+	}
+	return nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func getRec(name string, stdin io.Reader, tc *timetree.Collection, landscape *model.TimePix) (map[string]*recTree, error) {
+	f, err := input.Open(name, stdin)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rt, err := readRecon(f, tc, landscape)
+	if err != nil {
+		return nil, fmt.Errorf("on input file %q: %v", name, err)
+	}
+	return rt, nil
+}
+
+// A recTree stores the location of each node
+// for each particle.
+type recTree struct {
+	name  string
+	nodes map[int]map[int]earth.Point
+}
+
+var headerFields = []string{
+	"tree",
+	"particle",
+	"node",
+	"age",
+	"to",
+}
+
+func readRecon(r io.Reader, tc *timetree.Collection, tp *model.TimePix) (map[string]*recTree, error) {
+	tsv := csv.NewReader(r)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range headerFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	rt := make(map[string]*recTree)
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "tree"
+		tn := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if tn == "" {
+			continue
+		}
+		tn = strings.ToLower(tn)
+		tv := tc.Tree(tn)
+		if tv == nil {
+			continue
+		}
+
+		f = "node"
+		id, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+
+		// only the location at the node age is used
+		f = "age"
+		age, err := strconv.ParseInt(row[fields[f]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if age != tv.Age(id) {
+			continue
+		}
+
+		f = "particle"
+		pN, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+
+		f = "to"
+		px, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if px >= tp.Pixelation().Len() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, px)
+		}
+
+		t, ok := rt[tn]
+		if !ok {
+			t = &recTree{
+				name:  tn,
+				nodes: make(map[int]map[int]earth.Point),
+			}
+			rt[tn] = t
+		}
+		n, ok := t.nodes[id]
+		if !ok {
+			n = make(map[int]earth.Point)
+			t.nodes[id] = n
+		}
+		n[pN] = tp.Pixelation().ID(px).Point()
+	}
+
+	if len(rt) == 0 {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+
+	return rt, nil
+}
+
+func writeDisplacement(w io.Writer, tc *timetree.Collection, rt map[string]*recTree) error {
+	tab := csv.NewWriter(w)
+	tab.Comma = '\t'
+	tab.UseCRLF = true
+
+	if err := tab.Write([]string{"tree", "parent", "node", "age", "brLen", "distance", "d-025", "d-975", "dist-rad", "dr-025", "dr-975"}); err != nil {
+		return err
+	}
+	for _, name := range tc.Names() {
+		dt, ok := rt[name]
+		if !ok {
+			continue
+		}
+		t := tc.Tree(name)
+
+		for _, nID := range t.Nodes() {
+			if t.IsRoot(nID) {
+				continue
+			}
+			pID := t.Parent(nID)
+			pn := dt.nodes[pID]
+			cn := dt.nodes[nID]
+
+			dist := make([]float64, 0, len(cn))
+			for p, pt := range cn {
+				ppt, ok := pn[p]
+				if !ok {
+					continue
+				}
+				dist = append(dist, earth.Distance(ppt, pt))
+			}
+			if len(dist) == 0 {
+				continue
+			}
+			slices.Sort(dist)
+
+			brLen := float64(t.Age(pID)-t.Age(nID)) / timestage.MillionYears
+			dR := stat.Quantile(0.5, stat.Empirical, dist, nil)
+			d025 := stat.Quantile(0.025, stat.Empirical, dist, nil)
+			d975 := stat.Quantile(0.975, stat.Empirical, dist, nil)
+
+			row := []string{
+				name,
+				strconv.Itoa(pID),
+				strconv.Itoa(nID),
+				strconv.FormatFloat(float64(t.Age(nID))/timestage.MillionYears, 'f', 3, 64),
+				strconv.FormatFloat(brLen, 'f', 3, 64),
+				strconv.FormatFloat(dR*earth.Radius/1000, 'f', 3, 64),
+				strconv.FormatFloat(d025*earth.Radius/1000, 'f', 3, 64),
+				strconv.FormatFloat(d975*earth.Radius/1000, 'f', 3, 64),
+				strconv.FormatFloat(dR, 'f', 3, 64),
+				strconv.FormatFloat(d025, 'f', 3, 64),
+				strconv.FormatFloat(d975, 'f', 3, 64),
+			}
+			if err := tab.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	tab.Flush()
+	if err := tab.Error(); err != nil {
+		return err
+	}
+	return nil
+}
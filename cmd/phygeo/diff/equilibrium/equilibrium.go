@@ -0,0 +1,288 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package equilibrium implements a command to calculate
+// the equilibrium distribution of the diffusion model.
+package equilibrium
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/infer/diffusion"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/phygeo/version"
+)
+
+var Command = &command.Command{
+	Usage: `equilibrium [--lambda <value>] [--duration <value>]
+	[-o|--output <file>] [--cpu <number>] <project-file>`,
+	Short: "calculate the equilibrium distribution of the model",
+	Long: `
+Command equilibrium calculates the equilibrium (i.e., stationary) distribution
+of the diffusion model at each time stage of a project, that is, the expected
+location of a lineage that moves for a long time in the landscape of a time
+stage, without any geographic data. As this distribution depends only on the
+landscape, the pixel weights, and the concentration parameter, it is the null
+expectation against which the reconstructions of the nodes can be compared.
+
+The argument of the command is the name of the project file.
+
+In each step of the process, a lineage moves from a pixel to another using the
+same kernel of the likelihood reconstruction: a spherical normal scaled by the
+weight of the destination pixel. As this kernel is reversible, the stationary
+distribution (the limit of a power iteration over the kernel) is calculated
+directly: the probability of a pixel is proportional to its weight, times the
+sum of the kernel from the pixel to all the pixels of the landscape. In a
+landscape with disconnected regions, each region will have a probability
+proportional to its size and weight.
+
+The flag --lambda defines the concentration parameter of the spherical normal
+(in 1/radian^2 units), by default is 100. The flag --duration defines the
+duration of each step of the process, in million years (by default 1). The
+kernel of each step is a spherical normal with a concentration of lambda
+divided by the duration.
+
+The output is a pixel probability file (see 'phygeo help diff
+pix-prob-files'), with the tree name "equilibrium" and the node 0, and the
+probability of each pixel at each time stage as a "freq" value, so it can be
+drawn with the command 'diff map'. By default, the output file will be named
+using the project name, the "equilibrium" suffix, and the lambda value. Use
+the flag --output, or -o, to define a different name.
+
+As calculating the distribution can be computationally expensive, it is
+calculated in parallel using all available processors. Use the flag --cpu to
+change the number of processors.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var lambdaFlag float64
+var durationFlag float64
+var numCPU int
+var output string
+
+func setFlags(c *command.Command) {
+	c.Flags().Float64Var(&lambdaFlag, "lambda", 100, "")
+	c.Flags().Float64Var(&durationFlag, "duration", 1, "")
+	c.Flags().IntVar(&numCPU, "cpu", runtime.GOMAXPROCS(0), "")
+	c.Flags().StringVar(&output, "output", "", "")
+	c.Flags().StringVar(&output, "o", "", "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if lambdaFlag <= 0 {
+		return c.UsageError("flag --lambda: value must be greater than 0")
+	}
+	if durationFlag <= 0 {
+		return c.UsageError("flag --duration: value must be greater than 0")
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("paleolandscape not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	landscape, err := readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	rotF := p.Path(project.GeoMotion)
+	if rotF == "" {
+		msg := fmt.Sprintf("plate motion model not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	rot, err := readRotation(rotF, landscape.Pixelation())
+	if err != nil {
+		return err
+	}
+
+	stF := p.Path(project.Stages)
+	stages, err := readStages(stF, rot, landscape)
+	if err != nil {
+		return err
+	}
+
+	pwF := p.Path(project.PixWeight)
+	if pwF == "" {
+		msg := fmt.Sprintf("pixel weights not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	pw, err := readPixWeights(pwF)
+	if err != nil {
+		return err
+	}
+
+	dm, _ := earth.NewDistMatRingScale(landscape.Pixelation())
+	param := diffusion.Param{
+		Landscape: landscape,
+		DM:        dm,
+		PW:        pw,
+		Lambda:    lambdaFlag,
+	}
+	diffusion.SetCPU(numCPU)
+
+	ages := stages.Stages()
+	eq := make(map[int64]map[int]float64, len(ages))
+	for _, a := range ages {
+		eq[a] = diffusion.Equilibrium(param, a, durationFlag)
+	}
+
+	if output == "" {
+		output = fmt.Sprintf("%s-equilibrium-%.6f.tab", args[0], lambdaFlag)
+	}
+	if err := writeEquilibrium(output, args[0], ages, eq, landscape.Pixelation()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func writeEquilibrium(name, p string, ages []int64, eq map[int64]map[int]float64, pix *earth.Pixelation) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if err == nil && e != nil {
+			err = e
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "# diff.equilibrium, project %q\n", p)
+	fmt.Fprintf(w, "# lambda: %.6f * 1/radian^2\n", lambdaFlag)
+	fmt.Fprintf(w, "# step duration: %.6f My\n", durationFlag)
+	fmt.Fprintf(w, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "# phygeo: %s\n", version.String())
+
+	tsv := csv.NewWriter(w)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	if err := tsv.Write([]string{"tree", "node", "age", "type", "equator", "pixel", "value"}); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+
+	equator := strconv.Itoa(pix.Equator())
+	for i := len(ages) - 1; i >= 0; i-- {
+		a := ages[i]
+		st := eq[a]
+		age := strconv.FormatInt(a, 10)
+		for px := 0; px < pix.Len(); px++ {
+			v, ok := st[px]
+			if !ok {
+				continue
+			}
+			row := []string{
+				"equilibrium",
+				"0",
+				age,
+				"freq",
+				equator,
+				strconv.Itoa(px),
+				strconv.FormatFloat(v, 'f', 15, 64),
+			}
+			if err := tsv.Write(row); err != nil {
+				return fmt.Errorf("while writing data on %q: %v", name, err)
+			}
+		}
+	}
+
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	return nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readRotation(name string, pix *earth.Pixelation) (*model.StageRot, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rot, err := model.ReadStageRot(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return rot, nil
+}
+
+func readPixWeights(name string) (pixweight.Pixel, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pw, err := pixweight.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return pw, nil
+}
+
+func readStages(name string, rot *model.StageRot, landscape *model.TimePix) (timestage.Stages, error) {
+	stages := timestage.New()
+	stages.Add(rot)
+	stages.Add(landscape)
+
+	if name == "" {
+		return stages, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := timestage.Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+	stages.Add(st)
+
+	return stages, nil
+}
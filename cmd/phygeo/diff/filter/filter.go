@@ -0,0 +1,616 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package filter implements a command to extract a subset
+// of a pixel probability file,
+// or a stochastic mapping file.
+package filter
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/clade"
+	"github.com/js-arias/phygeo/internal/geobox"
+	"github.com/js-arias/phygeo/internal/input"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/version"
+	"github.com/js-arias/timetree"
+)
+
+var Command = &command.Command{
+	Usage: `filter [--trees <tree-list>] [--nodes <node-list>]
+	[--clades <clade-list>] [--window <min,max>]
+	[--box <lat,lon,lat,lon>] [--values <value-list>] [--condition]
+	[--normalize <mode>]
+	-i|--input <file> [-o|--output <file>] <project-file>`,
+	Short: "extract a subset of a reconstruction file",
+	Long: `
+Command filter reads a pixel probability file (see 'phygeo diff
+pix-prob-files'), or a stochastic mapping file (see 'phygeo diff mapping'),
+and writes the rows that match a set of conditions, so other commands can be
+used with only a subset of a reconstruction. The type of the file is detected
+from the columns of the file.
+
+The argument of the command is the name of the project file.
+
+The flag --input, or -i, is required and indicates the input file. If the
+input is "-", the file will be read from the standard input.
+
+If no flag is given, all the rows will be written. The flags are combined, so
+a row is written only if it matches all the conditions.
+
+The flag --trees defines the trees to be used, the format is the tree names
+separated by commas, for example "tree-1,tree-2".
+
+The flag --nodes defines the nodes to be used, the format is the node IDs
+separated by commas, for example "0,1,6,10". The list can also include clade
+labels defined in the project (see 'phygeo tree label'), for example
+"0,felids"; a label is resolved in each tree as the most recent common
+ancestor of its terminals. The flag --clades uses the same format, but each
+element selects the indicated node and all of its descendants. If both flags
+are defined, the nodes of both flags will be used.
+
+The flag --window defines an age window, with the format "min,max", in
+million years, for example "5,23". Only the time stages with an age inside the
+window (including the bounds) will be used.
+
+A spatial region can be defined with one of the following flags. The flag
+--box defines a box using the latitude and longitude of two opposite corners,
+in present coordinates, for example "-10,-80,-40,-50". The first corner is the
+western corner, and the second corner is the eastern corner, so a box that
+crosses the antimeridian is defined with a western longitude greater than the
+eastern longitude, for example "-10,170,-30,-170". The pixels of the box
+are rotated to each time stage using the plate motion model of the project.
+The flag --values defines the region using the landscape values of the pixels
+at each time stage. The format is the values separated by commas, for example,
+"1,2" will use all the pixels with the values 1 or 2. In pixel probability
+files, only the pixels inside the region will be used. In stochastic mapping
+files, by default, only the rows in which the particle is inside the region
+(i.e., the "to" column) will be used. If the flag --condition is set, instead
+of removing the rows outside the region, all the rows of the particles that
+enter the region at least once will be kept, and the particles that never
+enter the region will be removed. Only the rows that match the other flags
+are used to check if a particle enters the region.
+
+In pixel probability files, the values of the selected pixels are kept as
+they are in the input file. The flag --normalize can be used to rescale the
+values of each node at each time stage. Valid values are:
+
+	none  the values are not rescaled (the default)
+	sum   the values are rescaled so they sum 1 (in "log-like" files, the
+	      exponential of the values sum 1)
+	max   the values are rescaled so the maximum value is 1 (in "log-like"
+	      files, the maximum value is 0)
+
+Values of the type "kde" can not be rescaled, as they are cumulative values.
+
+By default, the output is printed in the standard output. Use the flag
+--output, or -o, to define an output file. The output file has the same
+columns as the input file, and keeps the comments of the header of the input
+file.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var conditionFlag bool
+var treesFlag string
+var nodesFlag string
+var cladesFlag string
+var windowFlag string
+var boxFlag string
+var valuesFlag string
+var normFlag string
+var inputFile string
+var output string
+
+func setFlags(c *command.Command) {
+	c.Flags().BoolVar(&conditionFlag, "condition", false, "")
+	c.Flags().StringVar(&treesFlag, "trees", "", "")
+	c.Flags().StringVar(&nodesFlag, "nodes", "", "")
+	c.Flags().StringVar(&cladesFlag, "clades", "", "")
+	c.Flags().StringVar(&windowFlag, "window", "", "")
+	c.Flags().StringVar(&boxFlag, "box", "", "")
+	c.Flags().StringVar(&valuesFlag, "values", "", "")
+	c.Flags().StringVar(&normFlag, "normalize", "none", "")
+	c.Flags().StringVar(&inputFile, "input", "", "")
+	c.Flags().StringVar(&inputFile, "i", "", "")
+	c.Flags().StringVar(&output, "output", "", "")
+	c.Flags().StringVar(&output, "o", "", "")
+}
+
+// Valid values of the flag --normalize.
+const (
+	normNone = "none"
+	normSum  = "sum"
+	normMax  = "max"
+)
+
+func run(c *command.Command, args []string) (err error) {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if inputFile == "" {
+		return c.UsageError("expecting input file, flag --input")
+	}
+	if boxFlag != "" && valuesFlag != "" {
+		return c.UsageError("flag --box and flag --values are mutually exclusive")
+	}
+	if conditionFlag && boxFlag == "" && valuesFlag == "" {
+		return c.UsageError("flag --condition: expecting a region, flag --box or flag --values")
+	}
+	normFlag = strings.ToLower(normFlag)
+	switch normFlag {
+	case normNone, normSum, normMax:
+	default:
+		return c.UsageError(fmt.Sprintf("flag --normalize: unknown value %q", normFlag))
+	}
+
+	s := &selection{
+		trees: parseTreeNames(),
+	}
+	s.minAge, s.maxAge, err = parseWindow()
+	if err != nil {
+		return err
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	if nodesFlag != "" || cladesFlag != "" {
+		tf := p.Path(project.Trees)
+		if tf == "" {
+			msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+			return c.UsageError(msg)
+		}
+		tc, err := readTreeFile(tf)
+		if err != nil {
+			return err
+		}
+
+		labels := clade.New()
+		if lf := p.Path(project.Clades); lf != "" {
+			labels, err = readLabels(lf)
+			if err != nil {
+				return err
+			}
+		}
+		s.nodes, err = parseNodes(tc, labels)
+		if err != nil {
+			return err
+		}
+	}
+
+	if boxFlag != "" || valuesFlag != "" {
+		s.reg, err = readRegion(c, p, args[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	in, err := input.Open(inputFile, c.Stdin())
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	w := c.Stdout()
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			e := f.Close()
+			if err == nil && e != nil {
+				err = e
+			}
+		}()
+		w = f
+	} else {
+		output = "stdout"
+	}
+
+	n, err := filterFile(in, w, s, args[0])
+	if err != nil {
+		return fmt.Errorf("while filtering %q into %q: %v", inputFile, output, err)
+	}
+	if n == 0 {
+		fmt.Fprintf(c.Stderr(), "WARNING: no rows of %q match the filters\n", inputFile)
+	}
+	return nil
+}
+
+// ReadRegion returns the region
+// defined by the flags --box or --values.
+func readRegion(c *command.Command, p *project.Project, name string) (*region, error) {
+	reg := &region{
+		stages: make(map[int64]map[int]bool),
+	}
+	var err error
+	if boxFlag != "" {
+		bx, err := geobox.Parse(boxFlag)
+		if err != nil {
+			return nil, fmt.Errorf("on flag --box: %v", err)
+		}
+		reg.box = &bx
+	} else {
+		reg.values, err = parseValues(valuesFlag)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("landscape not defined in project %q", name)
+		return nil, c.UsageError(msg)
+	}
+	reg.landscape, err = readLandscape(lsf)
+	if err != nil {
+		return nil, err
+	}
+
+	if boxFlag != "" {
+		rotF := p.Path(project.GeoMotion)
+		if rotF == "" {
+			msg := fmt.Sprintf("plate motion model not defined in project %q", name)
+			return nil, c.UsageError(msg)
+		}
+		reg.tot, err = readRotation(rotF, reg.landscape.Pixelation())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return reg, nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readRotation(name string, pix *earth.Pixelation) (*model.Total, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rot, err := model.ReadTotal(f, pix, false)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return rot, nil
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func readLabels(name string) (*clade.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := clade.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+// Kinds of reconstruction files.
+const (
+	pixProbFile = iota
+	mappingFile
+)
+
+var pixProbFields = []string{
+	"tree",
+	"node",
+	"age",
+	"type",
+	"equator",
+	"pixel",
+	"value",
+}
+
+var mappingFields = []string{
+	"tree",
+	"particle",
+	"node",
+	"age",
+	"to",
+}
+
+// FilterFile writes the rows of a reconstruction file
+// that match a selection.
+// It returns the number of rows written.
+func filterFile(r io.Reader, w io.Writer, s *selection, p string) (int, error) {
+	br := bufio.NewReader(r)
+
+	// header comments
+	var comments []string
+	var head []string
+	skip := 0
+	for head == nil {
+		ln, err := br.ReadString('\n')
+		if ln == "" && err != nil {
+			if errors.Is(err, io.EOF) {
+				return 0, fmt.Errorf("while reading header: %v", err)
+			}
+			return 0, err
+		}
+		skip++
+		ln = strings.TrimRight(ln, "\r\n")
+		if strings.HasPrefix(ln, "#") {
+			comments = append(comments, ln)
+			continue
+		}
+		if strings.TrimSpace(ln) == "" {
+			continue
+		}
+		hr := csv.NewReader(strings.NewReader(ln))
+		hr.Comma = '\t'
+		head, err = hr.Read()
+		if err != nil {
+			return 0, fmt.Errorf("while reading header: %v", err)
+		}
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+
+	kind := pixProbFile
+	req := pixProbFields
+	if _, ok := fields["particle"]; ok {
+		kind = mappingFile
+		req = mappingFields
+	}
+	for _, h := range req {
+		if _, ok := fields[h]; !ok {
+			return 0, fmt.Errorf("expecting field %q", h)
+		}
+	}
+	if kind == mappingFile && normFlag != normNone {
+		return 0, fmt.Errorf("flag --normalize: only valid for pixel probability files")
+	}
+	if kind == pixProbFile && conditionFlag {
+		return 0, fmt.Errorf("flag --condition: only valid for stochastic mapping files")
+	}
+
+	tsv := csv.NewReader(br)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+	tsv.FieldsPerRecord = len(head)
+
+	out, err := outHeader(w, head, comments, p)
+	if err != nil {
+		return 0, err
+	}
+
+	// rows are only stored
+	// if they are required to be processed
+	// after reading the whole file
+	store := conditionFlag || normFlag != normNone
+	var rows [][]string
+
+	// particles that enter the region
+	visited := make(map[string]map[int]bool)
+
+	pxField := "pixel"
+	if kind == mappingFile {
+		pxField = "to"
+	}
+	_, hasEquator := fields["equator"]
+	n := 0
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		ln += skip
+		if err != nil {
+			return 0, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "tree"
+		tn := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if tn == "" {
+			continue
+		}
+		tn = strings.ToLower(tn)
+		if !s.hasTree(tn) {
+			continue
+		}
+
+		f = "node"
+		id, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return 0, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if !s.hasNode(tn, id) {
+			continue
+		}
+
+		f = "age"
+		age, err := strconv.ParseInt(row[fields[f]], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if !s.hasAge(age) {
+			continue
+		}
+
+		if s.reg != nil {
+			pix := s.reg.landscape.Pixelation()
+			if hasEquator {
+				f = "equator"
+				eq, err := strconv.Atoi(row[fields[f]])
+				if err != nil {
+					return 0, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+				}
+				if eq != pix.Equator() {
+					return 0, fmt.Errorf("on row %d: field %q: got %d, want %d", ln, f, eq, pix.Equator())
+				}
+			}
+
+			f = pxField
+			px, err := strconv.Atoi(row[fields[f]])
+			if err != nil {
+				return 0, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+			}
+			if px < 0 || px >= pix.Len() {
+				return 0, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, px)
+			}
+
+			in := s.reg.in(age, px)
+			if conditionFlag {
+				f = "particle"
+				pN, err := strconv.Atoi(row[fields[f]])
+				if err != nil {
+					return 0, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+				}
+				if in {
+					v, ok := visited[tn]
+					if !ok {
+						v = make(map[int]bool)
+						visited[tn] = v
+					}
+					v[pN] = true
+				}
+			} else if !in {
+				continue
+			}
+		}
+
+		if store {
+			rows = append(rows, row)
+			continue
+		}
+		if err := out.Write(row); err != nil {
+			return 0, err
+		}
+		n++
+	}
+
+	if conditionFlag {
+		rows = visitedRows(rows, fields, visited)
+	}
+	if normFlag != normNone {
+		if err := normalize(rows, fields, normFlag); err != nil {
+			return 0, err
+		}
+	}
+	for _, row := range rows {
+		if err := out.Write(row); err != nil {
+			return 0, err
+		}
+		n++
+	}
+
+	out.Flush()
+	if err := out.Error(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func outHeader(w io.Writer, head, comments []string, p string) (*csv.Writer, error) {
+	for _, c := range comments {
+		fmt.Fprintf(w, "%s\n", c)
+	}
+	fmt.Fprintf(w, "# diff.filter, project %q\n", p)
+	if treesFlag != "" {
+		fmt.Fprintf(w, "# trees: %s\n", treesFlag)
+	}
+	if nodesFlag != "" {
+		fmt.Fprintf(w, "# nodes: %s\n", nodesFlag)
+	}
+	if cladesFlag != "" {
+		fmt.Fprintf(w, "# clades: %s\n", cladesFlag)
+	}
+	if windowFlag != "" {
+		fmt.Fprintf(w, "# age window: %s\n", windowFlag)
+	}
+	if boxFlag != "" {
+		fmt.Fprintf(w, "# region: box %s\n", boxFlag)
+	}
+	if valuesFlag != "" {
+		fmt.Fprintf(w, "# region: values %s\n", valuesFlag)
+	}
+	if conditionFlag {
+		fmt.Fprintf(w, "# conditioned on particles that enter the region\n")
+	}
+	if normFlag != normNone {
+		fmt.Fprintf(w, "# normalize: %s\n", normFlag)
+	}
+	fmt.Fprintf(w, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "# phygeo: %s\n", version.String())
+
+	tsv := csv.NewWriter(w)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	if err := tsv.Write(head); err != nil {
+		return nil, err
+	}
+	return tsv, nil
+}
+
+// VisitedRows returns the rows of the particles
+// that enter the region.
+func visitedRows(rows [][]string, fields map[string]int, visited map[string]map[int]bool) [][]string {
+	var keep [][]string
+	for _, row := range rows {
+		tn := strings.ToLower(strings.Join(strings.Fields(row[fields["tree"]]), " "))
+		// the particle ID was already validated
+		pN, _ := strconv.Atoi(row[fields["particle"]])
+		if !visited[tn][pN] {
+			continue
+		}
+		keep = append(keep, row)
+	}
+	return keep
+}
@@ -0,0 +1,100 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A stageKey identifies a time stage
+// of a node of a tree.
+type stageKey struct {
+	tree string
+	node string
+	age  string
+}
+
+// Normalize rescales the values
+// of the rows of a pixel probability file,
+// so the values of each node at each time stage
+// sum 1 (with mode "sum")
+// or have a maximum of 1 (with mode "max").
+// In "log-like" files,
+// the values are rescaled in log space.
+func normalize(rows [][]string, fields map[string]int, mode string) error {
+	stages := make(map[stageKey][]int)
+	var keys []stageKey
+	values := make([]float64, len(rows))
+	for i, row := range rows {
+		k := stageKey{
+			tree: strings.ToLower(strings.Join(strings.Fields(row[fields["tree"]]), " ")),
+			node: row[fields["node"]],
+			age:  row[fields["age"]],
+		}
+		if _, ok := stages[k]; !ok {
+			keys = append(keys, k)
+		}
+		stages[k] = append(stages[k], i)
+
+		f := "value"
+		v, err := strconv.ParseFloat(row[fields[f]], 64)
+		if err != nil {
+			return fmt.Errorf("tree %q, node %s, age %s: field %q: %v", k.tree, k.node, k.age, f, err)
+		}
+		values[i] = v
+	}
+
+	for _, k := range keys {
+		idx := stages[k]
+		tp := strings.ToLower(rows[idx[0]][fields["type"]])
+		for _, i := range idx {
+			if t := strings.ToLower(rows[i][fields["type"]]); t != tp {
+				return fmt.Errorf("tree %q, node %s, age %s: mixed value types %q and %q", k.tree, k.node, k.age, tp, t)
+			}
+		}
+
+		switch tp {
+		case "log-like":
+			max := -math.MaxFloat64
+			for _, i := range idx {
+				if values[i] > max {
+					max = values[i]
+				}
+			}
+			scale := max
+			if mode == normSum {
+				var sum float64
+				for _, i := range idx {
+					sum += math.Exp(values[i] - max)
+				}
+				scale = max + math.Log(sum)
+			}
+			for _, i := range idx {
+				rows[i][fields["value"]] = strconv.FormatFloat(values[i]-scale, 'f', 8, 64)
+			}
+		case "freq":
+			var scale float64
+			for _, i := range idx {
+				if mode == normSum {
+					scale += values[i]
+				} else if values[i] > scale {
+					scale = values[i]
+				}
+			}
+			if scale == 0 {
+				continue
+			}
+			for _, i := range idx {
+				rows[i][fields["value"]] = strconv.FormatFloat(values[i]/scale, 'f', 15, 64)
+			}
+		default:
+			return fmt.Errorf("flag --normalize: can not rescale values of type %q", tp)
+		}
+	}
+	return nil
+}
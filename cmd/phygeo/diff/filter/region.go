@@ -0,0 +1,73 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/internal/geobox"
+)
+
+// A region is a set of pixels
+// defined at each time stage,
+// either by a box,
+// or by landscape values.
+type region struct {
+	box    *geobox.Box
+	values map[int]bool
+
+	landscape *model.TimePix
+	tot       *model.Total
+
+	// pixels of the region
+	// at each time stage
+	stages map[int64]map[int]bool
+}
+
+// In returns true if a pixel
+// is inside the region
+// at a given age.
+func (r *region) in(age int64, px int) bool {
+	age = r.landscape.ClosestStageAge(age)
+	st, ok := r.stages[age]
+	if !ok {
+		if r.box != nil {
+			st = r.box.Region(r.landscape.Pixelation(), r.tot, age)
+		} else {
+			st = valueRegion(r.landscape, r.values, age)
+		}
+		r.stages[age] = st
+	}
+	return st[px]
+}
+
+func parseValues(val string) (map[int]bool, error) {
+	vs := strings.Split(val, ",")
+	values := make(map[int]bool, len(vs))
+	for _, v := range vs {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("on flag --values: %v", err)
+		}
+		values[n] = true
+	}
+	return values, nil
+}
+
+// ValueRegion returns the pixels
+// with the given landscape values
+// at a time stage.
+func valueRegion(landscape *model.TimePix, values map[int]bool, age int64) map[int]bool {
+	region := make(map[int]bool)
+	for px, v := range landscape.Stage(landscape.ClosestStageAge(age)) {
+		if values[v] {
+			region[px] = true
+		}
+	}
+	return region
+}
@@ -0,0 +1,151 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/js-arias/phygeo/clade"
+	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/timetree"
+)
+
+// A selection is a set of conditions
+// used to select the rows
+// of a reconstruction file.
+type selection struct {
+	// sorted tree names
+	trees []string
+
+	// nodes of each tree
+	nodes map[string]map[int]bool
+
+	// age window,
+	// in years
+	minAge, maxAge int64
+
+	reg *region
+}
+
+// HasTree returns true if a tree is selected.
+func (s *selection) hasTree(name string) bool {
+	if len(s.trees) == 0 {
+		return true
+	}
+	_, ok := slices.BinarySearch(s.trees, name)
+	return ok
+}
+
+// HasNode returns true if a node of a tree is selected.
+func (s *selection) hasNode(tree string, id int) bool {
+	if s.nodes == nil {
+		return true
+	}
+	return s.nodes[tree][id]
+}
+
+// HasAge returns true if an age is inside the age window.
+func (s *selection) hasAge(age int64) bool {
+	if s.maxAge < 0 {
+		return true
+	}
+	return age >= s.minAge && age <= s.maxAge
+}
+
+func parseTreeNames() []string {
+	if treesFlag == "" {
+		return nil
+	}
+	trees := strings.Split(treesFlag, ",")
+	for i, t := range trees {
+		trees[i] = strings.ToLower(strings.Join(strings.Fields(t), " "))
+	}
+	slices.Sort(trees)
+
+	return trees
+}
+
+// ParseNodes returns the nodes of each tree
+// defined by the flags --nodes and --clades,
+// either as node IDs,
+// or as clade labels of the project.
+func parseNodes(tc *timetree.Collection, labels *clade.Collection) (map[string]map[int]bool, error) {
+	nodes := make(map[string]map[int]bool, len(tc.Names()))
+	for _, tn := range tc.Names() {
+		t := tc.Tree(tn)
+		ns := make(map[int]bool)
+		if nodesFlag != "" {
+			ids, err := clade.Nodes(labels, t, nodesFlag)
+			if err != nil {
+				return nil, fmt.Errorf("on flag --nodes: %v", err)
+			}
+			for _, id := range ids {
+				ns[id] = true
+			}
+		}
+		if cladesFlag != "" {
+			ids, err := clade.Nodes(labels, t, cladesFlag)
+			if err != nil {
+				return nil, fmt.Errorf("on flag --clades: %v", err)
+			}
+			tNodes := t.Nodes()
+			for _, id := range ids {
+				if !slices.Contains(tNodes, id) {
+					continue
+				}
+				for _, n := range descendants(t, id) {
+					ns[n] = true
+				}
+			}
+		}
+		nodes[tn] = ns
+	}
+	return nodes, nil
+}
+
+// Descendants returns a node
+// and all of its descendants.
+func descendants(t *timetree.Tree, n int) []int {
+	desc := []int{n}
+	for i := 0; i < len(desc); i++ {
+		desc = append(desc, t.Children(desc[i])...)
+	}
+	return desc
+}
+
+// ParseWindow returns the age window,
+// in years,
+// defined by the flag --window.
+// If the flag is not defined,
+// the maximum age will be -1.
+func parseWindow() (min, max int64, err error) {
+	if windowFlag == "" {
+		return 0, -1, nil
+	}
+
+	vs := strings.Split(windowFlag, ",")
+	if len(vs) != 2 {
+		return 0, 0, fmt.Errorf("on flag --window: expecting 2 ages, got %d", len(vs))
+	}
+	var ages [2]int64
+	for i, v := range vs {
+		a, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("on flag --window: %v", err)
+		}
+		if a < 0 {
+			return 0, 0, fmt.Errorf("on flag --window: invalid age %.6f", a)
+		}
+		ages[i] = int64(math.Round(a * timestage.MillionYears))
+	}
+	if ages[0] > ages[1] {
+		ages[0], ages[1] = ages[1], ages[0]
+	}
+	return ages[0], ages[1], nil
+}
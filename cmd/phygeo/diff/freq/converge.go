@@ -0,0 +1,222 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package freq
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/js-arias/phygeo/version"
+)
+
+// ConvFractions are the fractions of the particles
+// used for the running estimates
+// of the pixel frequencies.
+var convFractions = []float64{0.10, 0.25, 0.50}
+
+// A nodeConv stores the convergence diagnostics
+// of the particles of a node.
+type nodeConv struct {
+	tree      string
+	node      int
+	age       int64
+	particles int
+	ess       float64
+
+	// total variation distance
+	// of the running estimates
+	// to the estimate using all particles
+	dist []float64
+
+	// Monte Carlo error of the estimate
+	// using all particles
+	mcErr float64
+
+	// number of particles required
+	// for the target error
+	required int
+}
+
+// Convergence returns the convergence diagnostics
+// of the pixel frequencies of each node,
+// at the time stage of the node
+// (i.e., the youngest stage),
+// sorted by tree and node.
+func convergence(rt map[string]*recTree, target float64) []nodeConv {
+	var conv []nodeConv
+
+	trees := make([]string, 0, len(rt))
+	for tn := range rt {
+		trees = append(trees, tn)
+	}
+	slices.Sort(trees)
+
+	for _, tn := range trees {
+		t := rt[tn]
+		nodes := make([]int, 0, len(t.nodes))
+		for id := range t.nodes {
+			nodes = append(nodes, id)
+		}
+		slices.Sort(nodes)
+		for _, id := range nodes {
+			n := t.nodes[id]
+			var s *recStage
+			for _, st := range n.stages {
+				if s == nil || st.age < s.age {
+					s = st
+				}
+			}
+			if s == nil || len(s.samples) == 0 {
+				continue
+			}
+
+			nc := nodeConv{
+				tree:      t.name,
+				node:      n.id,
+				age:       s.age,
+				particles: distinct(s.samples),
+				ess:       ess(s.sum, s.sumSq),
+			}
+
+			slices.SortFunc(s.samples, func(a, b sample) int {
+				return a.particle - b.particle
+			})
+			full := sampleFreq(s.samples)
+			for _, f := range convFractions {
+				sz := int(math.Ceil(f * float64(len(s.samples))))
+				nc.dist = append(nc.dist, totalVariation(sampleFreq(s.samples[:sz]), full))
+			}
+
+			nc.mcErr, nc.required = mcError(full, nc.ess, target)
+			conv = append(conv, nc)
+		}
+	}
+	return conv
+}
+
+// SampleFreq returns the pixel frequencies
+// of a set of particles.
+func sampleFreq(samples []sample) map[int]float64 {
+	freq := make(map[int]float64)
+	for _, s := range samples {
+		freq[s.px]++
+	}
+	for px, f := range freq {
+		freq[px] = f / float64(len(samples))
+	}
+	return freq
+}
+
+// TotalVariation returns the total variation distance
+// between two pixel frequencies.
+func totalVariation(a, b map[int]float64) float64 {
+	var sum float64
+	for px, p := range a {
+		sum += math.Abs(p - b[px])
+	}
+	for px, p := range b {
+		if _, ok := a[px]; ok {
+			continue
+		}
+		sum += p
+	}
+	return sum / 2
+}
+
+// McError returns the Monte Carlo error
+// of a pixel frequency
+// (the largest standard error of the pixels)
+// and the number of particles
+// required to reach the target error.
+//
+// As the particles are independent draws,
+// the standard error of a pixel
+// is sqrt(p(1-p)/n),
+// where n is the effective sample size,
+// so the number of particles required
+// is p(1-p)/target^2.
+func mcError(freq map[int]float64, n, target float64) (float64, int) {
+	var v float64
+	for _, p := range freq {
+		if pv := p * (1 - p); pv > v {
+			v = pv
+		}
+	}
+	if n < 1 {
+		n = 1
+	}
+	e := math.Sqrt(v / n)
+
+	req := math.Ceil(v / (target * target))
+	if req < 1 {
+		req = 1
+	}
+	return e, int(req)
+}
+
+func writeConvergence(conv []nodeConv, name, p string, target float64) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if err == nil && e != nil {
+			err = e
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "# diff.freq particle convergence, project %q\n", p)
+	fmt.Fprintf(w, "# target Monte Carlo error: %.6f\n", target)
+	fmt.Fprintf(w, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "# phygeo: %s\n", version.String())
+
+	tsv := csv.NewWriter(w)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	header := []string{"tree", "node", "age", "particles", "ess"}
+	for _, f := range convFractions {
+		header = append(header, fmt.Sprintf("tv%d", int(f*100)))
+	}
+	header = append(header, "error", "required")
+	if err := tsv.Write(header); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	for _, nc := range conv {
+		row := []string{
+			nc.tree,
+			strconv.Itoa(nc.node),
+			strconv.FormatInt(nc.age, 10),
+			strconv.Itoa(nc.particles),
+			strconv.FormatFloat(nc.ess, 'f', 3, 64),
+		}
+		for _, d := range nc.dist {
+			row = append(row, strconv.FormatFloat(d, 'f', 6, 64))
+		}
+		row = append(row,
+			strconv.FormatFloat(nc.mcErr, 'f', 6, 64),
+			strconv.Itoa(nc.required),
+		)
+		if err := tsv.Write(row); err != nil {
+			return fmt.Errorf("while writing data on %q: %v", name, err)
+		}
+	}
+
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	return nil
+}
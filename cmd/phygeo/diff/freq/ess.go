@@ -0,0 +1,153 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package freq
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/js-arias/phygeo/version"
+)
+
+// A sample is the location of a particle
+// at a time stage.
+type sample struct {
+	particle int
+	px       int
+}
+
+// A stageDiag stores the diagnostics
+// of the particles of a time stage.
+type stageDiag struct {
+	tree      string
+	node      int
+	age       int64
+	particles int
+	pixels    int
+	ess       float64
+}
+
+// Diagnostics returns the particle diagnostics
+// of each node and time stage,
+// sorted by tree, node, and age (from oldest to youngest).
+func diagnostics(rt map[string]*recTree) []stageDiag {
+	var diag []stageDiag
+
+	trees := make([]string, 0, len(rt))
+	for tn := range rt {
+		trees = append(trees, tn)
+	}
+	slices.Sort(trees)
+
+	for _, tn := range trees {
+		t := rt[tn]
+		nodes := make([]int, 0, len(t.nodes))
+		for id := range t.nodes {
+			nodes = append(nodes, id)
+		}
+		slices.Sort(nodes)
+		for _, id := range nodes {
+			n := t.nodes[id]
+			stages := make([]int64, 0, len(n.stages))
+			for a := range n.stages {
+				stages = append(stages, a)
+			}
+			slices.Sort(stages)
+
+			for i := len(stages) - 1; i >= 0; i-- {
+				s := n.stages[stages[i]]
+				particles := s.particles
+				if len(s.samples) > 0 {
+					particles = distinct(s.samples)
+				}
+				diag = append(diag, stageDiag{
+					tree:      t.name,
+					node:      n.id,
+					age:       s.age,
+					particles: particles,
+					pixels:    len(s.rec),
+					ess:       ess(s.sum, s.sumSq),
+				})
+			}
+		}
+	}
+	return diag
+}
+
+// ESS returns the effective sample size
+// of the particles of a time stage,
+// using the Kish's effective sample size
+// of the particle weights:
+// (sum w)^2 / sum(w^2).
+// If all particles have the same weight,
+// it is the number of particles.
+func ess(sum, sumSq float64) float64 {
+	if sumSq == 0 {
+		return 0
+	}
+	return sum * sum / sumSq
+}
+
+// Distinct returns the number of distinct particles
+// of a set of particle locations.
+func distinct(samples []sample) int {
+	ids := make(map[int]bool, len(samples))
+	for _, s := range samples {
+		ids[s.particle] = true
+	}
+	return len(ids)
+}
+
+func writeDiagnostics(diag []stageDiag, name, p string) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if err == nil && e != nil {
+			err = e
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "# diff.freq particle diagnostics, project %q\n", p)
+	fmt.Fprintf(w, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "# phygeo: %s\n", version.String())
+
+	tsv := csv.NewWriter(w)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	if err := tsv.Write([]string{"tree", "node", "age", "particles", "pixels", "ess"}); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	for _, d := range diag {
+		row := []string{
+			d.tree,
+			strconv.Itoa(d.node),
+			strconv.FormatInt(d.age, 10),
+			strconv.Itoa(d.particles),
+			strconv.Itoa(d.pixels),
+			strconv.FormatFloat(d.ess, 'f', 3, 64),
+		}
+		if err := tsv.Write(row); err != nil {
+			return fmt.Errorf("while writing data on %q: %v", name, err)
+		}
+	}
+
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	return nil
+}
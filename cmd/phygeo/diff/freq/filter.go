@@ -0,0 +1,113 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package freq
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/js-arias/phygeo/clade"
+	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/timetree"
+)
+
+func parseTreeNames() []string {
+	if treesFlag == "" {
+		return nil
+	}
+	trees := strings.Split(treesFlag, ",")
+	for i, t := range trees {
+		trees[i] = strings.ToLower(strings.Join(strings.Fields(t), " "))
+	}
+	slices.Sort(trees)
+
+	return trees
+}
+
+// ParseNodes returns the nodes of each tree
+// defined by the flag --nodes,
+// either as node IDs,
+// or as clade labels of the project.
+func parseNodes(tc *timetree.Collection, labels *clade.Collection) (map[string][]int, error) {
+	if nodesFlag == "" {
+		return nil, nil
+	}
+
+	nodes := make(map[string][]int, len(tc.Names()))
+	for _, tn := range tc.Names() {
+		ids, err := clade.Nodes(labels, tc.Tree(tn), nodesFlag)
+		if err != nil {
+			return nil, fmt.Errorf("on flag --nodes: %v", err)
+		}
+		nodes[tn] = ids
+	}
+	return nodes, nil
+}
+
+// ParseAges returns the ages,
+// in years,
+// from a list of ages in million years.
+func parseAges() ([]int64, error) {
+	if agesFlag == "" {
+		return nil, nil
+	}
+
+	vs := strings.Split(agesFlag, ",")
+	ages := make([]int64, 0, len(vs))
+	for _, v := range vs {
+		a, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, fmt.Errorf("on flag --ages: %v", err)
+		}
+		if a < 0 {
+			return nil, fmt.Errorf("on flag --ages: invalid age %.6f", a)
+		}
+		ages = append(ages, int64(math.Round(a*timestage.MillionYears)))
+	}
+	slices.Sort(ages)
+
+	return ages, nil
+}
+
+// FilterRec removes the trees, nodes,
+// and time stages not in the given lists.
+// An empty list keeps all the elements.
+// The nodes are given for each tree;
+// if the map is nil all the nodes are kept.
+func filterRec(rt map[string]*recTree, trees []string, nodes map[string][]int, ages []int64) {
+	for tn, t := range rt {
+		if len(trees) > 0 {
+			if _, ok := slices.BinarySearch(trees, tn); !ok {
+				delete(rt, tn)
+				continue
+			}
+		}
+		for id, n := range t.nodes {
+			if nodes != nil {
+				if _, ok := slices.BinarySearch(nodes[tn], id); !ok {
+					delete(t.nodes, id)
+					continue
+				}
+			}
+			if len(ages) == 0 {
+				continue
+			}
+			for a := range n.stages {
+				if _, ok := slices.BinarySearch(ages, a); !ok {
+					delete(n.stages, a)
+				}
+			}
+			if len(n.stages) == 0 {
+				delete(t.nodes, id)
+			}
+		}
+		if len(t.nodes) == 0 {
+			delete(rt, tn)
+		}
+	}
+}
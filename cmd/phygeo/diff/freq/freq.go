@@ -26,12 +26,19 @@ import (
 	"github.com/js-arias/earth/stat"
 	"github.com/js-arias/earth/stat/dist"
 	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/clade"
+	"github.com/js-arias/phygeo/internal/input"
 	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/version"
+	"github.com/js-arias/timetree"
 )
 
 var Command = &command.Command{
 	Usage: `freq [--kde <value>] [--cpu <number>]
-	[-i|--input <file>] [--freq <file>]
+	[--sets <levels>] [--ess <file>] [--min-ess <value>]
+	[--converge <file>] [--mc-error <value>]
+	[-i|--input <file>] [--freq <file>] [--post-split <mode>]
+	[--trees <tree-list>] [--nodes <node-list>] [--ages <age-list>]
 	[-o|--output <file>] <project-file>`,
 	Short: "calculate pixel frequencies",
 	Long: `
@@ -43,7 +50,8 @@ The argument of the command is the name of the project file.
 
 The flag --input, or -i, indicates the input file from a stochastic mapping.
 The flag --freq, indicates the input file from a frequency file as produced by
-this command.
+this command. If the input is "-", the file will be read from the standard
+input.
 
 By default, the ranges are taken as given. If the flag --kde is defined, a
 kernel density estimation using a spherical normal will be used to smooth the
@@ -54,7 +62,101 @@ number of processors.
 
 By default, the output file will have the name of the input file with the
 prefix "freq" or "kde" if the --kde flag is used. With the flag --output, or
--o, a different prefix can be defined.
+-o, a different prefix can be defined. If the output is "-", or the input is
+read from the standard input and no output is defined, the results will be
+written to the standard output.
+
+Each node (except the root) might have a post-split stage, at the age of the
+split of its parent node, that duplicates the split stage of the parent. The
+flag --post-split defines how these stages are treated. Valid values are:
+
+	skip   the post-split stages are ignored (the default)
+	merge  the post-split stage is used as the split stage of the parent
+	       node, if the parent does not have a reconstruction at that age
+	keep   the post-split stages are used as stages of the node
+
+Except with the value "keep", the trees of the project are required to
+identify the post-split stages.
+
+By default, all the nodes of the reconstruction will be processed. As
+frequency and KDE files can be very large, the output can be restricted to a
+subset of the reconstruction. If the flag --trees is defined, only the
+indicated trees will be used, the format is the tree names separated by
+commas, for example "tree-1,tree-2". If the flag --nodes is defined, only the
+indicated nodes will be used, the format is the node IDs separated by commas,
+for example "0,1,6,10". The list can also include clade labels defined in the
+project (see 'phygeo tree label'), for example "0,felids"; a label is
+resolved in each tree as the most recent common ancestor of its terminals. If
+the flag --ages is defined, only the time stages at the indicated ages will be
+used, the format is the ages in million years separated by commas, for
+example "0,10.5,66". The filters are applied before any other calculation, so
+only the selected subset will be smoothed and written, and the diagnostics
+will be restricted to the same subset.
+
+If the stochastic mapping file has a "weight" column (for example, when the
+particles were produced from several lambda values), each particle will be
+counted using its weight.
+
+When reading a stochastic mapping file, the flag --ess can be used to define
+a file to write the diagnostics of the particles of each node and time stage.
+The diagnostics file contains the following columns:
+
+	- tree       the name of the tree
+	- node       the ID of the node in the tree
+	- age        the age of the time stage, in years
+	- particles  the number of distinct particles
+	- pixels     the number of distinct pixels with particles
+	- ess        the effective sample size of the particles
+
+The effective sample size is the Kish's effective sample size of the particle
+weights ((sum w)^2 / sum(w^2)). If the particles are not weighted, it is the
+number of particles; if the particles are weighted (e.g., particles from
+several lambda values), it is smaller, as the particles with a small weight
+contribute little to the frequencies. If the flag --min-ess is defined, a
+warning will be printed for each time stage with an effective sample size
+below the indicated value, and after the frequencies are written, the command
+will fail.
+
+When reading a stochastic mapping file, the flag --converge can be used to
+define a file to write the convergence of the pixel frequencies of each node
+(at the time stage of the node) as a function of the number of particles. The
+pixel frequencies are estimated using the first 10%, 25%, and 50% of the
+particles (ordered by their ID), and compared with the estimate using all the
+particles. The file also reports the Monte Carlo error of the estimate (the
+largest standard error of the frequency of a pixel, using the effective
+sample size), and the number of particles required to reach a target Monte
+Carlo error. The target error is set with the flag --mc-error (default
+0.01). This can be used to choose the number of particles of a stochastic
+mapping. The convergence file contains the following columns:
+
+	- tree       the name of the tree
+	- node       the ID of the node in the tree
+	- age        the age of the node, in years
+	- particles  the number of distinct particles
+	- ess        the effective sample size of the particles
+	- tv10       the total variation distance between the estimate with
+	             10% of the particles and the estimate with all particles
+	- tv25       the same, with 25% of the particles
+	- tv50       the same, with 50% of the particles
+	- error      the Monte Carlo error using all particles
+	- required   the number of particles required for the target error
+
+If the flag --sets is defined with a list of credible levels, separated by
+commas (for example "0.5,0.95"), an additional file will be written with the
+pixels of each credible set, for each node and time stage. In a KDE
+reconstruction, the sets are taken from the CDF, so they are the same sets
+drawn by the map command with the --bound flag. In a frequency
+reconstruction, the sets are built adding pixels, from the most to the least
+frequent, until the level is reached. The file will have the prefix
+"<output>-sets", or "sets" if the output is the standard output, and it
+contains the following columns:
+
+	- tree     the name of the tree
+	- node     the ID of the node in the tree
+	- age      the age of the time stage, in years
+	- level    the credible level of the set
+	- equator  the number of pixels in the equator
+	- pixel    the ID of a pixel in the credible set
 	`,
 	SetFlags: setFlags,
 	Run:      run,
@@ -62,18 +164,36 @@ prefix "freq" or "kde" if the --kde flag is used. With the flag --output, or
 
 var numCPU int
 var kdeLambda float64
+var setsFlag string
+var essFile string
+var minESS float64
+var convFile string
+var mcErrFlag float64
 var inputFile string
 var freqFile string
 var outPrefix string
+var postSplitFlag string
+var treesFlag string
+var nodesFlag string
+var agesFlag string
 
 func setFlags(c *command.Command) {
 	c.Flags().IntVar(&numCPU, "cpu", runtime.GOMAXPROCS(0), "")
 	c.Flags().Float64Var(&kdeLambda, "kde", 0, "")
+	c.Flags().StringVar(&setsFlag, "sets", "", "")
+	c.Flags().StringVar(&essFile, "ess", "", "")
+	c.Flags().Float64Var(&minESS, "min-ess", 0, "")
+	c.Flags().StringVar(&convFile, "converge", "", "")
+	c.Flags().Float64Var(&mcErrFlag, "mc-error", 0.01, "")
 	c.Flags().StringVar(&inputFile, "input", "", "")
 	c.Flags().StringVar(&inputFile, "i", "", "")
 	c.Flags().StringVar(&freqFile, "freq", "", "")
 	c.Flags().StringVar(&outPrefix, "output", "", "")
 	c.Flags().StringVar(&outPrefix, "o", "", "")
+	c.Flags().StringVar(&postSplitFlag, "post-split", postSkip, "")
+	c.Flags().StringVar(&treesFlag, "trees", "", "")
+	c.Flags().StringVar(&nodesFlag, "nodes", "", "")
+	c.Flags().StringVar(&agesFlag, "ages", "", "")
 }
 
 func run(c *command.Command, args []string) error {
@@ -84,6 +204,35 @@ func run(c *command.Command, args []string) error {
 		return c.UsageError("expecting input file, flags --input, or --freq")
 	}
 
+	if inputFile == "" && (essFile != "" || minESS > 0) {
+		return c.UsageError("flags --ess and --min-ess require a stochastic mapping file, flag --input")
+	}
+	if inputFile == "" && convFile != "" {
+		return c.UsageError("flag --converge requires a stochastic mapping file, flag --input")
+	}
+	if mcErrFlag <= 0 || mcErrFlag >= 1 {
+		return c.UsageError(fmt.Sprintf("flag --mc-error: invalid value %.6f", mcErrFlag))
+	}
+
+	postMode, err := parsePostSplit(postSplitFlag)
+	if err != nil {
+		return c.UsageError(fmt.Sprintf("flag --post-split: %v", err))
+	}
+
+	var levels []float64
+	if setsFlag != "" {
+		levels, err = parseLevels(setsFlag)
+		if err != nil {
+			return c.UsageError(err.Error())
+		}
+	}
+
+	trees := parseTreeNames()
+	ages, err := parseAges()
+	if err != nil {
+		return c.UsageError(err.Error())
+	}
+
 	p, err := project.Read(args[0])
 	if err != nil {
 		return err
@@ -99,16 +248,73 @@ func run(c *command.Command, args []string) error {
 		return err
 	}
 
-	rt, err := getRec(landscape)
+	rt, err := getRec(c.Stdin(), landscape)
 	if err != nil {
 		return err
 	}
+	var nodes map[string][]int
+	if postMode != postKeep || nodesFlag != "" {
+		tf := p.Path(project.Trees)
+		if tf == "" {
+			msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+			return c.UsageError(msg)
+		}
+		tc, err := readTreeFile(tf)
+		if err != nil {
+			return err
+		}
+		if postMode != postKeep {
+			postSplit(rt, tc, postMode)
+		}
+
+		var labels *clade.Collection
+		if lf := p.Path(project.Clades); lf != "" {
+			labels, err = readLabels(lf)
+			if err != nil {
+				return err
+			}
+		}
+		nodes, err = parseNodes(tc, labels)
+		if err != nil {
+			return c.UsageError(err.Error())
+		}
+	}
+	filterRec(rt, trees, nodes, ages)
+	if len(rt) == 0 {
+		return fmt.Errorf("no reconstruction after applying the flags --trees, --nodes, and --ages")
+	}
+
+	var low int
+	if essFile != "" || minESS > 0 {
+		diag := diagnostics(rt)
+		if essFile != "" {
+			if err := writeDiagnostics(diag, essFile, args[0]); err != nil {
+				return err
+			}
+		}
+		for _, d := range diag {
+			if d.ess >= minESS {
+				continue
+			}
+			fmt.Fprintf(c.Stderr(), "WARNING: tree %q: node %d: age %.6f: effective sample size %.3f (%d particles)\n", d.tree, d.node, float64(d.age)/1_000_000, d.ess, d.particles)
+			low++
+		}
+	}
+	if convFile != "" {
+		conv := convergence(rt, mcErrFlag)
+		if err := writeConvergence(conv, convFile, args[0], mcErrFlag); err != nil {
+			return err
+		}
+	}
 
 	if outPrefix == "" {
 		outPrefix = "freq"
 		if kdeLambda > 0 {
 			outPrefix = "kde"
 		}
+		if inputFile == "-" || freqFile == "-" {
+			outPrefix = "-"
+		}
 	}
 
 	tp := "freq"
@@ -130,27 +336,50 @@ func run(c *command.Command, args []string) error {
 		scale(rt)
 	}
 
-	name := fmt.Sprintf("%s-%s-%s.tab", outPrefix, args[0], inputFile)
-	if err := writeFrequencies(rt, name, args[0], tp, landscape.Pixelation().Len(), landscape.Pixelation().Equator()); err != nil {
-		return err
+	input := inputFile
+	if input == "" {
+		input = freqFile
+	}
+	if len(levels) > 0 {
+		name := fmt.Sprintf("%s-sets-%s-%s.tab", outPrefix, args[0], input)
+		if outPrefix == "-" {
+			name = fmt.Sprintf("sets-%s.tab", args[0])
+		}
+		if err := writeSets(rt, name, args[0], tp, levels, landscape.Pixelation().Equator()); err != nil {
+			return err
+		}
 	}
 
+	if outPrefix == "-" {
+		if err := writeFrequencies(c.Stdout(), rt, args[0], tp, landscape.Pixelation().Len(), landscape.Pixelation().Equator()); err != nil {
+			return fmt.Errorf("while writing on standard output: %v", err)
+		}
+	} else {
+		name := fmt.Sprintf("%s-%s-%s.tab", outPrefix, args[0], inputFile)
+		if err := writeFreqFile(rt, name, args[0], tp, landscape.Pixelation().Len(), landscape.Pixelation().Equator()); err != nil {
+			return err
+		}
+	}
+
+	if low > 0 {
+		return fmt.Errorf("%d time stages with an effective sample size below %.3f", low, minESS)
+	}
 	return nil
 }
 
-func getRec(landscape *model.TimePix) (map[string]*recTree, error) {
+func getRec(stdin io.Reader, landscape *model.TimePix) (map[string]*recTree, error) {
 	name := inputFile
 	if inputFile == "" {
 		name = freqFile
 	}
-	f, err := os.Open(name)
+	f, err := input.Open(name, stdin)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
 	if inputFile != "" {
-		rt, err := readRecon(f, landscape)
+		rt, err := readRecon(f, landscape, convFile != "" || essFile != "" || minESS > 0)
 		if err != nil {
 			return nil, fmt.Errorf("on input file %q: %v", name, err)
 		}
@@ -179,6 +408,35 @@ func readLandscape(name string) (*model.TimePix, error) {
 	return tp, nil
 }
 
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func readLabels(name string) (*clade.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := clade.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
 func readPixWeights(name string) (pixweight.Pixel, error) {
 	f, err := os.Open(name)
 	if err != nil {
@@ -211,6 +469,16 @@ type recStage struct {
 	rec       map[int]float64
 	sum       float64
 	landscape *model.TimePix
+
+	// sum of the squared weights
+	// of the particles
+	sumSq float64
+
+	// number of particles
+	particles int
+
+	// particle locations
+	samples []sample
 }
 
 var headerFields = []string{
@@ -220,10 +488,35 @@ var headerFields = []string{
 	"to",
 }
 
-func readRecon(r io.Reader, landscape *model.TimePix) (map[string]*recTree, error) {
-	tsv := csv.NewReader(r)
+// A stageKey identifies a time stage
+// of a node in a tree.
+type stageKey struct {
+	tree string
+	node int
+	age  int64
+}
+
+// ReadRecon reads a stochastic mapping file
+// and accumulates the particle counts
+// of each node and time stage.
+//
+// The file is read in a single pass,
+// and rows are aggregated as soon as they are read,
+// so the memory used depends on the number of time stages
+// and pixels,
+// and not in the number of particles.
+// The time stages are stored in a flat slice,
+// indexed by tree, node, and age,
+// so each row requires a single lookup.
+// If samples is true,
+// the location of each particle will be stored
+// (required for the particle diagnostics,
+// and the convergence diagnostics).
+func readRecon(r io.Reader, landscape *model.TimePix, samples bool) (map[string]*recTree, error) {
+	tsv := csv.NewReader(bufio.NewReaderSize(r, 1<<20))
 	tsv.Comma = '\t'
 	tsv.Comment = '#'
+	tsv.ReuseRecord = true
 
 	head, err := tsv.Read()
 	if err != nil {
@@ -239,9 +532,23 @@ func readRecon(r io.Reader, landscape *model.TimePix) (map[string]*recTree, erro
 			return nil, fmt.Errorf("expecting field %q", h)
 		}
 	}
+	treeCol := fields["tree"]
+	nodeCol := fields["node"]
+	ageCol := fields["age"]
+	toCol := fields["to"]
+	particleCol, hasParticle := fields["particle"]
+	weightCol, hasWeight := fields["weight"]
 
+	numPix := landscape.Pixelation().Len()
 	rt := make(map[string]*recTree)
-	for {
+	index := make(map[stageKey]int)
+	var stages []*recStage
+
+	// the last tree name read,
+	// to avoid the normalization of the name
+	// in each row
+	var rawName, tn string
+	for i := 0; ; i++ {
 		row, err := tsv.Read()
 		if errors.Is(err, io.EOF) {
 			break
@@ -251,63 +558,71 @@ func readRecon(r io.Reader, landscape *model.TimePix) (map[string]*recTree, erro
 			return nil, fmt.Errorf("on row %d: %v", ln, err)
 		}
 
-		f := "tree"
-		tn := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if row[treeCol] != rawName {
+			rawName = strings.Clone(row[treeCol])
+			tn = strings.ToLower(strings.Join(strings.Fields(rawName), " "))
+		}
 		if tn == "" {
 			continue
 		}
-		tn = strings.ToLower(tn)
-		t, ok := rt[tn]
-		if !ok {
-			t = &recTree{
-				name:  tn,
-				nodes: make(map[int]*recNode),
-			}
-			rt[tn] = t
-		}
 
-		f = "node"
-		id, err := strconv.Atoi(row[fields[f]])
+		f := "node"
+		id, err := strconv.Atoi(row[nodeCol])
 		if err != nil {
 			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
 		}
-		n, ok := t.nodes[id]
-		if !ok {
-			n = &recNode{
-				id:     id,
-				tree:   t,
-				stages: make(map[int64]*recStage),
-			}
-			t.nodes[id] = n
-		}
 
 		f = "age"
-		age, err := strconv.ParseInt(row[fields[f]], 10, 64)
+		age, err := strconv.ParseInt(row[ageCol], 10, 64)
 		if err != nil {
 			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
 		}
-		st, ok := n.stages[age]
-		if !ok {
-			st = &recStage{
-				node:      n,
-				age:       age,
-				rec:       make(map[int]float64),
-				landscape: landscape,
-			}
-			n.stages[age] = st
-		}
 
 		f = "to"
-		px, err := strconv.Atoi(row[fields[f]])
+		px, err := strconv.Atoi(row[toCol])
 		if err != nil {
 			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
 		}
-		if px >= landscape.Pixelation().Len() {
+		if px >= numPix {
 			return nil, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, px)
 		}
 
-		st.rec[px]++
-		st.sum++
+		pID := i
+		if samples && hasParticle {
+			f = "particle"
+			pID, err = strconv.Atoi(row[particleCol])
+			if err != nil {
+				return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+			}
+		}
+
+		w := 1.0
+		if hasWeight {
+			f = "weight"
+			w, err = strconv.ParseFloat(row[weightCol], 64)
+			if err != nil {
+				return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+			}
+		}
+
+		key := stageKey{tree: tn, node: id, age: age}
+		sID, ok := index[key]
+		if !ok {
+			sID = len(stages)
+			index[key] = sID
+			stages = append(stages, newRecStage(rt, key, landscape))
+		}
+		st := stages[sID]
+		st.rec[px] += w
+		st.sum += w
+		st.sumSq += w * w
+		st.particles++
+		if samples {
+			st.samples = append(st.samples, sample{
+				particle: pID,
+				px:       px,
+			})
+		}
 	}
 	if len(rt) == 0 {
 		return nil, fmt.Errorf("while reading data: %v", io.EOF)
@@ -316,6 +631,38 @@ func readRecon(r io.Reader, landscape *model.TimePix) (map[string]*recTree, erro
 	return rt, nil
 }
 
+// NewRecStage adds a new time stage
+// to a reconstruction.
+func newRecStage(rt map[string]*recTree, key stageKey, landscape *model.TimePix) *recStage {
+	t, ok := rt[key.tree]
+	if !ok {
+		t = &recTree{
+			name:  key.tree,
+			nodes: make(map[int]*recNode),
+		}
+		rt[key.tree] = t
+	}
+
+	n, ok := t.nodes[key.node]
+	if !ok {
+		n = &recNode{
+			id:     key.node,
+			tree:   t,
+			stages: make(map[int64]*recStage),
+		}
+		t.nodes[key.node] = n
+	}
+
+	st := &recStage{
+		node:      n,
+		age:       key.age,
+		rec:       make(map[int]float64),
+		landscape: landscape,
+	}
+	n.stages[key.age] = st
+	return st
+}
+
 var headerFreq = []string{
 	"tree",
 	"node",
@@ -516,7 +863,7 @@ func setKDE(rt map[string]*recTree, landscape *model.TimePix, weights pixweight.
 	close(in)
 }
 
-func writeFrequencies(rt map[string]*recTree, name, p, tp string, numPix, eq int) (err error) {
+func writeFreqFile(rt map[string]*recTree, name, p, tp string, numPix, eq int) (err error) {
 	f, err := os.Create(name)
 	if err != nil {
 		return err
@@ -528,12 +875,20 @@ func writeFrequencies(rt map[string]*recTree, name, p, tp string, numPix, eq int
 		}
 	}()
 
-	w := bufio.NewWriter(f)
+	if err := writeFrequencies(f, rt, p, tp, numPix, eq); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	return nil
+}
+
+func writeFrequencies(out io.Writer, rt map[string]*recTree, p, tp string, numPix, eq int) error {
+	w := bufio.NewWriter(out)
 	fmt.Fprintf(w, "# diff.freq, project %q\n", p)
 	if tp == "kde" {
 		fmt.Fprintf(w, "# KDE smoothing: lambda %.6f * 1/radian^2\n", kdeLambda)
 	}
 	fmt.Fprintf(w, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "# phygeo: %s\n", version.String())
 
 	tsv := csv.NewWriter(w)
 	tsv.Comma = '\t'
@@ -592,10 +947,10 @@ func writeFrequencies(rt map[string]*recTree, name, p, tp string, numPix, eq int
 
 	tsv.Flush()
 	if err := tsv.Error(); err != nil {
-		return fmt.Errorf("while writing data on %q: %v", name, err)
+		return err
 	}
 	if err := w.Flush(); err != nil {
-		return fmt.Errorf("while writing data on %q: %v", name, err)
+		return err
 	}
 	return nil
 }
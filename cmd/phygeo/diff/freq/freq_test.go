@@ -0,0 +1,424 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package freq
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+)
+
+// SimParticles returns a stochastic mapping file
+// with a given number of particles,
+// nodes, and time stages per node.
+func simParticles(particles, nodes, stages, numPix int) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# simulated particles\n")
+	fmt.Fprintf(&buf, "tree\tparticle\tnode\tage\tlambda\tequator\tfrom\tto\r\n")
+	for p := 0; p < particles; p++ {
+		for n := 0; n < nodes; n++ {
+			for s := 0; s < stages; s++ {
+				age := int64(stages-s) * 1_000_000
+				px := (p*7 + n*13 + s*31) % numPix
+				fmt.Fprintf(&buf, "Tree One\t%d\t%d\t%d\t100.000000\t60\t%d\t%d\r\n", p, n, age, px, px)
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// ParticlesFile is a small stochastic mapping file
+// with known pixel frequencies.
+const particlesFile = `# hand-written particles
+tree	particle	node	age	lambda	equator	from	to
+Tree  One	0	0	2000000	100.000000	60	10	10
+Tree  One	1	0	2000000	100.000000	60	10	10
+Tree  One	2	0	2000000	100.000000	60	11	11
+Tree  One	3	0	2000000	100.000000	60	12	12
+Tree  One	0	1	1000000	100.000000	60	10	20
+Tree  One	1	1	1000000	100.000000	60	10	20
+Tree  One	2	1	1000000	100.000000	60	11	20
+Tree  One	3	1	1000000	100.000000	60	12	21
+Tree  One	0	1	0	100.000000	60	20	30
+Tree  One	1	1	0	100.000000	60	20	31
+tree two	0	0	1000000	50.000000	60	5	5
+`
+
+func TestReadRecon(t *testing.T) {
+	landscape := model.NewTimePix(earth.NewPixelation(60))
+	rt, err := readRecon(strings.NewReader(particlesFile), landscape, true)
+	if err != nil {
+		t.Fatalf("reader: %v", err)
+	}
+
+	type stageFreq struct {
+		tree      string
+		node      int
+		age       int64
+		particles int
+		rec       map[int]float64
+	}
+	want := []stageFreq{
+		{"tree one", 0, 2_000_000, 4, map[int]float64{10: 2, 11: 1, 12: 1}},
+		{"tree one", 1, 1_000_000, 4, map[int]float64{20: 3, 21: 1}},
+		{"tree one", 1, 0, 2, map[int]float64{30: 1, 31: 1}},
+		{"tree two", 0, 1_000_000, 1, map[int]float64{5: 1}},
+	}
+
+	if len(rt) != 2 {
+		t.Fatalf("trees: got %d, want %d", len(rt), 2)
+	}
+	for _, w := range want {
+		tr, ok := rt[w.tree]
+		if !ok {
+			t.Fatalf("tree %q not found", w.tree)
+		}
+		n, ok := tr.nodes[w.node]
+		if !ok {
+			t.Fatalf("tree %q: node %d not found", w.tree, w.node)
+		}
+		st, ok := n.stages[w.age]
+		if !ok {
+			t.Fatalf("tree %q: node %d: stage %d not found", w.tree, w.node, w.age)
+		}
+		if st.particles != w.particles {
+			t.Errorf("tree %q: node %d: stage %d: particles: got %d, want %d", w.tree, w.node, w.age, st.particles, w.particles)
+		}
+		if len(st.samples) != w.particles {
+			t.Errorf("tree %q: node %d: stage %d: samples: got %d, want %d", w.tree, w.node, w.age, len(st.samples), w.particles)
+		}
+		if st.sum != float64(w.particles) {
+			t.Errorf("tree %q: node %d: stage %d: sum: got %.3f, want %d", w.tree, w.node, w.age, st.sum, w.particles)
+		}
+		if len(st.rec) != len(w.rec) {
+			t.Errorf("tree %q: node %d: stage %d: pixels: got %d, want %d", w.tree, w.node, w.age, len(st.rec), len(w.rec))
+		}
+		for px, v := range w.rec {
+			if st.rec[px] != v {
+				t.Errorf("tree %q: node %d: stage %d: pixel %d: got %.3f, want %.3f", w.tree, w.node, w.age, px, st.rec[px], v)
+			}
+		}
+	}
+
+	// frequencies after scaling
+	scale(rt)
+	st := rt["tree one"].nodes[1].stages[1_000_000]
+	freqs := map[int]float64{20: 0.75, 21: 0.25}
+	for px, f := range freqs {
+		if math.Abs(st.rec[px]-f) > 1e-12 {
+			t.Errorf("scaled frequency: pixel %d: got %.6f, want %.6f", px, st.rec[px], f)
+		}
+	}
+}
+
+func BenchmarkReadRecon(b *testing.B) {
+	landscape := model.NewTimePix(earth.NewPixelation(60))
+	data := simParticles(200, 50, 10, landscape.Pixelation().Len())
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := readRecon(bytes.NewReader(data), landscape, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadReconNested(b *testing.B) {
+	landscape := model.NewTimePix(earth.NewPixelation(60))
+	data := simParticles(200, 50, 10, landscape.Pixelation().Len())
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := readReconNested(bytes.NewReader(data), landscape); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// ReadReconNested is the previous implementation
+// of the stochastic mapping reader,
+// that normalizes the tree name,
+// and searches the nested maps of trees, nodes, and stages
+// in each row,
+// and always stores the particle samples.
+// It is kept as a reference for the benchmarks.
+func readReconNested(r io.Reader, landscape *model.TimePix) (map[string]*recTree, error) {
+	tsv := csv.NewReader(r)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range headerFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	_, hasParticle := fields["particle"]
+	_, hasWeight := fields["weight"]
+
+	rt := make(map[string]*recTree)
+	for i := 0; ; i++ {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "tree"
+		tn := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if tn == "" {
+			continue
+		}
+		tn = strings.ToLower(tn)
+		t, ok := rt[tn]
+		if !ok {
+			t = &recTree{
+				name:  tn,
+				nodes: make(map[int]*recNode),
+			}
+			rt[tn] = t
+		}
+
+		f = "node"
+		id, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		n, ok := t.nodes[id]
+		if !ok {
+			n = &recNode{
+				id:     id,
+				tree:   t,
+				stages: make(map[int64]*recStage),
+			}
+			t.nodes[id] = n
+		}
+
+		f = "age"
+		age, err := strconv.ParseInt(row[fields[f]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		st, ok := n.stages[age]
+		if !ok {
+			st = &recStage{
+				node:      n,
+				age:       age,
+				rec:       make(map[int]float64),
+				landscape: landscape,
+			}
+			n.stages[age] = st
+		}
+
+		f = "to"
+		px, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if px >= landscape.Pixelation().Len() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, px)
+		}
+
+		pID := i
+		if hasParticle {
+			f = "particle"
+			pID, err = strconv.Atoi(row[fields[f]])
+			if err != nil {
+				return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+			}
+		}
+
+		w := 1.0
+		if hasWeight {
+			f = "weight"
+			w, err = strconv.ParseFloat(row[fields[f]], 64)
+			if err != nil {
+				return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+			}
+		}
+
+		st.rec[px] += w
+		st.sum += w
+		st.samples = append(st.samples, sample{
+			particle: pID,
+			px:       px,
+		})
+	}
+	if len(rt) == 0 {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+
+	return rt, nil
+}
+
+func TestConvergence(t *testing.T) {
+	landscape := model.NewTimePix(earth.NewPixelation(60))
+	data := simParticles(100, 3, 2, landscape.Pixelation().Len())
+	rt, err := readRecon(bytes.NewReader(data), landscape, true)
+	if err != nil {
+		t.Fatalf("reader: %v", err)
+	}
+
+	conv := convergence(rt, 0.01)
+	if len(conv) != 3 {
+		t.Fatalf("nodes: got %d, want %d", len(conv), 3)
+	}
+	for _, nc := range conv {
+		if nc.age != 1_000_000 {
+			t.Errorf("node %d: age: got %d, want %d", nc.node, nc.age, 1_000_000)
+		}
+		if nc.particles != 100 {
+			t.Errorf("node %d: particles: got %d, want %d", nc.node, nc.particles, 100)
+		}
+		if len(nc.dist) != len(convFractions) {
+			t.Fatalf("node %d: fractions: got %d, want %d", nc.node, len(nc.dist), len(convFractions))
+		}
+		for i, d := range nc.dist {
+			if d < 0 || d > 1 {
+				t.Errorf("node %d: fraction %.2f: invalid distance %.6f", nc.node, convFractions[i], d)
+			}
+		}
+
+		// each particle is in a different pixel,
+		// so p(1-p) = 0.0099
+		if nc.required != 99 {
+			t.Errorf("node %d: required: got %d, want %d", nc.node, nc.required, 99)
+		}
+	}
+}
+
+func TestESS(t *testing.T) {
+	tests := map[string]struct {
+		weights []float64
+		want    float64
+	}{
+		"unweighted": {[]float64{1, 1, 1, 1, 1}, 5},
+		"uniform":    {[]float64{0.25, 0.25, 0.25, 0.25}, 4},
+		"weighted":   {[]float64{0.5, 0.25, 0.25}, 8.0 / 3},
+		"single":     {[]float64{1, 0, 0, 0}, 1},
+		"empty":      {nil, 0},
+	}
+	for name, test := range tests {
+		var sum, sumSq float64
+		for _, w := range test.weights {
+			sum += w
+			sumSq += w * w
+		}
+		if got := ess(sum, sumSq); math.Abs(got-test.want) > 1e-12 {
+			t.Errorf("%s: got %.6f, want %.6f", name, got, test.want)
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	// all the particles of node 1
+	// are in the same pixel
+	data := `tree	particle	node	age	lambda	weight	equator	from	to
+t	0	0	1000000	100.000000	0.5	60	10	10
+t	1	0	1000000	100.000000	0.5	60	11	11
+t	2	0	1000000	50.000000	0.25	60	12	12
+t	3	0	1000000	50.000000	0.25	60	13	13
+t	0	1	0	100.000000	0.5	60	10	20
+t	1	1	0	100.000000	0.5	60	11	20
+t	2	1	0	50.000000	0.25	60	12	20
+t	3	1	0	50.000000	0.25	60	13	20
+`
+	landscape := model.NewTimePix(earth.NewPixelation(60))
+	rt, err := readRecon(strings.NewReader(data), landscape, true)
+	if err != nil {
+		t.Fatalf("reader: %v", err)
+	}
+
+	diag := diagnostics(rt)
+	if len(diag) != 2 {
+		t.Fatalf("diagnostics: got %d stages, want %d", len(diag), 2)
+	}
+	pixels := map[int]int{0: 4, 1: 1}
+	for _, d := range diag {
+		if d.particles != 4 {
+			t.Errorf("node %d: particles: got %d, want %d", d.node, d.particles, 4)
+		}
+		if d.pixels != pixels[d.node] {
+			t.Errorf("node %d: pixels: got %d, want %d", d.node, d.pixels, pixels[d.node])
+		}
+
+		// (sum w)^2 / sum(w^2) = 2.25/0.625
+		if math.Abs(d.ess-3.6) > 1e-12 {
+			t.Errorf("node %d: ess: got %.6f, want %.6f", d.node, d.ess, 3.6)
+		}
+	}
+}
+
+func TestTotalVariation(t *testing.T) {
+	a := map[int]float64{1: 0.5, 2: 0.5}
+	b := map[int]float64{2: 0.5, 3: 0.5}
+	if got := totalVariation(a, b); math.Abs(got-0.5) > 1e-12 {
+		t.Errorf("distance: got %.6f, want %.6f", got, 0.5)
+	}
+	if got := totalVariation(a, a); got != 0 {
+		t.Errorf("distance: got %.6f, want %.6f", got, 0.0)
+	}
+}
+
+func TestFilterRec(t *testing.T) {
+	pix := earth.NewPixelation(60)
+	landscape := model.NewTimePix(pix)
+	data := simParticles(10, 3, 2, pix.Len())
+
+	rt, err := readRecon(bytes.NewReader(data), landscape, false)
+	if err != nil {
+		t.Fatalf("unable to read particles: %v", err)
+	}
+	filterRec(rt, []string{"tree one"}, map[string][]int{"tree one": {0, 2}}, []int64{1_000_000})
+
+	tr, ok := rt["tree one"]
+	if !ok {
+		t.Fatalf("tree %q: not found", "tree one")
+	}
+	if len(tr.nodes) != 2 {
+		t.Errorf("nodes: got %d, want %d", len(tr.nodes), 2)
+	}
+	for _, id := range []int{0, 2} {
+		n, ok := tr.nodes[id]
+		if !ok {
+			t.Errorf("node %d: not found", id)
+			continue
+		}
+		if len(n.stages) != 1 {
+			t.Errorf("node %d: stages: got %d, want %d", id, len(n.stages), 1)
+		}
+		if _, ok := n.stages[1_000_000]; !ok {
+			t.Errorf("node %d: stage %d: not found", id, 1_000_000)
+		}
+	}
+
+	filterRec(rt, []string{"tree two"}, nil, nil)
+	if len(rt) != 0 {
+		t.Errorf("trees: got %d, want %d", len(rt), 0)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package freq
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/js-arias/timetree"
+)
+
+// Valid values for the treatment
+// of post-split stages.
+const (
+	postKeep  = "keep"
+	postSkip  = "skip"
+	postMerge = "merge"
+)
+
+// ParsePostSplit returns the treatment
+// of post-split stages.
+func parsePostSplit(v string) (string, error) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	switch v {
+	case postKeep, postSkip, postMerge:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown value %q", v)
+}
+
+// PostSplit removes the post-split stages
+// of the reconstruction,
+// i.e., the stages of a node
+// at the age of the split of its parent node,
+// that duplicate the split stage of the parent.
+// If mode is merge,
+// the post-split stage will be moved to the parent node
+// if the parent does not have a stage at that age.
+func postSplit(rt map[string]*recTree, tc *timetree.Collection, mode string) {
+	if mode == postKeep {
+		return
+	}
+
+	for _, t := range rt {
+		tv := tc.Tree(t.name)
+		if tv == nil {
+			continue
+		}
+		for _, n := range t.nodes {
+			if tv.IsRoot(n.id) {
+				continue
+			}
+			pID := tv.Parent(n.id)
+			age := tv.Age(pID)
+			st, ok := n.stages[age]
+			if !ok {
+				continue
+			}
+			delete(n.stages, age)
+			if mode != postMerge {
+				continue
+			}
+
+			p, ok := t.nodes[pID]
+			if !ok {
+				p = &recNode{
+					id:     pID,
+					tree:   t,
+					stages: make(map[int64]*recStage),
+				}
+				t.nodes[pID] = p
+			}
+			if _, ok := p.stages[age]; ok {
+				continue
+			}
+			st.node = p
+			p.stages[age] = st
+		}
+	}
+
+	// remove nodes without stages
+	for _, t := range rt {
+		for id, n := range t.nodes {
+			if len(n.stages) == 0 {
+				delete(t.nodes, id)
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package freq
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/js-arias/phygeo/version"
+)
+
+// ParseLevels returns the credible levels
+// defined in the --sets flag.
+func parseLevels(s string) ([]float64, error) {
+	var levels []float64
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		l, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("flag --sets: invalid value %q: %v", v, err)
+		}
+		if l <= 0 || l > 1 {
+			return nil, fmt.Errorf("flag --sets: invalid value %q: expecting a value between 0 and 1", v)
+		}
+		levels = append(levels, l)
+	}
+	if len(levels) == 0 {
+		return nil, fmt.Errorf("flag --sets: expecting at least a credible level")
+	}
+	slices.Sort(levels)
+	return slices.Compact(levels), nil
+}
+
+// CredibleSet returns the pixels
+// in the credible set of a stage
+// at the given level.
+//
+// In a KDE reconstruction,
+// the values are already scaled to the CDF,
+// so a pixel is in the set
+// if its value is at least 1 - level.
+// In a frequency reconstruction,
+// pixels are added,
+// from the highest to the lowest frequency,
+// until the accumulated frequency reaches the level.
+func credibleSet(rec map[int]float64, tp string, level float64) []int {
+	var set []int
+	if tp == "kde" {
+		for px, v := range rec {
+			if v >= 1-level {
+				set = append(set, px)
+			}
+		}
+		slices.Sort(set)
+		return set
+	}
+
+	pixels := make([]int, 0, len(rec))
+	var sum float64
+	for px, v := range rec {
+		pixels = append(pixels, px)
+		sum += v
+	}
+	slices.SortFunc(pixels, func(a, b int) int {
+		if rec[a] > rec[b] {
+			return -1
+		}
+		if rec[a] < rec[b] {
+			return 1
+		}
+		return a - b
+	})
+
+	var acc float64
+	for _, px := range pixels {
+		if acc >= level*sum {
+			break
+		}
+		set = append(set, px)
+		acc += rec[px]
+	}
+	slices.Sort(set)
+	return set
+}
+
+func writeSets(rt map[string]*recTree, name, p, tp string, levels []float64, eq int) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if err == nil && e != nil {
+			err = e
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "# diff.freq credible sets, project %q\n", p)
+	fmt.Fprintf(w, "# reconstruction type: %s\n", tp)
+	fmt.Fprintf(w, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "# phygeo: %s\n", version.String())
+
+	tsv := csv.NewWriter(w)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	if err := tsv.Write([]string{"tree", "node", "age", "level", "equator", "pixel"}); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+
+	trees := make([]string, 0, len(rt))
+	for tn := range rt {
+		trees = append(trees, tn)
+	}
+	slices.Sort(trees)
+
+	for _, tn := range trees {
+		t := rt[tn]
+		nodes := make([]int, 0, len(t.nodes))
+		for id := range t.nodes {
+			nodes = append(nodes, id)
+		}
+		slices.Sort(nodes)
+		for _, id := range nodes {
+			n := t.nodes[id]
+			stages := make([]int64, 0, len(n.stages))
+			for a := range n.stages {
+				stages = append(stages, a)
+			}
+			slices.Sort(stages)
+
+			for i := len(stages) - 1; i >= 0; i-- {
+				s := n.stages[stages[i]]
+				for _, l := range levels {
+					for _, px := range credibleSet(s.rec, tp, l) {
+						row := []string{
+							t.name,
+							strconv.Itoa(n.id),
+							strconv.FormatInt(s.age, 10),
+							strconv.FormatFloat(l, 'f', -1, 64),
+							strconv.Itoa(eq),
+							strconv.Itoa(px),
+						}
+						if err := tsv.Write(row); err != nil {
+							return fmt.Errorf("while writing data on %q: %v", name, err)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package hostile implements a command to report
+// the terminal range pixels
+// with a pixel weight of zero.
+package hostile
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/infer/diffusion"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/ranges"
+	"github.com/js-arias/timetree"
+)
+
+var Command = &command.Command{
+	Usage: "hostile [--snap] [--wait <seconds>] <project-file>",
+	Short: "report terminal pixels with zero weight",
+	Long: `
+Command hostile reads a PhyGeo project and reports the pixels of the terminal
+ranges that are located in a landscape value with a pixel weight of zero at
+the time stage of the terminal. As the likelihood of these pixels is always
+zero, they are ignored by the reconstruction, and if all the pixels of a
+terminal are in such "hostile" pixels, the likelihood of the tree will be
+zero (i.e., a log-likelihood of -Inf).
+
+The argument of the command is the name of the project file.
+
+The report is printed in the standard output, as a TSV table with the
+following columns:
+
+	tree     the name of the tree
+	taxon    the name of the terminal
+	age      the age of the terminal, in years
+	pixel    the ID of the hostile pixel
+	value    the landscape value of the hostile pixel
+	nearest  the ID of the nearest pixel with a non-zero weight, or -1 if
+	         there is no such pixel
+	n-value  the landscape value of the nearest pixel
+	weight   the weight of the nearest pixel
+	dist     the distance, in km, to the nearest pixel
+
+If the flag --snap is defined, each hostile pixel will be replaced by its
+nearest pixel with a non-zero weight, and the range file of the project will
+be updated. If a terminal is found in several trees, the pixels will be
+snapped using the age of the terminal in the first tree (in name order).
+
+While the pixels are snapped, the project is locked. If the project is locked
+by another process, the command fails. Use the flag --wait to set the maximum
+time, in seconds, to wait until the lock is released.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var snapFlag bool
+var waitFlag float64
+
+func setFlags(c *command.Command) {
+	c.Flags().BoolVar(&snapFlag, "snap", false, "")
+	c.Flags().Float64Var(&waitFlag, "wait", 0, "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	pFile := args[0]
+	if !snapFlag {
+		p, err := project.Read(pFile)
+		if err != nil {
+			return err
+		}
+		return hostile(c, p, pFile)
+	}
+
+	wait := time.Duration(waitFlag * float64(time.Second))
+	return project.Update(pFile, wait, func(p *project.Project) error {
+		return hostile(c, p, pFile)
+	})
+}
+
+// Hostile reports the hostile pixels of the terminals,
+// and if the flag --snap is defined,
+// replaces them in the ranges of the project.
+func hostile(c *command.Command, p *project.Project, pFile string) error {
+	tf := p.Path(project.Trees)
+	if tf == "" {
+		msg := fmt.Sprintf("tree file not defined in project %q", pFile)
+		return c.UsageError(msg)
+	}
+	tc, err := readTreeFile(tf)
+	if err != nil {
+		return err
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("paleolandscape not defined in project %q", pFile)
+		return c.UsageError(msg)
+	}
+	landscape, err := readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	pwF := p.Path(project.PixWeight)
+	if pwF == "" {
+		msg := fmt.Sprintf("pixel weights not defined in project %q", pFile)
+		return c.UsageError(msg)
+	}
+	pw, err := readPixWeights(pwF)
+	if err != nil {
+		return err
+	}
+
+	rf := p.Path(project.Ranges)
+	if rf == "" {
+		msg := fmt.Sprintf("range file not defined in project %q", pFile)
+		return c.UsageError(msg)
+	}
+	rc, err := readRanges(rf, landscape.Pixelation())
+	if err != nil {
+		return err
+	}
+
+	param := diffusion.Param{
+		Landscape: landscape,
+		PW:        pw,
+		Ranges:    rc,
+	}
+
+	var hs []treeHostile
+	for _, tn := range tc.Names() {
+		for _, h := range diffusion.HostilePixels(tc.Tree(tn), param) {
+			hs = append(hs, treeHostile{tree: tn, Hostile: h})
+		}
+	}
+
+	if err := writeHostile(c.Stdout(), hs); err != nil {
+		return err
+	}
+
+	if !snapFlag {
+		return nil
+	}
+	if len(hs) == 0 {
+		return project.SkipWrite
+	}
+
+	snap(rc, hs)
+	if err := writeCollection(rf, rc); err != nil {
+		return err
+	}
+	p.Add(project.Ranges, rf)
+	return nil
+}
+
+type treeHostile struct {
+	tree string
+	diffusion.Hostile
+}
+
+// Snap replaces the hostile pixels of each terminal
+// with its nearest pixel with a non-zero weight.
+func snap(rc *ranges.Collection, hs []treeHostile) {
+	done := make(map[string]string)
+	snapped := make(map[string]map[int]float64)
+	for _, h := range hs {
+		if tn, ok := done[h.Taxon]; ok && tn != h.tree {
+			continue
+		}
+		done[h.Taxon] = h.tree
+
+		rng, ok := snapped[h.Taxon]
+		if !ok {
+			rng = maps.Clone(rc.Range(h.Taxon))
+			snapped[h.Taxon] = rng
+		}
+		v := rng[h.Pixel]
+		delete(rng, h.Pixel)
+		if h.Nearest < 0 {
+			continue
+		}
+		if v > rng[h.Nearest] {
+			rng[h.Nearest] = v
+		}
+	}
+
+	for tax, rng := range snapped {
+		if len(rng) == 0 {
+			continue
+		}
+		age := rc.Age(tax)
+		if rc.Type(tax) == ranges.Points {
+			rc.SetPixels(tax, age, rng)
+			continue
+		}
+		rc.Set(tax, age, rng)
+	}
+}
+
+func writeHostile(w io.Writer, hs []treeHostile) error {
+	tsv := csv.NewWriter(w)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	if err := tsv.Write([]string{"tree", "taxon", "age", "pixel", "value", "nearest", "n-value", "weight", "dist"}); err != nil {
+		return err
+	}
+
+	for _, h := range hs {
+		dist := "NA"
+		if h.Nearest >= 0 {
+			dist = strconv.FormatFloat(h.Dist*earth.Radius/1000, 'f', 3, 64)
+		}
+		row := []string{
+			h.tree,
+			h.Taxon,
+			strconv.FormatInt(h.Age, 10),
+			strconv.Itoa(h.Pixel),
+			strconv.Itoa(h.Value),
+			strconv.Itoa(h.Nearest),
+			strconv.Itoa(h.NearestValue),
+			strconv.FormatFloat(h.Weight, 'f', 6, 64),
+			dist,
+		}
+		if err := tsv.Write(row); err != nil {
+			return err
+		}
+	}
+
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return fmt.Errorf("while writing data: %v", err)
+	}
+	return nil
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readPixWeights(name string) (pixweight.Pixel, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pw, err := pixweight.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return pw, nil
+}
+
+func readRanges(name string, pix *earth.Pixelation) (*ranges.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := ranges.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func writeCollection(name string, coll *ranges.Collection) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	if err := coll.TSV(f); err != nil {
+		return fmt.Errorf("while writing to %q: %v", name, err)
+	}
+	return nil
+}
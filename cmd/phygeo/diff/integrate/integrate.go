@@ -24,9 +24,13 @@ import (
 	"github.com/js-arias/earth/model"
 	"github.com/js-arias/earth/stat/dist"
 	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/agerange"
+	"github.com/js-arias/phygeo/constraint"
 	"github.com/js-arias/phygeo/infer/diffusion"
+	"github.com/js-arias/phygeo/internal/shard"
 	"github.com/js-arias/phygeo/project"
 	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/phygeo/version"
 	"github.com/js-arias/ranges"
 	"github.com/js-arias/timetree"
 	"gonum.org/v1/gonum/stat/distuv"
@@ -34,9 +38,9 @@ import (
 
 var Command = &command.Command{
 	Usage: `integrate [--stem <age>]
-	[--distribution <distribution>] [-p|--particles <number>]
+	[--distribution <distribution>] [-p|--particles <number>] [--resume]
 	[--min <float>] [--max <float>] [--mc <number>] [--parts <number>]
-	[--cpu <number>] <project-file>`,
+	[--float32] [--shard <i/n>] [--cpu <number>] <project-file>`,
 	Short: "integrate numerically the likelihood curve",
 	Long: `
 Command integrate reads a PhyGeo project, and makes a numerical integration of
@@ -69,6 +73,16 @@ used for the stochastic mapping. The results will be stored in the file called
 flag -o or --output is defined, the value of the flag will be used as a prefix
 for the output file.
 
+To add more samples to a previous sampling (e.g., until the reconstructions
+converge), use the flag --resume. With this flag, the results will be stored
+in the file "<project>-<tree>-sampling-x<particles>.tab". If the file already
+exists, the new samples will be appended to the file, continuing the
+numbering of the particles, and using the random number generator from the
+state in which it was left by the previous run. The flag --parts indicates
+the number of samples to be added. The state of the sampling is stored as
+comments in the file after each sample, so an interrupted run can also be
+resumed. The distribution must be the same used in the previous runs.
+
 By default the command performs an stepwise integration, the flag --parts
 indicates the number of segments using for the integration. The default value
 is 1000. If the flag --mc is defined, it will perform a Monte Carlo
@@ -84,13 +98,30 @@ following columns:
 		(in Km/My)
 	- logLike, the log likelihood for the reconstruction
 
+If the flag --float32 is given, the conditional likelihoods will be stored in
+single precision (with a rescaling constant for each time stage), and pixels
+with vanishing likelihoods will be ignored. Each stored value uses about a
+quarter less memory, so the savings are modest, and mostly come from the
+ignored pixels at high resolutions.
+
 By default, all available CPUs will be used in the processing. Set --cpu flag
 to use a different number of CPUs.
+
+To split the integration into independent jobs (e.g., as an array job in a
+cluster), use the flag --shard with a value "i/n", in which n is the number of
+jobs, and i is the job number (from 1 to n). The lambda values (either the
+points of the stepwise integration, the Monte Carlo samples, or the samples
+from the distribution) are assigned to the jobs in order, so the value k
+(starting at 0) will be evaluated by the job (k mod n) + 1. When sampling from
+a distribution, the name of the particles file will include the suffix
+"-shard-<i>-of-<n>", and the particle IDs will be unique among all the jobs.
+The outputs of each job can be combined with the command 'phygeo concat'.
 	`,
 	SetFlags: setFlags,
 	Run:      run,
 }
 
+var float32Flag bool
 var minFlag float64
 var maxFlag float64
 var mcParts int
@@ -99,9 +130,13 @@ var numCPU int
 var particles int
 var stemAge float64
 var distribution string
+var resume bool
 var output string
+var shardFlag string
+var jobShard shard.Shard
 
 func setFlags(c *command.Command) {
+	c.Flags().BoolVar(&float32Flag, "float32", false, "")
 	c.Flags().Float64Var(&minFlag, "min", 0, "")
 	c.Flags().Float64Var(&maxFlag, "max", 1000, "")
 	c.Flags().Float64Var(&stemAge, "stem", 0, "")
@@ -111,14 +146,24 @@ func setFlags(c *command.Command) {
 	c.Flags().IntVar(&particles, "p", 1000, "")
 	c.Flags().IntVar(&particles, "particles", 1000, "")
 	c.Flags().StringVar(&distribution, "distribution", "", "")
+	c.Flags().BoolVar(&resume, "resume", false, "")
 	c.Flags().StringVar(&output, "output", "", "")
 	c.Flags().StringVar(&output, "o", "", "")
+	c.Flags().StringVar(&shardFlag, "shard", "", "")
 }
 
 func run(c *command.Command, args []string) error {
 	if len(args) < 1 {
 		return c.UsageError("expecting project file")
 	}
+	var err error
+	jobShard, err = shard.Parse(shardFlag)
+	if err != nil {
+		return c.UsageError(fmt.Sprintf("flag --shard: %v", err))
+	}
+	if resume && (distribution == "" || particles == 0) {
+		return c.UsageError("flag --resume: expecting a sampling from a distribution, flag --distribution, with particles")
+	}
 
 	p, err := project.Read(args[0])
 	if err != nil {
@@ -176,6 +221,21 @@ func run(c *command.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	var ar *agerange.Collection
+	if af := p.Path(project.AgeRanges); af != "" {
+		ar, err = readAgeRanges(af, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+	var cn *constraint.Collection
+	if cf := p.Path(project.Constraints); cf != "" {
+		cn, err = readConstraints(cf, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+
 	// check if all terminals have defined ranges
 	for _, tn := range tc.Names() {
 		t := tc.Tree(tn)
@@ -192,18 +252,20 @@ func run(c *command.Command, args []string) error {
 	dm, _ := earth.NewDistMatRingScale(landscape.Pixelation())
 
 	param := diffusion.Param{
-		Landscape: landscape,
-		Rot:       rot,
-		DM:        dm,
-		PW:        pw,
-		Ranges:    rc,
-		Stages:    stages.Stages(),
+		Landscape:   landscape,
+		Rot:         rot,
+		DM:          dm,
+		PW:          pw,
+		Ranges:      rc,
+		AgeRanges:   ar,
+		Constraints: cn,
+		Stages:      stages.Stages(),
+		Float32:     float32Flag,
 	}
 
 	fmt.Fprintf(c.Stdout(), "tree\tlambda\tstdDev\tlogLike\n")
 	if distribution != "" {
-		r, err := getDistribution()
-		if err != nil {
+		if _, err := getDistribution(newState().src); err != nil {
 			return err
 		}
 		for _, tn := range tc.Names() {
@@ -213,7 +275,7 @@ func run(c *command.Command, args []string) error {
 				stem = t.Age(t.Root()) / 10
 			}
 			param.Stem = stem
-			if err := sample(c.Stdout(), args[0], t, param, r); err != nil {
+			if err := sample(c.Stdout(), args[0], t, param); err != nil {
 				return err
 			}
 		}
@@ -237,16 +299,25 @@ func run(c *command.Command, args []string) error {
 	return nil
 }
 
-func sample(w io.Writer, projName string, t *timetree.Tree, p diffusion.Param, r rander) (err error) {
+func sample(w io.Writer, projName string, t *timetree.Tree, p diffusion.Param) (err error) {
 	name := t.Name()
+	st := newState()
 	var bw *bufio.Writer
 	var tsv *csv.Writer
 	if particles > 0 {
-		out := fmt.Sprintf("%s-%s-sampling-%dx%d.tab", projName, t.Name(), parts, particles)
-		if output != "" {
-			out = output + "-" + out
+		out := samplingFile(projName, t.Name())
+		var exists bool
+		if resume {
+			st, exists, err = readState(out)
+			if err != nil {
+				return err
+			}
+		}
+		mode := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if exists {
+			mode = os.O_WRONLY | os.O_APPEND
 		}
-		f, err := os.Create(out)
+		f, err := os.OpenFile(out, mode, 0o644)
 		if err != nil {
 			return err
 		}
@@ -257,13 +328,30 @@ func sample(w io.Writer, projName string, t *timetree.Tree, p diffusion.Param, r
 			}
 		}()
 		bw = bufio.NewWriter(f)
-		tsv, err = outHeader(bw, t.Name(), projName)
-		if err != nil {
-			return fmt.Errorf("while writing header on %q: %v", name, err)
+		if exists {
+			tsv = resumeHeader(bw)
+		} else {
+			tsv, err = outHeader(bw, t.Name(), projName)
+			if err != nil {
+				return fmt.Errorf("while writing header on %q: %v", name, err)
+			}
+			if resume {
+				if err := st.write(bw); err != nil {
+					return fmt.Errorf("while writing header on %q: %v", name, err)
+				}
+			}
 		}
 	}
 
-	for i := 0; i < parts; i++ {
+	r, err := getDistribution(st.src)
+	if err != nil {
+		return err
+	}
+	first := st.next
+	for i := first; i < first+parts; i++ {
+		if !jobShard.Has(i) {
+			continue
+		}
 		p.Lambda = r.Rand()
 		df := diffusion.New(t, p)
 		like := df.DownPass()
@@ -275,12 +363,33 @@ func sample(w io.Writer, projName string, t *timetree.Tree, p diffusion.Param, r
 		if particles == 0 {
 			continue
 		}
+		df.SetSeed(st.src.Uint64())
 		df.Simulate(particles)
 		for x := 0; x < particles; x++ {
 			if err := writeUpPass(tsv, x, i*particles, df); err != nil {
 				return fmt.Errorf("while writing data on %q: %v", name, err)
 			}
 		}
+		if !resume {
+			continue
+		}
+
+		// store the state after each sample
+		st.next = i + 1
+		if i+jobShard.N >= first+parts {
+			// the last sample of the shard
+			st.next = first + parts
+		}
+		tsv.Flush()
+		if err := tsv.Error(); err != nil {
+			return fmt.Errorf("while writing data on %q: %v", name, err)
+		}
+		if err := st.write(bw); err != nil {
+			return fmt.Errorf("while writing data on %q: %v", name, err)
+		}
+		if err := bw.Flush(); err != nil {
+			return fmt.Errorf("while writing data on %q: %v", name, err)
+		}
 	}
 
 	if particles == 0 {
@@ -299,7 +408,12 @@ func sample(w io.Writer, projName string, t *timetree.Tree, p diffusion.Param, r
 func integrate(w io.Writer, t *timetree.Tree, p diffusion.Param) {
 	name := t.Name()
 	step := (maxFlag - minFlag) / float64(parts)
+	k := 0
 	for i := minFlag + step/2; i < maxFlag; i += step {
+		k++
+		if !jobShard.Has(k - 1) {
+			continue
+		}
 		p.Lambda = i
 		df := diffusion.New(t, p)
 		like := df.DownPass()
@@ -313,6 +427,9 @@ func monteCarlo(w io.Writer, t *timetree.Tree, p diffusion.Param) {
 	name := t.Name()
 	size := maxFlag - minFlag
 	for i := 0; i < mcParts; i++ {
+		if !jobShard.Has(i) {
+			continue
+		}
 		p.Lambda = rand.Float64()*size + minFlag
 		df := diffusion.New(t, p)
 		like := df.DownPass()
@@ -419,13 +536,61 @@ func readRanges(name string) (*ranges.Collection, error) {
 	return coll, nil
 }
 
+func readAgeRanges(name string, pix *earth.Pixelation) (*agerange.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := agerange.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func readConstraints(name string, pix *earth.Pixelation) (*constraint.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := constraint.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
 // Rander is an interface for probability distributions
 // that produce random numbers.
 type rander interface {
 	Rand() float64
 }
 
-func getDistribution() (rander, error) {
+// SamplingFile returns the name of the file
+// used to store the particles
+// of a sampling from a distribution.
+func samplingFile(projName, tree string) string {
+	out := fmt.Sprintf("%s-%s-sampling-%dx%d", projName, tree, parts, particles)
+	if resume {
+		out = fmt.Sprintf("%s-%s-sampling-x%d", projName, tree, particles)
+	}
+	if jobShard.N > 1 {
+		out += fmt.Sprintf("-shard-%d-of-%d", jobShard.I, jobShard.N)
+	}
+	out += ".tab"
+	if output != "" {
+		out = output + "-" + out
+	}
+	return out
+}
+
+func getDistribution(src pcgSource) (rander, error) {
 	s := strings.Split(distribution, "=")
 	if len(s) < 2 {
 		return nil, fmt.Errorf("invalid --distribution value: %q", distribution)
@@ -452,7 +617,7 @@ func getDistribution() (rander, error) {
 		return distuv.Gamma{
 			Alpha: alpha,
 			Beta:  beta,
-			Src:   nil,
+			Src:   src,
 		}, nil
 	}
 	return nil, fmt.Errorf("invalid --distribution: unknown distribution %q", distribution)
@@ -463,6 +628,7 @@ func outHeader(w io.Writer, t, p string) (*csv.Writer, error) {
 	fmt.Fprintf(w, "# sampling from distribution: %s\n", distribution)
 	fmt.Fprintf(w, "# up-pass particles: %d\n", particles*parts)
 	fmt.Fprintf(w, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "# phygeo: %s\n", version.String())
 
 	tsv := csv.NewWriter(w)
 	tsv.Comma = '\t'
@@ -474,6 +640,19 @@ func outHeader(w io.Writer, t, p string) (*csv.Writer, error) {
 	return tsv, nil
 }
 
+// ResumeHeader writes the header
+// of the samples added to a sampling file.
+func resumeHeader(w io.Writer) *csv.Writer {
+	fmt.Fprintf(w, "# resumed sampling: %d samples added\n", parts)
+	fmt.Fprintf(w, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "# phygeo: %s\n", version.String())
+
+	tsv := csv.NewWriter(w)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	return tsv
+}
+
 func writeUpPass(tsv *csv.Writer, p, cum int, t *diffusion.Tree) error {
 	nodes := t.Nodes()
 
@@ -0,0 +1,139 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package integrate
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A pcgSource is a PCG generator
+// that can be used as the source
+// of the gonum distributions.
+type pcgSource struct {
+	*rand.PCG
+}
+
+func (s pcgSource) Seed(seed uint64) {
+	s.PCG.Seed(seed, 0)
+}
+
+// Comments used to store the state of a sampling.
+const (
+	distComment  = "# sampling from distribution: "
+	nextComment  = "# next sample: "
+	stateComment = "# random state: "
+)
+
+// A samplingState is the state of a sampling file
+// that can be resumed.
+type samplingState struct {
+	// the first sample to be added
+	next int
+
+	// the random number generator
+	src pcgSource
+}
+
+// NewState returns the state of a new sampling.
+func newState() *samplingState {
+	return &samplingState{
+		src: pcgSource{rand.NewPCG(rand.Uint64(), rand.Uint64())},
+	}
+}
+
+// ReadState reads the state of a sampling file.
+// If the file does not exist,
+// it returns a new state,
+// and false.
+func readState(name string) (*samplingState, bool, error) {
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return newState(), false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	s, err := parseState(f)
+	if err != nil {
+		return nil, false, fmt.Errorf("on file %q: %v", name, err)
+	}
+	return s, true, nil
+}
+
+// ParseState reads the state of a sampling
+// from the comments of a sampling file.
+// As the state is updated after each sample,
+// the last values of the file are used.
+func parseState(r io.Reader) (*samplingState, error) {
+	var dist, next, state string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		ln := sc.Text()
+		if !strings.HasPrefix(ln, "#") {
+			continue
+		}
+		if v, ok := strings.CutPrefix(ln, distComment); ok {
+			dist = strings.TrimSpace(v)
+			continue
+		}
+		if v, ok := strings.CutPrefix(ln, nextComment); ok {
+			next = strings.TrimSpace(v)
+			continue
+		}
+		if v, ok := strings.CutPrefix(ln, stateComment); ok {
+			state = strings.TrimSpace(v)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	if dist != distribution {
+		return nil, fmt.Errorf("sampling from distribution %q, want %q", dist, distribution)
+	}
+	if next == "" || state == "" {
+		return nil, fmt.Errorf("undefined sampling state")
+	}
+
+	s := &samplingState{
+		src: pcgSource{&rand.PCG{}},
+	}
+	var err error
+	s.next, err = strconv.Atoi(next)
+	if err != nil {
+		return nil, fmt.Errorf("invalid next sample: %v", err)
+	}
+	b, err := hex.DecodeString(state)
+	if err != nil {
+		return nil, fmt.Errorf("invalid random state: %v", err)
+	}
+	if err := s.src.UnmarshalBinary(b); err != nil {
+		return nil, fmt.Errorf("invalid random state: %v", err)
+	}
+	return s, nil
+}
+
+// Write writes the state of a sampling
+// as comments.
+func (s *samplingState) write(w io.Writer) error {
+	b, err := s.src.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s%d\n", nextComment, s.next)
+	fmt.Fprintf(w, "%s%s\n", stateComment, hex.EncodeToString(b))
+	return nil
+}
@@ -0,0 +1,574 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package latband implements a command to estimate
+// the occupancy of latitudinal bands
+// through time.
+package latband
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/clade"
+	"github.com/js-arias/phygeo/internal/input"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/version"
+	"github.com/js-arias/timetree"
+)
+
+var Command = &command.Command{
+	Usage: `latband [--width <degrees>]
+	-i|--input <file> [-o|--output <file>] <project-file>`,
+	Short: "occupancy of latitudinal bands through time",
+	Long: `
+Command latband reads a file with a probability reconstruction for the nodes
+of one or more trees in a project, and for each time stage, estimates the
+number of lineages in each latitudinal band, for example, to study the
+formation of a latitudinal diversity gradient.
+
+The argument of the command is the name of the project file.
+
+The flag --input, or -i, is required and indicates the input file. The input
+file is a pixel probability file. If the input is "-", the file will be read
+from the standard input.
+
+The latitude of a pixel is the latitude of the pixel at the time stage (i.e.,
+the paleolatitude). By default, the bands are 10 degrees wide, starting at the
+south pole. Use the flag --width to define a different width, in degrees. If
+the width is not a divisor of 180, the northernmost band will be narrower.
+
+At each time stage, the values of each node are scaled so they sum 1, and the
+occupancy of a band is the sum of the scaled values of the pixels in the band,
+summed over all the lineages present at the time stage. Then, the occupancy is
+the expected number of lineages in the band. The post-split stage of a node
+(i.e., the stage with the same age as its parent) is ignored, so each lineage
+is counted only once.
+
+The occupancy is reported for the whole tree, and if clade labels are defined
+in the project (see 'phygeo tree label'), for each labeled clade. A clade
+includes the most recent common ancestor of the clade, and all of its
+descendants.
+
+The output is a tab-delimited file with the following columns:
+
+	tree      the name of the tree
+	clade     the clade label ("--" for the whole tree)
+	age       the age of the time stage, in years
+	lineages  the number of lineages at the time stage
+
+followed by a column for each band, from south to north, with the occupancy
+of the band. The name of the column is the latitude range of the band, for
+example "-10:0". The rows of each tree and clade are ordered from the oldest
+to the youngest time stage.
+
+By default, the output is printed in the standard output. Use the flag
+--output, or -o, to define an output file.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var widthFlag float64
+var inputFile string
+var output string
+
+func setFlags(c *command.Command) {
+	c.Flags().Float64Var(&widthFlag, "width", 10, "")
+	c.Flags().StringVar(&inputFile, "input", "", "")
+	c.Flags().StringVar(&inputFile, "i", "", "")
+	c.Flags().StringVar(&output, "output", "", "")
+	c.Flags().StringVar(&output, "o", "", "")
+}
+
+func run(c *command.Command, args []string) (err error) {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if inputFile == "" {
+		return c.UsageError("expecting input file, flag --input")
+	}
+	if widthFlag <= 0 || widthFlag > 180 {
+		return c.UsageError("flag --width: value must be between 0 and 180")
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	tf := p.Path(project.Trees)
+	if tf == "" {
+		msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	tc, err := readTreeFile(tf)
+	if err != nil {
+		return err
+	}
+
+	labels := clade.New()
+	if lf := p.Path(project.Clades); lf != "" {
+		labels, err = readLabels(lf)
+		if err != nil {
+			return err
+		}
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("landscape not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	landscape, err := readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	bands := newBands(widthFlag)
+	rt, err := getRec(inputFile, c.Stdin(), tc, landscape)
+	if err != nil {
+		return err
+	}
+
+	w := c.Stdout()
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			e := f.Close()
+			if err == nil && e != nil {
+				err = e
+			}
+		}()
+		w = f
+	} else {
+		output = "stdout"
+	}
+	if err := writeBands(w, args[0], tc, rt, labels, landscape.Pixelation(), bands); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", output, err)
+	}
+	return nil
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func readLabels(name string) (*clade.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := clade.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func getRec(name string, stdin io.Reader, tc *timetree.Collection, landscape *model.TimePix) (map[string]*recTree, error) {
+	r, err := input.Open(name, stdin)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	rt, err := readRecon(r, tc, landscape)
+	if err != nil {
+		return nil, fmt.Errorf("on input file %q: %v", name, err)
+	}
+	return rt, nil
+}
+
+// Bands is a set of latitudinal bands
+// of the same width,
+// from the south pole to the north pole.
+type bands struct {
+	width float64
+
+	// the southern limit of each band
+	south []float64
+}
+
+func newBands(width float64) bands {
+	b := bands{width: width}
+	for i := 0; ; i++ {
+		// rounded to avoid floating point noise
+		// in the band names
+		lat := math.Round((-90+float64(i)*width)*1e6) / 1e6
+		if lat >= 90 {
+			break
+		}
+		b.south = append(b.south, lat)
+	}
+	return b
+}
+
+// Len returns the number of bands.
+func (b bands) len() int {
+	return len(b.south)
+}
+
+// Band returns the index of the band
+// of a latitude.
+func (b bands) band(lat float64) int {
+	i := int(math.Floor((lat + 90) / b.width))
+	if i >= len(b.south) {
+		return len(b.south) - 1
+	}
+	if i < 0 {
+		return 0
+	}
+	return i
+}
+
+// Names returns the names of the bands.
+func (b bands) names() []string {
+	names := make([]string, len(b.south))
+	for i, lat := range b.south {
+		max := 90.0
+		if i+1 < len(b.south) {
+			max = b.south[i+1]
+		}
+		names[i] = strconv.FormatFloat(lat, 'f', -1, 64) + ":" + strconv.FormatFloat(max, 'f', -1, 64)
+	}
+	return names
+}
+
+// A recTree stores the occupancy of the bands
+// of each node at each time stage.
+type recTree struct {
+	name string
+	tree *timetree.Tree
+
+	// type of the reconstruction
+	tp string
+
+	// the values of each pixel
+	// at each node and time stage
+	nodes map[int]map[int64]map[int]float64
+}
+
+// Occupancy returns the sum of the scaled values
+// of each band,
+// for each time stage,
+// for the lineages of a set of nodes.
+// It also returns the number of lineages
+// at each time stage.
+func (t *recTree) occupancy(nodes []int, pix *earth.Pixelation, b bands) (map[int64][]float64, map[int64]int) {
+	occ := make(map[int64][]float64)
+	lineages := make(map[int64]int)
+	for _, id := range nodes {
+		for age, rec := range t.nodes[id] {
+			if !t.tree.IsRoot(id) && age == t.tree.Age(t.tree.Parent(id)) {
+				// post-split stage
+				continue
+			}
+			st := scale(rec, t.tp)
+			if st == nil {
+				continue
+			}
+
+			o, ok := occ[age]
+			if !ok {
+				o = make([]float64, b.len())
+				occ[age] = o
+			}
+			for px, p := range st {
+				lat := pix.ID(px).Point().Latitude()
+				o[b.band(lat)] += p
+			}
+			lineages[age]++
+		}
+	}
+	return occ, lineages
+}
+
+// Scale returns the values of a time stage
+// scaled so they sum 1.
+// It returns nil if the sum is zero.
+func scale(rec map[int]float64, tp string) map[int]float64 {
+	st := make(map[int]float64, len(rec))
+	if tp == "log-like" {
+		max := -math.MaxFloat64
+		for _, p := range rec {
+			if p > max {
+				max = p
+			}
+		}
+		for px, p := range rec {
+			st[px] = math.Exp(p - max)
+		}
+	} else {
+		for px, p := range rec {
+			st[px] = p
+		}
+	}
+
+	var sum float64
+	for _, p := range st {
+		sum += p
+	}
+	if sum == 0 {
+		return nil
+	}
+	for px, p := range st {
+		st[px] = p / sum
+	}
+	return st
+}
+
+var headerFields = []string{
+	"tree",
+	"node",
+	"age",
+	"type",
+	"equator",
+	"pixel",
+	"value",
+}
+
+func readRecon(r io.Reader, tc *timetree.Collection, landscape *model.TimePix) (map[string]*recTree, error) {
+	tsv := csv.NewReader(r)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range headerFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	var tp string
+	rt := make(map[string]*recTree)
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "tree"
+		tn := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if tn == "" {
+			continue
+		}
+		tn = strings.ToLower(tn)
+		tv := tc.Tree(tn)
+		if tv == nil {
+			continue
+		}
+		t, ok := rt[tn]
+		if !ok {
+			t = &recTree{
+				name:  tn,
+				tree:  tv,
+				nodes: make(map[int]map[int64]map[int]float64),
+			}
+			rt[tn] = t
+		}
+
+		f = "node"
+		id, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if !slices.Contains(tv.Nodes(), id) {
+			return nil, fmt.Errorf("on row %d: field %q: node %d not in tree %q", ln, f, id, tn)
+		}
+		n, ok := t.nodes[id]
+		if !ok {
+			n = make(map[int64]map[int]float64)
+			t.nodes[id] = n
+		}
+
+		f = "age"
+		age, err := strconv.ParseInt(row[fields[f]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		st, ok := n[age]
+		if !ok {
+			st = make(map[int]float64)
+			n[age] = st
+		}
+
+		f = "type"
+		tpV := strings.ToLower(strings.Join(strings.Fields(row[fields[f]]), " "))
+		if tpV == "" {
+			return nil, fmt.Errorf("on row %d: field %q: expecting reconstruction type", ln, f)
+		}
+		if tp == "" {
+			tp = tpV
+		}
+		if tp != tpV {
+			return nil, fmt.Errorf("on row %d: field %q: got %q want %q", ln, f, tpV, tp)
+		}
+		t.tp = tp
+
+		f = "equator"
+		eq, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if eq != landscape.Pixelation().Equator() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid equator value %d", ln, f, eq)
+		}
+
+		f = "pixel"
+		px, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if px >= landscape.Pixelation().Len() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, px)
+		}
+
+		f = "value"
+		v, err := strconv.ParseFloat(row[fields[f]], 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		st[px] = v
+	}
+	if len(rt) == 0 {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+
+	return rt, nil
+}
+
+// Descendants returns a node
+// and all of its descendants.
+func descendants(t *timetree.Tree, n int) []int {
+	desc := []int{n}
+	for i := 0; i < len(desc); i++ {
+		desc = append(desc, t.Children(desc[i])...)
+	}
+	return desc
+}
+
+func writeBands(w io.Writer, p string, tc *timetree.Collection, rt map[string]*recTree, labels *clade.Collection, pix *earth.Pixelation, b bands) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# latitudinal band occupancy, project %q\n", p)
+	fmt.Fprintf(bw, "# band width: %.6f degrees\n", widthFlag)
+	fmt.Fprintf(bw, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(bw, "# phygeo: %s\n", version.String())
+
+	tsv := csv.NewWriter(bw)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	header := append([]string{"tree", "clade", "age", "lineages"}, b.names()...)
+	if err := tsv.Write(header); err != nil {
+		return err
+	}
+
+	for _, name := range tc.Names() {
+		t, ok := rt[name]
+		if !ok {
+			continue
+		}
+
+		groups := []string{"--"}
+		nodes := map[string][]int{
+			"--": t.tree.Nodes(),
+		}
+		for _, l := range labels.Names() {
+			n := labels.Node(t.tree, l)
+			if n < 0 {
+				continue
+			}
+			groups = append(groups, l)
+			nodes[l] = descendants(t.tree, n)
+		}
+
+		for _, g := range groups {
+			occ, lineages := t.occupancy(nodes[g], pix, b)
+			ages := make([]int64, 0, len(occ))
+			for a := range occ {
+				ages = append(ages, a)
+			}
+			slices.Sort(ages)
+
+			for i := len(ages) - 1; i >= 0; i-- {
+				a := ages[i]
+				row := []string{
+					t.name,
+					g,
+					strconv.FormatInt(a, 10),
+					strconv.Itoa(lineages[a]),
+				}
+				for _, v := range occ[a] {
+					row = append(row, strconv.FormatFloat(v, 'f', 6, 64))
+				}
+				if err := tsv.Write(row); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return nil
+}
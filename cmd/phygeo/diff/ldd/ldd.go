@@ -0,0 +1,556 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package ldd implements a command to estimate
+// the parameters of a diffusion model
+// with long-distance dispersal.
+package ldd
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/agerange"
+	"github.com/js-arias/phygeo/constraint"
+	"github.com/js-arias/phygeo/infer/diffusion"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/ranges"
+	"github.com/js-arias/timetree"
+)
+
+var Command = &command.Command{
+	Usage: `ldd [--stem <age>] [--lambda <value>] [--ld <value>]
+	[--step <value>] [--stop <value>]
+	[-p|--particles <number>]
+	[--cpu <number>] <project-file>`,
+	Short: "estimate the long-distance dispersal weight",
+	Long: `
+Command ldd reads a PhyGeo project, and search for the maximum likelihood
+estimates of the lambda parameter and the probability of a long-distance
+dispersal event, using a mixture kernel (see "phygeo help diff like").
+
+The argument of the command is the name of the project file.
+
+The algorithm is a simple hill climbing search over both parameters. By
+default, it starts at a lambda value of 100, and a probability of a
+long-distance dispersal of 0.01 per million years. Use the flags --lambda and
+--ld to define different starting points. At each cycle, the lambda value is
+moved by a step, and the probability of a long-distance dispersal is
+multiplied, or divided, by a factor (with a minimum value of 1e-9). By
+default, the initial lambda step is 100, use the flag --step to change the
+value; the initial factor is 10. At each cycle the step value (and the
+logarithm of the factor) is reduced a 50%, and stop when step has a size of 1.
+Use flag --stop to set a different stop value.
+
+For each parameter, a 95% confidence interval is calculated using the
+likelihood profile of the parameter, with the other parameter fixed at its
+estimated value. The bounds are the parameter values with a log-likelihood
+1.92 units below the maximum.
+
+Using the estimated parameters, a stochastic mapping is performed, and for
+each branch segment of each particle the probability that the movement was
+produced by the long-distance component of the kernel is calculated. By
+default, 1000 particles are used; use the flag --particles, or -p, to define
+a different number. Segments with a zero length are ignored.
+
+By default, an stem branch will be added to each tree using the 10% of the
+root age. To set a different stem age use the flag --stem, the value should
+be in million years.
+
+By default, all available CPUs will be used in the processing. Set --cpu flag
+to use a different number of CPUs.
+
+The results are printed in the standard output, as a tab-delimited table with
+the following columns:
+
+	tree       the name of the tree
+	lambda     the estimated lambda value
+	lambda-lo  the lower bound of the lambda value
+	lambda-hi  the upper bound of the lambda value
+	ld         the estimated probability of a long-distance dispersal, per
+	           million years
+	ld-lo      the lower bound of the probability
+	ld-hi      the upper bound of the probability
+	logLike    the log-likelihood of the estimated parameters
+	segments   the number of branch segments in the stochastic maps
+	ld-frac    the expected fraction of segments produced by the
+	           long-distance component
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var lambdaFlag float64
+var ldFlag float64
+var stemAge float64
+var stepFlag float64
+var stopFlag float64
+var particles int
+var numCPU int
+
+func setFlags(c *command.Command) {
+	c.Flags().Float64Var(&lambdaFlag, "lambda", 100, "")
+	c.Flags().Float64Var(&ldFlag, "ld", 0.01, "")
+	c.Flags().Float64Var(&stopFlag, "stop", 1, "")
+	c.Flags().Float64Var(&stepFlag, "step", 100, "")
+	c.Flags().Float64Var(&stemAge, "stem", 0, "")
+	c.Flags().IntVar(&particles, "particles", 1000, "")
+	c.Flags().IntVar(&particles, "p", 1000, "")
+	c.Flags().IntVar(&numCPU, "cpu", runtime.NumCPU(), "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if lambdaFlag <= 0 {
+		return c.UsageError("flag --lambda: value must be greater than 0")
+	}
+	if ldFlag <= 0 || ldFlag >= 1 {
+		return c.UsageError("flag --ld: value must be between 0 and 1")
+	}
+	if particles < 1 {
+		return c.UsageError("flag --particles: value must be greater than 0")
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	tf := p.Path(project.Trees)
+	if tf == "" {
+		msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	tc, err := readTreeFile(tf)
+	if err != nil {
+		return err
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("paleolandscape not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	landscape, err := readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	rotF := p.Path(project.GeoMotion)
+	if rotF == "" {
+		msg := fmt.Sprintf("plate motion model not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	rot, err := readRotation(rotF, landscape.Pixelation())
+	if err != nil {
+		return err
+	}
+
+	stF := p.Path(project.Stages)
+	stages, err := readStages(stF, rot, landscape)
+	if err != nil {
+		return err
+	}
+
+	pwF := p.Path(project.PixWeight)
+	if pwF == "" {
+		msg := fmt.Sprintf("pixel weights not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	pw, err := readPixWeights(pwF)
+	if err != nil {
+		return err
+	}
+
+	rf := p.Path(project.Ranges)
+	rc, err := readRanges(rf)
+	if err != nil {
+		return err
+	}
+	var ar *agerange.Collection
+	if af := p.Path(project.AgeRanges); af != "" {
+		ar, err = readAgeRanges(af, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+	var cn *constraint.Collection
+	if cf := p.Path(project.Constraints); cf != "" {
+		cn, err = readConstraints(cf, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+
+	// check if all terminals have defined ranges
+	for _, tn := range tc.Names() {
+		t := tc.Tree(tn)
+		for _, term := range t.Terms() {
+			if !rc.HasTaxon(term) {
+				return fmt.Errorf("taxon %q of tree %q has no defined range", term, tn)
+			}
+		}
+	}
+
+	// Set the number of parallel processors
+	diffusion.SetCPU(numCPU)
+
+	dm, _ := earth.NewDistMatRingScale(landscape.Pixelation())
+
+	param := diffusion.Param{
+		Landscape:   landscape,
+		Rot:         rot,
+		DM:          dm,
+		PW:          pw,
+		Ranges:      rc,
+		AgeRanges:   ar,
+		Constraints: cn,
+		Stages:      stages.Stages(),
+		Cache:       diffusion.NewPDFCache(landscape.Pixelation()),
+	}
+
+	fmt.Fprintf(c.Stdout(), "tree\tlambda\tlambda-lo\tlambda-hi\tld\tld-lo\tld-hi\tlogLike\tsegments\tld-frac\n")
+	for _, tn := range tc.Names() {
+		t := tc.Tree(tn)
+		stem := int64(stemAge * 1_000_000)
+		if stem == 0 {
+			stem = t.Age(t.Root()) / 10
+		}
+		param.Stem = stem
+
+		e := newEstimate(t, param)
+		e.search()
+		lLo, lHi := e.lambdaCI()
+		ldLo, ldHi := e.ldCI()
+
+		param.Lambda = e.lambda
+		param.LongDist = e.ld
+		dt := diffusion.New(t, param)
+		dt.DownPass()
+		dt.Simulate(particles)
+		segs, frac := longDistFrac(dt, t)
+
+		fmt.Fprintf(c.Stdout(), "%s\t%.6f\t%.6f\t%.6f\t%.6g\t%.6g\t%.6g\t%.6f\t%d\t%.6f\n", tn, e.lambda, lLo, lHi, e.ld, ldLo, ldHi, e.logLike, segs, frac)
+	}
+	return nil
+}
+
+// An estimate stores the best parameters
+// of a mixture kernel
+// for a tree.
+type estimate struct {
+	t *timetree.Tree
+	p diffusion.Param
+
+	lambda  float64
+	ld      float64
+	logLike float64
+}
+
+func newEstimate(t *timetree.Tree, p diffusion.Param) *estimate {
+	e := &estimate{
+		t:      t,
+		p:      p,
+		lambda: lambdaFlag,
+		ld:     ldFlag,
+	}
+	e.logLike = e.eval(e.lambda, e.ld)
+	return e
+}
+
+// Eval returns the log-likelihood
+// of a pair of parameters.
+func (e *estimate) eval(lambda, ld float64) float64 {
+	e.p.Lambda = lambda
+	e.p.LongDist = ld
+	dt := diffusion.New(e.t, e.p)
+	return dt.DownPass()
+}
+
+// Search performs a hill climbing
+// over both parameters.
+// The probability of a long-distance dispersal
+// is searched in a logarithmic scale.
+func (e *estimate) search() {
+	step := stepFlag
+	factor := math.Log(10)
+	for {
+		for {
+			type move struct{ lambda, ld float64 }
+			moves := []move{
+				{e.lambda + step, e.ld},
+				{e.lambda - step, e.ld},
+				{e.lambda, e.ld * math.Exp(factor)},
+				{e.lambda, e.ld / math.Exp(factor)},
+			}
+			improved := false
+			for _, m := range moves {
+				if m.lambda <= 0 || m.ld < minLD || m.ld >= 1 {
+					continue
+				}
+				like := e.eval(m.lambda, m.ld)
+				if like > e.logLike {
+					e.lambda = m.lambda
+					e.ld = m.ld
+					e.logLike = like
+					improved = true
+				}
+			}
+			if !improved {
+				break
+			}
+		}
+		if step < stopFlag {
+			break
+		}
+		step /= 2
+		factor /= 2
+	}
+}
+
+// MinLD is the minimum probability
+// of a long-distance dispersal
+// used in the search.
+const minLD = 1e-9
+
+// ProfileDrop is the drop in the log-likelihood
+// of the bounds of a 95% confidence interval
+// (i.e., half of the 0.95 quantile
+// of a chi-square distribution
+// with one degree of freedom).
+const profileDrop = 1.920729
+
+// Bisections is the number of bisections
+// used to find a bound.
+const bisections = 20
+
+// LambdaCI returns the confidence interval
+// of the lambda value.
+func (e *estimate) lambdaCI() (lo, hi float64) {
+	target := e.logLike - profileDrop
+	f := func(x float64) float64 {
+		return e.eval(x, e.ld)
+	}
+
+	lo = e.lambda / 1000
+	if f(lo) < target {
+		lo = bound(f, lo, e.lambda, target)
+	}
+
+	hi = e.lambda * 2
+	for i := 0; i < 10 && f(hi) >= target; i++ {
+		hi *= 2
+	}
+	hi = bound(f, hi, e.lambda, target)
+	return lo, hi
+}
+
+// LdCI returns the confidence interval
+// of the probability of a long-distance dispersal.
+func (e *estimate) ldCI() (lo, hi float64) {
+	target := e.logLike - profileDrop
+	f := func(x float64) float64 {
+		return e.eval(e.lambda, math.Exp(x))
+	}
+
+	x := math.Log(e.ld)
+	lo = math.Log(minLD)
+	if f(lo) < target {
+		lo = bound(f, lo, x, target)
+	}
+	hi = math.Log(1 - 1e-6)
+	if f(hi) < target {
+		hi = bound(f, hi, x, target)
+	}
+	return math.Exp(lo), math.Exp(hi)
+}
+
+// Bound returns the value between out,
+// a value with a log-likelihood below the target,
+// and in,
+// a value with a log-likelihood above the target,
+// in which the log-likelihood is equal to the target.
+func bound(f func(float64) float64, out, in, target float64) float64 {
+	for i := 0; i < bisections; i++ {
+		mid := (out + in) / 2
+		if f(mid) < target {
+			out = mid
+			continue
+		}
+		in = mid
+	}
+	return (out + in) / 2
+}
+
+// LongDistFrac returns the number of branch segments
+// in the stochastic maps of a tree,
+// and the expected fraction of segments
+// produced by the long-distance component
+// of the kernel.
+func longDistFrac(dt *diffusion.Tree, t *timetree.Tree) (int, float64) {
+	var segs int
+	var sum float64
+	for _, n := range t.Nodes() {
+		stages := dt.Stages(n)
+		for i, a := range stages {
+			// the first stage of a node
+			// is the split from its parent
+			if i == 0 {
+				continue
+			}
+			for p := 0; p < particles; p++ {
+				sd := dt.SrcDest(n, p, a)
+				if sd.From < 0 {
+					continue
+				}
+				prob, ok := dt.LongDistProb(n, a, sd.From, sd.To)
+				if !ok {
+					continue
+				}
+				segs++
+				sum += prob
+			}
+		}
+	}
+	if segs == 0 {
+		return 0, 0
+	}
+	return segs, sum / float64(segs)
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readRotation(name string, pix *earth.Pixelation) (*model.StageRot, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rot, err := model.ReadStageRot(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return rot, nil
+}
+
+func readStages(name string, rot *model.StageRot, landscape *model.TimePix) (timestage.Stages, error) {
+	stages := timestage.New()
+	stages.Add(rot)
+	stages.Add(landscape)
+
+	if name == "" {
+		return stages, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := timestage.Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+	stages.Add(st)
+
+	return stages, nil
+}
+
+func readPixWeights(name string) (pixweight.Pixel, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pw, err := pixweight.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return pw, nil
+}
+
+func readRanges(name string) (*ranges.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := ranges.ReadTSV(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func readAgeRanges(name string, pix *earth.Pixelation) (*agerange.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := agerange.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func readConstraints(name string, pix *earth.Pixelation) (*constraint.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := constraint.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
@@ -8,12 +8,15 @@ package like
 
 import (
 	"bufio"
+	"compress/gzip"
 	"encoding/csv"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/js-arias/command"
@@ -21,16 +24,24 @@ import (
 	"github.com/js-arias/earth/model"
 	"github.com/js-arias/earth/stat/dist"
 	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/agerange"
+	"github.com/js-arias/phygeo/constraint"
 	"github.com/js-arias/phygeo/infer/diffusion"
+	"github.com/js-arias/phygeo/internal/shard"
 	"github.com/js-arias/phygeo/project"
 	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/phygeo/version"
 	"github.com/js-arias/ranges"
 	"github.com/js-arias/timetree"
 )
 
 var Command = &command.Command{
 	Usage: `like [--stem <age>] [--lambda <value>]
-	[-o|--output <file>]
+	[--gzip] [--threshold <value>] [--float32] [--per-stage]
+	[--summary-only] [--root]
+	[--kernel <name>] [--ld <value>] [--engine <name>]
+	[-o|--output <file>] [--shard <i/n>]
+	[--snap <km>] [--snap-log <file>]
 	[--cpu <number>] <project-file>`,
 	Short: "perform a likelihood reconstruction",
 	Long: `
@@ -39,6 +50,27 @@ for the trees in the project.
 
 The argument of the command is the name of the project file.
 
+If the project has age-specific ranges (for example, fossils of a lineage at
+different time slices), each range will be attached to the branch of the
+lineage at the age of the range, adding a new time stage at that age if
+required. See "phygeo help range range-files" for more information.
+Similarly, if the project has node constraints (for example, a fossil assigned
+to a stem lineage), each constraint will be attached to the branch of the
+lineage of the node at the age of the constraint. See "phygeo tree
+constraint" for more information.
+
+Terminal range pixels located in a landscape value with a pixel weight of zero
+are ignored by the reconstruction, and will be reported as warnings in the
+standard error. Use the command 'phygeo diff hostile' for a detailed report.
+
+If the flag --snap is defined with a radius in km, the hostile pixels of each
+terminal (i.e., pixels in a landscape value with a pixel weight of zero) will
+be moved to the nearest pixel with a non-zero weight, if that pixel is within
+the indicated radius. The range file of the project is not modified. All
+moved pixels will be recorded in a log file, by default named using the
+project file name and the suffix "-snap.tab". Use the flag --snap-log to
+define a different name.
+
 By default, a stem branch will be added to each tree using 10% of the root
 age. To set a different stem age, use the flag --stem; the value should be in
 million years.
@@ -49,36 +81,158 @@ diffusion process over a million years using 1/radias^2 units. If no value is
 defined, it will use 100. As the kappa parameter, larger values indicate low
 diffusivity, while smaller values indicate high diffusivity.
 
+By default, the dispersal kernel is a spherical normal. Use the flag --kernel
+to define a different kernel. Valid kernels are:
+
+	normal   the spherical normal (the default).
+	mixture  an heavy-tailed kernel, made of a mixture of a spherical normal
+	         and an uniform distribution over the whole sphere, that models
+	         rare long-distance dispersal events. The probability of a
+	         long-distance event per million years is defined with the flag
+	         --ld (by default 0.01), so the weight of the uniform component
+	         at a time stage of t million years is 1-(1-ld)^t.
+
+By default, the conditional likelihoods are calculated as a convolution of
+the dispersal kernel over the pixels. Use the flag --engine to define a
+different method. Valid engines are:
+
+	convolution  the convolution of the dispersal kernel (the default).
+	ctmc         an exact continuous-time Markov chain between neighbor
+	             pixels, calculated with sparse matrix exponentials. As its
+	             cost grows with the number of pixels, and the expected
+	             number of movements between pixels, it is only recommended
+	             for coarse pixelations (for example, 180 pixels or less
+	             at the equator). The engine is only used for the
+	             likelihood; with the mixture kernel, the uniform component
+	             is added to the chain probabilities.
+
 The output file is a pixel probability file with the conditional likelihoods
 (i.e., down-pass results) for each pixel at each node. The prefix of the
 output file name is the name of the project file. To set a different prefix,
 use the flag --output, or -o. The output file name will be named by the tree
-name, the lambda value, and the suffix 'down'.
+name, the lambda value, and the suffix 'down'. If the mixture kernel is used,
+the kernel name and the value of --ld will be added after the lambda value
+(for example, "project.tab-tree-100.000000-mixture-0.010000-down.tab").
+
+For lambda profiling, or model comparison, only the likelihood of each tree is
+required. If the flag --summary-only is given, the output file will not be
+written, and the likelihood of each tree will be printed in the standard
+output, as a TSV table with the columns "tree", "lambda", and "logLike". If
+the flag --root is also given, the conditional likelihoods of the oldest stage
+of the root (i.e., the start of the stem branch) will be written in a file
+with the suffix 'root' instead of 'down'. As the pixel weights are already
+included in the conditional likelihoods, the normalized values of this stage
+are the posterior of the root.
+
+Down-pass files can be very large. If the flag --gzip is given, the output
+file will be compressed with gzip, and the suffix ".gz" will be added to the
+file name. Compressed files are detected automatically by the commands that
+read pixel probability files. The flag --threshold can be used to skip pixels
+with a likelihood that is smaller than the given fraction of the best pixel
+at each time stage, for example, "--threshold 1e-10" will skip the pixels
+whose likelihood is less than 1e-10 times the likelihood of the best pixel.
+
+At high resolutions, most pixels have vanishing likelihoods. If the flag
+--float32 is given, the conditional likelihoods will be stored in single
+precision, rescaled at each time stage. Pixels with a likelihood smaller than
+about 1e-45 times the likelihood of the best pixel of a time stage will be
+ignored, so the log-likelihood of the reconstruction will be exact up to the
+single precision. Each stored value uses about a quarter less memory, so the
+savings are modest, and mostly come from the ignored pixels.
+
+If the flag --per-stage is given, the contribution of each branch segment to
+the log-likelihood of the tree will be written in a file with the same name as
+the output file, but with the suffix 'stages' instead of 'down'. The
+contribution of a segment is the change of the log of the total conditional
+likelihood (the sum over all pixels) along the segment. At the youngest stage
+of each node, the contribution also includes the difference between the total
+conditional likelihood of the node and those of its descendants, which
+measures the overlap of the descendant ranges at a split. The oldest stage of
+the root includes the normalization of the pixel priors. The sum of all the
+contributions is the log-likelihood of the tree. Segments with large negative
+contributions indicate terminals or time stages that dominate the likelihood,
+for example, by a misplaced record. The file contains the following columns:
+
+	tree     the name of the tree
+	node     the ID of the node in the tree
+	age      the age of the time stage (the youngest age of the segment),
+	         in years
+	taxon    the name of the terminal, if the node is a terminal
+	logLike  the contribution to the log-likelihood
 
 By default, all available CPUs will be used in the calculations. Set the flag
 --cpu to use a different number of CPUs.
+
+To split the analysis of several trees into independent jobs (e.g., as an
+array job in a cluster), use the flag --shard with a value "i/n", in which n
+is the number of jobs, and i is the job number (from 1 to n). Trees are
+assigned to the jobs in order of their names, so the tree k (starting at 0)
+will be analyzed by the job (k mod n) + 1.
 	`,
 	SetFlags: setFlags,
 	Run:      run,
 }
 
+var gzipFlag bool
+var float32Flag bool
+var perStage bool
+var summaryOnly bool
+var rootFlag bool
 var lambdaFlag float64
 var stemAge float64
+var threshold float64
 var numCPU int
+var kernelFlag string
+var ldFlag float64
+var engineFlag string
+var snapRadius float64
+var snapLog string
 var output string
+var shardFlag string
+var jobShard shard.Shard
 
 func setFlags(c *command.Command) {
+	c.Flags().BoolVar(&float32Flag, "float32", false, "")
+	c.Flags().BoolVar(&gzipFlag, "gzip", false, "")
+	c.Flags().BoolVar(&perStage, "per-stage", false, "")
+	c.Flags().BoolVar(&summaryOnly, "summary-only", false, "")
+	c.Flags().BoolVar(&rootFlag, "root", false, "")
 	c.Flags().Float64Var(&lambdaFlag, "lambda", 100, "")
+	c.Flags().Float64Var(&threshold, "threshold", 0, "")
 	c.Flags().Float64Var(&stemAge, "stem", 0, "")
+	c.Flags().Float64Var(&snapRadius, "snap", 0, "")
+	c.Flags().StringVar(&snapLog, "snap-log", "", "")
 	c.Flags().IntVar(&numCPU, "cpu", runtime.GOMAXPROCS(0), "")
+	c.Flags().StringVar(&kernelFlag, "kernel", "normal", "")
+	c.Flags().Float64Var(&ldFlag, "ld", 0.01, "")
+	c.Flags().StringVar(&engineFlag, "engine", string(diffusion.Convolution), "")
 	c.Flags().StringVar(&output, "output", "", "")
 	c.Flags().StringVar(&output, "o", "", "")
+	c.Flags().StringVar(&shardFlag, "shard", "", "")
 }
 
 func run(c *command.Command, args []string) error {
 	if len(args) < 1 {
 		return c.UsageError("expecting project file")
 	}
+	if snapRadius < 0 {
+		return c.UsageError("flag --snap: value must be greater than 0")
+	}
+	if rootFlag && !summaryOnly {
+		return c.UsageError("flag --root: requires flag --summary-only")
+	}
+	longDist, err := parseKernel()
+	if err != nil {
+		return c.UsageError(err.Error())
+	}
+	engine, err := diffusion.ParseEngine(engineFlag)
+	if err != nil {
+		return c.UsageError(fmt.Sprintf("flag --engine: %v", err))
+	}
+	jobShard, err = shard.Parse(shardFlag)
+	if err != nil {
+		return c.UsageError(fmt.Sprintf("flag --shard: %v", err))
+	}
 
 	p, err := project.Read(args[0])
 	if err != nil {
@@ -136,6 +290,21 @@ func run(c *command.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	var ar *agerange.Collection
+	if af := p.Path(project.AgeRanges); af != "" {
+		ar, err = readAgeRanges(af, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+	var cn *constraint.Collection
+	if cf := p.Path(project.Constraints); cf != "" {
+		cn, err = readConstraints(cf, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+
 	// check if all terminals have defined ranges
 	for _, tn := range tc.Names() {
 		t := tc.Tree(tn)
@@ -151,40 +320,221 @@ func run(c *command.Command, args []string) error {
 	standard := calcStandardDeviation(landscape.Pixelation(), lambdaFlag)
 
 	param := diffusion.Param{
-		Landscape: landscape,
-		Rot:       rot,
-		DM:        dm,
-		PW:        pw,
-		Ranges:    rc,
-		Lambda:    lambdaFlag,
-		Stages:    stages.Stages(),
+		Landscape:   landscape,
+		Rot:         rot,
+		DM:          dm,
+		PW:          pw,
+		Ranges:      rc,
+		AgeRanges:   ar,
+		Constraints: cn,
+		Lambda:      lambdaFlag,
+		LongDist:    longDist,
+		Engine:      engine,
+		Stages:      stages.Stages(),
+		Float32:     float32Flag,
 	}
 
 	// Set the number of parallel processors
 	diffusion.SetCPU(numCPU)
 
-	for _, tn := range tc.Names() {
+	var summary *csv.Writer
+	if summaryOnly {
+		summary = csv.NewWriter(c.Stdout())
+		summary.Comma = '\t'
+		summary.UseCRLF = true
+		if err := summary.Write([]string{"tree", "lambda", "logLike"}); err != nil {
+			return err
+		}
+	}
+
+	var snaps []snapRec
+	for i, tn := range tc.Names() {
+		if !jobShard.Has(i) {
+			continue
+		}
 		t := tc.Tree(tn)
 		stem := int64(stemAge * 1_000_000)
 		if stem == 0 {
 			stem = t.Age(t.Root()) / 10
 		}
 		param.Stem = stem
-		name := fmt.Sprintf("%s-%s-%.6f-down.tab", args[0], t.Name(), lambdaFlag)
+		param.Ranges = rc
+		if snapRadius > 0 {
+			var moved []diffusion.Hostile
+			param.Ranges, moved = diffusion.Snap(t, param, snapRadius*1000/earth.Radius)
+			for _, m := range moved {
+				snaps = append(snaps, snapRec{tree: tn, Hostile: m})
+			}
+		}
+		warnHostile(c.Stderr(), t, param)
+		suffix := "down"
+		if rootFlag {
+			suffix = "root"
+		}
+		name := fmt.Sprintf("%s-%s-%.6f%s-%s.tab", args[0], t.Name(), lambdaFlag, kernelName(longDist), suffix)
 		if output != "" {
 			name = output + "-" + name
 		}
+		if gzipFlag {
+			name += ".gz"
+		}
 
 		dt := diffusion.New(t, param)
 		dt.DownPass()
-		if err := writeTreeConditional(dt, name, args[0], lambdaFlag, standard, landscape.Pixelation().Len(), landscape.Pixelation().Equator()); err != nil {
-			return err
+		if !summaryOnly || rootFlag {
+			root := -1
+			if rootFlag {
+				root = t.Root()
+			}
+			if err := writeTreeConditional(dt, name, args[0], lambdaFlag, standard, landscape.Pixelation().Len(), landscape.Pixelation().Equator(), root); err != nil {
+				return err
+			}
+		}
+		if perStage {
+			sName := fmt.Sprintf("%s-%s-%.6f%s-stages.tab", args[0], t.Name(), lambdaFlag, kernelName(longDist))
+			if output != "" {
+				sName = output + "-" + sName
+			}
+			if err := writeStageLikes(dt, t, sName, args[0], lambdaFlag); err != nil {
+				return err
+			}
+		}
+		if summaryOnly {
+			row := []string{
+				tn,
+				strconv.FormatFloat(lambdaFlag, 'f', 6, 64),
+				strconv.FormatFloat(dt.LogLike(), 'f', 6, 64),
+			}
+			if err := summary.Write(row); err != nil {
+				return err
+			}
+			summary.Flush()
+			continue
 		}
 		fmt.Fprintf(c.Stdout(), "%s\t%.6f\n", tn, dt.LogLike())
 	}
+	if summaryOnly {
+		if err := summary.Error(); err != nil {
+			return fmt.Errorf("while writing on standard output: %v", err)
+		}
+	}
+
+	if snapRadius > 0 {
+		if snapLog == "" {
+			snapLog = args[0] + "-snap.tab"
+		}
+		if err := writeSnapLog(snapLog, args[0], snapRadius, snaps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WarnHostile reports the terminals of a tree
+// with range pixels with a pixel weight of zero.
+func warnHostile(w io.Writer, t *timetree.Tree, p diffusion.Param) {
+	hostile := make(map[string]int)
+	for _, h := range diffusion.HostilePixels(t, p) {
+		hostile[h.Taxon]++
+	}
+	for _, tax := range t.Terms() {
+		n := hostile[tax]
+		if n == 0 {
+			continue
+		}
+		if n == len(p.Ranges.Range(tax)) {
+			fmt.Fprintf(w, "WARNING: tree %q: taxon %q: all pixels with zero weight: likelihood will be zero\n", t.Name(), tax)
+			continue
+		}
+		fmt.Fprintf(w, "WARNING: tree %q: taxon %q: %d pixels with zero weight\n", t.Name(), tax, n)
+	}
+}
+
+// SnapRec is a pixel moved
+// by the snap preprocessing.
+type snapRec struct {
+	tree string
+	diffusion.Hostile
+}
+
+func writeSnapLog(name, p string, radius float64, moved []snapRec) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if err == nil && e != nil {
+			err = e
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "# diff.like, project %q\n", p)
+	fmt.Fprintf(w, "# snap radius: %.6f km\n", radius)
+	fmt.Fprintf(w, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "# phygeo: %s\n", version.String())
+
+	tsv := csv.NewWriter(w)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	if err := tsv.Write([]string{"tree", "taxon", "age", "pixel", "value", "snap", "snap-value", "dist"}); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	for _, m := range moved {
+		row := []string{
+			m.tree,
+			m.Taxon,
+			strconv.FormatInt(m.Age, 10),
+			strconv.Itoa(m.Pixel),
+			strconv.Itoa(m.Value),
+			strconv.Itoa(m.Nearest),
+			strconv.Itoa(m.NearestValue),
+			strconv.FormatFloat(m.Dist*earth.Radius/1000, 'f', 3, 64),
+		}
+		if err := tsv.Write(row); err != nil {
+			return fmt.Errorf("while writing data on %q: %v", name, err)
+		}
+	}
+
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
 	return nil
 }
 
+// ParseKernel returns the probability of a long-distance dispersal
+// per million years
+// of the kernel defined with the flag --kernel.
+func parseKernel() (float64, error) {
+	switch strings.ToLower(kernelFlag) {
+	case "normal":
+		return 0, nil
+	case "mixture":
+		if ldFlag <= 0 || ldFlag >= 1 {
+			return 0, fmt.Errorf("flag --ld: value must be between 0 and 1")
+		}
+		return ldFlag, nil
+	}
+	return 0, fmt.Errorf("flag --kernel: unknown kernel %q", kernelFlag)
+}
+
+// KernelName returns the name of the kernel,
+// and its parameters,
+// as used in the output file names.
+// The spherical normal kernel
+// is not included in the names.
+func kernelName(longDist float64) string {
+	if longDist == 0 {
+		return ""
+	}
+	return fmt.Sprintf("-mixture-%.6f", longDist)
+}
+
 func readTreeFile(name string) (*timetree.Collection, error) {
 	f, err := os.Open(name)
 	if err != nil {
@@ -259,6 +609,36 @@ func readRanges(name string) (*ranges.Collection, error) {
 	return coll, nil
 }
 
+func readAgeRanges(name string, pix *earth.Pixelation) (*agerange.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := agerange.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func readConstraints(name string, pix *earth.Pixelation) (*constraint.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := constraint.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
 func readStages(name string, rot *model.StageRot, landscape *model.TimePix) (timestage.Stages, error) {
 	stages := timestage.New()
 	stages.Add(rot)
@@ -291,7 +671,12 @@ func calcStandardDeviation(pix *earth.Pixelation, lambda float64) float64 {
 	return math.Sqrt(v) * earth.Radius / 1000
 }
 
-func writeTreeConditional(t *diffusion.Tree, name, p string, lambda, standard float64, numPix, eq int) (err error) {
+// WriteTreeConditional writes the conditional likelihoods
+// of the nodes of a tree.
+// If root is not negative,
+// only the oldest stage of the root
+// will be written.
+func writeTreeConditional(t *diffusion.Tree, name, p string, lambda, standard float64, numPix, eq, root int) (err error) {
 	f, err := os.Create(name)
 	if err != nil {
 		return err
@@ -303,12 +688,34 @@ func writeTreeConditional(t *diffusion.Tree, name, p string, lambda, standard fl
 		}
 	}()
 
-	w := bufio.NewWriter(f)
+	var w *bufio.Writer
+	if gzipFlag {
+		z := gzip.NewWriter(f)
+		defer func() {
+			e := z.Close()
+			if err == nil && e != nil {
+				err = e
+			}
+		}()
+		w = bufio.NewWriter(z)
+	} else {
+		w = bufio.NewWriter(f)
+	}
 	fmt.Fprintf(w, "# diff.like on tree %q of project %q\n", t.Name(), p)
 	fmt.Fprintf(w, "# lambda: %.6f * 1/radian^2\n", lambda)
 	fmt.Fprintf(w, "# standard deviation: %.6f * Km/My\n", standard)
+	if ld := t.LongDist(); ld > 0 {
+		fmt.Fprintf(w, "# kernel: mixture, long-distance dispersal: %.6f per My\n", ld)
+	}
+	if e := t.Engine(); e != diffusion.Convolution {
+		fmt.Fprintf(w, "# engine: %s\n", e)
+	}
 	fmt.Fprintf(w, "# logLikelihood: %.6f\n", t.LogLike())
+	if threshold > 0 {
+		fmt.Fprintf(w, "# threshold: %g\n", threshold)
+	}
 	fmt.Fprintf(w, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "# phygeo: %s\n", version.String())
 
 	tsv := csv.NewWriter(w)
 	tsv.Comma = '\t'
@@ -318,15 +725,34 @@ func writeTreeConditional(t *diffusion.Tree, name, p string, lambda, standard fl
 	}
 
 	nodes := t.Nodes()
+	if root >= 0 {
+		nodes = []int{root}
+	}
 	for _, n := range nodes {
 		stages := t.Stages(n)
+		if root >= 0 {
+			stages = stages[:1]
+		}
 		for _, a := range stages {
 			c := t.Conditional(n, a)
+			min := math.Inf(-1)
+			if threshold > 0 {
+				max := -math.MaxFloat64
+				for _, lk := range c {
+					if lk > max {
+						max = lk
+					}
+				}
+				min = max + math.Log(threshold)
+			}
 			for px := 0; px < numPix; px++ {
 				lk, ok := c[px]
 				if !ok {
 					continue
 				}
+				if lk < min {
+					continue
+				}
 				row := []string{
 					t.Name(),
 					strconv.Itoa(n),
@@ -353,3 +779,51 @@ func writeTreeConditional(t *diffusion.Tree, name, p string, lambda, standard fl
 	}
 	return nil
 }
+
+func writeStageLikes(dt *diffusion.Tree, t *timetree.Tree, name, p string, lambda float64) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if err == nil && e != nil {
+			err = e
+		}
+	}()
+
+	fmt.Fprintf(f, "# diff.like per-stage contributions on tree %q of project %q\n", t.Name(), p)
+	fmt.Fprintf(f, "# lambda: %.6f * 1/radian^2\n", lambda)
+	fmt.Fprintf(f, "# logLikelihood: %.6f\n", dt.LogLike())
+	fmt.Fprintf(f, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(f, "# phygeo: %s\n", version.String())
+
+	tsv := csv.NewWriter(f)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	if err := tsv.Write([]string{"tree", "node", "age", "taxon", "logLike"}); err != nil {
+		return err
+	}
+	for _, sl := range dt.StageLikes() {
+		var tax string
+		if t.IsTerm(sl.Node) {
+			tax = t.Taxon(sl.Node)
+		}
+		row := []string{
+			t.Name(),
+			strconv.Itoa(sl.Node),
+			strconv.FormatInt(sl.Age, 10),
+			tax,
+			strconv.FormatFloat(sl.LogLike, 'f', 6, 64),
+		}
+		if err := tsv.Write(row); err != nil {
+			return err
+		}
+	}
+
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,547 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package loo implements a command to evaluate
+// the influence of each terminal
+// in a biogeographic reconstruction
+// using a leave-one-out analysis.
+package loo
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/agerange"
+	"github.com/js-arias/phygeo/constraint"
+	"github.com/js-arias/phygeo/infer/diffusion"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/ranges"
+	"github.com/js-arias/timetree"
+	"gonum.org/v1/gonum/spatial/r3"
+)
+
+var Command = &command.Command{
+	Usage: `loo [--stem <age>] [--lambda <value>]
+	[--step <value>] [--stop <value>]
+	[--float32] [--cpu <number>] <project-file>`,
+	Short: "leave-one-out analysis of terminal influence",
+	Long: `
+Command loo reads a PhyGeo project, and for each tree, repeats the analysis
+removing each terminal in turn, to evaluate the influence of each terminal on
+the estimated lambda value and on the reconstruction of the root. Terminals
+with a large influence might indicate a misplaced record, or a terminal that
+requires a closer examination.
+
+The argument of the command is the name of the project file.
+
+By default, the maximum likelihood estimate of lambda is searched for the
+complete tree, and for each tree with a removed terminal, using the same hill
+climbing search of the command 'diff ml'. The search starts at a lambda value
+of zero, with an initial step of 100, that is reduced a 50% at each cycle, and
+stops when the step has a size of 1. Use the flag --step to change the initial
+step, and the flag --stop to set a different stop value. If the flag --lambda
+is defined, the lambda value will be fixed, and only the changes in the
+reconstruction of the root will be reported.
+
+The reconstruction of the root is the posterior probability of the pixels at
+the start of the stem branch (i.e., the oldest age of the reconstruction), in
+which the conditional likelihoods of the down-pass are combined with the pixel
+priors. To make the reconstructions comparable, the start of the stem branch
+is always at the same age, even if the removal of a terminal changes the age
+of the root. The location of the root is summarized by the centroid of the
+posterior (i.e., the mean of the pixel locations, weighted by their
+posterior), projected on the surface of the sphere.
+
+By default, a stem branch will be added to each tree using the 10% of the root
+age. To set a different stem age use the flag --stem, the value should be in
+million years.
+
+Trees with less than three terminals will be ignored.
+
+If the flag --float32 is given, the conditional likelihoods will be stored in
+single precision (with a rescaling constant for each time stage), and pixels
+with vanishing likelihoods will be ignored. Each stored value uses about a
+quarter less memory, so the savings are modest, and mostly come from the
+ignored pixels at high resolutions.
+
+By default, all available CPUs will be used in the processing. Set --cpu flag
+to use a different number of CPUs.
+
+The output is printed in the standard output, as a tab-delimited table with
+the following columns:
+
+	tree      the name of the tree
+	taxon     the removed terminal, "--" for the complete tree
+	lambda    the lambda value (in 1/radian^2)
+	delta     the change of lambda with respect to the complete tree
+	logLike   the log-likelihood of the reconstruction
+	lat       the latitude of the centroid of the root
+	lon       the longitude of the centroid of the root
+	distance  the distance, in kilometers, between the root centroid and
+	          the root centroid of the complete tree
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var float32Flag bool
+var lambdaFlag float64
+var stemAge float64
+var stepFlag float64
+var stopFlag float64
+var numCPU int
+
+func setFlags(c *command.Command) {
+	c.Flags().BoolVar(&float32Flag, "float32", false, "")
+	c.Flags().Float64Var(&lambdaFlag, "lambda", 0, "")
+	c.Flags().Float64Var(&stopFlag, "stop", 1, "")
+	c.Flags().Float64Var(&stepFlag, "step", 100, "")
+	c.Flags().Float64Var(&stemAge, "stem", 0, "")
+	c.Flags().IntVar(&numCPU, "cpu", runtime.GOMAXPROCS(0), "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if lambdaFlag < 0 {
+		return c.UsageError("flag --lambda: value must be greater than 0")
+	}
+	if stepFlag <= 0 || stopFlag <= 0 {
+		return c.UsageError("flags --step and --stop: values must be greater than 0")
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	tf := p.Path(project.Trees)
+	if tf == "" {
+		msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	tc, err := readTreeFile(tf)
+	if err != nil {
+		return err
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("paleolandscape not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	landscape, err := readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	rotF := p.Path(project.GeoMotion)
+	if rotF == "" {
+		msg := fmt.Sprintf("plate motion model not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	rot, err := readRotation(rotF, landscape.Pixelation())
+	if err != nil {
+		return err
+	}
+
+	stF := p.Path(project.Stages)
+	stages, err := readStages(stF, rot, landscape)
+	if err != nil {
+		return err
+	}
+
+	pwF := p.Path(project.PixWeight)
+	if pwF == "" {
+		msg := fmt.Sprintf("pixel weights not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	pw, err := readPixWeights(pwF)
+	if err != nil {
+		return err
+	}
+
+	rf := p.Path(project.Ranges)
+	rc, err := readRanges(rf)
+	if err != nil {
+		return err
+	}
+	var ar *agerange.Collection
+	if af := p.Path(project.AgeRanges); af != "" {
+		ar, err = readAgeRanges(af, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+	var cn *constraint.Collection
+	if cf := p.Path(project.Constraints); cf != "" {
+		cn, err = readConstraints(cf, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+
+	// check if all terminals have defined ranges
+	for _, tn := range tc.Names() {
+		t := tc.Tree(tn)
+		for _, term := range t.Terms() {
+			if !rc.HasTaxon(term) {
+				return fmt.Errorf("taxon %q of tree %q has no defined range", term, tn)
+			}
+		}
+	}
+
+	// Set the number of parallel processors
+	diffusion.SetCPU(numCPU)
+
+	dm, _ := earth.NewDistMatRingScale(landscape.Pixelation())
+
+	param := diffusion.Param{
+		Landscape:   landscape,
+		Rot:         rot,
+		DM:          dm,
+		PW:          pw,
+		Ranges:      rc,
+		AgeRanges:   ar,
+		Constraints: cn,
+		Stages:      stages.Stages(),
+		Cache:       diffusion.NewPDFCache(landscape.Pixelation()),
+		Float32:     float32Flag,
+	}
+
+	tsv := csv.NewWriter(c.Stdout())
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	if err := tsv.Write([]string{"tree", "taxon", "lambda", "delta", "logLike", "lat", "lon", "distance"}); err != nil {
+		return err
+	}
+
+	for _, tn := range tc.Names() {
+		t := tc.Tree(tn)
+		terms := t.Terms()
+		if len(terms) < 3 {
+			fmt.Fprintf(c.Stderr(), "WARNING: tree %q: ignored: only %d terminals\n", tn, len(terms))
+			continue
+		}
+
+		stem := int64(stemAge * 1_000_000)
+		if stem == 0 {
+			stem = t.Age(t.Root()) / 10
+		}
+		oldest := t.Age(t.Root()) + stem
+
+		full := analyze(t, param, oldest)
+		if err := full.write(tsv, tn, "--", full); err != nil {
+			return err
+		}
+
+		for _, term := range terms {
+			pt := prune(t, term)
+			r := analyze(pt, param, oldest)
+			if err := r.write(tsv, tn, term, full); err != nil {
+				return err
+			}
+		}
+		tsv.Flush()
+	}
+
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return fmt.Errorf("while writing on standard output: %v", err)
+	}
+	return nil
+}
+
+// Result is the result of an analysis.
+type result struct {
+	lambda   float64
+	logLike  float64
+	centroid r3.Vec
+}
+
+// Analyze returns the lambda value,
+// the log-likelihood,
+// and the centroid of the root
+// of a tree.
+func analyze(t *timetree.Tree, p diffusion.Param, oldest int64) result {
+	p.Stem = oldest - t.Age(t.Root())
+
+	r := result{
+		lambda:  lambdaFlag,
+		logLike: -math.MaxFloat64,
+	}
+	if lambdaFlag > 0 {
+		p.Lambda = lambdaFlag
+		df := diffusion.New(t, p)
+		r.logLike = df.DownPass()
+	} else {
+		r.first(t, p, stepFlag)
+		for step := stepFlag / 2; ; step = step / 2 {
+			r.search(t, p, step)
+			if step < stopFlag {
+				break
+			}
+		}
+	}
+
+	p.Lambda = r.lambda
+	df := diffusion.New(t, p)
+	df.DownPass()
+	r.centroid = centroid(df.Conditional(t.Root(), oldest), p.Landscape.Pixelation())
+	return r
+}
+
+func (r *result) first(t *timetree.Tree, p diffusion.Param, step float64) {
+	// go up
+	upOK := false
+	for l := r.lambda + step; ; l += step {
+		p.Lambda = l
+		df := diffusion.New(t, p)
+		like := df.DownPass()
+		if like < r.logLike {
+			break
+		}
+		r.lambda = l
+		r.logLike = like
+		upOK = true
+	}
+	// we found an improvement
+	if upOK {
+		return
+	}
+
+	// go down
+	for l := r.lambda - step; l > 0; l -= step {
+		p.Lambda = l
+		df := diffusion.New(t, p)
+		like := df.DownPass()
+		if like < r.logLike {
+			return
+		}
+		r.lambda = l
+		r.logLike = like
+	}
+}
+
+// Search go one step up and one step down
+// to see if the likelihood improves.
+func (r *result) search(t *timetree.Tree, p diffusion.Param, step float64) {
+	// go up
+	p.Lambda = r.lambda + step
+	df := diffusion.New(t, p)
+	like := df.DownPass()
+	if like > r.logLike {
+		r.lambda = p.Lambda
+		r.logLike = like
+		return
+	}
+
+	// go down
+	if r.lambda <= step {
+		return
+	}
+	p.Lambda = r.lambda - step
+	df = diffusion.New(t, p)
+	like = df.DownPass()
+	if like > r.logLike {
+		r.lambda = p.Lambda
+		r.logLike = like
+	}
+}
+
+func (r result) write(tsv *csv.Writer, tree, taxon string, full result) error {
+	pt := earth.NewPoint(
+		earth.ToDegree(math.Asin(r.centroid.Z)),
+		earth.ToDegree(math.Atan2(r.centroid.Y, r.centroid.X)),
+	)
+	fp := earth.NewPoint(
+		earth.ToDegree(math.Asin(full.centroid.Z)),
+		earth.ToDegree(math.Atan2(full.centroid.Y, full.centroid.X)),
+	)
+	d := earth.Distance(pt, fp) * earth.Radius / 1000
+
+	row := []string{
+		tree,
+		taxon,
+		strconv.FormatFloat(r.lambda, 'f', 6, 64),
+		strconv.FormatFloat(r.lambda-full.lambda, 'f', 6, 64),
+		strconv.FormatFloat(r.logLike, 'f', 6, 64),
+		strconv.FormatFloat(pt.Latitude(), 'f', 6, 64),
+		strconv.FormatFloat(pt.Longitude(), 'f', 6, 64),
+		strconv.FormatFloat(d, 'f', 3, 64),
+	}
+	return tsv.Write(row)
+}
+
+// Prune returns a copy of a tree
+// without the indicated terminal.
+func prune(t *timetree.Tree, term string) *timetree.Tree {
+	pt := t.SubTree(t.Root(), t.Name())
+	id, ok := pt.TaxNode(term)
+	if !ok {
+		return pt
+	}
+	pt.Delete(id)
+	pt.Format()
+	return pt
+}
+
+// Centroid returns the centroid
+// of a conditional likelihood map,
+// as a unit vector.
+func centroid(logLike map[int]float64, pix *earth.Pixelation) r3.Vec {
+	max := -math.MaxFloat64
+	for _, p := range logLike {
+		if p > max {
+			max = p
+		}
+	}
+
+	var v r3.Vec
+	for px, p := range logLike {
+		w := math.Exp(p - max)
+		v = r3.Add(v, r3.Scale(w, pix.ID(px).Point().Vector()))
+	}
+	if r3.Norm(v) == 0 {
+		return v
+	}
+	return r3.Unit(v)
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readRotation(name string, pix *earth.Pixelation) (*model.StageRot, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rot, err := model.ReadStageRot(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return rot, nil
+}
+
+func readStages(name string, rot *model.StageRot, landscape *model.TimePix) (timestage.Stages, error) {
+	stages := timestage.New()
+	stages.Add(rot)
+	stages.Add(landscape)
+
+	if name == "" {
+		return stages, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := timestage.Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+	stages.Add(st)
+
+	return stages, nil
+}
+
+func readPixWeights(name string) (pixweight.Pixel, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pw, err := pixweight.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return pw, nil
+}
+
+func readRanges(name string) (*ranges.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := ranges.ReadTSV(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func readAgeRanges(name string, pix *earth.Pixelation) (*agerange.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := agerange.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func readConstraints(name string, pix *earth.Pixelation) (*constraint.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := constraint.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
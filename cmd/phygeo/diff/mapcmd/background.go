@@ -0,0 +1,74 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package mapcmd
+
+import (
+	"fmt"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// ParseColor parses a color definition.
+// A color can be defined as "R,G,B",
+// "R,G,B,A",
+// a hexadecimal value ("#rrggbb" or "#rrggbbaa"),
+// or "none" (or "transparent")
+// for a fully transparent color.
+func parseColor(s string) (color.Color, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "none" || s == "transparent" {
+		return color.RGBA{}, nil
+	}
+
+	var v []uint8
+	if strings.HasPrefix(s, "#") {
+		h := strings.TrimPrefix(s, "#")
+		if len(h) != 6 && len(h) != 8 {
+			return nil, fmt.Errorf("invalid color %q", s)
+		}
+		for i := 0; i < len(h); i += 2 {
+			c, err := strconv.ParseUint(h[i:i+2], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid color %q: %v", s, err)
+			}
+			v = append(v, uint8(c))
+		}
+	} else {
+		f := strings.Split(s, ",")
+		if len(f) != 3 && len(f) != 4 {
+			return nil, fmt.Errorf("invalid color %q: expecting three or four values", s)
+		}
+		for _, cv := range f {
+			c, err := strconv.ParseUint(strings.TrimSpace(cv), 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid color %q: %v", s, err)
+			}
+			v = append(v, uint8(c))
+		}
+	}
+	if len(v) == 3 {
+		return color.RGBA{v[0], v[1], v[2], 255}, nil
+	}
+	return color.NRGBA{v[0], v[1], v[2], v[3]}, nil
+}
+
+// ParseTransparent returns the landscape values
+// defined in the --transparent flag.
+func parseTransparent(s string) (map[int]bool, error) {
+	tr := make(map[int]bool)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		lv, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid landscape value %q: %v", v, err)
+		}
+		tr[lv] = true
+	}
+	return tr, nil
+}
@@ -0,0 +1,105 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package mapcmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/js-arias/phygeo/bundle"
+	"github.com/js-arias/phygeo/internal/input"
+	"github.com/js-arias/phygeo/pixkey"
+	"github.com/js-arias/phygeo/project"
+)
+
+// Bndl is the reconstruction bundle
+// used instead of a project file.
+var bndl *bundle.Bundle
+
+// OpenProject reads a project file,
+// or the project stored in a reconstruction bundle.
+func openProject(name string) (*project.Project, error) {
+	if !bundle.Is(name) {
+		return project.Read(name)
+	}
+
+	b, err := bundle.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	bndl = b
+	return b.Project(), nil
+}
+
+// CloseBundle closes the reconstruction bundle,
+// if it is open.
+func closeBundle() {
+	if bndl == nil {
+		return
+	}
+	bndl.Close()
+	bndl = nil
+}
+
+// BundleInput returns the name of the reconstruction
+// stored in the bundle,
+// if the bundle has a single reconstruction.
+func bundleInput() (string, error) {
+	if bndl == nil {
+		return "", fmt.Errorf("expecting input file, flag --input")
+	}
+	recs := bndl.Recs()
+	if len(recs) != 1 {
+		return "", fmt.Errorf("bundle with %d reconstructions: expecting input file, flag --input", len(recs))
+	}
+	return path.Base(recs[0]), nil
+}
+
+// OpenFile opens a dataset file,
+// either from the reconstruction bundle,
+// or from the file system.
+func openFile(name string) (io.ReadCloser, error) {
+	if bndl != nil {
+		return bndl.Open(name)
+	}
+	return os.Open(name)
+}
+
+// OpenRecFile opens a reconstruction file.
+// If the reconstruction is stored in the bundle,
+// it will be read from the bundle,
+// otherwise it will be read from the file system.
+// If the file is compressed with gzip,
+// it will be decompressed.
+func openRecFile(name string) (io.ReadCloser, error) {
+	if bndl != nil {
+		if rn, ok := bndl.Rec(name); ok {
+			f, err := bndl.Open(rn)
+			if err != nil {
+				return nil, err
+			}
+			return input.NewReader(f)
+		}
+	}
+	return input.Open(name, nil)
+}
+
+// ReadBundleKey reads the color key
+// stored in the bundle.
+func readBundleKey() (*pixkey.PixKey, error) {
+	f, err := bndl.Open(bndl.Key())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys, err := pixkey.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("on bundle key: %v", err)
+	}
+	return keys, nil
+}
@@ -0,0 +1,128 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package mapcmd
+
+import (
+	"fmt"
+	"math"
+)
+
+// DiffRec returns the signed difference
+// between two reconstructions.
+//
+// The values of each time stage of each node
+// are normalized so they sum to 1
+// and the difference (a - b)
+// is scaled by the maximum absolute difference
+// of the stage.
+// As the maps only draw pixels with a positive value,
+// the scaled difference is stored as (1 + d)/2,
+// so no difference is at 0.5
+// and the midpoint of a diverging color scale.
+//
+// Only the stages present in both reconstructions
+// are kept.
+func diffRec(a, b map[string]*recTree) (map[string]*recTree, error) {
+	for _, t := range a {
+		if t.tp == "kde" {
+			return nil, fmt.Errorf("flag --diff: KDE reconstructions are not supported")
+		}
+		bt, ok := b[t.name]
+		if !ok {
+			return nil, fmt.Errorf("flag --diff: tree %q not found", t.name)
+		}
+		if bt.tp == "kde" {
+			return nil, fmt.Errorf("flag --diff: KDE reconstructions are not supported")
+		}
+	}
+
+	rt := make(map[string]*recTree, len(a))
+	for _, t := range a {
+		bt := b[t.name]
+		dt := &recTree{
+			name:  t.name,
+			nodes: make(map[int]*recNode, len(t.nodes)),
+			tp:    t.tp,
+		}
+		for _, n := range t.nodes {
+			bn, ok := bt.nodes[n.id]
+			if !ok {
+				continue
+			}
+			dn := &recNode{
+				id:     n.id,
+				tree:   dt,
+				stages: make(map[int64]*recStage, len(n.stages)),
+			}
+			for _, s := range n.stages {
+				bs, ok := bn.stages[s.age]
+				if !ok {
+					continue
+				}
+				dn.stages[s.age] = &recStage{
+					node: dn,
+					age:  s.age,
+					rec:  diffStage(s.rec, bs.rec),
+				}
+			}
+			if len(dn.stages) == 0 {
+				continue
+			}
+			dt.nodes[n.id] = dn
+		}
+		rt[t.name] = dt
+	}
+	return rt, nil
+}
+
+// DiffStage returns the scaled difference
+// between two pixel reconstructions.
+func diffStage(a, b map[int]float64) map[int]float64 {
+	pa := normalize(a)
+	pb := normalize(b)
+
+	diff := make(map[int]float64, len(pa))
+	var max float64
+	for px, p := range pa {
+		diff[px] = p - pb[px]
+	}
+	for px, p := range pb {
+		if _, ok := pa[px]; ok {
+			continue
+		}
+		diff[px] = -p
+	}
+	for _, d := range diff {
+		max = math.Max(max, math.Abs(d))
+	}
+
+	for px, d := range diff {
+		if max > 0 {
+			d = d / max
+		}
+		v := (1 + d) / 2
+		if v <= 0 {
+			// keep the pixel on the map
+			v = math.SmallestNonzeroFloat64
+		}
+		diff[px] = v
+	}
+	return diff
+}
+
+func normalize(rec map[int]float64) map[int]float64 {
+	var sum float64
+	for _, p := range rec {
+		sum += p
+	}
+	n := make(map[int]float64, len(rec))
+	if sum == 0 {
+		return n
+	}
+	for px, p := range rec {
+		n[px] = p / sum
+	}
+	return n
+}
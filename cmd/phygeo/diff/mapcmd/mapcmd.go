@@ -11,10 +11,12 @@ import (
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	"image/png"
 	"io"
 	"math"
 	"os"
+	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
@@ -22,32 +24,78 @@ import (
 	"github.com/js-arias/command"
 	"github.com/js-arias/earth"
 	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/clade"
+	"github.com/js-arias/phygeo/internal/input"
 	"github.com/js-arias/phygeo/pixkey"
 	"github.com/js-arias/phygeo/probmap"
 	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/timetree"
 )
 
 var Command = &command.Command{
 	Usage: `map [-c|--columns <value>]
 	[--key <key-file>] [--gray] [--scale <color-scale>]
-	[--bound <value>] [--richness]
+	[--bg <color>] [--land-alpha <value>] [--transparent <values>]
+	[--relief <elevation-file>] [--exaggeration <value>]
+	[--range-alpha <value>]
+	[--bound <value>] [--sets <levels>] [--richness] [--clade <terminals>] [--extinct <mode>]
 	[--unrot] [--present] [--contour <image-file>]
-	[--recent] [--trees <tree-list>] [--nodes <node-list>]
-	-i|--input <file> [-o|--output <file-prefix>] <project-file>`,
+	[--points <taxon>] [--paths <particle-file>] [--max-paths <number>]
+	[--path-scale <color-scale>] [--recent] [--trees <tree-list>] [--nodes <node-list>]
+	[--post-split <mode>] [--tiles <zoom>] [--strip]
+	[--name-template <template>] [--diff <file>]
+	[-i|--input <file>] [-o|--output <file-prefix>] <project-file>`,
 	Short: "draw a map reconstruction",
 	Long: `
 Command map reads a file with a probability reconstruction for the nodes of
 one or more trees in a project and draws the reconstruction as an image map
 using a plate carrée (equirectangular) projection.
 
-The argument of the command is the name of the project file.
+The argument of the command is the name of the project file. It can also be
+a reconstruction bundle built with the command 'diff bundle'; in that case,
+all the datasets (and the color key, if the flag --key is not defined) will be
+read from the bundle.
 
-The flag --input, or -i, is required and indicates the input file. The input
-file is a pixel probability file.
+The flag --input, or -i, indicates the input file. The input file is a pixel
+probability file. If the input is "-", the file will be read from the standard
+input; in that case, if no output prefix is given, the prefix "map" will be
+used. The flag is required, unless a bundle with a single reconstruction is
+used. If a bundle is used, the input file (and the particles file of the flag
+--paths) will be searched first in the bundle, using the base name of the
+file.
 
 By default, when reading a KDE reconstruction, it will only map the pixels in
 the 0.95 of the CDF. Use the flag --bound to change this bound value.
 
+If the flag --sets is defined with a list of credible levels, separated by
+commas (for example "0.5,0.95"), instead of the probability values, the maps
+will show the credible set membership of each pixel, that is, the pixels
+inside the smallest set, the pixels inside each larger set, and the pixels
+outside all the sets (drawn with the landscape colors). In a KDE
+reconstruction, the sets are taken from the CDF (and the flag --bound is
+ignored); otherwise, the sets are built adding pixels, from the most to the
+least probable, until the level is reached. These are the same sets written
+by the command 'diff freq' with the flag --sets. The colors of the sets are
+taken from the color scale: with n levels, the k-th set (starting from 0,
+the smallest set) uses the color at 1 - k/n of the scale, so with the
+default scale and the levels "0.5,0.95", the 50% set will be red, and the
+95% set will be green. The flag --sets is ignored in richness maps.
+
+If the flag --diff is defined with a second pixel probability file (for
+example, a reconstruction of the same trees using a different landscape
+hypothesis), the maps will show the signed difference between the input
+reconstruction and the indicated file. For each node and time stage, the
+values of both reconstructions are normalized to sum 1, and the difference
+(input minus the --diff file) is scaled by the maximum absolute difference of
+that map, so each map uses the full range of the color scale. The difference
+is drawn using the diverging sunset color scale of Paul Tol
+<https://personal.sron.nl/~pault/#fig:scheme_sunset>, in which pixels more
+probable in the input are red, pixels more probable in the --diff file are
+blue, and pixels without difference are pale yellow; the flag --scale is
+ignored. Only the trees, nodes, and time stages present in both files will be
+drawn. KDE reconstructions cannot be compared, and the flags --sets and
+--richness cannot be used with --diff.
+
 By default, the reconstructions will be mapped using their respective time
 stages. If the flag --unrot is given, then the reconstructions will be drawn
 at the present time. By default, the landscape of the time stage will be used
@@ -57,6 +105,26 @@ given image will be used as a contour of the output map. The contour map will
 set the size of the output image and should be fully transparent, except for
 the contour, which will always be drawn in black.
 
+If the flag --points is defined with the name of a taxon, the records of that
+taxon in the project's distribution ranges will be drawn as white circles over
+each map. If the value is "all", the records of all the terminals will be
+drawn. The records are rotated to the time stage of each map (or to the
+present, if the flag --unrot is given), and only the records of the terminals
+that are alive at the age of the map will be drawn.
+
+If the flag --paths is defined with a particles file (for example, the output
+of the command 'diff particles'), the trajectories of the particles will be
+drawn over each map as thin great-circle polylines between the start and end
+pixels of each time stage. For each node, the drawn trajectories are the
+movements of the lineage of the node, from the root up to the age of the map,
+rotated to the time stage of the map (or to the present, if the flag --unrot
+is given). By default, only the first 100 particles of each tree will be
+drawn; use the flag --max-paths to change this number. The paths are colored
+by their age, using the incandescent color scale (the oldest paths at the
+start of the scale); use the flag --path-scale to set a different color scale
+(using the same values of the flag --scale). Paths are not drawn in richness
+maps.
+
 By default, it will output the results of each node. If the flag --recent is
 defined, only the most recent time stage for each node (i.e., splits and
 terminals) will be used for output. If the flag trees is defined, only the
@@ -64,7 +132,32 @@ indicated trees will be used for output, the format is the tree names
 separated by commas, for example "tree-1,tree-2" will produce maps for nodes
 on trees tree-1 and tree-2. If the flag --nodes is defined, only the indicated
 nodes will be used for output, the format is the node IDs separated by commas,
-for example "0,1,6,10" will produce maps for nodes 0, 1, 6 and 10.
+for example "0,1,6,10" will produce maps for nodes 0, 1, 6 and 10. The list
+can also include clade labels defined in the project (see 'phygeo tree
+label'), for example "0,felids"; a label is resolved in each tree as the most
+recent common ancestor of its terminals.
+
+If the flag --strip is defined, instead of an image for each time stage, all
+the time stages of a node will be drawn side by side in a single image, from
+the oldest (at the left) to the youngest stage (at the right), with the age of
+each stage, in million years, above its map. The flag --columns defines the
+width of each map of the strip. As all the maps of the strip are kept in a
+single image, use a small number of columns (e.g., 1200) for nodes with many
+time stages. The flag --strip cannot be used with --richness or --tiles.
+
+In a pixel probability file, each node (except the root) has a post-split
+stage, at the age of the split of its parent node, that duplicates the split
+stage of the parent. The flag --post-split defines how these stages are
+treated. Valid values are:
+
+	skip   the post-split stages are ignored (the default)
+	merge  the post-split stage is drawn as the split stage of the parent
+	       node, if the parent does not have a reconstruction at that age
+	       (for example, if the file only contains some nodes)
+	keep   the post-split stages are drawn as stages of the node
+
+Except with the value "keep", the trees of the project are required to
+identify the post-split stages.
 
 If the flag --richness is defined, then it will output the relative richness
 over time, that is, the number of lineages alive at the end of each time
@@ -72,15 +165,95 @@ stage. This number is calculated using the scaled pixel values of each node
 alive at each time (so each pixel can add a number between 1 and 0). For each
 map, the output is scaled to the maximum value at that time stage.
 
+By default, all the lineages are used for the richness maps. The flags --trees
+and --nodes can be used to restrict the richness to the indicated trees and
+nodes. The flag --clade restricts the richness to the lineages of a clade,
+defined by the most recent common ancestor of a list of terminals separated by
+commas, for example "Panthera leo,Felis catus" will use the lineages of the
+clade of felids (including the lineage of the ancestor). Only the trees that
+contain all the terminals of the clade will be used. With these flags, the
+richness of different groups of lineages can be compared, for example,
+lineages of two different clades through time.
+
+Lineages of extinct terminals (i.e., terminals with an age older than the
+present) are always drawn up to the age of the terminal (i.e., its last
+appearance). The flag --extinct defines how the extinct lineages are treated
+in richness maps. Valid values are:
+
+	include  all lineages are used (the default)
+	exclude  lineages in which all descendants are extinct (i.e., extinct
+	         terminals and extinct subclades) are ignored, so the richness
+	         only includes the lineages with extant descendants
+	weight   each lineage is weighted by its survival probability,
+	         estimated as the fraction of its descendant terminals that
+	         are extant
+
+With the values "exclude" and "weight", the trees of the project are
+required.
+
 By default, the output image will have the input file name as a prefix. To
 change the prefix, use the flag --output or -o. The suffix of the file will be
 the tree name, the node ID, and the time stage.
 
+The flag --name-template can be used to define a different naming convention
+for the output files. The template is a string in which the following fields
+will be replaced:
+
+	{prefix}  the output prefix (by default, the input file name)
+	{proj}    the project file name, without the extension
+	{tree}    the tree name
+	{node}    the node ID
+	{age}     the time stage age, in million years (or "strip", with the
+	          flag --strip)
+
+For example, the template "{proj}/{tree}/{node}-{age}" will write the maps of
+each node in a directory with the name of the tree (that must exist). If the
+template does not end with ".png", the extension will be added. If more than
+one node of a tree is mapped, the template must include the field {node}.
+When used with --richness, the fields {tree} and {node} will be empty.
+
 By default, the resulting image will be 3600 pixels wide. Use the flag
---column, or -c, to define a different number of columns. By default, the
+--column, or -c, to define a different number of columns. The image is
+encoded row by row, and the hillshade of the relief (see below) is calculated
+in bands of rows, so the memory used is bounded regardless of the number of
+columns.
+
+If the flag --tiles is defined with a zoom level, instead of a single image,
+each map will be written as a set of tiles of 256x256 pixels, that can be used
+in a web map. The tiles use a geodetic tiling scheme (EPSG:4326, i.e., the
+plate carrée projection used for the images), in which the zoom level 0 has
+two tiles (one for each hemisphere), and the number of tiles on each axis is
+doubled at each zoom level. All the zoom levels, from 0 to the indicated zoom
+level, will be written in a directory with the name of the output file
+(without the extension) using the layout "{z}/{x}/{y}.png", with the tile 0,0
+at the north-west corner. As the size of the tiles is fixed, the flags
+--columns and --contour are ignored. By default, the
 images will have a gray background. Use the flag --key to define the landscape
 colors of the image. If the flag --gray is set, then gray colors will be used.
 
+Use the flag --bg to define the color used for the landscape pixels without a
+color in the color key (or for all pixels, if no key is given). The color can
+be defined as "R,G,B", "R,G,B,A" (e.g., "32,32,32" for a dark background), as
+a hexadecimal value (e.g., "#202020"), or as "none" for a fully transparent
+background. The flag --land-alpha sets the opacity of the landscape colors, a
+value between 0 (transparent) and 1 (opaque, the default). The flag
+--transparent defines a list of landscape values, separated by commas, whose
+pixels will be fully transparent; for example, "0" will draw a transparent
+ocean (if the value 0 is used for the ocean in the landscape model). The
+reconstructed ranges are always drawn opaque, so these flags can be used to
+compose the maps over dark slides or as layers of a figure.
+
+If the flag --relief is defined with an elevation model, a hillshade
+calculated from the elevation values will be drawn over the landscape colors,
+and the reconstructed ranges will be blended over the shaded landscape. The
+elevation model is a time pixelation file (the same format used for the
+landscape), with the elevation of each pixel in meters, and must use the same
+pixelation as the landscape. The flag --exaggeration sets the vertical
+exaggeration of the relief; by default it is 20, as the relief is barely
+visible at global scales without exaggeration. The flag --range-alpha sets
+the opacity of the range colors over the relief, a value between 0 and 1 (by
+default, 0.7).
+
 By default, a rainbow color scale will be used, other color scales can be
 defined using the --scale flag. Valid scale values are mostly based on Paul
 Tol color scales:
@@ -103,15 +276,33 @@ var unRot bool
 var present bool
 var richnessFlag bool
 var recentFlag bool
+var stripFlag bool
 var colsFlag int
 var bound float64
 var treesFlag string
 var nodesFlag string
 var contourFile string
+var pointsFlag string
+var pathsFile string
+var maxPaths int
+var pathScale string
 var keyFile string
+var bgFlag string
+var landAlpha float64
+var transFlag string
 var inputFile string
 var outPrefix string
 var scale string
+var reliefFile string
+var exaggeration float64
+var rangeAlpha float64
+var nameTemplate string
+var postSplitFlag string
+var cladeFlag string
+var tilesFlag int
+var extinctFlag string
+var setsFlag string
+var diffFile string
 
 func setFlags(c *command.Command) {
 	c.Flags().BoolVar(&grayFlag, "gray", false, "")
@@ -119,10 +310,15 @@ func setFlags(c *command.Command) {
 	c.Flags().BoolVar(&present, "present", false, "")
 	c.Flags().BoolVar(&richnessFlag, "richness", false, "")
 	c.Flags().BoolVar(&recentFlag, "recent", false, "")
+	c.Flags().BoolVar(&stripFlag, "strip", false, "")
 	c.Flags().IntVar(&colsFlag, "columns", 3600, "")
 	c.Flags().IntVar(&colsFlag, "c", 3600, "")
 	c.Flags().Float64Var(&bound, "bound", 0.95, "")
+	c.Flags().StringVar(&setsFlag, "sets", "", "")
 	c.Flags().StringVar(&keyFile, "key", "", "")
+	c.Flags().StringVar(&bgFlag, "bg", "", "")
+	c.Flags().Float64Var(&landAlpha, "land-alpha", 1, "")
+	c.Flags().StringVar(&transFlag, "transparent", "", "")
 	c.Flags().StringVar(&nodesFlag, "nodes", "", "")
 	c.Flags().StringVar(&treesFlag, "trees", "", "")
 	c.Flags().StringVar(&inputFile, "input", "", "")
@@ -130,21 +326,103 @@ func setFlags(c *command.Command) {
 	c.Flags().StringVar(&outPrefix, "output", "", "")
 	c.Flags().StringVar(&outPrefix, "o", "", "")
 	c.Flags().StringVar(&contourFile, "contour", "", "")
+	c.Flags().StringVar(&pointsFlag, "points", "", "")
+	c.Flags().StringVar(&pathsFile, "paths", "", "")
+	c.Flags().IntVar(&maxPaths, "max-paths", 100, "")
+	c.Flags().StringVar(&pathScale, "path-scale", "incandescent", "")
 	c.Flags().StringVar(&scale, "scale", "rainbow", "")
+	c.Flags().StringVar(&reliefFile, "relief", "", "")
+	c.Flags().Float64Var(&exaggeration, "exaggeration", 20, "")
+	c.Flags().Float64Var(&rangeAlpha, "range-alpha", probmap.DefaultRangeAlpha, "")
+	c.Flags().StringVar(&nameTemplate, "name-template", "", "")
+	c.Flags().StringVar(&postSplitFlag, "post-split", postSkip, "")
+	c.Flags().StringVar(&cladeFlag, "clade", "", "")
+	c.Flags().IntVar(&tilesFlag, "tiles", -1, "")
+	c.Flags().StringVar(&extinctFlag, "extinct", extInclude, "")
+	c.Flags().StringVar(&diffFile, "diff", "", "")
 }
 
 func run(c *command.Command, args []string) error {
 	if len(args) < 1 {
 		return c.UsageError("expecting project file")
 	}
-	if inputFile == "" {
-		return c.UsageError("expecting input file, flag --input")
+
+	postMode, err := parsePostSplit(postSplitFlag)
+	if err != nil {
+		return c.UsageError(fmt.Sprintf("flag --post-split: %v", err))
+	}
+
+	if diffFile != "" {
+		if richnessFlag {
+			return c.UsageError("flag --diff: cannot be used with --richness")
+		}
+		if setsFlag != "" {
+			return c.UsageError("flag --diff: cannot be used with --sets")
+		}
+		if diffFile == "-" && inputFile == "-" {
+			return c.UsageError("flag --diff: standard input already used by the input file")
+		}
 	}
 
-	p, err := project.Read(args[0])
+	if stripFlag {
+		if richnessFlag {
+			return c.UsageError("flag --strip: cannot be used with --richness")
+		}
+		if tilesFlag >= 0 {
+			return c.UsageError("flag --strip: cannot be used with --tiles")
+		}
+	}
+
+	var levels []float64
+	if setsFlag != "" && !richnessFlag {
+		levels, err = parseLevels(setsFlag)
+		if err != nil {
+			return c.UsageError(err.Error())
+		}
+		// keep all the pixels of the largest set
+		bound = levels[len(levels)-1]
+	}
+
+	p, err := openProject(args[0])
 	if err != nil {
 		return err
 	}
+	defer closeBundle()
+
+	if inputFile == "" {
+		inputFile, err = bundleInput()
+		if err != nil {
+			return c.UsageError(err.Error())
+		}
+	}
+
+	var tc *timetree.Collection
+	if postMode != postKeep || pathsFile != "" || cladeFlag != "" || nodesFlag != "" || !strings.EqualFold(extinctFlag, extInclude) {
+		tf := p.Path(project.Trees)
+		if tf == "" {
+			msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+			return c.UsageError(msg)
+		}
+		tc, err = readTreeFile(tf)
+		if err != nil {
+			return err
+		}
+	}
+
+	var nodes map[string][]int
+	if nodesFlag != "" {
+		var labels *clade.Collection
+		if lf := p.Path(project.Clades); lf != "" {
+			labels, err = readLabels(lf)
+			if err != nil {
+				return err
+			}
+		}
+		nodes, err = parseNodes(tc, labels)
+		if err != nil {
+			return c.UsageError(err.Error())
+		}
+	}
 
 	lsf := p.Path(project.Landscape)
 	if lsf == "" {
@@ -156,8 +434,40 @@ func run(c *command.Command, args []string) error {
 		return err
 	}
 
+	var bg color.Color
+	if bgFlag != "" {
+		bg, err = parseColor(bgFlag)
+		if err != nil {
+			return c.UsageError(fmt.Sprintf("flag --bg: %v", err))
+		}
+	}
+	if landAlpha < 0 || landAlpha > 1 {
+		return c.UsageError("flag --land-alpha: value must be between 0 and 1")
+	}
+	var transparent map[int]bool
+	if transFlag != "" {
+		transparent, err = parseTransparent(transFlag)
+		if err != nil {
+			return c.UsageError(fmt.Sprintf("flag --transparent: %v", err))
+		}
+	}
+
+	var relief *model.TimePix
+	if reliefFile != "" {
+		if exaggeration <= 0 {
+			return c.UsageError("flag --exaggeration: value must be greater than 0")
+		}
+		if rangeAlpha <= 0 || rangeAlpha > 1 {
+			return c.UsageError("flag --range-alpha: value must be between 0 and 1")
+		}
+		relief, err = readRelief(reliefFile, landscape)
+		if err != nil {
+			return err
+		}
+	}
+
 	var contour image.Image
-	if contourFile != "" {
+	if contourFile != "" && tilesFlag < 0 {
 		contour, err = readContour(contourFile)
 		if err != nil {
 			return err
@@ -181,33 +491,64 @@ func run(c *command.Command, args []string) error {
 		}
 	}
 
+	var points *pointSet
+	if pointsFlag != "" {
+		rf := p.Path(project.Ranges)
+		if rf == "" {
+			msg := fmt.Sprintf("distribution ranges not defined in project %q", args[0])
+			return c.UsageError(msg)
+		}
+		coll, err := readRanges(rf)
+		if err != nil {
+			return err
+		}
+
+		rotF := p.Path(project.GeoMotion)
+		if rotF == "" {
+			msg := fmt.Sprintf("plate motion model not defined in project %q", args[0])
+			return c.UsageError(msg)
+		}
+		rot, err := readStageRot(rotF, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+
+		points, err = newPointSet(coll, rot, pointsFlag)
+		if err != nil {
+			return c.UsageError(err.Error())
+		}
+	}
+
 	var keys *pixkey.PixKey
 	if keyFile != "" {
 		keys, err = pixkey.Read(keyFile)
 		if err != nil {
 			return err
 		}
-		if grayFlag && !keys.HasGrayScale() {
-			keys = nil
+	} else if bndl != nil && bndl.Key() != "" {
+		keys, err = readBundleKey()
+		if err != nil {
+			return err
 		}
 	}
-	var gradient probmap.Gradienter
-	switch strings.ToLower(scale) {
-	case "gray":
-		gradient = probmap.HalfGrayScale{}
-	case "rainbow":
-		gradient = probmap.RainbowPurpleToRed{}
-	case "incandescent":
-		gradient = probmap.Incandescent{}
-	case "iridescent":
-		gradient = probmap.Iridescent{}
+	if keys != nil && grayFlag && !keys.HasGrayScale() {
+		keys = nil
+	}
+	if landAlpha == 0 {
+		// a fully transparent landscape
+		keys = nil
+		bg = color.RGBA{}
 	}
+	gradient := getGradient(scale)
 
 	if richnessFlag {
 		if outPrefix == "" {
 			outPrefix = "richness-" + inputFile
+			if inputFile == "-" {
+				outPrefix = "richness"
+			}
 		}
-		stages, err := richnessOnTime(landscape)
+		stages, err := richnessOnTime(c.Stdin(), landscape, tc, nodes, postMode)
 		if err != nil {
 			return err
 		}
@@ -216,6 +557,9 @@ func run(c *command.Command, args []string) error {
 		for _, st := range stages {
 			age := float64(st.age) / 1_000_000
 			out := fmt.Sprintf("%s-%.3f.png", outPrefix, age)
+			if nameTemplate != "" {
+				out = outName(args[0], "", -1, strconv.FormatFloat(age, 'f', 3, 64))
+			}
 
 			pm := &probmap.Image{
 				Cols:      colsFlag,
@@ -227,10 +571,19 @@ func run(c *command.Command, args []string) error {
 				Present:   present,
 				Gray:      grayFlag,
 				Gradient:  gradient,
-			}
-			pm.Format(tot)
 
-			if err := writeImage(out, pm); err != nil {
+				Relief:       relief,
+				Exaggeration: exaggeration,
+				RangeAlpha:   rangeAlpha,
+
+				Background:  bg,
+				LandAlpha:   landAlpha,
+				Transparent: transparent,
+			}
+			if points != nil {
+				pm.Points = points.at(st.age, pointStage(st.age))
+			}
+			if err := drawMap(out, pm, tot); err != nil {
 				return err
 			}
 		}
@@ -239,18 +592,51 @@ func run(c *command.Command, args []string) error {
 
 	if outPrefix == "" {
 		outPrefix = inputFile
+		if inputFile == "-" {
+			outPrefix = "map"
+		}
 	}
 
-	nodes, err := parseNodes()
-	if err != nil {
-		return err
-	}
 	trees := parseTreeNames()
 
-	rt, err := getRec(inputFile, landscape)
+	var paths *pathSet
+	var pathGradient probmap.Gradienter
+	if pathsFile != "" {
+		if maxPaths <= 0 {
+			return c.UsageError("flag --max-paths: value must be greater than 0")
+		}
+		rotF := p.Path(project.GeoMotion)
+		if rotF == "" {
+			msg := fmt.Sprintf("plate motion model not defined in project %q", args[0])
+			return c.UsageError(msg)
+		}
+		paths, err = readPaths(pathsFile, tc, rotF, landscape.Pixelation(), maxPaths)
+		if err != nil {
+			return err
+		}
+		pathGradient = getGradient(pathScale)
+		if pathGradient == nil {
+			pathGradient = probmap.Incandescent{}
+		}
+	}
+
+	rt, err := getRec(inputFile, c.Stdin(), landscape)
 	if err != nil {
 		return err
 	}
+	postSplit(rt, tc, postMode)
+	if diffFile != "" {
+		brt, err := getRec(diffFile, c.Stdin(), landscape)
+		if err != nil {
+			return err
+		}
+		postSplit(brt, tc, postMode)
+		rt, err = diffRec(rt, brt)
+		if err != nil {
+			return err
+		}
+		gradient = probmap.Sunset{}
+	}
 
 	if len(trees) == 0 {
 		trees = make([]string, 0, len(rt))
@@ -260,17 +646,21 @@ func run(c *command.Command, args []string) error {
 		slices.Sort(trees)
 	}
 
-	for _, tn := range trees {
-		t := rt[tn]
-		nodeList := nodes
-		if len(nodeList) == 0 {
-			nodeList = make([]int, 0, len(t.nodes))
-			for id := range t.nodes {
-				nodeList = append(nodeList, id)
+	// without the node field
+	// the maps of different nodes
+	// will have the same name
+	if nameTemplate != "" && !strings.Contains(nameTemplate, "{node}") {
+		for _, tn := range trees {
+			if n := len(treeNodes(rt[tn], tn, nodes)); n > 1 {
+				msg := fmt.Sprintf("flag --name-template: field {node} required: %d nodes of tree %q will be mapped", n, tn)
+				return c.UsageError(msg)
 			}
-			slices.Sort(nodeList)
 		}
-		for _, id := range nodeList {
+	}
+
+	for _, tn := range trees {
+		t := rt[tn]
+		for _, id := range treeNodes(t, tn, nodes) {
 			n := t.nodes[id]
 			stages := make([]int64, 0, len(n.stages))
 			for a := range n.stages {
@@ -281,25 +671,63 @@ func run(c *command.Command, args []string) error {
 				stages = stages[:1]
 			}
 
+			var strip []*probmap.Image
+			if stripFlag {
+				// from the oldest to the youngest stage
+				slices.Reverse(stages)
+			}
 			for _, a := range stages {
 				s := n.stages[a]
 				age := float64(s.age) / 1_000_000
 				out := fmt.Sprintf("%s-%s-n%d-%.3f.png", outPrefix, t.name, n.id, age)
+				if nameTemplate != "" {
+					out = outName(args[0], t.name, n.id, strconv.FormatFloat(age, 'f', 3, 64))
+				}
+
+				rng := s.rec
+				if levels != nil {
+					rng = setClasses(s.rec, t.tp, levels)
+				}
 
 				pm := &probmap.Image{
 					Cols:      colsFlag,
 					Age:       s.age,
 					Landscape: landscape,
 					Keys:      keys,
-					Rng:       s.rec,
+					Rng:       rng,
 					Contour:   contour,
 					Present:   present,
 					Gray:      grayFlag,
 					Gradient:  gradient,
-				}
-				pm.Format(tot)
 
-				if err := writeImage(out, pm); err != nil {
+					Relief:       relief,
+					Exaggeration: exaggeration,
+					RangeAlpha:   rangeAlpha,
+
+					Background:  bg,
+					LandAlpha:   landAlpha,
+					Transparent: transparent,
+				}
+				if points != nil {
+					pm.Points = points.at(s.age, pointStage(s.age))
+				}
+				if paths != nil {
+					pm.Paths = paths.at(t.name, n.id, s.age, pointStage(s.age), pathGradient)
+				}
+				if stripFlag {
+					strip = append(strip, pm)
+					continue
+				}
+				if err := drawMap(out, pm, tot); err != nil {
+					return err
+				}
+			}
+			if stripFlag {
+				out := fmt.Sprintf("%s-%s-n%d-strip.png", outPrefix, t.name, n.id)
+				if nameTemplate != "" {
+					out = outName(args[0], t.name, n.id, "strip")
+				}
+				if err := drawStrip(out, strip, tot, bg); err != nil {
 					return err
 				}
 			}
@@ -309,7 +737,73 @@ func run(c *command.Command, args []string) error {
 	return nil
 }
 
+// TreeNodes returns the IDs of the nodes of a tree
+// that will be mapped.
+func treeNodes(t *recTree, name string, nodes map[string][]int) []int {
+	if t == nil {
+		return nil
+	}
+	if nodes == nil {
+		ids := make([]int, 0, len(t.nodes))
+		for id := range t.nodes {
+			ids = append(ids, id)
+		}
+		slices.Sort(ids)
+		return ids
+	}
+
+	var ids []int
+	for _, id := range nodes[name] {
+		if _, ok := t.nodes[id]; ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// GetGradient returns the gradient
+// of a color scale.
+// If the scale is unknown,
+// it returns nil.
+func getGradient(scale string) probmap.Gradienter {
+	switch strings.ToLower(scale) {
+	case "gray":
+		return probmap.HalfGrayScale{}
+	case "rainbow":
+		return probmap.RainbowPurpleToRed{}
+	case "incandescent":
+		return probmap.Incandescent{}
+	case "iridescent":
+		return probmap.Iridescent{}
+	}
+	return nil
+}
+
+// PointStage returns the time stage
+// used for the records drawn on a map.
+func pointStage(age int64) int64 {
+	if unRot {
+		return 0
+	}
+	return age
+}
+
 func readLandscape(name string) (*model.TimePix, error) {
+	f, err := openFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readRelief(name string, landscape *model.TimePix) (*model.TimePix, error) {
 	f, err := os.Open(name)
 	if err != nil {
 		return nil, err
@@ -320,6 +814,9 @@ func readLandscape(name string) (*model.TimePix, error) {
 	if err != nil {
 		return nil, fmt.Errorf("on file %q: %v", name, err)
 	}
+	if eq := landscape.Pixelation().Equator(); tp.Pixelation().Equator() != eq {
+		return nil, fmt.Errorf("on file %q: invalid equator value %d, want %d", name, tp.Pixelation().Equator(), eq)
+	}
 
 	return tp, nil
 }
@@ -339,7 +836,7 @@ func readContour(name string) (image.Image, error) {
 }
 
 func readRotation(name string, pix *earth.Pixelation) (*model.Total, error) {
-	f, err := os.Open(name)
+	f, err := openFile(name)
 	if err != nil {
 		return nil, err
 	}
@@ -353,23 +850,36 @@ func readRotation(name string, pix *earth.Pixelation) (*model.Total, error) {
 	return rot, nil
 }
 
-func getRec(name string, landscape *model.TimePix) (map[string]*recTree, error) {
-	f, err := os.Open(name)
+func getRec(name string, stdin io.Reader, landscape *model.TimePix) (map[string]*recTree, error) {
+	r, err := openInput(name, stdin)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	defer r.Close()
 
-	rt, err := readRecon(f, landscape)
+	rt, err := readRecon(r, landscape)
 	if err != nil {
 		return nil, fmt.Errorf("on input file %q: %v", name, err)
 	}
 	return rt, nil
 }
 
+// OpenInput opens an input file.
+// If the name is "-",
+// it will use the standard input.
+func openInput(name string, stdin io.Reader) (io.ReadCloser, error) {
+	if name == "-" {
+		return input.Open(name, stdin)
+	}
+	return openRecFile(name)
+}
+
 type recTree struct {
 	name  string
 	nodes map[int]*recNode
+
+	// type of the reconstruction
+	tp string
 }
 
 type recNode struct {
@@ -511,6 +1021,9 @@ func readRecon(r io.Reader, landscape *model.TimePix) (map[string]*recTree, erro
 	if len(rt) == 0 {
 		return nil, fmt.Errorf("while reading data: %v", io.EOF)
 	}
+	for _, t := range rt {
+		t.tp = tp
+	}
 
 	switch tp {
 	case "log-like":
@@ -565,7 +1078,43 @@ func readRecon(r io.Reader, landscape *model.TimePix) (map[string]*recTree, erro
 	return rt, nil
 }
 
-func writeImage(name string, m *probmap.Image) (err error) {
+// DrawMap formats and writes a map image.
+// If the flag --tiles is defined,
+// the map will be written as a set of tiles
+// for each zoom level.
+func drawMap(name string, m *probmap.Image, tot *model.Total) error {
+	if tilesFlag < 0 {
+		m.Format(tot)
+		return writeImage(name, m)
+	}
+
+	dir := strings.TrimSuffix(name, filepath.Ext(name))
+	for z := 0; z <= tilesFlag; z++ {
+		m.Cols = probmap.TileCols(z)
+		m.Format(tot)
+
+		nx, ny := m.Tiles()
+		for x := 0; x < nx; x++ {
+			d := filepath.Join(dir, strconv.Itoa(z), strconv.Itoa(x))
+			if err := os.MkdirAll(d, 0o755); err != nil {
+				return err
+			}
+		}
+		// tiles are drawn by rows
+		// so the hillshade bands are reused
+		for y := 0; y < ny; y++ {
+			for x := 0; x < nx; x++ {
+				tn := filepath.Join(dir, strconv.Itoa(z), strconv.Itoa(x), strconv.Itoa(y)+".png")
+				if err := writeImage(tn, m.Tile(x, y)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func writeImage(name string, m image.Image) (err error) {
 	f, err := os.Create(name)
 	if err != nil {
 		return err
@@ -583,6 +1132,31 @@ func writeImage(name string, m *probmap.Image) (err error) {
 	return nil
 }
 
+// OutName returns an output file name
+// using the name template.
+// If id is negative,
+// the node field will be empty.
+func outName(proj, tree string, id int, age string) string {
+	node := ""
+	if id >= 0 {
+		node = strconv.Itoa(id)
+	}
+	proj = strings.TrimSuffix(filepath.Base(proj), filepath.Ext(proj))
+
+	r := strings.NewReplacer(
+		"{prefix}", outPrefix,
+		"{proj}", proj,
+		"{tree}", tree,
+		"{node}", node,
+		"{age}", age,
+	)
+	name := r.Replace(nameTemplate)
+	if !strings.HasSuffix(strings.ToLower(name), ".png") {
+		name += ".png"
+	}
+	return name
+}
+
 func parseTreeNames() []string {
 	if treesFlag == "" {
 		return nil
@@ -596,21 +1170,37 @@ func parseTreeNames() []string {
 	return trees
 }
 
-func parseNodes() ([]int, error) {
+// ParseNodes returns the nodes of each tree
+// defined by the flag --nodes,
+// either as node IDs,
+// or as clade labels of the project.
+func parseNodes(tc *timetree.Collection, labels *clade.Collection) (map[string][]int, error) {
 	if nodesFlag == "" {
 		return nil, nil
 	}
 
-	ids := strings.Split(nodesFlag, ",")
-	nodes := make([]int, 0, len(ids))
-	for _, id := range ids {
-		n, err := strconv.Atoi(id)
+	nodes := make(map[string][]int, len(tc.Names()))
+	for _, tn := range tc.Names() {
+		ids, err := clade.Nodes(labels, tc.Tree(tn), nodesFlag)
 		if err != nil {
 			return nil, fmt.Errorf("on flag --nodes: %v", err)
 		}
-		nodes = append(nodes, n)
+		nodes[tn] = ids
 	}
-	slices.Sort(nodes)
-
 	return nodes, nil
 }
+
+func readLabels(name string) (*clade.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := clade.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
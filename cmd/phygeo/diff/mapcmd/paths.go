@@ -0,0 +1,311 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package mapcmd
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/probmap"
+	"github.com/js-arias/timetree"
+)
+
+// A pathSet stores the particle trajectories
+// to be drawn over the maps.
+type pathSet struct {
+	tc    *timetree.Collection
+	tot   *model.Total // from present to the stage
+	inv   *model.Total // from the stage to present
+	trees map[string]map[int]map[int][]segment
+}
+
+// A segment is the movement of a particle
+// in a time stage.
+type segment struct {
+	age  int64
+	from int
+	to   int
+}
+
+var pathFields = []string{
+	"tree",
+	"particle",
+	"node",
+	"age",
+	"from",
+	"to",
+}
+
+// ReadPaths reads the trajectories
+// of the first particles of each tree
+// from a particles file.
+func readPaths(name string, tc *timetree.Collection, rotF string, pix *earth.Pixelation, max int) (*pathSet, error) {
+	r, err := openRecFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	trees, err := readSegments(r, tc, pix, max)
+	if err != nil {
+		return nil, fmt.Errorf("on paths file %q: %v", name, err)
+	}
+
+	tot, err := readRotation(rotF, pix)
+	if err != nil {
+		return nil, err
+	}
+	inv, err := readInverse(rotF, pix)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pathSet{
+		tc:    tc,
+		tot:   tot,
+		inv:   inv,
+		trees: trees,
+	}, nil
+}
+
+func readSegments(r io.Reader, tc *timetree.Collection, pix *earth.Pixelation, max int) (map[string]map[int]map[int][]segment, error) {
+	tsv := csv.NewReader(r)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range pathFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	trees := make(map[string]map[int]map[int][]segment)
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "tree"
+		tn := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if tn == "" {
+			continue
+		}
+		tn = strings.ToLower(tn)
+		if tc.Tree(tn) == nil {
+			continue
+		}
+
+		f = "particle"
+		pN, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		t, ok := trees[tn]
+		if !ok {
+			t = make(map[int]map[int][]segment)
+			trees[tn] = t
+		}
+		p, ok := t[pN]
+		if !ok {
+			// only the first particles are used
+			if len(t) >= max {
+				continue
+			}
+			p = make(map[int][]segment)
+			t[pN] = p
+		}
+
+		f = "node"
+		id, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+
+		f = "age"
+		age, err := strconv.ParseInt(row[fields[f]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+
+		f = "from"
+		from, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if from >= pix.Len() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, from)
+		}
+
+		f = "to"
+		to, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if to >= pix.Len() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, to)
+		}
+
+		p[id] = append(p[id], segment{
+			age:  age,
+			from: from,
+			to:   to,
+		})
+	}
+	if len(trees) == 0 {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+
+	return trees, nil
+}
+
+// At returns the paths of the lineage of a node
+// from the root
+// up to the given age,
+// with pixels rotated to the given time stage.
+// The color of each path is defined by its age
+// relative to the age of the root.
+func (ps *pathSet) at(tn string, id int, age, stage int64, gradient probmap.Gradienter) []probmap.Path {
+	t := ps.tc.Tree(tn)
+	if t == nil {
+		return nil
+	}
+	particles := ps.trees[tn]
+	if len(particles) == 0 {
+		return nil
+	}
+
+	lineage := []int{id}
+	for n := id; !t.IsRoot(n); {
+		n = t.Parent(n)
+		lineage = append(lineage, n)
+	}
+
+	// the oldest age is the start of the stem branch
+	var oldest float64
+	for _, p := range particles {
+		for _, s := range p[t.Root()] {
+			if a := float64(s.age); a > oldest {
+				oldest = a
+			}
+		}
+		break
+	}
+
+	pIDs := make([]int, 0, len(particles))
+	for p := range particles {
+		pIDs = append(pIDs, p)
+	}
+	slices.Sort(pIDs)
+
+	var paths []probmap.Path
+	for _, p := range pIDs {
+		for _, n := range lineage {
+			for _, s := range particles[p][n] {
+				if s.age < age {
+					continue
+				}
+				if s.from == s.to {
+					continue
+				}
+				from, ok := ps.rotate(s.from, s.age, stage)
+				if !ok {
+					continue
+				}
+				to, ok := ps.rotate(s.to, s.age, stage)
+				if !ok {
+					continue
+				}
+
+				// old paths at the start of the gradient
+				v := 1.0
+				if oldest > 0 {
+					v = 1 - float64(s.age)/oldest
+				}
+				paths = append(paths, probmap.Path{
+					From:  from,
+					To:    to,
+					Color: gradient.Gradient(v),
+				})
+			}
+		}
+	}
+	return paths
+}
+
+// Rotate rotates a pixel from the time stage of a segment
+// to the indicated time stage.
+// If stage is 0,
+// the pixel will be rotated to the present.
+func (ps *pathSet) rotate(px int, age, stage int64) (int, bool) {
+	age = ps.tot.ClosestStageAge(age)
+	stage = ps.tot.ClosestStageAge(stage)
+	if age == stage {
+		return px, true
+	}
+
+	pp := ps.inv.Rotation(age)[px]
+	if len(pp) == 0 {
+		return 0, false
+	}
+	if stage == 0 {
+		return pp[0], true
+	}
+
+	sp := ps.tot.Rotation(stage)[pp[0]]
+	if len(sp) == 0 {
+		return 0, false
+	}
+	return sp[0], true
+}
+
+func readInverse(name string, pix *earth.Pixelation) (*model.Total, error) {
+	f, err := openFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rot, err := model.ReadTotal(f, pix, true)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return rot, nil
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := openFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
@@ -0,0 +1,124 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package mapcmd
+
+import (
+	"fmt"
+
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/ranges"
+)
+
+// A pointSet stores the observed records of the terminals
+// to be drawn over the maps.
+type pointSet struct {
+	rot  *model.StageRot
+	taxa map[string]map[int]bool
+	age  map[string]int64
+}
+
+func newPointSet(coll *ranges.Collection, rot *model.StageRot, taxon string) (*pointSet, error) {
+	ps := &pointSet{
+		rot:  rot,
+		taxa: make(map[string]map[int]bool),
+		age:  make(map[string]int64),
+	}
+
+	var taxa []string
+	if taxon == "all" {
+		taxa = coll.Taxa()
+	} else {
+		if !coll.HasTaxon(taxon) {
+			return nil, fmt.Errorf("flag --points: taxon %q without records", taxon)
+		}
+		taxa = []string{taxon}
+	}
+
+	for _, tax := range taxa {
+		pts := make(map[int]bool)
+		for px := range coll.Range(tax) {
+			pts[px] = true
+		}
+		ps.taxa[tax] = pts
+		ps.age[tax] = rot.ClosestStageAge(coll.Age(tax))
+	}
+	return ps, nil
+}
+
+// At returns the pixels of the records
+// of all the terminals alive at a given age,
+// rotated to the given time stage.
+func (ps *pointSet) at(age, stage int64) map[int]bool {
+	age = ps.rot.ClosestStageAge(age)
+	stage = ps.rot.ClosestStageAge(stage)
+
+	pts := make(map[int]bool)
+	for tax, tp := range ps.taxa {
+		if ps.age[tax] > age {
+			continue
+		}
+		for px := range rotatePoints(ps.rot, tp, ps.age[tax], stage) {
+			pts[px] = true
+		}
+	}
+	return pts
+}
+
+// RotatePoints rotates a set of pixels
+// from a time stage to another time stage.
+func rotatePoints(rot *model.StageRot, pts map[int]bool, from, to int64) map[int]bool {
+	for from != to {
+		var r *model.Rotation
+		if from < to {
+			r = rot.YoungToOld(from)
+		} else {
+			r = rot.OldToYoung(from)
+		}
+		if r == nil {
+			break
+		}
+
+		np := make(map[int]bool, len(pts))
+		for px := range pts {
+			for _, dst := range r.Rot[px] {
+				np[dst] = true
+			}
+		}
+		pts = np
+		from = r.To
+	}
+	return pts
+}
+
+func readStageRot(name string, pix *earth.Pixelation) (*model.StageRot, error) {
+	f, err := openFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rot, err := model.ReadStageRot(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return rot, nil
+}
+
+func readRanges(name string) (*ranges.Collection, error) {
+	f, err := openFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := ranges.ReadTSV(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
@@ -4,17 +4,54 @@
 
 package mapcmd
 
-import "github.com/js-arias/earth/model"
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
 
-func richnessOnTime(landscape *model.TimePix) (map[int64]*recStage, error) {
-	rt, err := getRec(inputFile, landscape)
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/timetree"
+)
+
+func richnessOnTime(stdin io.Reader, landscape *model.TimePix, tc *timetree.Collection, nodes map[string][]int, postMode string) (map[int64]*recStage, error) {
+	rt, err := getRec(inputFile, stdin, landscape)
+	if err != nil {
+		return nil, err
+	}
+	postSplit(rt, tc, postMode)
+
+	lineages, err := richnessLineages(tc, nodes)
 	if err != nil {
 		return nil, err
 	}
+	extinct, err := parseExtinct(extinctFlag)
+	if err != nil {
+		return nil, fmt.Errorf("flag --extinct: %v", err)
+	}
+	var surv map[string]map[int]float64
+	if extinct != extInclude {
+		surv = survival(tc)
+	}
 
 	stages := make(map[int64]*recStage)
 	for _, t := range rt {
 		for _, n := range t.nodes {
+			if !lineages(t.name, n.id) {
+				continue
+			}
+			w := 1.0
+			switch extinct {
+			case extExclude:
+				if surv[t.name][n.id] == 0 {
+					continue
+				}
+			case extWeight:
+				w = surv[t.name][n.id]
+				if w == 0 {
+					continue
+				}
+			}
 			for _, s := range n.stages {
 				// only use exact time stages
 				age := landscape.ClosestStageAge(s.age)
@@ -32,12 +69,16 @@ func richnessOnTime(landscape *model.TimePix) (map[int64]*recStage, error) {
 				}
 
 				for px, p := range s.rec {
-					st.rec[px] += p
+					st.rec[px] += p * w
 				}
 			}
 		}
 	}
 
+	if len(stages) == 0 {
+		return nil, fmt.Errorf("no lineages selected for richness")
+	}
+
 	// scale values
 	for _, st := range stages {
 		var max float64
@@ -46,6 +87,9 @@ func richnessOnTime(landscape *model.TimePix) (map[int64]*recStage, error) {
 				max = p
 			}
 		}
+		if max == 0 {
+			continue
+		}
 
 		for px, p := range st.rec {
 			st.rec[px] = p / max
@@ -54,3 +98,112 @@ func richnessOnTime(landscape *model.TimePix) (map[int64]*recStage, error) {
 
 	return stages, nil
 }
+
+// Valid values for the treatment
+// of extinct lineages
+// in richness maps.
+const (
+	extInclude = "include"
+	extExclude = "exclude"
+	extWeight  = "weight"
+)
+
+// ParseExtinct returns the treatment
+// of extinct lineages.
+func parseExtinct(v string) (string, error) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	switch v {
+	case extInclude, extExclude, extWeight:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown value %q", v)
+}
+
+// Survival returns the fraction of the descendant terminals
+// of each node
+// that are extant
+// (i.e., terminals with age 0).
+func survival(tc *timetree.Collection) map[string]map[int]float64 {
+	surv := make(map[string]map[int]float64, len(tc.Names()))
+	for _, tn := range tc.Names() {
+		t := tc.Tree(tn)
+		terms := make(map[int]int)
+		extant := make(map[int]int)
+
+		// nodes are in pre-order,
+		// so the descendants are visited
+		// before their ancestors
+		nodes := t.Nodes()
+		for j := len(nodes) - 1; j >= 0; j-- {
+			id := nodes[j]
+			if t.IsTerm(id) {
+				terms[id] = 1
+				if t.Age(id) == 0 {
+					extant[id] = 1
+				}
+			}
+			if p := t.Parent(id); p >= 0 {
+				terms[p] += terms[id]
+				extant[p] += extant[id]
+			}
+		}
+
+		ns := make(map[int]float64, len(nodes))
+		for _, id := range nodes {
+			ns[id] = float64(extant[id]) / float64(terms[id])
+		}
+		surv[tn] = ns
+	}
+	return surv
+}
+
+// RichnessLineages returns a function
+// that reports if a node of a tree
+// is used for the richness maps,
+// as defined by the flags --trees, --nodes, and --clade.
+func richnessLineages(tc *timetree.Collection, nodes map[string][]int) (func(tree string, node int) bool, error) {
+	trees := parseTreeNames()
+
+	var clade map[string]map[int]bool
+	if cladeFlag != "" {
+		terms := strings.Split(cladeFlag, ",")
+		clade = make(map[string]map[int]bool)
+		for _, tn := range tc.Names() {
+			t := tc.Tree(tn)
+			mrca := t.MRCA(terms...)
+			if mrca < 0 {
+				continue
+			}
+			desc := map[int]bool{mrca: true}
+			for _, id := range t.Nodes() {
+				for a := id; a >= 0; a = t.Parent(a) {
+					if a == mrca {
+						desc[id] = true
+						break
+					}
+				}
+			}
+			clade[tn] = desc
+		}
+		if len(clade) == 0 {
+			return nil, fmt.Errorf("on flag --clade: terminals %q not found in trees", cladeFlag)
+		}
+	}
+
+	return func(tree string, node int) bool {
+		if trees != nil {
+			if _, ok := slices.BinarySearch(trees, tree); !ok {
+				return false
+			}
+		}
+		if nodes != nil {
+			if _, ok := slices.BinarySearch(nodes[tree], node); !ok {
+				return false
+			}
+		}
+		if clade != nil {
+			return clade[tree][node]
+		}
+		return true
+	}, nil
+}
@@ -0,0 +1,114 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package mapcmd
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ParseLevels parses the credible levels
+// of the flag --sets.
+// The levels are sorted from the smallest
+// to the largest.
+func parseLevels(s string) ([]float64, error) {
+	var levels []float64
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		l, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("flag --sets: invalid value %q: %v", v, err)
+		}
+		if l <= 0 || l > 1 {
+			return nil, fmt.Errorf("flag --sets: invalid value %q: expecting a value between 0 and 1", v)
+		}
+		levels = append(levels, l)
+	}
+	if len(levels) == 0 {
+		return nil, fmt.Errorf("flag --sets: expecting at least a credible level")
+	}
+	slices.Sort(levels)
+	return slices.Compact(levels), nil
+}
+
+// SetClasses returns the credible set membership
+// of the pixels of a stage.
+//
+// Each pixel is assigned to the smallest set
+// that contains it.
+// The pixels of the smallest set have a value of 1,
+// and the value decreases for each larger set,
+// so with n levels,
+// the pixels of the k-th set
+// (starting from 0)
+// have a value of 1 - k/n.
+// Pixels outside the largest set are removed.
+func setClasses(rec map[int]float64, tp string, levels []float64) map[int]float64 {
+	class := make(map[int]float64)
+	n := float64(len(levels))
+	for k := len(levels) - 1; k >= 0; k-- {
+		v := 1 - float64(k)/n
+		for _, px := range credibleSet(rec, tp, levels[k]) {
+			class[px] = v
+		}
+	}
+	return class
+}
+
+// CredibleSet returns the pixels
+// in the credible set of a stage
+// at the given level.
+//
+// In a KDE reconstruction,
+// the values are already scaled to the CDF,
+// so a pixel is in the set
+// if its value is at least 1 - level.
+// Otherwise,
+// pixels are added from the most to the least probable
+// until the level is reached.
+func credibleSet(rec map[int]float64, tp string, level float64) []int {
+	var set []int
+	if tp == "kde" {
+		for px, v := range rec {
+			if v >= 1-level {
+				set = append(set, px)
+			}
+		}
+		slices.Sort(set)
+		return set
+	}
+
+	pixels := make([]int, 0, len(rec))
+	var sum float64
+	for px, v := range rec {
+		pixels = append(pixels, px)
+		sum += v
+	}
+	slices.SortFunc(pixels, func(a, b int) int {
+		if rec[a] > rec[b] {
+			return -1
+		}
+		if rec[a] < rec[b] {
+			return 1
+		}
+		return a - b
+	})
+
+	var acc float64
+	for _, px := range pixels {
+		if acc >= level*sum {
+			break
+		}
+		set = append(set, px)
+		acc += rec[px]
+	}
+	slices.Sort(set)
+	return set
+}
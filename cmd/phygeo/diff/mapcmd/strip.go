@@ -0,0 +1,93 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package mapcmd
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/internal/chart"
+	"github.com/js-arias/phygeo/probmap"
+	"gonum.org/v1/plot/font"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/vgimg"
+)
+
+// StripFontScale is the size of the age labels
+// of a strip,
+// relative to the width of each panel.
+const stripFontScale = 1.0 / 30
+
+// DrawStrip draws the maps of the time stages of a node
+// side by side,
+// from the oldest to the youngest stage,
+// as a single image,
+// with the age of each stage
+// above its panel.
+func drawStrip(name string, maps []*probmap.Image, tot *model.Total, bg color.Color) error {
+	if len(maps) == 0 {
+		return nil
+	}
+	for _, m := range maps {
+		m.Format(tot)
+	}
+	w := maps[0].Bounds().Dx()
+	h := maps[0].Bounds().Dy()
+
+	size := float64(w) * stripFontScale
+	if size < chart.LabelSize {
+		size = chart.LabelSize
+	}
+	labelH := int(size * 1.6)
+
+	if bg == nil {
+		bg = color.White
+	}
+	strip := image.NewRGBA(image.Rect(0, 0, w*len(maps), h+labelH))
+	draw.Draw(strip, strip.Bounds(), &image.Uniform{bg}, image.Point{}, draw.Src)
+
+	// the labels are drawn with a resolution of 72 DPI
+	// so a point is a pixel
+	c := vgimg.NewWith(
+		vgimg.UseWH(vg.Length(strip.Bounds().Dx()), vg.Length(labelH)),
+		vgimg.UseDPI(72),
+		vgimg.UseBackgroundColor(bg),
+	)
+	face := font.DefaultCache.Lookup(chart.Font, font.Length(size))
+	c.SetColor(labelColor(bg))
+	for i, m := range maps {
+		label := fmt.Sprintf("%.3f Ma", float64(m.Age)/1_000_000)
+		x := float64(i*w) + (float64(w)-float64(face.Width(label)))/2
+		y := (float64(labelH) - size) / 2
+		c.FillString(face, vg.Point{X: vg.Length(x), Y: vg.Length(y)}, label)
+	}
+	draw.Draw(strip, image.Rect(0, 0, strip.Bounds().Dx(), labelH), c.Image(), image.Point{}, draw.Over)
+
+	for i, m := range maps {
+		r := image.Rect(i*w, labelH, (i+1)*w, labelH+h)
+		draw.Draw(strip, r, m, image.Point{}, draw.Over)
+	}
+
+	return writeImage(name, strip)
+}
+
+// LabelColor returns the color of the labels
+// drawn over a background color.
+func labelColor(bg color.Color) color.Color {
+	r, g, b, a := bg.RGBA()
+	if a == 0 {
+		return color.Black
+	}
+	// relative luminance
+	// of a non-premultiplied color
+	l := (0.2126*float64(r) + 0.7152*float64(g) + 0.0722*float64(b)) / float64(a)
+	if l < 0.5 {
+		return color.White
+	}
+	return color.Black
+}
@@ -0,0 +1,128 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package merge
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/js-arias/timetree"
+)
+
+// A clade is a set of terminals
+// found in one or more trees.
+type clade struct {
+	id   int
+	taxa []string
+
+	// number of trees with the clade
+	trees int
+
+	// average age of the clade
+	age    int64
+	ageSum float64
+
+	// merged reconstruction
+	// and the number of trees
+	// with a reconstruction of the clade
+	rec  map[int]float64
+	recs int
+}
+
+// MergeClades maps the nodes of the trees
+// by their descendant terminals,
+// and returns the clades found
+// in at least the threshold fraction of the trees,
+// with their merged reconstruction.
+// The clades are sorted by size,
+// and then by their terminals.
+func mergeClades(trees []*timetree.Tree, recs []*recTree, threshold float64) ([]*clade, error) {
+	cls := make(map[string]*clade)
+	for i, t := range trees {
+		r := recs[i]
+		for id, taxa := range treeClades(t) {
+			key := strings.Join(taxa, "\n")
+			cl, ok := cls[key]
+			if !ok {
+				cl = &clade{
+					taxa: taxa,
+					rec:  make(map[int]float64),
+				}
+				cls[key] = cl
+			}
+			cl.trees++
+			cl.ageSum += float64(t.Age(id))
+
+			n, ok := r.nodes[id]
+			if !ok || len(n.stages) == 0 {
+				continue
+			}
+			var young int64 = math.MaxInt64
+			for a := range n.stages {
+				young = min(young, a)
+			}
+			st := n.stages[young]
+			var sum float64
+			for _, v := range st {
+				sum += v
+			}
+			if sum == 0 {
+				return nil, fmt.Errorf("tree %q: node %d: age %d: empty reconstruction", t.Name(), id, young)
+			}
+			for px, v := range st {
+				cl.rec[px] += v / sum
+			}
+			cl.recs++
+		}
+	}
+
+	var merged []*clade
+	for _, cl := range cls {
+		if cl.recs == 0 {
+			continue
+		}
+		if float64(cl.trees)/float64(len(trees)) < threshold {
+			continue
+		}
+		for px, v := range cl.rec {
+			cl.rec[px] = v / float64(cl.recs)
+		}
+		cl.age = int64(math.Round(cl.ageSum / float64(cl.trees)))
+		merged = append(merged, cl)
+	}
+	slices.SortFunc(merged, func(a, b *clade) int {
+		if len(a.taxa) != len(b.taxa) {
+			return len(b.taxa) - len(a.taxa)
+		}
+		return slices.Compare(a.taxa, b.taxa)
+	})
+	for i, cl := range merged {
+		cl.id = i
+	}
+	return merged, nil
+}
+
+// TreeClades returns the sorted terminals
+// of each node of a tree.
+func treeClades(t *timetree.Tree) map[int][]string {
+	cls := make(map[int][]string)
+	var desc func(n int) []string
+	desc = func(n int) []string {
+		var taxa []string
+		if t.IsTerm(n) {
+			taxa = append(taxa, t.Taxon(n))
+		}
+		for _, c := range t.Children(n) {
+			taxa = append(taxa, desc(c)...)
+		}
+		slices.Sort(taxa)
+		cls[n] = taxa
+		return taxa
+	}
+	desc(t.Root())
+	return cls
+}
@@ -0,0 +1,467 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package merge implements a command to merge
+// the reconstructions of several trees
+// (e.g., a sample of a posterior distribution of trees)
+// into a consensus reconstruction.
+package merge
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/internal/input"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/version"
+	"github.com/js-arias/timetree"
+)
+
+var Command = &command.Command{
+	Usage: `merge [--threshold <value>] [--name <tree-name>]
+	-i|--input <file> [-o|--output <file>] <project-file>`,
+	Short: "merge reconstructions across trees",
+	Long: `
+Command merge reads a file with a probability reconstruction for the nodes of
+several trees in a project (for example, a sample of trees from a Bayesian
+posterior), and merges the reconstructions of the nodes that represent the
+same clade into a consensus reconstruction.
+
+The argument of the command is the name of the project file.
+
+The flag --input, or -i, is required and indicates the input file. The input
+file is a pixel probability file with a "log-like" or a "freq" reconstruction
+(KDE reconstructions are not supported, as they are scaled to the CDF). If the
+input is "-", the file will be read from the standard input. Only the trees
+of the project that are present in the input file will be used.
+
+Nodes of different trees are mapped by their clades (i.e., the set of their
+descendant terminals). The frequency of a clade is the fraction of the trees
+in which the clade is found. By default, only clades found in at least half
+of the trees will be merged. Use the flag --threshold to define a different
+frequency.
+
+The reconstruction of a node is taken at the age of the node (i.e., the
+youngest time stage of the node). In each tree, the values of the pixels are
+normalized so they sum to one, and then the reconstruction of a clade is the
+average of the normalized values over the trees in which the clade is found.
+As each tree has the same weight, the contribution of a particular topology
+is proportional to its frequency in the tree sample. The age of the merged
+node is the average age of the node in the trees.
+
+The merged reconstruction is written as a pixel probability file, with values
+of type "freq", using a single "tree" for all the merged clades. By default,
+the tree name is "merged"; use the flag --name to define a different name. The
+node IDs of the merged tree are assigned by clade size (the clade with all
+terminals is the node 0). By default, the output file name is the name of the
+project file with the suffix "-merged.tab". Use the flag --output, or -o, to
+define a different name.
+
+The list of merged clades is printed in the standard output, as a
+tab-delimited table with the following columns:
+
+	node     the ID of the merged node
+	trees    the number of trees with the clade
+	freq     the frequency of the clade
+	age      the average age of the node, in million years
+	terms    the number of terminals in the clade
+	taxa     the terminals of the clade, separated by commas
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var threshold float64
+var inputFile string
+var output string
+var treeName string
+
+func setFlags(c *command.Command) {
+	c.Flags().Float64Var(&threshold, "threshold", 0.5, "")
+	c.Flags().StringVar(&inputFile, "input", "", "")
+	c.Flags().StringVar(&inputFile, "i", "", "")
+	c.Flags().StringVar(&output, "output", "", "")
+	c.Flags().StringVar(&output, "o", "", "")
+	c.Flags().StringVar(&treeName, "name", "merged", "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if inputFile == "" {
+		return c.UsageError("expecting input file, flag --input")
+	}
+	if threshold <= 0 || threshold > 1 {
+		return c.UsageError("flag --threshold: value must be between 0 and 1")
+	}
+	treeName = strings.Join(strings.Fields(treeName), " ")
+	if treeName == "" {
+		return c.UsageError("flag --name: expecting tree name")
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("landscape not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	landscape, err := readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	tf := p.Path(project.Trees)
+	if tf == "" {
+		msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	tc, err := readTreeFile(tf)
+	if err != nil {
+		return err
+	}
+
+	rt, err := getRec(inputFile, c.Stdin(), landscape)
+	if err != nil {
+		return err
+	}
+
+	var trees []*timetree.Tree
+	var recs []*recTree
+	for _, name := range tc.Names() {
+		r, ok := rt[name]
+		if !ok {
+			continue
+		}
+		trees = append(trees, tc.Tree(name))
+		recs = append(recs, r)
+	}
+	if len(trees) == 0 {
+		return fmt.Errorf("on input file %q: no trees of project %q", inputFile, args[0])
+	}
+
+	clades, err := mergeClades(trees, recs, threshold)
+	if err != nil {
+		return err
+	}
+
+	if output == "" {
+		output = args[0] + "-merged.tab"
+	}
+	if err := writeMerged(output, args[0], len(trees), clades, landscape.Pixelation()); err != nil {
+		return err
+	}
+
+	if err := writeClades(c.Stdout(), len(trees), clades); err != nil {
+		return fmt.Errorf("while writing on standard output: %v", err)
+	}
+	return nil
+}
+
+func writeMerged(name, p string, numTrees int, clades []*clade, pix *earth.Pixelation) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if err == nil && e != nil {
+			err = e
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "# diff.merge, project %q\n", p)
+	fmt.Fprintf(w, "# input: %q\n", inputFile)
+	fmt.Fprintf(w, "# trees: %d\n", numTrees)
+	fmt.Fprintf(w, "# clade frequency threshold: %.6f\n", threshold)
+	fmt.Fprintf(w, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "# phygeo: %s\n", version.String())
+
+	tsv := csv.NewWriter(w)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	if err := tsv.Write([]string{"tree", "node", "age", "type", "equator", "pixel", "value"}); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+
+	equator := strconv.Itoa(pix.Equator())
+	for _, cl := range clades {
+		id := strconv.Itoa(cl.id)
+		age := strconv.FormatInt(cl.age, 10)
+		for px := 0; px < pix.Len(); px++ {
+			v, ok := cl.rec[px]
+			if !ok {
+				continue
+			}
+			row := []string{
+				treeName,
+				id,
+				age,
+				"freq",
+				equator,
+				strconv.Itoa(px),
+				strconv.FormatFloat(v, 'f', 15, 64),
+			}
+			if err := tsv.Write(row); err != nil {
+				return fmt.Errorf("while writing data on %q: %v", name, err)
+			}
+		}
+	}
+
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	return nil
+}
+
+func writeClades(w io.Writer, numTrees int, clades []*clade) error {
+	tsv := csv.NewWriter(w)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	if err := tsv.Write([]string{"node", "trees", "freq", "age", "terms", "taxa"}); err != nil {
+		return err
+	}
+
+	for _, cl := range clades {
+		row := []string{
+			strconv.Itoa(cl.id),
+			strconv.Itoa(cl.trees),
+			strconv.FormatFloat(float64(cl.trees)/float64(numTrees), 'f', 6, 64),
+			strconv.FormatFloat(float64(cl.age)/1_000_000, 'f', 6, 64),
+			strconv.Itoa(len(cl.taxa)),
+			strings.Join(cl.taxa, ","),
+		}
+		if err := tsv.Write(row); err != nil {
+			return err
+		}
+	}
+
+	tsv.Flush()
+	return tsv.Error()
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func getRec(name string, stdin io.Reader, landscape *model.TimePix) (map[string]*recTree, error) {
+	r, err := input.Open(name, stdin)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	rt, err := readRecon(r, landscape)
+	if err != nil {
+		return nil, fmt.Errorf("on input file %q: %v", name, err)
+	}
+	return rt, nil
+}
+
+type recTree struct {
+	name  string
+	nodes map[int]*recNode
+}
+
+type recNode struct {
+	id     int
+	stages map[int64]map[int]float64
+}
+
+var headerFields = []string{
+	"tree",
+	"node",
+	"age",
+	"type",
+	"equator",
+	"pixel",
+	"value",
+}
+
+func readRecon(r io.Reader, landscape *model.TimePix) (map[string]*recTree, error) {
+	tsv := csv.NewReader(r)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range headerFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	var tp string
+	rt := make(map[string]*recTree)
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "tree"
+		tn := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if tn == "" {
+			continue
+		}
+		tn = strings.ToLower(tn)
+		t, ok := rt[tn]
+		if !ok {
+			t = &recTree{
+				name:  tn,
+				nodes: make(map[int]*recNode),
+			}
+			rt[tn] = t
+		}
+
+		f = "node"
+		id, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		n, ok := t.nodes[id]
+		if !ok {
+			n = &recNode{
+				id:     id,
+				stages: make(map[int64]map[int]float64),
+			}
+			t.nodes[id] = n
+		}
+
+		f = "age"
+		age, err := strconv.ParseInt(row[fields[f]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		st, ok := n.stages[age]
+		if !ok {
+			st = make(map[int]float64)
+			n.stages[age] = st
+		}
+
+		f = "type"
+		tpV := strings.ToLower(strings.Join(strings.Fields(row[fields[f]]), " "))
+		if tpV == "" {
+			return nil, fmt.Errorf("on row %d: field %q: expecting reconstruction type", ln, f)
+		}
+		if tp == "" {
+			tp = tpV
+		}
+		if tp != tpV {
+			return nil, fmt.Errorf("on row %d: field %q: got %q want %q", ln, f, tpV, tp)
+		}
+
+		f = "equator"
+		eq, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if eq != landscape.Pixelation().Equator() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid equator value %d", ln, f, eq)
+		}
+
+		f = "pixel"
+		px, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if px >= landscape.Pixelation().Len() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, px)
+		}
+
+		f = "value"
+		v, err := strconv.ParseFloat(row[fields[f]], 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		st[px] = v
+	}
+	if len(rt) == 0 {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+
+	switch tp {
+	case "log-like":
+		// transform log-like values
+		for _, t := range rt {
+			for _, n := range t.nodes {
+				for _, s := range n.stages {
+					max := -math.MaxFloat64
+					for _, p := range s {
+						if p > max {
+							max = p
+						}
+					}
+					for px, p := range s {
+						s[px] = math.Exp(p - max)
+					}
+				}
+			}
+		}
+	case "freq":
+		// frequencies are normalized when merged
+	case "kde":
+		return nil, fmt.Errorf("KDE reconstructions can not be merged")
+	default:
+		return nil, fmt.Errorf("unknown reconstruction type %q", tp)
+	}
+
+	return rt, nil
+}
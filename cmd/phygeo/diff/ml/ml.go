@@ -8,27 +8,37 @@
 package ml
 
 import (
+	"bufio"
+	"encoding/csv"
 	"fmt"
 	"io"
 	"math"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/js-arias/command"
 	"github.com/js-arias/earth"
 	"github.com/js-arias/earth/model"
 	"github.com/js-arias/earth/stat/dist"
 	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/agerange"
+	"github.com/js-arias/phygeo/constraint"
 	"github.com/js-arias/phygeo/infer/diffusion"
 	"github.com/js-arias/phygeo/project"
 	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/phygeo/version"
 	"github.com/js-arias/ranges"
 	"github.com/js-arias/timetree"
 )
 
 var Command = &command.Command{
 	Usage: `ml [--stem <age>]
-	[--lambda <value>ep <value>] [--stop <value>]
+	[--lambda <value>] [--step <value>] [--stop <value>]
+	[--kernel <name>] [--ld <value>] [--engine <name>]
+	[--float32] [--snap <km>] [--snap-log <file>]
 	[--cpu <number>] <project-file>`,
 	Short: "search the maximum likelihood estimate",
 	Long: `
@@ -41,10 +51,53 @@ default, the initial step has a value of 100, use the flag --step to change
 the value. At each cycle the step value is reduced a 50%, and stop when step
 has a size of 1. Use flag --stop to set a different stop value.
 
+Terminal range pixels located in a landscape value with a pixel weight of zero
+are ignored by the reconstruction, and will be reported as warnings in the
+standard error. Use the command 'phygeo diff hostile' for a detailed report.
+
+If the flag --snap is defined with a radius in km, the hostile pixels of each
+terminal (i.e., pixels in a landscape value with a pixel weight of zero) will
+be moved to the nearest pixel with a non-zero weight, if that pixel is within
+the indicated radius. The range file of the project is not modified. All
+moved pixels will be recorded in a log file, by default named using the
+project file name and the suffix "-snap.tab". Use the flag --snap-log to
+define a different name.
+
 By default, an stem branch will be added to each tree using the 10% of the root
 age. To set a different stem age use the flag --stem, the value should be in
 million years.
 
+By default, the dispersal kernel is a spherical normal. Use the flag --kernel
+to define a different kernel. Valid kernels are:
+
+	normal   the spherical normal (the default).
+	mixture  an heavy-tailed kernel, made of a mixture of a spherical normal
+	         and an uniform distribution over the whole sphere, that models
+	         rare long-distance dispersal events. The probability of a
+	         long-distance event per million years is defined with the flag
+	         --ld (by default 0.01), so the weight of the uniform component
+	         at a time stage of t million years is 1-(1-ld)^t.
+
+By default, the conditional likelihoods are calculated as a convolution of
+the dispersal kernel over the pixels. Use the flag --engine to define a
+different method. Valid engines are:
+
+	convolution  the convolution of the dispersal kernel (the default).
+	ctmc         an exact continuous-time Markov chain between neighbor
+	             pixels, calculated with sparse matrix exponentials. As its
+	             cost grows with the number of pixels, and the expected
+	             number of movements between pixels, it is only recommended
+	             for coarse pixelations (for example, 180 pixels or less
+	             at the equator). The engine is only used for the
+	             likelihood; with the mixture kernel, the uniform component
+	             is added to the chain probabilities.
+
+If the flag --float32 is given, the conditional likelihoods will be stored in
+single precision (with a rescaling constant for each time stage), and pixels
+with vanishing likelihoods will be ignored. Each stored value uses about a
+quarter less memory, so the savings are modest, and mostly come from the
+ignored pixels at high resolutions.
+
 By default, all available CPUs will be used in the processing. Set --cpu flag
 to use a different number of CPUs.
 	`,
@@ -52,24 +105,47 @@ to use a different number of CPUs.
 	Run:      run,
 }
 
+var float32Flag bool
 var lambdaFlag float64
 var stemAge float64
 var stepFlag float64
 var stopFlag float64
 var numCPU int
+var kernelFlag string
+var ldFlag float64
+var engineFlag string
+var snapRadius float64
+var snapLog string
 
 func setFlags(c *command.Command) {
+	c.Flags().BoolVar(&float32Flag, "float32", false, "")
 	c.Flags().Float64Var(&lambdaFlag, "lambda", 0, "")
 	c.Flags().Float64Var(&stopFlag, "stop", 1, "")
 	c.Flags().Float64Var(&stepFlag, "step", 100, "")
 	c.Flags().Float64Var(&stemAge, "stem", 0, "")
+	c.Flags().Float64Var(&snapRadius, "snap", 0, "")
+	c.Flags().StringVar(&snapLog, "snap-log", "", "")
 	c.Flags().IntVar(&numCPU, "cpu", runtime.NumCPU(), "")
+	c.Flags().StringVar(&kernelFlag, "kernel", "normal", "")
+	c.Flags().Float64Var(&ldFlag, "ld", 0.01, "")
+	c.Flags().StringVar(&engineFlag, "engine", string(diffusion.Convolution), "")
 }
 
 func run(c *command.Command, args []string) error {
 	if len(args) < 1 {
 		return c.UsageError("expecting project file")
 	}
+	if snapRadius < 0 {
+		return c.UsageError("flag --snap: value must be greater than 0")
+	}
+	longDist, err := parseKernel()
+	if err != nil {
+		return c.UsageError(err.Error())
+	}
+	engine, err := diffusion.ParseEngine(engineFlag)
+	if err != nil {
+		return c.UsageError(fmt.Sprintf("flag --engine: %v", err))
+	}
 
 	p, err := project.Read(args[0])
 	if err != nil {
@@ -127,6 +203,21 @@ func run(c *command.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	var ar *agerange.Collection
+	if af := p.Path(project.AgeRanges); af != "" {
+		ar, err = readAgeRanges(af, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+	var cn *constraint.Collection
+	if cf := p.Path(project.Constraints); cf != "" {
+		cn, err = readConstraints(cf, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+
 	// check if all terminals have defined ranges
 	for _, tn := range tc.Names() {
 		t := tc.Tree(tn)
@@ -143,14 +234,27 @@ func run(c *command.Command, args []string) error {
 	dm, _ := earth.NewDistMatRingScale(landscape.Pixelation())
 
 	param := diffusion.Param{
-		Landscape: landscape,
-		Rot:       rot,
-		DM:        dm,
-		PW:        pw,
-		Ranges:    rc,
-		Stages:    stages.Stages(),
+		Landscape:   landscape,
+		Rot:         rot,
+		DM:          dm,
+		PW:          pw,
+		Ranges:      rc,
+		AgeRanges:   ar,
+		Constraints: cn,
+		LongDist:    longDist,
+		Engine:      engine,
+		Stages:      stages.Stages(),
+		Cache:       diffusion.NewPDFCache(landscape.Pixelation()),
+		Float32:     float32Flag,
+	}
+
+	var snaps []snapRec
+	if longDist > 0 {
+		fmt.Fprintf(c.Stdout(), "# kernel: mixture, long-distance dispersal: %.6f per My\n", longDist)
+	}
+	if engine != diffusion.Convolution {
+		fmt.Fprintf(c.Stdout(), "# engine: %s\n", engine)
 	}
-
 	fmt.Fprintf(c.Stdout(), "tree\tlambda\tstdDev\tlogLike\tstep\n")
 	for _, tn := range tc.Names() {
 		t := tc.Tree(tn)
@@ -159,6 +263,15 @@ func run(c *command.Command, args []string) error {
 			stem = t.Age(t.Root()) / 10
 		}
 		param.Stem = stem
+		param.Ranges = rc
+		if snapRadius > 0 {
+			var moved []diffusion.Hostile
+			param.Ranges, moved = diffusion.Snap(t, param, snapRadius*1000/earth.Radius)
+			for _, m := range moved {
+				snaps = append(snaps, snapRec{tree: tn, Hostile: m})
+			}
+		}
+		warnHostile(c.Stderr(), t, param)
 
 		b := &bestRec{
 			lambda:  lambdaFlag,
@@ -183,6 +296,15 @@ func run(c *command.Command, args []string) error {
 		fmt.Fprintf(c.Stdout(), "# %s\t%.6f\t%.6f\t<--- best value\n", tn, b.lambda, b.logLike)
 	}
 
+	if snapRadius > 0 {
+		if snapLog == "" {
+			snapLog = args[0] + "-snap.tab"
+		}
+		if err := writeSnapLog(snapLog, args[0], snapRadius, snaps); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -275,6 +397,99 @@ func (b *bestRec) search(w io.Writer, t *timetree.Tree, p diffusion.Param, step
 	}
 }
 
+// WarnHostile reports the terminals of a tree
+// with range pixels with a pixel weight of zero.
+func warnHostile(w io.Writer, t *timetree.Tree, p diffusion.Param) {
+	hostile := make(map[string]int)
+	for _, h := range diffusion.HostilePixels(t, p) {
+		hostile[h.Taxon]++
+	}
+	for _, tax := range t.Terms() {
+		n := hostile[tax]
+		if n == 0 {
+			continue
+		}
+		if n == len(p.Ranges.Range(tax)) {
+			fmt.Fprintf(w, "WARNING: tree %q: taxon %q: all pixels with zero weight: likelihood will be zero\n", t.Name(), tax)
+			continue
+		}
+		fmt.Fprintf(w, "WARNING: tree %q: taxon %q: %d pixels with zero weight\n", t.Name(), tax, n)
+	}
+}
+
+// SnapRec is a pixel moved
+// by the snap preprocessing.
+type snapRec struct {
+	tree string
+	diffusion.Hostile
+}
+
+func writeSnapLog(name, p string, radius float64, moved []snapRec) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if err == nil && e != nil {
+			err = e
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "# diff.ml, project %q\n", p)
+	fmt.Fprintf(w, "# snap radius: %.6f km\n", radius)
+	fmt.Fprintf(w, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "# phygeo: %s\n", version.String())
+
+	tsv := csv.NewWriter(w)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	if err := tsv.Write([]string{"tree", "taxon", "age", "pixel", "value", "snap", "snap-value", "dist"}); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	for _, m := range moved {
+		row := []string{
+			m.tree,
+			m.Taxon,
+			strconv.FormatInt(m.Age, 10),
+			strconv.Itoa(m.Pixel),
+			strconv.Itoa(m.Value),
+			strconv.Itoa(m.Nearest),
+			strconv.Itoa(m.NearestValue),
+			strconv.FormatFloat(m.Dist*earth.Radius/1000, 'f', 3, 64),
+		}
+		if err := tsv.Write(row); err != nil {
+			return fmt.Errorf("while writing data on %q: %v", name, err)
+		}
+	}
+
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	return nil
+}
+
+// ParseKernel returns the probability of a long-distance dispersal
+// per million years
+// of the kernel defined with the flag --kernel.
+func parseKernel() (float64, error) {
+	switch strings.ToLower(kernelFlag) {
+	case "normal":
+		return 0, nil
+	case "mixture":
+		if ldFlag <= 0 || ldFlag >= 1 {
+			return 0, fmt.Errorf("flag --ld: value must be between 0 and 1")
+		}
+		return ldFlag, nil
+	}
+	return 0, fmt.Errorf("flag --kernel: unknown kernel %q", kernelFlag)
+}
+
 func readTreeFile(name string) (*timetree.Collection, error) {
 	f, err := os.Open(name)
 	if err != nil {
@@ -372,6 +587,36 @@ func readRanges(name string) (*ranges.Collection, error) {
 	return coll, nil
 }
 
+func readAgeRanges(name string, pix *earth.Pixelation) (*agerange.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := agerange.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func readConstraints(name string, pix *earth.Pixelation) (*constraint.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := constraint.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
 // CalcStandardDeviation returns the standard deviation
 // (i.e. the square root of variance)
 // in km per million year.
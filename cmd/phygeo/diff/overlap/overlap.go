@@ -0,0 +1,542 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package overlap implements a command to measure
+// the geographic overlap of two clades
+// through time.
+package overlap
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/internal/input"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/version"
+	"github.com/js-arias/timetree"
+)
+
+var Command = &command.Command{
+	Usage: `overlap --tree <tree> --first <node-list> --second <node-list>
+	[--exact] -i|--input <file> [-o|--output <file>] <project-file>`,
+	Short: "measure the overlap of two clades through time",
+	Long: `
+Command overlap reads a file with a probability reconstruction for the nodes
+of a tree in a project, and for two sets of nodes, measures the overlap of
+their reconstructions at each time stage in which both sets are present.
+
+The argument of the command is the name of the project file.
+
+The flag --input, or -i, is required and indicates the input file. The input
+file is a pixel probability file.
+
+The flag --tree is required and indicates the tree to be used.
+
+The flags --first and --second are required and define the two sets of nodes
+to be compared. The format is the node IDs separated by commas, for example
+"1,6" will use nodes 1 and 6. By default, each node indicates a clade, so all
+of its descendant nodes will be included in the set. If the flag --exact is
+given, only the indicated nodes will be used.
+
+At each time stage, the reconstruction of each set is the sum of the
+reconstructions of the nodes in the set, scaled so the sum of all pixels is
+one. Then, the overlap is measured using Schoener's D:
+
+	D = 1 - 1/2 sum |p1(x) - p2(x)|
+
+which is 0 when there is no overlap, and 1 when both reconstructions are
+identical.
+
+The output is a tab-delimited file with the following columns:
+
+	-tree    the name of the tree
+	-age     the age of the time stage, in years
+	-d       the Schoener's D value
+	-shared  the number of pixels with a probability greater than zero
+	         in both sets
+
+By default, the output is printed in the standard output. Use the flag
+--output, or -o, to define an output file.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var exactFlag bool
+var treeName string
+var firstFlag string
+var secondFlag string
+var inputFile string
+var output string
+
+func setFlags(c *command.Command) {
+	c.Flags().BoolVar(&exactFlag, "exact", false, "")
+	c.Flags().StringVar(&treeName, "tree", "", "")
+	c.Flags().StringVar(&firstFlag, "first", "", "")
+	c.Flags().StringVar(&secondFlag, "second", "", "")
+	c.Flags().StringVar(&inputFile, "input", "", "")
+	c.Flags().StringVar(&inputFile, "i", "", "")
+	c.Flags().StringVar(&output, "output", "", "")
+	c.Flags().StringVar(&output, "o", "", "")
+}
+
+func run(c *command.Command, args []string) (err error) {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if inputFile == "" {
+		return c.UsageError("expecting input file, flag --input")
+	}
+	if treeName == "" {
+		return c.UsageError("expecting tree name, flag --tree")
+	}
+	treeName = strings.ToLower(strings.Join(strings.Fields(treeName), " "))
+	if firstFlag == "" || secondFlag == "" {
+		return c.UsageError("expecting node lists, flags --first and --second")
+	}
+	first, err := parseNodes("--first", firstFlag)
+	if err != nil {
+		return err
+	}
+	second, err := parseNodes("--second", secondFlag)
+	if err != nil {
+		return err
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	tf := p.Path(project.Trees)
+	if tf == "" {
+		msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	tc, err := readTreeFile(tf)
+	if err != nil {
+		return err
+	}
+	t := tc.Tree(treeName)
+	if t == nil {
+		return fmt.Errorf("tree %q not found in project %q", treeName, args[0])
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("landscape not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	landscape, err := readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	rt, err := getRec(inputFile, landscape)
+	if err != nil {
+		return err
+	}
+	rec, ok := rt[treeName]
+	if !ok {
+		return fmt.Errorf("tree %q not found in input file %q", treeName, inputFile)
+	}
+
+	if !exactFlag {
+		first = cladeNodes(t, first)
+		second = cladeNodes(t, second)
+	}
+
+	s1 := rec.sum(first)
+	s2 := rec.sum(second)
+
+	w := c.Stdout()
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			e := f.Close()
+			if err == nil && e != nil {
+				err = e
+			}
+		}()
+		w = f
+	}
+	if err := writeOverlap(w, treeName, args[0], s1, s2); err != nil {
+		if output != "" {
+			return fmt.Errorf("while writing data on %q: %v", output, err)
+		}
+		return err
+	}
+	return nil
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func getRec(name string, landscape *model.TimePix) (map[string]*recTree, error) {
+	r, err := input.Open(name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	rt, err := readRecon(r, landscape)
+	if err != nil {
+		return nil, fmt.Errorf("on input file %q: %v", name, err)
+	}
+	return rt, nil
+}
+
+// CladeNodes returns the nodes of the clades
+// defined by the given nodes.
+func cladeNodes(t *timetree.Tree, nodes []int) []int {
+	in := make(map[int]bool, len(nodes))
+	for _, id := range nodes {
+		in[id] = true
+	}
+
+	var clade []int
+	for _, id := range t.Nodes() {
+		for a := id; a >= 0; a = t.Parent(a) {
+			if in[a] {
+				clade = append(clade, id)
+				break
+			}
+		}
+	}
+	return clade
+}
+
+type recTree struct {
+	name  string
+	nodes map[int]*recNode
+}
+
+type recNode struct {
+	id     int
+	tree   *recTree
+	stages map[int64]*recStage
+}
+
+type recStage struct {
+	node *recNode
+	age  int64
+	rec  map[int]float64
+}
+
+// Sum returns the sum of the scaled reconstructions
+// of a set of nodes at each time stage.
+// The returned values are scaled to sum 1.
+func (t *recTree) sum(nodes []int) map[int64]map[int]float64 {
+	stages := make(map[int64]map[int]float64)
+	for _, id := range nodes {
+		n, ok := t.nodes[id]
+		if !ok {
+			continue
+		}
+		for _, s := range n.stages {
+			st, ok := stages[s.age]
+			if !ok {
+				st = make(map[int]float64)
+				stages[s.age] = st
+			}
+			for px, p := range s.rec {
+				st[px] += p
+			}
+		}
+	}
+
+	for _, st := range stages {
+		var sum float64
+		for _, p := range st {
+			sum += p
+		}
+		if sum == 0 {
+			continue
+		}
+		for px, p := range st {
+			st[px] = p / sum
+		}
+	}
+	return stages
+}
+
+var headerFields = []string{
+	"tree",
+	"node",
+	"age",
+	"type",
+	"equator",
+	"pixel",
+	"value",
+}
+
+// ReadRecon reads a pixel probability file
+// and scales the values of each stage
+// so they sum 1.
+func readRecon(r io.Reader, landscape *model.TimePix) (map[string]*recTree, error) {
+	tsv := csv.NewReader(r)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range headerFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	var tp string
+	rt := make(map[string]*recTree)
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "tree"
+		tn := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if tn == "" {
+			continue
+		}
+		tn = strings.ToLower(tn)
+		t, ok := rt[tn]
+		if !ok {
+			t = &recTree{
+				name:  tn,
+				nodes: make(map[int]*recNode),
+			}
+			rt[tn] = t
+		}
+
+		f = "node"
+		id, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		n, ok := t.nodes[id]
+		if !ok {
+			n = &recNode{
+				id:     id,
+				tree:   t,
+				stages: make(map[int64]*recStage),
+			}
+			t.nodes[id] = n
+		}
+
+		f = "age"
+		age, err := strconv.ParseInt(row[fields[f]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		st, ok := n.stages[age]
+		if !ok {
+			st = &recStage{
+				node: n,
+				age:  age,
+				rec:  make(map[int]float64),
+			}
+			n.stages[age] = st
+		}
+
+		f = "type"
+		tpV := strings.ToLower(strings.Join(strings.Fields(row[fields[f]]), " "))
+		if tpV == "" {
+			return nil, fmt.Errorf("on row %d: field %q: expecting reconstruction type", ln, f)
+		}
+		if tp == "" {
+			tp = tpV
+		}
+		if tp != tpV {
+			return nil, fmt.Errorf("on row %d: field %q: got %q want %q", ln, f, tpV, tp)
+		}
+
+		f = "equator"
+		eq, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if eq != landscape.Pixelation().Equator() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid equator value %d", ln, f, eq)
+		}
+
+		f = "pixel"
+		px, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if px >= landscape.Pixelation().Len() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, px)
+		}
+
+		f = "value"
+		v, err := strconv.ParseFloat(row[fields[f]], 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		st.rec[px] = v
+	}
+	if len(rt) == 0 {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+
+	for _, t := range rt {
+		for _, n := range t.nodes {
+			for _, s := range n.stages {
+				if tp == "log-like" {
+					max := -math.MaxFloat64
+					for _, p := range s.rec {
+						if p > max {
+							max = p
+						}
+					}
+					for px, p := range s.rec {
+						s.rec[px] = math.Exp(p - max)
+					}
+				}
+
+				var sum float64
+				for _, p := range s.rec {
+					sum += p
+				}
+				if sum == 0 {
+					continue
+				}
+				for px, p := range s.rec {
+					s.rec[px] = p / sum
+				}
+			}
+		}
+	}
+
+	return rt, nil
+}
+
+func writeOverlap(w io.Writer, tree, p string, s1, s2 map[int64]map[int]float64) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# clade overlap, tree %q, project %q\n", tree, p)
+	fmt.Fprintf(bw, "# first: %s\n", firstFlag)
+	fmt.Fprintf(bw, "# second: %s\n", secondFlag)
+	fmt.Fprintf(bw, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(bw, "# phygeo: %s\n", version.String())
+
+	tsv := csv.NewWriter(bw)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	if err := tsv.Write([]string{"tree", "age", "d", "shared"}); err != nil {
+		return err
+	}
+
+	ages := make([]int64, 0, len(s1))
+	for a := range s1 {
+		if _, ok := s2[a]; !ok {
+			continue
+		}
+		ages = append(ages, a)
+	}
+	slices.Sort(ages)
+
+	for i := len(ages) - 1; i >= 0; i-- {
+		a := ages[i]
+		r1, r2 := s1[a], s2[a]
+
+		var diff float64
+		shared := 0
+		for px, p := range r1 {
+			q := r2[px]
+			diff += math.Abs(p - q)
+			if p > 0 && q > 0 {
+				shared++
+			}
+		}
+		for px, q := range r2 {
+			if _, ok := r1[px]; ok {
+				continue
+			}
+			diff += q
+		}
+
+		row := []string{
+			tree,
+			strconv.FormatInt(a, 10),
+			strconv.FormatFloat(1-diff/2, 'f', 6, 64),
+			strconv.Itoa(shared),
+		}
+		if err := tsv.Write(row); err != nil {
+			return err
+		}
+	}
+
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parseNodes(flag, val string) ([]int, error) {
+	ids := strings.Split(val, ",")
+	nodes := make([]int, 0, len(ids))
+	for _, id := range ids {
+		n, err := strconv.Atoi(strings.TrimSpace(id))
+		if err != nil {
+			return nil, fmt.Errorf("on flag %s: %v", flag, err)
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
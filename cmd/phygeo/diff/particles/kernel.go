@@ -0,0 +1,101 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package particles
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const kernelComment = "# kernel:"
+
+// A kernelReader reads the lines of a down-pass file,
+// and stores the dispersal kernel
+// defined in the comments of the file
+// (written by 'diff like').
+type kernelReader struct {
+	r    *bufio.Reader
+	line []byte
+
+	// the kernel was defined in the file
+	defined bool
+
+	// probability of a long-distance dispersal
+	// per million years
+	longDist float64
+}
+
+func newKernelReader(r io.Reader) *kernelReader {
+	return &kernelReader{r: bufio.NewReader(r)}
+}
+
+func (kr *kernelReader) Read(p []byte) (int, error) {
+	if len(kr.line) == 0 {
+		ln, err := kr.r.ReadBytes('\n')
+		if len(ln) == 0 {
+			return 0, err
+		}
+		if err := kr.parse(string(ln)); err != nil {
+			return 0, err
+		}
+		kr.line = ln
+	}
+	n := copy(p, kr.line)
+	kr.line = kr.line[n:]
+	return n, nil
+}
+
+// Parse reads the kernel of a comment line.
+// It returns an error
+// if the kernel is not supported,
+// or if the file has different kernels.
+func (kr *kernelReader) parse(ln string) error {
+	v, ok := strings.CutPrefix(ln, kernelComment)
+	if !ok {
+		return nil
+	}
+	ld, err := parseKernel(v)
+	if err != nil {
+		return err
+	}
+	if kr.defined && ld != kr.longDist {
+		return fmt.Errorf("input with different kernels")
+	}
+	kr.defined = true
+	kr.longDist = ld
+	return nil
+}
+
+// ParseKernel returns the probability of a long-distance dispersal
+// per million years
+// of a kernel comment,
+// for example:
+//
+//	# kernel: mixture, long-distance dispersal: 0.050000 per My
+func parseKernel(v string) (float64, error) {
+	name, rest, _ := strings.Cut(strings.TrimSpace(v), ",")
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "normal":
+		return 0, nil
+	case "mixture":
+		f, ok := strings.CutPrefix(strings.TrimSpace(rest), "long-distance dispersal:")
+		fs := strings.Fields(f)
+		if !ok || len(fs) == 0 {
+			return 0, fmt.Errorf("kernel %q: undefined long-distance dispersal", strings.TrimSpace(v))
+		}
+		ld, err := strconv.ParseFloat(fs[0], 64)
+		if err != nil {
+			return 0, fmt.Errorf("kernel %q: %v", strings.TrimSpace(v), err)
+		}
+		if ld <= 0 || ld >= 1 {
+			return 0, fmt.Errorf("kernel %q: long-distance dispersal must be between 0 and 1", strings.TrimSpace(v))
+		}
+		return ld, nil
+	}
+	return 0, fmt.Errorf("unsupported kernel %q", strings.TrimSpace(name))
+}
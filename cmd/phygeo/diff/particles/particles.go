@@ -14,8 +14,10 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"math/rand/v2"
 	"os"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -25,17 +27,23 @@ import (
 	"github.com/js-arias/earth/model"
 	"github.com/js-arias/earth/stat/dist"
 	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/agerange"
+	"github.com/js-arias/phygeo/constraint"
 	"github.com/js-arias/phygeo/infer/diffusion"
+	"github.com/js-arias/phygeo/internal/input"
+	"github.com/js-arias/phygeo/internal/shard"
 	"github.com/js-arias/phygeo/project"
 	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/phygeo/version"
 	"github.com/js-arias/ranges"
 	"github.com/js-arias/timetree"
 )
 
 var Command = &command.Command{
 	Usage: `particles [-p|--particles <number>]
+	[--root-pixel <id|lat,lon>] [--root-range <file>]
 	-i|--input <file> [-o|--output <file>]
-	[--cpu <number>] <project-file>`,
+	[--shard <i/n>] [--seed <number>] [--cpu <number>] <project-file>`,
 	Short: "perform a stochastic mapping",
 	Long: `
 Command particles reads a file with the conditional likelihoods of one or more
@@ -47,19 +55,67 @@ By default, 1000 particles will be simulated for the stochastic mapping. The
 number of particles can be changed with the flag --particles, or -p.
 
 The flag --input, or -i, is required and indicates the input file. The input
-file is a pixel probability file with stored log-likelihoods.
+file is a pixel probability file with stored log-likelihoods. If the input is
+"-", the file will be read from the standard input.
 
 The prefix for the name of the output file will be the name of the project
 file. To set a different prefix, use the flag --output, or -o. The full file
 name will be the prefix, the tree name, the value of lambda, and the number of
-particles.
+particles. If the output is "-", the results of all trees will be written to
+the standard output.
+
+The dispersal kernel is the kernel used to calculate the conditional
+likelihoods, as reported in the header of the input file by the command 'diff
+like' (if no kernel is reported, the spherical normal is used). If the input
+file has different kernels, or a kernel that is not supported, the command
+will fail.
+
+The input file can contain the conditional likelihoods of a tree for several
+lambda values (for example, the down-pass files of the command 'diff like' run
+with different values of the flag --lambda, combined with the command 'phygeo
+concat'). In that case, the stochastic mapping will be made for each lambda
+value, and each particle will be weighted by the likelihood of its lambda
+value (i.e., the lambda values are taken as samples from the prior, so the
+likelihood is the importance weight of each sample). The weights are scaled
+so their sum is 1, and the output file name will use the word 'weighted'
+instead of the lambda value.
+
+By default, the location of the root is drawn from the whole root
+reconstruction. To condition the stochastic mapping on a hypothesized origin,
+use the flag --root-pixel, with the ID of a pixel, or the latitude and
+longitude of a point separated by a comma (e.g., "-30,-60"), or the flag
+--root-range, with a range file (in the format used by 'phygeo range'), in
+which case all the pixels with a density greater than zero will be used. The
+pixel locations are at the time stage of the root (i.e., at the start of the
+root stem), and the root will be drawn only from the indicated pixels. The
+log-likelihood reported in the output file will be the likelihood
+conditional on the root region, and the log-likelihood penalty (i.e., the
+difference between the unconditional and the conditional log-likelihoods)
+will be also reported. If there are several lambda values, the importance
+weights will use the conditional likelihoods.
 
 The output file is a TSV file, indicating the name of the tree, the number of
-the particle simulation, the node, the age of the node time stage, and the
-pixel location of the particle at the beginning and end of the stage.
+the particle simulation, the node, the age of the node time stage, the lambda
+value, the weight of the particle, and the pixel location of the particle at
+the beginning and end of the stage. If the input file has a single lambda
+value for a tree, the weight of all particles will be 1. The weights are used
+by the commands 'diff freq' and 'diff speed'.
 
 By default, all available CPUs will be used in the processing. Set the --cpu
 flag to use a different number of CPUs.
+
+Each particle uses its own stream of random numbers, derived from a seed, so
+for a given seed, the results are the same regardless of the number of CPUs
+used. By default, a random seed is used; use the flag --seed to set the seed
+(a positive integer). The seed is reported in the header of the output file.
+
+To split the analysis of an input file with several trees into independent
+jobs (e.g., as an array job in a cluster), use the flag --shard with a value
+"i/n", in which n is the number of jobs, and i is the job number (from 1 to
+n). Trees are assigned to the jobs in order of their names, so the tree k
+(starting at 0) will be analyzed by the job (k mod n) + 1. If the output is
+written in the standard output, the outputs of each job can be combined with
+the command 'phygeo concat'.
 	`,
 	SetFlags: setFlags,
 	Run:      run,
@@ -69,6 +125,15 @@ var numCPU int
 var numParticles int
 var inputFile string
 var outPrefix string
+var shardFlag string
+var jobShard shard.Shard
+var rootPixel string
+var rootRange string
+var seedFlag uint64
+
+// probability of a long-distance dispersal
+// of the kernel of the input file
+var longDist float64
 
 func setFlags(c *command.Command) {
 	c.Flags().IntVar(&numCPU, "cpu", runtime.GOMAXPROCS(0), "")
@@ -78,12 +143,24 @@ func setFlags(c *command.Command) {
 	c.Flags().StringVar(&inputFile, "i", "", "")
 	c.Flags().StringVar(&outPrefix, "output", "", "")
 	c.Flags().StringVar(&outPrefix, "o", "", "")
+	c.Flags().StringVar(&shardFlag, "shard", "", "")
+	c.Flags().StringVar(&rootPixel, "root-pixel", "", "")
+	c.Flags().StringVar(&rootRange, "root-range", "", "")
+	c.Flags().Uint64Var(&seedFlag, "seed", 0, "")
 }
 
 func run(c *command.Command, args []string) error {
 	if len(args) < 1 {
 		return c.UsageError("expecting project file")
 	}
+	var err error
+	jobShard, err = shard.Parse(shardFlag)
+	if err != nil {
+		return c.UsageError(fmt.Sprintf("flag --shard: %v", err))
+	}
+	if rootPixel != "" && rootRange != "" {
+		return c.UsageError("flags --root-pixel and --root-range are mutually exclusive")
+	}
 
 	p, err := project.Read(args[0])
 	if err != nil {
@@ -144,59 +221,136 @@ func run(c *command.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	var ar *agerange.Collection
+	if af := p.Path(project.AgeRanges); af != "" {
+		ar, err = readAgeRanges(af, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+	var cn *constraint.Collection
+	if cf := p.Path(project.Constraints); cf != "" {
+		cn, err = readConstraints(cf, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+
+	region, err := rootRegion(landscape.Pixelation())
+	if err != nil {
+		return err
+	}
 
 	dm, _ := earth.NewDistMatRingScale(landscape.Pixelation())
 
-	rt, err := getRec(inputFile, landscape)
+	rt, ld, err := getRec(inputFile, c.Stdin(), landscape)
 	if err != nil {
 		return err
 	}
+	longDist = ld
 
 	// Set the number of parallel processors
 	diffusion.SetCPU(numCPU)
 
-	param := diffusion.Param{
-		Landscape: landscape,
-		Rot:       rot,
-		DM:        dm,
-		PW:        pw,
-		Ranges:    rc,
-		Stages:    stages.Stages(),
+	if seedFlag == 0 {
+		seedFlag = rand.Uint64()
 	}
 
-	for _, t := range rt {
-		ct := tc.Tree(t.name)
+	param := diffusion.Param{
+		Landscape:   landscape,
+		Rot:         rot,
+		DM:          dm,
+		PW:          pw,
+		Ranges:      rc,
+		AgeRanges:   ar,
+		Constraints: cn,
+		Stages:      stages.Stages(),
+		LongDist:    longDist,
+	}
+
+	// when writing to the standard output
+	// the header is only written for the first tree
+	stdout := bufio.NewWriter(c.Stdout())
+	header := true
+
+	names := make([]string, 0, len(rt))
+	for tn := range rt {
+		names = append(names, tn)
+	}
+	slices.Sort(names)
+
+	for i, tn := range names {
+		if !jobShard.Has(i) {
+			continue
+		}
+		ct := tc.Tree(tn)
 		if ct == nil {
 			continue
 		}
-		param.Lambda = t.lambda
-		param.Stem = t.oldest - ct.Age(ct.Root())
-		standard := calcStandardDeviation(landscape.Pixelation(), t.lambda)
 
-		dt := diffusion.New(ct, param)
-		nodes := dt.Nodes()
-		for _, n := range nodes {
-			nn, ok := t.nodes[n]
-			if !ok {
-				return fmt.Errorf("tree %q: node %d: undefined node", dt.Name(), n)
-			}
-			stages := dt.Stages(n)
+		samples := make([]*lambdaTree, 0, len(rt[tn]))
+		for _, t := range rt[tn] {
+			param.Lambda = t.lambda
+			param.Stem = t.oldest - ct.Age(ct.Root())
 
-			for _, a := range stages {
-				s, ok := nn.stages[a]
+			dt := diffusion.New(ct, param)
+			nodes := dt.Nodes()
+			for _, n := range nodes {
+				nn, ok := t.nodes[n]
 				if !ok {
-					return fmt.Errorf("tree %q: node %d: age %d: undefined conditional likelihood", dt.Name(), n, a)
+					return fmt.Errorf("tree %q: lambda %.6f: node %d: undefined node", dt.Name(), t.lambda, n)
+				}
+				stages := dt.Stages(n)
+
+				for _, a := range stages {
+					s, ok := nn.stages[a]
+					if !ok {
+						return fmt.Errorf("tree %q: lambda %.6f: node %d: age %d: undefined conditional likelihood", dt.Name(), t.lambda, n, a)
+					}
+
+					dt.SetConditional(n, a, s.rec)
 				}
+			}
+			lt := &lambdaTree{
+				dt:       dt,
+				lambda:   t.lambda,
+				standard: calcStandardDeviation(landscape.Pixelation(), t.lambda),
+				logLike:  dt.LogLike(),
+			}
+			if region != nil {
+				if err := conditionRoot(dt, t, ct.Root(), region); err != nil {
+					return err
+				}
+				lt.penalty = lt.logLike
+				lt.logLike = dt.LogLike()
+				lt.penalty -= lt.logLike
+			}
+			dt.SetSeed(treeSeed(i, len(samples)))
+			samples = append(samples, lt)
+		}
+		setWeights(samples)
 
-				dt.SetConditional(n, a, s.rec)
+		if outPrefix == "-" {
+			if err := upPass(stdout, samples, args[0], numParticles, landscape.Pixelation().Equator(), header); err != nil {
+				return fmt.Errorf("while writing on standard output: %v", err)
 			}
+			header = false
+			continue
 		}
 
-		name := fmt.Sprintf("%s-%s-%.6fx%d.tab", outPrefix, dt.Name(), t.lambda, numParticles)
-		if err := upPass(dt, name, args[0], t.lambda, standard, numParticles, landscape.Pixelation().Equator()); err != nil {
+		name := fmt.Sprintf("%s-%s-%.6fx%d.tab", outPrefix, tn, samples[0].lambda, numParticles)
+		if len(samples) > 1 {
+			name = fmt.Sprintf("%s-%s-weighted-x%d.tab", outPrefix, tn, numParticles)
+		}
+		if err := writeUpPass(name, samples, args[0], numParticles, landscape.Pixelation().Equator()); err != nil {
 			return err
 		}
 	}
+	if outPrefix == "-" {
+		if err := stdout.Flush(); err != nil {
+			return fmt.Errorf("while writing on standard output: %v", err)
+		}
+	}
 
 	return nil
 }
@@ -298,18 +452,52 @@ func readRanges(name string) (*ranges.Collection, error) {
 	return coll, nil
 }
 
-func getRec(name string, landscape *model.TimePix) (map[string]*recTree, error) {
+func readAgeRanges(name string, pix *earth.Pixelation) (*agerange.Collection, error) {
 	f, err := os.Open(name)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	rt, err := readRecon(f, landscape)
+	coll, err := agerange.ReadTSV(f, pix)
 	if err != nil {
-		return nil, fmt.Errorf("on input file %q: %v", name, err)
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
 	}
-	return rt, nil
+
+	return coll, nil
+}
+
+func readConstraints(name string, pix *earth.Pixelation) (*constraint.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := constraint.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+// GetRec reads the conditional likelihoods
+// of an input file,
+// and the probability of a long-distance dispersal
+// of the dispersal kernel used in the file.
+func getRec(name string, stdin io.Reader, landscape *model.TimePix) (map[string][]*recTree, float64, error) {
+	r, err := input.Open(name, stdin)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+	kr := newKernelReader(r)
+	rt, err := readRecon(kr, landscape)
+	if err != nil {
+		return nil, 0, fmt.Errorf("on input file %q: %v", name, err)
+	}
+	return rt, kr.longDist, nil
 }
 
 type recTree struct {
@@ -342,7 +530,12 @@ var headerFields = []string{
 	"value",
 }
 
-func readRecon(r io.Reader, landscape *model.TimePix) (map[string]*recTree, error) {
+// ReadRecon reads the conditional likelihoods
+// of each tree
+// for each lambda value.
+// The down-passes of each tree
+// are sorted by lambda.
+func readRecon(r io.Reader, landscape *model.TimePix) (map[string][]*recTree, error) {
 	tsv := csv.NewReader(r)
 	tsv.Comma = '\t'
 	tsv.Comment = '#'
@@ -362,7 +555,12 @@ func readRecon(r io.Reader, landscape *model.TimePix) (map[string]*recTree, erro
 		}
 	}
 
-	rt := make(map[string]*recTree)
+	type treeLambda struct {
+		name   string
+		lambda float64
+	}
+
+	rt := make(map[treeLambda]*recTree)
 	for {
 		row, err := tsv.Read()
 		if errors.Is(err, io.EOF) {
@@ -391,17 +589,15 @@ func readRecon(r io.Reader, landscape *model.TimePix) (map[string]*recTree, erro
 			continue
 		}
 		tn = strings.ToLower(tn)
-		t, ok := rt[tn]
+		key := treeLambda{name: tn, lambda: lambda}
+		t, ok := rt[key]
 		if !ok {
 			t = &recTree{
 				name:   tn,
 				nodes:  make(map[int]*recNode),
 				lambda: lambda,
 			}
-			rt[tn] = t
-		}
-		if t.lambda != lambda {
-			return nil, fmt.Errorf("on row %d: field %q: got %.6f want %.6f", ln, "lambda", lambda, t.lambda)
+			rt[key] = t
 		}
 
 		f = "node"
@@ -467,7 +663,72 @@ func readRecon(r io.Reader, landscape *model.TimePix) (map[string]*recTree, erro
 		return nil, fmt.Errorf("while reading data: %v", io.EOF)
 	}
 
-	return rt, nil
+	trees := make(map[string][]*recTree)
+	for k, t := range rt {
+		trees[k.name] = append(trees[k.name], t)
+	}
+	for _, ls := range trees {
+		slices.SortFunc(ls, func(a, b *recTree) int {
+			if a.lambda < b.lambda {
+				return -1
+			}
+			if a.lambda > b.lambda {
+				return 1
+			}
+			return 0
+		})
+	}
+	return trees, nil
+}
+
+// A lambdaTree is the down-pass of a tree
+// for a lambda value.
+type lambdaTree struct {
+	dt       *diffusion.Tree
+	lambda   float64
+	standard float64
+	logLike  float64
+
+	// log-likelihood penalty
+	// of the root condition
+	penalty float64
+
+	// importance weight
+	// of the lambda value
+	weight float64
+}
+
+// SetWeights sets the importance weights
+// of the lambda values of a tree,
+// proportional to the likelihood of each value.
+// The sum of the weights is 1.
+func setWeights(samples []*lambdaTree) {
+	max := -math.MaxFloat64
+	for _, s := range samples {
+		if s.logLike > max {
+			max = s.logLike
+		}
+	}
+
+	var sum float64
+	for _, s := range samples {
+		s.weight = math.Exp(s.logLike - max)
+		sum += s.weight
+	}
+	for _, s := range samples {
+		s.weight /= sum
+	}
+}
+
+// TreeSeed returns the seed of the stochastic mapping
+// of a lambda sample of a tree,
+// from the seed of the run.
+// Trees are identified by their index
+// in the sorted list of tree names,
+// so the seed does not depend on the shard.
+func treeSeed(tree, sample int) uint64 {
+	r := rand.New(rand.NewPCG(seedFlag, uint64(tree)<<32|uint64(sample)))
+	return r.Uint64()
 }
 
 // CalcStandardDeviation returns the standard deviation
@@ -479,9 +740,7 @@ func calcStandardDeviation(pix *earth.Pixelation, lambda float64) float64 {
 	return math.Sqrt(v) * earth.Radius / 1000
 }
 
-func upPass(t *diffusion.Tree, name, p string, lambda, standard float64, particles, eq int) (err error) {
-	t.Simulate(particles)
-
+func writeUpPass(name string, samples []*lambdaTree, p string, particles, eq int) (err error) {
 	f, err := os.Create(name)
 	if err != nil {
 		return err
@@ -494,46 +753,96 @@ func upPass(t *diffusion.Tree, name, p string, lambda, standard float64, particl
 	}()
 
 	w := bufio.NewWriter(f)
-	tsv, err := outHeader(w, t.Name(), p, lambda, standard, t.LogLike())
+	if err := upPass(w, samples, p, particles, eq, true); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	return nil
+}
+
+// UpPass performs the stochastic mapping of a tree
+// for each lambda value
+// and writes the particles.
+// If header is false,
+// the column names will not be written.
+func upPass(w io.Writer, samples []*lambdaTree, p string, particles, eq int, header bool) error {
+	tsv, err := outHeader(w, samples, p, header)
 	if err != nil {
-		return fmt.Errorf("while writing header on %q: %v", name, err)
+		return err
 	}
 
-	for i := 0; i < particles; i++ {
-		if err := writeUpPass(tsv, i, t, lambda, eq); err != nil {
-			return fmt.Errorf("while writing data on %q: %v", name, err)
+	for k, s := range samples {
+		s.dt.Simulate(particles)
+		for i := 0; i < particles; i++ {
+			// particle IDs are unique
+			// across lambda values
+			id := k*particles + i
+			if err := writeParticle(tsv, id, i, s, eq); err != nil {
+				return err
+			}
 		}
 	}
 
 	tsv.Flush()
 	if err := tsv.Error(); err != nil {
-		return fmt.Errorf("while writing data on %q: %v", name, err)
-	}
-	if err := w.Flush(); err != nil {
-		return fmt.Errorf("while writing data on %q: %v", name, err)
+		return err
 	}
 	return nil
 }
 
-func outHeader(w io.Writer, t, p string, lambda, standard, logLike float64) (*csv.Writer, error) {
-	fmt.Fprintf(w, "# stochastic mapping on tree %q of project %q\n", t, p)
-	fmt.Fprintf(w, "# lambda: %.6f * 1/radian^2\n", lambda)
-	fmt.Fprintf(w, "# standard deviation: %.6f * Km/My\n", standard)
-	fmt.Fprintf(w, "# logLikelihood: %.6f\n", logLike)
+func outHeader(w io.Writer, samples []*lambdaTree, p string, header bool) (*csv.Writer, error) {
+	fmt.Fprintf(w, "# stochastic mapping on tree %q of project %q\n", samples[0].dt.Name(), p)
+	if rootPixel != "" {
+		fmt.Fprintf(w, "# root condition: pixel %s\n", rootPixel)
+	}
+	if rootRange != "" {
+		fmt.Fprintf(w, "# root condition: range file %q\n", rootRange)
+	}
+	if len(samples) == 1 {
+		fmt.Fprintf(w, "# lambda: %.6f * 1/radian^2\n", samples[0].lambda)
+		fmt.Fprintf(w, "# standard deviation: %.6f * Km/My\n", samples[0].standard)
+		fmt.Fprintf(w, "# logLikelihood: %.6f\n", samples[0].logLike)
+		if rootPixel != "" || rootRange != "" {
+			fmt.Fprintf(w, "# root condition penalty: %.6f\n", samples[0].penalty)
+		}
+	} else {
+		fmt.Fprintf(w, "# lambda values: %d\n", len(samples))
+		for _, s := range samples {
+			fmt.Fprintf(w, "# lambda: %.6f * 1/radian^2: standard deviation: %.6f * Km/My: logLikelihood: %.6f: weight: %.6f", s.lambda, s.standard, s.logLike, s.weight)
+			if rootPixel != "" || rootRange != "" {
+				fmt.Fprintf(w, ": root condition penalty: %.6f", s.penalty)
+			}
+			fmt.Fprintf(w, "\n")
+		}
+	}
+	if longDist > 0 {
+		fmt.Fprintf(w, "# kernel: mixture, long-distance dispersal: %.6f per My\n", longDist)
+	}
 	fmt.Fprintf(w, "# up-pass particles: %d\n", numParticles)
+	fmt.Fprintf(w, "# seed: %d\n", seedFlag)
 	fmt.Fprintf(w, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "# phygeo: %s\n", version.String())
 
 	tsv := csv.NewWriter(w)
 	tsv.Comma = '\t'
 	tsv.UseCRLF = true
-	if err := tsv.Write([]string{"tree", "particle", "node", "age", "lambda", "equator", "from", "to"}); err != nil {
+	if !header {
+		return tsv, nil
+	}
+	if err := tsv.Write([]string{"tree", "particle", "node", "age", "lambda", "weight", "equator", "from", "to"}); err != nil {
 		return nil, err
 	}
 
 	return tsv, nil
 }
 
-func writeUpPass(tsv *csv.Writer, p int, t *diffusion.Tree, lambda float64, eq int) error {
+// WriteParticle writes the particle p
+// of the down-pass of a lambda value,
+// using id as the particle ID.
+func writeParticle(tsv *csv.Writer, id, p int, s *lambdaTree, eq int) error {
+	t := s.dt
 	nodes := t.Nodes()
 
 	for _, n := range nodes {
@@ -548,10 +857,11 @@ func writeUpPass(tsv *csv.Writer, p int, t *diffusion.Tree, lambda float64, eq i
 			}
 			row := []string{
 				t.Name(),
-				strconv.Itoa(p),
+				strconv.Itoa(id),
 				strconv.Itoa(n),
 				strconv.FormatInt(a, 10),
-				strconv.FormatFloat(lambda, 'f', 6, 64),
+				strconv.FormatFloat(s.lambda, 'f', 6, 64),
+				strconv.FormatFloat(s.weight, 'g', 6, 64),
 				strconv.Itoa(eq),
 				strconv.Itoa(st.From),
 				strconv.Itoa(st.To),
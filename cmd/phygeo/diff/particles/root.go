@@ -0,0 +1,122 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package particles
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/js-arias/earth"
+	"github.com/js-arias/phygeo/infer/diffusion"
+	"github.com/js-arias/ranges"
+)
+
+// RootRegion returns the pixels
+// used to condition the root of the trees,
+// defined by the flags --root-pixel or --root-range.
+// If no flag is defined,
+// it returns nil.
+func rootRegion(pix *earth.Pixelation) (map[int]bool, error) {
+	if rootPixel != "" {
+		px, err := parseRootPixel(rootPixel, pix)
+		if err != nil {
+			return nil, fmt.Errorf("flag --root-pixel: %v", err)
+		}
+		return map[int]bool{px: true}, nil
+	}
+	if rootRange == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(rootRange)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := ranges.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", rootRange, err)
+	}
+
+	region := make(map[int]bool)
+	for _, tax := range coll.Taxa() {
+		for px, d := range coll.Range(tax) {
+			if d > 0 {
+				region[px] = true
+			}
+		}
+	}
+	if len(region) == 0 {
+		return nil, fmt.Errorf("flag --root-range: file %q without pixels", rootRange)
+	}
+	return region, nil
+}
+
+// ParseRootPixel returns the pixel ID
+// of a pixel defined as an ID,
+// or as a latitude, longitude pair.
+func parseRootPixel(val string, pix *earth.Pixelation) (int, error) {
+	coords := strings.Split(val, ",")
+	if len(coords) == 1 {
+		px, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil {
+			return 0, err
+		}
+		if px < 0 || px >= pix.Len() {
+			return 0, fmt.Errorf("invalid pixel value %d", px)
+		}
+		return px, nil
+	}
+	if len(coords) != 2 {
+		return 0, fmt.Errorf("invalid value %q: expecting <id> or <lat,lon>", val)
+	}
+
+	lat, err := strconv.ParseFloat(strings.TrimSpace(coords[0]), 64)
+	if err != nil {
+		return 0, err
+	}
+	if lat < -90 || lat > 90 {
+		return 0, fmt.Errorf("invalid latitude %.6f", lat)
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(coords[1]), 64)
+	if err != nil {
+		return 0, err
+	}
+	if lon < -180 || lon > 180 {
+		return 0, fmt.Errorf("invalid longitude %.6f", lon)
+	}
+	return pix.Pixel(lat, lon).ID(), nil
+}
+
+// ConditionRoot sets the conditional likelihood
+// of the root of a tree
+// so only the pixels of the root region
+// are valid.
+func conditionRoot(dt *diffusion.Tree, t *recTree, root int, region map[int]bool) error {
+	n, ok := t.nodes[root]
+	if !ok {
+		return fmt.Errorf("tree %q: lambda %.6f: node %d: undefined node", dt.Name(), t.lambda, root)
+	}
+	s, ok := n.stages[t.oldest]
+	if !ok {
+		return fmt.Errorf("tree %q: lambda %.6f: node %d: age %d: undefined conditional likelihood", dt.Name(), t.lambda, root, t.oldest)
+	}
+
+	logLike := make(map[int]float64, len(region))
+	for px, p := range s.rec {
+		if !region[px] {
+			continue
+		}
+		logLike[px] = p
+	}
+	if len(logLike) == 0 {
+		return fmt.Errorf("tree %q: lambda %.6f: root region without likelihood", dt.Name(), t.lambda)
+	}
+	dt.SetConditional(root, t.oldest, logLike)
+	return nil
+}
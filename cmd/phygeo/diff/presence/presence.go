@@ -0,0 +1,647 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package presence implements a command to test
+// the presence of a node in a region
+// using a Bayes factor.
+package presence
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/internal/geobox"
+	"github.com/js-arias/phygeo/internal/input"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/version"
+)
+
+var Command = &command.Command{
+	Usage: `presence --tree <tree> --node <node> [--age <age>]
+	[--box <lat,lon,lat,lon>] [--values <value-list>]
+	-i|--input <file> [-o|--output <file>] <project-file>`,
+	Short: "test the presence of a node in a region",
+	Long: `
+Command presence reads a file with a probability reconstruction for the nodes
+of a tree in a project, and for a node at a time stage, compares the posterior
+odds of the node being inside a region against the prior odds, and reports
+the Bayes factor of presence in the region.
+
+The argument of the command is the name of the project file.
+
+The flag --input, or -i, is required and indicates the input file. The input
+file is a pixel probability file.
+
+The flag --tree is required and indicates the tree to be used.
+
+The flag --node is required and indicates the ID of the node to be tested.
+
+By default, the time stage used is the youngest time stage of the node (i.e.,
+the time of the split). Use the flag --age to define a different time stage,
+in million years. The closest time stage of the node in the input file will be
+used.
+
+The region must be defined with one of the following flags. The flag --box
+defines a box using the latitude and longitude of two opposite corners, in
+present coordinates, for example "-10,-80,-40,-50". The first corner is the
+western corner, and the second corner is the eastern corner, so a box that
+crosses the antimeridian is defined with a western longitude greater than the
+eastern longitude, for example "-10,170,-30,-170". The pixels of the box are
+rotated to the time stage using the plate motion model of the project. The
+flag --values defines the region using the landscape values of the pixels at
+the time stage. The format is the values separated by commas, for example,
+"1,2" will use all the pixels with the values 1 or 2.
+
+The posterior probability of the region is the sum of the scaled
+probabilities of the pixels in the region. The prior probability of the
+region is the sum of the pixel weights of the pixels in the region, scaled by
+the sum of the weights of all pixels at the time stage (i.e., the prior
+defined by the pixel weights of the project). The Bayes factor is the ratio of
+the posterior odds over the prior odds:
+
+	BF = (post / (1 - post)) / (prior / (1 - prior))
+
+A Bayes factor greater than one supports the presence of the node in the
+region, and a value smaller than one supports its absence. If all the
+posterior probability is inside (or outside) the region, the Bayes factor will
+be infinite (or zero).
+
+The output is a tab-delimited file with the following columns:
+
+	-tree       the name of the tree
+	-node       the ID of the node
+	-age        the age of the time stage, in years
+	-posterior  the posterior probability of the region
+	-prior      the prior probability of the region
+	-postOdds   the posterior odds of the region
+	-priorOdds  the prior odds of the region
+	-bf         the Bayes factor
+	-log10bf    the logarithm (base 10) of the Bayes factor
+
+By default, the output is printed in the standard output. Use the flag
+--output, or -o, to define an output file.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var nodeFlag int
+var ageFlag float64
+var treeName string
+var boxFlag string
+var valuesFlag string
+var inputFile string
+var output string
+
+func setFlags(c *command.Command) {
+	c.Flags().IntVar(&nodeFlag, "node", -1, "")
+	c.Flags().Float64Var(&ageFlag, "age", -1, "")
+	c.Flags().StringVar(&treeName, "tree", "", "")
+	c.Flags().StringVar(&boxFlag, "box", "", "")
+	c.Flags().StringVar(&valuesFlag, "values", "", "")
+	c.Flags().StringVar(&inputFile, "input", "", "")
+	c.Flags().StringVar(&inputFile, "i", "", "")
+	c.Flags().StringVar(&output, "output", "", "")
+	c.Flags().StringVar(&output, "o", "", "")
+}
+
+func run(c *command.Command, args []string) (err error) {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if inputFile == "" {
+		return c.UsageError("expecting input file, flag --input")
+	}
+	if treeName == "" {
+		return c.UsageError("expecting tree name, flag --tree")
+	}
+	treeName = strings.ToLower(strings.Join(strings.Fields(treeName), " "))
+	if nodeFlag < 0 {
+		return c.UsageError("expecting node ID, flag --node")
+	}
+	if (boxFlag == "") == (valuesFlag == "") {
+		return c.UsageError("expecting a region, flag --box or flag --values")
+	}
+
+	var bx geobox.Box
+	var values map[int]bool
+	if boxFlag != "" {
+		bx, err = geobox.Parse(boxFlag)
+		if err != nil {
+			return fmt.Errorf("on flag --box: %v", err)
+		}
+	} else {
+		values, err = parseValues(valuesFlag)
+		if err != nil {
+			return err
+		}
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("landscape not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	landscape, err := readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	pwf := p.Path(project.PixWeight)
+	if pwf == "" {
+		msg := fmt.Sprintf("pixel weights not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	pw, err := readPixWeights(pwf)
+	if err != nil {
+		return err
+	}
+
+	var tot *model.Total
+	if boxFlag != "" {
+		rotF := p.Path(project.GeoMotion)
+		if rotF == "" {
+			msg := fmt.Sprintf("plate motion model not defined in project %q", args[0])
+			return c.UsageError(msg)
+		}
+		tot, err = readRotation(rotF, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+
+	rt, err := getRec(inputFile, landscape)
+	if err != nil {
+		return err
+	}
+	rec, ok := rt[treeName]
+	if !ok {
+		return fmt.Errorf("tree %q not found in input file %q", treeName, inputFile)
+	}
+	n, ok := rec.nodes[nodeFlag]
+	if !ok {
+		return fmt.Errorf("node %d of tree %q not found in input file %q", nodeFlag, treeName, inputFile)
+	}
+	st := n.stage(ageFlag)
+
+	var region map[int]bool
+	if boxFlag != "" {
+		region = bx.Region(landscape.Pixelation(), tot, st.age)
+	} else {
+		region = valueRegion(landscape, values, st.age)
+	}
+
+	t := test(st, region, landscape, pw)
+	if math.IsNaN(t.prior) || t.prior == 0 {
+		return fmt.Errorf("region without prior probability at %d years", st.age)
+	}
+	if t.prior == 1 {
+		return fmt.Errorf("region covers all pixels with prior probability at %d years", st.age)
+	}
+
+	w := c.Stdout()
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			e := f.Close()
+			if err == nil && e != nil {
+				err = e
+			}
+		}()
+		w = f
+	}
+	if err := writeTest(w, args[0], t); err != nil {
+		if output != "" {
+			return fmt.Errorf("while writing data on %q: %v", output, err)
+		}
+		return err
+	}
+	return nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readPixWeights(name string) (pixweight.Pixel, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pw, err := pixweight.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return pw, nil
+}
+
+func readRotation(name string, pix *earth.Pixelation) (*model.Total, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rot, err := model.ReadTotal(f, pix, false)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return rot, nil
+}
+
+func getRec(name string, landscape *model.TimePix) (map[string]*recTree, error) {
+	r, err := input.Open(name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	rt, err := readRecon(r, landscape)
+	if err != nil {
+		return nil, fmt.Errorf("on input file %q: %v", name, err)
+	}
+	return rt, nil
+}
+
+func parseValues(val string) (map[int]bool, error) {
+	vs := strings.Split(val, ",")
+	values := make(map[int]bool, len(vs))
+	for _, v := range vs {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("on flag --values: %v", err)
+		}
+		values[n] = true
+	}
+	return values, nil
+}
+
+// ValueRegion returns the pixels
+// with the given landscape values
+// at a time stage.
+func valueRegion(landscape *model.TimePix, values map[int]bool, age int64) map[int]bool {
+	region := make(map[int]bool)
+	for px, v := range landscape.Stage(landscape.ClosestStageAge(age)) {
+		if values[v] {
+			region[px] = true
+		}
+	}
+	return region
+}
+
+// A presenceTest is the result
+// of the test of presence of a node
+// in a region.
+type presenceTest struct {
+	tree  string
+	node  int
+	age   int64
+	post  float64
+	prior float64
+}
+
+// Test returns the posterior and prior probabilities
+// of a region at a time stage.
+// The prior is the pixel weight
+// of each pixel at the time stage.
+func test(st *recStage, region map[int]bool, landscape *model.TimePix, pw pixweight.Pixel) presenceTest {
+	var post float64
+	for px, p := range st.rec {
+		if region[px] {
+			post += p
+		}
+	}
+
+	stage := landscape.Stage(landscape.ClosestStageAge(st.age))
+	var in, sum float64
+	for px := 0; px < landscape.Pixelation().Len(); px++ {
+		w := pw.Weight(stage[px])
+		sum += w
+		if region[px] {
+			in += w
+		}
+	}
+
+	return presenceTest{
+		tree:  st.node.tree.name,
+		node:  st.node.id,
+		age:   st.age,
+		post:  post,
+		prior: in / sum,
+	}
+}
+
+// Odds returns the odds of a probability.
+func odds(p float64) float64 {
+	return p / (1 - p)
+}
+
+type recTree struct {
+	name  string
+	nodes map[int]*recNode
+}
+
+type recNode struct {
+	id     int
+	tree   *recTree
+	stages map[int64]*recStage
+}
+
+type recStage struct {
+	node *recNode
+	age  int64
+	rec  map[int]float64
+}
+
+// Stage returns the time stage of the node
+// closest to the given age,
+// in million years.
+// If the age is negative,
+// it returns the youngest time stage.
+func (n *recNode) stage(age float64) *recStage {
+	ages := make([]int64, 0, len(n.stages))
+	for a := range n.stages {
+		ages = append(ages, a)
+	}
+	slices.Sort(ages)
+	if age < 0 {
+		return n.stages[ages[0]]
+	}
+
+	a := int64(age * millionYears)
+	best := ages[0]
+	for _, sa := range ages[1:] {
+		if abs(sa-a) < abs(best-a) {
+			best = sa
+		}
+	}
+	return n.stages[best]
+}
+
+func abs(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// MillionYears is used to transform ages
+// (a float in million years)
+// to an integer in years.
+const millionYears = 1_000_000
+
+var headerFields = []string{
+	"tree",
+	"node",
+	"age",
+	"type",
+	"equator",
+	"pixel",
+	"value",
+}
+
+// ReadRecon reads a pixel probability file
+// and scales the values of each stage
+// so they sum 1.
+func readRecon(r io.Reader, landscape *model.TimePix) (map[string]*recTree, error) {
+	tsv := csv.NewReader(r)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range headerFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	var tp string
+	rt := make(map[string]*recTree)
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "tree"
+		tn := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if tn == "" {
+			continue
+		}
+		tn = strings.ToLower(tn)
+		t, ok := rt[tn]
+		if !ok {
+			t = &recTree{
+				name:  tn,
+				nodes: make(map[int]*recNode),
+			}
+			rt[tn] = t
+		}
+
+		f = "node"
+		id, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		n, ok := t.nodes[id]
+		if !ok {
+			n = &recNode{
+				id:     id,
+				tree:   t,
+				stages: make(map[int64]*recStage),
+			}
+			t.nodes[id] = n
+		}
+
+		f = "age"
+		age, err := strconv.ParseInt(row[fields[f]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		st, ok := n.stages[age]
+		if !ok {
+			st = &recStage{
+				node: n,
+				age:  age,
+				rec:  make(map[int]float64),
+			}
+			n.stages[age] = st
+		}
+
+		f = "type"
+		tpV := strings.ToLower(strings.Join(strings.Fields(row[fields[f]]), " "))
+		if tpV == "" {
+			return nil, fmt.Errorf("on row %d: field %q: expecting reconstruction type", ln, f)
+		}
+		if tp == "" {
+			tp = tpV
+		}
+		if tp != tpV {
+			return nil, fmt.Errorf("on row %d: field %q: got %q want %q", ln, f, tpV, tp)
+		}
+
+		f = "equator"
+		eq, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if eq != landscape.Pixelation().Equator() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid equator value %d", ln, f, eq)
+		}
+
+		f = "pixel"
+		px, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if px >= landscape.Pixelation().Len() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, px)
+		}
+
+		f = "value"
+		v, err := strconv.ParseFloat(row[fields[f]], 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		st.rec[px] = v
+	}
+	if len(rt) == 0 {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+
+	for _, t := range rt {
+		for _, n := range t.nodes {
+			for _, s := range n.stages {
+				if tp == "log-like" {
+					max := -math.MaxFloat64
+					for _, p := range s.rec {
+						if p > max {
+							max = p
+						}
+					}
+					for px, p := range s.rec {
+						s.rec[px] = math.Exp(p - max)
+					}
+				}
+
+				var sum float64
+				for _, p := range s.rec {
+					sum += p
+				}
+				if sum == 0 {
+					continue
+				}
+				for px, p := range s.rec {
+					s.rec[px] = p / sum
+				}
+			}
+		}
+	}
+
+	return rt, nil
+}
+
+func writeTest(w io.Writer, p string, t presenceTest) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# presence test, tree %q, project %q\n", t.tree, p)
+	if boxFlag != "" {
+		fmt.Fprintf(bw, "# region: box %s\n", boxFlag)
+	} else {
+		fmt.Fprintf(bw, "# region: values %s\n", valuesFlag)
+	}
+	fmt.Fprintf(bw, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(bw, "# phygeo: %s\n", version.String())
+
+	tsv := csv.NewWriter(bw)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	header := []string{
+		"tree",
+		"node",
+		"age",
+		"posterior",
+		"prior",
+		"postOdds",
+		"priorOdds",
+		"bf",
+		"log10bf",
+	}
+	if err := tsv.Write(header); err != nil {
+		return err
+	}
+
+	postOdds := odds(t.post)
+	priorOdds := odds(t.prior)
+	bf := postOdds / priorOdds
+	row := []string{
+		t.tree,
+		strconv.Itoa(t.node),
+		strconv.FormatInt(t.age, 10),
+		strconv.FormatFloat(t.post, 'f', 6, 64),
+		strconv.FormatFloat(t.prior, 'f', 6, 64),
+		strconv.FormatFloat(postOdds, 'g', 6, 64),
+		strconv.FormatFloat(priorOdds, 'g', 6, 64),
+		strconv.FormatFloat(bf, 'g', 6, 64),
+		strconv.FormatFloat(math.Log10(bf), 'f', 3, 64),
+	}
+	if err := tsv.Write(row); err != nil {
+		return err
+	}
+
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return nil
+}
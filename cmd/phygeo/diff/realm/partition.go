@@ -0,0 +1,166 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package realm
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/js-arias/timetree"
+)
+
+// ReadRealms reads a file with the realm
+// of each terminal.
+// The taxon names are stored in lower case.
+func readRealms(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rs, err := parseRealms(f)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+	return rs, nil
+}
+
+var realmFields = []string{
+	"taxon",
+	"realm",
+}
+
+func parseRealms(r io.Reader) (map[string]string, error) {
+	tsv := csv.NewReader(r)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range realmFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	rs := make(map[string]string)
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "taxon"
+		tax := strings.ToLower(strings.Join(strings.Fields(row[fields[f]]), " "))
+		if tax == "" {
+			continue
+		}
+		f = "realm"
+		rn := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if rn == "" {
+			continue
+		}
+		if pr, ok := rs[tax]; ok && pr != rn {
+			return nil, fmt.Errorf("on row %d: field %q: taxon already assigned to realm %q", ln, f, pr)
+		}
+		rs[tax] = rn
+	}
+	if len(rs) == 0 {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+	return rs, nil
+}
+
+// A partition is an assignment
+// of the branches of a tree
+// to realms.
+type partition struct {
+	// realm of each node
+	nodes map[int]string
+
+	// sorted list of the realms
+	// with at least one branch
+	realms []string
+}
+
+// NewPartition assigns each node of a tree
+// to the realm of the majority
+// of its descendant terminals.
+// Ties are resolved using the realm
+// that comes first in alphabetical order.
+func newPartition(t *timetree.Tree, realms map[string]string) (*partition, error) {
+	pt := &partition{
+		nodes: make(map[int]string),
+	}
+
+	counts := make(map[int]map[string]int)
+	var assign func(n int) error
+	assign = func(n int) error {
+		cn := make(map[string]int)
+		if t.IsTerm(n) {
+			tax := t.Taxon(n)
+			r, ok := realms[strings.ToLower(tax)]
+			if !ok {
+				return fmt.Errorf("tree %q: taxon %q: undefined realm", t.Name(), tax)
+			}
+			cn[r] = 1
+		}
+		for _, c := range t.Children(n) {
+			if err := assign(c); err != nil {
+				return err
+			}
+			for r, v := range counts[c] {
+				cn[r] += v
+			}
+		}
+		counts[n] = cn
+
+		var best string
+		for r, v := range cn {
+			if best == "" || v > cn[best] || (v == cn[best] && r < best) {
+				best = r
+			}
+		}
+		pt.nodes[n] = best
+		if !slices.Contains(pt.realms, best) {
+			pt.realms = append(pt.realms, best)
+		}
+		return nil
+	}
+	if err := assign(t.Root()); err != nil {
+		return nil, err
+	}
+	slices.Sort(pt.realms)
+	return pt, nil
+}
+
+// Branches returns the number of branches
+// assigned to a realm.
+func (pt *partition) branches(r string) int {
+	var n int
+	for _, nr := range pt.nodes {
+		if nr == r {
+			n++
+		}
+	}
+	return n
+}
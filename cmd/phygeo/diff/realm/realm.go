@@ -0,0 +1,536 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package realm implements a command to estimate
+// the lambda values of a partition of the tree
+// defined by the biogeographic realms of the terminals.
+package realm
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/agerange"
+	"github.com/js-arias/phygeo/constraint"
+	"github.com/js-arias/phygeo/infer/diffusion"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/ranges"
+	"github.com/js-arias/timetree"
+	"gonum.org/v1/gonum/stat/distuv"
+)
+
+var Command = &command.Command{
+	Usage: `realm --realms <file> [--lambda <value>] [--stem <age>]
+	[--step <value>] [--stop <value>]
+	[--cpu <number>] <project-file>`,
+	Short: "estimate lambda values by biogeographic realm",
+	Long: `
+Command realm reads a PhyGeo project, partitions the branches of each tree by
+the biogeographic realm of the terminals, and search for the maximum
+likelihood estimation of a lambda parameter for each partition. The
+partitioned model is compared with the joint model, in which all the branches
+share the same lambda value.
+
+The argument of the command is the name of the project file.
+
+The flag --realms is required and defines a tab-delimited file with the
+columns "taxon", with the name of a terminal, and "realm", with the name of
+the realm of the terminal. For example:
+
+	taxon	realm
+	Panthera onca	Neotropic
+	Panthera leo	Afrotropic
+	Panthera tigris	Indomalaya
+
+All the terminals of the trees must have a realm. Each branch is assigned to
+the realm of the majority of its descendant terminals; in case of ties, the
+realm that comes first in alphabetical order is used. The stem branch is
+assigned to the realm of the root.
+
+The search is a simple hill climbing search. The joint model starts at the
+lambda value defined with the flag --lambda (by default, 100). Then, starting
+from the joint estimate, the lambda value of each partition is searched in
+turn, while keeping the values of the other partitions, until a full round
+over all the partitions improves the likelihood by less than 0.001. By
+default, the initial step has a value of 100, use the flag --step to change
+the value. At each cycle the step value is reduced a 50%, and stop when step
+has a size of 1. Use flag --stop to set a different stop value.
+
+By default, an stem branch will be added to each tree using the 10% of the root
+age. To set a different stem age use the flag --stem, the value should be in
+million years.
+
+The output is printed in the standard output as a tab-delimited table with the
+following columns:
+
+	-tree      the name of the tree
+	-model     the model, either "joint" or "partition"
+	-realm     the name of the realm ("all" in the joint model)
+	-branches  the number of branches assigned to the realm
+	-lambda    the lambda value of the realm
+	-logLike   the log-likelihood of the model
+	-params    the number of parameters of the model
+	-AIC       the Akaike information criterion of the model
+
+After the rows of each tree, a comment line reports the likelihood ratio
+between the models, and its p-value using a chi-square distribution with the
+number of additional parameters as degrees of freedom. As the search is
+heuristic, the test should be taken as an approximation.
+
+By default, all available CPUs will be used in the processing. Set --cpu flag
+to use a different number of CPUs.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var lambdaFlag float64
+var stemAge float64
+var stepFlag float64
+var stopFlag float64
+var numCPU int
+var realmFile string
+
+func setFlags(c *command.Command) {
+	c.Flags().Float64Var(&lambdaFlag, "lambda", 100, "")
+	c.Flags().Float64Var(&stopFlag, "stop", 1, "")
+	c.Flags().Float64Var(&stepFlag, "step", 100, "")
+	c.Flags().Float64Var(&stemAge, "stem", 0, "")
+	c.Flags().IntVar(&numCPU, "cpu", runtime.NumCPU(), "")
+	c.Flags().StringVar(&realmFile, "realms", "", "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if realmFile == "" {
+		return c.UsageError("expecting realm file, flag --realms")
+	}
+	if lambdaFlag <= 0 {
+		return c.UsageError("flag --lambda: value must be greater than 0")
+	}
+
+	realms, err := readRealms(realmFile)
+	if err != nil {
+		return err
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	tf := p.Path(project.Trees)
+	if tf == "" {
+		msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	tc, err := readTreeFile(tf)
+	if err != nil {
+		return err
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("paleolandscape not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	landscape, err := readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	rotF := p.Path(project.GeoMotion)
+	if rotF == "" {
+		msg := fmt.Sprintf("plate motion model not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	rot, err := readRotation(rotF, landscape.Pixelation())
+	if err != nil {
+		return err
+	}
+
+	stF := p.Path(project.Stages)
+	stages, err := readStages(stF, rot, landscape)
+	if err != nil {
+		return err
+	}
+
+	pwF := p.Path(project.PixWeight)
+	if pwF == "" {
+		msg := fmt.Sprintf("pixel weights not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	pw, err := readPixWeights(pwF)
+	if err != nil {
+		return err
+	}
+
+	rf := p.Path(project.Ranges)
+	rc, err := readRanges(rf)
+	if err != nil {
+		return err
+	}
+	var ar *agerange.Collection
+	if af := p.Path(project.AgeRanges); af != "" {
+		ar, err = readAgeRanges(af, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+	var cn *constraint.Collection
+	if cf := p.Path(project.Constraints); cf != "" {
+		cn, err = readConstraints(cf, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+
+	// check if all terminals have defined ranges
+	for _, tn := range tc.Names() {
+		t := tc.Tree(tn)
+		for _, term := range t.Terms() {
+			if !rc.HasTaxon(term) {
+				return fmt.Errorf("taxon %q of tree %q has no defined range", term, tn)
+			}
+		}
+	}
+
+	// assign the branches of each tree
+	parts := make(map[string]*partition, len(tc.Names()))
+	for _, tn := range tc.Names() {
+		pt, err := newPartition(tc.Tree(tn), realms)
+		if err != nil {
+			return err
+		}
+		parts[tn] = pt
+	}
+
+	// Set the number of parallel processors
+	diffusion.SetCPU(numCPU)
+
+	dm, _ := earth.NewDistMatRingScale(landscape.Pixelation())
+
+	param := diffusion.Param{
+		Landscape:   landscape,
+		Rot:         rot,
+		DM:          dm,
+		PW:          pw,
+		Ranges:      rc,
+		AgeRanges:   ar,
+		Constraints: cn,
+		Lambda:      lambdaFlag,
+		Stages:      stages.Stages(),
+		Cache:       diffusion.NewPDFCache(landscape.Pixelation()),
+	}
+
+	fmt.Fprintf(c.Stdout(), "tree\tmodel\trealm\tbranches\tlambda\tlogLike\tparams\tAIC\n")
+	for _, tn := range tc.Names() {
+		t := tc.Tree(tn)
+		stem := int64(stemAge * 1_000_000)
+		if stem == 0 {
+			stem = t.Age(t.Root()) / 10
+		}
+		param.Stem = stem
+
+		pt := parts[tn]
+		joint := searchJoint(t, param)
+		lambdas, logLike := searchPartition(t, pt, param, joint.lambda, joint.logLike)
+		writeModels(c.Stdout(), tn, pt, joint, lambdas, logLike)
+	}
+
+	return nil
+}
+
+// BestRec stores the best reconstruction
+type bestRec struct {
+	lambda  float64
+	logLike float64
+}
+
+// SearchJoint search for the best lambda value
+// of the whole tree.
+func searchJoint(t *timetree.Tree, p diffusion.Param) bestRec {
+	eval := func(l float64) float64 {
+		p.Lambda = l
+		df := diffusion.New(t, p)
+		return df.DownPass()
+	}
+
+	b := bestRec{
+		lambda:  lambdaFlag,
+		logLike: eval(lambdaFlag),
+	}
+	b.hillClimb(eval)
+	return b
+}
+
+// SearchPartition search for the best lambda value
+// of each realm,
+// starting from the joint estimate.
+func searchPartition(t *timetree.Tree, pt *partition, p diffusion.Param, lambda, logLike float64) (map[string]float64, float64) {
+	lambdas := make(map[string]float64, len(pt.realms))
+	for _, r := range pt.realms {
+		lambdas[r] = lambda
+	}
+	if len(pt.realms) < 2 {
+		return lambdas, logLike
+	}
+
+	for {
+		start := logLike
+		for _, r := range pt.realms {
+			eval := func(l float64) float64 {
+				df := diffusion.New(t, p)
+				for n, nr := range pt.nodes {
+					v := lambdas[nr]
+					if nr == r {
+						v = l
+					}
+					df.SetBranchLambda(n, v)
+				}
+				return df.DownPass()
+			}
+
+			b := bestRec{
+				lambda:  lambdas[r],
+				logLike: logLike,
+			}
+			b.hillClimb(eval)
+			lambdas[r] = b.lambda
+			logLike = b.logLike
+		}
+		if logLike-start < 0.001 {
+			break
+		}
+	}
+	return lambdas, logLike
+}
+
+func (b *bestRec) hillClimb(eval func(float64) float64) {
+	b.first(eval, stepFlag)
+	for step := stepFlag / 2; ; step = step / 2 {
+		b.search(eval, step)
+		if step < stopFlag {
+			break
+		}
+	}
+}
+
+func (b *bestRec) first(eval func(float64) float64, step float64) {
+	// go up
+	upOK := false
+	for l := b.lambda + step; ; l += step {
+		like := eval(l)
+		if like < b.logLike {
+			break
+		}
+		b.lambda = l
+		b.logLike = like
+		upOK = true
+	}
+	// we found an improvement
+	if upOK {
+		return
+	}
+
+	// go down
+	for l := b.lambda - step; l > 0; l -= step {
+		like := eval(l)
+		if like < b.logLike {
+			return
+		}
+		b.lambda = l
+		b.logLike = like
+	}
+}
+
+// Search go one step up and one step down
+// to see if the likelihood improves.
+func (b *bestRec) search(eval func(float64) float64, step float64) {
+	// go up
+	l := b.lambda + step
+	like := eval(l)
+	if like > b.logLike {
+		b.lambda = l
+		b.logLike = like
+		return
+	}
+
+	// go down
+	if b.lambda <= step {
+		return
+	}
+	l = b.lambda - step
+	like = eval(l)
+	if like > b.logLike {
+		b.lambda = l
+		b.logLike = like
+	}
+}
+
+func writeModels(w io.Writer, tn string, pt *partition, joint bestRec, lambdas map[string]float64, logLike float64) {
+	jAIC := 2 - 2*joint.logLike
+	fmt.Fprintf(w, "%s\tjoint\tall\t%d\t%.6f\t%.6f\t%d\t%.6f\n", tn, len(pt.nodes), joint.lambda, joint.logLike, 1, jAIC)
+
+	k := len(pt.realms)
+	pAIC := 2*float64(k) - 2*logLike
+	for _, r := range pt.realms {
+		fmt.Fprintf(w, "%s\tpartition\t%s\t%d\t%.6f\t%.6f\t%d\t%.6f\n", tn, r, pt.branches(r), lambdas[r], logLike, k, pAIC)
+	}
+
+	best := "joint"
+	if pAIC < jAIC {
+		best = "partition"
+	}
+	lr := 2 * (logLike - joint.logLike)
+	if lr < 0 {
+		lr = 0
+	}
+	pValue := 1.0
+	if k > 1 {
+		chi := distuv.ChiSquared{K: float64(k - 1)}
+		pValue = chi.Survival(lr)
+	}
+	if math.IsNaN(pValue) {
+		pValue = 1
+	}
+	fmt.Fprintf(w, "# %s\tLR: %.6f\tdf: %d\tp-value: %.6f\tbest AIC: %s\n", tn, lr, k-1, pValue, best)
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readRotation(name string, pix *earth.Pixelation) (*model.StageRot, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rot, err := model.ReadStageRot(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return rot, nil
+}
+
+func readStages(name string, rot *model.StageRot, landscape *model.TimePix) (timestage.Stages, error) {
+	stages := timestage.New()
+	stages.Add(rot)
+	stages.Add(landscape)
+
+	if name == "" {
+		return stages, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := timestage.Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+	stages.Add(st)
+
+	return stages, nil
+}
+
+func readPixWeights(name string) (pixweight.Pixel, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pw, err := pixweight.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return pw, nil
+}
+
+func readRanges(name string) (*ranges.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := ranges.ReadTSV(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func readAgeRanges(name string, pix *earth.Pixelation) (*agerange.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := agerange.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func readConstraints(name string, pix *earth.Pixelation) (*constraint.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := constraint.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
@@ -0,0 +1,130 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package rose
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/js-arias/timetree"
+)
+
+// A clade is a set of terminals
+// defined by the user.
+type clade struct {
+	name  string
+	terms []string
+}
+
+// ReadClades reads a file with clade definitions.
+func readClades(name string) ([]*clade, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cl, err := parseClades(f)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+	return cl, nil
+}
+
+var cladeFields = []string{
+	"clade",
+	"taxon",
+}
+
+func parseClades(r io.Reader) ([]*clade, error) {
+	tsv := csv.NewReader(r)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range cladeFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	var cl []*clade
+	cm := make(map[string]*clade)
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "clade"
+		cn := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if cn == "" {
+			continue
+		}
+		f = "taxon"
+		tax := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if tax == "" {
+			continue
+		}
+
+		c, ok := cm[strings.ToLower(cn)]
+		if !ok {
+			c = &clade{name: cn}
+			cm[strings.ToLower(cn)] = c
+			cl = append(cl, c)
+		}
+		c.terms = append(c.terms, tax)
+	}
+	if len(cl) == 0 {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+	for _, c := range cl {
+		if len(c.terms) < 2 {
+			return nil, fmt.Errorf("clade %q: expecting at least two terminals", c.name)
+		}
+	}
+	return cl, nil
+}
+
+// CladeNodes returns the clades of each node of a tree,
+// as the index of the clade in the list of clades.
+// A clade includes all the branches
+// descendant from the most recent common ancestor
+// of its terminals
+// (i.e., the crown group).
+func cladeNodes(t *timetree.Tree, cl []*clade) (map[int][]int, error) {
+	nodes := make(map[int][]int)
+	for i, c := range cl {
+		mrca := t.MRCA(c.terms...)
+		if mrca < 0 {
+			return nil, fmt.Errorf("tree %q: clade %q: terminals not found in tree", t.Name(), c.name)
+		}
+
+		desc := t.Children(mrca)
+		for len(desc) > 0 {
+			id := desc[0]
+			desc = desc[1:]
+			nodes[id] = append(nodes[id], i)
+			desc = append(desc, t.Children(id)...)
+		}
+	}
+	return nodes, nil
+}
@@ -0,0 +1,598 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package rose implements a command to build
+// rose diagrams of the direction of the movements
+// in a reconstruction.
+package rose
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/internal/input"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/timetree"
+)
+
+var Command = &command.Command{
+	Usage: `rose [--sectors <number>] [--clades <file>] [--time]
+	[--svg <file-prefix>]
+	-i|--input <file> <project-file>`,
+	Short: "rose diagrams of movement directions",
+	Long: `
+Command rose reads a file with sampled pixels from a stochastic mapping of one
+or more trees in a project, and bins the direction of the movements of the
+particles into compass sectors, to build rose diagrams of the reconstructed
+histories.
+
+The direction of a movement is the initial bearing (i.e., the angle from the
+north, measured clockwise) of the great circle from the starting pixel to the
+ending pixel of each time segment of a branch. As pixels are reconstructed at
+each time stage, the direction is measured using the paleogeographic
+coordinates of the time stage. Time segments in which the particle does not
+move, as well as the root node and the post-split stages, are ignored.
+
+The argument of the command is the name of the project file.
+
+The flag --input, or -i, is required and indicates the input file. If the
+input is "-", the file will be read from the standard input.
+
+By default, the directions are binned into 8 sectors (N, NE, E, SE, S, SW, W,
+and NW), each sector centered at its bearing. Use the flag --sectors to define
+a different number of sectors.
+
+By default, a rose diagram is built with all the movements of each tree. If
+the flag --clades is defined with a file, a rose diagram will also be built
+for each clade defined in the file. The file is a tab-delimited file with the
+columns "clade", with the name of the clade, and "taxon", with the name of a
+terminal of the clade (one terminal per row). For example:
+
+	clade	taxon
+	felids	Panthera leo
+	felids	Felis catus
+	canids	Canis lupus
+	canids	Vulpes vulpes
+
+Each clade is defined by the most recent common ancestor (MRCA) of its
+terminals, and it includes all the branches descendant from the MRCA (i.e.,
+the crown group).
+
+If the flag --time is used, a rose diagram will also be built for each time
+stage (of the tree and each clade), using the time stages of the project.
+
+The output will be printed in the standard output, as a tab-delimited table
+with the following columns:
+
+	tree      the name of the tree
+	clade     the name of the clade ("--" for the whole tree)
+	age       the age of the time stage, in years ("--" for all stages)
+	sector    the sector index, from 0 (north), clockwise
+	bearing   the bearing of the center of the sector, in degrees
+	moves     the mean number of movements in the sector per particle
+	freq      the fraction of the movements in the sector
+	distance  the mean distance traveled in the sector per particle, in
+	          kilometers
+
+If the stochastic mapping file has a "weight" column (for example, when the
+particles were produced from several lambda values), the movements and
+distances will be weighted by the weight of each particle.
+
+If the flag --svg is defined with a file prefix, the rose diagrams of each
+tree will be drawn as an SVG file, using the indicated prefix and the name of
+the tree. Each row of the drawing is the whole tree, or a clade, and each
+column is a time stage (the first column is all the stages). The area of each
+petal is proportional to the fraction of movements in the sector.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var useTime bool
+var sectorsFlag int
+var cladesFile string
+var svgPrefix string
+var inputFile string
+
+func setFlags(c *command.Command) {
+	c.Flags().BoolVar(&useTime, "time", false, "")
+	c.Flags().IntVar(&sectorsFlag, "sectors", 8, "")
+	c.Flags().StringVar(&cladesFile, "clades", "", "")
+	c.Flags().StringVar(&svgPrefix, "svg", "", "")
+	c.Flags().StringVar(&inputFile, "input", "", "")
+	c.Flags().StringVar(&inputFile, "i", "", "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if inputFile == "" {
+		return c.UsageError("expecting input file, flag --input")
+	}
+	if sectorsFlag < 2 || sectorsFlag > 360 {
+		return c.UsageError(fmt.Sprintf("flag --sectors: invalid value %d: expecting a value between 2 and 360", sectorsFlag))
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("landscape not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	landscape, err := readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	tf := p.Path(project.Trees)
+	if tf == "" {
+		msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	tc, err := readTreeFile(tf)
+	if err != nil {
+		return err
+	}
+
+	var stages timestage.Stages
+	if useTime {
+		rotF := p.Path(project.GeoMotion)
+		if rotF == "" {
+			msg := fmt.Sprintf("plate motion model not defined in project %q", args[0])
+			return c.UsageError(msg)
+		}
+		stages, err = readStages(p.Path(project.Stages), rotF, landscape)
+		if err != nil {
+			return err
+		}
+	}
+
+	var cl []*clade
+	if cladesFile != "" {
+		cl, err = readClades(cladesFile)
+		if err != nil {
+			return err
+		}
+	}
+	cn := make(map[string]map[int][]int)
+	for _, name := range tc.Names() {
+		nodes, err := cladeNodes(tc.Tree(name), cl)
+		if err != nil {
+			return err
+		}
+		cn[name] = nodes
+	}
+
+	rt, err := getRec(inputFile, c.Stdin(), tc, landscape, stages, cn)
+	if err != nil {
+		return err
+	}
+
+	if err := writeRoses(c.Stdout(), tc, rt, cl); err != nil {
+		return fmt.Errorf("while writing on standard output: %v", err)
+	}
+
+	if svgPrefix != "" {
+		for _, name := range tc.Names() {
+			t, ok := rt[name]
+			if !ok {
+				continue
+			}
+			fName := svgPrefix + "-" + name + ".svg"
+			if err := writeSVG(fName, t, cl); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readStages(name, rotF string, landscape *model.TimePix) (timestage.Stages, error) {
+	rot, err := readRotation(rotF, landscape.Pixelation())
+	if err != nil {
+		return nil, err
+	}
+
+	stages := timestage.New()
+	stages.Add(rot)
+	stages.Add(landscape)
+
+	if name == "" {
+		return stages, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := timestage.Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+	stages.Add(st)
+
+	return stages, nil
+}
+
+func readRotation(name string, pix *earth.Pixelation) (*model.StageRot, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rot, err := model.ReadStageRot(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return rot, nil
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func getRec(name string, stdin io.Reader, tc *timetree.Collection, landscape *model.TimePix, stages timestage.Stages, cn map[string]map[int][]int) (map[string]*recTree, error) {
+	f, err := input.Open(name, stdin)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rt, err := readRecon(f, tc, landscape, stages, cn)
+	if err != nil {
+		return nil, fmt.Errorf("on input file %q: %v", name, err)
+	}
+	return rt, nil
+}
+
+// AllAges is the age used
+// for a rose diagram of all the time stages.
+const allAges = -1
+
+// WholeTree is the clade index used
+// for a rose diagram of the whole tree.
+const wholeTree = -1
+
+// A roseKey identifies a rose diagram
+// of a tree.
+type roseKey struct {
+	clade int
+	age   int64
+}
+
+// A rose is the number of movements
+// and the distance traveled
+// on each sector.
+type rose struct {
+	// weighted number of movements
+	moves []float64
+
+	// weighted distance in radians
+	dist []float64
+}
+
+// A recTree stores the rose diagrams
+// of a tree.
+type recTree struct {
+	name  string
+	roses map[roseKey]*rose
+
+	// weight of each particle
+	particles map[int]float64
+
+	// time stages with movements
+	ages map[int64]bool
+}
+
+func (t *recTree) add(k roseKey, sector int, dist, w float64) {
+	r, ok := t.roses[k]
+	if !ok {
+		r = &rose{
+			moves: make([]float64, sectorsFlag),
+			dist:  make([]float64, sectorsFlag),
+		}
+		t.roses[k] = r
+	}
+	r.moves[sector] += w
+	r.dist[sector] += dist * w
+}
+
+// SumWeights returns the sum of the weights
+// of the particles of a tree.
+func (t *recTree) sumWeights() float64 {
+	var sum float64
+	for _, w := range t.particles {
+		sum += w
+	}
+	return sum
+}
+
+// SortedAges returns the ages of the rose diagrams,
+// with all the stages first,
+// and then the time stages
+// from the most recent to the oldest.
+func (t *recTree) sortedAges() []int64 {
+	ages := make([]int64, 0, len(t.ages)+1)
+	ages = append(ages, allAges)
+	for a := range t.ages {
+		ages = append(ages, a)
+	}
+	slices.Sort(ages[1:])
+	return ages
+}
+
+// Bearing returns the initial bearing,
+// in degrees from the north,
+// of the great circle between two points.
+func bearing(from, to earth.Point) float64 {
+	lat1 := earth.ToRad(from.Latitude())
+	lat2 := earth.ToRad(to.Latitude())
+	dLon := earth.ToRad(to.Longitude() - from.Longitude())
+
+	y := math.Sin(dLon) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLon)
+	b := math.Atan2(y, x) * 180 / math.Pi
+	if b < 0 {
+		b += 360
+	}
+	return b
+}
+
+// Sector returns the sector of a bearing.
+// Sectors are centered at their bearing,
+// so the sector 0 is centered at the north.
+func sector(b float64, n int) int {
+	w := 360 / float64(n)
+	return int(math.Floor(b/w+0.5)) % n
+}
+
+var headerFields = []string{
+	"tree",
+	"particle",
+	"node",
+	"age",
+	"from",
+	"to",
+}
+
+func readRecon(r io.Reader, tc *timetree.Collection, tp *model.TimePix, stages timestage.Stages, cn map[string]map[int][]int) (map[string]*recTree, error) {
+	tsv := csv.NewReader(r)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range headerFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	_, hasWeight := fields["weight"]
+
+	pix := tp.Pixelation()
+	rt := make(map[string]*recTree)
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "tree"
+		tn := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if tn == "" {
+			continue
+		}
+		tn = strings.ToLower(tn)
+		tv := tc.Tree(tn)
+		if tv == nil {
+			continue
+		}
+		t, ok := rt[tn]
+		if !ok {
+			t = &recTree{
+				name:      tn,
+				roses:     make(map[roseKey]*rose),
+				particles: make(map[int]float64),
+				ages:      make(map[int64]bool),
+			}
+			rt[tn] = t
+		}
+
+		f = "particle"
+		pN, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		w := 1.0
+		if hasWeight {
+			f = "weight"
+			w, err = strconv.ParseFloat(row[fields[f]], 64)
+			if err != nil {
+				return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+			}
+		}
+		t.particles[pN] = w
+
+		f = "node"
+		id, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if tv.IsRoot(id) {
+			continue
+		}
+
+		f = "age"
+		age, err := strconv.ParseInt(row[fields[f]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+
+		// post-split stages have no duration
+		if tv.Age(tv.Parent(id)) == age {
+			continue
+		}
+
+		f = "from"
+		fPx, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if fPx >= pix.Len() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, fPx)
+		}
+
+		f = "to"
+		tPx, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if tPx >= pix.Len() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, tPx)
+		}
+		if fPx == tPx {
+			continue
+		}
+
+		from := pix.ID(fPx).Point()
+		to := pix.ID(tPx).Point()
+		dist := earth.Distance(from, to)
+		s := sector(bearing(from, to), sectorsFlag)
+
+		groups := append([]int{wholeTree}, cn[tn][id]...)
+		for _, g := range groups {
+			t.add(roseKey{clade: g, age: allAges}, s, dist, w)
+			if stages == nil {
+				continue
+			}
+			a := stages.ClosestStageAge(age)
+			t.ages[a] = true
+			t.add(roseKey{clade: g, age: a}, s, dist, w)
+		}
+	}
+
+	if len(rt) == 0 {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+
+	return rt, nil
+}
+
+func writeRoses(w io.Writer, tc *timetree.Collection, rt map[string]*recTree, cl []*clade) error {
+	tab := csv.NewWriter(w)
+	tab.Comma = '\t'
+	tab.UseCRLF = true
+
+	if err := tab.Write([]string{"tree", "clade", "age", "sector", "bearing", "moves", "freq", "distance"}); err != nil {
+		return err
+	}
+
+	width := 360 / float64(sectorsFlag)
+	for _, name := range tc.Names() {
+		t, ok := rt[name]
+		if !ok {
+			continue
+		}
+		sumW := t.sumWeights()
+
+		for c := wholeTree; c < len(cl); c++ {
+			cName := "--"
+			if c >= 0 {
+				cName = cl[c].name
+			}
+			for _, a := range t.sortedAges() {
+				r, ok := t.roses[roseKey{clade: c, age: a}]
+				if !ok {
+					continue
+				}
+				age := "--"
+				if a != allAges {
+					age = strconv.FormatInt(a, 10)
+				}
+
+				var sum float64
+				for _, m := range r.moves {
+					sum += m
+				}
+				for s, m := range r.moves {
+					row := []string{
+						name,
+						cName,
+						age,
+						strconv.Itoa(s),
+						strconv.FormatFloat(float64(s)*width, 'f', 3, 64),
+						strconv.FormatFloat(m/sumW, 'f', 6, 64),
+						strconv.FormatFloat(m/sum, 'f', 6, 64),
+						strconv.FormatFloat(r.dist[s]*earth.Radius/1000/sumW, 'f', 3, 64),
+					}
+					if err := tab.Write(row); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	tab.Flush()
+	if err := tab.Error(); err != nil {
+		return err
+	}
+	return nil
+}
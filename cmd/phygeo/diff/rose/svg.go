@@ -0,0 +1,188 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package rose
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+
+	"github.com/js-arias/phygeo/timestage"
+)
+
+// Size of the rose diagrams
+// in the SVG file.
+const (
+	cellSize = 160
+	radius   = 60
+)
+
+func writeSVG(name string, t *recTree, cl []*clade) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	bw := bufio.NewWriter(f)
+	if err := drawRoses(bw, t, cl); err != nil {
+		return fmt.Errorf("while writing file %q: %v", name, err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("while writing file %q: %v", name, err)
+	}
+	return nil
+}
+
+// DrawRoses draws the rose diagrams of a tree
+// as a grid,
+// with a row for the whole tree
+// and each clade,
+// and a column for each time stage.
+func drawRoses(w io.Writer, t *recTree, cl []*clade) error {
+	ages := t.sortedAges()
+
+	var groups []int
+	for c := wholeTree; c < len(cl); c++ {
+		for _, a := range ages {
+			if _, ok := t.roses[roseKey{clade: c, age: a}]; ok {
+				groups = append(groups, c)
+				break
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "%s", xml.Header)
+	e := xml.NewEncoder(w)
+	svg := xml.StartElement{
+		Name: xml.Name{Local: "svg"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "height"}, Value: strconv.Itoa(len(groups) * cellSize)},
+			{Name: xml.Name{Local: "width"}, Value: strconv.Itoa(len(ages) * cellSize)},
+			{Name: xml.Name{Local: "xmlns"}, Value: "http://www.w3.org/2000/svg"},
+		},
+	}
+	e.EncodeToken(svg)
+
+	g := xml.StartElement{
+		Name: xml.Name{Local: "g"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "stroke-width"}, Value: "1"},
+			{Name: xml.Name{Local: "stroke"}, Value: "black"},
+			{Name: xml.Name{Local: "font-family"}, Value: "Verdana"},
+			{Name: xml.Name{Local: "font-size"}, Value: "10"},
+		},
+	}
+	e.EncodeToken(g)
+
+	for i, c := range groups {
+		label := "all"
+		if c >= 0 {
+			label = cl[c].name
+		}
+		for j, a := range ages {
+			r, ok := t.roses[roseKey{clade: c, age: a}]
+			if !ok {
+				continue
+			}
+			age := "all stages"
+			if a != allAges {
+				age = strconv.FormatFloat(float64(a)/timestage.MillionYears, 'f', -1, 64) + " Ma"
+			}
+			x := float64(j*cellSize + cellSize/2)
+			y := float64(i*cellSize + cellSize/2 + 5)
+			r.draw(e, x, y)
+			text(e, float64(j*cellSize+5), float64(i*cellSize+12), label+", "+age)
+		}
+	}
+
+	e.EncodeToken(g.End())
+	e.EncodeToken(svg.End())
+	if err := e.Flush(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Draw draws a rose diagram
+// centered at x, y.
+// The area of each petal is proportional
+// to the fraction of movements in the sector.
+func (r *rose) draw(e *xml.Encoder, x, y float64) {
+	var sum, max float64
+	for _, m := range r.moves {
+		sum += m
+		if m > max {
+			max = m
+		}
+	}
+
+	// reference circle
+	circle := xml.StartElement{
+		Name: xml.Name{Local: "circle"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "cx"}, Value: strconv.FormatFloat(x, 'f', 2, 64)},
+			{Name: xml.Name{Local: "cy"}, Value: strconv.FormatFloat(y, 'f', 2, 64)},
+			{Name: xml.Name{Local: "r"}, Value: strconv.Itoa(radius)},
+			{Name: xml.Name{Local: "stroke"}, Value: "rgb(200,200,200)"},
+			{Name: xml.Name{Local: "fill"}, Value: "none"},
+		},
+	}
+	e.EncodeToken(circle)
+	e.EncodeToken(circle.End())
+	text(e, x-3, y-radius-2, "N")
+
+	if max == 0 {
+		return
+	}
+
+	width := 2 * math.Pi / float64(len(r.moves))
+	for s, m := range r.moves {
+		if m == 0 {
+			continue
+		}
+		pr := radius * math.Sqrt(m/max)
+		a1 := (float64(s) - 0.5) * width
+		a2 := (float64(s) + 0.5) * width
+		d := fmt.Sprintf("M %.2f %.2f L %.2f %.2f A %.2f %.2f 0 0 1 %.2f %.2f Z",
+			x, y,
+			x+pr*math.Sin(a1), y-pr*math.Cos(a1),
+			pr, pr,
+			x+pr*math.Sin(a2), y-pr*math.Cos(a2),
+		)
+		path := xml.StartElement{
+			Name: xml.Name{Local: "path"},
+			Attr: []xml.Attr{
+				{Name: xml.Name{Local: "d"}, Value: d},
+				{Name: xml.Name{Local: "fill"}, Value: "rgb(127,188,165)"},
+			},
+		}
+		e.EncodeToken(path)
+		e.EncodeToken(path.End())
+	}
+}
+
+func text(e *xml.Encoder, x, y float64, s string) {
+	tx := xml.StartElement{
+		Name: xml.Name{Local: "text"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "x"}, Value: strconv.FormatFloat(x, 'f', 2, 64)},
+			{Name: xml.Name{Local: "y"}, Value: strconv.FormatFloat(y, 'f', 2, 64)},
+			{Name: xml.Name{Local: "stroke-width"}, Value: "0"},
+		},
+	}
+	e.EncodeToken(tx)
+	e.EncodeToken(xml.CharData(s))
+	e.EncodeToken(tx.End())
+}
@@ -0,0 +1,451 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package shift implements a command to search
+// for candidate shifts of the diffusion rate
+// in the branches of a tree.
+package shift
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/agerange"
+	"github.com/js-arias/phygeo/constraint"
+	"github.com/js-arias/phygeo/infer/diffusion"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/ranges"
+	"github.com/js-arias/timetree"
+)
+
+var Command = &command.Command{
+	Usage: `shift --lambda <value> [--stem <age>]
+	[--step <value>] [--stop <value>]
+	[--cpu <number>] <project-file>`,
+	Short: "search for node-specific lambda values",
+	Long: `
+Command shift reads a PhyGeo project, and for each node of each tree, search
+for the maximum likelihood estimation of the lambda parameter of the subtree
+rooted at the node (including the branch of the node), while keeping the
+background lambda value in the rest of the tree. It is an exploratory tool to
+detect candidate locations of shifts in the diffusion rate.
+
+The argument of the command is the name of the project file.
+
+The flag --lambda is required and defines the background lambda value (for
+example, the value found with the command "diff ml").
+
+The search is a simple hill climbing search that starts at the background
+lambda value. By default, the initial step has a value of 100, use the flag
+--step to change the value. At each cycle the step value is reduced a 50%,
+and stop when step has a size of 1. Use flag --stop to set a different stop
+value.
+
+By default, an stem branch will be added to each tree using the 10% of the root
+age. To set a different stem age use the flag --stem, the value should be in
+million years.
+
+The first search step goes up (or down) from the background lambda while the
+likelihood improves. The upward search stops when the likelihood does not
+improve, or after 1000 steps (at large lambda values the kernels of all time
+stages collapse, and the likelihood does not change).
+
+The output is printed in the standard output as a tab-delimited table. The
+background lambda and the log-likelihood of each tree using the background
+lambda are printed as comments before the table. The table has the following
+columns:
+
+	-tree      the name of the tree
+	-node      the ID of the node
+	-lambda    the best lambda value for the subtree
+	-logLike   the log-likelihood of the tree with the best subtree
+	           lambda
+	-gain      the difference between the log-likelihood and the
+	           log-likelihood of the tree using the background lambda
+
+As more parameters always increase the likelihood, the gain values should be
+used to rank candidate nodes, and not as a formal test.
+
+By default, all available CPUs will be used in the processing. Set --cpu flag
+to use a different number of CPUs.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var lambdaFlag float64
+var stemAge float64
+var stepFlag float64
+var stopFlag float64
+var numCPU int
+
+func setFlags(c *command.Command) {
+	c.Flags().Float64Var(&lambdaFlag, "lambda", 0, "")
+	c.Flags().Float64Var(&stopFlag, "stop", 1, "")
+	c.Flags().Float64Var(&stepFlag, "step", 100, "")
+	c.Flags().Float64Var(&stemAge, "stem", 0, "")
+	c.Flags().IntVar(&numCPU, "cpu", runtime.GOMAXPROCS(0), "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if lambdaFlag <= 0 {
+		return c.UsageError("expecting background lambda, flag --lambda")
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	tf := p.Path(project.Trees)
+	if tf == "" {
+		msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	tc, err := readTreeFile(tf)
+	if err != nil {
+		return err
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("paleolandscape not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	landscape, err := readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	rotF := p.Path(project.GeoMotion)
+	if rotF == "" {
+		msg := fmt.Sprintf("plate motion model not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	rot, err := readRotation(rotF, landscape.Pixelation())
+	if err != nil {
+		return err
+	}
+
+	stF := p.Path(project.Stages)
+	stages, err := readStages(stF, rot, landscape)
+	if err != nil {
+		return err
+	}
+
+	pwF := p.Path(project.PixWeight)
+	if pwF == "" {
+		msg := fmt.Sprintf("pixel weights not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	pw, err := readPixWeights(pwF)
+	if err != nil {
+		return err
+	}
+
+	rf := p.Path(project.Ranges)
+	rc, err := readRanges(rf)
+	if err != nil {
+		return err
+	}
+	var ar *agerange.Collection
+	if af := p.Path(project.AgeRanges); af != "" {
+		ar, err = readAgeRanges(af, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+	var cn *constraint.Collection
+	if cf := p.Path(project.Constraints); cf != "" {
+		cn, err = readConstraints(cf, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+
+	// check if all terminals have defined ranges
+	for _, tn := range tc.Names() {
+		t := tc.Tree(tn)
+		for _, term := range t.Terms() {
+			if !rc.HasTaxon(term) {
+				return fmt.Errorf("taxon %q of tree %q has no defined range", term, tn)
+			}
+		}
+	}
+
+	// Set the number of parallel processors
+	diffusion.SetCPU(numCPU)
+
+	dm, _ := earth.NewDistMatRingScale(landscape.Pixelation())
+
+	param := diffusion.Param{
+		Landscape:   landscape,
+		Rot:         rot,
+		DM:          dm,
+		PW:          pw,
+		Ranges:      rc,
+		AgeRanges:   ar,
+		Constraints: cn,
+		Lambda:      lambdaFlag,
+		Stages:      stages.Stages(),
+		Cache:       diffusion.NewPDFCache(landscape.Pixelation()),
+	}
+
+	stem := int64(stemAge * 1_000_000)
+	bg := make(map[string]float64, len(tc.Names()))
+	fmt.Fprintf(c.Stdout(), "# background lambda: %.6f\n", lambdaFlag)
+	for _, tn := range tc.Names() {
+		t := tc.Tree(tn)
+		param.Stem = treeStem(t, stem)
+		df := diffusion.New(t, param)
+		bg[tn] = df.DownPass()
+		fmt.Fprintf(c.Stdout(), "# tree %s: background logLike: %.6f\n", tn, bg[tn])
+	}
+
+	fmt.Fprintf(c.Stdout(), "tree\tnode\tlambda\tlogLike\tgain\n")
+	for _, tn := range tc.Names() {
+		t := tc.Tree(tn)
+		param.Stem = treeStem(t, stem)
+		for _, n := range t.Nodes() {
+			if t.IsRoot(n) {
+				continue
+			}
+			b := searchNode(t, n, param)
+			fmt.Fprintf(c.Stdout(), "%s\t%d\t%.6f\t%.6f\t%.6f\n", tn, n, b.lambda, b.logLike, b.logLike-bg[tn])
+		}
+	}
+
+	return nil
+}
+
+// TreeStem returns the stem age of a tree.
+// If the stem is 0,
+// it will be the 10% of the root age.
+func treeStem(t *timetree.Tree, stem int64) int64 {
+	if stem == 0 {
+		return t.Age(t.Root()) / 10
+	}
+	return stem
+}
+
+// MaxUpSteps is the maximum number of steps
+// used in the first upward search.
+const maxUpSteps = 1000
+
+// BestRec stores the best reconstruction
+type bestRec struct {
+	lambda  float64
+	logLike float64
+}
+
+// SearchNode search for the best lambda value
+// of the subtree rooted at node n.
+func searchNode(t *timetree.Tree, n int, p diffusion.Param) bestRec {
+	eval := func(l float64) float64 {
+		df := diffusion.New(t, p)
+		df.SetLambda(n, l)
+		return df.DownPass()
+	}
+
+	b := bestRec{
+		lambda:  lambdaFlag,
+		logLike: eval(lambdaFlag),
+	}
+	b.first(eval, stepFlag)
+	for step := stepFlag / 2; ; step = step / 2 {
+		b.search(eval, step)
+		if step < stopFlag {
+			break
+		}
+	}
+	return b
+}
+
+func (b *bestRec) first(eval func(float64) float64, step float64) {
+	// go up
+	upOK := false
+	for i, l := 0, b.lambda+step; i < maxUpSteps; i, l = i+1, l+step {
+		like := eval(l)
+		if like <= b.logLike {
+			break
+		}
+		b.lambda = l
+		b.logLike = like
+		upOK = true
+	}
+	// we found an improvement
+	if upOK {
+		return
+	}
+
+	// go down
+	for l := b.lambda - step; l > 0; l -= step {
+		like := eval(l)
+		if like < b.logLike {
+			return
+		}
+		b.lambda = l
+		b.logLike = like
+	}
+}
+
+// Search go one step up and one step down
+// to see if the likelihood improves.
+func (b *bestRec) search(eval func(float64) float64, step float64) {
+	// go up
+	l := b.lambda + step
+	like := eval(l)
+	if like > b.logLike {
+		b.lambda = l
+		b.logLike = like
+		return
+	}
+
+	// go down
+	if b.lambda <= step {
+		return
+	}
+	l = b.lambda - step
+	like = eval(l)
+	if like > b.logLike {
+		b.lambda = l
+		b.logLike = like
+	}
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readRotation(name string, pix *earth.Pixelation) (*model.StageRot, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rot, err := model.ReadStageRot(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return rot, nil
+}
+
+func readStages(name string, rot *model.StageRot, landscape *model.TimePix) (timestage.Stages, error) {
+	stages := timestage.New()
+	stages.Add(rot)
+	stages.Add(landscape)
+
+	if name == "" {
+		return stages, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := timestage.Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+	stages.Add(st)
+
+	return stages, nil
+}
+
+func readPixWeights(name string) (pixweight.Pixel, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pw, err := pixweight.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return pw, nil
+}
+
+func readRanges(name string) (*ranges.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := ranges.ReadTSV(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func readAgeRanges(name string, pix *earth.Pixelation) (*agerange.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := agerange.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func readConstraints(name string, pix *earth.Pixelation) (*constraint.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := constraint.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
@@ -0,0 +1,534 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package simmap implements a command to export
+// a stochastic mapping
+// as SIMMAP formatted trees.
+package simmap
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/internal/input"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/timetree"
+)
+
+var Command = &command.Command{
+	Usage: `simmap [--areas <file>] [--labels <file>]
+	-i|--input <file> [-o|--output <file>] <project-file>`,
+	Short: "export a stochastic mapping as SIMMAP trees",
+	Long: `
+Command simmap reads a file with sampled pixels from a stochastic mapping of
+one or more trees in a project, and writes each particle as a tree in the
+SIMMAP format used by the R package phytools (e.g., to be read with the
+function read.simmap), so the stochastic maps can be post-processed in R.
+
+In a SIMMAP tree, each branch is annotated with the sequence of mapped states
+along the branch, from the oldest to the youngest, and the time spent in each
+state (in million years). For example, "A:{1,2.5:3,1.0}" indicates that the
+terminal A was in state 1 for 2.5 million years, and then in state 3 for 1
+million years.
+
+The mapped state is a discretization of the pixel of the particle. By default,
+the state is the landscape value of the pixel at the time stage of the
+particle. Use the flag --areas to define a different discretization, using a
+time pixelation file (with the same format as the landscape model) in which
+the value of each pixel is the ID of an area; pixels without a defined value
+will be assigned to the area 0. Use the flag --labels to give a name to the
+states. The labels file is a tab-delimited file with the columns "key", with
+the value of the state, and "label", with the name of the state. Spaces in
+labels will be replaced by underscores.
+
+In each time stage of a branch, the particle is located at the start pixel
+during the first half of the stage, and at the end pixel during the second
+half. Consecutive segments in the same state are merged.
+
+The argument of the command is the name of the project file.
+
+The flag --input, or -i, is required and indicates the input file. If the
+input is "-", the file will be read from the standard input.
+
+By default, the trees will be printed in the standard output, one tree per
+line. Use the flag --output, or -o, to define an output file. Particles with
+missing branches will be ignored.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var inputFile string
+var outputFile string
+var areasFile string
+var labelsFile string
+
+func setFlags(c *command.Command) {
+	c.Flags().StringVar(&inputFile, "input", "", "")
+	c.Flags().StringVar(&inputFile, "i", "", "")
+	c.Flags().StringVar(&outputFile, "output", "", "")
+	c.Flags().StringVar(&outputFile, "o", "", "")
+	c.Flags().StringVar(&areasFile, "areas", "", "")
+	c.Flags().StringVar(&labelsFile, "labels", "", "")
+}
+
+func run(c *command.Command, args []string) (err error) {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if inputFile == "" {
+		return c.UsageError("expecting input file, flag --input")
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("landscape not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	landscape, err := readTimePix(lsf, nil)
+	if err != nil {
+		return err
+	}
+
+	states := landscape
+	if areasFile != "" {
+		states, err = readTimePix(areasFile, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+
+	var labels map[int]string
+	if labelsFile != "" {
+		labels, err = readLabels(labelsFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	tf := p.Path(project.Trees)
+	if tf == "" {
+		msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	tc, err := readTreeFile(tf)
+	if err != nil {
+		return err
+	}
+
+	rt, err := getRec(inputFile, c.Stdin(), tc, landscape)
+	if err != nil {
+		return err
+	}
+
+	st := &stateMap{
+		tp:     states,
+		labels: labels,
+	}
+
+	if outputFile == "" || outputFile == "-" {
+		if err := writeSimmap(c.Stdout(), tc, rt, st); err != nil {
+			return fmt.Errorf("while writing on standard output: %v", err)
+		}
+		return nil
+	}
+
+	f, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+	if err := writeSimmap(f, tc, rt, st); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", outputFile, err)
+	}
+	return nil
+}
+
+func readTimePix(name string, pix *earth.Pixelation) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func readLabels(name string) (map[int]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tsv := csv.NewReader(f)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: while reading header: %v", name, err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range []string{"key", "label"} {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("on file %q: expecting field %q", name, h)
+		}
+	}
+
+	labels := make(map[int]string)
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on file %q: on row %d: %v", name, ln, err)
+		}
+
+		f := "key"
+		k, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on file %q: on row %d: field %q: %v", name, ln, f, err)
+		}
+
+		f = "label"
+		lb := strings.Join(strings.Fields(row[fields[f]]), "_")
+		if lb == "" {
+			continue
+		}
+		if strings.ContainsAny(lb, ",:{}();") {
+			return nil, fmt.Errorf("on file %q: on row %d: field %q: invalid label %q", name, ln, f, lb)
+		}
+		labels[k] = lb
+	}
+	return labels, nil
+}
+
+func getRec(name string, stdin io.Reader, tc *timetree.Collection, landscape *model.TimePix) (map[string]*recTree, error) {
+	f, err := input.Open(name, stdin)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rt, err := readRecon(f, tc, landscape)
+	if err != nil {
+		return nil, fmt.Errorf("on input file %q: %v", name, err)
+	}
+	return rt, nil
+}
+
+// A recTree stores the history
+// of each particle on a tree.
+type recTree struct {
+	name      string
+	particles map[int]*history
+}
+
+// A history stores the segments of each node
+// of a particle.
+type history struct {
+	nodes map[int][]segment
+}
+
+// A segment is the movement of a particle
+// in a time stage.
+type segment struct {
+	age  int64
+	from int
+	to   int
+}
+
+var headerFields = []string{
+	"tree",
+	"particle",
+	"node",
+	"age",
+	"from",
+	"to",
+}
+
+func readRecon(r io.Reader, tc *timetree.Collection, tp *model.TimePix) (map[string]*recTree, error) {
+	tsv := csv.NewReader(r)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range headerFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	rt := make(map[string]*recTree)
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "tree"
+		tn := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if tn == "" {
+			continue
+		}
+		tn = strings.ToLower(tn)
+		tv := tc.Tree(tn)
+		if tv == nil {
+			continue
+		}
+
+		f = "node"
+		id, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if tv.IsRoot(id) {
+			continue
+		}
+
+		f = "age"
+		age, err := strconv.ParseInt(row[fields[f]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+
+		f = "particle"
+		pN, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+
+		f = "from"
+		from, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if from >= tp.Pixelation().Len() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, from)
+		}
+
+		f = "to"
+		to, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if to >= tp.Pixelation().Len() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, to)
+		}
+
+		t, ok := rt[tn]
+		if !ok {
+			t = &recTree{
+				name:      tn,
+				particles: make(map[int]*history),
+			}
+			rt[tn] = t
+		}
+		h, ok := t.particles[pN]
+		if !ok {
+			h = &history{
+				nodes: make(map[int][]segment),
+			}
+			t.particles[pN] = h
+		}
+		h.nodes[id] = append(h.nodes[id], segment{
+			age:  age,
+			from: from,
+			to:   to,
+		})
+	}
+
+	if len(rt) == 0 {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+
+	return rt, nil
+}
+
+// A stateMap defines the state
+// of a pixel at a given age.
+type stateMap struct {
+	tp     *model.TimePix
+	labels map[int]string
+}
+
+func (sm *stateMap) state(age int64, px int) string {
+	v := sm.tp.AtClosest(age, px)
+	if lb, ok := sm.labels[v]; ok {
+		return lb
+	}
+	return strconv.Itoa(v)
+}
+
+// A mapped is the time spent in a state.
+type mapped struct {
+	state string
+	time  float64
+}
+
+// Branch returns the mapped states of a branch,
+// from the oldest to the youngest segment.
+// It returns false
+// if the branch is not complete.
+func (sm *stateMap) branch(t *timetree.Tree, id int, segs []segment) ([]mapped, bool) {
+	if len(segs) == 0 {
+		return nil, false
+	}
+	segs = slices.Clone(segs)
+	slices.SortFunc(segs, func(a, b segment) int {
+		if a.age > b.age {
+			return -1
+		}
+		if a.age < b.age {
+			return 1
+		}
+		return 0
+	})
+	if segs[len(segs)-1].age != t.Age(id) {
+		return nil, false
+	}
+
+	var m []mapped
+	add := func(s string, tm float64) {
+		if len(m) > 0 && m[len(m)-1].state == s {
+			m[len(m)-1].time += tm
+			return
+		}
+		m = append(m, mapped{state: s, time: tm})
+	}
+
+	prev := t.Age(t.Parent(id))
+	for _, s := range segs {
+		d := float64(prev-s.age) / timestage.MillionYears
+		prev = s.age
+		add(sm.state(s.age, s.from), d/2)
+		add(sm.state(s.age, s.to), d/2)
+	}
+	return m, true
+}
+
+func writeSimmap(w io.Writer, tc *timetree.Collection, rt map[string]*recTree, sm *stateMap) error {
+	bw := bufio.NewWriter(w)
+	for _, name := range tc.Names() {
+		r, ok := rt[name]
+		if !ok {
+			continue
+		}
+		t := tc.Tree(name)
+
+		particles := make([]int, 0, len(r.particles))
+		for p := range r.particles {
+			particles = append(particles, p)
+		}
+		slices.Sort(particles)
+
+		for _, p := range particles {
+			var sb strings.Builder
+			if !sm.node(&sb, t, t.Root(), r.particles[p]) {
+				continue
+			}
+			sb.WriteString(";\n")
+			if _, err := bw.WriteString(sb.String()); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// Node writes a node in SIMMAP format.
+// It returns false
+// if the history of the particle is incomplete.
+func (sm *stateMap) node(sb *strings.Builder, t *timetree.Tree, id int, h *history) bool {
+	if t.IsTerm(id) {
+		sb.WriteString(strings.Join(strings.Fields(t.Taxon(id)), "_"))
+	} else {
+		sb.WriteString("(")
+		for i, c := range t.Children(id) {
+			if i > 0 {
+				sb.WriteString(",")
+			}
+			if !sm.node(sb, t, c, h) {
+				return false
+			}
+		}
+		sb.WriteString(")")
+	}
+	if t.IsRoot(id) {
+		return true
+	}
+
+	m, ok := sm.branch(t, id, h.nodes[id])
+	if !ok {
+		return false
+	}
+	sb.WriteString(":{")
+	for i, s := range m {
+		if i > 0 {
+			sb.WriteString(":")
+		}
+		fmt.Fprintf(sb, "%s,%.6f", s.state, s.time)
+	}
+	sb.WriteString("}")
+	return true
+}
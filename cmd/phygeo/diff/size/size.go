@@ -0,0 +1,527 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package size implements a command to reconstruct
+// the evolution of the geographic range size
+// from a reconstruction.
+package size
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/internal/chart"
+	"github.com/js-arias/phygeo/internal/input"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/timetree"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+)
+
+var Command = &command.Command{
+	Usage: `size [--threshold <value>] [--plot <file-prefix>]
+	[--theme <theme>] [--format <format>] [--plot-size <size>]
+	-i|--input <file> <project-file>`,
+	Short: "reconstruct the evolution of range size",
+	Long: `
+Command size reads a file with a probability reconstruction for the nodes of
+one or more trees in a project, and estimates the size of the geographic range
+of each node at each time stage. Then it reports the range size trajectory
+along each path from the root to a terminal.
+
+The argument of the command is the name of the project file.
+
+The flag --input, or -i, is required and indicates the input file. The input
+file is a pixel probability file. If the input is "-", the file will be read
+from the standard input.
+
+The range size of a node at a time stage is the number of pixels with a
+density at least equal to a threshold, multiplied by the area of a pixel (the
+pixelation is equal area). In frequency and likelihood reconstructions, the
+density of each pixel is scaled, so the pixel with the highest value at each
+time stage has a density of 1. In KDE reconstructions, the values are already
+scaled to the CDF, so a threshold t is equivalent to the pixels inside the
+1-t bound of the CDF. By default, the threshold is 0.05. Use the flag
+--threshold to define a different value.
+
+The output will be printed in the standard output, as a tab-delimited table
+with the following columns:
+
+	tree     the name of the tree
+	term     the name of the terminal at the end of the path
+	node     the ID of the node in the path
+	age      the age of the time stage, in million years
+	pixels   the number of pixels above the threshold
+	area     the area of the range, in km^2
+
+The rows of each path are ordered from the oldest to the youngest time stage.
+
+If the flag --plot is defined with a file prefix, a plot of range size versus
+time will be produced for each tree, with a line for each path from the root
+to a terminal. The plot will be stored using the indicated prefix and the
+tree name. By default, the plot is a PNG file of 6x4 inches with a light
+theme. The flag --format sets the output format ("png", "svg", or "pdf"), the
+flag --plot-size sets the size, in inches, as "<width>x<height>" (for example
+"8x5"), and the flag --theme sets the color theme ("light" or "dark").
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var threshold float64
+var inputFile string
+var plotPrefix string
+var themeFlag string
+var formatFlag string
+var plotSize string
+
+func setFlags(c *command.Command) {
+	c.Flags().Float64Var(&threshold, "threshold", 0.05, "")
+	c.Flags().StringVar(&inputFile, "input", "", "")
+	c.Flags().StringVar(&inputFile, "i", "", "")
+	c.Flags().StringVar(&plotPrefix, "plot", "", "")
+	c.Flags().StringVar(&themeFlag, "theme", "light", "")
+	c.Flags().StringVar(&formatFlag, "format", chart.PNG, "")
+	c.Flags().StringVar(&plotSize, "plot-size", "", "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if inputFile == "" {
+		return c.UsageError("expecting input file, flag --input")
+	}
+	if threshold <= 0 || threshold > 1 {
+		return c.UsageError("flag --threshold: value must be between 0 and 1")
+	}
+	var style chart.Style
+	if plotPrefix != "" {
+		var err error
+		style, err = chart.NewStyle(themeFlag, formatFlag, plotSize, 6*vg.Inch, 4*vg.Inch)
+		if err != nil {
+			return c.UsageError(err.Error())
+		}
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("landscape not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	landscape, err := readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	tf := p.Path(project.Trees)
+	if tf == "" {
+		msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	tc, err := readTreeFile(tf)
+	if err != nil {
+		return err
+	}
+
+	rt, err := getRec(inputFile, c.Stdin(), landscape)
+	if err != nil {
+		return err
+	}
+
+	// the pixelation is equal area
+	pix := landscape.Pixelation()
+	pixArea := 4 * math.Pi * earth.Radius * earth.Radius / float64(pix.Len()) / 1_000_000
+
+	paths := make(map[string][]path)
+	for _, name := range tc.Names() {
+		r, ok := rt[name]
+		if !ok {
+			continue
+		}
+		paths[name] = treePaths(tc.Tree(name), r, pixArea)
+	}
+
+	if err := writeSizes(c.Stdout(), tc, paths); err != nil {
+		return fmt.Errorf("while writing on standard output: %v", err)
+	}
+
+	if plotPrefix != "" {
+		for _, name := range tc.Names() {
+			ps, ok := paths[name]
+			if !ok {
+				continue
+			}
+			if err := sizePlot(name, ps, style); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func getRec(name string, stdin io.Reader, landscape *model.TimePix) (map[string]*recTree, error) {
+	r, err := input.Open(name, stdin)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	rt, err := readRecon(r, landscape)
+	if err != nil {
+		return nil, fmt.Errorf("on input file %q: %v", name, err)
+	}
+	return rt, nil
+}
+
+type recTree struct {
+	name  string
+	nodes map[int]*recNode
+}
+
+type recNode struct {
+	id     int
+	stages map[int64]map[int]float64
+}
+
+var headerFields = []string{
+	"tree",
+	"node",
+	"age",
+	"type",
+	"equator",
+	"pixel",
+	"value",
+}
+
+func readRecon(r io.Reader, landscape *model.TimePix) (map[string]*recTree, error) {
+	tsv := csv.NewReader(r)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range headerFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	var tp string
+	rt := make(map[string]*recTree)
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "tree"
+		tn := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if tn == "" {
+			continue
+		}
+		tn = strings.ToLower(tn)
+		t, ok := rt[tn]
+		if !ok {
+			t = &recTree{
+				name:  tn,
+				nodes: make(map[int]*recNode),
+			}
+			rt[tn] = t
+		}
+
+		f = "node"
+		id, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		n, ok := t.nodes[id]
+		if !ok {
+			n = &recNode{
+				id:     id,
+				stages: make(map[int64]map[int]float64),
+			}
+			t.nodes[id] = n
+		}
+
+		f = "age"
+		age, err := strconv.ParseInt(row[fields[f]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		st, ok := n.stages[age]
+		if !ok {
+			st = make(map[int]float64)
+			n.stages[age] = st
+		}
+
+		f = "type"
+		tpV := strings.ToLower(strings.Join(strings.Fields(row[fields[f]]), " "))
+		if tpV == "" {
+			return nil, fmt.Errorf("on row %d: field %q: expecting reconstruction type", ln, f)
+		}
+		if tp == "" {
+			tp = tpV
+		}
+		if tp != tpV {
+			return nil, fmt.Errorf("on row %d: field %q: got %q want %q", ln, f, tpV, tp)
+		}
+
+		f = "equator"
+		eq, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if eq != landscape.Pixelation().Equator() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid equator value %d", ln, f, eq)
+		}
+
+		f = "pixel"
+		px, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if px >= landscape.Pixelation().Len() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, px)
+		}
+
+		f = "value"
+		v, err := strconv.ParseFloat(row[fields[f]], 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		st[px] = v
+	}
+	if len(rt) == 0 {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+
+	switch tp {
+	case "log-like":
+		// scale log-like values
+		for _, t := range rt {
+			for _, n := range t.nodes {
+				for _, s := range n.stages {
+					max := -math.MaxFloat64
+					for _, p := range s {
+						if p > max {
+							max = p
+						}
+					}
+					for px, p := range s {
+						s[px] = math.Exp(p - max)
+					}
+				}
+			}
+		}
+	case "freq":
+		// scale frequencies
+		for _, t := range rt {
+			for _, n := range t.nodes {
+				for _, s := range n.stages {
+					var max float64
+					for _, p := range s {
+						if p > max {
+							max = p
+						}
+					}
+					for px, p := range s {
+						s[px] = p / max
+					}
+				}
+			}
+		}
+	case "kde":
+		// values are already scaled to the CDF
+	default:
+		return nil, fmt.Errorf("unknown reconstruction type %q", tp)
+	}
+
+	return rt, nil
+}
+
+// A path is the range size trajectory
+// from the root to a terminal.
+type path struct {
+	term  string
+	sizes []stageSize
+}
+
+// A stageSize is the range size
+// of a node at a time stage.
+type stageSize struct {
+	node   int
+	age    int64
+	pixels int
+	area   float64
+}
+
+// TreePaths returns the range size trajectories
+// of each terminal of a tree.
+func treePaths(t *timetree.Tree, r *recTree, pixArea float64) []path {
+	terms := t.Terms()
+	paths := make([]path, 0, len(terms))
+	for _, term := range terms {
+		tn, _ := t.TaxNode(term)
+		var ids []int
+		for id := tn; id >= 0; id = t.Parent(id) {
+			ids = append(ids, id)
+		}
+		slices.Reverse(ids)
+
+		p := path{term: term}
+		for _, id := range ids {
+			n, ok := r.nodes[id]
+			if !ok {
+				continue
+			}
+			ages := make([]int64, 0, len(n.stages))
+			for a := range n.stages {
+				ages = append(ages, a)
+			}
+			slices.Sort(ages)
+			for i := len(ages) - 1; i >= 0; i-- {
+				var px int
+				for _, v := range n.stages[ages[i]] {
+					if v >= threshold {
+						px++
+					}
+				}
+				p.sizes = append(p.sizes, stageSize{
+					node:   id,
+					age:    ages[i],
+					pixels: px,
+					area:   float64(px) * pixArea,
+				})
+			}
+		}
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+func writeSizes(w io.Writer, tc *timetree.Collection, paths map[string][]path) error {
+	tab := csv.NewWriter(w)
+	tab.Comma = '\t'
+	tab.UseCRLF = true
+
+	if err := tab.Write([]string{"tree", "term", "node", "age", "pixels", "area"}); err != nil {
+		return err
+	}
+	for _, name := range tc.Names() {
+		ps, ok := paths[name]
+		if !ok {
+			continue
+		}
+		for _, p := range ps {
+			for _, s := range p.sizes {
+				row := []string{
+					name,
+					p.term,
+					strconv.Itoa(s.node),
+					strconv.FormatFloat(float64(s.age)/timestage.MillionYears, 'f', 3, 64),
+					strconv.Itoa(s.pixels),
+					strconv.FormatFloat(s.area, 'f', 3, 64),
+				}
+				if err := tab.Write(row); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	tab.Flush()
+	if err := tab.Error(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func sizePlot(name string, paths []path, style chart.Style) error {
+	p := style.New()
+	p.Title.Text = name
+	p.X.Label.Text = "age (Ma)"
+	p.Y.Label.Text = "range size (km^2)"
+
+	for _, ps := range paths {
+		if len(ps.sizes) == 0 {
+			continue
+		}
+		xy := make(plotter.XYs, 0, len(ps.sizes))
+		for _, s := range ps.sizes {
+			xy = append(xy, plotter.XY{
+				X: float64(s.age) / timestage.MillionYears,
+				Y: s.area,
+			})
+		}
+		ln, err := plotter.NewLine(xy)
+		if err != nil {
+			return fmt.Errorf("tree %q: terminal %q: %v", name, ps.term, err)
+		}
+		ln.LineStyle = style.LineStyle()
+		p.Add(ln)
+	}
+
+	out := fmt.Sprintf("%s-%s-size", plotPrefix, name)
+	if err := style.Save(p, out); err != nil {
+		return err
+	}
+	return nil
+}
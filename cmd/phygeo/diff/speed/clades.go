@@ -0,0 +1,438 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package speed
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/js-arias/earth"
+	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/timetree"
+	"gonum.org/v1/gonum/stat"
+)
+
+// A clade is a set of terminals
+// defined by the user.
+type clade struct {
+	name  string
+	terms []string
+}
+
+// ReadClades reads a file with clade definitions.
+func readClades(name string) ([]*clade, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cl, err := parseClades(f)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+	return cl, nil
+}
+
+var cladeFields = []string{
+	"clade",
+	"taxon",
+}
+
+func parseClades(r io.Reader) ([]*clade, error) {
+	tsv := csv.NewReader(r)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range cladeFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	var cl []*clade
+	cm := make(map[string]*clade)
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "clade"
+		cn := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if cn == "" {
+			continue
+		}
+		f = "taxon"
+		tax := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if tax == "" {
+			continue
+		}
+
+		c, ok := cm[strings.ToLower(cn)]
+		if !ok {
+			c = &clade{name: cn}
+			cm[strings.ToLower(cn)] = c
+			cl = append(cl, c)
+		}
+		c.terms = append(c.terms, tax)
+	}
+	if len(cl) == 0 {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+	for _, c := range cl {
+		if len(c.terms) < 2 {
+			return nil, fmt.Errorf("clade %q: expecting at least two terminals", c.name)
+		}
+	}
+	return cl, nil
+}
+
+// A recClade contains the distance
+// traveled by each particle
+// in all the branches of a clade.
+type recClade struct {
+	clade *clade
+	node  int
+
+	// number of branches in the clade
+	branches int
+
+	// sum of the branch lengths
+	// in million years
+	brLen float64
+
+	// distance (in radians)
+	// and weight of each particle
+	dist   map[int]float64
+	weight map[int]float64
+}
+
+// GetCladeRecs returns the reconstructions of each clade
+// in a tree.
+// A clade includes all the branches
+// descendant from the most recent common ancestor
+// of its terminals
+// (i.e., the crown group).
+func getCladeRecs(t *timetree.Tree, rt *recTree, cl []*clade) ([]*recClade, error) {
+	rc := make([]*recClade, 0, len(cl))
+	for _, c := range cl {
+		mrca := t.MRCA(c.terms...)
+		if mrca < 0 {
+			return nil, fmt.Errorf("tree %q: clade %q: terminals not found in tree", t.Name(), c.name)
+		}
+
+		r := &recClade{
+			clade:  c,
+			node:   mrca,
+			dist:   make(map[int]float64),
+			weight: make(map[int]float64),
+		}
+		nodes := []int{mrca}
+		for len(nodes) > 0 {
+			id := nodes[0]
+			nodes = nodes[1:]
+			for _, d := range t.Children(id) {
+				nodes = append(nodes, d)
+
+				n, ok := rt.nodes[d]
+				if !ok {
+					continue
+				}
+				r.branches++
+				r.brLen += float64(t.Age(id)-t.Age(d)) / timestage.MillionYears
+				for _, p := range n.recs {
+					r.dist[p.id] += p.dist
+					r.weight[p.id] = p.weight
+				}
+			}
+		}
+		rc = append(rc, r)
+	}
+	return rc, nil
+}
+
+// Speeds returns the speed
+// (in kilometers per million year)
+// of each particle
+// in a clade.
+func (rc *recClade) speeds() map[int]float64 {
+	sp := make(map[int]float64, len(rc.dist))
+	for id, d := range rc.dist {
+		sp[id] = d * earth.Radius / 1000 / rc.brLen
+	}
+	return sp
+}
+
+func writeClades(name string, tc *timetree.Collection, rt map[string]*recTree, cl []*clade) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	tab := csv.NewWriter(f)
+	tab.Comma = '\t'
+	tab.UseCRLF = true
+
+	if err := tab.Write([]string{"tree", "clade", "node", "branches", "brLen", "distance", "d-025", "d-975", "speed", "s-025", "s-975"}); err != nil {
+		return err
+	}
+	for _, tn := range tc.Names() {
+		dt, ok := rt[tn]
+		if !ok {
+			continue
+		}
+		rc, err := getCladeRecs(tc.Tree(tn), dt, cl)
+		if err != nil {
+			return err
+		}
+		for _, r := range rc {
+			dist, dw := sortedValues(r.dist, r.weight, earth.Radius/1000)
+			speed, sw := sortedValues(r.speeds(), r.weight, 1)
+			row := []string{
+				tn,
+				r.clade.name,
+				strconv.Itoa(r.node),
+				strconv.Itoa(r.branches),
+				strconv.FormatFloat(r.brLen, 'f', 3, 64),
+				strconv.FormatFloat(stat.Quantile(0.5, stat.Empirical, dist, dw), 'f', 3, 64),
+				strconv.FormatFloat(stat.Quantile(0.025, stat.Empirical, dist, dw), 'f', 3, 64),
+				strconv.FormatFloat(stat.Quantile(0.975, stat.Empirical, dist, dw), 'f', 3, 64),
+				strconv.FormatFloat(stat.Quantile(0.5, stat.Empirical, speed, sw), 'f', 3, 64),
+				strconv.FormatFloat(stat.Quantile(0.025, stat.Empirical, speed, sw), 'f', 3, 64),
+				strconv.FormatFloat(stat.Quantile(0.975, stat.Empirical, speed, sw), 'f', 3, 64),
+			}
+			if err := tab.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	tab.Flush()
+	if err := tab.Error(); err != nil {
+		return fmt.Errorf("while writing file %q: %v", name, err)
+	}
+	return nil
+}
+
+func writeCladeCmp(name string, tc *timetree.Collection, rt map[string]*recTree, cl []*clade) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	tab := csv.NewWriter(f)
+	tab.Comma = '\t'
+	tab.UseCRLF = true
+
+	if err := tab.Write([]string{"tree", "clade1", "clade2", "speed1", "speed2", "diff", "faster", "p-value"}); err != nil {
+		return err
+	}
+	for _, tn := range tc.Names() {
+		dt, ok := rt[tn]
+		if !ok {
+			continue
+		}
+		rc, err := getCladeRecs(tc.Tree(tn), dt, cl)
+		if err != nil {
+			return err
+		}
+		for i, r1 := range rc {
+			for _, r2 := range rc[i+1:] {
+				c := compareClades(r1, r2, permFlag)
+				row := []string{
+					tn,
+					r1.clade.name,
+					r2.clade.name,
+					strconv.FormatFloat(c.speed1, 'f', 3, 64),
+					strconv.FormatFloat(c.speed2, 'f', 3, 64),
+					strconv.FormatFloat(c.speed1-c.speed2, 'f', 3, 64),
+					strconv.FormatFloat(c.faster, 'f', 3, 64),
+					strconv.FormatFloat(c.pValue, 'f', 6, 64),
+				}
+				if err := tab.Write(row); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	tab.Flush()
+	if err := tab.Error(); err != nil {
+		return fmt.Errorf("while writing file %q: %v", name, err)
+	}
+	return nil
+}
+
+// A cladeCmp is the comparison
+// of the speeds of two clades.
+type cladeCmp struct {
+	// median speed of each clade
+	speed1 float64
+	speed2 float64
+
+	// fraction of particles
+	// in which the first clade is faster
+	faster float64
+
+	// p-value of the permutation test
+	pValue float64
+}
+
+// CompareClades compares the speeds of two clades
+// using a paired permutation test across particles:
+// as each particle is a full history of the tree,
+// in each replicate,
+// the speeds of the two clades are swapped
+// at random on each particle,
+// and the difference of the median speeds is recorded.
+// The p-value is the fraction of replicates
+// with an absolute difference
+// equal or larger than the observed one.
+func compareClades(r1, r2 *recClade, perm int) cladeCmp {
+	sp1 := r1.speeds()
+	sp2 := r2.speeds()
+
+	ids := make([]int, 0, len(sp1))
+	for id := range sp1 {
+		if _, ok := sp2[id]; !ok {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	v1 := make([]float64, len(ids))
+	v2 := make([]float64, len(ids))
+	w := make([]float64, len(ids))
+	var faster, sumW float64
+	for i, id := range ids {
+		v1[i] = sp1[id]
+		v2[i] = sp2[id]
+		w[i] = r1.weight[id]
+		sumW += w[i]
+		if v1[i] > v2[i] {
+			faster += w[i]
+		}
+	}
+
+	c := cladeCmp{
+		speed1: weightedMedian(v1, w),
+		speed2: weightedMedian(v2, w),
+		pValue: 1,
+	}
+	if sumW > 0 {
+		c.faster = faster / sumW
+	}
+	if perm <= 0 {
+		return c
+	}
+
+	obs := math.Abs(c.speed1 - c.speed2)
+	p1 := make([]float64, len(ids))
+	p2 := make([]float64, len(ids))
+	count := 1
+	for range perm {
+		for i := range ids {
+			p1[i], p2[i] = v1[i], v2[i]
+			if rand.IntN(2) == 1 {
+				p1[i], p2[i] = v2[i], v1[i]
+			}
+		}
+		d := math.Abs(weightedMedian(p1, w) - weightedMedian(p2, w))
+		if d >= obs {
+			count++
+		}
+	}
+	c.pValue = float64(count) / float64(perm+1)
+	return c
+}
+
+// SortedValues returns the values of each particle,
+// multiplied by a scale,
+// and sorted from the smallest to the largest,
+// as well as the weights of each particle.
+func sortedValues(vals, weights map[int]float64, scale float64) (v, w []float64) {
+	ids := make([]int, 0, len(vals))
+	for id := range vals {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, func(a, b int) int {
+		if vals[a] < vals[b] {
+			return -1
+		}
+		if vals[a] > vals[b] {
+			return 1
+		}
+		return a - b
+	})
+
+	v = make([]float64, 0, len(ids))
+	w = make([]float64, 0, len(ids))
+	for _, id := range ids {
+		v = append(v, vals[id]*scale)
+		w = append(w, weights[id])
+	}
+	return v, w
+}
+
+// WeightedMedian returns the weighted median
+// of a set of values.
+func weightedMedian(vals, weights []float64) float64 {
+	idx := make([]int, len(vals))
+	for i := range idx {
+		idx[i] = i
+	}
+	slices.SortFunc(idx, func(a, b int) int {
+		if vals[a] < vals[b] {
+			return -1
+		}
+		if vals[a] > vals[b] {
+			return 1
+		}
+		return 0
+	})
+
+	v := make([]float64, len(idx))
+	w := make([]float64, len(idx))
+	for i, j := range idx {
+		v[i] = vals[j]
+		w[i] = weights[j]
+	}
+	return stat.Quantile(0.5, stat.Empirical, v, w)
+}
@@ -0,0 +1,111 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package speed
+
+import (
+	"math"
+	"slices"
+	"strconv"
+
+	"github.com/js-arias/earth"
+	"gonum.org/v1/gonum/stat"
+)
+
+// A displacement is the decomposition
+// of the movement of a particle
+// in its latitudinal and longitudinal components,
+// in radians.
+type displacement struct {
+	// north is the latitudinal displacement,
+	// positive to the north
+	north float64
+
+	// pole is the displacement towards the poles,
+	// positive if the particle moves to a higher latitude
+	pole float64
+
+	// east is the longitudinal displacement,
+	// positive to the east
+	east float64
+}
+
+// Add adds the displacement
+// between two points.
+// The longitudinal displacement is measured
+// along the parallel of the mean latitude of the points,
+// using the shortest direction.
+func (d *displacement) add(from, to earth.Point) {
+	fLat := earth.ToRad(from.Latitude())
+	tLat := earth.ToRad(to.Latitude())
+	d.north += tLat - fLat
+	d.pole += math.Abs(tLat) - math.Abs(fLat)
+
+	dLon := to.Longitude() - from.Longitude()
+	if dLon > 180 {
+		dLon -= 360
+	}
+	if dLon < -180 {
+		dLon += 360
+	}
+	d.east += earth.ToRad(dLon) * math.Cos((fLat+tLat)/2)
+}
+
+var dirHeader = []string{
+	"north",
+	"n-025",
+	"n-975",
+	"poleward",
+	"p-025",
+	"p-975",
+	"east",
+	"e-025",
+	"e-975",
+}
+
+// DirCols returns the columns
+// of the decomposed displacements
+// of a set of particles,
+// as the median,
+// and the 2.5% and 97.5% of the empirical CDF
+// of each component,
+// in kilometers.
+func dirCols(dirs []displacement, weights []float64) []string {
+	components := []func(d displacement) float64{
+		func(d displacement) float64 { return d.north },
+		func(d displacement) float64 { return d.pole },
+		func(d displacement) float64 { return d.east },
+	}
+
+	cols := make([]string, 0, len(dirHeader))
+	for _, fn := range components {
+		idx := make([]int, len(dirs))
+		for i := range idx {
+			idx[i] = i
+		}
+		slices.SortFunc(idx, func(a, b int) int {
+			va, vb := fn(dirs[a]), fn(dirs[b])
+			if va < vb {
+				return -1
+			}
+			if va > vb {
+				return 1
+			}
+			return 0
+		})
+		v := make([]float64, 0, len(idx))
+		w := make([]float64, 0, len(idx))
+		for _, i := range idx {
+			v = append(v, fn(dirs[i])*earth.Radius/1000)
+			w = append(w, weights[i])
+		}
+
+		cols = append(cols,
+			strconv.FormatFloat(stat.Quantile(0.5, stat.Empirical, v, w), 'f', 3, 64),
+			strconv.FormatFloat(stat.Quantile(0.025, stat.Empirical, v, w), 'f', 3, 64),
+			strconv.FormatFloat(stat.Quantile(0.975, stat.Empirical, v, w), 'f', 3, 64),
+		)
+	}
+	return cols
+}
@@ -10,11 +10,11 @@ import (
 	"slices"
 
 	"github.com/js-arias/earth"
+	"github.com/js-arias/phygeo/internal/chart"
 	"github.com/js-arias/phygeo/timestage"
 	"github.com/js-arias/timetree"
 	"gonum.org/v1/gonum/stat"
 	"gonum.org/v1/plot"
-	"gonum.org/v1/plot/plotter"
 	"gonum.org/v1/plot/vg"
 	"gonum.org/v1/plot/vg/draw"
 )
@@ -23,6 +23,7 @@ import (
 type speedTimePlot struct {
 	speed, max, min map[int64]float64
 	style           draw.LineStyle
+	fill            color.Color
 }
 
 // DataRange implements the plot.DataRanger interface.
@@ -74,7 +75,7 @@ func (tp *speedTimePlot) Plot(c draw.Canvas, plt *plot.Plot) {
 			{X: x, Y: trY(tp.min[a])},
 			{X: x, Y: trY(tp.max[a])},
 		}
-		c.FillPolygon(color.RGBA{127, 188, 165, 255}, pts)
+		c.FillPolygon(tp.fill, pts)
 	}
 
 	c.SetLineStyle(tp.style)
@@ -99,8 +100,8 @@ func (tp *speedTimePlot) Plot(c draw.Canvas, plt *plot.Plot) {
 	c.Stroke(p)
 }
 
-func timeSpeedPlot(t *timetree.Tree, ts *treeSlice) error {
-	p := plot.New()
+func timeSpeedPlot(t *timetree.Tree, ts *treeSlice, style chart.Style) error {
+	p := style.New()
 	p.X.Label.Text = "age (Ma)"
 	p.Y.Label.Text = "speed (km/My)"
 
@@ -108,17 +109,12 @@ func timeSpeedPlot(t *timetree.Tree, ts *treeSlice) error {
 		speed: make(map[int64]float64, len(ts.timeSlices)),
 		min:   make(map[int64]float64, len(ts.timeSlices)),
 		max:   make(map[int64]float64, len(ts.timeSlices)),
-		style: plotter.DefaultLineStyle,
+		style: style.LineStyle(),
+		fill:  style.Theme.Fill,
 	}
 
 	for a, s := range ts.timeSlices {
-		dist := make([]float64, 0, len(s.distances))
-		weights := make([]float64, 0, len(s.distances))
-		for _, d := range s.distances {
-			dist = append(dist, d*earth.Radius/1000)
-			weights = append(weights, 1.0)
-		}
-		slices.Sort(dist)
+		dist, weights := s.sliceDist(earth.Radius / 1000)
 
 		d := stat.Quantile(0.5, stat.Empirical, dist, weights)
 		sp := d / s.sumBrLen
@@ -129,7 +125,7 @@ func timeSpeedPlot(t *timetree.Tree, ts *treeSlice) error {
 	}
 
 	p.Add(spp)
-	if err := p.Save(6*vg.Inch, 4*vg.Inch, fmt.Sprintf("%s-%s-nodes-box.png", plotPrefix, t.Name())); err != nil {
+	if err := style.Save(p, fmt.Sprintf("%s-%s-nodes-box", plotPrefix, t.Name())); err != nil {
 		return err
 	}
 	return nil
@@ -0,0 +1,51 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package speed
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/js-arias/timetree"
+)
+
+// Valid values for the treatment
+// of post-split stages.
+const (
+	postKeep  = "keep"
+	postSkip  = "skip"
+	postMerge = "merge"
+)
+
+// ParsePostSplit returns the treatment
+// of post-split stages.
+func parsePostSplit(v string) (string, error) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	switch v {
+	case postKeep, postSkip, postMerge:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown value %q", v)
+}
+
+// SkipPostSplit returns true if a row
+// is from a post-split stage,
+// i.e., a stage of a node
+// at the age of the split of its parent node,
+// and it should be ignored.
+//
+// As post-split stages have no duration,
+// merging them with the split stage of the parent
+// does not add any distance,
+// so they are ignored with both skip and merge.
+func skipPostSplit(t *timetree.Tree, id int, age int64) bool {
+	if postMode == postKeep {
+		return false
+	}
+	if t.IsRoot(id) {
+		return false
+	}
+	return t.Age(t.Parent(id)) == age
+}
@@ -22,11 +22,14 @@ import (
 	"github.com/js-arias/earth"
 	"github.com/js-arias/earth/model"
 	"github.com/js-arias/earth/stat/dist"
+	"github.com/js-arias/phygeo/internal/chart"
+	"github.com/js-arias/phygeo/internal/input"
 	"github.com/js-arias/phygeo/probmap"
 	"github.com/js-arias/phygeo/project"
 	"github.com/js-arias/phygeo/timestage"
 	"github.com/js-arias/timetree"
 	"gonum.org/v1/gonum/stat"
+	"gonum.org/v1/plot/vg"
 )
 
 var Command = &command.Command{
@@ -35,9 +38,11 @@ var Command = &command.Command{
 	[--step <number>] [--scale <value>]
 	[--color <color-scale>] [--width <value>]
 	[--box <number>] [--tick <tick-value>]
-	[--time] [--plot <file-prefix>]
-	[--null <number>]
-	-i|--input <file> <project-file>`,
+	[--time] [--direction] [--plot <file-prefix>]
+	[--theme <theme>] [--format <format>] [--plot-size <size>]
+	[--null <number>] [--post-split <mode>]
+	[--clades <file>] [--clade-out <file-prefix>] [--perm <number>]
+	[-i|--input <file>] <project-file>`,
 	Short: "calculates speed and distance for a reconstruction",
 	Long: `
 Command speed reads a file with a sampled pixels from stochastic mapping of
@@ -57,9 +62,14 @@ that move less than 5% of the simulations (i.e., they are slowest). By
 default, the number of simulations is 1000; this can be changed with the flag
 --null.
 
-The argument of the command is the name of the project file.
+The argument of the command is the name of the project file. It can also be
+a reconstruction bundle built with the command 'diff bundle'; in that case,
+all the datasets will be read from the bundle.
 
-The flag --input, or -i, is required and indicates the input file.
+The flag --input, or -i, indicates the input file. If the input is "-", the
+file will be read from the standard input. The flag is required, unless a
+bundle with a single reconstruction is used. If a bundle is used, the input
+file will be searched first in the bundle, using the base name of the file.
 
 If the flag --tree is defined with a file prefix, each tree will be saved as
 SVG with each branch colored by the speed of the branch in a red(=fast)-green-
@@ -111,6 +121,110 @@ with the following columns:
 	faster    fraction of particles faster than the 95% of the simulations
 	speed     the median of the speed in kilometers per million year
 	speed-rad the median of the speed in radians per million year
+	lambda    an approximate estimate of the lambda value of the branch
+
+The branch-specific lambda is a method-of-moments estimate, based on the
+expected squared displacement of a spherical normal: as the variance of the
+spherical normal for a time segment of length t is approximately 1/(lambda/t)
+on each axis, the expected squared great circle distance traveled in the
+segment is 2*t/lambda. Then, the estimate is 2*brLen/mean(d^2), in which d^2
+is the sum of the squared distances (in radians) of the time segments of the
+branch of each particle. This estimate is only an approximation (it ignores
+the discretization of the pixelation, and the effect of the landscape and the
+pixel weights on the particle movement), but it can be used to visualize the
+heterogeneity of the rates among branches without the fit of a relaxed model.
+For the whole tree (the row with node "--"), the estimate uses all branches.
+If the particles do not move in a branch, the value will be "NA".
+
+If the flag --direction is used, the displacement of each time segment is
+decomposed into its latitudinal and longitudinal components, and the
+following columns are added to the output:
+
+	north     the median of the latitudinal displacement in kilometers
+	          (positive to the north)
+	n-025     the 2.5% of the empirical CDF of the latitudinal displacement
+	n-975     the 97.5% of the empirical CDF of the latitudinal displacement
+	poleward  the median of the displacement towards the poles in
+	          kilometers (positive to higher latitudes, in either
+	          hemisphere)
+	p-025     the 2.5% of the empirical CDF of the poleward displacement
+	p-975     the 97.5% of the empirical CDF of the poleward displacement
+	east      the median of the longitudinal displacement in kilometers
+	          (positive to the east)
+	e-025     the 2.5% of the empirical CDF of the longitudinal displacement
+	e-975     the 97.5% of the empirical CDF of the longitudinal displacement
+
+The components are the net displacements of the particles (i.e., movements in
+opposite directions cancel each other), so they can be used to detect
+directional trends, for example, a poleward movement after a climatic change.
+The longitudinal displacement of a time segment is measured along the parallel
+of the mean latitude of the segment, using the shortest direction. The flag
+can be used with the flag --time, in which case the columns are added to each
+time slice.
+
+If the stochastic mapping file has a "weight" column (for example, when the
+particles were produced from several lambda values), the quantiles, the
+fractions of slower and faster particles, and the lambda estimate will be
+weighted by the weight of each particle.
+
+Each node (except the root) might have a post-split stage, at the age of the
+split of its parent node, that duplicates the split stage of the parent. The
+flag --post-split defines how these stages are treated. Valid values are:
+
+	skip   the post-split stages are ignored (the default)
+	merge  as post-split stages have no duration, it is the same as skip
+	keep   the movements in the post-split stages are added to the node
+
+If the flag --clades is defined with a file, the distance and speed will be
+also aggregated for each clade defined in the file. The file is a tab-delimited
+file with the columns "clade", with the name of the clade, and "taxon", with
+the name of a terminal of the clade (one terminal per row). For example:
+
+	clade	taxon
+	felids	Panthera leo
+	felids	Felis catus
+	canids	Canis lupus
+	canids	Vulpes vulpes
+
+Each clade is defined by the most recent common ancestor (MRCA) of its
+terminals, and it includes all the branches descendant from the MRCA (i.e.,
+the crown group). For each particle, the distance is the sum of the distances
+traveled in all the branches of the clade, and the speed is that distance
+divided by the sum of the branch lengths of the clade. The results will be
+stored in two files, using the prefix defined with the flag --clade-out (by
+default "clades"). The file "<prefix>-speed.tab" is a tab-delimited file with
+the following columns:
+
+	tree      the name of the tree
+	clade     the name of the clade
+	node      the ID of the MRCA of the clade
+	branches  the number of branches in the clade
+	brLen     the sum of the branch lengths in million years
+	distance  the median of the traveled distance in kilometers
+	d-025     the 2.5% of the empirical CDF of the distance
+	d-975     the 97.5% of the empirical CDF of the distance
+	speed     the median of the speed in kilometers per million year
+	s-025     the 2.5% of the empirical CDF of the speed
+	s-975     the 97.5% of the empirical CDF of the speed
+
+The file "<prefix>-cmp.tab" compares the speeds of each pair of clades. As
+each particle is a full history of the tree, the comparison is made with a
+paired permutation test across particles: in each replicate, the speeds of the
+two clades are swapped at random in each particle, and the absolute difference
+of the median speeds is compared with the observed difference. By default,
+1000 replicates are used; use the flag --perm to define a different number.
+The file has the following columns:
+
+	tree      the name of the tree
+	clade1    the name of the first clade
+	clade2    the name of the second clade
+	speed1    the median speed of the first clade
+	speed2    the median speed of the second clade
+	diff      the difference between the median speeds
+	faster    fraction of particles in which the first clade is faster
+	p-value   the p-value of the permutation test
+
+The flag --clades is ignored if the flag --time is used.
 
 If the flag --time is used, instead of calculating the speed per branch, the
 speed will be calculated for each time slice. In this case the whole traveled
@@ -127,13 +241,19 @@ tab-delimited file with the following columns:
 	speed     the median of the speed in kilometers per million year
 
 If the flag --plot is defined with a file prefix, a box plot for each tree
-will be produced, using the speed of each time segment.
+will be produced, using the speed of each time segment. By default, the plots
+are PNG files of 6x4 inches, drawn with a light theme. Use the flag --format
+to define a different output format (valid values are "png", "svg", and
+"pdf"), the flag --plot-size to define the size of the plots, in inches, as
+"<width>x<height>" (for example "8x5"), and the flag --theme to use a "dark"
+theme.
 	`,
 	SetFlags: setFlags,
 	Run:      run,
 }
 
 var useTime bool
+var useDir bool
 var stepX float64
 var timeBox float64
 var scale float64
@@ -142,11 +262,23 @@ var nullFlag int
 var treePrefix string
 var inputFile string
 var plotPrefix string
+var themeFlag string
+var formatFlag string
+var plotSize string
 var tickFlag string
 var colorScale string
+var postSplitFlag string
+var cladesFile string
+var cladePrefix string
+var permFlag int
+
+// postMode is the parsed value
+// of the flag --post-split
+var postMode string
 
 func setFlags(c *command.Command) {
 	c.Flags().BoolVar(&useTime, "time", false, "")
+	c.Flags().BoolVar(&useDir, "direction", false, "")
 	c.Flags().Float64Var(&stepX, "step", 10, "")
 	c.Flags().Float64Var(&timeBox, "box", 0, "")
 	c.Flags().Float64Var(&scale, "scale", timestage.MillionYears, "")
@@ -156,22 +288,46 @@ func setFlags(c *command.Command) {
 	c.Flags().StringVar(&inputFile, "i", "", "")
 	c.Flags().StringVar(&treePrefix, "tree", "", "")
 	c.Flags().StringVar(&plotPrefix, "plot", "", "")
+	c.Flags().StringVar(&themeFlag, "theme", "light", "")
+	c.Flags().StringVar(&formatFlag, "format", chart.PNG, "")
+	c.Flags().StringVar(&plotSize, "plot-size", "", "")
 	c.Flags().StringVar(&tickFlag, "tick", "", "")
 	c.Flags().StringVar(&colorScale, "color", "rainbow", "")
+	c.Flags().StringVar(&postSplitFlag, "post-split", postSkip, "")
+	c.Flags().StringVar(&cladesFile, "clades", "", "")
+	c.Flags().StringVar(&cladePrefix, "clade-out", "clades", "")
+	c.Flags().IntVar(&permFlag, "perm", 1000, "")
 }
 
 func run(c *command.Command, args []string) error {
 	if len(args) < 1 {
 		return c.UsageError("expecting project file")
 	}
-	if inputFile == "" {
-		return c.UsageError("expecting input file, flag --input")
+	var err error
+	postMode, err = parsePostSplit(postSplitFlag)
+	if err != nil {
+		return c.UsageError(fmt.Sprintf("flag --post-split: %v", err))
+	}
+	var style chart.Style
+	if plotPrefix != "" {
+		style, err = chart.NewStyle(themeFlag, formatFlag, plotSize, 6*vg.Inch, 4*vg.Inch)
+		if err != nil {
+			return c.UsageError(err.Error())
+		}
 	}
 
-	p, err := project.Read(args[0])
+	p, err := openProject(args[0])
 	if err != nil {
 		return err
 	}
+	defer closeBundle()
+
+	if inputFile == "" {
+		inputFile, err = bundleInput()
+		if err != nil {
+			return c.UsageError(err.Error())
+		}
+	}
 
 	lsf := p.Path(project.Landscape)
 	if lsf == "" {
@@ -206,7 +362,7 @@ func run(c *command.Command, args []string) error {
 			return err
 		}
 
-		tSlice, err := getTimeSlice(inputFile, tc, landscape, stages)
+		tSlice, err := getTimeSlice(inputFile, c.Stdin(), tc, landscape, stages)
 		if err != nil {
 			return err
 		}
@@ -222,7 +378,7 @@ func run(c *command.Command, args []string) error {
 				if !ok {
 					continue
 				}
-				if err := timeSpeedPlot(t, dt); err != nil {
+				if err := timeSpeedPlot(t, dt, style); err != nil {
 					continue
 				}
 			}
@@ -230,7 +386,7 @@ func run(c *command.Command, args []string) error {
 		return nil
 	}
 
-	tBranch, err := getBranches(inputFile, tc, landscape)
+	tBranch, err := getBranches(inputFile, c.Stdin(), tc, landscape)
 	if err != nil {
 		return err
 	}
@@ -267,6 +423,19 @@ func run(c *command.Command, args []string) error {
 		return err
 	}
 
+	if cladesFile != "" {
+		cl, err := readClades(cladesFile)
+		if err != nil {
+			return err
+		}
+		if err := writeClades(cladePrefix+"-speed.tab", tc, tBranch, cl); err != nil {
+			return err
+		}
+		if err := writeCladeCmp(cladePrefix+"-cmp.tab", tc, tBranch, cl); err != nil {
+			return err
+		}
+	}
+
 	if treePrefix != "" {
 		if err := plotTrees(tc, tBranch, gradient); err != nil {
 			return err
@@ -277,7 +446,7 @@ func run(c *command.Command, args []string) error {
 }
 
 func readLandscape(name string) (*model.TimePix, error) {
-	f, err := os.Open(name)
+	f, err := openFile(name)
 	if err != nil {
 		return nil, err
 	}
@@ -304,7 +473,7 @@ func readStages(name, rotF string, landscape *model.TimePix) (timestage.Stages,
 	if name == "" {
 		return stages, nil
 	}
-	f, err := os.Open(name)
+	f, err := openFile(name)
 	if err != nil {
 		return nil, err
 	}
@@ -320,7 +489,7 @@ func readStages(name, rotF string, landscape *model.TimePix) (timestage.Stages,
 }
 
 func readRotation(name string, pix *earth.Pixelation) (*model.StageRot, error) {
-	f, err := os.Open(name)
+	f, err := openFile(name)
 	if err != nil {
 		return nil, err
 	}
@@ -335,7 +504,7 @@ func readRotation(name string, pix *earth.Pixelation) (*model.StageRot, error) {
 }
 
 func readTreeFile(name string) (*timetree.Collection, error) {
-	f, err := os.Open(name)
+	f, err := openFile(name)
 	if err != nil {
 		return nil, err
 	}
@@ -348,8 +517,8 @@ func readTreeFile(name string) (*timetree.Collection, error) {
 	return c, nil
 }
 
-func getBranches(name string, tc *timetree.Collection, landscape *model.TimePix) (map[string]*recTree, error) {
-	f, err := os.Open(name)
+func getBranches(name string, stdin io.Reader, tc *timetree.Collection, landscape *model.TimePix) (map[string]*recTree, error) {
+	f, err := openInput(name, stdin)
 	if err != nil {
 		return nil, err
 	}
@@ -362,6 +531,16 @@ func getBranches(name string, tc *timetree.Collection, landscape *model.TimePix)
 	return rt, nil
 }
 
+// OpenInput opens an input file.
+// If the name is "-",
+// it will use the standard input.
+func openInput(name string, stdin io.Reader) (io.ReadCloser, error) {
+	if name == "-" {
+		return input.Open(name, stdin)
+	}
+	return openRecFile(name)
+}
+
 type recTree struct {
 	name   string
 	nodes  map[int]*recNode
@@ -380,6 +559,16 @@ type recBranch struct {
 	node  *recNode
 	dist  float64
 	endPt earth.Point
+
+	// sum of the squared distances
+	// of each time segment
+	sqDist float64
+
+	// weight of the particle
+	weight float64
+
+	// decomposed displacement
+	dir displacement
 }
 
 var headerFields = []string{
@@ -411,6 +600,8 @@ func readRecBranches(r io.Reader, tc *timetree.Collection, tp *model.TimePix) (m
 		}
 	}
 
+	_, hasWeight := fields["weight"]
+
 	rt := make(map[string]*recTree)
 	for {
 		row, err := tsv.Read()
@@ -463,16 +654,34 @@ func readRecBranches(r io.Reader, tc *timetree.Collection, tp *model.TimePix) (m
 			continue
 		}
 
+		f = "age"
+		age, err := strconv.ParseInt(row[fields[f]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if skipPostSplit(tv, id, age) {
+			continue
+		}
+
 		f = "particle"
 		pN, err := strconv.Atoi(row[fields[f]])
 		if err != nil {
 			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
 		}
+		w := 1.0
+		if hasWeight {
+			f = "weight"
+			w, err = strconv.ParseFloat(row[fields[f]], 64)
+			if err != nil {
+				return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+			}
+		}
 		p, ok := n.recs[pN]
 		if !ok {
 			p = &recBranch{
-				id:   pN,
-				node: n,
+				id:     pN,
+				node:   n,
+				weight: w,
 			}
 			n.recs[pN] = p
 		}
@@ -499,12 +708,9 @@ func readRecBranches(r io.Reader, tc *timetree.Collection, tp *model.TimePix) (m
 
 		dist := earth.Distance(from, to)
 		p.dist += dist
+		p.sqDist += dist * dist
+		p.dir.add(from, to)
 
-		f = "age"
-		age, err := strconv.ParseInt(row[fields[f]], 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
-		}
 		if age == tv.Age(id) {
 			p.endPt = to
 		}
@@ -522,12 +728,15 @@ func readRecBranches(r io.Reader, tc *timetree.Collection, tp *model.TimePix) (m
 		p, ok = root.recs[pN]
 		if !ok {
 			p = &recBranch{
-				id:   pN,
-				node: root,
+				id:     pN,
+				node:   root,
+				weight: w,
 			}
 			root.recs[pN] = p
 		}
 		p.dist += dist
+		p.sqDist += dist * dist
+		p.dir.add(from, to)
 	}
 
 	if len(rt) == 0 {
@@ -553,8 +762,9 @@ func nullRec(pix *earth.Pixelation, t *recTree, root int) *recTree {
 		if root == id {
 			for i := 0; i < nullFlag; i++ {
 				sn.recs[i] = &recBranch{
-					id:   i,
-					node: sn,
+					id:     i,
+					node:   sn,
+					weight: 1,
 				}
 			}
 			continue
@@ -582,9 +792,10 @@ func nullRec(pix *earth.Pixelation, t *recTree, root int) *recTree {
 				px = nx
 			}
 			sn.recs[i] = &recBranch{
-				id:   i,
-				node: sn,
-				dist: sum,
+				id:     i,
+				node:   sn,
+				dist:   sum,
+				weight: 1,
 			}
 		}
 	}
@@ -608,7 +819,11 @@ func writeRecBranch(w io.Writer, tc *timetree.Collection, rt, rSim map[string]*r
 	tab.Comma = '\t'
 	tab.UseCRLF = true
 
-	if err := tab.Write([]string{"tree", "node", "distance", "d-025", "d-975", "dist-rad", "dr-025", "dr-975", "brLen", "x-005", "x-095", "slower", "faster", "speed", "speed-rad"}); err != nil {
+	header := []string{"tree", "node", "distance", "d-025", "d-975", "dist-rad", "dr-025", "dr-975", "brLen", "x-005", "x-095", "slower", "faster", "speed", "speed-rad", "lambda"}
+	if useDir {
+		header = append(header, dirHeader...)
+	}
+	if err := tab.Write(header); err != nil {
 		return err
 	}
 	for _, name := range tc.Names() {
@@ -621,13 +836,7 @@ func writeRecBranch(w io.Writer, tc *timetree.Collection, rt, rSim map[string]*r
 
 		for _, nID := range t.Nodes() {
 			n := dt.nodes[nID]
-			dist := make([]float64, 0, len(n.recs))
-			weights := make([]float64, 0, len(n.recs))
-			for _, r := range n.recs {
-				dist = append(dist, r.dist)
-				weights = append(weights, 1.0)
-			}
-			slices.Sort(dist)
+			dist, weights := branchDist(n, 1)
 
 			brLen := float64(t.Len()) / timestage.MillionYears
 			pN := t.Parent(nID)
@@ -640,6 +849,19 @@ func writeRecBranch(w io.Writer, tc *timetree.Collection, rt, rSim map[string]*r
 			sR := dR / brLen
 			s := d / brLen
 
+			var sqDist, sumW float64
+			for _, r := range n.recs {
+				sqDist += r.weight * r.sqDist
+				sumW += r.weight
+			}
+			lambda := "NA"
+			if sqDist > 0 {
+				// method of moments:
+				// E[d^2] = 2 * t / lambda
+				l := 2 * brLen * sumW / sqDist
+				lambda = strconv.FormatFloat(l, 'f', 3, 64)
+			}
+
 			sn := st.nodes[nID]
 			nullDist := make([]float64, 0, len(sn.recs))
 			nullWeights := make([]float64, 0, len(sn.recs))
@@ -650,14 +872,14 @@ func writeRecBranch(w io.Writer, tc *timetree.Collection, rt, rSim map[string]*r
 			slices.Sort(nullDist)
 			n05 := stat.Quantile(0.05, stat.Empirical, nullDist, nullWeights)
 			n95 := stat.Quantile(0.95, stat.Empirical, nullDist, nullWeights)
-			var fast, slow int
-			for _, od := range dist {
+			var fast, slow float64
+			for i, od := range dist {
 				od *= earth.Radius / 1000
 				if od > n95 {
-					fast++
+					fast += weights[i]
 				}
 				if od < n05 {
-					slow++
+					slow += weights[i]
 				}
 			}
 
@@ -673,10 +895,20 @@ func writeRecBranch(w io.Writer, tc *timetree.Collection, rt, rSim map[string]*r
 				strconv.FormatFloat(brLen, 'f', 3, 64),
 				strconv.FormatFloat(n05, 'f', 3, 64),
 				strconv.FormatFloat(n95, 'f', 3, 64),
-				strconv.FormatFloat(float64(slow)/float64(len(dist)), 'f', 3, 64),
-				strconv.FormatFloat(float64(fast)/float64(len(dist)), 'f', 3, 64),
+				strconv.FormatFloat(slow/sumW, 'f', 3, 64),
+				strconv.FormatFloat(fast/sumW, 'f', 3, 64),
 				strconv.FormatFloat(s, 'f', 3, 64),
 				strconv.FormatFloat(sR, 'f', 3, 64),
+				lambda,
+			}
+			if useDir {
+				dirs := make([]displacement, 0, len(n.recs))
+				dw := make([]float64, 0, len(n.recs))
+				for _, r := range n.recs {
+					dirs = append(dirs, r.dir)
+					dw = append(dw, r.weight)
+				}
+				row = append(row, dirCols(dirs, dw)...)
 			}
 			if nID == 0 {
 				// root node is the whole tree
@@ -695,6 +927,35 @@ func writeRecBranch(w io.Writer, tc *timetree.Collection, rt, rSim map[string]*r
 	return nil
 }
 
+// BranchDist returns the distances
+// of the particles of a node,
+// multiplied by a scale,
+// and sorted from the shortest to the longest,
+// as well as the weights of each particle.
+func branchDist(n *recNode, scale float64) (dist, weights []float64) {
+	recs := make([]*recBranch, 0, len(n.recs))
+	for _, r := range n.recs {
+		recs = append(recs, r)
+	}
+	slices.SortFunc(recs, func(a, b *recBranch) int {
+		if a.dist < b.dist {
+			return -1
+		}
+		if a.dist > b.dist {
+			return 1
+		}
+		return 0
+	})
+
+	dist = make([]float64, 0, len(recs))
+	weights = make([]float64, 0, len(recs))
+	for _, r := range recs {
+		dist = append(dist, r.dist*scale)
+		weights = append(weights, r.weight)
+	}
+	return dist, weights
+}
+
 func plotTrees(tc *timetree.Collection, rt map[string]*recTree, gradient probmap.Gradienter) error {
 	tv, err := parseTick()
 	if err != nil {
@@ -716,13 +977,7 @@ func plotTrees(tc *timetree.Collection, rt map[string]*recTree, gradient probmap
 		max := math.SmallestNonzeroFloat64
 		for _, nID := range t.Nodes() {
 			n := rec.nodes[nID]
-			dist := make([]float64, 0, len(n.recs))
-			weights := make([]float64, 0, len(n.recs))
-			for _, r := range n.recs {
-				dist = append(dist, r.dist*earth.Radius/1000)
-				weights = append(weights, 1.0)
-			}
-			slices.Sort(dist)
+			dist, weights := branchDist(n, earth.Radius/1000)
 
 			// root node
 			pN := t.Parent(nID)
@@ -9,7 +9,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
 	"slices"
 	"strconv"
 	"strings"
@@ -21,8 +20,8 @@ import (
 	"gonum.org/v1/gonum/stat"
 )
 
-func getTimeSlice(name string, tc *timetree.Collection, tp *model.TimePix, stages timestage.Stages) (map[string]*treeSlice, error) {
-	f, err := os.Open(name)
+func getTimeSlice(name string, stdin io.Reader, tc *timetree.Collection, tp *model.TimePix, stages timestage.Stages) (map[string]*treeSlice, error) {
+	f, err := openInput(name, stdin)
 	if err != nil {
 		return nil, err
 	}
@@ -44,6 +43,62 @@ type recSlice struct {
 	age       int64
 	sumBrLen  float64
 	distances map[int]float64
+
+	// weights of the particles
+	weights map[int]float64
+
+	// decomposed displacements of the particles
+	dirs map[int]displacement
+}
+
+// SliceDist returns the distances
+// of the particles in a time slice,
+// multiplied by a scale,
+// and sorted from the shortest to the longest,
+// as well as the weights of each particle.
+func (s *recSlice) sliceDist(scale float64) (dist, weights []float64) {
+	ids := make([]int, 0, len(s.distances))
+	for id := range s.distances {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, func(a, b int) int {
+		if s.distances[a] < s.distances[b] {
+			return -1
+		}
+		if s.distances[a] > s.distances[b] {
+			return 1
+		}
+		return 0
+	})
+
+	dist = make([]float64, 0, len(ids))
+	weights = make([]float64, 0, len(ids))
+	for _, id := range ids {
+		w, ok := s.weights[id]
+		if !ok {
+			w = 1
+		}
+		dist = append(dist, s.distances[id]*scale)
+		weights = append(weights, w)
+	}
+	return dist, weights
+}
+
+// SliceDirs returns the decomposed displacements
+// of the particles in a time slice,
+// as well as the weights of each particle.
+func (s *recSlice) sliceDirs() (dirs []displacement, weights []float64) {
+	dirs = make([]displacement, 0, len(s.dirs))
+	weights = make([]float64, 0, len(s.dirs))
+	for id, d := range s.dirs {
+		w, ok := s.weights[id]
+		if !ok {
+			w = 1
+		}
+		dirs = append(dirs, d)
+		weights = append(weights, w)
+	}
+	return dirs, weights
 }
 
 func readTimeSlices(r io.Reader, tc *timetree.Collection, tp *model.TimePix, stages timestage.Stages) (map[string]*treeSlice, error) {
@@ -66,6 +121,8 @@ func readTimeSlices(r io.Reader, tc *timetree.Collection, tp *model.TimePix, sta
 		}
 	}
 
+	_, hasWeight := fields["weight"]
+
 	ts := make(map[string]*treeSlice)
 	for {
 		row, err := tsv.Read()
@@ -119,6 +176,9 @@ func readTimeSlices(r io.Reader, tc *timetree.Collection, tp *model.TimePix, sta
 		if err != nil {
 			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
 		}
+		if skipPostSplit(tv, id, age) {
+			continue
+		}
 		age = stages.ClosestStageAge(age)
 		rs := t.timeSlices[age]
 
@@ -144,6 +204,18 @@ func readTimeSlices(r io.Reader, tc *timetree.Collection, tp *model.TimePix, sta
 
 		dist := earth.Distance(from, to)
 		rs.distances[pN] += dist
+		d := rs.dirs[pN]
+		d.add(from, to)
+		rs.dirs[pN] = d
+
+		if hasWeight {
+			f = "weight"
+			w, err := strconv.ParseFloat(row[fields[f]], 64)
+			if err != nil {
+				return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+			}
+			rs.weights[pN] = w
+		}
 	}
 	if len(ts) == 0 {
 		return nil, fmt.Errorf("while reading data: %v", io.EOF)
@@ -171,6 +243,8 @@ func (s *treeSlice) addSlices(t *timetree.Tree, stages timestage.Stages, n int)
 			ts = &recSlice{
 				age:       a,
 				distances: make(map[int]float64),
+				weights:   make(map[int]float64),
+				dirs:      make(map[int]displacement),
 			}
 			s.timeSlices[a] = ts
 		}
@@ -185,6 +259,8 @@ func (s *treeSlice) addSlices(t *timetree.Tree, stages timestage.Stages, n int)
 		ts = &recSlice{
 			age:       age,
 			distances: make(map[int]float64),
+			weights:   make(map[int]float64),
+			dirs:      make(map[int]displacement),
 		}
 		s.timeSlices[age] = ts
 	}
@@ -196,7 +272,11 @@ func writeTimeSlice(w io.Writer, ts map[string]*treeSlice) error {
 	tab.Comma = '\t'
 	tab.UseCRLF = true
 
-	if err := tab.Write([]string{"tree", "age", "distance", "d-025", "d-975", "brLen", "speed"}); err != nil {
+	header := []string{"tree", "age", "distance", "d-025", "d-975", "brLen", "speed"}
+	if useDir {
+		header = append(header, dirHeader...)
+	}
+	if err := tab.Write(header); err != nil {
 		return err
 	}
 
@@ -217,13 +297,7 @@ func writeTimeSlice(w io.Writer, ts map[string]*treeSlice) error {
 		for _, a := range ages {
 			s := t.timeSlices[a]
 
-			dist := make([]float64, 0, len(s.distances))
-			weights := make([]float64, 0, len(s.distances))
-			for _, d := range s.distances {
-				dist = append(dist, d*earth.Radius/1000)
-				weights = append(weights, 1.0)
-			}
-			slices.Sort(dist)
+			dist, weights := s.sliceDist(earth.Radius / 1000)
 
 			d := stat.Quantile(0.5, stat.Empirical, dist, weights)
 			sp := d / s.sumBrLen
@@ -237,6 +311,10 @@ func writeTimeSlice(w io.Writer, ts map[string]*treeSlice) error {
 				strconv.FormatFloat(s.sumBrLen, 'f', 3, 64),
 				strconv.FormatFloat(sp, 'f', 3, 64),
 			}
+			if useDir {
+				dirs, dw := s.sliceDirs()
+				row = append(row, dirCols(dirs, dw)...)
+			}
 			if err := tab.Write(row); err != nil {
 				return err
 			}
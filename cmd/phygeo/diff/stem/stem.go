@@ -0,0 +1,569 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package stem implements a command to evaluate
+// the sensitivity of a reconstruction
+// to the length of the stem branch.
+package stem
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/agerange"
+	"github.com/js-arias/phygeo/constraint"
+	"github.com/js-arias/phygeo/infer/diffusion"
+	"github.com/js-arias/phygeo/pixstat"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/ranges"
+	"github.com/js-arias/timetree"
+)
+
+var Command = &command.Command{
+	Usage: `stem [--grid <fraction-list>] [--lambda <value>] [--fixed]
+	[--step <value>] [--stop <value>] [-p|--particles <number>]
+	[--cpu <number>] <project-file>`,
+	Short: "evaluate the sensitivity to the stem length",
+	Long: `
+Command stem reads a PhyGeo project, and repeats the reconstruction of each
+tree using different lengths of the stem branch, to evaluate how the lambda
+estimate and the location of the root change with the stem length. As the
+default stem length (10% of the root age) is arbitrary, this command
+quantifies the sensitivity of the results to that choice.
+
+The argument of the command is the name of the project file.
+
+The flag --grid defines the stem lengths to be evaluated, as fractions of the
+root age separated by commas. By default, the grid is
+"0.01,0.05,0.1,0.2,0.3,0.4,0.5" (i.e., from 1% to 50% of the root age). All
+values must be greater than 0.
+
+For each stem length, the maximum likelihood estimate of lambda is searched
+with the same hill climbing search used by the command 'diff ml'. The flag
+--lambda defines the starting lambda value (by default, 100). By default, the
+initial step has a value of 100, use the flag --step to change the value. At
+each cycle the step value is reduced a 50%, and stop when step has a size of
+1. Use flag --stop to set a different stop value. If the flag --fixed is
+given, the lambda value defined with --lambda will be used for all the stem
+lengths, without a search.
+
+Then, a stochastic mapping is performed to estimate the posterior
+distribution of the location of the root (at the age of the root node). By
+default, 1000 particles will be used; use the flag --particles, or -p, to
+define a different number.
+
+The output is printed in the standard output as a tab-delimited table with the
+following columns:
+
+	-tree      the name of the tree
+	-stem      the stem length as a fraction of the root age
+	-age       the age of the start of the stem, in years
+	-lambda    the lambda value
+	-logLike   the log-likelihood of the reconstruction
+	-weight    the relative likelihood of the stem length, i.e., the
+	           likelihood normalized over all the stem lengths of the
+	           tree
+	-lat       the latitude of the centroid of the root posterior
+	-lon       the longitude of the centroid of the root posterior
+	-shift     the distance, in km, between the centroid and the
+	           centroid of the reference stem length
+
+The reference stem length is the value of the grid closest to the default
+stem length (10% of the root age). After the rows of each tree, a comment line
+reports the lambda value and the root centroid shift, averaged over all the
+stem lengths using the weights.
+
+By default, all available CPUs will be used in the processing. Set --cpu flag
+to use a different number of CPUs.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var fixedFlag bool
+var lambdaFlag float64
+var stepFlag float64
+var stopFlag float64
+var particles int
+var numCPU int
+var gridFlag string
+
+func setFlags(c *command.Command) {
+	c.Flags().BoolVar(&fixedFlag, "fixed", false, "")
+	c.Flags().Float64Var(&lambdaFlag, "lambda", 100, "")
+	c.Flags().Float64Var(&stopFlag, "stop", 1, "")
+	c.Flags().Float64Var(&stepFlag, "step", 100, "")
+	c.Flags().IntVar(&particles, "particles", 1000, "")
+	c.Flags().IntVar(&particles, "p", 1000, "")
+	c.Flags().IntVar(&numCPU, "cpu", runtime.NumCPU(), "")
+	c.Flags().StringVar(&gridFlag, "grid", "0.01,0.05,0.1,0.2,0.3,0.4,0.5", "")
+}
+
+// DefaultStem is the default stem length
+// as a fraction of the root age.
+const defaultStem = 0.1
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if lambdaFlag <= 0 {
+		return c.UsageError("flag --lambda: value must be greater than 0")
+	}
+	if particles < 1 {
+		return c.UsageError("flag --particles: value must be greater than 0")
+	}
+	grid, err := parseGrid(gridFlag)
+	if err != nil {
+		return c.UsageError(fmt.Sprintf("flag --grid: %v", err))
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	tf := p.Path(project.Trees)
+	if tf == "" {
+		msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	tc, err := readTreeFile(tf)
+	if err != nil {
+		return err
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("paleolandscape not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	landscape, err := readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	rotF := p.Path(project.GeoMotion)
+	if rotF == "" {
+		msg := fmt.Sprintf("plate motion model not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	rot, err := readRotation(rotF, landscape.Pixelation())
+	if err != nil {
+		return err
+	}
+
+	stF := p.Path(project.Stages)
+	stages, err := readStages(stF, rot, landscape)
+	if err != nil {
+		return err
+	}
+
+	pwF := p.Path(project.PixWeight)
+	if pwF == "" {
+		msg := fmt.Sprintf("pixel weights not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	pw, err := readPixWeights(pwF)
+	if err != nil {
+		return err
+	}
+
+	rf := p.Path(project.Ranges)
+	rc, err := readRanges(rf)
+	if err != nil {
+		return err
+	}
+	var ar *agerange.Collection
+	if af := p.Path(project.AgeRanges); af != "" {
+		ar, err = readAgeRanges(af, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+	var cn *constraint.Collection
+	if cf := p.Path(project.Constraints); cf != "" {
+		cn, err = readConstraints(cf, landscape.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+
+	// check if all terminals have defined ranges
+	for _, tn := range tc.Names() {
+		t := tc.Tree(tn)
+		for _, term := range t.Terms() {
+			if !rc.HasTaxon(term) {
+				return fmt.Errorf("taxon %q of tree %q has no defined range", term, tn)
+			}
+		}
+	}
+
+	// Set the number of parallel processors
+	diffusion.SetCPU(numCPU)
+
+	dm, _ := earth.NewDistMatRingScale(landscape.Pixelation())
+
+	param := diffusion.Param{
+		Landscape:   landscape,
+		Rot:         rot,
+		DM:          dm,
+		PW:          pw,
+		Ranges:      rc,
+		AgeRanges:   ar,
+		Constraints: cn,
+		Lambda:      lambdaFlag,
+		Stages:      stages.Stages(),
+		Cache:       diffusion.NewPDFCache(landscape.Pixelation()),
+	}
+
+	fmt.Fprintf(c.Stdout(), "tree\tstem\tage\tlambda\tlogLike\tweight\tlat\tlon\tshift\n")
+	for _, tn := range tc.Names() {
+		t := tc.Tree(tn)
+		rootAge := t.Age(t.Root())
+		res := make([]stemRec, 0, len(grid))
+		for _, g := range grid {
+			param.Stem = int64(g * float64(rootAge))
+			if param.Stem < 1 {
+				return fmt.Errorf("tree %q: stem %.6f: stem length too small", tn, g)
+			}
+			r := evalStem(t, param)
+			r.frac = g
+			r.age = rootAge + param.Stem
+			res = append(res, r)
+		}
+		writeStems(c.Stdout(), tn, res)
+	}
+
+	return nil
+}
+
+func parseGrid(s string) ([]float64, error) {
+	var grid []float64
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		g, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, err
+		}
+		if g <= 0 {
+			return nil, fmt.Errorf("invalid value %.6f: must be greater than 0", g)
+		}
+		grid = append(grid, g)
+	}
+	if len(grid) == 0 {
+		return nil, fmt.Errorf("empty grid")
+	}
+	slices.Sort(grid)
+	return slices.Compact(grid), nil
+}
+
+// A stemRec is the result of a reconstruction
+// with a given stem length.
+type stemRec struct {
+	frac    float64
+	age     int64
+	lambda  float64
+	logLike float64
+
+	// centroid of the root posterior
+	centroid earth.Point
+	ok       bool
+}
+
+// EvalStem searches the best lambda value
+// for a stem length,
+// and returns the centroid
+// of the posterior of the root.
+func evalStem(t *timetree.Tree, p diffusion.Param) stemRec {
+	eval := func(l float64) float64 {
+		p.Lambda = l
+		df := diffusion.New(t, p)
+		return df.DownPass()
+	}
+
+	b := bestRec{
+		lambda:  lambdaFlag,
+		logLike: eval(lambdaFlag),
+	}
+	if !fixedFlag {
+		b.first(eval, stepFlag)
+		for step := stepFlag / 2; ; step = step / 2 {
+			b.search(eval, step)
+			if step < stopFlag {
+				break
+			}
+		}
+	}
+
+	p.Lambda = b.lambda
+	df := diffusion.New(t, p)
+	df.DownPass()
+	df.Simulate(particles)
+
+	root := t.Root()
+	age := t.Age(root)
+	post := make(map[int]float64)
+	for i := 0; i < particles; i++ {
+		px := df.SrcDest(root, i, age).To
+		if px < 0 {
+			continue
+		}
+		post[px]++
+	}
+	ct, ok := pixstat.Centroid(p.Landscape.Pixelation(), post)
+
+	return stemRec{
+		lambda:   b.lambda,
+		logLike:  b.logLike,
+		centroid: ct,
+		ok:       ok,
+	}
+}
+
+func writeStems(w io.Writer, tn string, res []stemRec) {
+	// relative likelihood
+	max := math.Inf(-1)
+	for _, r := range res {
+		max = math.Max(max, r.logLike)
+	}
+	weights := make([]float64, len(res))
+	var sum float64
+	for i, r := range res {
+		weights[i] = math.Exp(r.logLike - max)
+		sum += weights[i]
+	}
+
+	// reference stem
+	ref := 0
+	for i, r := range res {
+		if math.Abs(r.frac-defaultStem) < math.Abs(res[ref].frac-defaultStem) {
+			ref = i
+		}
+	}
+
+	var avgLambda, avgShift, shiftW float64
+	for i, r := range res {
+		wt := weights[i] / sum
+		avgLambda += wt * r.lambda
+
+		lat, lon, shift := "NA", "NA", "NA"
+		if r.ok {
+			lat = strconv.FormatFloat(r.centroid.Latitude(), 'f', 6, 64)
+			lon = strconv.FormatFloat(r.centroid.Longitude(), 'f', 6, 64)
+			if res[ref].ok {
+				d := earth.Distance(r.centroid, res[ref].centroid) * earth.Radius / 1000
+				shift = strconv.FormatFloat(d, 'f', 3, 64)
+				avgShift += wt * d
+				shiftW += wt
+			}
+		}
+		fmt.Fprintf(w, "%s\t%.6f\t%d\t%.6f\t%.6f\t%.6f\t%s\t%s\t%s\n", tn, r.frac, r.age, r.lambda, r.logLike, wt, lat, lon, shift)
+	}
+
+	shift := "NA"
+	if shiftW > 0 {
+		shift = strconv.FormatFloat(avgShift/shiftW, 'f', 3, 64)
+	}
+	fmt.Fprintf(w, "# %s\tweighted lambda: %.6f\tweighted shift: %s\treference stem: %.6f\n", tn, avgLambda, shift, res[ref].frac)
+}
+
+// BestRec stores the best reconstruction
+type bestRec struct {
+	lambda  float64
+	logLike float64
+}
+
+func (b *bestRec) first(eval func(float64) float64, step float64) {
+	// go up
+	upOK := false
+	for l := b.lambda + step; ; l += step {
+		like := eval(l)
+		if like < b.logLike {
+			break
+		}
+		b.lambda = l
+		b.logLike = like
+		upOK = true
+	}
+	// we found an improvement
+	if upOK {
+		return
+	}
+
+	// go down
+	for l := b.lambda - step; l > 0; l -= step {
+		like := eval(l)
+		if like < b.logLike {
+			return
+		}
+		b.lambda = l
+		b.logLike = like
+	}
+}
+
+// Search go one step up and one step down
+// to see if the likelihood improves.
+func (b *bestRec) search(eval func(float64) float64, step float64) {
+	// go up
+	l := b.lambda + step
+	like := eval(l)
+	if like > b.logLike {
+		b.lambda = l
+		b.logLike = like
+		return
+	}
+
+	// go down
+	if b.lambda <= step {
+		return
+	}
+	l = b.lambda - step
+	like = eval(l)
+	if like > b.logLike {
+		b.lambda = l
+		b.logLike = like
+	}
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readRotation(name string, pix *earth.Pixelation) (*model.StageRot, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rot, err := model.ReadStageRot(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return rot, nil
+}
+
+func readStages(name string, rot *model.StageRot, landscape *model.TimePix) (timestage.Stages, error) {
+	stages := timestage.New()
+	stages.Add(rot)
+	stages.Add(landscape)
+
+	if name == "" {
+		return stages, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := timestage.Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+	stages.Add(st)
+
+	return stages, nil
+}
+
+func readPixWeights(name string) (pixweight.Pixel, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pw, err := pixweight.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return pw, nil
+}
+
+func readRanges(name string) (*ranges.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := ranges.ReadTSV(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func readAgeRanges(name string, pix *earth.Pixelation) (*agerange.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := agerange.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func readConstraints(name string, pix *earth.Pixelation) (*constraint.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := constraint.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
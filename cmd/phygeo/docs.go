@@ -0,0 +1,405 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/js-arias/command"
+)
+
+var docsCommand = &command.Command{
+	Usage: `docs [--format <format>] [-o|--output <path>]`,
+	Short: "generate the documentation of all commands",
+	Long: `
+Command docs renders the help of all commands and help topics of PhyGeo as a
+single document. The documentation is generated from the same text printed by
+the help command, so it is always in sync with the program.
+
+By default, the documentation will be a single markdown document, with a
+section for each command, and with links between the commands. Use the flag
+--format to define a different format. Valid formats are:
+
+	- markdown  a single markdown document (default)
+	- man       a man page for each command and help topic
+
+By default, the markdown document will be written in the standard output. Use
+the flag --output, or -o, to define an output file. With the man format, the
+flag --output defines the directory in which the man pages will be written (by
+default, the current directory). Each man page will be named after the full
+name of the command, for example 'phygeo-diff-map.1'.
+	`,
+	SetFlags: docsFlags,
+	Run:      runDocs,
+}
+
+var docsFormat string
+var docsOutput string
+
+func docsFlags(c *command.Command) {
+	c.Flags().StringVar(&docsFormat, "format", "markdown", "")
+	c.Flags().StringVar(&docsOutput, "output", "", "")
+	c.Flags().StringVar(&docsOutput, "o", "", "")
+}
+
+func runDocs(c *command.Command, args []string) (err error) {
+	out := c.Stdout()
+	prev := app.Stdout()
+	defer app.SetStdout(prev)
+
+	root, err := readDoc(nil)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(docsFormat) {
+	case "markdown", "md":
+		if docsOutput == "" || docsOutput == "-" {
+			return writeMarkdown(out, root)
+		}
+		f, err := os.Create(docsOutput)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			e := f.Close()
+			if e != nil && err == nil {
+				err = e
+			}
+		}()
+		if err := writeMarkdown(f, root); err != nil {
+			return fmt.Errorf("while writing data on %q: %v", docsOutput, err)
+		}
+		return nil
+	case "man":
+		dir := docsOutput
+		if dir == "" {
+			dir = "."
+		}
+		return writeManPages(dir, root)
+	}
+	return c.UsageError(fmt.Sprintf("flag --format: unknown format %q", docsFormat))
+}
+
+// A doc is the documentation of a command
+// or a help topic.
+type doc struct {
+	path   []string
+	title  string
+	usage  string
+	long   string
+	cmds   []*doc
+	topics []*doc
+	parent *doc
+
+	// short is the short description,
+	// as listed by the parent
+	short string
+}
+
+// Name returns the full name of the command.
+func (d *doc) name() string {
+	return strings.Join(append([]string{strings.Fields(app.Usage)[0]}, d.path...), " ")
+}
+
+// ReadDoc reads the documentation of a command
+// and all of its children,
+// by parsing the output of the help command.
+func readDoc(path []string) (*doc, error) {
+	var buf bytes.Buffer
+	app.SetStdout(&buf)
+	if err := app.Execute(append([]string{"help"}, path...)); err != nil {
+		return nil, err
+	}
+
+	d := parseHelp(path, buf.String())
+	if len(path) == 0 {
+		// the docs command is not documented
+		d.cmds = slices.DeleteFunc(d.cmds, func(c *doc) bool {
+			return c.path[0] == "docs"
+		})
+	}
+	for _, list := range [][]*doc{d.cmds, d.topics} {
+		for i, c := range list {
+			nd, err := readDoc(c.path)
+			if err != nil {
+				return nil, err
+			}
+			nd.short = c.short
+			nd.parent = d
+			list[i] = nd
+		}
+	}
+	return d, nil
+}
+
+// ParseHelp parses a help message.
+func parseHelp(path []string, help string) *doc {
+	d := &doc{path: path}
+
+	const (
+		inTitle = iota
+		inUsage
+		inLong
+		inCmds
+		inTopics
+	)
+
+	var long []string
+	state := inTitle
+	s := bufio.NewScanner(strings.NewReader(help))
+	for s.Scan() {
+		ln := s.Text()
+		switch state {
+		case inTitle:
+			if ln == "" {
+				continue
+			}
+			if ln == "Usage:" {
+				state = inUsage
+				continue
+			}
+			if d.title == "" {
+				d.title = ln
+				continue
+			}
+			state = inLong
+			long = append(long, ln)
+		case inUsage:
+			if ln == "" {
+				if d.usage != "" {
+					state = inLong
+				}
+				continue
+			}
+			ln = strings.TrimPrefix(ln, "    ")
+			if d.usage != "" {
+				d.usage += "\n"
+			}
+			d.usage += ln
+		case inLong:
+			if ln == "The commands are:" {
+				state = inCmds
+				continue
+			}
+			if ln == "Additional help topics:" {
+				state = inTopics
+				continue
+			}
+			long = append(long, ln)
+		case inCmds, inTopics:
+			if ln == "Additional help topics:" {
+				state = inTopics
+				continue
+			}
+			if !strings.HasPrefix(ln, "    ") {
+				continue
+			}
+			f := strings.Fields(ln)
+			if len(f) == 0 {
+				continue
+			}
+			c := &doc{
+				path:  append(append([]string{}, path...), f[0]),
+				short: strings.Join(f[1:], " "),
+			}
+			if state == inCmds {
+				d.cmds = append(d.cmds, c)
+			} else {
+				d.topics = append(d.topics, c)
+			}
+		}
+	}
+	d.long = strings.TrimSpace(strings.Join(long, "\n"))
+	return d
+}
+
+// Anchor returns the markdown anchor
+// of a command.
+func (d *doc) anchor() string {
+	return strings.ReplaceAll(d.name(), " ", "-")
+}
+
+func writeMarkdown(w io.Writer, root *doc) error {
+	bw := bufio.NewWriter(w)
+	mdDoc(bw, root, 1)
+	return bw.Flush()
+}
+
+func mdDoc(w io.Writer, d *doc, level int) {
+	if level > 6 {
+		level = 6
+	}
+	fmt.Fprintf(w, "%s %s\n\n", strings.Repeat("#", level), d.name())
+	fmt.Fprintf(w, "%s\n\n", d.title)
+	if d.usage != "" {
+		fmt.Fprintf(w, "Usage:\n\n")
+		for _, ln := range strings.Split(d.usage, "\n") {
+			fmt.Fprintf(w, "    %s\n", strings.TrimLeft(ln, "\t"))
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	if d.long != "" {
+		fmt.Fprintf(w, "%s\n\n", d.long)
+	}
+	if len(d.cmds) > 0 {
+		fmt.Fprintf(w, "The commands are:\n\n")
+		for _, c := range d.cmds {
+			fmt.Fprintf(w, "- [%s](#%s): %s\n", c.path[len(c.path)-1], c.anchor(), c.short)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	if len(d.topics) > 0 {
+		fmt.Fprintf(w, "Additional help topics:\n\n")
+		for _, c := range d.topics {
+			fmt.Fprintf(w, "- [%s](#%s): %s\n", c.path[len(c.path)-1], c.anchor(), c.short)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+
+	for _, c := range d.cmds {
+		mdDoc(w, c, level+1)
+	}
+	for _, c := range d.topics {
+		mdDoc(w, c, level+1)
+	}
+}
+
+// ManName returns the name of the man page
+// of a command.
+func (d *doc) manName() string {
+	return strings.ReplaceAll(d.name(), " ", "-")
+}
+
+func writeManPages(dir string, d *doc) error {
+	name := filepath.Join(dir, d.manName()+".1")
+	if err := writeManPage(name, d); err != nil {
+		return err
+	}
+	for _, c := range d.cmds {
+		if err := writeManPages(dir, c); err != nil {
+			return err
+		}
+	}
+	for _, c := range d.topics {
+		if err := writeManPages(dir, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeManPage(name string, d *doc) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, ".TH %s 1\n", strings.ToUpper(d.manName()))
+	short := d.short
+	if short == "" {
+		short = d.title
+	}
+	fmt.Fprintf(w, ".SH NAME\n%s \\- %s\n", d.manName(), manEscape(short))
+	if d.usage != "" {
+		fmt.Fprintf(w, ".SH SYNOPSIS\n.nf\n")
+		for _, ln := range strings.Split(d.usage, "\n") {
+			fmt.Fprintf(w, "%s\n", manEscape(ln))
+		}
+		fmt.Fprintf(w, ".fi\n")
+	}
+	if d.long != "" {
+		fmt.Fprintf(w, ".SH DESCRIPTION\n")
+		manText(w, d.long)
+	}
+	if len(d.cmds) > 0 {
+		fmt.Fprintf(w, ".SH COMMANDS\n")
+		for _, c := range d.cmds {
+			fmt.Fprintf(w, ".TP\n.B %s\n%s\n", c.path[len(c.path)-1], manEscape(c.short))
+		}
+	}
+	if len(d.topics) > 0 {
+		fmt.Fprintf(w, ".SH HELP TOPICS\n")
+		for _, c := range d.topics {
+			fmt.Fprintf(w, ".TP\n.B %s\n%s\n", c.path[len(c.path)-1], manEscape(c.short))
+		}
+	}
+
+	var see []string
+	if d.parent != nil {
+		see = append(see, fmt.Sprintf("\\fB%s\\fR(1)", d.parent.manName()))
+	}
+	for _, c := range d.cmds {
+		see = append(see, fmt.Sprintf("\\fB%s\\fR(1)", c.manName()))
+	}
+	for _, c := range d.topics {
+		see = append(see, fmt.Sprintf("\\fB%s\\fR(1)", c.manName()))
+	}
+	if len(see) > 0 {
+		fmt.Fprintf(w, ".SH SEE ALSO\n%s\n", strings.Join(see, ",\n"))
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	return nil
+}
+
+// ManText writes a text as man paragraphs.
+// Lines indented with a tab
+// are written as no-filled blocks.
+func manText(w io.Writer, text string) {
+	inBlock := false
+	para := false
+	for _, ln := range strings.Split(text, "\n") {
+		if strings.HasPrefix(ln, "\t") {
+			if !inBlock {
+				fmt.Fprintf(w, ".PP\n.RS\n.nf\n")
+				inBlock = true
+			}
+			fmt.Fprintf(w, "%s\n", manEscape(strings.TrimPrefix(ln, "\t")))
+			continue
+		}
+		if inBlock {
+			fmt.Fprintf(w, ".fi\n.RE\n")
+			inBlock = false
+			para = false
+		}
+		if strings.TrimSpace(ln) == "" {
+			para = false
+			continue
+		}
+		if !para {
+			fmt.Fprintf(w, ".PP\n")
+			para = true
+		}
+		fmt.Fprintf(w, "%s\n", manEscape(strings.TrimSpace(ln)))
+	}
+	if inBlock {
+		fmt.Fprintf(w, ".fi\n.RE\n")
+	}
+}
+
+func manEscape(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\e")
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = "\\&" + s
+	}
+	return s
+}
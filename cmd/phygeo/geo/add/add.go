@@ -7,11 +7,11 @@
 package add
 
 import (
-	"errors"
 	"fmt"
 	"os"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/js-arias/command"
 	"github.com/js-arias/earth/model"
@@ -19,7 +19,8 @@ import (
 )
 
 var Command = &command.Command{
-	Usage: "add --type <file-type> <project-file> <model-file>",
+	Usage: `add [--wait <seconds>] --type <file-type>
+	<project-file> <model-file>`,
 	Short: "add a paleogeographic reconstruction model",
 	Long: `
 Command add adds the path of a paleogeographic reconstruction model to a
@@ -40,15 +41,21 @@ with one of the following values:
 
 	geomotion	for a plate motion model
 	landscape	for a landscape model
+
+While the model is added, the project is locked. If the project is locked by
+another process, the command fails. Use the flag --wait to set the maximum
+time, in seconds, to wait until the lock is released.
 	`,
 	SetFlags: setFlags,
 	Run:      run,
 }
 
 var typeFlag string
+var waitFlag float64
 
 func setFlags(c *command.Command) {
 	c.Flags().StringVar(&typeFlag, "type", "", "")
+	c.Flags().Float64Var(&waitFlag, "wait", 0, "")
 }
 
 func run(c *command.Command, args []string) error {
@@ -63,42 +70,24 @@ func run(c *command.Command, args []string) error {
 	}
 
 	pFile := args[0]
-	p, err := openProject(pFile)
-	if err != nil {
-		return err
-	}
-
-	typeFlag = strings.ToLower(typeFlag)
-	switch d := project.Dataset(typeFlag); d {
-	case project.GeoMotion:
-		if err := addGeoMotion(p, args[1]); err != nil {
-			return err
+	wait := time.Duration(waitFlag * float64(time.Second))
+	return project.UpdateNew(pFile, wait, func(p *project.Project) error {
+		typeFlag = strings.ToLower(typeFlag)
+		switch d := project.Dataset(typeFlag); d {
+		case project.GeoMotion:
+			if err := addGeoMotion(p, args[1]); err != nil {
+				return err
+			}
+		case project.Landscape:
+			if err := addLandscape(p, args[1]); err != nil {
+				return err
+			}
+		default:
+			msg := fmt.Sprintf("flag --type: unknown value %q", typeFlag)
+			return c.UsageError(msg)
 		}
-	case project.Landscape:
-		if err := addLandscape(p, args[1]); err != nil {
-			return err
-		}
-	default:
-		msg := fmt.Sprintf("flag --type: unknown value %q", typeFlag)
-		return c.UsageError(msg)
-	}
-
-	if err := p.Write(pFile); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func openProject(name string) (*project.Project, error) {
-	p, err := project.Read(name)
-	if errors.Is(err, os.ErrNotExist) {
-		return project.New(), nil
-	}
-	if err != nil {
-		return nil, fmt.Errorf("unable ot open project %q: %v", name, err)
-	}
-	return p, nil
+		return nil
+	})
 }
 
 func addGeoMotion(p *project.Project, path string) error {
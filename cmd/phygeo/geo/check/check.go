@@ -0,0 +1,416 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package check implements a command to validate
+// the plate motion model of a project
+// against the landscape model.
+package check
+
+import (
+	"encoding/csv"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/timestage"
+)
+
+var Command = &command.Command{
+	Usage: `check [--speed <value>]
+	[--map <file-prefix>] [-c|--columns <value>]
+	<project-file>`,
+	Short: "validate the plate motion model",
+	Long: `
+Command check reads the plate motion model and the landscape model of a
+PhyGeo project, and checks that the models are consistent. Inconsistencies
+between the models are usually found as cryptic errors when running an
+analysis.
+
+The argument of the command is the name of the project file.
+
+For each pair of neighbor time stages of the plate motion model, the command
+checks that:
+
+	- every landscape pixel at the youngest stage has a source pixel at the
+	  oldest stage (otherwise, the pixel "disappears" when going back in
+	  time);
+	- every landscape pixel at the oldest stage has a destination pixel at
+	  the youngest stage (otherwise, the pixel "disappears" when going
+	  forward in time);
+	- the distance between a pixel and its destination pixels is not larger
+	  than the distance expected given a maximum plate speed.
+
+If the project has pixel weights, only the pixels with a non-zero weight are
+checked. Otherwise, all pixels with a non-zero landscape value are checked. By
+default, the maximum plate speed is 200 km per million years (i.e., 20 cm per
+year); use the flag --speed to define a different value. To account for the
+pixelation, the size of a pixel is added to the expected distance.
+
+The time stages of the landscape model that are not found in the plate motion
+model are reported as warnings in the standard error.
+
+The inconsistencies are printed in the standard output, as a tab-delimited
+table with the following columns:
+
+	age      the age of the time stage of the pixel, in years
+	pixel    the ID of the pixel
+	value    the landscape value of the pixel
+	problem  the kind of inconsistency: "no-source" for a pixel without a
+	         source at the oldest stage, "no-dest" for a pixel without a
+	         destination at the youngest stage, or "jump" for a pixel that
+	         moves farther than expected
+	dest     the ID of the destination pixel of a jump, or -1
+	dist     the distance of a jump, in km
+
+If the flag --map is defined with a file prefix, a map with the inconsistent
+pixels will be drawn for each time stage with inconsistencies, using a plate
+carrée projection. Pixels without source or destination are drawn in red,
+pixels with jumps in blue, and the rest of the checked pixels in gray. The
+name of the file will be in the form '<prefix>-<age>.png' with the age in
+million years. By default the image will be 3600 pixels wide; use the flag
+--columns, or -c, to define a different number of image columns.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var speedFlag float64
+var mapPrefix string
+var colsFlag int
+
+func setFlags(c *command.Command) {
+	c.Flags().Float64Var(&speedFlag, "speed", 200, "")
+	c.Flags().StringVar(&mapPrefix, "map", "", "")
+	c.Flags().IntVar(&colsFlag, "columns", 3600, "")
+	c.Flags().IntVar(&colsFlag, "c", 3600, "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if speedFlag <= 0 {
+		return c.UsageError("flag --speed: value must be greater than 0")
+	}
+	if colsFlag%2 != 0 {
+		colsFlag++
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("paleolandscape not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	landscape, err := readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	rotF := p.Path(project.GeoMotion)
+	if rotF == "" {
+		msg := fmt.Sprintf("plate motion model not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	rot, err := readRotation(rotF, landscape.Pixelation())
+	if err != nil {
+		return err
+	}
+
+	var pw pixweight.Pixel
+	if pwF := p.Path(project.PixWeight); pwF != "" {
+		pw, err = readPixWeights(pwF)
+		if err != nil {
+			return err
+		}
+	}
+
+	rotStages := rot.Stages()
+	for _, a := range landscape.Stages() {
+		if _, ok := slices.BinarySearch(rotStages, a); !ok {
+			fmt.Fprintf(c.Stderr(), "WARNING: landscape stage %.6f Ma: not defined in the plate motion model\n", float64(a)/timestage.MillionYears)
+		}
+	}
+
+	probs := checkModel(rot, landscape, pw)
+	if err := writeProblems(c.Stdout(), probs); err != nil {
+		return fmt.Errorf("while writing on standard output: %v", err)
+	}
+
+	if mapPrefix == "" {
+		return nil
+	}
+	stages := make(map[int64]map[int]string)
+	for _, pr := range probs {
+		st, ok := stages[pr.age]
+		if !ok {
+			st = make(map[int]string)
+			stages[pr.age] = st
+		}
+		if st[pr.pixel] != "" && pr.kind == "jump" {
+			continue
+		}
+		st[pr.pixel] = pr.kind
+	}
+	for a, st := range stages {
+		name := fmt.Sprintf("%s-%d.png", mapPrefix, a/timestage.MillionYears)
+		img := problemMap{
+			step:  360 / float64(colsFlag),
+			pix:   landscape.Pixelation(),
+			valid: validPixels(landscape, a, pw),
+			probs: st,
+		}
+		if err := writeImage(name, img); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A problem is an inconsistency
+// between the plate motion model
+// and the landscape model.
+type problem struct {
+	age   int64
+	pixel int
+	value int
+	kind  string
+	dest  int
+	dist  float64 // in radians
+}
+
+// CheckModel returns the inconsistencies
+// of a plate motion model,
+// sorted from the oldest to the youngest stage,
+// and by pixel ID.
+func checkModel(rot *model.StageRot, landscape *model.TimePix, pw pixweight.Pixel) []problem {
+	pix := landscape.Pixelation()
+	tolerance := earth.ToRad(pix.Step())
+	stages := rot.Stages()
+
+	var probs []problem
+	for i := len(stages) - 1; i > 0; i-- {
+		old := stages[i]
+		young := stages[i-1]
+		maxDist := speedFlag*float64(old-young)/timestage.MillionYears*1000/earth.Radius + tolerance
+
+		// pixels at the youngest stage
+		if y2o := rot.YoungToOld(young); y2o != nil {
+			for _, px := range validPixels(landscape, young, pw) {
+				if _, ok := y2o.Rot[px]; ok {
+					continue
+				}
+				v, _ := landscape.At(landscape.ClosestStageAge(young), px)
+				probs = append(probs, problem{
+					age:   young,
+					pixel: px,
+					value: v,
+					kind:  "no-source",
+					dest:  -1,
+				})
+			}
+		}
+
+		// pixels at the oldest stage
+		o2y := rot.OldToYoung(old)
+		if o2y == nil {
+			continue
+		}
+		for _, px := range validPixels(landscape, old, pw) {
+			v, _ := landscape.At(landscape.ClosestStageAge(old), px)
+			dest, ok := o2y.Rot[px]
+			if !ok || len(dest) == 0 {
+				probs = append(probs, problem{
+					age:   old,
+					pixel: px,
+					value: v,
+					kind:  "no-dest",
+					dest:  -1,
+				})
+				continue
+			}
+			pt := pix.ID(px).Point()
+			for _, d := range dest {
+				dist := earth.Distance(pt, pix.ID(d).Point())
+				if dist <= maxDist {
+					continue
+				}
+				probs = append(probs, problem{
+					age:   old,
+					pixel: px,
+					value: v,
+					kind:  "jump",
+					dest:  d,
+					dist:  dist,
+				})
+			}
+		}
+	}
+
+	slices.SortStableFunc(probs, func(a, b problem) int {
+		if a.age != b.age {
+			if a.age > b.age {
+				return -1
+			}
+			return 1
+		}
+		return a.pixel - b.pixel
+	})
+	return probs
+}
+
+// ValidPixels returns the pixels to be checked
+// at a time stage.
+func validPixels(landscape *model.TimePix, age int64, pw pixweight.Pixel) []int {
+	stage := landscape.Stage(landscape.ClosestStageAge(age))
+	pixels := make([]int, 0, len(stage))
+	for px, v := range stage {
+		if pw != nil {
+			if pw.Weight(v) == 0 {
+				continue
+			}
+		} else if v == 0 {
+			continue
+		}
+		pixels = append(pixels, px)
+	}
+	slices.Sort(pixels)
+	return pixels
+}
+
+func writeProblems(w io.Writer, probs []problem) error {
+	tsv := csv.NewWriter(w)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	if err := tsv.Write([]string{"age", "pixel", "value", "problem", "dest", "dist"}); err != nil {
+		return err
+	}
+
+	for _, pr := range probs {
+		dist := "NA"
+		if pr.kind == "jump" {
+			dist = strconv.FormatFloat(pr.dist*earth.Radius/1000, 'f', 3, 64)
+		}
+		row := []string{
+			strconv.FormatInt(pr.age, 10),
+			strconv.Itoa(pr.pixel),
+			strconv.Itoa(pr.value),
+			pr.kind,
+			strconv.Itoa(pr.dest),
+			dist,
+		}
+		if err := tsv.Write(row); err != nil {
+			return err
+		}
+	}
+
+	tsv.Flush()
+	return tsv.Error()
+}
+
+// A problemMap is an image
+// with the inconsistent pixels
+// of a time stage.
+type problemMap struct {
+	step  float64
+	pix   *earth.Pixelation
+	valid []int
+	probs map[int]string
+}
+
+func (m problemMap) ColorModel() color.Model { return color.RGBAModel }
+func (m problemMap) Bounds() image.Rectangle { return image.Rect(0, 0, colsFlag, colsFlag/2) }
+func (m problemMap) At(x, y int) color.Color {
+	lat := 90 - float64(y)*m.step
+	lon := float64(x)*m.step - 180
+
+	px := m.pix.Pixel(lat, lon).ID()
+	switch m.probs[px] {
+	case "no-source", "no-dest":
+		return color.RGBA{220, 5, 12, 255}
+	case "jump":
+		return color.RGBA{25, 101, 176, 255}
+	}
+	if _, ok := slices.BinarySearch(m.valid, px); ok {
+		return color.RGBA{153, 153, 153, 255}
+	}
+	return color.RGBA{255, 255, 255, 255}
+}
+
+func writeImage(name string, img image.Image) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	if err := png.Encode(f, img); err != nil {
+		return fmt.Errorf("when encoding image file %q: %v", name, err)
+	}
+	return nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readRotation(name string, pix *earth.Pixelation) (*model.StageRot, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rot, err := model.ReadStageRot(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return rot, nil
+}
+
+func readPixWeights(name string) (pixweight.Pixel, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pw, err := pixweight.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return pw, nil
+}
@@ -0,0 +1,318 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package contour implements a command to draw
+// the coastlines of the landscape model of a PhyGeo project.
+package contour
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/timestage"
+)
+
+var Command = &command.Command{
+	Usage: `contour [-c|--columns <value>]
+	[--at <age>] [--land <values>] [--svg]
+	[-o|--output <file-prefix>] <project-file>`,
+	Short: "draw the coastlines of the landscape model",
+	Long: `
+Command contour reads the landscape model from a PhyGeo project and draws the
+boundary between land and sea pixels (i.e., the coastline) as a transparent
+image using a plate carrée projection. The resulting image can be used
+directly with the flag --contour of the map commands.
+
+The argument of the command is the name of the project file.
+
+By default, the image will be 3600 pixels wide; use the flag --columns, or -c,
+to define a different number of image columns. As the size of the contour
+sets the size of the maps that use it, it is recommended to use the same
+number of columns used in the map commands.
+
+By default, all time stages will be produced. Use the flag --at to define a
+particular time stage to be drawn (in million years).
+
+By default, the landscape values 3 (lowlands), 4 (highlands), and 5 (ice
+sheets) are considered as land, and any other value as sea. Use the flag
+--land to define a different set of land values, as a list separated by
+commas, for example "2,3,4" will also include the continental shelf as land.
+
+By default, the contour will be written as a png image. If the flag --svg is
+defined, the contour will be written as an SVG path instead.
+
+By default, the output files will be prefixed as 'contour'. To set a different
+prefix name, use the flag --output or -o. The name of the file will be in the
+form '<prefix>-<age>.png' (or '.svg') with the age in million years, using
+three decimals (e.g., 'contour-2.500.png').
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var svgFlag bool
+var colsFlag int
+var atFlag float64
+var landFlag string
+var outPrefix string
+
+func setFlags(c *command.Command) {
+	c.Flags().BoolVar(&svgFlag, "svg", false, "")
+	c.Flags().IntVar(&colsFlag, "columns", 3600, "")
+	c.Flags().IntVar(&colsFlag, "c", 3600, "")
+	c.Flags().Float64Var(&atFlag, "at", -1, "")
+	c.Flags().StringVar(&landFlag, "land", "3,4,5", "")
+	c.Flags().StringVar(&outPrefix, "output", "", "")
+	c.Flags().StringVar(&outPrefix, "o", "", "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	if colsFlag%2 != 0 {
+		colsFlag++
+	}
+
+	land, err := parseLand(landFlag)
+	if err != nil {
+		return c.UsageError(err.Error())
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("landscape not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	landscape, err := readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	var ages []int64
+	if atFlag >= 0 {
+		ages = []int64{landscape.ClosestStageAge(int64(atFlag * timestage.MillionYears))}
+	} else {
+		ages = landscape.Stages()
+	}
+
+	if outPrefix == "" {
+		outPrefix = "contour"
+	}
+
+	for _, a := range ages {
+		m := makeLandMask(landscape, a, land)
+		age := float64(a) / timestage.MillionYears
+		if svgFlag {
+			name := fmt.Sprintf("%s-%.3f.svg", outPrefix, age)
+			if err := writeSVG(name, m); err != nil {
+				return err
+			}
+			continue
+		}
+		name := fmt.Sprintf("%s-%.3f.png", outPrefix, age)
+		if err := writeImage(name, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseLand(s string) (map[int]bool, error) {
+	land := make(map[int]bool)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		k, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("flag --land: invalid value %q: %v", v, err)
+		}
+		land[k] = true
+	}
+	if len(land) == 0 {
+		return nil, fmt.Errorf("flag --land: expecting at least a land value")
+	}
+	return land, nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+// A landMask is a raster of land and sea cells
+// of a landscape stage,
+// in a plate carrée projection.
+//
+// As an image,
+// it is transparent,
+// except at the land cells
+// that are neighbors of a sea cell,
+// that are drawn in black.
+type landMask struct {
+	cols int
+	rows int
+	land []bool
+}
+
+func makeLandMask(tp *model.TimePix, age int64, land map[int]bool) landMask {
+	m := landMask{
+		cols: colsFlag,
+		rows: colsFlag / 2,
+		land: make([]bool, colsFlag*colsFlag/2),
+	}
+
+	step := 360 / float64(colsFlag)
+	pix := tp.Pixelation()
+	for y := 0; y < m.rows; y++ {
+		lat := 90 - float64(y)*step
+		for x := 0; x < m.cols; x++ {
+			lon := float64(x)*step - 180
+			v, _ := tp.At(age, pix.Pixel(lat, lon).ID())
+			m.land[y*m.cols+x] = land[v]
+		}
+	}
+	return m
+}
+
+// IsLand returns true if a cell is land.
+// The columns wrap around the anti-meridian,
+// and cells outside the rows are taken as sea.
+func (m landMask) isLand(x, y int) bool {
+	if y < 0 || y >= m.rows {
+		return false
+	}
+	x = (x + m.cols) % m.cols
+	return m.land[y*m.cols+x]
+}
+
+// IsCoast returns true if a cell is land
+// and at least one of its four neighbors is sea.
+func (m landMask) isCoast(x, y int) bool {
+	if !m.isLand(x, y) {
+		return false
+	}
+	if y > 0 && !m.isLand(x, y-1) {
+		return true
+	}
+	if y < m.rows-1 && !m.isLand(x, y+1) {
+		return true
+	}
+	if !m.isLand(x-1, y) || !m.isLand(x+1, y) {
+		return true
+	}
+	return false
+}
+
+func (m landMask) ColorModel() color.Model { return color.RGBAModel }
+func (m landMask) Bounds() image.Rectangle { return image.Rect(0, 0, m.cols, m.rows) }
+func (m landMask) At(x, y int) color.Color {
+	if m.isCoast(x, y) {
+		return color.RGBA{A: 255}
+	}
+	return color.RGBA{}
+}
+
+func writeImage(name string, img image.Image) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	if err := png.Encode(f, img); err != nil {
+		return fmt.Errorf("when encoding image file %q: %v", name, err)
+	}
+	return nil
+}
+
+// WriteSVG writes the coastline as a single SVG path
+// made of the cell edges that separate land and sea cells.
+func writeSVG(name string, m landMask) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n", m.cols, m.rows, m.cols, m.rows)
+	fmt.Fprintf(w, "<path fill=\"none\" stroke=\"black\" stroke-width=\"1\" d=\"")
+
+	// horizontal edges
+	for y := 1; y < m.rows; y++ {
+		start := -1
+		for x := 0; x <= m.cols; x++ {
+			edge := x < m.cols && m.isLand(x, y-1) != m.isLand(x, y)
+			if edge && start < 0 {
+				start = x
+				continue
+			}
+			if !edge && start >= 0 {
+				fmt.Fprintf(w, "M%d %dH%d", start, y, x)
+				start = -1
+			}
+		}
+	}
+
+	// vertical edges
+	// (the anti-meridian is not a coast)
+	for x := 1; x < m.cols; x++ {
+		start := -1
+		for y := 0; y <= m.rows; y++ {
+			edge := y < m.rows && m.isLand(x-1, y) != m.isLand(x, y)
+			if edge && start < 0 {
+				start = y
+				continue
+			}
+			if !edge && start >= 0 {
+				fmt.Fprintf(w, "M%d %dV%d", x, start, y)
+				start = -1
+			}
+		}
+	}
+	fmt.Fprintf(w, "\"/>\n</svg>\n")
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("while writing data on %q: %v", name, err)
+	}
+	return nil
+}
@@ -9,8 +9,11 @@ package geo
 import (
 	"github.com/js-arias/command"
 	"github.com/js-arias/phygeo/cmd/phygeo/geo/add"
+	"github.com/js-arias/phygeo/cmd/phygeo/geo/check"
+	"github.com/js-arias/phygeo/cmd/phygeo/geo/contour"
 	"github.com/js-arias/phygeo/cmd/phygeo/geo/mapcmd"
 	"github.com/js-arias/phygeo/cmd/phygeo/geo/pixel"
+	"github.com/js-arias/phygeo/cmd/phygeo/geo/refine"
 	"github.com/js-arias/phygeo/cmd/phygeo/geo/stages"
 	"github.com/js-arias/phygeo/cmd/phygeo/geo/weights"
 )
@@ -22,8 +25,11 @@ var Command = &command.Command{
 
 func init() {
 	Command.Add(add.Command)
+	Command.Add(check.Command)
+	Command.Add(contour.Command)
 	Command.Add(mapcmd.Command)
 	Command.Add(pixel.Command)
+	Command.Add(refine.Command)
 	Command.Add(stages.Command)
 	Command.Add(weights.Command)
 
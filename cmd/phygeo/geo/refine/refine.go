@@ -0,0 +1,309 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package refine implements a command to add time stages
+// to the paleogeographic models of a project
+// by interpolating the pixel locations.
+package refine
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/timestage"
+	"gonum.org/v1/gonum/spatial/r3"
+)
+
+var Command = &command.Command{
+	Usage: "refine [--wait <seconds>] --every <value> <project>",
+	Short: "interpolate time stages of a plate motion model",
+	Long: `
+Command refine adds time stages to the plate motion model, and the landscape
+model, of a PhyGeo project, by interpolating the locations of the pixels
+between the time stages defined in the models.
+
+The argument of the command is the name of the project file.
+
+The flag --every is required and defines the maximum length, in million
+years, between two consecutive time stages. If two stages of the model are
+separated by a longer time, new stages will be added every the indicated
+value, starting from the youngest stage.
+
+For each pixel of a tectonic plate, the location at a new stage is calculated
+as the spherical linear interpolation between its locations at the younger and
+the older stages of the model. The pixels that are not defined in both stages
+are ignored. The landscape value of an interpolated pixel is the value of the
+pixel at the younger stage (or the older stage, if the pixel is not defined
+in the younger stage of the landscape model). If several pixels are
+interpolated to the same location, the largest landscape value will be used.
+
+The new models will be written in files named after the original models, with
+the suffix "-refined" added before the extension, and the project will be
+updated to use the new models.
+
+While the models are refined, the project is locked. If the project is locked
+by another process, the command fails. Use the flag --wait to set the maximum
+time, in seconds, to wait until the lock is released.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var everyFlag float64
+var waitFlag float64
+
+func setFlags(c *command.Command) {
+	c.Flags().Float64Var(&everyFlag, "every", 0, "")
+	c.Flags().Float64Var(&waitFlag, "wait", 0, "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if everyFlag <= 0 {
+		return c.UsageError("flag --every: expecting a value greater than 0")
+	}
+
+	pFile := args[0]
+	wait := time.Duration(waitFlag * float64(time.Second))
+	return project.Update(pFile, wait, func(p *project.Project) error {
+		return refineProject(c, p, pFile)
+	})
+}
+
+// RefineProject adds the interpolated time stages
+// to the models of the project.
+func refineProject(c *command.Command, p *project.Project, pFile string) error {
+	rotF := p.Path(project.GeoMotion)
+	if rotF == "" {
+		msg := fmt.Sprintf("plate motion model not defined in project %q", pFile)
+		return c.UsageError(msg)
+	}
+	rec, err := readRecons(rotF)
+	if err != nil {
+		return err
+	}
+
+	lsF := p.Path(project.Landscape)
+	var landscape *model.TimePix
+	if lsF != "" {
+		landscape, err = readLandscape(lsF, rec.Pixelation())
+		if err != nil {
+			return err
+		}
+	}
+
+	every := int64(everyFlag * timestage.MillionYears)
+	ages := newStages(rec.Stages(), every)
+	if len(ages) == 0 {
+		fmt.Fprintf(c.Stderr(), "no stages added: all stages are separated by %.3f My or less\n", everyFlag)
+		return project.SkipWrite
+	}
+
+	nr, nl := refine(rec, landscape, ages)
+
+	out := refinedName(rotF)
+	if err := writeTSV(out, nr.TSV); err != nil {
+		return err
+	}
+	p.Add(project.GeoMotion, out)
+
+	if nl != nil {
+		out := refinedName(lsF)
+		if err := writeTSV(out, nl.TSV); err != nil {
+			return err
+		}
+		p.Add(project.Landscape, out)
+	}
+	return nil
+}
+
+// NewStages returns the ages of the new stages,
+// and the ages of the younger and older stages
+// used for the interpolation.
+func newStages(stages []int64, every int64) []interStage {
+	var ages []interStage
+	for i := 1; i < len(stages); i++ {
+		young := stages[i-1]
+		old := stages[i]
+		for a := young + every; a < old; a += every {
+			ages = append(ages, interStage{
+				age:   a,
+				young: young,
+				old:   old,
+			})
+		}
+	}
+	return ages
+}
+
+// An interStage is a time stage
+// between two stages of the model.
+type interStage struct {
+	age   int64
+	young int64
+	old   int64
+}
+
+// Refine returns new plate motion and landscape models
+// with the interpolated stages.
+func refine(rec *model.Recons, landscape *model.TimePix, ages []interStage) (*model.Recons, *model.TimePix) {
+	pix := rec.Pixelation()
+
+	nr := model.NewRecons(pix)
+	for _, plate := range rec.Plates() {
+		for _, a := range rec.Stages() {
+			if st := rec.PixStage(plate, a); len(st) > 0 {
+				nr.Add(plate, st, a)
+			}
+		}
+	}
+
+	var nl *model.TimePix
+	if landscape != nil {
+		nl = model.NewTimePix(pix)
+		for _, a := range landscape.Stages() {
+			for px, v := range landscape.Stage(a) {
+				nl.Set(a, px, v)
+			}
+		}
+	}
+
+	for _, is := range ages {
+		t := float64(is.age-is.young) / float64(is.old-is.young)
+		for _, plate := range rec.Plates() {
+			young := rec.PixStage(plate, is.young)
+			old := rec.PixStage(plate, is.old)
+
+			locs := make(map[int][]int)
+			for px, yl := range young {
+				ol, ok := old[px]
+				if !ok || len(yl) == 0 || len(ol) == 0 {
+					continue
+				}
+				v := slerp(centroid(pix, yl), centroid(pix, ol), t)
+				np := pix.FromVector(v).ID()
+				locs[px] = []int{np}
+
+				if nl == nil {
+					continue
+				}
+				val, ok := landscape.At(is.young, yl[0])
+				if !ok {
+					val, ok = landscape.At(is.old, ol[0])
+				}
+				if !ok {
+					continue
+				}
+				if prev, ok := nl.At(is.age, np); ok && prev > val {
+					continue
+				}
+				nl.Set(is.age, np, val)
+			}
+			if len(locs) == 0 {
+				continue
+			}
+			nr.Add(plate, locs, is.age)
+		}
+	}
+
+	return nr, nl
+}
+
+// Centroid returns the normalized mean vector
+// of a set of pixels.
+func centroid(pix *earth.Pixelation, pxs []int) r3.Vec {
+	var v r3.Vec
+	for _, px := range pxs {
+		v = r3.Add(v, pix.ID(px).Point().Vector())
+	}
+	if r3.Norm(v) == 0 {
+		return pix.ID(pxs[0]).Point().Vector()
+	}
+	return r3.Unit(v)
+}
+
+// Slerp returns the spherical linear interpolation
+// between two unit vectors.
+func slerp(a, b r3.Vec, t float64) r3.Vec {
+	angle := math.Acos(math.Max(-1, math.Min(1, r3.Dot(a, b))))
+	s := math.Sin(angle)
+	if s < 1e-9 {
+		if t < 0.5 {
+			return a
+		}
+		return b
+	}
+	wa := math.Sin((1-t)*angle) / s
+	wb := math.Sin(t*angle) / s
+	return r3.Unit(r3.Add(r3.Scale(wa, a), r3.Scale(wb, b)))
+}
+
+// RefinedName returns the name of the file
+// of a refined model.
+func refinedName(name string) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s-refined%s", strings.TrimSuffix(name, ext), ext)
+}
+
+func readRecons(name string) (*model.Recons, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rec, err := model.ReadReconsTSV(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return rec, nil
+}
+
+func readLandscape(name string, pix *earth.Pixelation) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+	if eq := pix.Equator(); tp.Pixelation().Equator() != eq {
+		return nil, fmt.Errorf("on file %q: invalid equator value %d, want %d", name, tp.Pixelation().Equator(), eq)
+	}
+
+	return tp, nil
+}
+
+func writeTSV(name string, tsv func(io.Writer) error) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	if err := tsv(f); err != nil {
+		return fmt.Errorf("while writing to %q: %v", name, err)
+	}
+	return nil
+}
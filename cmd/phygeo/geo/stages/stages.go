@@ -9,6 +9,7 @@ package stages
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/js-arias/command"
 	"github.com/js-arias/earth"
@@ -20,7 +21,7 @@ import (
 var Command = &command.Command{
 	Usage: `stages [--add <value>]
 	[--each <value>] [--from <value>] [--to <value>]
-	[-f|--file <file>] <project>`,
+	[-f|--file <file>] [--wait <seconds>] <project>`,
 	Short: "manage time stages",
 	Long: `
 Command stages manage the time stages defined for a PhyGeo project.
@@ -44,6 +45,10 @@ If the flag --file or -f is defined, the time stages will be stored in the
 indicated file. If at least a stage is added and no stage file is defined, the
 default file name will be 'stages.tab'.
 
+While the time stages are added, the project is locked. If the project is
+locked by another process, the command fails. Use the flag --wait to set the
+maximum time, in seconds, to wait until the lock is released.
+
 The file for the time stages is just a tab-delimited file without a header, in
 which the first column contains the time stages in years. Here is an example:
 
@@ -64,6 +69,7 @@ var eachFlag float64
 var fromFlag float64
 var toFlag float64
 var stageFile string
+var waitFlag float64
 
 func setFlags(c *command.Command) {
 	c.Flags().Float64Var(&addFlag, "add", -1, "")
@@ -72,6 +78,7 @@ func setFlags(c *command.Command) {
 	c.Flags().Float64Var(&toFlag, "to", -1, "")
 	c.Flags().StringVar(&stageFile, "file", "", "")
 	c.Flags().StringVar(&stageFile, "f", "", "")
+	c.Flags().Float64Var(&waitFlag, "wait", 0, "")
 }
 
 func run(c *command.Command, args []string) error {
@@ -79,62 +86,60 @@ func run(c *command.Command, args []string) error {
 		return c.UsageError("expecting project file")
 	}
 
-	p, err := project.Read(args[0])
-	if err != nil {
-		return err
-	}
-
-	stages := timestage.New()
-	if err := readTimeStages(p, stages); err != nil {
-		return err
-	}
-
-	stF := p.Path(project.Stages)
-	if stF == "" {
-		stF = "stages.tab"
-	}
-	write := false
-
-	if addFlag >= 0 {
-		write = true
-		add := int64(addFlag * timestage.MillionYears)
-		stages.AddStage(add)
-	} else if eachFlag > 0 {
-		write = true
-		each := int64(eachFlag * timestage.MillionYears)
-		st := stages.Stages()
-		from := st[len(st)-1]
-		if fromFlag >= 0 {
-			from = int64(fromFlag * timestage.MillionYears)
-		}
-		var to int64
-		if toFlag >= 0 {
-			to = int64(toFlag * timestage.MillionYears)
+	if addFlag < 0 && eachFlag <= 0 {
+		p, err := project.Read(args[0])
+		if err != nil {
+			return err
 		}
-		for a := from; a >= to; a -= each {
-			stages.AddStage(a)
+		stages := timestage.New()
+		if err := readTimeStages(p, stages); err != nil {
+			return err
 		}
-	}
-
-	if !write {
 		for _, a := range stages.Stages() {
 			fmt.Fprintf(c.Stdout(), "%.6f\n", float64(a)/timestage.MillionYears)
 		}
 		return nil
 	}
 
-	if stageFile != "" {
-		stF = stageFile
-	}
-	if err := writeStages(stF, stages); err != nil {
-		return err
-	}
+	wait := time.Duration(waitFlag * float64(time.Second))
+	return project.Update(args[0], wait, func(p *project.Project) error {
+		stages := timestage.New()
+		if err := readTimeStages(p, stages); err != nil {
+			return err
+		}
 
-	p.Add(project.Stages, stF)
-	if err := p.Write(args[0]); err != nil {
-		return err
-	}
-	return nil
+		if addFlag >= 0 {
+			add := int64(addFlag * timestage.MillionYears)
+			stages.AddStage(add)
+		} else {
+			each := int64(eachFlag * timestage.MillionYears)
+			st := stages.Stages()
+			from := st[len(st)-1]
+			if fromFlag >= 0 {
+				from = int64(fromFlag * timestage.MillionYears)
+			}
+			var to int64
+			if toFlag >= 0 {
+				to = int64(toFlag * timestage.MillionYears)
+			}
+			for a := from; a >= to; a -= each {
+				stages.AddStage(a)
+			}
+		}
+
+		stF := p.Path(project.Stages)
+		if stF == "" {
+			stF = "stages.tab"
+		}
+		if stageFile != "" {
+			stF = stageFile
+		}
+		if err := writeStages(stF, stages); err != nil {
+			return err
+		}
+		p.Add(project.Stages, stF)
+		return nil
+	})
 }
 
 func readTimeStages(p *project.Project, stages timestage.Stages) (err error) {
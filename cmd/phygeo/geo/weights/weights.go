@@ -7,6 +7,8 @@
 package weights
 
 import (
+	"bufio"
+	"encoding/csv"
 	"fmt"
 	"io"
 	"os"
@@ -14,15 +16,19 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/js-arias/command"
 	"github.com/js-arias/earth/model"
 	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/pixkey"
 	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/version"
 )
 
 var Command = &command.Command{
-	Usage: "weights [--add <file>] [--set <value>] <project-file>",
+	Usage: `weights [--add <file>] [--set <value>] [--wait <seconds>]
+	[--key <key-file>] [--template] [--check] <project-file>`,
 	Short: "manage pixel weights",
 	Long: `
 Command prior manage pixel normalized weights defined for a PhyGeo project.
@@ -40,9 +46,30 @@ The sintaxis of the definition is:
 
 	<value>=<probability>
 
-If there is no pixel weights file defined in the project, a new file will be
-created using the project file name as a prefix and "-pix-weights.tab" as a
-suffix.
+Several definitions can be set at once, separated by commas, for example
+"1=1,2=0.5,3=0.1". If the flag --key is defined with a landscape key file (the
+same file used to color the maps), the value can also be a label of the key,
+for example "lowlands=1" (labels are case insensitive). If there is no pixel
+weights file defined in the project, a new file will be created using the
+project file name as a prefix and "-pix-weights.tab" as a suffix.
+
+If the flag --key is defined, the labels of the key will be printed with the
+current pixel weights. If the flag --template is defined, instead of the
+current weights, a pixel weights file will be printed in the standard output,
+with all the values of the key, and of the landscape of the project, so it
+can be edited and then added with the flag --add. The file includes the
+columns "key", "weight" (the current weight, or 0 if undefined), and
+"comment" (the label of the key).
+
+If the flag --check is defined, the command will check that all the values of
+the landscape of the project, at any time stage, have a defined pixel weight,
+and will fail if any value is undefined.
+
+When the flags --add or --set are used, the project is locked with the file
+"<project-file>.lock" while the pixel weights are updated, so several weights
+can be set by commands running in parallel (e.g., in a job script). If the
+project is locked by another process, the command fails. Use the flag --wait
+to set the maximum time, in seconds, to wait until the lock is released.
 	`,
 	SetFlags: setFlags,
 	Run:      run,
@@ -50,68 +77,74 @@ suffix.
 
 var weightsFile string
 var setFlag string
+var waitFlag float64
+var keyFile string
+var templateFlag bool
+var checkFlag bool
 
 func setFlags(c *command.Command) {
 	c.Flags().StringVar(&weightsFile, "add", "", "")
 	c.Flags().StringVar(&setFlag, "set", "", "")
+	c.Flags().Float64Var(&waitFlag, "wait", 0, "")
+	c.Flags().StringVar(&keyFile, "key", "", "")
+	c.Flags().BoolVar(&templateFlag, "template", false, "")
+	c.Flags().BoolVar(&checkFlag, "check", false, "")
 }
 
-func run(c *command.Command, args []string) error {
+func run(c *command.Command, args []string) (err error) {
 	if len(args) < 1 {
 		return c.UsageError("expecting project file")
 	}
-
-	p, err := project.Read(args[0])
-	if err != nil {
-		return err
+	if templateFlag && keyFile == "" {
+		return c.UsageError("flag --template: expecting a key file, flag --key")
 	}
 
-	if weightsFile != "" {
-		if _, err := readPriorFile(weightsFile); err != nil {
-			return err
-		}
-		p.Add(project.PixWeight, weightsFile)
-		if err := p.Write(args[0]); err != nil {
+	var keys *pixkey.PixKey
+	if keyFile != "" {
+		keys, err = pixkey.Read(keyFile)
+		if err != nil {
 			return err
 		}
-		return nil
 	}
 
-	if setFlag != "" {
-		pw := pixweight.New()
-		pwF := p.Path(project.PixWeight)
-		if pwF != "" {
-			pw, err = readPriorFile(p.Path(project.PixWeight))
-			if err != nil {
+	wait := time.Duration(waitFlag * float64(time.Second))
+	if weightsFile != "" {
+		return project.Update(args[0], wait, func(p *project.Project) error {
+			if _, err := readPriorFile(weightsFile); err != nil {
 				return err
 			}
-		} else {
-			pwF = makePixPriorFileName(args[0])
-		}
+			p.Add(project.PixWeight, weightsFile)
+			return nil
+		})
+	}
 
-		k, prob, err := getKeyProb()
-		if err != nil {
-			return err
-		}
-		pw.Set(k, prob)
+	if setFlag != "" {
+		return project.Update(args[0], wait, func(p *project.Project) error {
+			return setWeights(p, args[0], keys)
+		})
+	}
 
-		if err := writePWF(pwF, pw); err != nil {
-			return err
-		}
-		p.Add(project.PixWeight, pwF)
-		if err := p.Write(args[0]); err != nil {
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	var tp *model.TimePix
+	if tpF := p.Path(project.Landscape); tpF != "" {
+		tp, err = readLandscape(tpF)
+		if err != nil {
 			return err
 		}
-		return nil
 	}
 
 	pwF := p.Path(project.PixWeight)
 	if pwF == "" {
-		if tp := p.Path(project.Landscape); tp != "" {
-			pw := pixweight.New()
-			if err := reportWithLandscape(c.Stderr(), tp, pw); err != nil {
-				return err
-			}
+		pw := pixweight.New()
+		if templateFlag {
+			return writeTemplate(c.Stdout(), tp, pw, keys)
+		}
+		if tp != nil {
+			reportWithLandscape(c.Stderr(), tp, pw, keys)
 		}
 		return fmt.Errorf("pixel weights undefined for project %q", args[0])
 	}
@@ -120,33 +153,86 @@ func run(c *command.Command, args []string) error {
 	if err != nil {
 		return err
 	}
-	if tp := p.Path(project.Landscape); tp != "" {
-		if err := reportWithLandscape(c.Stdout(), tp, pw); err != nil {
-			return err
+	if templateFlag {
+		return writeTemplate(c.Stdout(), tp, pw, keys)
+	}
+	if checkFlag {
+		if tp == nil {
+			return fmt.Errorf("flag --check: landscape undefined for project %q", args[0])
 		}
+		return checkWeights(tp, pw)
+	}
+	if tp != nil {
+		reportWithLandscape(c.Stdout(), tp, pw, keys)
 		return nil
 	}
 
 	for _, v := range pw.Values() {
-		fmt.Fprintf(c.Stdout(), "%d\t%.6f\n", v, pw.Weight(v))
+		fmt.Fprintf(c.Stdout(), "%d\t%.6f%s\n", v, pw.Weight(v), keyLabel(keys, v))
 	}
 
 	return nil
 }
 
-func reportWithLandscape(w io.Writer, name string, pw pixweight.Pixel) error {
-	tp, err := readLandscape(name)
+// SetWeights sets the pixel weights
+// defined with the flag --set.
+func setWeights(p *project.Project, pFile string, keys *pixkey.PixKey) (err error) {
+	pw := pixweight.New()
+	pwF := p.Path(project.PixWeight)
+	if pwF != "" {
+		pw, err = readPriorFile(p.Path(project.PixWeight))
+		if err != nil {
+			return err
+		}
+	} else {
+		pwF = makePixPriorFileName(pFile)
+	}
+
+	kw, err := parseSet(keys)
 	if err != nil {
 		return err
 	}
+	for _, w := range kw {
+		pw.Set(w.key, w.weight)
+	}
 
+	if err := writePWF(pwF, pw); err != nil {
+		return err
+	}
+	p.Add(project.PixWeight, pwF)
+	return nil
+}
+
+// LandscapeValues returns the values of the landscape
+// at any time stage.
+func landscapeValues(tp *model.TimePix) map[int]bool {
 	val := make(map[int]bool)
+	if tp == nil {
+		return val
+	}
 	for _, age := range tp.Stages() {
 		s := tp.Stage(age)
 		for _, v := range s {
 			val[v] = true
 		}
 	}
+	return val
+}
+
+// KeyLabel returns the label of a value,
+// as an additional column.
+func keyLabel(keys *pixkey.PixKey, v int) string {
+	if keys == nil {
+		return ""
+	}
+	if lb := keys.Label(v); lb != "" {
+		return "\t" + lb
+	}
+	return ""
+}
+
+func reportWithLandscape(w io.Writer, tp *model.TimePix, pw pixweight.Pixel, keys *pixkey.PixKey) {
+	val := landscapeValues(tp)
 	val[0] = true
 
 	notLand := make(map[int]bool)
@@ -166,20 +252,95 @@ func reportWithLandscape(w io.Writer, name string, pw pixweight.Pixel) error {
 
 	for _, v := range pv {
 		wt := pw.Weight(v)
+		lb := keyLabel(keys, v)
 		if notLand[v] {
-			fmt.Fprintf(w, "%d\t%.6f\tpixel value not in landscape\n", v, wt)
+			fmt.Fprintf(w, "%d\t%.6f%s\tpixel value not in landscape\n", v, wt, lb)
 			continue
 		}
 		if wt == 0 {
-			fmt.Fprintf(w, "%d\t%.6f\tpixel weight undefined\n", v, wt)
+			fmt.Fprintf(w, "%d\t%.6f%s\tpixel weight undefined\n", v, wt, lb)
 			continue
 		}
-		fmt.Fprintf(w, "%d\t%.6f\n", v, wt)
+		fmt.Fprintf(w, "%d\t%.6f%s\n", v, wt, lb)
+	}
+}
+
+// CheckWeights returns an error
+// if a value of the landscape
+// has no defined pixel weight.
+func checkWeights(tp *model.TimePix, pw pixweight.Pixel) error {
+	defined := make(map[int]bool)
+	for _, v := range pw.Values() {
+		defined[v] = true
 	}
 
+	var undef []string
+	val := landscapeValues(tp)
+	pv := make([]int, 0, len(val))
+	for v := range val {
+		pv = append(pv, v)
+	}
+	slices.Sort(pv)
+	for _, v := range pv {
+		if defined[v] {
+			continue
+		}
+		undef = append(undef, strconv.Itoa(v))
+	}
+	if len(undef) > 0 {
+		return fmt.Errorf("pixel weights undefined for landscape values: %s", strings.Join(undef, ", "))
+	}
 	return nil
 }
 
+// WriteTemplate writes a pixel weights file
+// with all the values of the key,
+// the landscape,
+// and the current pixel weights,
+// using the labels of the key as comments.
+func writeTemplate(w io.Writer, tp *model.TimePix, pw pixweight.Pixel, keys *pixkey.PixKey) error {
+	val := landscapeValues(tp)
+	for _, v := range keys.Keys() {
+		val[v] = true
+	}
+	for _, v := range pw.Values() {
+		val[v] = true
+	}
+	pv := make([]int, 0, len(val))
+	for v := range val {
+		pv = append(pv, v)
+	}
+	slices.Sort(pv)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# pixel weights template\n")
+	fmt.Fprintf(bw, "# key file: %q\n", keyFile)
+	fmt.Fprintf(bw, "# date: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(bw, "# phygeo: %s\n", version.String())
+
+	tsv := csv.NewWriter(bw)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	if err := tsv.Write([]string{"key", "weight", "comment"}); err != nil {
+		return err
+	}
+	for _, v := range pv {
+		row := []string{
+			strconv.Itoa(v),
+			strconv.FormatFloat(pw.Weight(v), 'f', 6, 64),
+			keys.Label(v),
+		}
+		if err := tsv.Write(row); err != nil {
+			return err
+		}
+	}
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
 func readPriorFile(name string) (pixweight.Pixel, error) {
 	f, err := os.Open(name)
 	if err != nil {
@@ -216,24 +377,54 @@ func makePixPriorFileName(path string) string {
 	return p[:i] + "-pix-prob.tab"
 }
 
-func getKeyProb() (key int, prob float64, err error) {
-	s := strings.Split(setFlag, "=")
-	if len(s) < 2 {
-		return 0, 0, fmt.Errorf("invalid --set value: %q", setFlag)
-	}
-	key, err = strconv.Atoi(s[0])
-	if err != nil {
-		return 0, 0, fmt.Errorf("invalid --set value: %q: %v", setFlag, err)
-	}
-	prob, err = strconv.ParseFloat(s[1], 64)
-	if err != nil {
-		return 0, 0, fmt.Errorf("invalid --set value: %q: %v", setFlag, err)
+// A keyWeight is a pixel weight
+// defined for a raster value.
+type keyWeight struct {
+	key    int
+	weight float64
+}
+
+// ParseSet returns the pixel weights
+// defined with the flag --set.
+// If a key is given,
+// the labels of the key can be used
+// instead of the raster values.
+func parseSet(keys *pixkey.PixKey) ([]keyWeight, error) {
+	labels := make(map[string]int)
+	if keys != nil {
+		for _, k := range keys.Keys() {
+			if lb := keys.Label(k); lb != "" {
+				labels[strings.ToLower(lb)] = k
+			}
+		}
 	}
-	if prob < 0 || prob > 1 {
-		return 0, 0, fmt.Errorf("invalid --set value: %q: invalid probability value", setFlag)
+
+	var kw []keyWeight
+	for _, def := range strings.Split(setFlag, ",") {
+		s := strings.Split(def, "=")
+		if len(s) < 2 {
+			return nil, fmt.Errorf("invalid --set value: %q", def)
+		}
+		class := strings.Join(strings.Fields(s[0]), " ")
+		key, err := strconv.Atoi(class)
+		if err != nil {
+			k, ok := labels[strings.ToLower(class)]
+			if !ok {
+				return nil, fmt.Errorf("invalid --set value: %q: unknown value %q", def, class)
+			}
+			key = k
+		}
+		prob, err := strconv.ParseFloat(strings.TrimSpace(s[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --set value: %q: %v", def, err)
+		}
+		if prob < 0 || prob > 1 {
+			return nil, fmt.Errorf("invalid --set value: %q: invalid probability value", def)
+		}
+		kw = append(kw, keyWeight{key: key, weight: prob})
 	}
 
-	return key, prob, nil
+	return kw, nil
 }
 
 func writePWF(name string, pw pixweight.Pixel) (err error) {
@@ -249,6 +440,7 @@ func writePWF(name string, pw pixweight.Pixel) (err error) {
 		}
 	}()
 
+	fmt.Fprintf(f, "# phygeo: %s\n", version.String())
 	if err := pw.TSV(f); err != nil {
 		return err
 	}
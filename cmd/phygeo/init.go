@@ -0,0 +1,393 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/cmd/phygeo/prj/scale"
+	"github.com/js-arias/phygeo/pixkey"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/version"
+)
+
+var initCommand = &command.Command{
+	Usage: `init [--geomotion <file>] [--landscape <file>]
+	[--key <file>] [--equator <value>] <project-file>`,
+	Short: "create a new project",
+	Long: `
+Command init creates a new PhyGeo project with a paleogeographic
+reconstruction model, and prints the steps required to complete the project.
+
+The argument of the command is the name of the project file. The project file
+must not exist.
+
+The flag --geomotion defines the plate motion model, and the flag --landscape
+defines the landscape model of the project. Both models are required, and
+must be based on the same pixelation and time stages. The models can be
+given as a local file, or as an URL (starting with "http://" or "https://"),
+in which case the model will be downloaded into the directory of the project
+file. If none of these flags is defined, the command will run interactively,
+asking for each value in the standard input.
+
+The flag --key defines a key file for the landscape values (the same file
+used by the map commands with the flag --key). If the key file has a "label"
+(or "comment") column, it will be used to set the default pixel weights of
+the project, using the following rules, in order:
+
+	label with "ocean", "sea", "marine", "shelf", or "plateau"  0.0
+	label with "ice" or "glacier"                             0.1
+	label with "land", "highland", "mountain", or "continent"  1.0
+
+Values with other labels will have a weight of 0 and will be reported in the
+standard error. The pixel weights will be stored in a file named after the
+project file with the suffix "-pix-weights.tab". The weights can be modified
+later with the command "phygeo geo weights".
+
+The flag --equator defines the resolution of the project (i.e., the number of
+pixels at the equator). If it is lower than the resolution of the models,
+lower-resolution versions of the models will be built and used by the
+project, as done by the command "phygeo prj scale".
+	`,
+	SetFlags: initFlags,
+	Run:      runInit,
+}
+
+var initGeoMotion string
+var initLandscape string
+var initKey string
+var initEquator int
+
+func initFlags(c *command.Command) {
+	c.Flags().StringVar(&initGeoMotion, "geomotion", "", "")
+	c.Flags().StringVar(&initLandscape, "landscape", "", "")
+	c.Flags().StringVar(&initKey, "key", "", "")
+	c.Flags().IntVar(&initEquator, "equator", 0, "")
+}
+
+func runInit(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	pFile := args[0]
+	if _, err := os.Stat(pFile); err == nil {
+		return fmt.Errorf("project %q already exists", pFile)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if initGeoMotion == "" && initLandscape == "" {
+		if err := askInit(c.Stdin(), c.Stderr()); err != nil {
+			return err
+		}
+	}
+	if initGeoMotion == "" {
+		return c.UsageError("flag --geomotion undefined")
+	}
+	if initLandscape == "" {
+		return c.UsageError("flag --landscape undefined")
+	}
+	if initEquator < 0 {
+		return c.UsageError(fmt.Sprintf("flag --equator: invalid value %d", initEquator))
+	}
+
+	dir := filepath.Dir(pFile)
+	gmFile, err := fetchModel(initGeoMotion, dir)
+	if err != nil {
+		return err
+	}
+	tot, err := readInitTotal(gmFile)
+	if err != nil {
+		return err
+	}
+	lsFile, err := fetchModel(initLandscape, dir)
+	if err != nil {
+		return err
+	}
+	landscape, err := readInitLandscape(lsFile)
+	if err != nil {
+		return err
+	}
+
+	eq := tot.Pixelation().Equator()
+	if e := landscape.Pixelation().Equator(); e != eq {
+		return fmt.Errorf("landscape file %q: got %d equatorial pixels, want %d", lsFile, e, eq)
+	}
+	if err := cmpInitStages(landscape.Stages(), tot.Stages()); err != nil {
+		return fmt.Errorf("landscape file %q: %v", lsFile, err)
+	}
+	if initEquator > eq {
+		return fmt.Errorf("flag --equator: invalid value %d: must be lower than %d", initEquator, eq)
+	}
+
+	err = project.Create(pFile, func() (*project.Project, error) {
+		p := project.New()
+		p.Add(project.GeoMotion, gmFile)
+		p.Add(project.Landscape, lsFile)
+
+		if initKey != "" {
+			keys, err := pixkey.Read(initKey)
+			if err != nil {
+				return nil, err
+			}
+			pw, undef := labelWeights(keys)
+			for _, v := range undef {
+				fmt.Fprintf(c.Stderr(), "WARNING: key %d (%q): pixel weight undefined\n", v, keys.Label(v))
+			}
+			pwFile := initWeightsName(pFile)
+			if err := writeInitWeights(pwFile, pw); err != nil {
+				return nil, err
+			}
+			p.Add(project.PixWeight, pwFile)
+		}
+		return p, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if initEquator > 0 && initEquator < eq {
+		scale.Command.SetStdout(c.Stdout())
+		scale.Command.SetStderr(c.Stderr())
+		if err := scale.Command.Execute([]string{"--equator", strconv.Itoa(initEquator), pFile}); err != nil {
+			return err
+		}
+		if err := scale.Command.Execute([]string{"--use", strconv.Itoa(initEquator), pFile}); err != nil {
+			return err
+		}
+	}
+
+	printNextSteps(c.Stdout(), pFile, initKey != "")
+	return nil
+}
+
+// AskInit asks for the values of the flags
+// using the standard input.
+func askInit(r io.Reader, w io.Writer) error {
+	in := bufio.NewScanner(r)
+	ask := func(msg string) (string, error) {
+		fmt.Fprintf(w, "%s: ", msg)
+		if !in.Scan() {
+			if err := in.Err(); err != nil {
+				return "", err
+			}
+			return "", io.ErrUnexpectedEOF
+		}
+		return strings.TrimSpace(in.Text()), nil
+	}
+
+	var err error
+	initGeoMotion, err = ask("Plate motion model (file or URL)")
+	if err != nil {
+		return fmt.Errorf("while reading plate motion model: %v", err)
+	}
+	initLandscape, err = ask("Landscape model (file or URL)")
+	if err != nil {
+		return fmt.Errorf("while reading landscape model: %v", err)
+	}
+	initKey, err = ask("Landscape key file (empty to skip)")
+	if err != nil {
+		return fmt.Errorf("while reading key file: %v", err)
+	}
+	eq, err := ask("Pixels at the equator (empty to use the model resolution)")
+	if err != nil {
+		return fmt.Errorf("while reading resolution: %v", err)
+	}
+	if eq != "" {
+		initEquator, err = strconv.Atoi(eq)
+		if err != nil {
+			return fmt.Errorf("invalid resolution %q: %v", eq, err)
+		}
+	}
+	return nil
+}
+
+// FetchModel returns the path of a model file.
+// If the name is an URL,
+// the file will be downloaded
+// into the indicated directory.
+func fetchModel(name, dir string) (string, error) {
+	if !strings.HasPrefix(name, "http://") && !strings.HasPrefix(name, "https://") {
+		return name, nil
+	}
+
+	u, err := url.Parse(name)
+	if err != nil {
+		return "", err
+	}
+	base := path.Base(u.Path)
+	if base == "." || base == "/" {
+		return "", fmt.Errorf("URL %q: undefined file name", name)
+	}
+	out := filepath.Join(dir, base)
+	if _, err := os.Stat(out); err == nil {
+		return "", fmt.Errorf("URL %q: file %q already exists", name, out)
+	}
+
+	resp, err := http.Get(name)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("URL %q: %s", name, resp.Status)
+	}
+
+	if err := writeDownload(out, resp.Body); err != nil {
+		os.Remove(out)
+		return "", fmt.Errorf("URL %q: %v", name, err)
+	}
+	return out, nil
+}
+
+func writeDownload(name string, r io.Reader) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// LabelWeights returns the default pixel weights
+// from the labels of a key.
+// It also returns the keys
+// with an undefined weight.
+func labelWeights(keys *pixkey.PixKey) (pixweight.Pixel, []int) {
+	rules := []struct {
+		words  []string
+		weight float64
+	}{
+		{[]string{"ocean", "sea", "marine", "shelf", "plateau"}, 0},
+		{[]string{"ice", "glacier"}, 0.1},
+		{[]string{"land", "highland", "mountain", "continent"}, 1},
+	}
+
+	pw := pixweight.New()
+	var undef []int
+	for _, v := range keys.Keys() {
+		lb := strings.ToLower(keys.Label(v))
+		found := false
+		for _, r := range rules {
+			for _, w := range r.words {
+				if strings.Contains(lb, w) {
+					found = true
+					break
+				}
+			}
+			if found {
+				pw.Set(v, r.weight)
+				break
+			}
+		}
+		if !found {
+			undef = append(undef, v)
+		}
+	}
+	return pw, undef
+}
+
+func printNextSteps(w io.Writer, pFile string, hasWeights bool) {
+	fmt.Fprintf(w, "Project %q created.\n", pFile)
+	fmt.Fprintf(w, "Next steps:\n")
+	if !hasWeights {
+		fmt.Fprintf(w, "\t- set the pixel weights:\n\t\tphygeo geo weights --set <value>=<weight> %s\n", pFile)
+	}
+	fmt.Fprintf(w, "\t- add the trees:\n\t\tphygeo tree add %s <tree-file>\n", pFile)
+	fmt.Fprintf(w, "\t- add the ranges of the terminals:\n\t\tphygeo range add %s <range-file>\n", pFile)
+	fmt.Fprintf(w, "\t- check the project:\n\t\tphygeo prj info %s\n", pFile)
+	fmt.Fprintf(w, "\t- search the best lambda value:\n\t\tphygeo diff ml %s\n", pFile)
+}
+
+func initWeightsName(pFile string) string {
+	ext := filepath.Ext(pFile)
+	return strings.TrimSuffix(pFile, ext) + "-pix-weights.tab"
+}
+
+func writeInitWeights(name string, pw pixweight.Pixel) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	fmt.Fprintf(f, "# phygeo: %s\n", version.String())
+	if err := pw.TSV(f); err != nil {
+		return fmt.Errorf("while writing to %q: %v", name, err)
+	}
+	return nil
+}
+
+func readInitLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readInitTotal(name string) (*model.Total, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tot, err := model.ReadTotal(f, nil, false)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tot, nil
+}
+
+func cmpInitStages(st1, st2 []int64) error {
+	if len(st1) > len(st2) {
+		st1 = st1[:len(st2)]
+	}
+	if len(st2) > len(st1) {
+		st2 = st2[:len(st1)]
+	}
+
+	if !reflect.DeepEqual(st1, st2) {
+		return fmt.Errorf("got %v stages, want %v", st1, st2)
+	}
+	return nil
+}
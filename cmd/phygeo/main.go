@@ -25,6 +25,11 @@ func init() {
 	app.Add(rangecmd.Command)
 	app.Add(prj.Command)
 	app.Add(tree.Command)
+
+	app.Add(docsCommand)
+	app.Add(initCommand)
+	app.Add(concatCommand)
+	app.Add(versionCommand)
 }
 
 func main() {
@@ -0,0 +1,131 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package exportjson implements a command to export
+// a PhyGeo project as a JSON file.
+package exportjson
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/phygeo/version"
+)
+
+var Command = &command.Command{
+	Usage: "export-json [-o|--output <file>] <project-file>",
+	Short: "export a project as a JSON file",
+	Long: `
+Command export-json reads a PhyGeo project and writes it as a JSON file, so it
+can be used by external programs.
+
+The argument of the command is the name of the project file.
+
+The paths of all the datasets of the project will be exported. If the project
+has pixel weights, or time stages, their values will be included in the JSON
+file. See "phygeo help prj json-schema" for a description of the JSON file.
+
+By default, the output is printed in the standard output. Use the flag
+--output, or -o, to define an output file.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var output string
+
+func setFlags(c *command.Command) {
+	c.Flags().StringVar(&output, "output", "", "")
+	c.Flags().StringVar(&output, "o", "", "")
+}
+
+func run(c *command.Command, args []string) (err error) {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	j := p.JSON()
+	j.PhyGeo = version.String()
+
+	if pwF := p.Path(project.PixWeight); pwF != "" {
+		pw, err := readPixWeights(pwF)
+		if err != nil {
+			return err
+		}
+		for _, v := range pw.Values() {
+			j.PixWeights = append(j.PixWeights, project.JSONWeight{
+				Value:  v,
+				Weight: pw.Weight(v),
+			})
+		}
+	}
+
+	if stF := p.Path(project.Stages); stF != "" {
+		st, err := readStages(stF)
+		if err != nil {
+			return err
+		}
+		j.Stages = st.Stages()
+	}
+
+	w := c.Stdout()
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			e := f.Close()
+			if err == nil && e != nil {
+				err = e
+			}
+		}()
+		w = f
+	}
+	if err := j.Encode(w); err != nil {
+		if output != "" {
+			return fmt.Errorf("while writing data on %q: %v", output, err)
+		}
+		return err
+	}
+	return nil
+}
+
+func readPixWeights(name string) (pixweight.Pixel, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pw, err := pixweight.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return pw, nil
+}
+
+func readStages(name string) (timestage.Stages, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := timestage.Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+	return st, nil
+}
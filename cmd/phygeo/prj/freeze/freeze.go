@@ -0,0 +1,72 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package freeze implements a command to store
+// the checksums of the datasets of a project.
+package freeze
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/phygeo/project"
+)
+
+var Command = &command.Command{
+	Usage: "freeze [--off] [--wait <seconds>] <project-file>",
+	Short: "store the checksums of the project datasets",
+	Long: `
+Command freeze reads a PhyGeo project and stores the SHA-256 checksum of each
+dataset file in the project file. When a project with checksums is read, the
+dataset files are checked, and if a file was modified outside PhyGeo (for
+example, edited by hand, or replaced by another program), the command will
+fail with an error, so an analysis will never use a dataset different from the
+one recorded in the project.
+
+The argument of the command is the name of the project file.
+
+When a PhyGeo command modifies a dataset of a project with checksums, the
+checksums are updated automatically. If a file was modified intentionally
+outside PhyGeo, use the command "phygeo prj update-checksums" to accept the
+changes.
+
+Checksums are only stored for the datasets used by the analysis (i.e., datasets
+at alternative resolutions are not checked).
+
+If the flag --off is given, the checksums will be removed from the project.
+
+While the checksums are stored, the project is locked. If the project is locked
+by another process, the command fails. Use the flag --wait to set the maximum
+time, in seconds, to wait until the lock is released.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var offFlag bool
+var waitFlag float64
+
+func setFlags(c *command.Command) {
+	c.Flags().BoolVar(&offFlag, "off", false, "")
+	c.Flags().Float64Var(&waitFlag, "wait", 0, "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	pFile := args[0]
+	wait := time.Duration(waitFlag * float64(time.Second))
+	return project.Update(pFile, wait, func(p *project.Project) error {
+		if offFlag {
+			p.Unfreeze()
+			return nil
+		}
+		if err := p.Freeze(); err != nil {
+			return fmt.Errorf("on project %q: %v", pFile, err)
+		}
+		return nil
+	})
+}
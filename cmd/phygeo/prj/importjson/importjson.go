@@ -0,0 +1,179 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package importjson implements a command to create
+// a PhyGeo project from a JSON file.
+package importjson
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/timestage"
+)
+
+var Command = &command.Command{
+	Usage: "import-json [--force] [-i|--input <file>] <project-file>",
+	Short: "create a project from a JSON file",
+	Long: `
+Command import-json reads a JSON file with the definition of a PhyGeo project
+(for example, one created by an external program), and writes it as a PhyGeo
+project file.
+
+The argument of the command is the name of the project file. The project file
+must not exist.
+
+By default, the JSON file is read from the standard input. Use the flag
+--input, or -i, to read from a file. See "phygeo help prj json-schema" for a
+description of the JSON file.
+
+If the JSON file includes pixel weights, or time stages, they will be written
+in the paths of the "pixweight" and "stages" datasets of the project. If these
+paths are not defined, the files "pix-weights.tab" and "stages.tab" will be
+used. If any of these files already exists, the command will fail without
+writing any file. Use the flag --force to overwrite the existing files.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var forceFlag bool
+var input string
+
+func setFlags(c *command.Command) {
+	c.Flags().BoolVar(&forceFlag, "force", false, "")
+	c.Flags().StringVar(&input, "input", "", "")
+	c.Flags().StringVar(&input, "i", "", "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	j, err := readJSON(c.Stdin())
+	if err != nil {
+		return err
+	}
+	return project.Create(args[0], func() (*project.Project, error) {
+		return jsonProject(j)
+	})
+}
+
+// JSONProject builds a project from a JSON file,
+// and writes its pixel weights
+// and time stages.
+func jsonProject(j *project.JSON) (*project.Project, error) {
+	p, err := j.Project()
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", inName(), err)
+	}
+
+	var pw pixweight.Pixel
+	if len(j.PixWeights) > 0 {
+		pw = pixweight.New()
+		for _, w := range j.PixWeights {
+			if err := pw.Set(w.Value, w.Weight); err != nil {
+				return nil, fmt.Errorf("on file %q: pixweights: value %d: %v", inName(), w.Value, err)
+			}
+		}
+		if p.Path(project.PixWeight) == "" {
+			p.Add(project.PixWeight, "pix-weights.tab")
+		}
+	}
+
+	var st timestage.Stages
+	if len(j.Stages) > 0 {
+		st = timestage.New()
+		for _, a := range j.Stages {
+			if a < 0 {
+				return nil, fmt.Errorf("on file %q: stages: invalid age %d", inName(), a)
+			}
+			st.AddStage(a)
+		}
+		if p.Path(project.Stages) == "" {
+			p.Add(project.Stages, "stages.tab")
+		}
+	}
+
+	var files []file
+	if pw != nil {
+		files = append(files, file{p.Path(project.PixWeight), pw.TSV})
+	}
+	if st != nil {
+		files = append(files, file{p.Path(project.Stages), st.Write})
+	}
+
+	// check the files before writing them,
+	// so no file is written
+	// if any of them exists
+	if !forceFlag {
+		for _, f := range files {
+			if _, err := os.Stat(f.name); err == nil {
+				return nil, fmt.Errorf("file %q already exists (use --force to overwrite it)", f.name)
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+		}
+	}
+	for _, f := range files {
+		if err := writeFile(f.name, f.write); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// A file is a file written with the project.
+type file struct {
+	name  string
+	write func(io.Writer) error
+}
+
+func inName() string {
+	if input == "" {
+		return "stdin"
+	}
+	return input
+}
+
+func readJSON(r io.Reader) (*project.JSON, error) {
+	if input != "" {
+		f, err := os.Open(input)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	j, err := project.ReadJSON(r)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", inName(), err)
+	}
+	return j, nil
+}
+
+func writeFile(name string, write func(io.Writer) error) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	if err := write(f); err != nil {
+		return fmt.Errorf("while writing to %q: %v", name, err)
+	}
+	return nil
+}
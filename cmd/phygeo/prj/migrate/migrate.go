@@ -0,0 +1,425 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package migrate implements a command to upgrade
+// projects created with older versions of PhyGeo.
+package migrate
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/ranges"
+)
+
+var Command = &command.Command{
+	Usage: "migrate [--dry-run] [--wait <seconds>] <project-file>",
+	Short: "upgrade a project from an older version",
+	Long: `
+Command migrate reads a PhyGeo project created with an older version of
+PhyGeo, and upgrades the project file, and the dataset files, to the current
+formats, so they can be used by the current commands.
+
+The argument of the command is the name of the project file.
+
+The following deprecated dataset keywords are replaced:
+
+	points   replaced by "ranges"
+	timepix  replaced by "landscape"
+	geomod   replaced by "geomotion"
+
+The files of the presence points of the taxa (the old "points" dataset) are
+upgraded to the current format of distribution ranges. Older files are
+tab-delimited files without the "type" and "density" columns, with the
+columns "taxon", "equator", and "pixel", or with the columns "taxon",
+"latitude", and "longitude" (in that case, the pixelation of the landscape is
+used). In both cases, the "age" column is optional (if not given, the age
+will be 0).
+
+The files are upgraded in place. Before any file is modified, a backup of
+each file to be modified is made, using the same name with the ".bak"
+extension. If a backup file already exists, the command will fail without
+modifying any file.
+
+For each upgraded dataset, the dataset and the upgraded file are printed in
+the standard output. If the flag --dry-run is defined, the changes will be
+printed, but the files will not be modified.
+
+While the project is upgraded, the project is locked. If the project is locked
+by another process, the command fails. Use the flag --wait to set the maximum
+time, in seconds, to wait until the lock is released.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var dryRun bool
+var waitFlag float64
+
+func setFlags(c *command.Command) {
+	c.Flags().BoolVar(&dryRun, "dry-run", false, "")
+	c.Flags().Float64Var(&waitFlag, "wait", 0, "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	pFile := args[0]
+
+	// The project is read without checking
+	// deprecated datasets or checksums.
+	wait := time.Duration(waitFlag * float64(time.Second))
+	return project.Repair(pFile, wait, func(p *project.Project) error {
+		dep := p.Deprecated()
+		if err := p.Migrate(); err != nil {
+			return fmt.Errorf("on project %q: %v", pFile, err)
+		}
+		for _, s := range dep {
+			r, _ := project.Replacement(s)
+			fmt.Fprintf(c.Stdout(), "%s\t%s\treplaced by %q\n", s, pFile, r)
+		}
+
+		var points []rangeFile
+		if rf := p.Path(project.Ranges); rf != "" {
+			points = append(points, rangeFile{
+				path:      rf,
+				landscape: p.Path(project.Landscape),
+			})
+		}
+		for _, eq := range p.Equators() {
+			rf := p.Scaled(project.Ranges, eq)
+			if rf == "" {
+				continue
+			}
+			points = append(points, rangeFile{
+				path:      rf,
+				landscape: p.Scaled(project.Landscape, eq),
+			})
+		}
+
+		var upgrade []rangeFile
+		for _, rf := range points {
+			if slices.ContainsFunc(upgrade, func(u rangeFile) bool { return u.path == rf.path }) {
+				continue
+			}
+			ok, err := isLegacyPoints(rf.path)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			upgrade = append(upgrade, rf)
+			fmt.Fprintf(c.Stdout(), "%s\t%s\tupgraded to range format\n", project.Ranges, rf.path)
+		}
+
+		if len(dep) == 0 && len(upgrade) == 0 {
+			fmt.Fprintf(c.Stdout(), "project %q is up to date\n", pFile)
+			return project.SkipWrite
+		}
+		if dryRun {
+			return project.SkipWrite
+		}
+
+		// backups are made before any file is modified
+		var files []string
+		for _, rf := range upgrade {
+			files = append(files, rf.path)
+		}
+		writeProject := len(dep) > 0 || p.Frozen()
+		if writeProject {
+			files = append(files, pFile)
+		}
+		if err := backupAll(files); err != nil {
+			return err
+		}
+
+		for _, rf := range upgrade {
+			if err := upgradePoints(rf); err != nil {
+				return err
+			}
+			if rf.path == p.Path(project.Ranges) {
+				p.Add(project.Ranges, rf.path)
+			}
+		}
+
+		if !writeProject {
+			return project.SkipWrite
+		}
+		return nil
+	})
+}
+
+// A rangeFile is a file of distribution ranges
+// and the landscape file
+// at the same resolution.
+type rangeFile struct {
+	path      string
+	landscape string
+}
+
+// IsLegacyPoints returns true
+// if a file of distribution ranges
+// uses the format of the old points files.
+func isLegacyPoints(name string) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	tsv := csv.NewReader(f)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return false, fmt.Errorf("on file %q: while reading header: %v", name, err)
+	}
+	fields := make(map[string]bool, len(head))
+	for _, h := range head {
+		fields[strings.ToLower(h)] = true
+	}
+	if fields["type"] && fields["density"] {
+		return false, nil
+	}
+	if !fields["taxon"] {
+		return false, fmt.Errorf("on file %q: expecting field %q", name, "taxon")
+	}
+	if fields["equator"] && fields["pixel"] {
+		return true, nil
+	}
+	if fields["latitude"] && fields["longitude"] {
+		return true, nil
+	}
+	return false, fmt.Errorf("on file %q: unknown format of distribution ranges", name)
+}
+
+func upgradePoints(rf rangeFile) error {
+	f, err := os.Open(rf.path)
+	if err != nil {
+		return err
+	}
+	coll, err := readLegacyPoints(f, rf.landscape)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("on file %q: %v", rf.path, err)
+	}
+
+	if err := writeRanges(rf.path, coll); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReadLegacyPoints reads a file of presence points
+// in the format used by older versions of PhyGeo.
+func readLegacyPoints(r io.Reader, landscape string) (*ranges.Collection, error) {
+	tsv := csv.NewReader(r)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	_, usePix := fields["pixel"]
+
+	var pix *earth.Pixelation
+	if !usePix {
+		if landscape == "" {
+			return nil, errors.New("landscape undefined: required to pixelate geographic coordinates")
+		}
+		tp, err := readLandscape(landscape)
+		if err != nil {
+			return nil, err
+		}
+		pix = tp.Pixelation()
+	}
+
+	var coll *ranges.Collection
+	if pix != nil {
+		coll = ranges.New(pix)
+	}
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "taxon"
+		tax := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if tax == "" {
+			continue
+		}
+
+		var age int64
+		f = "age"
+		if i, ok := fields[f]; ok && strings.TrimSpace(row[i]) != "" {
+			age, err = strconv.ParseInt(strings.TrimSpace(row[i]), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+			}
+		}
+		if coll != nil && coll.HasTaxon(tax) && coll.Age(tax) != age {
+			return nil, fmt.Errorf("on row %d: field %q: invalid age: got %d, want %d", ln, f, age, coll.Age(tax))
+		}
+
+		if !usePix {
+			f = "latitude"
+			lat, err := strconv.ParseFloat(row[fields[f]], 64)
+			if err != nil {
+				return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+			}
+			if lat < -90 || lat > 90 {
+				return nil, fmt.Errorf("on row %d: field %q: invalid latitude %.6f", ln, f, lat)
+			}
+
+			f = "longitude"
+			lon, err := strconv.ParseFloat(row[fields[f]], 64)
+			if err != nil {
+				return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+			}
+			if lon < -180 || lon > 180 {
+				return nil, fmt.Errorf("on row %d: field %q: invalid longitude %.6f", ln, f, lon)
+			}
+			coll.Add(tax, age, lat, lon)
+			continue
+		}
+
+		f = "equator"
+		eq, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if pix == nil {
+			pix = earth.NewPixelation(eq)
+			coll = ranges.New(pix)
+		}
+		if pix.Equator() != eq {
+			return nil, fmt.Errorf("on row %d: field %q: got %d, want %d", ln, f, eq, pix.Equator())
+		}
+
+		f = "pixel"
+		px, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if px < 0 || px >= pix.Len() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, px)
+		}
+		coll.AddPixel(tax, age, px)
+	}
+	if coll == nil {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+	return coll, nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func writeRanges(name string, coll *ranges.Collection) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	if err := coll.TSV(f); err != nil {
+		return fmt.Errorf("while writing to %q: %v", name, err)
+	}
+	return nil
+}
+
+// BackupAll makes a backup
+// of each file.
+// It fails without making any backup
+// if a backup file already exists.
+func backupAll(files []string) error {
+	for _, name := range files {
+		bak := name + ".bak"
+		if _, err := os.Stat(bak); err == nil {
+			return fmt.Errorf("backup file %q already exists", bak)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	for _, name := range files {
+		if err := backup(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Backup copies a file
+// into a file with the same name
+// and the ".bak" extension.
+func backup(name string) (err error) {
+	bak := name + ".bak"
+	out, err := os.OpenFile(bak, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("backup file %q already exists", bak)
+		}
+		return err
+	}
+	defer func() {
+		e := out.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("while writing backup %q: %v", bak, err)
+	}
+	return nil
+}
@@ -2,265 +2,154 @@
 // All rights reserved.
 // Distributed under BSD2 license that can be found in the LICENSE file.
 
-// Package prj implements a command to print
-// the basic information of a project.
+// Package prj is a metapackage for commands
+// that dealt with PhyGeo project files.
 package prj
 
 import (
-	"fmt"
-	"io"
-	"math"
-	"os"
+	"errors"
+	"strings"
 
 	"github.com/js-arias/command"
-	"github.com/js-arias/earth"
-	"github.com/js-arias/earth/model"
-	"github.com/js-arias/earth/stat/pixweight"
-	"github.com/js-arias/phygeo/project"
-	"github.com/js-arias/phygeo/timestage"
-	"github.com/js-arias/ranges"
-	"github.com/js-arias/timetree"
+	"github.com/js-arias/phygeo/cmd/phygeo/prj/exportjson"
+	"github.com/js-arias/phygeo/cmd/phygeo/prj/freeze"
+	"github.com/js-arias/phygeo/cmd/phygeo/prj/importjson"
+	"github.com/js-arias/phygeo/cmd/phygeo/prj/info"
+	"github.com/js-arias/phygeo/cmd/phygeo/prj/migrate"
+	"github.com/js-arias/phygeo/cmd/phygeo/prj/scale"
+	"github.com/js-arias/phygeo/cmd/phygeo/prj/updatesums"
 )
 
 var Command = &command.Command{
-	Usage: "prj <project-file>",
-	Short: "print information about a project",
+	Usage: "prj <command> [<argument>...]",
+	Short: "commands for PhyGeo project files",
 	Long: `
-Command prj reads a PhyGeo project and prints the information of the different
-project elements into the standard output.
-
-The argument of the command is the name of the project file.
+If the first argument is not a command, it is taken as the name of a project
+file, and the command info is run, so 'phygeo prj <project-file>' is the same
+as 'phygeo prj info <project-file>'.
 	`,
-	Run: run,
 }
 
-func run(c *command.Command, args []string) error {
-	if len(args) < 1 {
-		return c.UsageError("expecting project file")
-	}
-
-	p, err := project.Read(args[0])
-	if err != nil {
-		return err
-	}
-
-	var pix *earth.Pixelation
-
-	stages := timestage.New()
-
-	rotF := p.Path(project.GeoMotion)
-	if rotF != "" {
-		pix, err = readRotation(c.Stdout(), rotF, stages)
-		if err != nil {
-			return err
-		}
-	}
-
-	lsF := p.Path(project.Landscape)
-	if lsF != "" {
-		pix, err = readLandscape(c.Stdout(), lsF, pix, stages)
-		if err != nil {
-			return err
-		}
-	}
-
-	stF := p.Path(project.Stages)
-	if err := readTimeStages(c.Stdout(), stF, stages); err != nil {
-		return err
-	}
-
-	pwF := p.Path(project.PixWeight)
-	if pwF != "" {
-		if err := readPixWeights(c.Stdout(), pwF); err != nil {
-			return err
-		}
-	}
-
-	ptR := p.Path(project.Ranges)
-	if ptR != "" {
-		if err := readRanges(c.Stdout(), ptR, pix, project.Ranges); err != nil {
-			return err
-		}
-	}
-
-	tF := p.Path(project.Trees)
-	if tF != "" {
-		if err := readTrees(c.Stdout(), tF); err != nil {
-			return err
-		}
-	}
-
-	return nil
+// Commands are the children commands of prj,
+// including the help topics.
+var commands = []*command.Command{
+	exportjson.Command,
+	freeze.Command,
+	importjson.Command,
+	info.Command,
+	migrate.Command,
+	scale.Command,
+	updatesums.Command,
+
+	// help topics
+	jsonSchemaGuide,
 }
 
-func readRotation(w io.Writer, name string, st timestage.Stages) (*earth.Pixelation, error) {
-	f, err := os.Open(name)
-	if err != nil {
-		return nil, err
+func init() {
+	Command.Run = run
+	for _, c := range commands {
+		Command.Add(c)
 	}
-	defer f.Close()
-
-	rot, err := model.ReadTotal(f, nil, false)
-	if err != nil {
-		return nil, fmt.Errorf("on file %q: %v", name, err)
-	}
-	pix := rot.Pixelation()
-
-	fmt.Fprintf(w, "Plate motion model:\n")
-	fmt.Fprintf(w, "\tfile: %s\n", name)
-	fmt.Fprintf(w, "\tpixelation: e%d\n", pix.Equator())
-
-	st.Add(rot)
-	stages := rot.Stages()
-	min := float64(stages[0]) / timestage.MillionYears
-	max := float64(stages[len(stages)-1]) / timestage.MillionYears
-	fmt.Fprintf(w, "\tstages: %d [%.3f-%.3f Ma]\n", len(stages), min, max)
-	fmt.Fprintf(w, "\n")
-
-	return pix, nil
 }
 
-func readLandscape(w io.Writer, name string, pix *earth.Pixelation, st timestage.Stages) (*earth.Pixelation, error) {
-	f, err := os.Open(name)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	tp, err := model.ReadTimePix(f, pix)
-	if err != nil {
-		return nil, fmt.Errorf("on file %q: %v", name, err)
-	}
-	if pix == nil {
-		pix = tp.Pixelation()
-	}
-
-	fmt.Fprintf(w, "Landscape model:\n")
-	fmt.Fprintf(w, "\tfile: %s\n", name)
-	fmt.Fprintf(w, "\tpixelation: e%d\n", pix.Equator())
-
-	st.Add(tp)
-	stages := tp.Stages()
-	min := float64(stages[0]) / timestage.MillionYears
-	max := float64(stages[len(stages)-1]) / timestage.MillionYears
-	fmt.Fprintf(w, "\tstages: %d [%.3f-%.3f Ma]\n", len(stages), min, max)
-	fmt.Fprintf(w, "\n")
-
-	return pix, nil
+// Run runs the prj command.
+// If the first argument is a command
+// (or a help request),
+// the command is run.
+// Otherwise,
+// for compatibility with older versions,
+// the arguments are taken as the arguments
+// of the info command.
+func run(c *command.Command, args []string) error {
+	if len(args) == 0 || isCommand(args[0]) {
+		// a command with a Run function
+		// does not run its children
+		// so they are run
+		// with Run removed
+		c.Run = nil
+		defer func() { c.Run = run }()
+		return childError(c.Execute(args))
+	}
+	return childError(info.Command.Execute(args))
 }
 
-func readTimeStages(w io.Writer, name string, stages timestage.Stages) error {
-	fmt.Fprintf(w, "Time stages:\n")
-
-	if name != "" {
-		fmt.Fprintf(w, "\tfile: %s\n", name)
-
-		f, err := os.Open(name)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-
-		st, err := timestage.Read(f)
-		if err != nil {
-			return fmt.Errorf("on file %q: %v", name, err)
+// IsCommand returns true
+// if the name is the name of a children command,
+// or a help request.
+func isCommand(name string) bool {
+	name = strings.ToLower(name)
+	if name == "help" {
+		return true
+	}
+	for _, c := range commands {
+		if strings.ToLower(strings.Fields(c.Usage)[0]) == name {
+			return true
 		}
-		stages.Add(st)
 	}
-
-	st := stages.Stages()
-	min := float64(st[0]) / timestage.MillionYears
-	max := float64(st[len(st)-1]) / timestage.MillionYears
-	fmt.Fprintf(w, "\tstages: %d [%.3f-%.3f Ma]\n", len(stages), min, max)
-	fmt.Fprintf(w, "\n")
-
-	return nil
+	return false
 }
 
-func readPixWeights(w io.Writer, name string) error {
-	f, err := os.Open(name)
-	if err != nil {
+// ChildError removes the name of prj
+// from an error returned by a children command,
+// as it will be added again
+// when the error is returned by prj.
+func childError(err error) error {
+	if err == nil || errors.Is(err, Command.UsageError("")) {
 		return err
 	}
-	defer f.Close()
-
-	pw, err := pixweight.ReadTSV(f)
-	if err != nil {
-		return fmt.Errorf("when reading %q: %v", name, err)
+	msg := err.Error()
+	if i := strings.Index(msg, " prj "); i >= 0 {
+		msg = msg[i+len(" prj "):]
 	}
-
-	fmt.Fprintf(w, "Pixel weights:\n")
-	fmt.Fprintf(w, "\tfile: %s\n", name)
-	fmt.Fprintf(w, "\tdefined pixel types: %d\n", len(pw.Values()))
-	fmt.Fprintf(w, "\n")
-
-	return nil
+	return errors.New(msg)
 }
 
-func readRanges(w io.Writer, name string, pix *earth.Pixelation, tp project.Dataset) error {
-	f, err := os.Open(name)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	coll, err := ranges.ReadTSV(f, pix)
-	if err != nil {
-		return fmt.Errorf("when reading %q: %v", name, err)
-	}
-
-	fmt.Fprintf(w, "Terminal %s:\n", tp)
-	fmt.Fprintf(w, "\tfile: %s\n", name)
-	fmt.Fprintf(w, "\tdefined taxa: %d\n", len(coll.Taxa()))
-	fmt.Fprintf(w, "\n")
-
-	return nil
-}
-
-func readTrees(w io.Writer, name string) error {
-	f, err := os.Open(name)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	c, err := timetree.ReadTSV(f)
-	if err != nil {
-		return fmt.Errorf("while reading file %q: %v", name, err)
-	}
-
-	fmt.Fprintf(w, "Trees:\n")
-	fmt.Fprintf(w, "\tfile: %s\n", name)
-
-	terms := make(map[string]bool)
-	min := math.MaxFloat64
-	var max float64
-	for _, tn := range c.Names() {
-		t := c.Tree(tn)
-		if t == nil {
-			continue
-		}
-		ra := float64(t.Age(t.Root())) / timestage.MillionYears
-		if ra > max {
-			max = ra
-		}
-
-		for _, tax := range t.Terms() {
-			terms[tax] = true
-			id, ok := t.TaxNode(tax)
-			if !ok {
-				continue
-			}
-			ta := float64(t.Age(id)) / timestage.MillionYears
-			if ta < min {
-				min = ta
-			}
-		}
-	}
-	fmt.Fprintf(w, "\ttrees: %d\n", len(c.Names()))
-	fmt.Fprintf(w, "\tterminals: %d\n", len(terms))
-	fmt.Fprintf(w, "\tage range: %.3f-%.3f Ma\n", min, max)
-	fmt.Fprintf(w, "\n")
-
-	return nil
+var jsonSchemaGuide = &command.Command{
+	Usage: "json-schema",
+	Short: "about the JSON schema of projects",
+	Long: `
+A PhyGeo project can be exported to, or imported from, a JSON file, so
+external programs (for example, R or Julia scripts, or a graphical interface)
+can create and read PhyGeo projects. The JSON file is an object with the
+following fields:
+
+	-schema      the identifier of the schema. The current schema is
+	             "phygeo-project/1".
+	-phygeo      the version of PhyGeo that created the file (optional).
+	-datasets    an object with the path of each dataset of the project,
+	             using the dataset keyword (for example "trees" or
+	             "landscape") as key.
+	-scaled      an object with the paths of the datasets at alternative
+	             resolutions (optional). The key is the number of pixels at
+	             the equator, and the value an object with the path of each
+	             dataset, as in the field "datasets".
+	-pixweights  an array with the pixel weights of the project (optional).
+	             Each element is an object with the fields "value" (a
+	             landscape value) and "weight" (the weight of the value,
+	             between 0 and 1).
+	-stages      an array with the time stages of the project, in years
+	             (optional).
+
+Here is an example file:
+
+	{
+		"schema": "phygeo-project/1",
+		"phygeo": "v0.1.0",
+		"datasets": {
+			"geomotion": "geo-motion.tab",
+			"landscape": "landscape.tab",
+			"pixweight": "pix-weights.tab",
+			"ranges": "ranges.tab",
+			"trees": "trees.tab"
+		},
+		"pixweights": [
+			{"value": 0, "weight": 0},
+			{"value": 1, "weight": 1}
+		]
+	}
+
+Large datasets (the trees, the ranges, the landscape, and the plate motion
+model) are only referenced by their paths, while the parameters of the
+analysis (the pixel weights and the time stages) are included in the file.
+	`,
 }
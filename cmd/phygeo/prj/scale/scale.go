@@ -0,0 +1,525 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package scale implements a command to manage
+// the resolutions of the models
+// of a PhyGeo project.
+package scale
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/agerange"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/ranges"
+)
+
+var Command = &command.Command{
+	Usage: `scale [--equator <value>] [--use <value>]
+	[--wait <seconds>] <project>`,
+	Short: "manage model resolutions",
+	Long: `
+Command scale manages the resolutions (i.e., the number of pixels at the
+equator) of the datasets of a PhyGeo project, so exploratory runs can be done
+using a low resolution, and the final runs using the full resolution, while
+using the same project.
+
+The argument of the command is the name of the project file.
+
+By default, the command will print the resolution used by the project, and the
+alternative resolutions defined in the project, with the datasets defined for
+each resolution.
+
+Use the flag --equator to define a new resolution, with the number of pixels
+at the equator. The resolution must be lower than the resolution used by the
+project. The command will build lower-resolution versions of the plate motion
+model, the landscape model, the geographic ranges, and the age-specific
+ranges defined in the project, and register them in the project. The new
+files will be named after the original files, adding the suffix "-e<value>"
+before the extension. To reassign the pixels, each pixel of the new
+resolution will take the most common value of the pixels of the original
+resolution that fall inside it (i.e., a majority vote). In the plate motion
+model, the value is the plate of the pixel; in the landscape model, it is the
+landscape feature, with ties resolved by choosing the largest value. In the
+range maps, a pixel will be present if any of the original pixels is present,
+and for continuous ranges, the largest value will be used.
+
+Use the flag --use to switch the datasets used by the project with the
+datasets of another resolution registered in the project. The datasets used
+before the switch will be kept as an alternative resolution, so it is possible
+to go back at any moment.
+
+While the datasets are built, or switched, the project is locked. If the
+project is locked by another process, the command fails. Use the flag --wait to
+set the maximum time, in seconds, to wait until the lock is released.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var eqFlag int
+var useFlag int
+var waitFlag float64
+
+func setFlags(c *command.Command) {
+	c.Flags().IntVar(&eqFlag, "equator", 0, "")
+	c.Flags().IntVar(&useFlag, "use", 0, "")
+	c.Flags().Float64Var(&waitFlag, "wait", 0, "")
+}
+
+// Datasets that depend on the pixelation.
+var pixSets = []project.Dataset{
+	project.GeoMotion,
+	project.Landscape,
+	project.Ranges,
+	project.AgeRanges,
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if eqFlag != 0 && useFlag != 0 {
+		return c.UsageError("flags --equator and --use are mutually exclusive")
+	}
+
+	pFile := args[0]
+	if eqFlag == 0 && useFlag == 0 {
+		p, err := project.Read(pFile)
+		if err != nil {
+			return err
+		}
+		cur, err := projectEquator(p)
+		if err != nil {
+			return err
+		}
+		printResolutions(c.Stdout(), p, cur)
+		return nil
+	}
+
+	wait := time.Duration(waitFlag * float64(time.Second))
+	return project.Update(pFile, wait, func(p *project.Project) error {
+		cur, err := projectEquator(p)
+		if err != nil {
+			return err
+		}
+
+		if useFlag != 0 {
+			return useResolution(p, cur, useFlag)
+		}
+
+		if eqFlag < 0 || eqFlag >= cur {
+			return fmt.Errorf("flag --equator: invalid value %d: must be lower than %d", eqFlag, cur)
+		}
+		return scaleProject(p, eqFlag)
+	})
+}
+
+// ProjectEquator returns the number of pixels at the equator
+// of the datasets currently used by the project.
+func projectEquator(p *project.Project) (int, error) {
+	if name := p.Path(project.GeoMotion); name != "" {
+		rec, err := readRecons(name)
+		if err != nil {
+			return 0, err
+		}
+		return rec.Pixelation().Equator(), nil
+	}
+	if name := p.Path(project.Landscape); name != "" {
+		tp, err := readLandscape(name)
+		if err != nil {
+			return 0, err
+		}
+		return tp.Pixelation().Equator(), nil
+	}
+	return 0, fmt.Errorf("undefined %s or %s in the project", project.GeoMotion, project.Landscape)
+}
+
+func printResolutions(w io.Writer, p *project.Project, cur int) {
+	fmt.Fprintf(w, "current: %d\n", cur)
+	for _, eq := range p.Equators() {
+		fmt.Fprintf(w, "e%d:", eq)
+		for _, s := range pixSets {
+			if name := p.Scaled(s, eq); name != "" {
+				fmt.Fprintf(w, "\t%s:%s", s, name)
+			}
+		}
+		fmt.Fprintf(w, "\n")
+	}
+}
+
+// UseResolution switches the datasets of the project
+// with the datasets at the given resolution.
+func useResolution(p *project.Project, cur, eq int) error {
+	if eq == cur {
+		return nil
+	}
+	for _, s := range pixSets {
+		if p.Path(s) == "" {
+			continue
+		}
+		if p.Scaled(s, eq) == "" {
+			return fmt.Errorf("flag --use: dataset %q undefined at equator %d", s, eq)
+		}
+	}
+
+	for _, s := range pixSets {
+		name := p.Scaled(s, eq)
+		if name == "" {
+			continue
+		}
+		prev := p.Add(s, name)
+		p.AddScaled(s, cur, prev)
+		p.AddScaled(s, eq, "")
+	}
+	return nil
+}
+
+// ScaleProject builds the lower-resolution versions
+// of the datasets of a project.
+func scaleProject(p *project.Project, eq int) error {
+	pix := earth.NewPixelation(eq)
+
+	if name := p.Path(project.GeoMotion); name != "" {
+		rec, err := readRecons(name)
+		if err != nil {
+			return err
+		}
+		sr := scaleRecons(rec, pix)
+		out := scaledName(name, eq)
+		if err := writeTSV(out, sr.TSV); err != nil {
+			return err
+		}
+		p.AddScaled(project.GeoMotion, eq, out)
+	}
+
+	if name := p.Path(project.Landscape); name != "" {
+		tp, err := readLandscape(name)
+		if err != nil {
+			return err
+		}
+		if tp.Pixelation().Equator() <= eq {
+			return fmt.Errorf("landscape %q: equator %d is not larger than %d", name, tp.Pixelation().Equator(), eq)
+		}
+		st := scaleLandscape(tp, pix)
+		out := scaledName(name, eq)
+		if err := writeTSV(out, st.TSV); err != nil {
+			return err
+		}
+		p.AddScaled(project.Landscape, eq, out)
+	}
+
+	if name := p.Path(project.Ranges); name != "" {
+		coll, err := readRanges(name)
+		if err != nil {
+			return err
+		}
+		if coll.Pixelation().Equator() <= eq {
+			return fmt.Errorf("ranges %q: equator %d is not larger than %d", name, coll.Pixelation().Equator(), eq)
+		}
+		sc := scaleRanges(coll, pix)
+		out := scaledName(name, eq)
+		if err := writeTSV(out, sc.TSV); err != nil {
+			return err
+		}
+		p.AddScaled(project.Ranges, eq, out)
+	}
+
+	if name := p.Path(project.AgeRanges); name != "" {
+		coll, err := readAgeRanges(name)
+		if err != nil {
+			return err
+		}
+		if coll.Pixelation().Equator() <= eq {
+			return fmt.Errorf("age ranges %q: equator %d is not larger than %d", name, coll.Pixelation().Equator(), eq)
+		}
+		sc := scaleAgeRanges(coll, pix)
+		out := scaledName(name, eq)
+		if err := writeTSV(out, sc.TSV); err != nil {
+			return err
+		}
+		p.AddScaled(project.AgeRanges, eq, out)
+	}
+
+	return nil
+}
+
+// ScaledName returns the name of the file
+// of a dataset at a given resolution.
+func scaledName(name string, eq int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s-e%d%s", strings.TrimSuffix(name, ext), eq, ext)
+}
+
+// PixMap returns the pixel of the destination pixelation
+// for each pixel of the source pixelation.
+func pixMap(src, dst *earth.Pixelation) []int {
+	m := make([]int, src.Len())
+	for id := range m {
+		pt := src.ID(id).Point()
+		m[id] = dst.Pixel(pt.Latitude(), pt.Longitude()).ID()
+	}
+	return m
+}
+
+// ScaleRecons reassigns the pixels of a plate motion model
+// to a lower resolution pixelation.
+// Each pixel is assigned to the most common plate
+// of the source pixels.
+func scaleRecons(rec *model.Recons, pix *earth.Pixelation) *model.Recons {
+	toDst := pixMap(rec.Pixelation(), pix)
+
+	// plate votes for each destination pixel
+	votes := make(map[int]map[int]int)
+	for _, plate := range rec.Plates() {
+		for _, px := range rec.Pixels(plate) {
+			dp := toDst[px]
+			if votes[dp] == nil {
+				votes[dp] = make(map[int]int)
+			}
+			votes[dp][plate]++
+		}
+	}
+	plateOf := make(map[int]int, len(votes))
+	for dp, v := range votes {
+		best, max := 0, 0
+		for plate, n := range v {
+			if n > max || (n == max && plate < best) {
+				best, max = plate, n
+			}
+		}
+		plateOf[dp] = best
+	}
+
+	sr := model.NewRecons(pix)
+	for _, plate := range rec.Plates() {
+		for _, age := range rec.Stages() {
+			stage := rec.PixStage(plate, age)
+			if len(stage) == 0 {
+				continue
+			}
+			locs := make(map[int][]int)
+			for px, sp := range stage {
+				dp := toDst[px]
+				if plateOf[dp] != plate {
+					continue
+				}
+				for _, s := range sp {
+					ds := toDst[s]
+					if !slices.Contains(locs[dp], ds) {
+						locs[dp] = append(locs[dp], ds)
+					}
+				}
+			}
+			if len(locs) == 0 {
+				continue
+			}
+			for _, l := range locs {
+				slices.Sort(l)
+			}
+			sr.Add(plate, locs, age)
+		}
+	}
+	return sr
+}
+
+// ScaleLandscape reassigns the pixel values of a landscape model
+// to a lower resolution pixelation.
+// Each pixel takes the most common value
+// of the source pixels,
+// and ties are resolved using the largest value.
+func scaleLandscape(tp *model.TimePix, pix *earth.Pixelation) *model.TimePix {
+	src := tp.Pixelation()
+	toDst := pixMap(src, pix)
+	fromDst := make([][]int, pix.Len())
+	for px, dp := range toDst {
+		fromDst[dp] = append(fromDst[dp], px)
+	}
+
+	type vote struct {
+		value int
+		ok    bool
+	}
+
+	st := model.NewTimePix(pix)
+	for _, age := range tp.Stages() {
+		for dp, sp := range fromDst {
+			if len(sp) == 0 {
+				// no source pixel is inside the pixel
+				// so use the source pixel at its center
+				pt := pix.ID(dp).Point()
+				sp = []int{src.Pixel(pt.Latitude(), pt.Longitude()).ID()}
+			}
+
+			votes := make(map[vote]int)
+			for _, px := range sp {
+				v, ok := tp.At(age, px)
+				votes[vote{value: v, ok: ok}]++
+			}
+
+			var best vote
+			max := 0
+			for v, n := range votes {
+				if n < max {
+					continue
+				}
+				if n == max {
+					if v.ok != best.ok {
+						if !v.ok {
+							continue
+						}
+					} else if v.value < best.value {
+						continue
+					}
+				}
+				best, max = v, n
+			}
+			if !best.ok {
+				continue
+			}
+			st.Set(age, dp, best.value)
+		}
+	}
+	return st
+}
+
+// ScaleRanges reassigns the pixels of the ranges of a collection
+// to a lower resolution pixelation.
+func scaleRanges(coll *ranges.Collection, pix *earth.Pixelation) *ranges.Collection {
+	toDst := pixMap(coll.Pixelation(), pix)
+
+	sc := ranges.New(pix)
+	for _, tax := range coll.Taxa() {
+		rng := make(map[int]float64)
+		for px, v := range coll.Range(tax) {
+			dp := toDst[px]
+			if v > rng[dp] {
+				rng[dp] = v
+			}
+		}
+
+		if coll.Type(tax) == ranges.Points {
+			sc.SetPixels(tax, coll.Age(tax), rng)
+			continue
+		}
+		sc.Set(tax, coll.Age(tax), rng)
+	}
+	return sc
+}
+
+// ScaleAgeRanges reassigns the pixels
+// of the age-specific ranges of a collection
+// to a lower resolution pixelation.
+func scaleAgeRanges(coll *agerange.Collection, pix *earth.Pixelation) *agerange.Collection {
+	toDst := pixMap(coll.Pixelation(), pix)
+
+	sc := agerange.New(pix)
+	for _, tax := range coll.Taxa() {
+		for _, age := range coll.Ages(tax) {
+			rng := make(map[int]float64)
+			for px, v := range coll.Range(tax, age) {
+				dp := toDst[px]
+				if v > rng[dp] {
+					rng[dp] = v
+				}
+			}
+
+			if coll.Type(tax, age) == ranges.Points {
+				for px := range rng {
+					sc.AddPixel(tax, age, px)
+				}
+				continue
+			}
+			sc.Set(tax, age, rng)
+		}
+	}
+	return sc
+}
+
+func readRecons(name string) (*model.Recons, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rec, err := model.ReadReconsTSV(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return rec, nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readRanges(name string) (*ranges.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := ranges.ReadTSV(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func readAgeRanges(name string) (*agerange.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := agerange.ReadTSV(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func writeTSV(name string, tsv func(io.Writer) error) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	if err := tsv(f); err != nil {
+		return fmt.Errorf("while writing to %q: %v", name, err)
+	}
+	return nil
+}
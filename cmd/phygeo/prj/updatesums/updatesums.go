@@ -0,0 +1,73 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package updatesums implements a command to update
+// the checksums of the datasets of a project.
+package updatesums
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/phygeo/project"
+)
+
+var Command = &command.Command{
+	Usage: "update-checksums [--wait <seconds>] <project-file>",
+	Short: "update the checksums of the project datasets",
+	Long: `
+Command update-checksums reads a PhyGeo project with checksums (see "phygeo
+help prj freeze") and recalculates the SHA-256 checksum of each dataset file,
+accepting any change made to the files outside PhyGeo. For each dataset with a
+modified file, it prints the dataset and the file name in the standard output.
+
+The argument of the command is the name of the project file.
+
+While the checksums are updated, the project is locked. If the project is
+locked by another process, the command fails. Use the flag --wait to set the
+maximum time, in seconds, to wait until the lock is released.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var waitFlag float64
+
+func setFlags(c *command.Command) {
+	c.Flags().Float64Var(&waitFlag, "wait", 0, "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	pFile := args[0]
+
+	// The project is read without checking
+	// the checksums.
+	wait := time.Duration(waitFlag * float64(time.Second))
+	return project.Repair(pFile, wait, func(p *project.Project) error {
+		if !p.Frozen() {
+			msg := fmt.Sprintf("project %q without checksums: use \"phygeo prj freeze\"", pFile)
+			return c.UsageError(msg)
+		}
+
+		prev := make(map[project.Dataset]string)
+		for _, s := range p.Sets() {
+			prev[s] = p.Checksum(s)
+		}
+
+		if err := p.Freeze(); err != nil {
+			return fmt.Errorf("on project %q: %v", pFile, err)
+		}
+		for _, s := range p.Sets() {
+			if prev[s] == p.Checksum(s) {
+				continue
+			}
+			fmt.Fprintf(c.Stdout(), "%s\t%s\n", s, p.Path(s))
+		}
+		return nil
+	})
+}
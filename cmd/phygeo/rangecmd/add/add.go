@@ -13,21 +13,25 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/js-arias/command"
 	"github.com/js-arias/earth"
 	"github.com/js-arias/earth/model"
 	"github.com/js-arias/gbifer/tsv"
+	"github.com/js-arias/phygeo/agerange"
 	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/records"
 	"github.com/js-arias/ranges"
 	"github.com/js-arias/timetree"
 )
 
 var Command = &command.Command{
 	Usage: `add [-f|--file <range-file>]
-	[--format <format>] [--filter]
+	[--format <format>] [--filter] [--ages] [--wait <seconds>]
 	<project-file> [<range-file>...]`,
 	Short: "add taxon ranges to a PhyGeo project",
 	Long: `
@@ -62,6 +66,18 @@ possible to define a different file format. Valid formats are:
 In formats different from the PhyGeo format, all entries are assumed to be
 geo-referenced at the present time.
 
+In formats different from the PhyGeo format, the metadata of each record will
+be stored in the records file of the project (or in a new file called
+'records.tab' if the project does not have a records file), so the pixels of a
+range can be traced to the original records (use the flag --records of the
+command 'range taxa' to query the records of a taxon). The metadata of a
+record is its source (the name of the input file), its ID, its basis of
+record, and its date. In the DarwinCore format, the ID is read from the field
+"gbifID" (or "occurrenceID"), the basis from "basisOfRecord", and the date
+from "eventDate". In PaleoBiology DataBase files, the ID is read from the field
+"occurrence_no". In the text and csv formats, the optional fields "source",
+"record", "basis", and "date" will be used.
+
 By default, all records in the input files will be added. If the flag --filter
 is defined and there are trees in the project, then it will add only the
 records that match a taxon name in the trees.
@@ -73,6 +89,21 @@ the flag --file or -f. If this flag is used, and there is a range file already
 defined, then a new file will be created, and used as the range file for the
 added type of range map for the project (previously defined ranges will be
 kept).
+
+By default, each taxon has a single range at a single age. If the flag --ages
+is defined, the ranges will be added to the age-specific range file of the
+project, in which a taxon can have ranges at different ages (for example, the
+fossils of a lineage found at different time slices). In the diffusion
+analysis, each age-specific range is attached to the branch of the lineage at
+the age of the range. If the project does not have an age-specific range
+file, a new one will be created with the name 'age-ranges.tab' (or the name
+defined with the flag --file).
+
+While the ranges are added, the project is locked with the file
+"<project-file>.lock", so several range files can be added to the same
+project by commands running in parallel (e.g., in a job script). If the
+project is locked by another process, the command fails. Use the flag --wait
+to set the maximum time, in seconds, to wait until the lock is released.
 	`,
 	SetFlags: setFlags,
 	Run:      run,
@@ -81,12 +112,16 @@ kept).
 var format string
 var outFile string
 var filterFlag bool
+var agesFlag bool
+var waitFlag float64
 
 func setFlags(c *command.Command) {
 	c.Flags().StringVar(&outFile, "file", "", "")
 	c.Flags().StringVar(&outFile, "f", "", "")
 	c.Flags().StringVar(&format, "format", "phygeo", "")
 	c.Flags().BoolVar(&filterFlag, "filter", false, "")
+	c.Flags().BoolVar(&agesFlag, "ages", false, "")
+	c.Flags().Float64Var(&waitFlag, "wait", 0, "")
 }
 
 func run(c *command.Command, args []string) error {
@@ -94,31 +129,14 @@ func run(c *command.Command, args []string) error {
 		return c.UsageError("expecting project file")
 	}
 	pFile := args[0]
-	p, err := openProject(pFile)
-	if err != nil {
-		return err
-	}
-
-	if err := addRangeData(c.Stdin(), p, args[1:]); err != nil {
-		return err
-	}
-
-	if err := p.Write(pFile); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func openProject(name string) (*project.Project, error) {
-	p, err := project.Read(name)
-	if errors.Is(err, os.ErrNotExist) {
-		return project.New(), nil
-	}
-	if err != nil {
-		return nil, fmt.Errorf("unable ot open project %q: %v", name, err)
-	}
-	return p, nil
+	wait := time.Duration(waitFlag * float64(time.Second))
+	return project.UpdateNew(pFile, wait, func(p *project.Project) error {
+		add := addRangeData
+		if agesFlag {
+			add = addAgeRangeData
+		}
+		return add(c.Stdin(), p, args[1:])
+	})
 }
 
 func makeFilter(p *project.Project) (map[string]bool, error) {
@@ -176,30 +194,17 @@ func addRangeData(r io.Reader, p *project.Project, files []string) error {
 		}
 	}
 
-	readRangeFunc := readCollection
-	switch strings.ToLower(format) {
-	case "csv":
-		readRangeFunc = func(r io.Reader, name string, pix *earth.Pixelation) (*ranges.Collection, error) {
-			return readTextData(r, name, pix, ',')
-		}
-	case "darwin":
-		readRangeFunc = readGBIFData
-	case "pbdb":
-		readRangeFunc = readPaleoDBData
-	case "phygeo":
-	case "text":
-		readRangeFunc = func(r io.Reader, name string, pix *earth.Pixelation) (*ranges.Collection, error) {
-			return readTextData(r, name, pix, '\t')
-		}
-	default:
-		return fmt.Errorf("format %q unknown", format)
+	readRangeFunc, err := rangeReader()
+	if err != nil {
+		return err
 	}
+	recs := records.New(pix)
 
 	if len(files) == 0 {
 		files = append(files, "-")
 	}
 	for _, f := range files {
-		c, err := readRangeFunc(r, f, pix)
+		c, err := readRangeFunc(r, f, pix, recs)
 		if err != nil {
 			return err
 		}
@@ -207,6 +212,7 @@ func addRangeData(r io.Reader, p *project.Project, files []string) error {
 		for _, nm := range c.Taxa() {
 			if filterFlag {
 				if !filter[nm] {
+					recs.Delete(nm)
 					continue
 				}
 			}
@@ -242,9 +248,180 @@ func addRangeData(r io.Reader, p *project.Project, files []string) error {
 		return err
 	}
 	p.Add(project.Ranges, rngFile)
+
+	return addRecords(p, recs)
+}
+
+// AddRecords adds the metadata of the records
+// to the records file of the project.
+func addRecords(p *project.Project, recs *records.Collection) error {
+	if len(recs.Taxa()) == 0 {
+		return nil
+	}
+
+	recFile := p.Path(project.Records)
+	if recFile != "" {
+		pr, err := readRecords(recFile, recs.Pixelation())
+		if err != nil {
+			return err
+		}
+		if err := pr.Merge(recs); err != nil {
+			return fmt.Errorf("on file %q: %v", recFile, err)
+		}
+		recs = pr
+	} else {
+		recFile = "records.tab"
+	}
+
+	if err := writeRecords(recFile, recs); err != nil {
+		return err
+	}
+	p.Add(project.Records, recFile)
 	return nil
 }
 
+// RangeReader returns the function used to read
+// the input range files,
+// based on the input format.
+//
+// The records read
+// (if the format has records)
+// will be added to the given records collection.
+func rangeReader() (func(io.Reader, string, *earth.Pixelation, *records.Collection) (*ranges.Collection, error), error) {
+	switch strings.ToLower(format) {
+	case "csv":
+		return func(r io.Reader, name string, pix *earth.Pixelation, recs *records.Collection) (*ranges.Collection, error) {
+			return readTextData(r, name, pix, ',', recs)
+		}, nil
+	case "darwin":
+		return readGBIFData, nil
+	case "pbdb":
+		return readPaleoDBData, nil
+	case "phygeo":
+		return func(r io.Reader, name string, pix *earth.Pixelation, recs *records.Collection) (*ranges.Collection, error) {
+			return readCollection(r, name, pix)
+		}, nil
+	case "text":
+		return func(r io.Reader, name string, pix *earth.Pixelation, recs *records.Collection) (*ranges.Collection, error) {
+			return readTextData(r, name, pix, '\t', recs)
+		}, nil
+	}
+	return nil, fmt.Errorf("format %q unknown", format)
+}
+
+func addAgeRangeData(r io.Reader, p *project.Project, files []string) error {
+	pix, err := openPixelation(p)
+	if err != nil {
+		return err
+	}
+
+	var coll *agerange.Collection
+	if pf := p.Path(project.AgeRanges); pf != "" {
+		var err error
+		coll, err = readAgeCollection(r, pf, pix)
+		if err != nil {
+			return err
+		}
+	} else {
+		coll = agerange.New(pix)
+	}
+
+	var filter map[string]bool
+	if filterFlag {
+		filter, err = makeFilter(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	// in the phygeo format,
+	// a taxon can have ranges at different ages
+	readRangeFunc, err := rangeReader()
+	if err != nil {
+		return err
+	}
+	isPhyGeo := strings.ToLower(format) == "phygeo"
+	recs := records.New(pix)
+
+	if len(files) == 0 {
+		files = append(files, "-")
+	}
+	for _, f := range files {
+		var c *agerange.Collection
+		if isPhyGeo {
+			c, err = readAgeCollection(r, f, pix)
+			if err != nil {
+				return err
+			}
+		} else {
+			rc, err := readRangeFunc(r, f, pix, recs)
+			if err != nil {
+				return err
+			}
+			c = toAgeCollection(rc)
+		}
+
+		for _, nm := range c.Taxa() {
+			if filterFlag {
+				if !filter[nm] {
+					recs.Delete(nm)
+					continue
+				}
+			}
+			for _, age := range c.Ages(nm) {
+				rng := c.Range(nm, age)
+
+				// a geographic range map
+				if c.Type(nm, age) == ranges.Range {
+					coll.Set(nm, age, rng)
+					continue
+				}
+
+				// presence-absence points
+				for id := range rng {
+					coll.AddPixel(nm, age, id)
+				}
+			}
+		}
+	}
+	if len(coll.Taxa()) == 0 {
+		return nil
+	}
+
+	rngFile := p.Path(project.AgeRanges)
+	if outFile != "" {
+		rngFile = outFile
+	}
+	if rngFile == "" {
+		rngFile = "age-ranges.tab"
+	}
+
+	if err := writeAgeCollection(rngFile, coll); err != nil {
+		return err
+	}
+	p.Add(project.AgeRanges, rngFile)
+
+	return addRecords(p, recs)
+}
+
+// ToAgeCollection copies the ranges of a collection
+// into an age-specific collection.
+func toAgeCollection(c *ranges.Collection) *agerange.Collection {
+	ac := agerange.New(c.Pixelation())
+	for _, nm := range c.Taxa() {
+		age := c.Age(nm)
+		rng := c.Range(nm)
+		if c.Type(nm) == ranges.Range {
+			ac.Set(nm, age, rng)
+			continue
+		}
+		for id := range rng {
+			ac.AddPixel(nm, age, id)
+		}
+	}
+	return ac
+}
+
 func openPixelation(p *project.Project) (*earth.Pixelation, error) {
 	if path := p.Path(project.Landscape); path != "" {
 		f, err := os.Open(path)
@@ -293,13 +470,33 @@ func readCollection(r io.Reader, name string, pix *earth.Pixelation) (*ranges.Co
 	return coll, nil
 }
 
+func readAgeCollection(r io.Reader, name string, pix *earth.Pixelation) (*agerange.Collection, error) {
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	} else {
+		name = "stdin"
+	}
+
+	coll, err := agerange.ReadTSV(r, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
 var textHeaderFields = []string{
 	"species",
 	"latitude",
 	"longitude",
 }
 
-func readTextData(r io.Reader, name string, pix *earth.Pixelation, comma rune) (*ranges.Collection, error) {
+func readTextData(r io.Reader, name string, pix *earth.Pixelation, comma rune, recs *records.Collection) (*ranges.Collection, error) {
 	if name != "-" {
 		f, err := os.Open(name)
 		if err != nil {
@@ -363,6 +560,17 @@ func readTextData(r io.Reader, name string, pix *earth.Pixelation, comma rune) (
 		}
 
 		coll.Add(tax, 0, lat, lon)
+		rec := records.Record{
+			Taxon:  tax,
+			Pixel:  pix.Pixel(lat, lon).ID(),
+			Source: recField(row, fields, filepath.Base(name), "source"),
+			ID:     recField(row, fields, "", "record"),
+			Basis:  recField(row, fields, "", "basis"),
+			Date:   recField(row, fields, "", "date"),
+		}
+		if err := recs.Add(rec); err != nil {
+			return nil, fmt.Errorf("on file %q: row %d: %v", name, ln, err)
+		}
 	}
 	return coll, nil
 }
@@ -373,7 +581,7 @@ var gbifFields = []string{
 	"decimallongitude",
 }
 
-func readGBIFData(r io.Reader, name string, pix *earth.Pixelation) (*ranges.Collection, error) {
+func readGBIFData(r io.Reader, name string, pix *earth.Pixelation, recs *records.Collection) (*ranges.Collection, error) {
 	if name != "-" {
 		f, err := os.Open(name)
 		if err != nil {
@@ -435,6 +643,17 @@ func readGBIFData(r io.Reader, name string, pix *earth.Pixelation) (*ranges.Coll
 		}
 
 		coll.Add(tax, 0, lat, lon)
+		rec := records.Record{
+			Taxon:  tax,
+			Pixel:  pix.Pixel(lat, lon).ID(),
+			Source: filepath.Base(name),
+			ID:     recField(row, fields, "", "gbifid", "occurrenceid"),
+			Basis:  recField(row, fields, "", "basisofrecord"),
+			Date:   recField(row, fields, "", "eventdate"),
+		}
+		if err := recs.Add(rec); err != nil {
+			return nil, fmt.Errorf("on file %q: row %d: %v", name, ln, err)
+		}
 	}
 
 	return coll, nil
@@ -446,7 +665,7 @@ var pbdbFields = []string{
 	"lng",
 }
 
-func readPaleoDBData(r io.Reader, name string, pix *earth.Pixelation) (*ranges.Collection, error) {
+func readPaleoDBData(r io.Reader, name string, pix *earth.Pixelation, recs *records.Collection) (*ranges.Collection, error) {
 	if name != "-" {
 		f, err := os.Open(name)
 		if err != nil {
@@ -522,11 +741,72 @@ func readPaleoDBData(r io.Reader, name string, pix *earth.Pixelation) (*ranges.C
 		}
 
 		coll.Add(tax, 0, lat, lon)
+		rec := records.Record{
+			Taxon:  tax,
+			Pixel:  pix.Pixel(lat, lon).ID(),
+			Source: filepath.Base(name),
+			ID:     recField(row, fields, "", "occurrence_no"),
+			Basis:  "",
+			Date:   "",
+		}
+		if err := recs.Add(rec); err != nil {
+			return nil, fmt.Errorf("on file %q: row %d: %v", name, ln, err)
+		}
 	}
 
 	return coll, nil
 }
 
+// RecField returns the value of the first field
+// of a row
+// with a non-empty value.
+// If no field has a value,
+// it returns the default value.
+func recField(row []string, fields map[string]int, def string, names ...string) string {
+	for _, nm := range names {
+		i, ok := fields[nm]
+		if !ok || i >= len(row) {
+			continue
+		}
+		if v := strings.TrimSpace(row[i]); v != "" {
+			return v
+		}
+	}
+	return def
+}
+
+func readRecords(name string, pix *earth.Pixelation) (*records.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	recs, err := records.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+	return recs, nil
+}
+
+func writeRecords(name string, recs *records.Collection) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	if err := recs.TSV(f); err != nil {
+		return fmt.Errorf("while writing to %q: %v", name, err)
+	}
+	return nil
+}
+
 func writeCollection(name string, coll *ranges.Collection) (err error) {
 	f, err := os.Create(name)
 	if err != nil {
@@ -544,3 +824,21 @@ func writeCollection(name string, coll *ranges.Collection) (err error) {
 	}
 	return nil
 }
+
+func writeAgeCollection(name string, coll *agerange.Collection) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	if err := coll.TSV(f); err != nil {
+		return fmt.Errorf("while writing to %q: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package export implements a command to export
+// the distribution ranges of a PhyGeo project
+// as CSV or GeoJSON files.
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/ranges"
+)
+
+var Command = &command.Command{
+	Usage: `export [--format <format>] [--geometry <geometry>]
+	[--age <value>] [-t|--taxon <name>]
+	[-o|--output <file>] <project-file>`,
+	Short: "export distribution ranges as CSV or GeoJSON",
+	Long: `
+Command export reads the geographic ranges from a PhyGeo project and writes
+them in a format that can be read by GIS software (for example QGIS or Google
+Earth), so the pixels used by the model can be inspected.
+
+The argument of the command is the name of the project file.
+
+The flag --format sets the output format. Valid values are:
+
+	csv      a comma-delimited file (the default)
+	geojson  a GeoJSON feature collection
+
+The flag --geometry sets how each pixel is exported. Valid values are:
+
+	points  the center of the pixel, as a latitude, longitude pair (the
+	        default)
+	pixels  the boundary of the pixel, as a polygon
+
+In a CSV file, each row is a pixel of a taxon, with the following columns:
+
+	taxon      the name of the taxon
+	type       the type of the range ("points" or "range")
+	age        the age of the pixels, in million years
+	pixel      the ID of the pixel
+	density    the density of the pixel
+	latitude   the latitude of the pixel center
+	longitude  the longitude of the pixel center
+
+With the geometry "pixels", an additional column "wkt" will store the pixel
+boundary as a well-known text polygon. In a GeoJSON file, each pixel is a
+feature, with the same fields stored as properties of the feature.
+
+Pixel boundaries are built from the isolatitude rings of the pixelation: each
+pixel spans the latitude step of the pixelation, and the longitude width of
+the pixels of its ring. Pixels that cross the 180° meridian are split into
+two polygons.
+
+By default, the ranges are exported at the age in which they are defined in
+the project (i.e., the present, except for rotated fossil ranges). If the
+flag --age is defined with an age, in million years, the ranges will be
+rotated to the time stage of that age, using the plate motion model of the
+project. Pixels without a location at the time stage will be ignored, and a
+warning will be printed if a taxon has no pixels at the time stage.
+
+By default, all taxa will be exported; use the flag --taxon, or -t, to export
+a single taxon. By default, the output will be printed in the standard output;
+use the flag --output, or -o, to define an output file.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var formatFlag string
+var geomFlag string
+var ageFlag float64
+var taxFlag string
+var output string
+
+func setFlags(c *command.Command) {
+	c.Flags().StringVar(&formatFlag, "format", formatCSV, "")
+	c.Flags().StringVar(&geomFlag, "geometry", geomPoints, "")
+	c.Flags().Float64Var(&ageFlag, "age", -1, "")
+	c.Flags().StringVar(&taxFlag, "taxon", "", "")
+	c.Flags().StringVar(&taxFlag, "t", "", "")
+	c.Flags().StringVar(&output, "output", "", "")
+	c.Flags().StringVar(&output, "o", "", "")
+}
+
+// Valid output formats.
+const (
+	formatCSV     = "csv"
+	formatGeoJSON = "geojson"
+)
+
+// Valid geometries.
+const (
+	geomPoints = "points"
+	geomPixels = "pixels"
+)
+
+func run(c *command.Command, args []string) (err error) {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	format := strings.ToLower(formatFlag)
+	if format != formatCSV && format != formatGeoJSON {
+		return c.UsageError(fmt.Sprintf("flag --format: unknown format %q", formatFlag))
+	}
+	geom := strings.ToLower(geomFlag)
+	if geom != geomPoints && geom != geomPixels {
+		return c.UsageError(fmt.Sprintf("flag --geometry: unknown geometry %q", geomFlag))
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	rf := p.Path(project.Ranges)
+	if rf == "" {
+		msg := fmt.Sprintf("distribution ranges not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	coll, err := readRanges(rf)
+	if err != nil {
+		return err
+	}
+
+	ls := coll.Taxa()
+	if taxFlag != "" {
+		name := strings.Join(strings.Fields(taxFlag), " ")
+		i := slices.IndexFunc(ls, func(tax string) bool {
+			return strings.EqualFold(tax, name)
+		})
+		if i < 0 {
+			return fmt.Errorf("taxon %q not found in project %q", name, args[0])
+		}
+		ls = ls[i : i+1]
+	}
+
+	var rot *rotation
+	if ageFlag >= 0 {
+		rotF := p.Path(project.GeoMotion)
+		if rotF == "" {
+			msg := fmt.Sprintf("plate motion model not defined in project %q", args[0])
+			return c.UsageError(msg)
+		}
+		tot, err := readRotation(rotF, coll)
+		if err != nil {
+			return err
+		}
+		rot = newRotation(tot, int64(math.Round(ageFlag*timestage.MillionYears)))
+	}
+
+	var rs []taxRange
+	for _, tax := range ls {
+		tr := taxRange{
+			name: tax,
+			tp:   coll.Type(tax),
+			age:  coll.Age(tax),
+			rng:  coll.Range(tax),
+		}
+		if rot != nil {
+			tr = rot.rotate(tr)
+			if len(tr.rng) == 0 {
+				fmt.Fprintf(c.Stderr(), "WARNING: taxon %q: undefined pixels at age %.6f\n", tax, float64(tr.age)/timestage.MillionYears)
+				continue
+			}
+		}
+		rs = append(rs, tr)
+	}
+
+	w := c.Stdout()
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			e := f.Close()
+			if e != nil && err == nil {
+				err = e
+			}
+		}()
+		w = f
+	} else {
+		output = "stdout"
+	}
+
+	bw := bufio.NewWriter(w)
+	if format == formatGeoJSON {
+		err = writeGeoJSON(bw, coll, rs, geom == geomPixels)
+	} else {
+		err = writeCSV(bw, coll, rs, geom == geomPixels)
+	}
+	if err != nil {
+		return fmt.Errorf("while writing to %q: %v", output, err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("while writing to %q: %v", output, err)
+	}
+	return nil
+}
+
+// A taxRange is the range of a taxon
+// at a given age.
+type taxRange struct {
+	name string
+	tp   ranges.Type
+	age  int64
+	rng  map[int]float64
+}
+
+// Pixels returns the sorted pixels of the range.
+func (tr taxRange) pixels() []int {
+	px := make([]int, 0, len(tr.rng))
+	for id := range tr.rng {
+		px = append(px, id)
+	}
+	slices.Sort(px)
+	return px
+}
+
+// A rotation moves the ranges
+// to a time stage.
+type rotation struct {
+	tot *model.Total
+	inv *model.Total
+	age int64
+}
+
+func newRotation(tot *model.Total, age int64) *rotation {
+	return &rotation{
+		tot: tot,
+		inv: tot.Inverse(),
+		age: tot.ClosestStageAge(age),
+	}
+}
+
+// Rotate returns a taxon range
+// rotated to the time stage of the rotation.
+// Ranges defined at a past time stage
+// are first moved to the present.
+// If several pixels are moved to the same location,
+// the maximum density is kept.
+func (r *rotation) rotate(tr taxRange) taxRange {
+	rng := tr.rng
+	if tr.age > 0 && r.tot.ClosestStageAge(tr.age) != r.age {
+		rng = move(rng, r.inv.Rotation(tr.age))
+		tr.age = 0
+	}
+	if tr.age == 0 && r.age > 0 {
+		rng = move(rng, r.tot.Rotation(r.age))
+	}
+	tr.age = r.age
+	tr.rng = rng
+	return tr
+}
+
+func move(rng map[int]float64, rot map[int][]int) map[int]float64 {
+	n := make(map[int]float64, len(rng))
+	for px, d := range rng {
+		for _, np := range rot[px] {
+			if d > n[np] {
+				n[np] = d
+			}
+		}
+	}
+	return n
+}
+
+func readRanges(name string) (*ranges.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := ranges.ReadTSV(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func readRotation(name string, coll *ranges.Collection) (*model.Total, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rot, err := model.ReadTotal(f, coll.Pixelation(), false)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return rot, nil
+}
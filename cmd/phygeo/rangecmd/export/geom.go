@@ -0,0 +1,203 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/js-arias/earth"
+	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/ranges"
+)
+
+// PixelRings returns the boundary of a pixel
+// as one or more closed rings
+// of longitude, latitude pairs.
+// A pixel that crosses the 180° meridian
+// is split in two rings.
+func pixelRings(pix *earth.Pixelation, id int) [][][2]float64 {
+	px := pix.ID(id)
+	pt := px.Point()
+	step := pix.Step()
+
+	north := math.Min(pt.Latitude()+step/2, 90)
+	south := math.Max(pt.Latitude()-step/2, -90)
+
+	width := 360 / float64(pix.PixPerRing(px.Ring()))
+	west := pt.Longitude() - width/2
+	east := pt.Longitude() + width/2
+
+	if width >= 360 {
+		return [][][2]float64{box(-180, 180, south, north)}
+	}
+	if west < -180 {
+		return [][][2]float64{
+			box(-180, east, south, north),
+			box(west+360, 180, south, north),
+		}
+	}
+	if east > 180 {
+		return [][][2]float64{
+			box(west, 180, south, north),
+			box(-180, east-360, south, north),
+		}
+	}
+	return [][][2]float64{box(west, east, south, north)}
+}
+
+// Box returns a closed ring
+// in counter-clockwise order.
+func box(west, east, south, north float64) [][2]float64 {
+	return [][2]float64{
+		{west, south},
+		{east, south},
+		{east, north},
+		{west, north},
+		{west, south},
+	}
+}
+
+// WKT returns a set of rings
+// as a well-known text polygon.
+func wkt(rings [][][2]float64) string {
+	polys := make([]string, 0, len(rings))
+	for _, r := range rings {
+		pts := make([]string, 0, len(r))
+		for _, p := range r {
+			pts = append(pts, fmt.Sprintf("%.6f %.6f", p[0], p[1]))
+		}
+		polys = append(polys, "(("+strings.Join(pts, ", ")+"))")
+	}
+	if len(polys) == 1 {
+		return "POLYGON " + polys[0]
+	}
+	return "MULTIPOLYGON (" + strings.Join(polys, ", ") + ")"
+}
+
+func writeCSV(w io.Writer, coll *ranges.Collection, rs []taxRange, pixels bool) error {
+	tab := csv.NewWriter(w)
+	tab.UseCRLF = true
+
+	header := []string{"taxon", "type", "age", "pixel", "density", "latitude", "longitude"}
+	if pixels {
+		header = append(header, "wkt")
+	}
+	if err := tab.Write(header); err != nil {
+		return err
+	}
+
+	pix := coll.Pixelation()
+	for _, tr := range rs {
+		age := strconv.FormatFloat(float64(tr.age)/timestage.MillionYears, 'f', 6, 64)
+		for _, id := range tr.pixels() {
+			pt := pix.ID(id).Point()
+			row := []string{
+				tr.name,
+				string(tr.tp),
+				age,
+				strconv.Itoa(id),
+				strconv.FormatFloat(tr.rng[id], 'f', 6, 64),
+				strconv.FormatFloat(pt.Latitude(), 'f', 6, 64),
+				strconv.FormatFloat(pt.Longitude(), 'f', 6, 64),
+			}
+			if pixels {
+				row = append(row, wkt(pixelRings(pix, id)))
+			}
+			if err := tab.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	tab.Flush()
+	if err := tab.Error(); err != nil {
+		return err
+	}
+	return nil
+}
+
+type featureCollection struct {
+	Type     string    `json:"type"`
+	Features []feature `json:"features"`
+}
+
+type feature struct {
+	Type       string     `json:"type"`
+	Geometry   geometry   `json:"geometry"`
+	Properties properties `json:"properties"`
+}
+
+type geometry struct {
+	Type        string `json:"type"`
+	Coordinates any    `json:"coordinates"`
+}
+
+type properties struct {
+	Taxon     string  `json:"taxon"`
+	Type      string  `json:"type"`
+	Age       float64 `json:"age"`
+	Pixel     int     `json:"pixel"`
+	Density   float64 `json:"density"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+func writeGeoJSON(w io.Writer, coll *ranges.Collection, rs []taxRange, pixels bool) error {
+	fc := featureCollection{
+		Type:     "FeatureCollection",
+		Features: []feature{},
+	}
+
+	pix := coll.Pixelation()
+	for _, tr := range rs {
+		age := float64(tr.age) / timestage.MillionYears
+		for _, id := range tr.pixels() {
+			pt := pix.ID(id).Point()
+			f := feature{
+				Type: "Feature",
+				Properties: properties{
+					Taxon:     tr.name,
+					Type:      string(tr.tp),
+					Age:       age,
+					Pixel:     id,
+					Density:   tr.rng[id],
+					Latitude:  pt.Latitude(),
+					Longitude: pt.Longitude(),
+				},
+			}
+			f.Geometry = geometry{
+				Type:        "Point",
+				Coordinates: [2]float64{pt.Longitude(), pt.Latitude()},
+			}
+			if pixels {
+				rings := pixelRings(pix, id)
+				if len(rings) == 1 {
+					f.Geometry = geometry{
+						Type:        "Polygon",
+						Coordinates: rings,
+					}
+				} else {
+					polys := make([][][][2]float64, 0, len(rings))
+					for _, r := range rings {
+						polys = append(polys, [][][2]float64{r})
+					}
+					f.Geometry = geometry{
+						Type:        "MultiPolygon",
+						Coordinates: polys,
+					}
+				}
+			}
+			fc.Features = append(fc.Features, f)
+		}
+	}
+
+	return json.NewEncoder(w).Encode(fc)
+}
@@ -0,0 +1,420 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package importcmd implements a command to import
+// range maps from a directory of shapefiles
+// into a PhyGeo project.
+package importcmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/ranges"
+	"github.com/js-arias/timetree"
+)
+
+var Command = &command.Command{
+	Usage: `import [--field <name>] [--filter]
+	[-f|--file <range-file>] [--wait <seconds>]
+	<project-file> <directory>`,
+	Short: "import range maps from shapefiles",
+	Long: `
+Command import reads the range maps stored as polygons in the shapefiles of a
+directory (for example, the range maps of the IUCN Red List), rasterizes them
+using the pixelation of the project, and adds them as continuous range maps
+to a PhyGeo project.
+
+The first argument of the command is the name of the project file. A
+pixelation model must be already defined for the project, either a rotation
+model, or a paleolandscape model.
+
+The second argument is the directory with the shapefiles. The directory will
+be searched recursively, and all files with the extension ".shp" will be read.
+Only polygon shapefiles with geographic coordinates (i.e., longitude and
+latitude in degrees) are supported. GeoPackage files (".gpkg") are not
+supported, and will be reported as errors.
+
+The name of the taxon of each polygon is read from the attributes file (with
+the extension ".dbf") associated with the shapefile. By default, the fields
+"binomial", "sci_name", "sciname", and "species" will be searched, in that
+order. Use the flag --field to define a different field. If there is no
+attributes file, the name of the shapefile will be used as the taxon name,
+replacing the underscores with spaces (e.g., "Panthera_onca.shp" will be read
+as "Panthera onca"). All the polygons of a taxon will be merged into a single
+range map.
+
+A pixel is included in the range map if its center is inside a polygon. If a
+polygon is smaller than a pixel, the pixels of the vertices of the polygon
+will be used.
+
+If the flag --filter is defined, only the taxa that match a terminal in the
+trees of the project will be added. The names are matched ignoring case and
+spaces.
+
+The command prints a progress log in the standard error. As a single invalid
+file should not stop the import of a large collection, the files with errors
+are skipped, and a summary of the errors will be printed at the end.
+
+By default the range maps will be stored in the range file currently defined
+for the project. If the project does not have a range file, a new one will be
+created with the name 'ranges.tab'. A different file name can be defined with
+the flag --file or -f. If a taxon already has a range, it will be replaced.
+
+While the range maps are imported, the project is locked. If the project is
+locked by another process, the command fails. Use the flag --wait to set the
+maximum time, in seconds, to wait until the lock is released.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var fieldFlag string
+var outFile string
+var filterFlag bool
+var waitFlag float64
+
+func setFlags(c *command.Command) {
+	c.Flags().StringVar(&fieldFlag, "field", "", "")
+	c.Flags().StringVar(&outFile, "file", "", "")
+	c.Flags().StringVar(&outFile, "f", "", "")
+	c.Flags().BoolVar(&filterFlag, "filter", false, "")
+	c.Flags().Float64Var(&waitFlag, "wait", 0, "")
+}
+
+var nameFields = []string{
+	"binomial",
+	"sci_name",
+	"sciname",
+	"species",
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if len(args) < 2 {
+		return c.UsageError("expecting shapefiles directory")
+	}
+
+	pFile := args[0]
+	wait := time.Duration(waitFlag * float64(time.Second))
+	return project.Update(pFile, wait, func(p *project.Project) error {
+		return importRanges(c, p, args[1])
+	})
+}
+
+// ImportRanges adds the range maps
+// of the shapefiles in a directory
+// to the project.
+func importRanges(c *command.Command, p *project.Project, dir string) error {
+	pix, err := openPixelation(p)
+	if err != nil {
+		return err
+	}
+
+	var filter map[string]string
+	if filterFlag {
+		filter, err = makeFilter(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	files, err := findFiles(dir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("directory %q: no shapefiles found", dir)
+	}
+
+	fields := nameFields
+	if fieldFlag != "" {
+		fields = []string{fieldFlag}
+	}
+
+	rngs := make(map[string]map[int]float64)
+	var errs []error
+	skipped := make(map[string]bool)
+	for i, f := range files {
+		fmt.Fprintf(c.Stderr(), "[%d/%d] %s\n", i+1, len(files), f)
+		if strings.ToLower(filepath.Ext(f)) == ".gpkg" {
+			errs = append(errs, fmt.Errorf("on file %q: GeoPackage format not supported", f))
+			continue
+		}
+
+		shapes, err := readShapefile(f, fields)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for name, polys := range shapes {
+			key := matchKey(name)
+			if filter != nil {
+				tn, ok := filter[key]
+				if !ok {
+					skipped[name] = true
+					continue
+				}
+				name = tn
+			}
+			rng, ok := rngs[name]
+			if !ok {
+				rng = make(map[int]float64)
+				rngs[name] = rng
+			}
+			for _, poly := range polys {
+				poly.rasterize(pix, rng)
+			}
+		}
+	}
+
+	var coll *ranges.Collection
+	rngFile := p.Path(project.Ranges)
+	if outFile != "" {
+		rngFile = outFile
+	}
+	if rngFile == "" {
+		rngFile = "ranges.tab"
+	}
+	if _, err := os.Stat(rngFile); err == nil {
+		coll, err = readCollection(rngFile, pix)
+		if err != nil {
+			return err
+		}
+	} else {
+		coll = ranges.New(pix)
+	}
+
+	names := make([]string, 0, len(rngs))
+	for name := range rngs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if len(rngs[name]) == 0 {
+			continue
+		}
+		coll.Set(name, 0, rngs[name])
+	}
+
+	fmt.Fprintf(c.Stderr(), "files: %d, taxa added: %d", len(files), len(names))
+	if filterFlag {
+		fmt.Fprintf(c.Stderr(), ", taxa not in trees: %d", len(skipped))
+	}
+	fmt.Fprintf(c.Stderr(), ", errors: %d\n", len(errs))
+	for _, err := range errs {
+		fmt.Fprintf(c.Stderr(), "\t%v\n", err)
+	}
+
+	if len(names) == 0 {
+		return project.SkipWrite
+	}
+	if err := writeCollection(rngFile, coll); err != nil {
+		return err
+	}
+	p.Add(project.Ranges, rngFile)
+	return nil
+}
+
+// FindFiles returns the shapefiles
+// (and GeoPackage files)
+// in a directory.
+func findFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".shp", ".gpkg":
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// ReadShapefile reads the polygons of a shapefile
+// grouped by taxon name.
+func readShapefile(name string, fields []string) (map[string][]*polygon, error) {
+	if err := checkProjection(name); err != nil {
+		return nil, err
+	}
+
+	polys, err := readShapes(name)
+	if err != nil {
+		return nil, err
+	}
+
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	var names []string
+	for _, ext := range []string{".dbf", ".DBF"} {
+		if _, err := os.Stat(base + ext); err != nil {
+			continue
+		}
+		names, err = readDBFField(base+ext, fields)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) != len(polys) {
+			return nil, fmt.Errorf("on file %q: got %d records, want %d", base+ext, len(names), len(polys))
+		}
+		break
+	}
+
+	tax := strings.ReplaceAll(filepath.Base(base), "_", " ")
+	shapes := make(map[string][]*polygon)
+	for i, p := range polys {
+		if p == nil {
+			continue
+		}
+		n := tax
+		if names != nil {
+			n = names[i]
+		}
+		n = strings.Join(strings.Fields(n), " ")
+		if n == "" {
+			continue
+		}
+		shapes[n] = append(shapes[n], p)
+	}
+	return shapes, nil
+}
+
+// CheckProjection returns an error
+// if the projection file of a shapefile
+// defines a projected coordinate system.
+func checkProjection(name string) error {
+	prj := strings.TrimSuffix(name, filepath.Ext(name)) + ".prj"
+	b, err := os.ReadFile(prj)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(string(b))), "PROJCS") {
+		return fmt.Errorf("on file %q: projected coordinates not supported", prj)
+	}
+	return nil
+}
+
+// MatchKey returns the key used to match taxon names.
+func matchKey(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// MakeFilter returns the names of the terminals
+// of the trees in the project,
+// keyed by its match key.
+func makeFilter(p *project.Project) (map[string]string, error) {
+	tf := p.Path(project.Trees)
+	if tf == "" {
+		return nil, fmt.Errorf("project without trees")
+	}
+
+	f, err := os.Open(tf)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", tf, err)
+	}
+	terms := make(map[string]string)
+	for _, tn := range c.Names() {
+		t := c.Tree(tn)
+		if t == nil {
+			continue
+		}
+		for _, tax := range t.Terms() {
+			terms[matchKey(tax)] = tax
+		}
+	}
+
+	return terms, nil
+}
+
+func openPixelation(p *project.Project) (*earth.Pixelation, error) {
+	if path := p.Path(project.Landscape); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		tp, err := model.ReadTimePix(f, nil)
+		if err != nil {
+			return nil, fmt.Errorf("on file %q: %v", path, err)
+		}
+		return tp.Pixelation(), nil
+	}
+	if path := p.Path(project.GeoMotion); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		tot, err := model.ReadTotal(f, nil, false)
+		if err != nil {
+			return nil, fmt.Errorf("on file %q: %v", path, err)
+		}
+		return tot.Pixelation(), nil
+	}
+	return nil, errors.New("undefined pixelation model")
+}
+
+func readCollection(name string, pix *earth.Pixelation) (*ranges.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := ranges.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func writeCollection(name string, coll *ranges.Collection) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	if err := coll.TSV(f); err != nil {
+		return fmt.Errorf("while writing to %q: %v", name, err)
+	}
+	return nil
+}
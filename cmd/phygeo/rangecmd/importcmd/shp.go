@@ -0,0 +1,291 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package importcmd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/js-arias/earth"
+)
+
+// A polygon is a set of rings
+// (i.e., closed lines)
+// in geographic coordinates.
+type polygon struct {
+	rings [][]point
+
+	// bounding box
+	minLat, maxLat float64
+	minLon, maxLon float64
+}
+
+// A point is a geographic point
+// in degrees.
+type point struct {
+	lat, lon float64
+}
+
+// Shape types with polygons
+// in an ESRI shapefile.
+const (
+	shpNull     = 0
+	shpPolygon  = 5
+	shpPolygonZ = 15
+	shpPolygonM = 25
+)
+
+// ReadShapes reads the polygons of an ESRI shapefile.
+// Records without a polygon
+// (i.e., a null shape)
+// are returned as nil,
+// so the returned slice can be matched
+// with the records of the associated DBF file.
+func readShapes(name string) ([]*polygon, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	var head [100]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, fmt.Errorf("on file %q: while reading header: %v", name, err)
+	}
+	if code := binary.BigEndian.Uint32(head[0:4]); code != 9994 {
+		return nil, fmt.Errorf("on file %q: not a shapefile", name)
+	}
+	switch tp := binary.LittleEndian.Uint32(head[32:36]); tp {
+	case shpNull, shpPolygon, shpPolygonZ, shpPolygonM:
+	default:
+		return nil, fmt.Errorf("on file %q: unsupported shape type %d", name, tp)
+	}
+
+	var polys []*polygon
+	for {
+		var rh [8]byte
+		if _, err := io.ReadFull(r, rh[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("on file %q: record %d: %v", name, len(polys)+1, err)
+		}
+		size := int(binary.BigEndian.Uint32(rh[4:8])) * 2
+		content := make([]byte, size)
+		if _, err := io.ReadFull(r, content); err != nil {
+			return nil, fmt.Errorf("on file %q: record %d: %v", name, len(polys)+1, err)
+		}
+
+		p, err := parsePolygon(content)
+		if err != nil {
+			return nil, fmt.Errorf("on file %q: record %d: %v", name, len(polys)+1, err)
+		}
+		polys = append(polys, p)
+	}
+	return polys, nil
+}
+
+func parsePolygon(b []byte) (*polygon, error) {
+	if len(b) < 4 {
+		return nil, errors.New("record too short")
+	}
+	tp := binary.LittleEndian.Uint32(b[0:4])
+	if tp == shpNull {
+		return nil, nil
+	}
+	if tp != shpPolygon && tp != shpPolygonZ && tp != shpPolygonM {
+		return nil, fmt.Errorf("unsupported shape type %d", tp)
+	}
+	if len(b) < 44 {
+		return nil, errors.New("record too short")
+	}
+
+	numParts := int(binary.LittleEndian.Uint32(b[36:40]))
+	numPoints := int(binary.LittleEndian.Uint32(b[40:44]))
+	partsEnd := 44 + 4*numParts
+	pointsEnd := partsEnd + 16*numPoints
+	if numParts <= 0 || numPoints <= 0 || len(b) < pointsEnd {
+		return nil, errors.New("invalid polygon size")
+	}
+
+	parts := make([]int, numParts+1)
+	for i := 0; i < numParts; i++ {
+		parts[i] = int(binary.LittleEndian.Uint32(b[44+4*i:]))
+	}
+	parts[numParts] = numPoints
+
+	p := &polygon{
+		minLat: 90,
+		maxLat: -90,
+		minLon: 180,
+		maxLon: -180,
+	}
+	for i := 0; i < numParts; i++ {
+		if parts[i] < 0 || parts[i] > parts[i+1] || parts[i+1] > numPoints {
+			return nil, errors.New("invalid polygon parts")
+		}
+		ring := make([]point, 0, parts[i+1]-parts[i])
+		for j := parts[i]; j < parts[i+1]; j++ {
+			off := partsEnd + 16*j
+			lon := math.Float64frombits(binary.LittleEndian.Uint64(b[off:]))
+			lat := math.Float64frombits(binary.LittleEndian.Uint64(b[off+8:]))
+			if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+				return nil, fmt.Errorf("invalid coordinate (%.6f, %.6f): expecting geographic coordinates", lat, lon)
+			}
+			ring = append(ring, point{lat: lat, lon: lon})
+			p.minLat = math.Min(p.minLat, lat)
+			p.maxLat = math.Max(p.maxLat, lat)
+			p.minLon = math.Min(p.minLon, lon)
+			p.maxLon = math.Max(p.maxLon, lon)
+		}
+		p.rings = append(p.rings, ring)
+	}
+	return p, nil
+}
+
+// Inside returns true if a point is inside the polygon
+// using the even-odd rule,
+// so holes are excluded.
+func (p *polygon) inside(lat, lon float64) bool {
+	if lat < p.minLat || lat > p.maxLat || lon < p.minLon || lon > p.maxLon {
+		return false
+	}
+
+	in := false
+	for _, r := range p.rings {
+		for i, j := 0, len(r)-1; i < len(r); j, i = i, i+1 {
+			a, b := r[i], r[j]
+			if (a.lat > lat) == (b.lat > lat) {
+				continue
+			}
+			x := (b.lon-a.lon)*(lat-a.lat)/(b.lat-a.lat) + a.lon
+			if lon < x {
+				in = !in
+			}
+		}
+	}
+	return in
+}
+
+// Rasterize adds to a range the pixels
+// whose center is inside the polygon.
+// If no pixel center is inside the polygon
+// (i.e., the polygon is smaller than a pixel),
+// the pixels of the vertices of the polygon
+// will be added.
+func (p *polygon) rasterize(pix *earth.Pixelation, rng map[int]float64) {
+	added := false
+	for ring := 0; ring < pix.Rings(); ring++ {
+		lat := pix.RingLat(ring)
+		if lat < p.minLat || lat > p.maxLat {
+			continue
+		}
+		first := pix.FirstPix(ring).ID()
+		for i := 0; i < pix.PixPerRing(ring); i++ {
+			pt := pix.ID(first + i).Point()
+			if !p.inside(pt.Latitude(), pt.Longitude()) {
+				continue
+			}
+			rng[first+i] = 1
+			added = true
+		}
+	}
+	if added {
+		return
+	}
+
+	for _, r := range p.rings {
+		for _, pt := range r {
+			rng[pix.Pixel(pt.lat, pt.lon).ID()] = 1
+		}
+	}
+}
+
+// ReadDBFField reads the values of a field
+// of a DBF (dBase) file.
+// The values are returned in the order of the records,
+// including the deleted records
+// (which are returned as empty strings).
+func readDBFField(name string, fields []string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	var head [32]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, fmt.Errorf("on file %q: while reading header: %v", name, err)
+	}
+	numRec := int(binary.LittleEndian.Uint32(head[4:8]))
+	headLen := int(binary.LittleEndian.Uint16(head[8:10]))
+	recLen := int(binary.LittleEndian.Uint16(head[10:12]))
+	if headLen < 33 || recLen < 1 {
+		return nil, fmt.Errorf("on file %q: invalid header", name)
+	}
+
+	desc := make([]byte, headLen-32)
+	if _, err := io.ReadFull(r, desc); err != nil {
+		return nil, fmt.Errorf("on file %q: while reading header: %v", name, err)
+	}
+
+	// field descriptors
+	type dbfField struct {
+		name   string
+		offset int
+		size   int
+	}
+	var fds []dbfField
+	offset := 1 // deletion flag
+	for i := 0; i+32 <= len(desc) && desc[i] != 0x0d; i += 32 {
+		fn := strings.ToLower(strings.TrimRight(string(desc[i:i+11]), "\x00 "))
+		size := int(desc[i+16])
+		fds = append(fds, dbfField{name: fn, offset: offset, size: size})
+		offset += size
+	}
+
+	fIdx := -1
+	for _, want := range fields {
+		for i, fd := range fds {
+			if fd.name == strings.ToLower(want) {
+				fIdx = i
+				break
+			}
+		}
+		if fIdx >= 0 {
+			break
+		}
+	}
+	if fIdx < 0 {
+		return nil, fmt.Errorf("on file %q: fields %v not found", name, fields)
+	}
+	fd := fds[fIdx]
+	if fd.offset+fd.size > recLen {
+		return nil, fmt.Errorf("on file %q: invalid field %q", name, fd.name)
+	}
+
+	values := make([]string, 0, numRec)
+	rec := make([]byte, recLen)
+	for i := 0; i < numRec; i++ {
+		if _, err := io.ReadFull(r, rec); err != nil {
+			return nil, fmt.Errorf("on file %q: record %d: %v", name, i+1, err)
+		}
+		if rec[0] == '*' {
+			values = append(values, "")
+			continue
+		}
+		v := strings.TrimSpace(string(rec[fd.offset : fd.offset+fd.size]))
+		values = append(values, v)
+	}
+	return values, nil
+}
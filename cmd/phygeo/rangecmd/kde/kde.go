@@ -14,6 +14,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/js-arias/command"
 	"github.com/js-arias/earth"
@@ -27,7 +28,8 @@ import (
 
 var Command = &command.Command{
 	Usage: `kde [--lambda <value>] [--bound <value>]
-	[-f|--file <file>] <project-file> [<taxon-list>]`,
+	[-f|--file <file>] [--wait <seconds>]
+	<project-file> [<taxon-list>]`,
 	Short: "estimate geographic ranges using a KDE",
 	Long: `
 Command kde reads the point locations from a PhyGeo project and produces new
@@ -53,6 +55,10 @@ By default, the range maps will be stored in the range file currently defined
 for the project. A different file name can be defined with the flag --file or
 -f. If this flag is used a new file will be created and used as the range file
 of the project (previously defined ranges will be kept).
+
+While the ranges are estimated, the project is locked. If the project is locked
+by another process, the command fails. Use the flag --wait to set the maximum
+time, in seconds, to wait until the lock is released.
 	`,
 	SetFlags: setFlags,
 	Run:      run,
@@ -61,12 +67,14 @@ of the project (previously defined ranges will be kept).
 var lambdaFlag float64
 var boundFlag float64
 var outFile string
+var waitFlag float64
 
 func setFlags(c *command.Command) {
 	c.Flags().Float64Var(&lambdaFlag, "lambda", 0, "")
 	c.Flags().Float64Var(&boundFlag, "bound", 0.95, "")
 	c.Flags().StringVar(&outFile, "file", "", "")
 	c.Flags().StringVar(&outFile, "f", "", "")
+	c.Flags().Float64Var(&waitFlag, "wait", 0, "")
 }
 
 func run(c *command.Command, args []string) error {
@@ -74,14 +82,22 @@ func run(c *command.Command, args []string) error {
 		return c.UsageError("expecting project file")
 	}
 	pFile := args[0]
-	p, err := openProject(pFile)
-	if err != nil {
-		return err
+	var taxFile string
+	if len(args) > 1 {
+		taxFile = args[1]
 	}
+	wait := time.Duration(waitFlag * float64(time.Second))
+	return project.Update(pFile, wait, func(p *project.Project) error {
+		return kdeRanges(c, p, pFile, taxFile)
+	})
+}
 
+// KdeRanges sets the ranges of the taxa defined as points
+// using a kernel density estimation.
+func kdeRanges(c *command.Command, p *project.Project, pFile, taxFile string) error {
 	lsf := p.Path(project.Landscape)
 	if lsf == "" {
-		msg := fmt.Sprintf("landscape not defined in project %q", args[0])
+		msg := fmt.Sprintf("landscape not defined in project %q", pFile)
 		return c.UsageError(msg)
 	}
 	landscape, err := readLandscape(lsf)
@@ -91,7 +107,7 @@ func run(c *command.Command, args []string) error {
 
 	pwF := p.Path(project.PixWeight)
 	if pwF == "" {
-		msg := fmt.Sprintf("pixel weights not defined in project %q", args[0])
+		msg := fmt.Sprintf("pixel weights not defined in project %q", pFile)
 		return c.UsageError(msg)
 	}
 	pw, err := readPixWeights(pwF)
@@ -121,8 +137,8 @@ func run(c *command.Command, args []string) error {
 	n := dist.NewNormal(lambdaFlag, landscape.Pixelation())
 
 	var lsTaxa map[string]bool
-	if len(args) > 1 {
-		lsTaxa, err = readTaxonNames(args[1])
+	if taxFile != "" {
+		lsTaxa, err = readTaxonNames(taxFile)
 		if err != nil {
 			return err
 		}
@@ -156,24 +172,9 @@ func run(c *command.Command, args []string) error {
 		return err
 	}
 	p.Add(project.Ranges, outFile)
-
-	if err := p.Write(pFile); err != nil {
-		return err
-	}
 	return nil
 }
 
-func openProject(name string) (*project.Project, error) {
-	p, err := project.Read(name)
-	if errors.Is(err, os.ErrNotExist) {
-		return project.New(), nil
-	}
-	if err != nil {
-		return nil, fmt.Errorf("unable ot open project %q: %v", name, err)
-	}
-	return p, nil
-}
-
 func readLandscape(name string) (*model.TimePix, error) {
 	f, err := os.Open(name)
 	if err != nil {
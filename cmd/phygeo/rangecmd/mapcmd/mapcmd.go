@@ -26,6 +26,8 @@ import (
 var Command = &command.Command{
 	Usage: `map [-c|--columns <value>]
 	[--key <key-file>] [--gray] [--scale <color-scale>]
+	[--relief <elevation-file>] [--exaggeration <value>]
+	[--range-alpha <value>]
 	[-t|--taxon <name>]
 	[--unrot] [--present] [--contour <image-file>]
 	[-o|--output <file-prefix] <project-file>`,
@@ -53,6 +55,17 @@ By default, the resulting image will be 3600 pixels wide. Use the flag
 --column, or -c, to define a different number of columns. By default, the
 images will have a gray background. Use the flag --key to define the landscape
 colors of the image. If the flag --gray is set, then gray colors will be used.
+
+If the flag --relief is defined with an elevation model, a hillshade
+calculated from the elevation values will be drawn over the landscape colors,
+and the ranges will be blended over the shaded landscape. The elevation model
+is a time pixelation file (the same format used for the landscape), with the
+elevation of each pixel in meters, and must use the same pixelation as the
+landscape. The flag --exaggeration sets the vertical exaggeration of the
+relief; by default it is 20, as the relief is barely visible at global scales
+without exaggeration. The flag --range-alpha sets the opacity of the range
+colors over the relief, a value between 0 and 1 (by default, 0.7).
+
 By default, a rainbow color scale will be used, other color scales can be
 defined using the --scale flag. Valid scale values are mostly based on Paul
 Tol color scales:
@@ -82,6 +95,9 @@ var keyFile string
 var outPrefix string
 var taxFlag string
 var scale string
+var reliefFile string
+var exaggeration float64
+var rangeAlpha float64
 
 func setFlags(c *command.Command) {
 	c.Flags().BoolVar(&grayFlag, "gray", false, "")
@@ -96,6 +112,9 @@ func setFlags(c *command.Command) {
 	c.Flags().StringVar(&outPrefix, "o", "", "")
 	c.Flags().StringVar(&contourFile, "contour", "", "")
 	c.Flags().StringVar(&scale, "scale", "rainbow", "")
+	c.Flags().StringVar(&reliefFile, "relief", "", "")
+	c.Flags().Float64Var(&exaggeration, "exaggeration", 20, "")
+	c.Flags().Float64Var(&rangeAlpha, "range-alpha", probmap.DefaultRangeAlpha, "")
 }
 
 func run(c *command.Command, args []string) error {
@@ -118,6 +137,20 @@ func run(c *command.Command, args []string) error {
 		return err
 	}
 
+	var relief *model.TimePix
+	if reliefFile != "" {
+		if exaggeration <= 0 {
+			return c.UsageError("flag --exaggeration: value must be greater than 0")
+		}
+		if rangeAlpha <= 0 || rangeAlpha > 1 {
+			return c.UsageError("flag --range-alpha: value must be between 0 and 1")
+		}
+		relief, err = readRelief(reliefFile, landscape)
+		if err != nil {
+			return err
+		}
+	}
+
 	var contour image.Image
 	if contourFile != "" {
 		contour, err = readContour(contourFile)
@@ -205,6 +238,10 @@ func run(c *command.Command, args []string) error {
 			Present:   present,
 			Gray:      grayFlag,
 			Gradient:  gradient,
+
+			Relief:       relief,
+			Exaggeration: exaggeration,
+			RangeAlpha:   rangeAlpha,
 		}
 		tm.Format(tot)
 
@@ -231,6 +268,24 @@ func readLandscape(name string) (*model.TimePix, error) {
 	return tp, nil
 }
 
+func readRelief(name string, landscape *model.TimePix) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+	if eq := landscape.Pixelation().Equator(); tp.Pixelation().Equator() != eq {
+		return nil, fmt.Errorf("on file %q: invalid equator value %d, want %d", name, tp.Pixelation().Equator(), eq)
+	}
+
+	return tp, nil
+}
+
 func readContour(name string) (image.Image, error) {
 	f, err := os.Open(name)
 	if err != nil {
@@ -9,11 +9,15 @@ package rangecmd
 import (
 	"github.com/js-arias/command"
 	"github.com/js-arias/phygeo/cmd/phygeo/rangecmd/add"
+	"github.com/js-arias/phygeo/cmd/phygeo/rangecmd/export"
+	"github.com/js-arias/phygeo/cmd/phygeo/rangecmd/importcmd"
 	"github.com/js-arias/phygeo/cmd/phygeo/rangecmd/kde"
 	"github.com/js-arias/phygeo/cmd/phygeo/rangecmd/mapcmd"
 	"github.com/js-arias/phygeo/cmd/phygeo/rangecmd/remove"
 	"github.com/js-arias/phygeo/cmd/phygeo/rangecmd/rotate"
+	"github.com/js-arias/phygeo/cmd/phygeo/rangecmd/stats"
 	"github.com/js-arias/phygeo/cmd/phygeo/rangecmd/taxa"
+	"github.com/js-arias/phygeo/cmd/phygeo/rangecmd/thin"
 )
 
 var Command = &command.Command{
@@ -23,11 +27,15 @@ var Command = &command.Command{
 
 func init() {
 	Command.Add(add.Command)
+	Command.Add(export.Command)
+	Command.Add(importcmd.Command)
 	Command.Add(kde.Command)
 	Command.Add(mapcmd.Command)
 	Command.Add(remove.Command)
 	Command.Add(rotate.Command)
+	Command.Add(stats.Command)
 	Command.Add(taxa.Command)
+	Command.Add(thin.Command)
 
 	// help guides
 	Command.Add(rangeFilesGuide)
@@ -81,5 +89,16 @@ Here is an example file:
 
 In a PhyGeo project, the file that contains the geographic distribution range
 data is indicated with the "ranges" keyword.
+
+In a distribution range file, each taxon has a single range at a single age.
+But the records of a lineage (for example, its fossils) might come from
+different time slices. Such records are stored in an age-specific range file,
+that uses the same format, but in which a taxon can have ranges at different
+ages. In the diffusion analysis, each age-specific range is attached to the
+branch of the lineage of the taxon at the age of the range (ranges younger
+than the terminal, or older than the root stem, are ignored). In a PhyGeo
+project, the age-specific range file is indicated with the "ageranges"
+keyword, and it can be defined using the flag --ages of the command
+"phygeo range add".
 	`,
 }
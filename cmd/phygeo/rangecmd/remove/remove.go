@@ -10,59 +10,77 @@ package remove
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/js-arias/command"
 	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/records"
 	"github.com/js-arias/ranges"
 	"github.com/js-arias/timetree"
 )
 
 var Command = &command.Command{
-	Usage: "remove <project-file>",
+	Usage: "remove [--wait <seconds>] <project-file>",
 	Short: "remove distribution ranges absent in tree",
 	Long: `
 Package remove reads the geographic ranges from a PhyGeo project and removes
 all ranges that are not defined as terminals of the phylogenetic trees of the
 project.
 
-The name of the removed distribution ranges will be printed on the screen.
+The name of the removed distribution ranges will be printed on the screen. If
+the project has a records file, the records of the removed taxa will be also
+removed.
 
 The argument of the command is the name of the project file.
+
+While the ranges are removed, the project is locked. If the project is locked
+by another process, the command fails. Use the flag --wait to set the maximum
+time, in seconds, to wait until the lock is released.
 	`,
-	Run: run,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var waitFlag float64
+
+func setFlags(c *command.Command) {
+	c.Flags().Float64Var(&waitFlag, "wait", 0, "")
 }
 
 func run(c *command.Command, args []string) error {
 	if len(args) < 1 {
 		return c.UsageError("expecting project file")
 	}
+	wait := time.Duration(waitFlag * float64(time.Second))
+	return project.Update(args[0], wait, func(p *project.Project) error {
+		return removeRanges(c, p, args[0])
+	})
+}
 
-	p, err := project.Read(args[0])
-	if err != nil {
-		return err
-	}
-
+// RemoveRanges removes the ranges of the taxa
+// that are not terminals of the trees of the project.
+func removeRanges(c *command.Command, p *project.Project, pFile string) error {
 	rf := p.Path(project.Ranges)
 	if rf == "" {
-		return nil
+		return project.SkipWrite
 	}
 	coll, err := readRanges(rf)
 	if err != nil {
 		return err
 	}
 	if coll == nil {
-		return nil
+		return project.SkipWrite
 	}
 
 	tf := p.Path(project.Trees)
 	if tf == "" {
-		msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+		msg := fmt.Sprintf("tree file not defined in project %q", pFile)
 		return c.UsageError(msg)
 	}
 
 	ls, err := makeTermList(tf)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	changed := false
@@ -76,12 +94,30 @@ func run(c *command.Command, args []string) error {
 	}
 
 	if !changed {
-		return nil
+		return project.SkipWrite
 	}
 
 	if err := writeCollection(rf, coll); err != nil {
 		return err
 	}
+	p.Add(project.Ranges, rf)
+
+	if recF := p.Path(project.Records); recF != "" {
+		recs, err := readRecords(recF)
+		if err != nil {
+			return err
+		}
+		for _, tax := range recs.Taxa() {
+			if _, ok := ls[tax]; ok {
+				continue
+			}
+			recs.Delete(tax)
+		}
+		if err := writeRecords(recF, recs); err != nil {
+			return err
+		}
+		p.Add(project.Records, recF)
+	}
 	return nil
 }
 
@@ -100,6 +136,20 @@ func readRanges(name string) (*ranges.Collection, error) {
 	return coll, nil
 }
 
+func readRecords(name string) (*records.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	recs, err := records.ReadTSV(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+	return recs, nil
+}
+
 func makeTermList(name string) (map[string]bool, error) {
 	f, err := os.Open(name)
 	if err != nil {
@@ -144,3 +194,21 @@ func writeCollection(name string, coll *ranges.Collection) (err error) {
 	}
 	return nil
 }
+
+func writeRecords(name string, recs *records.Collection) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	if err := recs.TSV(f); err != nil {
+		return fmt.Errorf("while writing to %q: %v", name, err)
+	}
+	return nil
+}
@@ -9,6 +9,7 @@ package rotate
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/js-arias/command"
 	"github.com/js-arias/earth/model"
@@ -19,7 +20,7 @@ import (
 )
 
 var Command = &command.Command{
-	Usage: "rotate <project-file>",
+	Usage: "rotate [--wait <seconds>] <project-file>",
 	Short: "rotate point records",
 	Long: `
 Command rotate reads the point locations from a PhyGeo project, as well as the
@@ -33,8 +34,19 @@ the terminals will be used to define the time stage for the rotation.
 
 Only terminals in which the distribution ranges are defined as points will be
 rotated.
+
+While the records are rotated, the project is locked. If the project is locked
+by another process, the command fails. Use the flag --wait to set the maximum
+time, in seconds, to wait until the lock is released.
 	`,
-	Run: run,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var waitFlag float64
+
+func setFlags(c *command.Command) {
+	c.Flags().Float64Var(&waitFlag, "wait", 0, "")
 }
 
 func run(c *command.Command, args []string) error {
@@ -42,14 +54,18 @@ func run(c *command.Command, args []string) error {
 		return c.UsageError("expecting project file")
 	}
 	pFile := args[0]
-	p, err := project.Read(pFile)
-	if err != nil {
-		return err
-	}
+	wait := time.Duration(waitFlag * float64(time.Second))
+	return project.Update(pFile, wait, func(p *project.Project) error {
+		return rotateRanges(c, p, pFile)
+	})
+}
 
+// RotateRanges sets the point records of the fossil taxa
+// to their past location.
+func rotateRanges(c *command.Command, p *project.Project, pFile string) error {
 	tf := p.Path(project.Trees)
 	if tf == "" {
-		msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+		msg := fmt.Sprintf("tree file not defined in project %q", pFile)
 		return c.UsageError(msg)
 	}
 	ages, err := readTermAges(tf)
@@ -59,7 +75,7 @@ func run(c *command.Command, args []string) error {
 
 	rotF := p.Path(project.GeoMotion)
 	if rotF == "" {
-		msg := fmt.Sprintf("plate motion model not defined in project %q", args[0])
+		msg := fmt.Sprintf("plate motion model not defined in project %q", pFile)
 		return c.UsageError(msg)
 	}
 	tot, err := readRotation(rotF)
@@ -109,10 +125,6 @@ func run(c *command.Command, args []string) error {
 		return err
 	}
 	p.Add(project.Ranges, pf)
-
-	if err := p.Write(pFile); err != nil {
-		return err
-	}
 	return nil
 }
 
@@ -0,0 +1,200 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package stats implements a command to print
+// occupancy statistics
+// of the distribution ranges in a PhyGeo project.
+package stats
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/pixstat"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/ranges"
+)
+
+var Command = &command.Command{
+	Usage: "stats <project-file>",
+	Short: "print occupancy statistics of distribution ranges",
+	Long: `
+Command stats reads the geographic ranges from a PhyGeo project and prints,
+for each taxon, some statistics of its range at the time stage of the range
+age.
+
+The argument of the command is the name of the project file.
+
+The output is a tab-delimited table printed in the standard output, with the
+following columns:
+
+	-taxon     the name of the taxon
+	-type      the type of the range model
+	-age       the time stage of the range (in years)
+	-pixels    the number of pixels of the range
+	-area      the total area of the range pixels (in km^2)
+	-min-lat   the southernmost latitude of the range
+	-max-lat   the northernmost latitude of the range
+	-lat       the latitude of the range centroid
+	-lon       the longitude of the range centroid
+	-west      the westernmost longitude of the range
+	-east      the easternmost longitude of the range
+	-radius    the radius (in km) of the smallest circle around the
+	           centroid that contains 95% of the range density
+	-classes   the landscape composition of the range, as a list of
+	           "<class>:<pixels>" values separated by commas
+
+The centroid is the mean of the pixel locations on the sphere, weighted by
+the density of each pixel. The longitude bounds are measured eastward, so if
+the range crosses the anti-meridian (i.e., 180° of longitude), the west bound
+will be greater than the east bound (e.g., a range from Fiji to Samoa will
+have west = 177 and east = -171).
+	`,
+	Run: run,
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+
+	p, err := project.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("paleolandscape not defined in project %q", args[0])
+		return c.UsageError(msg)
+	}
+	landscape, err := readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	rf := p.Path(project.Ranges)
+	if rf == "" {
+		return nil
+	}
+	coll, err := readRanges(rf, landscape.Pixelation())
+	if err != nil {
+		return err
+	}
+
+	if err := writeStats(c.Stdout(), coll, landscape); err != nil {
+		return err
+	}
+	return nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readRanges(name string, pix *earth.Pixelation) (*ranges.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := ranges.ReadTSV(f, pix)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func writeStats(w io.Writer, coll *ranges.Collection, landscape *model.TimePix) error {
+	pix := landscape.Pixelation()
+
+	// the pixelation is equal area
+	pixArea := 4 * math.Pi * earth.Radius * earth.Radius / float64(pix.Len()) / 1_000_000
+
+	tsv := csv.NewWriter(w)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	if err := tsv.Write([]string{"taxon", "type", "age", "pixels", "area", "min-lat", "max-lat", "lat", "lon", "west", "east", "radius", "classes"}); err != nil {
+		return err
+	}
+
+	for _, tax := range coll.Taxa() {
+		rng := coll.Range(tax)
+		age := landscape.ClosestStageAge(coll.Age(tax))
+		stage := landscape.Stage(age)
+
+		classes := make(map[int]int)
+		pixels := make([]int, 0, len(rng))
+		for px := range rng {
+			pixels = append(pixels, px)
+			classes[stage[px]]++
+		}
+		b, _ := pixstat.Bounds(pix, pixels)
+
+		lat, lon, radius := "NA", "NA", "NA"
+		if ct, ok := pixstat.Centroid(pix, rng); ok {
+			lat = strconv.FormatFloat(ct.Latitude(), 'f', 6, 64)
+			lon = strconv.FormatFloat(ct.Longitude(), 'f', 6, 64)
+			r := pixstat.HPDRadius(pix, rng, ct, 0.95)
+			radius = strconv.FormatFloat(r*earth.Radius/1000, 'f', 3, 64)
+		}
+
+		cls := make([]int, 0, len(classes))
+		for v := range classes {
+			cls = append(cls, v)
+		}
+		slices.Sort(cls)
+		comp := make([]string, 0, len(cls))
+		for _, v := range cls {
+			comp = append(comp, fmt.Sprintf("%d:%d", v, classes[v]))
+		}
+
+		row := []string{
+			tax,
+			string(coll.Type(tax)),
+			strconv.FormatInt(age, 10),
+			strconv.Itoa(len(rng)),
+			strconv.FormatFloat(pixArea*float64(len(rng)), 'f', 3, 64),
+			strconv.FormatFloat(b.South, 'f', 6, 64),
+			strconv.FormatFloat(b.North, 'f', 6, 64),
+			lat,
+			lon,
+			strconv.FormatFloat(b.West, 'f', 6, 64),
+			strconv.FormatFloat(b.East, 'f', 6, 64),
+			radius,
+			strings.Join(comp, ","),
+		}
+		if err := tsv.Write(row); err != nil {
+			return err
+		}
+	}
+
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return fmt.Errorf("while writing data: %v", err)
+	}
+	return nil
+}
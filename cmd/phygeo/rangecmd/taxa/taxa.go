@@ -8,21 +8,24 @@
 package taxa
 
 import (
+	"encoding/csv"
 	"fmt"
 	"io"
 	"os"
 	"slices"
+	"strconv"
 
 	"github.com/js-arias/command"
 	"github.com/js-arias/earth/model"
 	"github.com/js-arias/earth/stat/pixweight"
 	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/records"
 	"github.com/js-arias/ranges"
 	"github.com/js-arias/timetree"
 )
 
 var Command = &command.Command{
-	Usage: "taxa [--count] [--val] <project-file>",
+	Usage: "taxa [--count] [--val] [--records <taxon>] <project-file>",
 	Short: "print a list of taxa with distribution ranges",
 	Long: `
 Command taxa reads the geographic ranges from a PhyGeo project and print the
@@ -39,6 +42,17 @@ If the flag --val is defined, and all the taxa has valid records, the command
 will finish silently. Otherwise, any invalid taxon (a taxon without valid
 records) will be reported. To be valid, a taxon must have, at least, one
 valid pixel (i.e. a pixel with a weight greater than zero).
+
+If the flag --records is defined with the name of a taxon, the metadata of
+the occurrence records of the taxon (stored in the records file of the
+project) will be printed, as a tab-delimited table with the following
+columns:
+
+	pixel   the ID of the pixel of the record
+	source  the source of the record (e.g., the input file)
+	record  the ID of the record in the source
+	basis   the basis of the record
+	date    the date of the record
 	`,
 	SetFlags: setFlags,
 	Run:      run,
@@ -47,11 +61,13 @@ valid pixel (i.e. a pixel with a weight greater than zero).
 var countFlag bool
 var rangeFlag bool
 var valFlag bool
+var recordsFlag string
 
 func setFlags(c *command.Command) {
 	c.Flags().BoolVar(&countFlag, "count", false, "")
 	c.Flags().BoolVar(&rangeFlag, "ranges", false, "")
 	c.Flags().BoolVar(&valFlag, "val", false, "")
+	c.Flags().StringVar(&recordsFlag, "records", "", "")
 }
 
 func run(c *command.Command, args []string) error {
@@ -64,6 +80,18 @@ func run(c *command.Command, args []string) error {
 		return err
 	}
 
+	if recordsFlag != "" {
+		recF := p.Path(project.Records)
+		if recF == "" {
+			return fmt.Errorf("records not defined in project %q", args[0])
+		}
+		recs, err := readRecords(recF)
+		if err != nil {
+			return err
+		}
+		return printRecords(c.Stdout(), recs, recordsFlag)
+	}
+
 	rf := p.Path(project.Ranges)
 	if rf == "" {
 		if !valFlag {
@@ -154,6 +182,48 @@ func readRanges(name string) (*ranges.Collection, error) {
 	return coll, nil
 }
 
+func readRecords(name string) (*records.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	recs, err := records.ReadTSV(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+	return recs, nil
+}
+
+func printRecords(w io.Writer, recs *records.Collection, taxon string) error {
+	rs := recs.Records(taxon)
+	if len(rs) == 0 {
+		return fmt.Errorf("taxon %q: no records", taxon)
+	}
+
+	tab := csv.NewWriter(w)
+	tab.Comma = '\t'
+	tab.UseCRLF = true
+	if err := tab.Write([]string{"pixel", "source", "record", "basis", "date"}); err != nil {
+		return err
+	}
+	for _, r := range rs {
+		row := []string{
+			strconv.Itoa(r.Pixel),
+			r.Source,
+			r.ID,
+			r.Basis,
+			r.Date,
+		}
+		if err := tab.Write(row); err != nil {
+			return err
+		}
+	}
+	tab.Flush()
+	return tab.Error()
+}
+
 func readLandscape(name string) (*model.TimePix, error) {
 	f, err := os.Open(name)
 	if err != nil {
@@ -0,0 +1,311 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package thin implements a command
+// to remove duplicated records
+// and to perform a spatial thinning
+// of the records of the distribution ranges
+// in a PhyGeo project.
+package thin
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/ranges"
+)
+
+var Command = &command.Command{
+	Usage: `thin [--dist <value>] [--dry] [--wait <seconds>]
+	<project-file>`,
+	Short: "remove duplicated and nearby records",
+	Long: `
+Command thin reads the geographic ranges from a PhyGeo project, removes
+duplicated records of each taxon and, optionally, performs a spatial thinning
+of the records, to reduce the spatial sampling bias before an inference.
+
+The argument of the command is the name of the project file.
+
+Only the taxa with ranges defined as presence-absence pixels (i.e., "points")
+are processed. As records are stored as pixels, two records of the same taxon
+in the same pixel are duplicates, so at most one record per pixel will be
+kept.
+
+The flag --dist defines the minimum distance, in kilometers, between two
+records of the same taxon. Records are processed in the order of their pixel
+IDs (i.e., from north to south), and a record will be kept only if its
+distance to all the previously kept records of the taxon is at least the
+given distance. By default, the value is 0, so only duplicated records will be
+removed.
+
+The removed records will be printed in the standard output, as a tab-delimited
+table with the following columns:
+
+	-taxon    the name of the taxon
+	-equator  the number of pixels in the equator of the pixelation
+	-pixel    the ID of the pixel of the removed record
+	-lat      the latitude of the pixel
+	-lon      the longitude of the pixel
+	-reason   the reason of the removal, either "duplicate" or "thinned"
+	-near     the ID of the kept pixel that causes the removal
+
+By default, the range file of the project will be updated. If the flag --dry
+is defined, only the report will be printed, and the range file will be kept
+as is.
+
+While the records are thinned, the project is locked. If the project is locked
+by another process, the command fails. Use the flag --wait to set the maximum
+time, in seconds, to wait until the lock is released.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var distFlag float64
+var dryFlag bool
+var waitFlag float64
+
+func setFlags(c *command.Command) {
+	c.Flags().Float64Var(&distFlag, "dist", 0, "")
+	c.Flags().BoolVar(&dryFlag, "dry", false, "")
+	c.Flags().Float64Var(&waitFlag, "wait", 0, "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if distFlag < 0 {
+		return c.UsageError("flag --dist: value must be positive")
+	}
+	wait := time.Duration(waitFlag * float64(time.Second))
+	return project.Update(args[0], wait, func(p *project.Project) error {
+		return thinRanges(c, p, args[0])
+	})
+}
+
+// ThinRanges removes the duplicated and nearby records
+// of the ranges of the project.
+func thinRanges(c *command.Command, p *project.Project, pFile string) error {
+	rf := p.Path(project.Ranges)
+	if rf == "" {
+		msg := fmt.Sprintf("distribution ranges not defined in project %q", pFile)
+		return c.UsageError(msg)
+	}
+	coll, err := readRanges(rf)
+	if err != nil {
+		return err
+	}
+	dups, err := countRecords(rf)
+	if err != nil {
+		return err
+	}
+
+	pix := coll.Pixelation()
+	tsv := csv.NewWriter(c.Stdout())
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	if err := tsv.Write([]string{"taxon", "equator", "pixel", "lat", "lon", "reason", "near"}); err != nil {
+		return fmt.Errorf("while writing on standard output: %v", err)
+	}
+
+	changed := false
+	for _, tax := range coll.Taxa() {
+		if coll.Type(tax) != ranges.Points {
+			continue
+		}
+		rng := coll.Range(tax)
+		pixels := make([]int, 0, len(rng))
+		for px := range rng {
+			pixels = append(pixels, px)
+		}
+		slices.Sort(pixels)
+
+		// duplicated records
+		for _, px := range pixels {
+			for i := 1; i < dups[tax][px]; i++ {
+				if err := writeRemoved(tsv, pix, tax, px, "duplicate", px); err != nil {
+					return fmt.Errorf("while writing on standard output: %v", err)
+				}
+				changed = true
+			}
+		}
+
+		if distFlag == 0 {
+			continue
+		}
+
+		kept := make(map[int]float64, len(pixels))
+		var keep []int
+		for _, px := range pixels {
+			pt := pix.ID(px).Point()
+			near := -1
+			for _, k := range keep {
+				d := earth.Distance(pt, pix.ID(k).Point()) * earth.Radius / 1000
+				if d < distFlag {
+					near = k
+					break
+				}
+			}
+			if near >= 0 {
+				if err := writeRemoved(tsv, pix, tax, px, "thinned", near); err != nil {
+					return fmt.Errorf("while writing on standard output: %v", err)
+				}
+				continue
+			}
+			keep = append(keep, px)
+			kept[px] = 1
+		}
+		if len(kept) < len(rng) {
+			coll.SetPixels(tax, coll.Age(tax), kept)
+			changed = true
+		}
+	}
+
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return fmt.Errorf("while writing on standard output: %v", err)
+	}
+
+	if !changed || dryFlag {
+		return project.SkipWrite
+	}
+	if err := writeCollection(rf, coll); err != nil {
+		return err
+	}
+	p.Add(project.Ranges, rf)
+	return nil
+}
+
+func writeRemoved(tsv *csv.Writer, pix *earth.Pixelation, tax string, px int, reason string, near int) error {
+	pt := pix.ID(px).Point()
+	row := []string{
+		tax,
+		strconv.Itoa(pix.Equator()),
+		strconv.Itoa(px),
+		strconv.FormatFloat(pt.Latitude(), 'f', 6, 64),
+		strconv.FormatFloat(pt.Longitude(), 'f', 6, 64),
+		reason,
+		strconv.Itoa(near),
+	}
+	return tsv.Write(row)
+}
+
+func readRanges(name string) (*ranges.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := ranges.ReadTSV(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+// CountRecords returns the number of records
+// of each taxon in each pixel
+// as stored in a range file.
+func countRecords(name string) (map[string]map[int]int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tsv := csv.NewReader(f)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: while reading header: %v", name, err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range []string{"taxon", "pixel"} {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("on file %q: expecting field %q", name, h)
+		}
+	}
+
+	recs := make(map[string]map[int]int)
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on file %q: on row %d: %v", name, ln, err)
+		}
+
+		tax := canon(row[fields["taxon"]])
+		if tax == "" {
+			continue
+		}
+
+		f := "pixel"
+		px, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on file %q: on row %d: field %q: %v", name, ln, f, err)
+		}
+		r, ok := recs[tax]
+		if !ok {
+			r = make(map[int]int)
+			recs[tax] = r
+		}
+		r[px]++
+	}
+	return recs, nil
+}
+
+// Canon returns a taxon name
+// in its canonical form
+// (as used in a range collection).
+func canon(name string) string {
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" {
+		return ""
+	}
+	name = strings.ToLower(name)
+	r, n := utf8.DecodeRuneInString(name)
+	return string(unicode.ToUpper(r)) + name[n:]
+}
+
+func writeCollection(name string, coll *ranges.Collection) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	if err := coll.TSV(f); err != nil {
+		return fmt.Errorf("while writing to %q: %v", name, err)
+	}
+	return nil
+}
@@ -7,10 +7,10 @@
 package add
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	"github.com/js-arias/command"
 	"github.com/js-arias/phygeo/project"
@@ -20,7 +20,7 @@ import (
 
 var Command = &command.Command{
 	Usage: `add [-f|--file <tree-file>]
-	[--newick <name>] [--age <value>]
+	[--newick <name>] [--age <value>] [--wait <seconds>]
 	<project-file> [<tree-file>...]`,
 	Short: "add phylogenetic trees to a PhyGeo project",
 	Long: `
@@ -47,6 +47,12 @@ with the name 'trees.tab'. A different tree file name can be defined using the
 flag --file, or -f. If this flag is used, and there is tree file already
 defined, then a new file with that name will be created, and used as the tree
 file for the project (previously defined trees will be kept).
+
+While the trees are added, the project is locked with the file
+"<project-file>.lock", so the trees can be added by commands running in
+parallel (e.g., in a job script). If the project is locked by another
+process, the command fails. Use the flag --wait to set the maximum time, in
+seconds, to wait until the lock is released.
 	`,
 	SetFlags: setFlags,
 	Run:      run,
@@ -55,12 +61,14 @@ file for the project (previously defined trees will be kept).
 var treeFile string
 var newickName string
 var rootAge float64
+var waitFlag float64
 
 func setFlags(c *command.Command) {
 	c.Flags().StringVar(&treeFile, "file", "", "")
 	c.Flags().StringVar(&treeFile, "f", "", "")
 	c.Flags().StringVar(&newickName, "newick", "", "")
 	c.Flags().Float64Var(&rootAge, "age", 0, "")
+	c.Flags().Float64Var(&waitFlag, "wait", 0, "")
 }
 
 func run(c *command.Command, args []string) error {
@@ -68,11 +76,15 @@ func run(c *command.Command, args []string) error {
 		return c.UsageError("expecting project file")
 	}
 	pFile := args[0]
-	p, err := openProject(pFile)
-	if err != nil {
-		return err
-	}
+	wait := time.Duration(waitFlag * float64(time.Second))
+	return project.UpdateNew(pFile, wait, func(p *project.Project) error {
+		return addTrees(c, p, args[1:])
+	})
+}
 
+// AddTrees adds the trees in the input files
+// to the tree file of the project.
+func addTrees(c *command.Command, p *project.Project, args []string) (err error) {
 	var tc *timetree.Collection
 	if tf := p.Path(project.Trees); tf != "" {
 		tc, err = readTreeFile(nil, tf)
@@ -84,7 +96,6 @@ func run(c *command.Command, args []string) error {
 		tc = timetree.NewCollection()
 	}
 
-	args = args[1:]
 	if len(args) == 0 {
 		args = append(args, "-")
 	}
@@ -127,24 +138,9 @@ func run(c *command.Command, args []string) error {
 		return err
 	}
 	p.Add(project.Trees, treeFile)
-	if err := p.Write(pFile); err != nil {
-		return err
-	}
-
 	return nil
 }
 
-func openProject(name string) (*project.Project, error) {
-	p, err := project.Read(name)
-	if errors.Is(err, os.ErrNotExist) {
-		return project.New(), nil
-	}
-	if err != nil {
-		return nil, fmt.Errorf("unable ot open project %q: %v", name, err)
-	}
-	return p, nil
-}
-
 func readTreeFile(r io.Reader, name string) (*timetree.Collection, error) {
 	if name != "" {
 		f, err := os.Open(name)
@@ -0,0 +1,290 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package constraint implements a command to add
+// and check geographic constraints
+// for the nodes of the trees in a PhyGeo project.
+package constraint
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/constraint"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/timetree"
+)
+
+var Command = &command.Command{
+	Usage: `constraint [-i|--input <file>] [-f|--file <file>]
+	[--wait <seconds>] <project-file>`,
+	Short: "add and check node constraints",
+	Long: `
+Command constraint adds geographic constraints for the lineages of internal
+nodes of the trees in a PhyGeo project, and reports how the constraints are
+attached to the nodes of each tree.
+
+A node constraint is a range map that the lineage of a node must occupy at a
+given age (for example, a fossil assigned to a stem lineage, or a fixed pixel
+for an ancestor). The node is defined as the most recent common ancestor
+(MRCA) of a list of terminals, so the same constraint can be used with
+different trees. In a diffusion analysis, the constraint is attached to the
+branch of the lineage of the node that contains the age of the constraint
+(from the node towards the root), adding a new time stage at that age if
+required, and its density multiplies the conditional likelihood at that
+stage. Constraints are ignored in trees without the terminals, or if the age
+is younger than the node, or older than the stem of the tree.
+
+The argument of the command is the name of the project file.
+
+The flag --input, or -i, defines a file with the constraints to be added to
+the project. If a constraint with the same name is already defined in the
+project, it will be replaced. The constraints file is a tab-delimited file
+with the following columns:
+
+	constraint  the name of the constraint
+	terms       the terminals that define the node, separated by commas
+	age         the age of the constraint, in years
+	equator     the number of pixels at the equator of the pixelation
+	pixel       the ID of a pixel, at the time stage of the constraint
+	density     the density of the constraint at the pixel
+
+All the rows of a constraint must have the same terminals and age. Here is an
+example file:
+
+	# node constraints
+	constraint	terms	age	equator	pixel	density
+	stem felids	Panthera leo,Felis catus	25000000	360	17319	1.000000
+	stem felids	Panthera leo,Felis catus	25000000	360	17320	0.500000
+
+By default, the constraints will be stored in the constraints file of the
+project, or in a file called "constraints.tab" if the project does not have a
+constraints file. Use the flag --file, or -f, to define a different file. In
+the project, the constraints file is indicated with the "constraints" keyword.
+
+If no input file is given, the command only reports the constraints already
+defined in the project.
+
+While the constraints are added, the project is locked. If the project is
+locked by another process, the command fails. Use the flag --wait to set the
+maximum time, in seconds, to wait until the lock is released.
+
+The output will be printed in the standard output, as a tab-delimited table
+with the following columns:
+
+	tree        the name of the tree
+	constraint  the name of the constraint
+	node        the ID of the MRCA node (or "--" if not found)
+	age         the age of the constraint, in million years
+	pixels      the number of pixels of the constraint
+	status      "ok" if the constraint is attached to the tree,
+	            "no-terms" if the terminals are not in the tree,
+	            "young" if the constraint is younger than the node
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var inputFile string
+var consFile string
+var waitFlag float64
+
+func setFlags(c *command.Command) {
+	c.Flags().StringVar(&inputFile, "input", "", "")
+	c.Flags().StringVar(&inputFile, "i", "", "")
+	c.Flags().StringVar(&consFile, "file", "", "")
+	c.Flags().StringVar(&consFile, "f", "", "")
+	c.Flags().Float64Var(&waitFlag, "wait", 0, "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	pFile := args[0]
+	if inputFile == "" {
+		p, err := project.Read(pFile)
+		if err != nil {
+			return err
+		}
+		return constraints(c, p, pFile)
+	}
+
+	wait := time.Duration(waitFlag * float64(time.Second))
+	return project.Update(pFile, wait, func(p *project.Project) error {
+		return constraints(c, p, pFile)
+	})
+}
+
+// Constraints adds the constraints of the input file
+// to the project,
+// and reports the constraints of the project.
+func constraints(c *command.Command, p *project.Project, pFile string) error {
+	lsf := p.Path(project.Landscape)
+	if lsf == "" {
+		msg := fmt.Sprintf("landscape not defined in project %q", pFile)
+		return c.UsageError(msg)
+	}
+	landscape, err := readLandscape(lsf)
+	if err != nil {
+		return err
+	}
+
+	tf := p.Path(project.Trees)
+	if tf == "" {
+		msg := fmt.Sprintf("tree file not defined in project %q", pFile)
+		return c.UsageError(msg)
+	}
+	tc, err := readTreeFile(tf)
+	if err != nil {
+		return err
+	}
+
+	var coll *constraint.Collection
+	if cf := p.Path(project.Constraints); cf != "" {
+		coll, err = readConstraints(cf, landscape)
+		if err != nil {
+			return err
+		}
+	}
+
+	if inputFile != "" {
+		nc, err := readConstraints(inputFile, landscape)
+		if err != nil {
+			return err
+		}
+		if coll == nil {
+			coll = constraint.New(landscape.Pixelation())
+		}
+		for _, name := range nc.Names() {
+			cn := nc.Constraint(name)
+			if err := coll.Add(cn.Name, cn.Terms, cn.Age, cn.Range); err != nil {
+				return err
+			}
+		}
+
+		if consFile == "" {
+			consFile = p.Path(project.Constraints)
+			if consFile == "" {
+				consFile = "constraints.tab"
+			}
+		}
+		if err := writeConstraints(consFile, coll); err != nil {
+			return err
+		}
+		p.Add(project.Constraints, consFile)
+	}
+
+	if coll == nil {
+		return fmt.Errorf("constraints not defined in project %q", pFile)
+	}
+
+	return report(c, tc, coll)
+}
+
+func report(c *command.Command, tc *timetree.Collection, coll *constraint.Collection) error {
+	tab := csv.NewWriter(c.Stdout())
+	tab.Comma = '\t'
+	tab.UseCRLF = true
+
+	if err := tab.Write([]string{"tree", "constraint", "node", "age", "pixels", "status"}); err != nil {
+		return err
+	}
+	for _, tn := range tc.Names() {
+		t := tc.Tree(tn)
+		for _, name := range coll.Names() {
+			cn := coll.Constraint(name)
+			node := "--"
+			status := "no-terms"
+			if id := t.MRCA(cn.Terms...); id >= 0 {
+				node = strconv.Itoa(id)
+				status = "ok"
+				if cn.Age < t.Age(id) {
+					status = "young"
+				}
+			}
+			row := []string{
+				tn,
+				cn.Name,
+				node,
+				strconv.FormatFloat(float64(cn.Age)/timestage.MillionYears, 'f', 3, 64),
+				strconv.Itoa(len(cn.Range)),
+				status,
+			}
+			if err := tab.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	tab.Flush()
+	return tab.Error()
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func readConstraints(name string, landscape *model.TimePix) (*constraint.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := constraint.ReadTSV(f, landscape.Pixelation())
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func writeConstraints(name string, coll *constraint.Collection) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	if err := coll.TSV(f); err != nil {
+		return fmt.Errorf("while writing to %q: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package draw
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/js-arias/phygeo/probmap"
+)
+
+// ReadColorTable reads a table
+// with a value for each node of each tree.
+func readColorTable(name, field string) (map[string]map[int]float64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vals, err := parseColorTable(f, field)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+	return vals, nil
+}
+
+func parseColorTable(r io.Reader, field string) (map[string]map[int]float64, error) {
+	tsv := csv.NewReader(r)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+	tsv.FieldsPerRecord = -1
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(strings.TrimSpace(h))
+		fields[h] = i
+	}
+	field = strings.ToLower(field)
+	for _, h := range []string{"tree", "node", field} {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	vals := make(map[string]map[int]float64)
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+		if len(row) < len(head) {
+			return nil, fmt.Errorf("on row %d: got %d fields, want %d", ln, len(row), len(head))
+		}
+
+		f := "tree"
+		tn := strings.ToLower(strings.Join(strings.Fields(row[fields[f]]), " "))
+		if tn == "" {
+			continue
+		}
+
+		f = "node"
+		id, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+
+		f = field
+		v, err := strconv.ParseFloat(row[fields[f]], 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+
+		t, ok := vals[tn]
+		if !ok {
+			t = make(map[int]float64)
+			vals[tn] = t
+		}
+		if _, dup := t[id]; dup {
+			return nil, fmt.Errorf("on row %d: field %q: node %d already defined", ln, "node", id)
+		}
+		t[id] = v
+	}
+	if len(vals) == 0 {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+	return vals, nil
+}
+
+// GetGradient returns a color gradient
+// from its name.
+func getGradient(name string) (probmap.Gradienter, error) {
+	switch strings.ToLower(name) {
+	case "gray":
+		return probmap.HalfGrayScale{}, nil
+	case "gray2":
+		return probmap.LightGrayScale{}, nil
+	case "rainbow":
+		return probmap.RainbowPurpleToRed{}, nil
+	case "incandescent":
+		return probmap.Incandescent{}, nil
+	case "iridescent":
+		return probmap.Iridescent{}, nil
+	}
+	return nil, fmt.Errorf("unknown color scale %q", name)
+}
+
+// SetColor sets the color of each branch
+// scaling the node values
+// between the minimum and maximum value
+// of the tree.
+// Nodes without a value are drawn in light gray.
+func (s *svgTree) setColor(vals map[int]float64, gradient probmap.Gradienter) {
+	min := math.Inf(1)
+	max := math.Inf(-1)
+	for _, v := range vals {
+		if logColor {
+			if v <= 0 {
+				continue
+			}
+			v = math.Log10(v)
+		}
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+	}
+	s.root.setColor(vals, min, max, gradient)
+}
+
+func (n *node) setColor(vals map[int]float64, min, max float64, gradient probmap.Gradienter) {
+	c := color.RGBA{205, 205, 205, 255}
+	if v, ok := vals[n.id]; ok && (!logColor || v > 0) {
+		if logColor {
+			v = math.Log10(v)
+		}
+		var x float64
+		if max > min {
+			x = (v - min) / (max - min)
+		}
+		c = gradient.Gradient(x).(color.RGBA)
+	}
+	n.color = &c
+
+	for _, d := range n.desc {
+		d.setColor(vals, min, max, gradient)
+	}
+}
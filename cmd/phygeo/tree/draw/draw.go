@@ -14,6 +14,9 @@ import (
 	"strings"
 
 	"github.com/js-arias/command"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/pixkey"
+	"github.com/js-arias/phygeo/probmap"
 	"github.com/js-arias/phygeo/project"
 	"github.com/js-arias/phygeo/timestage"
 	"github.com/js-arias/timetree"
@@ -24,6 +27,9 @@ var Command = &command.Command{
 	[--scale <value>]
 	[--step <value>] [--time <number>] [--tick <tick-value>]
 	[--nonodes]
+	[--maps <file>] [--map-nodes <node-list>] [--map-width <value>]
+	[--bound <value>] [--key <key-file>]
+	[--color-by <file>] [--field <name>] [--color <scale>] [--log]
 	[-o|--output <out-prefix>]
 	<project-file>`,
 	Short: "draw project trees as SVG files",
@@ -56,6 +62,43 @@ ticks that will be labeled; for example, the default is "1,5,5" which means
 that small ticks will be added each scale unit, major ticks will be added
 every 5 scale units, and labels will be added every 5 scale units.
 
+If the flag --maps is defined with a pixel probability file (for example, a
+KDE reconstruction produced with "diff freq --kde"), a small map with the
+reconstruction of each node, at the age of the node, will be attached to the
+node, so the figure will summarize the reconstruction in a single image. The
+maps are embedded in the SVG file. By default, the maps of all the nodes in
+the reconstruction will be drawn. Use the flag --map-nodes to define the
+nodes to be drawn, as a list of node IDs separated by commas; for example,
+"0,1,6" will only draw the maps of nodes 0, 1 and 6. By default, each map will
+be 100 pixel units wide; use the flag --map-width to define a different
+value. When reading a KDE reconstruction, only the pixels in the 0.95 of the
+CDF will be drawn; use the flag --bound to change this bound value. By
+default, the maps will have a gray background; use the flag --key to define
+the landscape colors of the maps. The maps require a landscape defined in the
+project.
+
+If the flag --color-by is defined with a tab-delimited file, the branches
+will be colored using the values of each node in the file. The file must have
+the columns "tree", with the name of the tree, "node", with the ID of the node
+(the branch of a node is the branch from the node to its parent), and "value",
+with the value of the node. Use the flag --field to read the values from a
+different column, so any table with node values (for example, a table of
+entropies, range sizes, trait probabilities, or any other statistic) can be
+used. The values are scaled between the minimum and maximum values of each
+tree. Nodes without a value will be drawn in light gray. If the flag --log is
+given, the log10 of the values will be used (non-positive values will be
+ignored). By default, a rainbow color scale will be used; other color scales
+can be defined using the flag --color. Valid scale values are mostly based on
+Paul Tol color scales:
+
+	- iridescent  <https://personal.sron.nl/~pault/#fig:scheme_iridescent>
+	- rainbow     default value (from purple to red)
+	        <https://personal.sron.nl/~pault/#fig:scheme_rainbow_smooth>
+	- incandescent
+		<https://personal.sron.nl/~pault/#fig:scheme_incandescent>
+	- gray         a gray scale from black to mid gray (RGB: 127).
+	- gray2        a gray scale from black to light gray (RBG: 200).
+
 By default, the names of the trees will be used as the output file names. Use
 the flag -o, or --output, to define a prefix for the resulting files.
 	`,
@@ -70,6 +113,15 @@ var scale float64
 var treeName string
 var tickFlag string
 var outPrefix string
+var mapsFile string
+var mapNodes string
+var mapWidth int
+var bound float64
+var keyFile string
+var colorBy string
+var colorField string
+var colorScale string
+var logColor bool
 
 func setFlags(c *command.Command) {
 	c.Flags().BoolVar(&noNodes, "nonodes", false, "")
@@ -80,6 +132,15 @@ func setFlags(c *command.Command) {
 	c.Flags().StringVar(&outPrefix, "o", "", "")
 	c.Flags().StringVar(&treeName, "tree", "", "")
 	c.Flags().StringVar(&tickFlag, "tick", "", "")
+	c.Flags().StringVar(&mapsFile, "maps", "", "")
+	c.Flags().StringVar(&mapNodes, "map-nodes", "", "")
+	c.Flags().IntVar(&mapWidth, "map-width", 100, "")
+	c.Flags().Float64Var(&bound, "bound", 0.95, "")
+	c.Flags().StringVar(&keyFile, "key", "", "")
+	c.Flags().StringVar(&colorBy, "color-by", "", "")
+	c.Flags().StringVar(&colorField, "field", "value", "")
+	c.Flags().StringVar(&colorScale, "color", "rainbow", "")
+	c.Flags().BoolVar(&logColor, "log", false, "")
 }
 
 func run(c *command.Command, args []string) error {
@@ -106,10 +167,72 @@ func run(c *command.Command, args []string) error {
 		return err
 	}
 
+	var landscape *model.TimePix
+	var keys *pixkey.PixKey
+	var rec map[string]map[int]map[int]float64
+	var nodes []int
+	if mapsFile != "" {
+		if mapWidth < 2 {
+			return c.UsageError("flag --map-width: value must be at least 2")
+		}
+		nodes, err = parseMapNodes()
+		if err != nil {
+			return c.UsageError(err.Error())
+		}
+
+		lsf := p.Path(project.Landscape)
+		if lsf == "" {
+			msg := fmt.Sprintf("landscape not defined in project %q", args[0])
+			return c.UsageError(msg)
+		}
+		landscape, err = readLandscape(lsf)
+		if err != nil {
+			return err
+		}
+		if keyFile != "" {
+			keys, err = pixkey.Read(keyFile)
+			if err != nil {
+				return err
+			}
+		}
+
+		rec, err = readNodeMaps(mapsFile, landscape)
+		if err != nil {
+			return err
+		}
+	}
+
+	var colors map[string]map[int]float64
+	var gradient probmap.Gradienter
+	if colorBy != "" {
+		gradient, err = getGradient(colorScale)
+		if err != nil {
+			return c.UsageError(fmt.Sprintf("flag --color: %v", err))
+		}
+		colors, err = readColorTable(colorBy, colorField)
+		if err != nil {
+			return err
+		}
+	}
+
 	ls := tc.Names()
 	for _, tn := range ls {
 		t := tc.Tree(tn)
-		if err := writeSVG(tn, copyTree(t, stepX, tv.min, tv.max, tv.label)); err != nil {
+		st := copyTree(t, stepX, tv.min, tv.max, tv.label)
+		if v, ok := colors[strings.ToLower(tn)]; ok {
+			st.setColor(v, gradient)
+		}
+		if r, ok := rec[tn]; ok {
+			ages := make(map[int]int64)
+			for _, id := range t.Nodes() {
+				ages[id] = t.Age(id)
+			}
+			st.maps, err = newMinimap(r, ages, landscape, keys, nodes)
+			if err != nil {
+				return fmt.Errorf("tree %q: %v", tn, err)
+			}
+		}
+		if err := writeSVG(tn, st); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,305 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package draw
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/phygeo/internal/input"
+	"github.com/js-arias/phygeo/pixkey"
+	"github.com/js-arias/phygeo/probmap"
+)
+
+// A minimap is a thumbnail map
+// of the reconstruction of a node.
+type minimap struct {
+	width  int
+	height int
+
+	// maps of the nodes,
+	// as data URIs of PNG images
+	nodes map[int]string
+}
+
+// ReadNodeMaps reads the reconstruction of the nodes
+// of each tree
+// at the most recent time stage of each node.
+func readNodeMaps(name string, landscape *model.TimePix) (map[string]map[int]map[int]float64, error) {
+	r, err := input.Open(name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	rt, err := readRecon(r, landscape)
+	if err != nil {
+		return nil, fmt.Errorf("on input file %q: %v", name, err)
+	}
+	return rt, nil
+}
+
+var headerFields = []string{
+	"tree",
+	"node",
+	"age",
+	"type",
+	"equator",
+	"pixel",
+	"value",
+}
+
+func readRecon(r io.Reader, landscape *model.TimePix) (map[string]map[int]map[int]float64, error) {
+	tsv := csv.NewReader(r)
+	tsv.Comma = '\t'
+	tsv.Comment = '#'
+
+	head, err := tsv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range headerFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	type nodeRec struct {
+		age int64
+		rec map[int]float64
+	}
+
+	var tp string
+	nodes := make(map[string]map[int]*nodeRec)
+	for {
+		row, err := tsv.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tsv.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "tree"
+		tn := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if tn == "" {
+			continue
+		}
+		tn = strings.ToLower(tn)
+		t, ok := nodes[tn]
+		if !ok {
+			t = make(map[int]*nodeRec)
+			nodes[tn] = t
+		}
+
+		f = "node"
+		id, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+
+		f = "age"
+		age, err := strconv.ParseInt(row[fields[f]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+
+		// only the most recent stage is used
+		n, ok := t[id]
+		if !ok || age < n.age {
+			n = &nodeRec{
+				age: age,
+				rec: make(map[int]float64),
+			}
+			t[id] = n
+		}
+		if age > n.age {
+			continue
+		}
+
+		f = "type"
+		tpV := strings.ToLower(strings.Join(strings.Fields(row[fields[f]]), " "))
+		if tpV == "" {
+			return nil, fmt.Errorf("on row %d: field %q: expecting reconstruction type", ln, f)
+		}
+		if tp == "" {
+			tp = tpV
+		}
+		if tp != tpV {
+			return nil, fmt.Errorf("on row %d: field %q: got %q want %q", ln, f, tpV, tp)
+		}
+
+		f = "equator"
+		eq, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if eq != landscape.Pixelation().Equator() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid equator value %d", ln, f, eq)
+		}
+
+		f = "pixel"
+		px, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if px >= landscape.Pixelation().Len() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, px)
+		}
+
+		f = "value"
+		v, err := strconv.ParseFloat(row[fields[f]], 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		n.rec[px] = v
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+
+	rt := make(map[string]map[int]map[int]float64, len(nodes))
+	for tn, t := range nodes {
+		rt[tn] = make(map[int]map[int]float64, len(t))
+		for id, n := range t {
+			rt[tn][id] = n.rec
+		}
+	}
+
+	for _, t := range rt {
+		for _, rec := range t {
+			switch tp {
+			case "log-like":
+				// scale log-like values
+				max := -math.MaxFloat64
+				for _, p := range rec {
+					if p > max {
+						max = p
+					}
+				}
+				for px, p := range rec {
+					rec[px] = math.Exp(p - max)
+				}
+			case "freq":
+				// scale frequencies
+				var max float64
+				for _, p := range rec {
+					if p > max {
+						max = p
+					}
+				}
+				for px, p := range rec {
+					rec[px] = p / max
+				}
+			case "kde":
+				// remove pixels outside the bound
+				for px, p := range rec {
+					if p < 1-bound {
+						delete(rec, px)
+					}
+				}
+			}
+		}
+	}
+
+	return rt, nil
+}
+
+// NewMinimap draws the thumbnail maps
+// of the indicated nodes of a tree.
+// If no nodes are given,
+// all the nodes with a reconstruction will be drawn.
+func newMinimap(rec map[int]map[int]float64, ages map[int]int64, landscape *model.TimePix, keys *pixkey.PixKey, nodes []int) (*minimap, error) {
+	mm := &minimap{
+		width:  mapWidth,
+		height: mapWidth / 2,
+		nodes:  make(map[int]string),
+	}
+
+	if len(nodes) == 0 {
+		for id := range rec {
+			nodes = append(nodes, id)
+		}
+	}
+	for _, id := range nodes {
+		r, ok := rec[id]
+		if !ok {
+			continue
+		}
+		age, ok := ages[id]
+		if !ok {
+			continue
+		}
+
+		// the image is drawn at twice the resolution
+		// of the thumbnail
+		pm := &probmap.Image{
+			Cols:      2 * mapWidth,
+			Age:       age,
+			Landscape: landscape,
+			Keys:      keys,
+			Rng:       r,
+		}
+		pm.Format(nil)
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, pm); err != nil {
+			return nil, fmt.Errorf("when encoding map of node %d: %v", id, err)
+		}
+		mm.nodes[id] = "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+	return mm, nil
+}
+
+func readLandscape(name string) (*model.TimePix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tp, err := model.ReadTimePix(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+
+	return tp, nil
+}
+
+func parseMapNodes() ([]int, error) {
+	if mapNodes == "" {
+		return nil, nil
+	}
+
+	var nodes []int
+	for _, v := range strings.Split(mapNodes, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("flag --map-nodes: invalid node ID %q: %v", v, err)
+		}
+		nodes = append(nodes, id)
+	}
+	return nodes, nil
+}
@@ -7,6 +7,7 @@ package draw
 import (
 	"encoding/xml"
 	"fmt"
+	"image/color"
 	"io"
 	"math"
 	"strconv"
@@ -28,6 +29,10 @@ type node struct {
 
 	anc  *node
 	desc []*node
+
+	// branch color,
+	// if nil, the default color is used
+	color *color.RGBA
 }
 
 type svgTree struct {
@@ -43,6 +48,9 @@ type svgTree struct {
 
 	taxSz int
 	root  *node
+
+	// node maps
+	maps *minimap
 }
 
 func copyTree(t *timetree.Tree, xStep float64, minTick, maxTick, labelTick int) svgTree {
@@ -123,14 +131,21 @@ func (s *svgTree) prepare(n *node) {
 }
 
 func (s svgTree) draw(w io.Writer) error {
+	// margins for the node maps
+	var mx, my int
+	if s.maps != nil {
+		mx = s.maps.width
+		my = s.maps.height
+	}
+
 	fmt.Fprintf(w, "%s", xml.Header)
 	e := xml.NewEncoder(w)
 	svg := xml.StartElement{
 		Name: xml.Name{Local: "svg"},
 		Attr: []xml.Attr{
-			{Name: xml.Name{Local: "height"}, Value: strconv.Itoa(s.y + 5 + 2*yStep)},
+			{Name: xml.Name{Local: "height"}, Value: strconv.Itoa(s.y + 5 + 2*yStep + my)},
 			// assume that each character has 6 pixels wide
-			{Name: xml.Name{Local: "width"}, Value: strconv.Itoa(int(s.x) + s.taxSz*6)},
+			{Name: xml.Name{Local: "width"}, Value: strconv.Itoa(int(s.x) + s.taxSz*6 + mx)},
 			{Name: xml.Name{Local: "xmlns"}, Value: "http://www.w3.org/2000/svg"},
 		},
 	}
@@ -146,12 +161,18 @@ func (s svgTree) draw(w io.Writer) error {
 			{Name: xml.Name{Local: "font-size"}, Value: "10"},
 		},
 	}
+	if s.maps != nil {
+		g.Attr = append(g.Attr, xml.Attr{Name: xml.Name{Local: "transform"}, Value: fmt.Sprintf("translate(%d,%d)", mx, my)})
+	}
 	e.EncodeToken(g)
 
 	s.drawTimeRecs(e)
 	s.drawTimeScale(e)
 
 	s.root.draw(e)
+	if s.maps != nil {
+		s.root.drawMap(e, s.maps)
+	}
 	s.root.label(e)
 
 	e.EncodeToken(g.End())
@@ -262,6 +283,10 @@ func (n node) draw(e *xml.Encoder) {
 	if n.anc != nil {
 		ln.Attr[0].Value = strconv.Itoa(int(n.anc.x))
 	}
+	if n.color != nil {
+		rgb := fmt.Sprintf("rgb(%d,%d,%d)", n.color.R, n.color.G, n.color.B)
+		ln.Attr = append(ln.Attr, xml.Attr{Name: xml.Name{Local: "stroke"}, Value: rgb})
+	}
 	e.EncodeToken(ln)
 	e.EncodeToken(ln.End())
 
@@ -333,3 +358,43 @@ func (n node) label(e *xml.Encoder) {
 		d.label(e)
 	}
 }
+
+// DrawMap draws the map of the node
+// at the upper left of the node.
+func (n node) drawMap(e *xml.Encoder, mm *minimap) {
+	if uri, ok := mm.nodes[n.id]; ok {
+		x := int(n.x) - mm.width - 2
+		y := n.y - mm.height - 2
+		img := xml.StartElement{
+			Name: xml.Name{Local: "image"},
+			Attr: []xml.Attr{
+				{Name: xml.Name{Local: "x"}, Value: strconv.Itoa(x)},
+				{Name: xml.Name{Local: "y"}, Value: strconv.Itoa(y)},
+				{Name: xml.Name{Local: "width"}, Value: strconv.Itoa(mm.width)},
+				{Name: xml.Name{Local: "height"}, Value: strconv.Itoa(mm.height)},
+				{Name: xml.Name{Local: "href"}, Value: uri},
+			},
+		}
+		e.EncodeToken(img)
+		e.EncodeToken(img.End())
+
+		// map border
+		rect := xml.StartElement{
+			Name: xml.Name{Local: "rect"},
+			Attr: []xml.Attr{
+				{Name: xml.Name{Local: "x"}, Value: strconv.Itoa(x)},
+				{Name: xml.Name{Local: "y"}, Value: strconv.Itoa(y)},
+				{Name: xml.Name{Local: "width"}, Value: strconv.Itoa(mm.width)},
+				{Name: xml.Name{Local: "height"}, Value: strconv.Itoa(mm.height)},
+				{Name: xml.Name{Local: "fill"}, Value: "none"},
+				{Name: xml.Name{Local: "stroke-width"}, Value: "1"},
+			},
+		}
+		e.EncodeToken(rect)
+		e.EncodeToken(rect.End())
+	}
+
+	for _, d := range n.desc {
+		d.drawMap(e, mm)
+	}
+}
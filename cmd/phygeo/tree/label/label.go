@@ -0,0 +1,278 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package label implements a command to assign
+// and check clade labels
+// for the nodes of the trees in a PhyGeo project.
+package label
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/phygeo/clade"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/timetree"
+)
+
+var Command = &command.Command{
+	Usage: `label [--add <label>] [--delete <label>]
+	[-i|--input <file>] [-f|--file <file>] [--wait <seconds>]
+	<project-file> [<terminal>...]`,
+	Short: "assign and check clade labels",
+	Long: `
+Command label assigns names (labels) to clades of the trees in a PhyGeo
+project, and reports the nodes identified by each label in each tree.
+
+A clade label is defined by the most recent common ancestor (MRCA) of a list
+of terminals, so the same label can be used with different trees, and it is
+not affected by changes in the node IDs after a tree is edited. Commands with
+the flag --nodes accept labels in place of node IDs.
+
+The first argument of the command is the name of the project file.
+
+The flag --add defines the name of a label to be added to the project, using
+the terminals given as additional arguments of the command. If a label with
+the same name is already defined in the project, it will be replaced. As
+labels are used in place of node IDs, a label can not be a number, nor
+contain commas. Labels are case insensitive. For example:
+
+	phygeo tree label --add felids project.tab "Panthera leo" "Felis catus"
+
+The flag --delete removes a label from the project.
+
+The flag --input, or -i, defines a file with labels to be added to the
+project. The labels file is a tab-delimited file with the columns "clade",
+with the name of the label, and "taxon", with the name of a terminal of the
+clade (one terminal per row). This is the same format used by the flag
+--clades of the commands that aggregate results by clade, so the labels file
+of the project can be used with those commands. Here is an example file:
+
+	# clade labels
+	clade	taxon
+	felids	Panthera leo
+	felids	Felis catus
+	canids	Canis lupus
+	canids	Vulpes vulpes
+
+By default, the labels will be stored in the clades file of the project, or
+in a file called "clades.tab" if the project does not have a clades file. Use
+the flag --file, or -f, to define a different file. In the project, the clades
+file is indicated with the "clades" keyword.
+
+If no flag is given, the command only reports the labels already defined in
+the project.
+
+While the labels are updated, the project is locked. If the project is locked
+by another process, the command fails. Use the flag --wait to set the maximum
+time, in seconds, to wait until the lock is released.
+
+The output will be printed in the standard output, as a tab-delimited table
+with the following columns:
+
+	tree    the name of the tree
+	label   the name of the label
+	node    the ID of the MRCA node (or "--" if not found)
+	terms   the number of terminals of the label
+	status  "ok" if the label is found in the tree,
+	        "no-terms" if the terminals are not in the tree
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var addFlag string
+var delFlag string
+var inputFile string
+var labelFile string
+var waitFlag float64
+
+func setFlags(c *command.Command) {
+	c.Flags().StringVar(&addFlag, "add", "", "")
+	c.Flags().StringVar(&delFlag, "delete", "", "")
+	c.Flags().StringVar(&inputFile, "input", "", "")
+	c.Flags().StringVar(&inputFile, "i", "", "")
+	c.Flags().StringVar(&labelFile, "file", "", "")
+	c.Flags().StringVar(&labelFile, "f", "", "")
+	c.Flags().Float64Var(&waitFlag, "wait", 0, "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if addFlag != "" && len(args) < 2 {
+		return c.UsageError("flag --add: expecting terminal names")
+	}
+	if addFlag == "" && len(args) > 1 {
+		return c.UsageError("terminal names are only used with flag --add")
+	}
+
+	pFile := args[0]
+	if addFlag == "" && delFlag == "" && inputFile == "" {
+		p, err := project.Read(pFile)
+		if err != nil {
+			return err
+		}
+		return labels(c, p, pFile, args[1:])
+	}
+
+	wait := time.Duration(waitFlag * float64(time.Second))
+	return project.Update(pFile, wait, func(p *project.Project) error {
+		return labels(c, p, pFile, args[1:])
+	})
+}
+
+// Labels updates the clade labels of the project,
+// and reports the labels of the project.
+func labels(c *command.Command, p *project.Project, pFile string, terms []string) error {
+	tf := p.Path(project.Trees)
+	if tf == "" {
+		msg := fmt.Sprintf("tree file not defined in project %q", pFile)
+		return c.UsageError(msg)
+	}
+	tc, err := readTreeFile(tf)
+	if err != nil {
+		return err
+	}
+
+	var coll *clade.Collection
+	if lf := p.Path(project.Clades); lf != "" {
+		coll, err = readLabels(lf)
+		if err != nil {
+			return err
+		}
+	}
+
+	if addFlag != "" || delFlag != "" || inputFile != "" {
+		if coll == nil {
+			coll = clade.New()
+		}
+		if inputFile != "" {
+			nc, err := readLabels(inputFile)
+			if err != nil {
+				return err
+			}
+			for _, name := range nc.Names() {
+				lb := nc.Label(name)
+				if err := coll.Add(lb.Name, lb.Terms); err != nil {
+					return err
+				}
+			}
+		}
+		if delFlag != "" {
+			if coll.Label(delFlag) == nil {
+				return fmt.Errorf("label %q not defined in project %q", delFlag, pFile)
+			}
+			coll.Delete(delFlag)
+		}
+		if addFlag != "" {
+			if err := coll.Add(addFlag, terms); err != nil {
+				return c.UsageError(fmt.Sprintf("flag --add: %v", err))
+			}
+		}
+
+		if labelFile == "" {
+			labelFile = p.Path(project.Clades)
+			if labelFile == "" {
+				labelFile = "clades.tab"
+			}
+		}
+		if err := writeLabels(labelFile, coll); err != nil {
+			return err
+		}
+		p.Add(project.Clades, labelFile)
+	}
+
+	if coll == nil {
+		return fmt.Errorf("clade labels not defined in project %q", pFile)
+	}
+
+	return report(c, tc, coll)
+}
+
+func report(c *command.Command, tc *timetree.Collection, coll *clade.Collection) error {
+	tab := csv.NewWriter(c.Stdout())
+	tab.Comma = '\t'
+	tab.UseCRLF = true
+
+	if err := tab.Write([]string{"tree", "label", "node", "terms", "status"}); err != nil {
+		return err
+	}
+	for _, tn := range tc.Names() {
+		t := tc.Tree(tn)
+		for _, name := range coll.Names() {
+			lb := coll.Label(name)
+			node := "--"
+			status := "no-terms"
+			if id := coll.Node(t, name); id >= 0 {
+				node = strconv.Itoa(id)
+				status = "ok"
+			}
+			row := []string{
+				tn,
+				lb.Name,
+				node,
+				strconv.Itoa(len(lb.Terms)),
+				status,
+			}
+			if err := tab.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	tab.Flush()
+	return tab.Error()
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func readLabels(name string) (*clade.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	coll, err := clade.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("when reading %q: %v", name, err)
+	}
+
+	return coll, nil
+}
+
+func writeLabels(name string, coll *clade.Collection) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	if err := coll.TSV(f); err != nil {
+		return fmt.Errorf("while writing to %q: %v", name, err)
+	}
+	return nil
+}
@@ -10,6 +10,7 @@ package remove
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/js-arias/command"
 	"github.com/js-arias/earth/model"
@@ -20,7 +21,7 @@ import (
 )
 
 var Command = &command.Command{
-	Usage: "remove <project-file>",
+	Usage: "remove [--wait <seconds>] <project-file>",
 	Short: "remove terminals without data",
 	Long: `
 Command remove reads the trees and geographic ranges from a PhyGeo project and
@@ -30,35 +31,49 @@ To be valid, a terminal must have at least a single record defined on a pixel
 in which the landscape value has a weight greater than zero.
 
 The name of the removed terminal will be printed on the screen.
+
+While the trees are updated, the project is locked. If the project is locked
+by another process, the command fails. Use the flag --wait to set the maximum
+time, in seconds, to wait until the lock is released.
 	`,
-	Run: run,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+var waitFlag float64
+
+func setFlags(c *command.Command) {
+	c.Flags().Float64Var(&waitFlag, "wait", 0, "")
 }
 
 func run(c *command.Command, args []string) error {
 	if len(args) < 1 {
 		return c.UsageError("expecting project file")
 	}
+	wait := time.Duration(waitFlag * float64(time.Second))
+	return project.Update(args[0], wait, func(p *project.Project) error {
+		return removeTerms(c, p, args[0])
+	})
+}
 
-	p, err := project.Read(args[0])
-	if err != nil {
-		return err
-	}
-
+// RemoveTerms removes the terminals without valid records
+// from the trees of the project.
+func removeTerms(c *command.Command, p *project.Project, pFile string) error {
 	rf := p.Path(project.Ranges)
 	if rf == "" {
-		return nil
+		return project.SkipWrite
 	}
 	coll, err := readRanges(rf)
 	if err != nil {
 		return err
 	}
 	if coll == nil {
-		return nil
+		return project.SkipWrite
 	}
 
 	lsf := p.Path(project.Landscape)
 	if lsf == "" {
-		msg := fmt.Sprintf("paleolandscape not defined in project %q", args[0])
+		msg := fmt.Sprintf("paleolandscape not defined in project %q", pFile)
 		return c.UsageError(msg)
 	}
 	landscape, err := readLandscape(lsf)
@@ -68,7 +83,7 @@ func run(c *command.Command, args []string) error {
 
 	pwF := p.Path(project.PixWeight)
 	if pwF == "" {
-		msg := fmt.Sprintf("pixel weights not defined in project %q", args[0])
+		msg := fmt.Sprintf("pixel weights not defined in project %q", pFile)
 		return c.UsageError(msg)
 	}
 	pw, err := readPixWeights(pwF)
@@ -78,7 +93,7 @@ func run(c *command.Command, args []string) error {
 
 	tf := p.Path(project.Trees)
 	if tf == "" {
-		msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+		msg := fmt.Sprintf("tree file not defined in project %q", pFile)
 		return c.UsageError(msg)
 	}
 	tc, err := readTreeFile(tf)
@@ -125,12 +140,13 @@ func run(c *command.Command, args []string) error {
 	}
 
 	if !changes {
-		return nil
+		return project.SkipWrite
 	}
 
 	if err := writeTrees(tc, tf); err != nil {
 		return err
 	}
+	p.Add(project.Trees, tf)
 	return nil
 }
 
@@ -14,6 +14,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/js-arias/command"
 	"github.com/js-arias/phygeo/project"
@@ -22,7 +23,7 @@ import (
 )
 
 var Command = &command.Command{
-	Usage: `set [--tozero] [-i|--input <file>]
+	Usage: `set [--tozero] [-i|--input <file>] [--wait <seconds>]
 	<project>`,
 	Short: "set ages of the nodes of a tree",
 	Long: `
@@ -46,6 +47,10 @@ tree. The changes are made sequentially.
 As an usual operation is to set ages of all terminals to 0 (present), the flag
 --tozero is provided to automate this action. Note that the flag will set all
 terminals in the project.
+
+While the trees are updated, the project is locked. If the project is locked
+by another process, the command fails. Use the flag --wait to set the maximum
+time, in seconds, to wait until the lock is released.
 	`,
 	SetFlags: setFlags,
 	Run:      run,
@@ -53,11 +58,13 @@ terminals in the project.
 
 var toZero bool
 var input string
+var waitFlag float64
 
 func setFlags(c *command.Command) {
 	c.Flags().BoolVar(&toZero, "tozero", false, "")
 	c.Flags().StringVar(&input, "input", "", "")
 	c.Flags().StringVar(&input, "i", "", "")
+	c.Flags().Float64Var(&waitFlag, "wait", 0, "")
 }
 
 var changes = false
@@ -67,36 +74,35 @@ func run(c *command.Command, args []string) error {
 		return c.UsageError("expecting project file")
 	}
 
-	p, err := project.Read(args[0])
-	if err != nil {
-		return err
-	}
+	wait := time.Duration(waitFlag * float64(time.Second))
+	return project.Update(args[0], wait, func(p *project.Project) error {
+		tf := p.Path(project.Trees)
+		if tf == "" {
+			msg := fmt.Sprintf("tree file not defined in project %q", args[0])
+			return c.UsageError(msg)
+		}
 
-	tf := p.Path(project.Trees)
-	if tf == "" {
-		msg := fmt.Sprintf("tree file not defined in project %q", args[0])
-		return c.UsageError(msg)
-	}
+		tc, err := readTreeFile(tf)
+		if err != nil {
+			return err
+		}
 
-	tc, err := readTreeFile(tf)
-	if err != nil {
-		return err
-	}
+		if toZero {
+			termsToZero(tc)
+		} else {
+			setAges(tc)
+		}
 
-	if toZero {
-		termsToZero(tc)
-	} else {
-		setAges(tc)
-	}
+		if !changes {
+			return project.SkipWrite
+		}
 
-	if !changes {
+		if err := writeTrees(tc, tf); err != nil {
+			return err
+		}
+		p.Add(project.Trees, tf)
 		return nil
-	}
-
-	if err := writeTrees(tc, tf); err != nil {
-		return err
-	}
-	return nil
+	})
 }
 
 func termsToZero(c *timetree.Collection) {
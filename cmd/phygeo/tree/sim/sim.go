@@ -0,0 +1,301 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package sim implements a command to simulate
+// random trees
+// and add them to a PhyGeo project.
+package sim
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/phygeo/project"
+	"github.com/js-arias/phygeo/timestage"
+	"github.com/js-arias/timetree"
+	"github.com/js-arias/timetree/simulate"
+)
+
+var Command = &command.Command{
+	Usage: `sim [--trees <number>] [--terms <range>]
+	[--rate <value>] [--extinction <value>]
+	[--name <string>] [-f|--file <tree-file>] [--wait <seconds>]
+	--age <range> <project-file>`,
+	Short: "simulate random trees",
+	Long: `
+Command sim creates one or more random time-calibrated trees and adds them to
+a PhyGeo project. The simulated trees can be used to build null expectations
+for the empirical data of the project.
+
+The argument of the command is the name of the project file. If no project
+file exists, a new project will be created.
+
+The flag --age is required and provides the range of the root age, in million
+years. The range can be a single number (all simulated trees will have the
+same age) or a range separated by a comma; for example, "66,251" will simulate
+trees selecting root ages between 251 and 66 million years.
+
+By default, 100 trees will be created. Use the flag --trees to define a
+different number of trees.
+
+By default, each tree will have between 40 and 80 terminals. Use the flag
+--terms to define a range. The range can be a single number (all simulated
+trees will have exactly the indicated number of terminals) or a range
+separated by a comma; for example, "40,80" defines the default range.
+
+By default, trees will be simulated using a Yule (pure birth) process, with
+the speciation rate defined as spRate = (ln(terms) - ln(2)) / rootAge, where
+terms is the middle value of the terminal range. Use the flag --rate to set a
+different speciation rate (in events per million years). To simulate trees
+using a birth-death process, use the flag --extinction with the relative
+extinction rate (i.e., the extinction rate divided by the speciation rate), a
+value between 0 and 1. If the speciation rate is not given, it will be
+adjusted so the net diversification rate produces the expected number of
+terminals. In birth-death trees, extinct lineages are kept as terminals with
+an age older than the present.
+
+By default, trees will be named as "random-<number>". Use the flag --name to
+set a different tree name prefix.
+
+By default the trees will be stored in the tree file currently defined for the
+project. If the project does not have a tree file, a new one will be created
+with the name 'trees.tab'. A different tree file name can be defined using the
+flag --file, or -f. If this flag is used, and there is tree file already
+defined, then a new file with that name will be created, and used as the tree
+file for the project (previously defined trees will be kept).
+
+While the trees are added, the project is locked. If the project is locked by
+another process, the command fails. Use the flag --wait to set the maximum
+time, in seconds, to wait until the lock is released.
+	`,
+	SetFlags: setFlags,
+	Run:      run,
+}
+
+// maxTries is the maximum number of trials
+// to simulate a tree
+// with a valid number of terminals.
+const maxTries = 1000
+
+var numTrees int
+var rate float64
+var extFlag float64
+var ageFlag string
+var termFlag string
+var treeName string
+var treeFile string
+var waitFlag float64
+
+func setFlags(c *command.Command) {
+	c.Flags().IntVar(&numTrees, "trees", 100, "")
+	c.Flags().Float64Var(&rate, "rate", 0, "")
+	c.Flags().Float64Var(&extFlag, "extinction", 0, "")
+	c.Flags().StringVar(&ageFlag, "age", "", "")
+	c.Flags().StringVar(&termFlag, "terms", "40,80", "")
+	c.Flags().StringVar(&treeName, "name", "random", "")
+	c.Flags().StringVar(&treeFile, "file", "", "")
+	c.Flags().StringVar(&treeFile, "f", "", "")
+	c.Flags().Float64Var(&waitFlag, "wait", 0, "")
+}
+
+func run(c *command.Command, args []string) error {
+	if len(args) < 1 {
+		return c.UsageError("expecting project file")
+	}
+	if ageFlag == "" {
+		return c.UsageError("flag --age undefined")
+	}
+	if extFlag < 0 || extFlag >= 1 {
+		return c.UsageError("flag --extinction: value must be between 0 and 1")
+	}
+	if rate < 0 {
+		return c.UsageError("flag --rate: value must be positive")
+	}
+
+	min, max, err := parseFloatRange(ageFlag)
+	if err != nil {
+		return c.UsageError(fmt.Sprintf("flag --age: %v", err))
+	}
+	minAge := int64(min * timestage.MillionYears)
+	maxAge := int64(max * timestage.MillionYears)
+	if minAge <= 0 {
+		return c.UsageError("flag --age: root age must be greater than 0")
+	}
+
+	minTerm, maxTerm, err := parseIntRange(termFlag)
+	if err != nil {
+		return c.UsageError(fmt.Sprintf("flag --terms: %v", err))
+	}
+	if minTerm < 2 {
+		return c.UsageError("flag --terms: expecting at least two terminals")
+	}
+	avgTerm := minTerm + (maxTerm-minTerm)/2
+
+	pFile := args[0]
+	wait := time.Duration(waitFlag * float64(time.Second))
+	return project.UpdateNew(pFile, wait, func(p *project.Project) error {
+		var tc *timetree.Collection
+		if tf := p.Path(project.Trees); tf != "" {
+			tc, err = readTreeFile(tf)
+			if err != nil {
+				return fmt.Errorf("on project %q: %v", pFile, err)
+			}
+		}
+		if tc == nil {
+			tc = timetree.NewCollection()
+		}
+
+		for i := 0; i < numTrees; i++ {
+			name := fmt.Sprintf("%s-%d", treeName, i)
+			t, err := simTree(name, minAge, maxAge, minTerm, maxTerm, avgTerm)
+			if err != nil {
+				return err
+			}
+			if err := tc.Add(t); err != nil {
+				return fmt.Errorf("when adding tree %q: %v", name, err)
+			}
+		}
+
+		if treeFile == "" {
+			treeFile = p.Path(project.Trees)
+			if treeFile == "" {
+				treeFile = "trees.tab"
+			}
+		}
+
+		if err := writeTrees(tc); err != nil {
+			return err
+		}
+		p.Add(project.Trees, treeFile)
+		return nil
+	})
+}
+
+func simTree(name string, minAge, maxAge int64, minTerm, maxTerm, avgTerm int) (*timetree.Tree, error) {
+	for i := 0; i < maxTries; i++ {
+		root := maxAge
+		if d := maxAge - minAge; d > 0 {
+			root = rand.Int64N(d) + minAge
+		}
+
+		spRate := rate
+		if spRate == 0 {
+			// net diversification rate
+			r := (math.Log(float64(avgTerm)) - math.Log(2)) / (float64(root) / timestage.MillionYears)
+			spRate = r / (1 - extFlag)
+		}
+
+		var t *timetree.Tree
+		if extFlag > 0 {
+			t, _ = simulate.BirthDeath(name, spRate, spRate*extFlag, root, maxTerm*2)
+		} else {
+			t, _ = simulate.Yule(name, spRate, root, maxTerm*2)
+		}
+		if tm := len(t.Terms()); tm >= minTerm && tm <= maxTerm {
+			t.Format()
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("tree %q: unable to simulate a tree with %s terminals after %d trials", name, termFlag, maxTries)
+}
+
+func readTreeFile(name string) (*timetree.Collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := timetree.ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file %q: %v", name, err)
+	}
+	return c, nil
+}
+
+func writeTrees(tc *timetree.Collection) (err error) {
+	f, err := os.Create(treeFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	if err := tc.TSV(f); err != nil {
+		return fmt.Errorf("while writing to %q: %v", treeFile, err)
+	}
+	return nil
+}
+
+func parseFloatRange(s string) (min, max float64, err error) {
+	f := strings.Split(s, ",")
+	if len(f) == 1 {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid range %q: %v", s, err)
+		}
+		return v, v, nil
+	}
+
+	if len(f) != 2 {
+		return 0, 0, fmt.Errorf("invalid range %q: expecting two values", s)
+	}
+
+	min, err = strconv.ParseFloat(f[0], 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid range %q: %v", s, err)
+	}
+
+	max, err = strconv.ParseFloat(f[1], 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid range %q: %v", s, err)
+	}
+
+	if max < min {
+		min, max = max, min
+	}
+
+	return min, max, nil
+}
+
+func parseIntRange(s string) (min, max int, err error) {
+	f := strings.Split(s, ",")
+	if len(f) == 1 {
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid range %q: %v", s, err)
+		}
+		return v, v, nil
+	}
+
+	if len(f) != 2 {
+		return 0, 0, fmt.Errorf("invalid range %q: expecting two values", s)
+	}
+
+	min, err = strconv.Atoi(f[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid range %q: %v", s, err)
+	}
+
+	max, err = strconv.Atoi(f[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid range %q: %v", s, err)
+	}
+
+	if max < min {
+		min, max = max, min
+	}
+
+	return min, max, nil
+}
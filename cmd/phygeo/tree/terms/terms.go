@@ -7,9 +7,16 @@
 package terms
 
 import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
 	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/js-arias/command"
 	"github.com/js-arias/phygeo/project"
@@ -17,7 +24,9 @@ import (
 )
 
 var Command = &command.Command{
-	Usage: "terms [--tree <tree-name>] <project-file>",
+	Usage: `terms [--tree <tree-name>]
+	[--gbif <file>] [--creator <user>] [--email <address>]
+	[--match <file>] <project-file>`,
 	Short: "print a list of tree terminals",
 	Long: `
 Command terms reads the trees from a PhyGeo project and print the name of the
@@ -27,15 +36,55 @@ The argument of the command is the name of the project file.
 
 By default all terminals will be printed. If the flag --tree is set, only the
 terminals of the indicated tree will be printed.
+
+To query GBIF, the names of the terminals are converted to GBIF-ready names:
+underscores are replaced by spaces, and only the first letter is capitalized
+(for example, "Panthera_onca" will be "Panthera onca").
+
+If the flag --gbif is defined, a request body for an occurrence download from
+GBIF will be written in the indicated file. The request is a JSON document
+that selects all the records with coordinates, and without geospatial issues,
+of the terminal names. It can be sent to the GBIF occurrence download API, for
+example:
+
+	curl --user <user>:<password> -H "Content-Type: application/json" \
+		-X POST -d @<file> https://api.gbif.org/v1/occurrence/download/request
+
+The flag --creator sets the GBIF user that request the download, and the flag
+--email sets the address used to notify the user when the download is ready.
+The download is requested in the simple CSV format (a tab-delimited file), so
+the downloaded records can be added to the project with the command 'range
+add --format darwin --filter'.
+
+As GBIF matches the names exactly, synonyms or misspelled names might not be
+found. If the flag --match is defined, a tab-delimited file will be written
+with the queries to the GBIF species match API for each terminal, that can be
+used to check the names, or to find the accepted names of synonyms. The file
+contains the following columns:
+
+	- taxon  the name of the terminal in the tree
+	- name   the GBIF-ready name of the terminal
+	- query  the URL of the species match query
+
+The queries are verbose, so alternative matches (for example, other names
+with the same epithet) will also be reported by GBIF.
 	`,
 	SetFlags: setFlags,
 	Run:      run,
 }
 
 var treeName string
+var gbifFile string
+var creator string
+var email string
+var matchFile string
 
 func setFlags(c *command.Command) {
 	c.Flags().StringVar(&treeName, "tree", "", "")
+	c.Flags().StringVar(&gbifFile, "gbif", "", "")
+	c.Flags().StringVar(&creator, "creator", "", "")
+	c.Flags().StringVar(&email, "email", "", "")
+	c.Flags().StringVar(&matchFile, "match", "", "")
 }
 
 func run(c *command.Command, args []string) error {
@@ -61,6 +110,17 @@ func run(c *command.Command, args []string) error {
 		fmt.Fprintf(c.Stdout(), "%s\n", term)
 	}
 
+	if gbifFile != "" {
+		if err := writeDownload(gbifFile, ls); err != nil {
+			return err
+		}
+	}
+	if matchFile != "" {
+		if err := writeMatch(matchFile, ls); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -102,3 +162,128 @@ func makeTermList(name string) ([]string, error) {
 
 	return termList, nil
 }
+
+// GBIFName returns a GBIF-ready name
+// of a terminal.
+func gbifName(term string) string {
+	name := strings.Join(strings.Fields(strings.ReplaceAll(term, "_", " ")), " ")
+	name = strings.ToLower(name)
+	r, sz := utf8.DecodeRuneInString(name)
+	if r == utf8.RuneError {
+		return name
+	}
+	return string(unicode.ToUpper(r)) + name[sz:]
+}
+
+// A predicate is a query predicate
+// of the GBIF occurrence download API.
+type predicate struct {
+	Type       string      `json:"type"`
+	Key        string      `json:"key,omitempty"`
+	Value      string      `json:"value,omitempty"`
+	Values     []string    `json:"values,omitempty"`
+	Predicates []predicate `json:"predicates,omitempty"`
+}
+
+// A downloadRequest is the request body
+// of the GBIF occurrence download API.
+type downloadRequest struct {
+	Creator             string    `json:"creator,omitempty"`
+	NotificationAddress []string  `json:"notificationAddresses,omitempty"`
+	SendNotification    bool      `json:"sendNotification"`
+	Format              string    `json:"format"`
+	Predicate           predicate `json:"predicate"`
+}
+
+// WriteDownload writes the request body
+// of a GBIF occurrence download
+// for a list of terminals.
+func writeDownload(name string, terms []string) (err error) {
+	names := make([]string, 0, len(terms))
+	for _, tax := range terms {
+		names = append(names, gbifName(tax))
+	}
+
+	req := downloadRequest{
+		Creator: creator,
+		Format:  "SIMPLE_CSV",
+		Predicate: predicate{
+			Type: "and",
+			Predicates: []predicate{
+				{Type: "in", Key: "SCIENTIFIC_NAME", Values: names},
+				{Type: "equals", Key: "HAS_COORDINATE", Value: "true"},
+				{Type: "equals", Key: "HAS_GEOSPATIAL_ISSUE", Value: "false"},
+			},
+		},
+	}
+	if email != "" {
+		req.NotificationAddress = []string{email}
+		req.SendNotification = true
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(req); err != nil {
+		return fmt.Errorf("while writing to %q: %v", name, err)
+	}
+	return nil
+}
+
+// MatchURL is the URL of the GBIF species match API.
+const matchURL = "https://api.gbif.org/v1/species/match"
+
+// WriteMatch writes the queries to the GBIF species match API
+// for a list of terminals.
+func writeMatch(name string, terms []string) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	tsv := csv.NewWriter(w)
+	tsv.Comma = '\t'
+	tsv.UseCRLF = true
+	if err := tsv.Write([]string{"taxon", "name", "query"}); err != nil {
+		return fmt.Errorf("while writing to %q: %v", name, err)
+	}
+	for _, tax := range terms {
+		gn := gbifName(tax)
+		q := url.Values{}
+		q.Set("name", gn)
+		q.Set("verbose", "true")
+		row := []string{
+			tax,
+			gn,
+			matchURL + "?" + q.Encode(),
+		}
+		if err := tsv.Write(row); err != nil {
+			return fmt.Errorf("while writing to %q: %v", name, err)
+		}
+	}
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return fmt.Errorf("while writing to %q: %v", name, err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("while writing to %q: %v", name, err)
+	}
+	return nil
+}
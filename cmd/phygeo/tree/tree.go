@@ -9,10 +9,13 @@ package tree
 import (
 	"github.com/js-arias/command"
 	"github.com/js-arias/phygeo/cmd/phygeo/tree/add"
+	"github.com/js-arias/phygeo/cmd/phygeo/tree/constraint"
 	"github.com/js-arias/phygeo/cmd/phygeo/tree/draw"
+	"github.com/js-arias/phygeo/cmd/phygeo/tree/label"
 	"github.com/js-arias/phygeo/cmd/phygeo/tree/list"
 	"github.com/js-arias/phygeo/cmd/phygeo/tree/remove"
 	"github.com/js-arias/phygeo/cmd/phygeo/tree/set"
+	"github.com/js-arias/phygeo/cmd/phygeo/tree/sim"
 	"github.com/js-arias/phygeo/cmd/phygeo/tree/terms"
 )
 
@@ -23,10 +26,13 @@ var Command = &command.Command{
 
 func init() {
 	Command.Add(add.Command)
+	Command.Add(constraint.Command)
 	Command.Add(draw.Command)
+	Command.Add(label.Command)
 	Command.Add(list.Command)
 	Command.Add(remove.Command)
 	Command.Add(set.Command)
+	Command.Add(sim.Command)
 	Command.Add(terms.Command)
 
 	// help topics
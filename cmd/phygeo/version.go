@@ -0,0 +1,90 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"runtime"
+
+	"github.com/js-arias/command"
+	"github.com/js-arias/phygeo/version"
+)
+
+var versionCommand = &command.Command{
+	Usage: "version",
+	Short: "print version and compatibility information",
+	Long: `
+Command version prints the version of PhyGeo, the versions of the main
+libraries used to build it (earth, ranges, and timetree), the file formats
+supported by PhyGeo, and the features available in the binary.
+
+The version is read from the build information embedded in the binary. If
+PhyGeo was built from a git checkout, the short revision hash will be added to
+the version, with the suffix "+dirty" if the checkout has uncommitted changes.
+When the version is unknown it will be reported as "(devel)".
+
+The same version string is written in the header of the output files of
+PhyGeo, in a comment line starting with "# phygeo:", so the program used to
+produce a result file can be identified.
+
+PhyGeo files are tab-delimited text files identified by the columns of their
+header, rather than by a version number (the only exception are the
+reconstruction bundles, that are zip files). The command prints the formats
+that can be read and written by the current version.
+	`,
+	Run: runVersion,
+}
+
+// FileFormats are the file formats
+// supported by PhyGeo.
+var fileFormats = []struct {
+	name string
+	desc string
+}{
+	{"project", "project file with the paths of the datasets"},
+	{"geomotion", "plate motion model (earth/model)"},
+	{"landscape", "paleolandscape model (earth/model)"},
+	{"pixweight", "pixel weights (earth/pixweight)"},
+	{"ranges", "point and continuous range maps (ranges)"},
+	{"ageranges", "age-specific range maps"},
+	{"records", "occurrence records of the terminals"},
+	{"constraints", "geographic constraints of the nodes"},
+	{"clades", "clade labels"},
+	{"trees", "time calibrated trees (timetree)"},
+	{"stages", "time stages"},
+	{"down-pass", "conditional likelihoods of 'diff like'"},
+	{"particles", "stochastic maps of 'diff particles'"},
+	{"frequency", "pixel frequencies of 'diff freq'"},
+	{"bundle", "reconstruction bundle of 'diff bundle' (zip file)"},
+}
+
+func runVersion(c *command.Command, args []string) error {
+	w := bufio.NewWriter(c.Stdout())
+
+	fmt.Fprintf(w, "phygeo %s\n", version.String())
+	fmt.Fprintf(w, "%s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+
+	fmt.Fprintf(w, "\nlibraries:\n")
+	for _, m := range version.Deps() {
+		fmt.Fprintf(w, "\t%-30s %s\n", m.Path, m.Version)
+	}
+
+	fmt.Fprintf(w, "\nfile formats (tab-delimited, identified by header):\n")
+	for _, ff := range fileFormats {
+		fmt.Fprintf(w, "\t%-12s %s\n", ff.name, ff.desc)
+	}
+
+	fmt.Fprintf(w, "\nfeatures:\n")
+	fmt.Fprintf(w, "\t%-12s %s\n", "compression", "gzip")
+	fmt.Fprintf(w, "\t%-12s %s\n", "precision", "float64, float32 (flag --float32)")
+	fmt.Fprintf(w, "\t%-12s %s\n", "gpu", "not available")
+	fmt.Fprintf(w, "\t%-12s %d\n", "cpus", runtime.NumCPU())
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("while writing on standard output: %v", err)
+	}
+	return nil
+}
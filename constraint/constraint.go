@@ -0,0 +1,375 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package constraint implements a collection
+// of geographic constraints
+// for the lineages of a tree.
+//
+// A constraint is a range map
+// (for example,
+// a fossil assigned to a stem lineage,
+// or a fixed pixel)
+// that the lineage of a node must occupy
+// at a given age.
+// The node is defined
+// as the most recent common ancestor
+// of a set of terminals,
+// so the same constraint can be used
+// in different trees.
+package constraint
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/js-arias/earth"
+)
+
+// A Constraint is a range map
+// that the lineage of a node
+// must occupy at a given age.
+type Constraint struct {
+	// Name of the constraint
+	Name string
+
+	// Terms are the terminals
+	// that define the node
+	// as its most recent common ancestor
+	Terms []string
+
+	// Age of the constraint,
+	// in years
+	Age int64
+
+	// Range is the map of pixels
+	// (at the time stage of the age)
+	// to the density of the constraint.
+	Range map[int]float64
+}
+
+// A Collection is a collection of constraints
+// with an associated pixelation.
+type Collection struct {
+	pix  *earth.Pixelation
+	cons map[string]*Constraint
+}
+
+// New creates a new empty collection
+// using an isolatitude pixelation.
+func New(pix *earth.Pixelation) *Collection {
+	return &Collection{
+		pix:  pix,
+		cons: make(map[string]*Constraint),
+	}
+}
+
+// Add adds a constraint to the collection.
+// If a constraint with the same name
+// is already in the collection,
+// it will be replaced.
+func (c *Collection) Add(name string, terms []string, age int64, rng map[int]float64) error {
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" {
+		return errors.New("empty constraint name")
+	}
+	if age < 0 {
+		return fmt.Errorf("constraint %q: invalid age %d", name, age)
+	}
+
+	ts := canonTerms(terms)
+	if len(ts) == 0 {
+		return fmt.Errorf("constraint %q: without terminals", name)
+	}
+
+	var max float64
+	for px, p := range rng {
+		if px < 0 || px >= c.pix.Len() {
+			return fmt.Errorf("constraint %q: invalid pixel value %d", name, px)
+		}
+		if p > max {
+			max = p
+		}
+	}
+	if max == 0 {
+		return fmt.Errorf("constraint %q: empty range", name)
+	}
+
+	cr := make(map[int]float64, len(rng))
+	for px, p := range rng {
+		if p <= 0 {
+			continue
+		}
+		cr[px] = p / max
+	}
+	c.cons[strings.ToLower(name)] = &Constraint{
+		Name:  name,
+		Terms: ts,
+		Age:   age,
+		Range: cr,
+	}
+	return nil
+}
+
+// Constraint returns a constraint
+// of the collection.
+func (c *Collection) Constraint(name string) *Constraint {
+	name = strings.ToLower(strings.Join(strings.Fields(name), " "))
+	cn, ok := c.cons[name]
+	if !ok {
+		return nil
+	}
+
+	rng := make(map[int]float64, len(cn.Range))
+	for px, p := range cn.Range {
+		rng[px] = p
+	}
+	return &Constraint{
+		Name:  cn.Name,
+		Terms: slices.Clone(cn.Terms),
+		Age:   cn.Age,
+		Range: rng,
+	}
+}
+
+// Names returns the names of the constraints
+// in the collection,
+// sorted alphabetically.
+func (c *Collection) Names() []string {
+	names := make([]string, 0, len(c.cons))
+	for _, cn := range c.cons {
+		names = append(names, cn.Name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+	})
+	return names
+}
+
+// Pixelation returns the underlying pixelation
+// of the collection.
+func (c *Collection) Pixelation() *earth.Pixelation {
+	return c.pix
+}
+
+var headerFields = []string{
+	"constraint",
+	"terms",
+	"age",
+	"equator",
+	"pixel",
+	"density",
+}
+
+// ReadTSV reads a collection of constraints
+// from a TSV file.
+//
+// The TSV must contain the following columns:
+//
+//   - constraint, the name of the constraint
+//   - terms, the terminals that define the node,
+//     separated by commas
+//   - age, the age of the constraint
+//     (in years)
+//   - equator, for the number of pixels in the equator
+//   - pixel, the ID of a pixel (from the pixelation)
+//     at the time stage of the constraint
+//   - density, the density of the constraint at that pixel
+//
+// All the rows of a constraint
+// must have the same terminals and age.
+//
+// Here is an example file:
+//
+//	# node constraints
+//	constraint	terms	age	equator	pixel	density
+//	stem felids	Panthera leo,Felis catus	25000000	360	17319	1.000000
+//	stem felids	Panthera leo,Felis catus	25000000	360	17320	0.500000
+func ReadTSV(r io.Reader, pix *earth.Pixelation) (*Collection, error) {
+	tab := csv.NewReader(r)
+	tab.Comma = '\t'
+	tab.Comment = '#'
+
+	head, err := tab.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range headerFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	type rawCons struct {
+		name  string
+		terms []string
+		age   int64
+		rng   map[int]float64
+	}
+	var raw []*rawCons
+	rm := make(map[string]*rawCons)
+	for {
+		row, err := tab.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tab.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "equator"
+		eq, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if pix == nil {
+			pix = earth.NewPixelation(eq)
+		}
+		if pix.Equator() != eq {
+			return nil, fmt.Errorf("on row %d: field %q: got %d, want %d", ln, f, eq, pix.Equator())
+		}
+
+		f = "constraint"
+		name := strings.Join(strings.Fields(row[fields[f]]), " ")
+		if name == "" {
+			continue
+		}
+
+		f = "terms"
+		terms := canonTerms(strings.Split(row[fields[f]], ","))
+		if len(terms) == 0 {
+			return nil, fmt.Errorf("on row %d: field %q: without terminals", ln, f)
+		}
+
+		f = "age"
+		age, err := strconv.ParseInt(row[fields[f]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+
+		rc, ok := rm[strings.ToLower(name)]
+		if !ok {
+			rc = &rawCons{
+				name:  name,
+				terms: terms,
+				age:   age,
+				rng:   make(map[int]float64),
+			}
+			rm[strings.ToLower(name)] = rc
+			raw = append(raw, rc)
+		}
+		if !slices.Equal(rc.terms, terms) {
+			return nil, fmt.Errorf("on row %d: field %q: constraint %q: got %v, want %v", ln, "terms", name, terms, rc.terms)
+		}
+		if rc.age != age {
+			return nil, fmt.Errorf("on row %d: field %q: constraint %q: got %d, want %d", ln, "age", name, age, rc.age)
+		}
+
+		f = "pixel"
+		px, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if px < 0 || px >= pix.Len() {
+			return nil, fmt.Errorf("on row %d: field %q: invalid pixel value %d", ln, f, px)
+		}
+
+		f = "density"
+		d, err := strconv.ParseFloat(row[fields[f]], 64)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		rc.rng[px] = d
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+
+	c := New(pix)
+	for _, rc := range raw {
+		if err := c.Add(rc.name, rc.terms, rc.age, rc.rng); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// TSV encodes the constraints of a collection
+// to a TSV file.
+func (c *Collection) TSV(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# node constraints\n")
+	fmt.Fprintf(bw, "# data save on: %s\n", time.Now().Format(time.RFC3339))
+
+	tab := csv.NewWriter(bw)
+	tab.Comma = '\t'
+	tab.UseCRLF = true
+
+	if err := tab.Write(headerFields); err != nil {
+		return fmt.Errorf("unable to write header: %v", err)
+	}
+
+	eq := strconv.Itoa(c.pix.Equator())
+	for _, nm := range c.Names() {
+		cn := c.cons[strings.ToLower(nm)]
+		pixels := make([]int, 0, len(cn.Range))
+		for px := range cn.Range {
+			pixels = append(pixels, px)
+		}
+		slices.Sort(pixels)
+
+		terms := strings.Join(cn.Terms, ",")
+		age := strconv.FormatInt(cn.Age, 10)
+		for _, px := range pixels {
+			row := []string{
+				cn.Name,
+				terms,
+				age,
+				eq,
+				strconv.Itoa(px),
+				strconv.FormatFloat(cn.Range[px], 'f', 6, 64),
+			}
+			if err := tab.Write(row); err != nil {
+				return fmt.Errorf("unable to write data: %v", err)
+			}
+		}
+	}
+
+	tab.Flush()
+	if err := tab.Error(); err != nil {
+		return fmt.Errorf("unable to write data: %v", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("unable to write data: %v", err)
+	}
+	return nil
+}
+
+// CanonTerms returns the terminal names
+// in its canonical form,
+// sorted and without duplicates.
+func canonTerms(terms []string) []string {
+	ts := make([]string, 0, len(terms))
+	for _, t := range terms {
+		t = strings.Join(strings.Fields(t), " ")
+		if t == "" {
+			continue
+		}
+		ts = append(ts, t)
+	}
+	slices.Sort(ts)
+	return slices.Compact(ts)
+}
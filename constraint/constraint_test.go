@@ -0,0 +1,108 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package constraint_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/js-arias/earth"
+	"github.com/js-arias/phygeo/constraint"
+)
+
+func TestReadTSV(t *testing.T) {
+	data := `# node constraints
+constraint	terms	age	equator	pixel	density
+stem felids	Panthera leo,Felis catus	25000000	360	17319	1.000000
+stem felids	Panthera leo,Felis catus	25000000	360	17320	0.500000
+Carnivora	Felis catus,Canis lupus	40000000	360	19117	2.000000
+`
+	c, err := constraint.ReadTSV(strings.NewReader(data), nil)
+	if err != nil {
+		t.Fatalf("unable to read data: %v", err)
+	}
+	testCollection(t, "read", c)
+
+	var buf bytes.Buffer
+	if err := c.TSV(&buf); err != nil {
+		t.Fatalf("unable to write data: %v", err)
+	}
+	c, err = constraint.ReadTSV(&buf, nil)
+	if err != nil {
+		t.Fatalf("unable to read written data: %v", err)
+	}
+	testCollection(t, "write", c)
+}
+
+func TestReadTSVError(t *testing.T) {
+	tests := map[string]string{
+		"different ages": `constraint	terms	age	equator	pixel	density
+stem felids	Panthera leo,Felis catus	25000000	360	17319	1.000000
+stem felids	Panthera leo,Felis catus	20000000	360	17320	1.000000
+`,
+		"different terminals": `constraint	terms	age	equator	pixel	density
+stem felids	Panthera leo,Felis catus	25000000	360	17319	1.000000
+stem felids	Panthera leo	25000000	360	17320	1.000000
+`,
+		"empty range": `constraint	terms	age	equator	pixel	density
+stem felids	Panthera leo,Felis catus	25000000	360	17319	0
+`,
+	}
+	for name, data := range tests {
+		if _, err := constraint.ReadTSV(strings.NewReader(data), nil); err == nil {
+			t.Errorf("%s: expecting error", name)
+		}
+	}
+}
+
+func TestAdd(t *testing.T) {
+	c := constraint.New(earth.NewPixelation(360))
+	if err := c.Add("stem felids", []string{"Panthera leo", "Felis catus", "Felis  catus"}, 25_000_000, map[int]float64{17319: 4, 17320: 2, 17321: 0}); err != nil {
+		t.Fatalf("unable to add constraint: %v", err)
+	}
+	if err := c.Add("empty", []string{"Panthera leo"}, 1, nil); err == nil {
+		t.Errorf("empty range: expecting error")
+	}
+
+	cn := c.Constraint("Stem Felids")
+	if cn == nil {
+		t.Fatalf("constraint %q not found", "stem felids")
+	}
+	if got, want := cn.Terms, []string{"Felis catus", "Panthera leo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("terms: got %v, want %v", got, want)
+	}
+	if got, want := cn.Range, map[int]float64{17319: 1, 17320: 0.5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("range: got %v, want %v", got, want)
+	}
+}
+
+func testCollection(t testing.TB, name string, c *constraint.Collection) {
+	t.Helper()
+
+	if got, want := c.Names(), []string{"Carnivora", "stem felids"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: names: got %v, want %v", name, got, want)
+	}
+
+	cn := c.Constraint("stem felids")
+	if cn == nil {
+		t.Fatalf("%s: constraint %q not found", name, "stem felids")
+	}
+	if got, want := cn.Terms, []string{"Felis catus", "Panthera leo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: terms: got %v, want %v", name, got, want)
+	}
+	if cn.Age != 25_000_000 {
+		t.Errorf("%s: age: got %d, want %d", name, cn.Age, 25_000_000)
+	}
+	if got, want := cn.Range, map[int]float64{17319: 1, 17320: 0.5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: range: got %v, want %v", name, got, want)
+	}
+
+	cn = c.Constraint("carnivora")
+	if got, want := cn.Range, map[int]float64{19117: 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: range: got %v, want %v", name, got, want)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package diffusion
+
+import (
+	"sync"
+
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/stat/dist"
+)
+
+// DefaultCacheSize is the default number of kernels
+// stored in a PDFCache.
+const DefaultCacheSize = 256
+
+// A PDFCache stores the discretized spherical normals
+// used by the time stages of a tree,
+// so they can be reused between different evaluations
+// (for example, during a parameter search).
+//
+// As a normal depends only on the concentration parameter
+// scaled by the duration of the time stage,
+// the cache is keyed by that scaled value.
+// Mixture kernels are keyed by the scaled value
+// and the weight of the long-distance component.
+//
+// The cache is bounded:
+// when the number of stored kernels
+// is larger than the size of the cache,
+// the least recently used kernels are removed.
+// Use Reset to remove all the kernels
+// at the end of a search session.
+//
+// The cache also stores the generator
+// used by the CTMC engine.
+type PDFCache struct {
+	mu   sync.Mutex
+	pix  *earth.Pixelation
+	size int
+	tick uint64
+	pdf  map[float64]*cacheEntry[dist.Normal]
+	mix  map[[2]float64]*cacheEntry[Mixture]
+	gen  *Generator
+}
+
+// A cacheEntry is a kernel stored in the cache,
+// with the time of its last use.
+type cacheEntry[T any] struct {
+	v    T
+	used uint64
+}
+
+// NewPDFCache returns a new empty cache
+// for a given pixelation,
+// with the default size.
+func NewPDFCache(pix *earth.Pixelation) *PDFCache {
+	return NewPDFCacheSize(pix, DefaultCacheSize)
+}
+
+// NewPDFCacheSize returns a new empty cache
+// for a given pixelation,
+// that stores at most the given number of kernels
+// of each type.
+func NewPDFCacheSize(pix *earth.Pixelation, size int) *PDFCache {
+	if size < 1 {
+		size = 1
+	}
+	return &PDFCache{
+		pix:  pix,
+		size: size,
+		pdf:  make(map[float64]*cacheEntry[dist.Normal]),
+		mix:  make(map[[2]float64]*cacheEntry[Mixture]),
+	}
+}
+
+// Normal returns a spherical normal
+// with the given concentration parameter
+// (in 1/radian^2 units).
+// If the normal is not in the cache,
+// it will be created.
+func (c *PDFCache) Normal(lambda float64) dist.Normal {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.normal(lambda)
+}
+
+func (c *PDFCache) normal(lambda float64) dist.Normal {
+	c.tick++
+	if e, ok := c.pdf[lambda]; ok {
+		e.used = c.tick
+		return e.v
+	}
+	n := dist.NewNormal(lambda, c.pix)
+	evict(c.pdf, c.size-1)
+	c.pdf[lambda] = &cacheEntry[dist.Normal]{v: n, used: c.tick}
+	return n
+}
+
+// Mixture returns a mixture kernel
+// with the given concentration parameter
+// (in 1/radian^2 units)
+// and weight of the long-distance component.
+// If the kernel is not in the cache,
+// it will be created.
+func (c *PDFCache) Mixture(lambda, w float64) Mixture {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := [2]float64{lambda, w}
+	n := c.normal(lambda)
+	if e, ok := c.mix[key]; ok {
+		e.used = c.tick
+		return e.v
+	}
+	m := NewMixture(n, w)
+	evict(c.mix, c.size-1)
+	c.mix[key] = &cacheEntry[Mixture]{v: m, used: c.tick}
+	return m
+}
+
+// Evict removes the least recently used entries
+// of a cache map,
+// until the map has at most the given number of entries.
+func evict[K comparable, T any](m map[K]*cacheEntry[T], max int) {
+	for len(m) > max {
+		var old K
+		first := true
+		var used uint64
+		for k, e := range m {
+			if first || e.used < used {
+				old = k
+				used = e.used
+				first = false
+			}
+		}
+		delete(m, old)
+	}
+}
+
+// Len returns the number of kernels
+// stored in the cache.
+func (c *PDFCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.pdf) + len(c.mix)
+}
+
+// Reset removes all the kernels stored in the cache.
+// The generator of the CTMC engine is kept,
+// as it depends only on the pixelation.
+func (c *PDFCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pdf = make(map[float64]*cacheEntry[dist.Normal])
+	c.mix = make(map[[2]float64]*cacheEntry[Mixture])
+}
+
+// Generator returns the generator
+// of the continuous-time Markov chain
+// of the pixelation.
+// The generator is built the first time it is requested.
+func (c *PDFCache) Generator() *Generator {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.gen == nil {
+		c.gen = NewGenerator(c.pix)
+	}
+	return c.gen
+}
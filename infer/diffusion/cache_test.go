@@ -0,0 +1,52 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package diffusion_test
+
+import (
+	"testing"
+
+	"github.com/js-arias/earth"
+	"github.com/js-arias/phygeo/infer/diffusion"
+)
+
+func TestPDFCache(t *testing.T) {
+	pix := earth.NewPixelation(30)
+	c := diffusion.NewPDFCacheSize(pix, 3)
+
+	// the same kernel is reused
+	for i := 0; i < 5; i++ {
+		c.Normal(100)
+	}
+	if c.Len() != 1 {
+		t.Errorf("len: got %d, want %d", c.Len(), 1)
+	}
+
+	c.Normal(50)
+	if n := c.Normal(50); n.Lambda() != 50 {
+		t.Errorf("lambda: got %g, want %g", n.Lambda(), 50.0)
+	}
+	if c.Len() != 2 {
+		t.Errorf("len: got %d, want %d", c.Len(), 2)
+	}
+
+	// the cache is bounded
+	for _, l := range []float64{10, 20, 30, 40} {
+		c.Normal(l)
+	}
+	if c.Len() != 3 {
+		t.Errorf("bounded len: got %d, want %d", c.Len(), 3)
+	}
+
+	c.Mixture(40, 0.1)
+	c.Mixture(40, 0.1)
+	if c.Len() != 4 {
+		t.Errorf("len with mixture: got %d, want %d", c.Len(), 4)
+	}
+
+	c.Reset()
+	if c.Len() != 0 {
+		t.Errorf("reset: got %d, want %d", c.Len(), 0)
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package diffusion
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/js-arias/earth"
+)
+
+// An Engine is the method used to integrate
+// the diffusion over a time stage
+// when calculating the conditional likelihoods.
+type Engine string
+
+// Valid engines.
+const (
+	// Convolution uses the discretized dispersal kernel
+	// (a spherical normal, or a mixture kernel)
+	// as a function of the great circle distance
+	// between pixels.
+	// It is the default engine.
+	Convolution Engine = "convolution"
+
+	// CTMC uses a continuous-time Markov chain
+	// between neighbor pixels,
+	// with the transition probabilities
+	// calculated as a matrix exponential
+	// (see Generator).
+	// It is exact for the discrete pixelation,
+	// but as the cost grows with the number of pixels
+	// and the expected number of movements between pixels,
+	// it is only recommended for coarse pixelations.
+	CTMC Engine = "ctmc"
+)
+
+// ParseEngine returns an engine from its name.
+// An empty name returns the convolution engine.
+func ParseEngine(name string) (Engine, error) {
+	switch e := Engine(strings.ToLower(strings.TrimSpace(name))); e {
+	case "":
+		return Convolution, nil
+	case Convolution, CTMC:
+		return e, nil
+	}
+	return "", fmt.Errorf("unknown engine %q", name)
+}
+
+// NeighborDist is the maximum distance,
+// in units of the pixel size,
+// between two pixels to be considered as neighbors.
+const neighborDist = 1.5
+
+// A Generator is the infinitesimal generator
+// (i.e., the rate matrix)
+// of a continuous-time Markov chain
+// that approximates a spherical Brownian motion
+// on a pixelation,
+// with a unit variance per unit of time.
+//
+// A particle can only move between neighbor pixels.
+// The rate between two neighbor pixels i and j is
+//
+//	q(i,j) = 2 / (k * d(i,j)^2)
+//
+// where d is the great circle distance
+// (in radians)
+// between the pixels,
+// and k is the mean number of neighbors of both pixels,
+// so the expected squared displacement
+// per unit of time
+// is equal to the one of a Brownian motion.
+// As the rates are symmetric,
+// the stationary distribution is uniform.
+//
+// As the variance of a spherical normal
+// with concentration λ/t
+// (see dist.Normal)
+// is t/λ,
+// the transition probabilities of a time stage
+// are given by exp(t/λ * Q).
+type Generator struct {
+	// neighbors and rates of each pixel,
+	// in compressed sparse row form
+	start []int
+	neigh []int
+	rate  []float64
+
+	// exit rate of each pixel
+	exit []float64
+
+	// maximum exit rate
+	max float64
+}
+
+// NewGenerator returns the generator
+// of a pixelation.
+func NewGenerator(pix *earth.Pixelation) *Generator {
+	maxDist := earth.ToRad(pix.Step()) * neighborDist
+
+	neigh := make([][]int, pix.Len())
+	dist := make([][]float64, pix.Len())
+	for r := 0; r < pix.Rings(); r++ {
+		first := pix.FirstPix(r).ID()
+		for i := first; i < first+pix.PixPerRing(r); i++ {
+			pi := pix.ID(i).Point()
+			for nr := r - 1; nr <= r+1; nr++ {
+				if nr < 0 || nr >= pix.Rings() {
+					continue
+				}
+				nf := pix.FirstPix(nr).ID()
+				for j := nf; j < nf+pix.PixPerRing(nr); j++ {
+					if j == i {
+						continue
+					}
+					d := earth.Distance(pi, pix.ID(j).Point())
+					if d > maxDist {
+						continue
+					}
+					neigh[i] = append(neigh[i], j)
+					dist[i] = append(dist[i], d)
+				}
+			}
+		}
+	}
+
+	g := &Generator{
+		start: make([]int, pix.Len()+1),
+		exit:  make([]float64, pix.Len()),
+	}
+	for i, ns := range neigh {
+		g.start[i] = len(g.neigh)
+		for x, j := range ns {
+			k := float64(len(ns)+len(neigh[j])) / 2
+			d := dist[i][x]
+			q := 2 / (k * d * d)
+			g.neigh = append(g.neigh, j)
+			g.rate = append(g.rate, q)
+			g.exit[i] += q
+		}
+		if g.exit[i] > g.max {
+			g.max = g.exit[i]
+		}
+	}
+	g.start[len(neigh)] = len(g.neigh)
+	return g
+}
+
+// Len returns the number of pixels
+// of the generator.
+func (g *Generator) Len() int {
+	return len(g.exit)
+}
+
+// MaxPoisson is the maximum expected number of events
+// of each step of the uniformization.
+const maxPoisson = 32
+
+// ExpTol is the truncation error
+// of the Poisson series of the uniformization.
+const expTol = 1e-12
+
+// Exp returns the product of the matrix exponential
+// exp(tau * Q)
+// and a vector v.
+// As the generator is symmetric,
+// the i-th value of the result
+// is the expected value of v
+// for a particle starting at the pixel i,
+// after a time tau.
+//
+// It uses the uniformization method,
+// splitting the time interval in steps,
+// so each step has a small expected number of events.
+func (g *Generator) Exp(tau float64, v []float64) []float64 {
+	out := make([]float64, len(v))
+	copy(out, v)
+	if tau <= 0 || g.max == 0 {
+		return out
+	}
+	if math.IsInf(tau, 1) {
+		// the stationary distribution
+		var sum float64
+		for _, x := range v {
+			sum += x
+		}
+		for i := range out {
+			out[i] = sum / float64(len(out))
+		}
+		return out
+	}
+
+	lt := g.max * tau
+	steps := int(math.Ceil(lt / maxPoisson))
+	h := lt / float64(steps)
+
+	acc := make([]float64, len(v))
+	cur := make([]float64, len(v))
+	next := make([]float64, len(v))
+	for s := 0; s < steps; s++ {
+		copy(cur, out)
+		p := math.Exp(-h)
+		cum := p
+		for i, x := range cur {
+			acc[i] = p * x
+		}
+		for k := 1; cum < 1-expTol; k++ {
+			g.uniform(cur, next)
+			cur, next = next, cur
+			p *= h / float64(k)
+			cum += p
+			for i, x := range cur {
+				acc[i] += p * x
+			}
+		}
+		out, acc = acc, out
+	}
+	return out
+}
+
+// Uniform sets dst as the product
+// of the uniformized transition matrix
+// P = I + Q/max
+// and the vector v.
+func (g *Generator) uniform(v, dst []float64) {
+	for i := range dst {
+		x := v[i] * (1 - g.exit[i]/g.max)
+		for e := g.start[i]; e < g.start[i+1]; e++ {
+			x += g.rate[e] / g.max * v[g.neigh[e]]
+		}
+		dst[i] = x
+	}
+}
+
+// CTMCConditional calculates the conditional likelihood
+// at a time stage
+// using the continuous-time Markov chain
+// of the tree.
+// Pixels with a vanishing likelihood
+// are ignored.
+func (ts *timeStage) ctmcConditional(t *Tree, endLike []likePix, max float64, res []likeResult) map[int]float64 {
+	n := t.gen.Len()
+	like := make([]float64, n)
+	weight := make([]float64, n)
+	var sumLike, sumWeight float64
+	for _, cL := range endLike {
+		like[cL.px] = cL.like
+		weight[cL.px] = cL.weight
+		sumLike += cL.like
+		sumWeight += cL.weight
+	}
+
+	tau := math.Inf(1)
+	if ts.node.lambda > 0 {
+		tau = ts.duration / ts.node.lambda
+	}
+	like = t.gen.Exp(tau, like)
+	weight = t.gen.Exp(tau, weight)
+
+	// long-distance component of a mixture kernel
+	var w float64
+	if m, ok := ts.pdf.(Mixture); ok {
+		w = m.Weight()
+	}
+
+	logLike := make(map[int]float64, len(res))
+	for _, r := range res {
+		sum := (1-w)*like[r.px] + w*sumLike/float64(n)
+		scale := (1-w)*weight[r.px] + w*sumWeight/float64(n)
+		if sum <= 0 || scale <= 0 {
+			continue
+		}
+		logLike[r.px] = math.Log(sum) + max - math.Log(scale)
+	}
+	return logLike
+}
@@ -0,0 +1,104 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package diffusion_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/js-arias/earth"
+	"github.com/js-arias/phygeo/infer/diffusion"
+)
+
+func TestParseEngine(t *testing.T) {
+	tests := map[string]diffusion.Engine{
+		"":            diffusion.Convolution,
+		"convolution": diffusion.Convolution,
+		"CTMC":        diffusion.CTMC,
+	}
+	for name, want := range tests {
+		got, err := diffusion.ParseEngine(name)
+		if err != nil {
+			t.Errorf("engine %q: unexpected error: %v", name, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("engine %q: got %q, want %q", name, got, want)
+		}
+	}
+
+	if _, err := diffusion.ParseEngine("fft"); err == nil {
+		t.Errorf("engine %q: expecting error", "fft")
+	}
+}
+
+func TestGeneratorExp(t *testing.T) {
+	pix := earth.NewPixelation(30)
+	g := diffusion.NewGenerator(pix)
+	if g.Len() != pix.Len() {
+		t.Fatalf("generator size: got %d, want %d", g.Len(), pix.Len())
+	}
+
+	start := pix.Pixel(0, 0).ID()
+	v := make([]float64, pix.Len())
+	v[start] = 1
+
+	for _, tau := range []float64{0.05, 0.1, 0.2} {
+		p := g.Exp(tau, v)
+
+		var sum, sq float64
+		for px, x := range p {
+			if x < -1e-12 {
+				t.Errorf("tau %.3f: pixel %d: negative probability %g", tau, px, x)
+			}
+			d := earth.Distance(pix.ID(start).Point(), pix.ID(px).Point())
+			sum += x
+			sq += x * d * d
+		}
+		if math.Abs(sum-1) > 1e-9 {
+			t.Errorf("tau %.3f: sum: got %.12f, want 1", tau, sum)
+		}
+
+		// the squared displacement of a Brownian motion
+		// on a sphere
+		// is 2*tau for small times
+		want := 2 * tau
+		if math.Abs(sq-want)/want > 0.2 {
+			t.Errorf("tau %.3f: squared displacement: got %.6f, want %.6f", tau, sq, want)
+		}
+	}
+
+	p := g.Exp(math.Inf(1), v)
+	for px, x := range p {
+		if math.Abs(x-1/float64(pix.Len())) > 1e-12 {
+			t.Errorf("stationary: pixel %d: got %g, want %g", px, x, 1/float64(pix.Len()))
+			break
+		}
+	}
+}
+
+func TestCTMCEngine(t *testing.T) {
+	tree, base := testParam(t)
+
+	for _, ld := range []float64{0, 0.01} {
+		p := base
+		p.LongDist = ld
+		conv := diffusion.New(tree, p).DownPass()
+
+		p.Engine = diffusion.CTMC
+		ct := diffusion.New(tree, p)
+		if e := ct.Engine(); e != diffusion.CTMC {
+			t.Errorf("long distance %.2f: engine: got %q, want %q", ld, e, diffusion.CTMC)
+		}
+		ctmc := ct.DownPass()
+
+		if math.IsInf(conv, 0) || math.IsNaN(conv) {
+			t.Fatalf("long distance %.2f: convolution: invalid likelihood %f", ld, conv)
+		}
+		if math.Abs(conv-ctmc) > 0.02*math.Abs(conv) {
+			t.Errorf("long distance %.2f: got %.6f, want %.6f", ld, ctmc, conv)
+		}
+	}
+}
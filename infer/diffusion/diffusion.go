@@ -8,6 +8,7 @@
 package diffusion
 
 import (
+	"context"
 	"math"
 	"slices"
 
@@ -15,6 +16,8 @@ import (
 	"github.com/js-arias/earth/model"
 	"github.com/js-arias/earth/stat/dist"
 	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/agerange"
+	"github.com/js-arias/phygeo/constraint"
 	"github.com/js-arias/phygeo/timestage"
 	"github.com/js-arias/ranges"
 	"github.com/js-arias/timetree"
@@ -38,6 +41,23 @@ type Param struct {
 	// Ranges is the collection of terminal ranges
 	Ranges *ranges.Collection
 
+	// AgeRanges is an optional collection
+	// of age-specific ranges of the terminals
+	// (for example, fossils of a lineage
+	// found at different time slices).
+	// Each range is attached to the branch stage
+	// of the lineage at the age of the range.
+	AgeRanges *agerange.Collection
+
+	// Constraints is an optional collection
+	// of geographic constraints
+	// of the lineages of the nodes
+	// (each node defined as the most recent common ancestor
+	// of a set of terminals).
+	// Each constraint is attached to the branch stage
+	// of the lineage at the age of the constraint.
+	Constraints *constraint.Collection
+
 	// Length in years of the stem node
 	Stem int64
 
@@ -45,8 +65,55 @@ type Param struct {
 	// in 1/radian units
 	Lambda float64
 
+	// LongDist is the probability
+	// of a long-distance dispersal
+	// per million years.
+	// If defined,
+	// the dispersal kernel will be a mixture
+	// of a spherical normal
+	// and an uniform distribution
+	// (see Mixture).
+	// If zero,
+	// the kernel will be a spherical normal.
+	LongDist float64
+
+	// Engine is the method used to integrate the diffusion
+	// when calculating the conditional likelihoods.
+	// By default,
+	// the convolution engine is used.
+	// The engine is not used in the stochastic mapping,
+	// which always uses the dispersal kernel.
+	Engine Engine
+
 	// Stages is the time stages used to split branches.
 	Stages []int64
+
+	// Cache is an optional cache of spherical normals.
+	// If defined,
+	// it will be used to reuse the normals
+	// between different evaluations.
+	Cache *PDFCache
+
+	// Float32 if true,
+	// the conditional likelihoods are stored
+	// in single precision,
+	// with a rescaling constant for each time stage,
+	// and pixels with a vanishing likelihood
+	// are ignored.
+	// Each stored value uses about a quarter less memory
+	// (map overhead dominates),
+	// and the calculations are still done
+	// in double precision.
+	Float32 bool
+
+	// SimStart is an optional set of pixels,
+	// at the time stage of the start of the root,
+	// used as the starting points
+	// of a data simulation
+	// (see NewSimData).
+	// If empty,
+	// any pixel with a non-zero weight can be used.
+	SimStart map[int]bool
 }
 
 // A Tree os a phylogenetic tree for biogeography.
@@ -58,6 +125,51 @@ type Tree struct {
 	rot       *model.StageRot
 	dm        *earth.DistMat
 	pw        pixweight.Pixel
+	cache     *PDFCache
+
+	// probability of a long-distance dispersal
+	// per million years
+	longDist float64
+
+	// if true,
+	// conditionals are stored in single precision
+	single bool
+
+	// generator of the continuous-time Markov chain,
+	// if the CTMC engine is used
+	gen *Generator
+
+	// seed of the random number generators
+	// used in the stochastic mapping
+	seed   uint64
+	seeded bool
+
+	// function used to report the progress
+	// of a down-pass or a simulation
+	progress ProgressFunc
+}
+
+// A ProgressFunc is a function used to report
+// the progress of a down-pass,
+// or a stochastic mapping,
+// with the number of steps done,
+// and the total number of steps.
+// In a down-pass,
+// a step is a time stage of a node,
+// and in a stochastic mapping,
+// a step is a particle.
+//
+// The function is called
+// from the goroutine that runs the down-pass
+// or the stochastic mapping.
+type ProgressFunc func(done, total int)
+
+// SetProgress sets a function
+// to report the progress of the down-pass
+// and the stochastic mapping.
+// Use nil to remove the function.
+func (t *Tree) SetProgress(fn ProgressFunc) {
+	t.progress = fn
 }
 
 // New creates a new tree by copying the indicated source tree.
@@ -73,6 +185,16 @@ func New(t *timetree.Tree, p Param) *Tree {
 		rot:       p.Rot,
 		dm:        p.DM,
 		pw:        p.PW,
+		cache:     p.Cache,
+		longDist:  p.LongDist,
+		single:    p.Float32,
+	}
+	if p.Engine == CTMC {
+		if p.Cache != nil {
+			nt.gen = p.Cache.Generator()
+		} else {
+			nt.gen = NewGenerator(p.Landscape.Pixelation())
+		}
 	}
 
 	root := &node{
@@ -80,10 +202,16 @@ func New(t *timetree.Tree, p Param) *Tree {
 	}
 	nt.nodes[root.id] = root
 	root.copySource(nt, p.Landscape, p.Stem, p.Stages)
+	if p.AgeRanges != nil {
+		nt.setAgeRanges(p.AgeRanges, p.Stem)
+	}
+	if p.Constraints != nil {
+		nt.setConstraints(p.Constraints, p.Stem)
+	}
 
 	// Prepare nodes and time stages
 	for _, n := range nt.nodes {
-		n.setPDF(p.Landscape.Pixelation(), p.Lambda)
+		n.setPDF(p.Landscape.Pixelation(), p.Lambda, p.LongDist, p.Cache)
 
 		if !nt.t.IsTerm(n.id) {
 			continue
@@ -98,15 +226,89 @@ func New(t *timetree.Tree, p Param) *Tree {
 			sum += p
 		}
 
-		st.logLike = make(map[int]float64, len(rng))
+		logLike := make(map[int]float64, len(rng))
 		for px, p := range rng {
-			st.logLike[px] = math.Log(p) - math.Log(sum)
+			logLike[px] = math.Log(p) - math.Log(sum)
 		}
+		st.setLike(st.addAgeLike(logLike), nt.single)
 	}
 
 	return nt
 }
 
+// SetAgeRanges attaches the age-specific ranges
+// of each terminal
+// to the stage of its lineage
+// at the age of the range.
+// Ranges younger than the terminal,
+// or older than the stem of the tree,
+// are ignored.
+func (t *Tree) setAgeRanges(ar *agerange.Collection, stem int64) {
+	for _, id := range t.t.Nodes() {
+		if !t.t.IsTerm(id) {
+			continue
+		}
+		tax := t.t.Taxon(id)
+		for _, age := range ar.Ages(tax) {
+			t.attachRange(id, age, ar.Range(tax, age), stem)
+		}
+	}
+}
+
+// SetConstraints attaches the node constraints
+// to the stage of the lineage of each node
+// at the age of the constraint.
+// Constraints with terminals not in the tree,
+// younger than the node,
+// or older than the stem of the tree,
+// are ignored.
+func (t *Tree) setConstraints(c *constraint.Collection, stem int64) {
+	for _, name := range c.Names() {
+		cn := c.Constraint(name)
+		id := t.t.MRCA(cn.Terms...)
+		if id < 0 {
+			continue
+		}
+		t.attachRange(id, cn.Age, cn.Range, stem)
+	}
+}
+
+// AttachRange attaches a range
+// to the stage of the lineage of a node
+// at the given age,
+// searching the branch that contains the age
+// from the node to the root.
+func (t *Tree) attachRange(id int, age int64, rng map[int]float64, stem int64) {
+	if age < t.t.Age(id) {
+		return
+	}
+
+	// search the branch
+	// that contains the age
+	n := id
+	for !t.t.IsRoot(n) && age > t.t.Age(t.t.Parent(n)) {
+		n = t.t.Parent(n)
+	}
+	if t.t.IsRoot(n) && age > t.t.Age(n)+stem {
+		return
+	}
+
+	var sum float64
+	for _, p := range rng {
+		sum += p
+	}
+	if sum == 0 {
+		return
+	}
+	logLike := make(map[int]float64, len(rng))
+	for px, p := range rng {
+		logLike[px] = math.Log(p) - math.Log(sum)
+	}
+
+	ts := t.nodes[n].addStage(age)
+	ts.setAgeLike(logLike)
+}
+
 // Conditional returns the conditional logLikelihood
 // for a given node
 // at a given age stage
@@ -133,6 +335,9 @@ func (t *Tree) Conditional(n int, age int64) map[int]float64 {
 	}
 
 	ts := nn.stages[i]
+	if ts.like32 != nil {
+		return ts.logLikes()
+	}
 	cLike := make(map[int]float64, len(ts.logLike))
 	for px, p := range ts.logLike {
 		cLike[px] = p
@@ -145,10 +350,49 @@ func (t *Tree) Conditional(n int, age int64) map[int]float64 {
 // to estimate the likelihood of the data
 // for a tree.
 func (t *Tree) DownPass() float64 {
+	logLike, _ := t.DownPassContext(context.Background())
+	return logLike
+}
+
+// DownPassContext is like DownPass,
+// but the down-pass can be canceled
+// using a context.
+// The context is checked before each time stage,
+// and if it is done,
+// it returns the error of the context.
+// After a canceled down-pass,
+// the conditional likelihoods of the tree
+// are incomplete,
+// so the tree should not be used.
+func (t *Tree) DownPassContext(ctx context.Context) (float64, error) {
+	pr := &progress{
+		fn: t.progress,
+	}
+	for _, n := range t.nodes {
+		pr.total += len(n.stages)
+	}
+
 	root := t.nodes[t.t.Root()]
-	root.fullDownPass(t)
+	if err := root.fullDownPass(ctx, t, pr); err != nil {
+		return 0, err
+	}
+
+	return t.LogLike(), nil
+}
+
+// A progress tracks the number of steps done
+// in a down-pass or a simulation.
+type progress struct {
+	fn    ProgressFunc
+	done  int
+	total int
+}
 
-	return t.LogLike()
+func (p *progress) step() {
+	p.done++
+	if p.fn != nil {
+		p.fn(p.done, p.total)
+	}
 }
 
 // LogLike returns the logLikelihood of the whole reconstruction
@@ -161,23 +405,42 @@ func (t *Tree) LogLike() float64 {
 
 	max := -math.MaxFloat64
 	var scale float64
-	for px, p := range ts.logLike {
+	ts.eachLogLike(func(px int, p float64) {
 		if p > max {
 			max = p
 		}
 		scale += t.pw.Weight(stage[px])
-	}
+	})
 
 	// We do not multiply the pixel weights,
 	// as the weight is already taken into account
 	// in method (*node)conditional().
 	var sum float64
-	for _, p := range ts.logLike {
+	ts.eachLogLike(func(_ int, p float64) {
 		sum += math.Exp(p - max)
-	}
+	})
 	return math.Log(sum) + max - math.Log(scale)
 }
 
+// LongDist returns the probability
+// of a long-distance dispersal
+// per million years
+// used by the kernel of the tree.
+// If zero,
+// the kernel is a spherical normal.
+func (t *Tree) LongDist() float64 {
+	return t.longDist
+}
+
+// Engine returns the engine used
+// to calculate the conditional likelihoods.
+func (t *Tree) Engine() Engine {
+	if t.gen != nil {
+		return CTMC
+	}
+	return Convolution
+}
+
 // Name returns the name of the tree.
 func (t *Tree) Name() string {
 	return t.t.Name()
@@ -216,6 +479,37 @@ func (t *Tree) Particles(n int, age int64) int {
 	return len(nn.stages[i].particles)
 }
 
+// SetLambda sets the concentration parameter
+// (per million years, in 1/radian^2 units)
+// of the branch of a node
+// and all of its descendants.
+// A new down-pass is required
+// to update the conditional likelihoods.
+func (t *Tree) SetLambda(n int, lambda float64) {
+	nn, ok := t.nodes[n]
+	if !ok {
+		return
+	}
+	nn.setPDF(t.landscape.Pixelation(), lambda, t.longDist, t.cache)
+	for _, c := range t.t.Children(n) {
+		t.SetLambda(c, lambda)
+	}
+}
+
+// SetBranchLambda sets the lambda value
+// (the concentration parameter per million years)
+// of the branch of a node,
+// without modifying its descendants.
+// A new down-pass is required
+// to update the conditional likelihoods.
+func (t *Tree) SetBranchLambda(n int, lambda float64) {
+	nn, ok := t.nodes[n]
+	if !ok {
+		return
+	}
+	nn.setPDF(t.landscape.Pixelation(), lambda, t.longDist, t.cache)
+}
+
 // SetConditional sets the conditional likelihood
 // (in logLike units)
 // of a node at a given time stage.
@@ -239,10 +533,11 @@ func (t *Tree) SetConditional(n int, age int64, logLike map[int]float64) {
 	}
 
 	ts := nn.stages[i]
-	ts.logLike = make(map[int]float64, len(logLike))
+	cLike := make(map[int]float64, len(logLike))
 	for px, p := range logLike {
-		ts.logLike[px] = p
+		cLike[px] = p
 	}
+	ts.setLike(cLike, t.single)
 }
 
 // SrcDest return the source and destination pixel
@@ -349,13 +644,68 @@ func (n *node) copySource(t *Tree, tp *model.TimePix, stem int64, stages []int64
 	n.stages = append(n.stages, ts)
 }
 
-func (n *node) setPDF(pix *earth.Pixelation, lambda float64) {
+// AddStage returns the stage of a node
+// at a given age,
+// adding a new stage if the age
+// is not already a stage of the node.
+func (n *node) addStage(age int64) *timeStage {
+	for i, ts := range n.stages {
+		if ts.age == age {
+			return ts
+		}
+		if ts.age > age {
+			continue
+		}
+
+		// split the stage
+		prev := n.stages[i-1].age
+		ns := &timeStage{
+			node:     n,
+			age:      age,
+			duration: float64(prev-age) / timestage.MillionYears,
+		}
+		ts.duration = float64(age-ts.age) / timestage.MillionYears
+		n.stages = slices.Insert(n.stages, i, ns)
+		return ns
+	}
+	return nil
+}
+
+// ZeroScale is the fraction of the pixel size
+// below which the standard deviation of a diffusion kernel
+// is considered as zero.
+const zeroScale = 0.1
+
+func (n *node) setPDF(pix *earth.Pixelation, lambda, longDist float64, cache *PDFCache) {
 	n.lambda = lambda
+	minVar := earth.ToRad(pix.Step()) * zeroScale
+	minVar *= minVar
 	for _, ts := range n.stages {
-		if ts.duration == 0 {
+		// a zero (or near-zero) length stage
+		// (for example, an epsilon branch
+		// from a resolved polytomy)
+		// is not diffused,
+		// as the kernel is smaller than a pixel.
+		ts.zero = false
+		if ts.duration == 0 || (lambda > 0 && ts.duration/lambda < minVar) {
+			ts.zero = true
+			continue
+		}
+
+		if longDist > 0 {
+			w := StageWeight(longDist, ts.duration)
+			if cache != nil {
+				ts.pdf = cache.Mixture(lambda/ts.duration, w)
+				continue
+			}
+			ts.pdf = NewMixture(dist.NewNormal(lambda/ts.duration, pix), w)
 			continue
 		}
 
+		if cache != nil {
+			ts.pdf = cache.Normal(lambda / ts.duration)
+			continue
+		}
 		ts.pdf = dist.NewNormal(lambda/ts.duration, pix)
 	}
 }
@@ -368,15 +718,75 @@ type timeStage struct {
 	age      int64
 	duration float64
 
+	// zero is true if the stage has a zero,
+	// or near-zero, length
+	zero bool
+
 	// likelihood at each pixel
 	logLike map[int]float64
 
+	// log-likelihood of the age-specific ranges
+	// attached to the stage
+	ageLike map[int]float64
+
+	// likelihood at each pixel
+	// in single precision,
+	// scaled by logScale
+	like32   map[int]float32
+	logScale float64
+
 	// scaled likelihood (not in log-form)
 	// updated with the destination prior
 	scaled map[int]float64
 
+	// sorted pixels of the scaled likelihood
+	scaledPix []int
+
 	// store particle locations
 	particles []SrcDest
 
-	pdf dist.Normal
+	pdf Kernel
+}
+
+// SetAgeLike sets the log-likelihood
+// of an age-specific range attached to the stage.
+// If the stage already has an age-specific range,
+// both ranges are combined.
+func (ts *timeStage) setAgeLike(logLike map[int]float64) {
+	if ts.ageLike == nil {
+		ts.ageLike = logLike
+		return
+	}
+
+	comb := make(map[int]float64, len(logLike))
+	for px, p := range logLike {
+		q, ok := ts.ageLike[px]
+		if !ok {
+			continue
+		}
+		comb[px] = p + q
+	}
+	ts.ageLike = comb
+}
+
+// AddAgeLike returns the conditional likelihood
+// of the stage
+// updated with the age-specific ranges
+// attached to the stage.
+// Pixels outside the age-specific ranges
+// are removed.
+func (ts *timeStage) addAgeLike(logLike map[int]float64) map[int]float64 {
+	if ts.ageLike == nil {
+		return logLike
+	}
+
+	add := make(map[int]float64, len(ts.ageLike))
+	for px, p := range logLike {
+		q, ok := ts.ageLike[px]
+		if !ok {
+			continue
+		}
+		add[px] = p + q
+	}
+	return add
 }
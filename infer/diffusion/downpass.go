@@ -5,12 +5,12 @@
 package diffusion
 
 import (
+	"context"
 	"math"
 	"sync"
 
 	"github.com/js-arias/earth"
 	"github.com/js-arias/earth/model"
-	"github.com/js-arias/earth/stat/dist"
 	"github.com/js-arias/earth/stat/pixweight"
 )
 
@@ -29,7 +29,7 @@ type likePixData struct {
 
 	like []likePix
 	max  float64
-	pdf  dist.Normal
+	pdf  Kernel
 }
 
 func pixLike(likeChan chan likeChanType, wg *sync.WaitGroup, data likePixData, r []likeResult) {
@@ -86,18 +86,23 @@ func SetCPU(cpu int) {
 	numCPU = cpu
 }
 
-func (n *node) fullDownPass(t *Tree) {
+func (n *node) fullDownPass(ctx context.Context, t *Tree, pr *progress) error {
 	for _, c := range t.t.Children(n.id) {
 		nc := t.nodes[c]
-		nc.fullDownPass(t)
+		if err := nc.fullDownPass(ctx, t, pr); err != nil {
+			return err
+		}
 	}
 
 	pixTmp := make([]likePix, 0, t.landscape.Pixelation().Len())
 	resTmp := make([]likeResult, 0, t.landscape.Pixelation().Len())
-	n.conditional(t, pixTmp, resTmp)
+	return n.conditional(ctx, t, pr, pixTmp, resTmp)
 }
 
-func (n *node) conditional(t *Tree, pixTmp []likePix, resTmp []likeResult) {
+func (n *node) conditional(ctx context.Context, t *Tree, pr *progress, pixTmp []likePix, resTmp []likeResult) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if !t.t.IsTerm(n.id) {
 		// In an split node
 		// the conditional likelihood is the product of the
@@ -106,25 +111,35 @@ func (n *node) conditional(t *Tree, pixTmp []likePix, resTmp []likeResult) {
 		var logLike map[int]float64
 		for i, d := range desc {
 			c := t.nodes[d]
+			cs := c.stages[0]
 			if i == 0 {
-				logLike = make(map[int]float64, len(c.stages[0].logLike))
+				logLike = make(map[int]float64, cs.numPix())
 			}
-			for px, p := range c.stages[0].logLike {
+			cs.eachLogLike(func(px int, p float64) {
 				logLike[px] += p
-			}
+			})
 		}
 
 		ts := n.stages[len(n.stages)-1]
-		ts.logLike = logLike
+		ts.setLike(ts.addAgeLike(logLike), t.single)
 	}
+	pr.step()
 
 	// internodes
 	for i := len(n.stages) - 2; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		ts := n.stages[i]
 		age := t.rot.ClosestStageAge(ts.age)
 		next := n.stages[i+1]
 		nextAge := t.rot.ClosestStageAge(next.age)
-		logLike := next.conditional(t, age, pixTmp, resTmp)
+		var logLike map[int]float64
+		if next.zero {
+			logLike = next.zeroConditional(t, age)
+		} else {
+			logLike = next.conditional(t, age, pixTmp, resTmp)
+		}
 
 		// Rotate if there is an stage change
 		if nextAge != age {
@@ -132,15 +147,17 @@ func (n *node) conditional(t *Tree, pixTmp []likePix, resTmp []likeResult) {
 			logLike = rotate(rot.Rot, logLike)
 		}
 
-		ts.logLike = logLike
+		ts.setLike(ts.addAgeLike(logLike), t.single)
+		pr.step()
 	}
 
 	if t.t.IsRoot(n.id) {
 		// set the pixels priors at the root
 		rs := n.stages[0]
 		tp := t.landscape.Stage(t.landscape.ClosestStageAge(rs.age))
-		rs.logLike = addWeights(rs.logLike, t.pw, tp)
+		rs.setLike(addWeights(rs.logLikes(), t.pw, tp), t.single)
 	}
+	return nil
 }
 
 // LikePix stores the conditional likelihood of a pixel.
@@ -166,7 +183,7 @@ func (ts *timeStage) conditional(t *Tree, old int64, pixTmp []likePix, resTmp []
 
 	// update descendant log like
 	// with the arrival priors
-	endLike, max := prepareLogLikePix(ts.logLike, t.pw, stage, pixTmp)
+	endLike, max := prepareLogLikePix(ts, t.pw, stage, pixTmp)
 
 	// reset result slice
 	resTmp = resTmp[:0]
@@ -186,6 +203,10 @@ func (ts *timeStage) conditional(t *Tree, old int64, pixTmp []likePix, resTmp []
 		resTmp = append(resTmp, likeResult{px: px})
 	}
 
+	if t.gen != nil {
+		return ts.ctmcConditional(t, endLike, max, resTmp)
+	}
+
 	data := likePixData{
 		pix:  t.landscape.Pixelation(),
 		dm:   t.dm,
@@ -226,6 +247,37 @@ func (ts *timeStage) conditional(t *Tree, old int64, pixTmp []likePix, resTmp []
 	return logLike
 }
 
+// ZeroConditional calculates the conditional likelihood
+// at a zero length time stage.
+// As there is no diffusion,
+// the conditional likelihood of each pixel
+// is the likelihood at the end of the stage.
+func (ts *timeStage) zeroConditional(t *Tree, old int64) map[int]float64 {
+	age := t.landscape.ClosestStageAge(ts.age)
+	var rot *model.Rotation
+	if age != old {
+		rot = t.rot.YoungToOld(age)
+	}
+	stage := t.landscape.Stage(age)
+
+	logLike := make(map[int]float64, ts.numPix())
+	ts.eachLogLike(func(px int, p float64) {
+		// skip pixels with 0 weight
+		if t.pw.Weight(stage[px]) == 0 {
+			return
+		}
+
+		// the pixel must be valid at the oldest stage
+		if rot != nil {
+			if _, ok := rot.Rot[px]; !ok {
+				return
+			}
+		}
+		logLike[px] = p
+	})
+	return logLike
+}
+
 func addWeights(logLike map[int]float64, weight pixweight.Pixel, tp map[int]int) map[int]float64 {
 	add := make(map[int]float64, len(logLike))
 	for px, p := range logLike {
@@ -243,7 +295,7 @@ func addWeights(logLike map[int]float64, weight pixweight.Pixel, tp map[int]int)
 // add the weight of each pixel
 // and return an array with the pixels and its normalized (non-log) conditional likelihoods,
 // and the normalization factor (in log form).
-func prepareLogLikePix(logLike map[int]float64, weight pixweight.Pixel, tp map[int]int, lp []likePix) ([]likePix, float64) {
+func prepareLogLikePix(ts *timeStage, weight pixweight.Pixel, tp map[int]int, lp []likePix) ([]likePix, float64) {
 	max := -math.MaxFloat64
 	lp = lp[:0]
 
@@ -253,7 +305,7 @@ func prepareLogLikePix(logLike map[int]float64, weight pixweight.Pixel, tp map[i
 			continue
 		}
 
-		p, ok := logLike[px]
+		p, ok := ts.logLikeAt(px)
 		if !ok {
 			p = -math.MaxFloat64
 		} else {
@@ -0,0 +1,146 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package diffusion_test
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/js-arias/phygeo/infer/diffusion"
+	"github.com/js-arias/timetree"
+)
+
+func TestDownPassContext(t *testing.T) {
+	tree, p := testParam(t)
+
+	want := diffusion.New(tree, p).DownPass()
+
+	dt := diffusion.New(tree, p)
+	var done, total int
+	dt.SetProgress(func(d, tot int) {
+		if d != done+1 {
+			t.Errorf("progress: got step %d, want %d", d, done+1)
+		}
+		done, total = d, tot
+	})
+	got, err := dt.DownPassContext(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if math.Abs(got-want) > 1e-6 {
+		t.Errorf("logLike: got %.6f, want %.6f", got, want)
+	}
+	if total == 0 || done != total {
+		t.Errorf("progress: got %d steps, want %d", done, total)
+	}
+
+	// cancel after the first step
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dt = diffusion.New(tree, p)
+	steps := 0
+	dt.SetProgress(func(d, tot int) {
+		steps = d
+		cancel()
+	})
+	if _, err := dt.DownPassContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled down-pass: got error %v, want %v", err, context.Canceled)
+	}
+	if steps != 1 {
+		t.Errorf("canceled down-pass: got %d steps, want 1", steps)
+	}
+}
+
+// TestZeroTree returns a tree
+// with internal nodes at an age
+// that is exactly on a stage boundary (5 Ma),
+// and a zero length branch
+// (from node 1 to node 2).
+func testZeroTree(t testing.TB) *timetree.Tree {
+	t.Helper()
+
+	tr := timetree.New("t", 8_000_000)
+	y, err := tr.Add(0, 3_000_000, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	x, err := tr.Add(y, 0, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	terms := []struct {
+		parent int
+		brLen  int64
+		name   string
+	}{
+		{x, 5_000_000, "a"},
+		{x, 5_000_000, "b"},
+		{y, 5_000_000, "c"},
+		{0, 8_000_000, "d"},
+	}
+	for _, tm := range terms {
+		if _, err := tr.Add(tm.parent, tm.brLen, tm.name); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	return tr
+}
+
+func TestDownPassZeroStage(t *testing.T) {
+	_, p := testParam(t)
+	tree := testZeroTree(t)
+
+	dt := diffusion.New(tree, p)
+	like := dt.DownPass()
+	if math.IsInf(like, 0) || math.IsNaN(like) {
+		t.Fatalf("logLike: got %.6f, want a finite value", like)
+	}
+
+	// the conditional of the zero length stage
+	// is the conditional at the end of the stage
+	x := 2
+	end := dt.Conditional(x, 5_000_000)
+	if len(end) == 0 {
+		t.Fatalf("node %d: empty conditional", x)
+	}
+	for px, v := range end {
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			t.Errorf("node %d, pixel %d: got %.6f, want a finite value", x, px, v)
+		}
+	}
+}
+
+func TestDownPassFloat32(t *testing.T) {
+	tree, p := testParam(t)
+
+	want := diffusion.New(tree, p)
+	wantLike := want.DownPass()
+
+	p.Float32 = true
+	got := diffusion.New(tree, p)
+	gotLike := got.DownPass()
+
+	// float32 has about 7 significant digits
+	const tol = 1e-4
+	if math.Abs(gotLike-wantLike) > tol {
+		t.Errorf("logLike: got %.6f, want %.6f", gotLike, wantLike)
+	}
+	if l := got.LogLike(); math.Abs(l-wantLike) > tol {
+		t.Errorf("LogLike: got %.6f, want %.6f", l, wantLike)
+	}
+
+	ws := want.StageLikes()
+	gs := got.StageLikes()
+	if len(gs) != len(ws) {
+		t.Fatalf("stage likes: got %d, want %d", len(gs), len(ws))
+	}
+	for i, w := range ws {
+		if math.Abs(gs[i].LogLike-w.LogLike) > tol {
+			t.Errorf("node %d, age %d: stage logLike: got %.6f, want %.6f", w.Node, w.Age, gs[i].LogLike, w.LogLike)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package diffusion
+
+import (
+	"sync"
+
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/stat/dist"
+)
+
+// Equilibrium returns the stationary distribution
+// of the diffusion process at a time stage,
+// i.e., the expected location of a lineage
+// after a long time moving in the landscape of the stage,
+// without any geographic data.
+//
+// In each step,
+// a lineage at pixel i moves to pixel j
+// with probability
+//
+//	K(i,j) = f(d(i,j)) w(j) / Z(i)
+//
+// where f is the spherical normal
+// with concentration lambda/duration
+// (the duration in million years),
+// w(j) is the weight of the destination pixel,
+// and Z(i) the sum of f(d(i,j)) w(j)
+// over all the pixels.
+// This is the same kernel used in the down-pass.
+// As the kernel is reversible
+// (w(i) Z(i) K(i,j) is symmetric),
+// instead of a power iteration,
+// the stationary distribution is calculated directly
+// as proportional to w(i) Z(i).
+// This is the limit of the power iteration
+// in a connected landscape,
+// and it is well defined
+// in landscapes with disconnected regions.
+//
+// The returned map contains the probability
+// of each pixel with a non-zero weight.
+// The parameter fields used are
+// Landscape, DM, PW, and Lambda.
+func Equilibrium(p Param, age int64, duration float64) map[int]float64 {
+	pix := p.Landscape.Pixelation()
+	stage := p.Landscape.Stage(p.Landscape.ClosestStageAge(age))
+
+	var pixels []int
+	var weights []float64
+	for px := 0; px < pix.Len(); px++ {
+		w := p.PW.Weight(stage[px])
+		if w == 0 {
+			continue
+		}
+		pixels = append(pixels, px)
+		weights = append(weights, w)
+	}
+	if len(pixels) == 0 {
+		return nil
+	}
+
+	pdf := dist.NewNormal(p.Lambda/duration, pix)
+	z := make([]float64, len(pixels))
+
+	cpu := numCPU
+	if cpu < 1 {
+		cpu = 1
+	}
+	size := (len(pixels) + cpu - 1) / cpu
+	var wg sync.WaitGroup
+	for start := 0; start < len(pixels); start += size {
+		end := min(start+size, len(pixels))
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				z[i] = kernelScale(pix, p.DM, pdf, pixels[i], pixels, weights)
+			}
+		}(start, end)
+	}
+	wg.Wait()
+
+	var sum float64
+	for i, w := range weights {
+		z[i] *= w
+		sum += z[i]
+	}
+	eq := make(map[int]float64, len(pixels))
+	for i, px := range pixels {
+		eq[px] = z[i] / sum
+	}
+	return eq
+}
+
+// KernelScale returns the sum of the kernel
+// from a source pixel to all the destination pixels.
+func kernelScale(pix *earth.Pixelation, dm *earth.DistMat, pdf dist.Normal, source int, pixels []int, weights []float64) float64 {
+	var sum float64
+	if dm != nil {
+		for i, px := range pixels {
+			sum += pdf.ScaledProbRingDist(dm.At(source, px)) * weights[i]
+		}
+		return sum
+	}
+
+	pt1 := pix.ID(source).Point()
+	for i, px := range pixels {
+		pt2 := pix.ID(px).Point()
+		sum += pdf.Prob(earth.Distance(pt1, pt2)) * weights[i]
+	}
+	return sum
+}
@@ -0,0 +1,168 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package diffusion
+
+import (
+	"maps"
+	"math"
+	"slices"
+
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/ranges"
+	"github.com/js-arias/timetree"
+)
+
+// A Hostile is a pixel of a terminal range
+// located in a landscape value
+// with a pixel weight of zero
+// at the time stage of the terminal.
+// As the likelihood of such pixels is always zero,
+// if all the pixels of a range are hostile,
+// the likelihood of the tree will be zero.
+type Hostile struct {
+	Taxon string
+	Age   int64 // age of the terminal, in years
+	Pixel int
+	Value int // landscape value of the pixel
+
+	// Nearest is the nearest pixel
+	// with a non-zero weight
+	// at the time stage of the terminal,
+	// or -1 if there is no such pixel.
+	Nearest int
+
+	// NearestValue is the landscape value
+	// of the nearest pixel.
+	NearestValue int
+
+	// Weight is the weight of the nearest pixel.
+	Weight float64
+
+	// Dist is the distance,
+	// in radians,
+	// to the nearest pixel.
+	Dist float64
+}
+
+// HostilePixels returns the pixels
+// of the terminal ranges of a tree
+// that have a pixel weight of zero
+// at the time stage of the terminal.
+// The pixels are sorted by taxon name
+// and pixel ID.
+//
+// The parameter fields used are
+// Landscape, PW, and Ranges.
+func HostilePixels(t *timetree.Tree, p Param) []Hostile {
+	var hs []Hostile
+	for _, tax := range t.Terms() {
+		id, ok := t.TaxNode(tax)
+		if !ok {
+			continue
+		}
+		age := t.Age(id)
+		hs = append(hs, hostileRange(tax, age, p.Ranges.Range(tax), p.Landscape, p.PW)...)
+	}
+	return hs
+}
+
+func hostileRange(tax string, age int64, rng map[int]float64, landscape *model.TimePix, pw pixweight.Pixel) []Hostile {
+	stage := landscape.Stage(landscape.ClosestStageAge(age))
+	pix := landscape.Pixelation()
+
+	var hs []Hostile
+	for px := range rng {
+		if pw.Weight(stage[px]) > 0 {
+			continue
+		}
+		h := Hostile{
+			Taxon:   tax,
+			Age:     age,
+			Pixel:   px,
+			Value:   stage[px],
+			Nearest: -1,
+			Dist:    math.Inf(1),
+		}
+
+		pt := pix.ID(px).Point()
+		for np := 0; np < pix.Len(); np++ {
+			w := pw.Weight(stage[np])
+			if w == 0 {
+				continue
+			}
+			d := earth.Distance(pt, pix.ID(np).Point())
+			if d < h.Dist {
+				h.Nearest = np
+				h.NearestValue = stage[np]
+				h.Weight = w
+				h.Dist = d
+			}
+		}
+		hs = append(hs, h)
+	}
+
+	slices.SortFunc(hs, func(a, b Hostile) int {
+		return a.Pixel - b.Pixel
+	})
+	return hs
+}
+
+// Snap moves the hostile pixels
+// of the terminal ranges of a tree
+// to the nearest pixel with a non-zero weight,
+// if that pixel is within the indicated radius
+// (in radians).
+// Hostile pixels without a valid pixel
+// inside the radius are kept.
+//
+// It returns a new range collection
+// with the snapped ranges,
+// and the moved pixels.
+// If no pixel is moved,
+// it returns the original collection.
+//
+// The parameter fields used are
+// Landscape, PW, and Ranges.
+func Snap(t *timetree.Tree, p Param, radius float64) (*ranges.Collection, []Hostile) {
+	var moved []Hostile
+	snapped := make(map[string]map[int]float64)
+	for _, h := range HostilePixels(t, p) {
+		if h.Nearest < 0 || h.Dist > radius {
+			continue
+		}
+
+		rng, ok := snapped[h.Taxon]
+		if !ok {
+			rng = maps.Clone(p.Ranges.Range(h.Taxon))
+			snapped[h.Taxon] = rng
+		}
+		v := rng[h.Pixel]
+		delete(rng, h.Pixel)
+		if v > rng[h.Nearest] {
+			rng[h.Nearest] = v
+		}
+		moved = append(moved, h)
+	}
+	if len(moved) == 0 {
+		return p.Ranges, nil
+	}
+
+	rc := ranges.New(p.Ranges.Pixelation())
+	for _, tax := range p.Ranges.Taxa() {
+		rng := p.Ranges.Range(tax)
+		if s, ok := snapped[tax]; ok {
+			rng = s
+		}
+		age := p.Ranges.Age(tax)
+		if p.Ranges.Type(tax) == ranges.Points {
+			rc.SetPixels(tax, age, rng)
+			continue
+		}
+		rc.Set(tax, age, rng)
+	}
+	return rc, moved
+}
@@ -0,0 +1,184 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package diffusion
+
+import (
+	"math"
+	"slices"
+
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/stat/dist"
+)
+
+// A Kernel is a dispersal kernel
+// discretized over a pixelation.
+// The spherical normal (dist.Normal)
+// is the default kernel.
+type Kernel interface {
+	// Prob returns the value of the probability density function
+	// for a pixel at a distance dist
+	// (in radians).
+	Prob(dist float64) float64
+
+	// ProbRingDist returns the value
+	// of the probability density function
+	// at a given ring distance.
+	ProbRingDist(rDist int) float64
+
+	// LogProbRingDist returns the natural logarithm
+	// of the probability density function
+	// at a given ring distance.
+	LogProbRingDist(rDist int) float64
+
+	// ScaledProbRingDist returns the value
+	// of the probability density function
+	// at a given ring distance,
+	// scaled by the maximum probability.
+	ScaledProbRingDist(rDist int) float64
+}
+
+// Mixture is a heavy-tailed dispersal kernel
+// made of a mixture of a spherical normal,
+// for the local diffusion,
+// and an uniform distribution over the sphere,
+// for the long-distance dispersal:
+//
+//	K(x|u) = (1-w) * SN(x|u,λ) + w / N
+//
+// where w is the weight of the long-distance component,
+// and N is the number of pixels.
+type Mixture struct {
+	step float64 // step of a ring in radians
+	w    float64 // weight of the long-distance component
+
+	pdf    []float64
+	logPDF []float64
+	scaled []float64
+}
+
+// NewMixture returns a mixture kernel
+// from a spherical normal
+// and the weight of the long-distance component.
+func NewMixture(n dist.Normal, w float64) Mixture {
+	pix := n.Pix()
+	rings := pix.Rings()
+	u := w / float64(pix.Len())
+
+	m := Mixture{
+		step:   earth.ToRad(pix.Step()),
+		w:      w,
+		pdf:    make([]float64, rings),
+		logPDF: make([]float64, rings),
+		scaled: make([]float64, rings),
+	}
+	for i := range m.pdf {
+		p := (1-w)*n.ProbRingDist(i) + u
+		m.pdf[i] = p
+		m.logPDF[i] = math.Log(p)
+	}
+	for i, p := range m.pdf {
+		m.scaled[i] = p / m.pdf[0]
+	}
+	return m
+}
+
+// LogProbRingDist returns the natural logarithm
+// of the probability density function
+// at a given ring distance.
+func (m Mixture) LogProbRingDist(rDist int) float64 {
+	return m.logPDF[rDist]
+}
+
+// Prob returns the value of the probability density function
+// for a pixel at a distance dist
+// (in radians).
+func (m Mixture) Prob(dist float64) float64 {
+	r := int(math.Round(dist / m.step))
+	if r >= len(m.pdf) {
+		r = len(m.pdf) - 1
+	}
+	return m.pdf[r]
+}
+
+// ProbRingDist returns the value
+// of the probability density function
+// at a given ring distance.
+func (m Mixture) ProbRingDist(rDist int) float64 {
+	return m.pdf[rDist]
+}
+
+// ScaledProbRingDist returns the value
+// of the probability density function
+// at a given ring distance,
+// scaled by the maximum probability
+// (i.e., by 0 distance).
+func (m Mixture) ScaledProbRingDist(rDist int) float64 {
+	return m.scaled[rDist]
+}
+
+// Weight returns the weight
+// of the long-distance component.
+func (m Mixture) Weight() float64 {
+	return m.w
+}
+
+// StageWeight returns the weight
+// of the long-distance component
+// of a time stage,
+// given the probability of a long-distance dispersal
+// per million years,
+// and the duration of the stage
+// (in million years).
+func StageWeight(longDist, duration float64) float64 {
+	if longDist <= 0 {
+		return 0
+	}
+	if longDist >= 1 {
+		return 1
+	}
+	return -math.Expm1(duration * math.Log1p(-longDist))
+}
+
+// LongDistProb returns the probability
+// that the movement of a particle
+// from a source to a destination pixel,
+// in a time stage of a node,
+// was produced by the long-distance component
+// of a mixture kernel.
+// The age of the stage is in years.
+// It returns false if the stage is not found,
+// or if the stage has a zero length.
+// If the kernel is not a mixture,
+// the probability is zero.
+func (t *Tree) LongDistProb(n int, age int64, from, to int) (float64, bool) {
+	nn, ok := t.nodes[n]
+	if !ok {
+		return 0, false
+	}
+
+	i, ok := slices.BinarySearchFunc(nn.stages, age, func(st *timeStage, age int64) int {
+		if st.age == age {
+			return 0
+		}
+		if st.age < age {
+			return 1
+		}
+		return -1
+	})
+	if !ok {
+		return 0, false
+	}
+	ts := nn.stages[i]
+	if ts.zero {
+		return 0, false
+	}
+
+	m, ok := ts.pdf.(Mixture)
+	if !ok {
+		return 0, true
+	}
+	u := m.w / float64(t.landscape.Pixelation().Len())
+	return u / m.ProbRingDist(t.dm.At(from, to)), true
+}
@@ -0,0 +1,79 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package diffusion_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/stat/dist"
+	"github.com/js-arias/phygeo/infer/diffusion"
+)
+
+func TestMixture(t *testing.T) {
+	pix := earth.NewPixelation(30)
+	dm, err := earth.NewDistMatRingScale(pix)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	n := dist.NewNormal(50, pix)
+
+	for _, w := range []float64{0, 0.01, 0.2, 1} {
+		m := diffusion.NewMixture(n, w)
+		if m.Weight() != w {
+			t.Errorf("weight %.3f: got %.6f", w, m.Weight())
+		}
+
+		// the kernel is a probability distribution
+		// over the pixels
+		var sum float64
+		for px := 0; px < pix.Len(); px++ {
+			sum += m.ProbRingDist(dm.At(0, px))
+		}
+		if math.Abs(sum-1) > 1e-9 {
+			t.Errorf("weight %.3f: sum: got %.12f, want %.12f", w, sum, 1.0)
+		}
+
+		// the long-distance component
+		// is a lower bound of the kernel
+		u := w / float64(pix.Len())
+		for r := 0; r < pix.Rings(); r++ {
+			p := m.ProbRingDist(r)
+			if want := (1-w)*n.ProbRingDist(r) + u; math.Abs(p-want) > 1e-12 {
+				t.Errorf("weight %.3f: ring %d: got %.12f, want %.12f", w, r, p, want)
+			}
+			if p < u {
+				t.Errorf("weight %.3f: ring %d: got %.12f, want at least %.12f", w, r, p, u)
+			}
+			if lp := m.LogProbRingDist(r); math.Abs(lp-math.Log(p)) > 1e-12 {
+				t.Errorf("weight %.3f: ring %d: log: got %.12f, want %.12f", w, r, lp, math.Log(p))
+			}
+		}
+	}
+}
+
+func TestStageWeight(t *testing.T) {
+	for _, ld := range []float64{0.001, 0.01, 0.05, 0.5} {
+		for _, d := range []float64{0, 0.1, 1, 5, 100} {
+			want := 1 - math.Pow(1-ld, d)
+			if w := diffusion.StageWeight(ld, d); math.Abs(w-want) > 1e-12 {
+				t.Errorf("ld %.3f, duration %.3f: got %.12f, want %.12f", ld, d, w, want)
+			}
+		}
+	}
+
+	// one million years
+	// is the long-distance probability
+	if w := diffusion.StageWeight(0.05, 1); math.Abs(w-0.05) > 1e-12 {
+		t.Errorf("one million years: got %.12f, want %.12f", w, 0.05)
+	}
+	if w := diffusion.StageWeight(0, 10); w != 0 {
+		t.Errorf("no long-distance dispersal: got %.12f, want %.12f", w, 0.0)
+	}
+	if w := diffusion.StageWeight(1, 0.5); w != 1 {
+		t.Errorf("certain long-distance dispersal: got %.12f, want %.12f", w, 1.0)
+	}
+}
@@ -36,7 +36,7 @@ func rotate(rot map[int][]int, rng map[int]float64) map[int]float64 {
 // RotPix rotates a pixel at a given age to the next age stage.
 // If there are multiple destinations,
 // it will pick a destination based on the weight of the destination pixels.
-func rotPix(rot *model.StageRot, ts *model.TimePix, pix int, age int64, pw pixweight.Pixel) int {
+func rotPix(rng *rand.Rand, rot *model.StageRot, ts *model.TimePix, pix int, age int64, pw pixweight.Pixel) int {
 	rm := rot.OldToYoung(age)
 	if rm == nil {
 		return pix
@@ -58,9 +58,9 @@ func rotPix(rot *model.StageRot, ts *model.TimePix, pix int, age int64, pw pixwe
 	}
 
 	for {
-		px := pxs[rand.IntN(len(pxs))]
+		px := pxs[rng.IntN(len(pxs))]
 		accept := pw.Weight(tp[px]) / max
-		if rand.Float64() < accept {
+		if rng.Float64() < accept {
 			return px
 		}
 	}
@@ -5,8 +5,10 @@
 package diffusion
 
 import (
+	"fmt"
 	"math"
 	"math/rand/v2"
+	"slices"
 
 	"github.com/js-arias/earth"
 	"github.com/js-arias/earth/stat/dist"
@@ -17,10 +19,14 @@ import (
 // NewSimData creates a new tree
 // for data simulation
 // by copying the indicated source tree.
+// If the parameters define a set of starting pixels,
+// the simulation will start in one of them,
+// and it returns an error if none of them
+// has a non-zero weight.
 //
 // To make the simulation
 // use method Simulate.
-func NewSimData(t *timetree.Tree, p Param, spread float64) *Tree {
+func NewSimData(t *timetree.Tree, p Param, spread float64) (*Tree, error) {
 	nt := &Tree{
 		t:         t,
 		nodes:     make(map[int]*node, len(t.Nodes())),
@@ -28,6 +34,8 @@ func NewSimData(t *timetree.Tree, p Param, spread float64) *Tree {
 		rot:       p.Rot,
 		dm:        p.DM,
 		pw:        p.PW,
+		cache:     p.Cache,
+		longDist:  p.LongDist,
 	}
 
 	root := &node{
@@ -38,18 +46,22 @@ func NewSimData(t *timetree.Tree, p Param, spread float64) *Tree {
 
 	// Prepare nodes and time stages
 	for _, n := range nt.nodes {
-		n.setPDF(p.Landscape.Pixelation(), p.Lambda)
+		n.setPDF(p.Landscape.Pixelation(), p.Lambda, p.LongDist, p.Cache)
 	}
 
 	// Create the centroid for the simulation
-	source := nt.startParticle(spread)
-	root.centroidSimulation(nt, source, spread)
-	return nt
+	rng := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	source, err := nt.startParticle(rng, spread, p.SimStart)
+	if err != nil {
+		return nil, err
+	}
+	root.centroidSimulation(nt, rng, source, spread)
+	return nt, nil
 }
 
 // RootField creates the starting field
 // and point of the simulation.
-func (t *Tree) startParticle(lambda float64) int {
+func (t *Tree) startParticle(rng *rand.Rand, lambda float64, start map[int]bool) (int, error) {
 	root := t.nodes[t.t.Root()]
 	rs := root.stages[0]
 
@@ -58,11 +70,30 @@ func (t *Tree) startParticle(lambda float64) int {
 
 	pix := t.landscape.Pixelation()
 
+	var candidates []int
+	if len(start) > 0 {
+		candidates = make([]int, 0, len(start))
+		for px := range start {
+			if t.pw.Weight(stage[px]) == 0 {
+				continue
+			}
+			candidates = append(candidates, px)
+		}
+		if len(candidates) == 0 {
+			return 0, fmt.Errorf("no valid starting pixels at age %d", age)
+		}
+		slices.Sort(candidates)
+	}
+
 	px := -1
 	for {
-		px = pix.Random().ID()
+		if candidates != nil {
+			px = candidates[rng.IntN(len(candidates))]
+		} else {
+			px = pix.Random().ID()
+		}
 		accept := t.pw.Weight(stage[px])
-		if rand.Float64() < accept {
+		if rng.Float64() < accept {
 			break
 		}
 	}
@@ -73,13 +104,13 @@ func (t *Tree) startParticle(lambda float64) int {
 	for px, p := range prob {
 		rs.logLike[px] = math.Log(p)
 	}
-	return rotPix(t.rot, t.landscape, px, rs.age, t.pw)
+	return rotPix(rng, t.rot, t.landscape, px, rs.age, t.pw), nil
 }
 
-func (n *node) centroidSimulation(t *Tree, source int, spread float64) {
+func (n *node) centroidSimulation(t *Tree, rng *rand.Rand, source int, spread float64) {
 	for i := 1; i < len(n.stages); i++ {
 		ts := n.stages[i]
-		source = ts.centroidSimulation(t, source, spread)
+		source = ts.centroidSimulation(t, rng, source, spread)
 	}
 	like := n.stages[len(n.stages)-1].logLike
 
@@ -90,29 +121,35 @@ func (n *node) centroidSimulation(t *Tree, source int, spread float64) {
 		for px, p := range like {
 			sp.logLike[px] = p
 		}
-		c.centroidSimulation(t, source, spread)
+		c.centroidSimulation(t, rng, source, spread)
 	}
 }
 
-func (ts *timeStage) centroidSimulation(t *Tree, source int, spread float64) int {
+func (ts *timeStage) centroidSimulation(t *Tree, rng *rand.Rand, source int, spread float64) int {
 	age := t.landscape.ClosestStageAge(ts.age)
 	stage := t.landscape.Stage(age)
 
 	pix := t.landscape.Pixelation()
-	density := buildDensity(pix, ts.pdf, t.dm, source, stage, t.pw)
-
-	centroid := pick(density)
+	centroid := source
+	if !ts.zero || t.pw.Weight(stage[source]) == 0 {
+		var pdf Kernel = ts.pdf
+		if ts.zero {
+			pdf = dist.NewNormal(spread, pix)
+		}
+		density := buildDensity(pix, pdf, t.dm, source, stage, t.pw)
+		centroid = pick(rng, density)
+	}
 	pdf := dist.NewNormal(spread, pix)
 	prob := buildDensity(pix, pdf, t.dm, centroid, stage, t.pw)
 	ts.logLike = make(map[int]float64, len(prob))
 	for px, p := range prob {
 		ts.logLike[px] = math.Log(p)
 	}
-	return rotPix(t.rot, t.landscape, centroid, ts.age, t.pw)
+	return rotPix(rng, t.rot, t.landscape, centroid, ts.age, t.pw)
 
 }
 
-func buildDensity(pix *earth.Pixelation, pdf dist.Normal, dm *earth.DistMat, source int, stage map[int]int, pw pixweight.Pixel) []float64 {
+func buildDensity(pix *earth.Pixelation, pdf Kernel, dm *earth.DistMat, source int, stage map[int]int, pw pixweight.Pixel) []float64 {
 	density := make([]float64, 0, pix.Len())
 	var max float64
 
@@ -156,11 +193,11 @@ func buildDensity(pix *earth.Pixelation, pdf dist.Normal, dm *earth.DistMat, sou
 	return density
 }
 
-func pick(density []float64) int {
+func pick(rng *rand.Rand, density []float64) int {
 	for {
-		px := rand.IntN(len(density))
+		px := rng.IntN(len(density))
 		accept := density[px]
-		if rand.Float64() < accept {
+		if rng.Float64() < accept {
 			return px
 		}
 	}
@@ -0,0 +1,40 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package diffusion_test
+
+import (
+	"testing"
+
+	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/infer/diffusion"
+)
+
+func TestNewSimDataStart(t *testing.T) {
+	tree, p := testParam(t)
+	p.SimStart = map[int]bool{10: true, 20: true}
+
+	sim, err := diffusion.NewSimData(tree, p, 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sim.Simulate(10)
+
+	p.LongDist = 0.05
+	sim, err = diffusion.NewSimData(tree, p, 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ld := sim.LongDist(); ld != p.LongDist {
+		t.Errorf("long distance dispersal: got %.6f, want %.6f", ld, p.LongDist)
+	}
+	p.LongDist = 0
+
+	// no pixel with a non-zero weight
+	p.PW = pixweight.New()
+	p.PW.Set(1, 0)
+	if _, err := diffusion.NewSimData(tree, p, 100); err == nil {
+		t.Errorf("invalid starting pixels: expecting error")
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package diffusion
+
+import (
+	"math"
+)
+
+// SetLike sets the conditional likelihood
+// (in logLike units)
+// of a time stage.
+//
+// If single is true,
+// the likelihood is stored in single precision:
+// the values are rescaled by the maximum likelihood
+// of the stage,
+// and the rescaling constant is kept in log form,
+// so the logLikelihood is recovered
+// up to the float32 precision.
+// Pixels with a likelihood that underflows
+// the single precision range
+// (i.e., about 1e-45 times smaller than the maximum)
+// are removed.
+func (ts *timeStage) setLike(logLike map[int]float64, single bool) {
+	if !single {
+		ts.logLike = logLike
+		ts.like32 = nil
+		ts.logScale = 0
+		return
+	}
+
+	max := -math.MaxFloat64
+	for _, p := range logLike {
+		if p > max {
+			max = p
+		}
+	}
+
+	ts.logLike = nil
+	ts.logScale = max
+	ts.like32 = make(map[int]float32, len(logLike))
+	for px, p := range logLike {
+		v := float32(math.Exp(p - max))
+		if v == 0 {
+			continue
+		}
+		ts.like32[px] = v
+	}
+}
+
+// LogLikes returns the conditional likelihood
+// (in logLike units)
+// of a time stage.
+//
+// If the stage is stored in single precision,
+// a new map is created,
+// so any change on the returned map
+// will not modify the stage.
+// To read the values without allocating a new map,
+// use eachLogLike or logLikeAt.
+func (ts *timeStage) logLikes() map[int]float64 {
+	if ts.like32 == nil {
+		return ts.logLike
+	}
+
+	logLike := make(map[int]float64, len(ts.like32))
+	for px, p := range ts.like32 {
+		logLike[px] = math.Log(float64(p)) + ts.logScale
+	}
+	return logLike
+}
+
+// EachLogLike calls fn
+// for each pixel of the conditional likelihood
+// (in logLike units)
+// of a time stage.
+func (ts *timeStage) eachLogLike(fn func(px int, p float64)) {
+	if ts.like32 == nil {
+		for px, p := range ts.logLike {
+			fn(px, p)
+		}
+		return
+	}
+	for px, p := range ts.like32 {
+		fn(px, math.Log(float64(p))+ts.logScale)
+	}
+}
+
+// LogLikeAt returns the conditional likelihood
+// (in logLike units)
+// of a pixel in a time stage.
+// It returns false if the pixel is not defined.
+func (ts *timeStage) logLikeAt(px int) (float64, bool) {
+	if ts.like32 == nil {
+		p, ok := ts.logLike[px]
+		return p, ok
+	}
+	p, ok := ts.like32[px]
+	if !ok {
+		return 0, false
+	}
+	return math.Log(float64(p)) + ts.logScale, true
+}
+
+// NumPix returns the number of pixels
+// with a defined conditional likelihood
+// in a time stage.
+func (ts *timeStage) numPix() int {
+	if ts.like32 == nil {
+		return len(ts.logLike)
+	}
+	return len(ts.like32)
+}
@@ -0,0 +1,109 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package diffusion
+
+import (
+	"math"
+)
+
+// StageLike is the contribution of a time stage
+// to the logLikelihood of a tree.
+type StageLike struct {
+	// Node ID
+	Node int
+
+	// Age of the time stage,
+	// i.e., the youngest age of the branch segment
+	Age int64
+
+	// LogLike is the contribution to the logLikelihood
+	LogLike float64
+}
+
+// StageLikes returns the contribution
+// of each time stage of each node
+// to the logLikelihood of the tree.
+// It must be called after a down-pass.
+//
+// The logLikelihood is decomposed
+// using the log of the total conditional likelihood
+// (i.e., the sum over all pixels)
+// at each time stage.
+// The contribution of a branch segment
+// is the change of the total conditional likelihood
+// from the youngest to the oldest age of the segment.
+// At the youngest stage of a node
+// (i.e., a split or a terminal),
+// the contribution also includes
+// the total conditional likelihood of the node
+// minus the total conditional likelihoods
+// of its descendants,
+// which measures the overlap of the descendant ranges
+// in the case of a split,
+// or the total likelihood of the range,
+// in the case of a terminal.
+// The normalization of the pixel priors of the root
+// is assigned to the oldest stage of the root.
+// Post-split stages of non-root nodes
+// are not included
+// as they do not have a duration.
+// The sum of all contributions
+// is the logLikelihood of the tree.
+func (t *Tree) StageLikes() []StageLike {
+	var sl []StageLike
+	for _, id := range t.Nodes() {
+		n := t.nodes[id]
+
+		var children float64
+		for _, c := range t.t.Children(id) {
+			children += t.nodes[c].stages[0].logTotal()
+		}
+
+		first := 1
+		if t.t.IsRoot(id) {
+			first = 0
+		}
+		for i := first; i < len(n.stages); i++ {
+			ts := n.stages[i]
+			var lk float64
+			if i > 0 {
+				prev := n.stages[i-1]
+				lk = prev.logTotal() - ts.logTotal()
+			} else {
+				lk = t.LogLike() - ts.logTotal()
+			}
+			if i == len(n.stages)-1 {
+				lk += ts.logTotal() - children
+			}
+			sl = append(sl, StageLike{
+				Node:    id,
+				Age:     ts.age,
+				LogLike: lk,
+			})
+		}
+	}
+	return sl
+}
+
+// LogTotal returns the log of the sum
+// of the conditional likelihoods
+// of a time stage.
+func (ts *timeStage) logTotal() float64 {
+	max := math.Inf(-1)
+	ts.eachLogLike(func(_ int, p float64) {
+		if p > max {
+			max = p
+		}
+	})
+	if math.IsInf(max, -1) {
+		return max
+	}
+
+	var sum float64
+	ts.eachLogLike(func(_ int, p float64) {
+		sum += math.Exp(p - max)
+	})
+	return math.Log(sum) + max
+}
@@ -5,9 +5,10 @@
 package diffusion
 
 import (
+	"context"
 	"math"
 	"math/rand/v2"
-	"sync"
+	"slices"
 )
 
 type simChan struct {
@@ -15,12 +16,17 @@ type simChan struct {
 	answer   chan struct{}
 }
 
-func doSim(pc chan simChan, t *Tree, size int) {
+func doSim(pc chan simChan, t *Tree, seed uint64, size int) {
 	density := make([]likePix, 0, size)
 	for c := range pc {
+		// each particle has its own random stream
+		// so the result does not depend
+		// on the number of CPUs
+		rng := rand.New(rand.NewPCG(seed, uint64(c.particle)))
+
 		root := t.nodes[t.t.Root()]
-		source := t.simulateRoot(c.particle, density)
-		root.simulate(t, c.particle, source, density)
+		source := t.simulateRoot(rng, c.particle, density)
+		root.simulate(t, rng, c.particle, source, density)
 		c.answer <- struct{}{}
 	}
 }
@@ -34,54 +40,95 @@ type SrcDest struct {
 	To int
 }
 
+// SetSeed sets the seed of the random number generators
+// used by Simulate.
+// For a given seed,
+// the simulated particles are the same
+// regardless of the number of CPUs.
+// If no seed is set,
+// a random seed will be used.
+func (t *Tree) SetSeed(seed uint64) {
+	t.seed = seed
+	t.seeded = true
+}
+
 // Simulate performs stochastic mappings
 // for the given number of particles.
 func (t *Tree) Simulate(particles int) {
+	t.SimulateContext(context.Background(), particles)
+}
+
+// SimulateContext is like Simulate,
+// but the stochastic mapping can be canceled
+// using a context.
+// The context is checked before each particle,
+// and if it is done,
+// it waits for the running particles
+// and returns the error of the context.
+// After a canceled simulation,
+// the particles of the tree are incomplete.
+func (t *Tree) SimulateContext(ctx context.Context, particles int) error {
 	root := t.nodes[t.t.Root()]
 	root.scaleLike(t, particles)
 
+	seed := t.seed
+	if !t.seeded {
+		seed = rand.Uint64()
+	}
+
 	sChan := make(chan simChan, numCPU*2)
 	for i := 0; i < numCPU; i++ {
-		go doSim(sChan, t, t.landscape.Pixelation().Len())
+		go doSim(sChan, t, seed, t.landscape.Pixelation().Len())
 	}
+	defer close(sChan)
 
-	var wg sync.WaitGroup
-	for p := 0; p < particles; p++ {
-		wg.Add(1)
-		go func(p int) {
-			a := make(chan struct{})
-			sChan <- simChan{
-				particle: p,
-				answer:   a,
-			}
-			<-a
-			wg.Done()
-		}(p)
+	pr := &progress{
+		fn:    t.progress,
+		total: particles,
 	}
-	wg.Wait()
-	close(sChan)
+	answer := make(chan struct{}, particles)
+	var err error
+	sent := 0
+	for sent < particles {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		select {
+		case sChan <- simChan{particle: sent, answer: answer}:
+			sent++
+		case <-answer:
+			pr.step()
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	for pr.done < sent {
+		<-answer
+		pr.step()
+	}
+	return err
 }
 
 func (n *node) scaleLike(t *Tree, p int) {
 	for _, st := range n.stages {
 		st.particles = make([]SrcDest, p)
-		st.scaled = make(map[int]float64, len(st.logLike))
+		st.scaled = make(map[int]float64, st.numPix())
 
 		tp := t.landscape.Stage(t.landscape.ClosestStageAge(st.age))
 		rot := t.rot.OldToYoung(st.age)
 
 		max := -math.MaxFloat64
-		for px, p := range st.logLike {
+		st.eachLogLike(func(px int, p float64) {
 			v := tp[px]
 			// skip pixels with 0 weight
 			if pw := t.pw.Weight(v); pw == 0 {
-				continue
+				return
 			}
 
 			if rot != nil {
 				// skip pixels that are invalid in the next stage rotation
 				if pxs := rot.Rot[px]; len(pxs) == 0 {
-					continue
+					return
 				}
 			}
 
@@ -90,12 +137,15 @@ func (n *node) scaleLike(t *Tree, p int) {
 			if p > max {
 				max = p
 			}
-		}
+		})
 
 		// scale
+		st.scaledPix = make([]int, 0, len(st.scaled))
 		for px, p := range st.scaled {
 			st.scaled[px] = math.Exp(p - max)
+			st.scaledPix = append(st.scaledPix, px)
 		}
+		slices.Sort(st.scaledPix)
 	}
 
 	for _, c := range t.t.Children(n.id) {
@@ -106,14 +156,15 @@ func (n *node) scaleLike(t *Tree, p int) {
 
 // SimulateRoot get the first pixel at the root,
 // and return it.
-func (t *Tree) simulateRoot(p int, density []likePix) int {
+func (t *Tree) simulateRoot(rng *rand.Rand, p int, density []likePix) int {
 	root := t.nodes[t.t.Root()]
 	rs := root.stages[0]
 
 	// set density
 	var max float64
 	density = density[:0]
-	for px, p := range rs.scaled {
+	for _, px := range rs.scaledPix {
+		p := rs.scaled[px]
 		density = append(density, likePix{
 			px:   px,
 			like: p,
@@ -123,11 +174,11 @@ func (t *Tree) simulateRoot(p int, density []likePix) int {
 		}
 	}
 
-	dest := rs.pick(p, -1, max, density)
-	return rotPix(t.rot, t.landscape, dest, rs.age, t.pw)
+	dest := rs.pick(rng, p, -1, max, density)
+	return rotPix(rng, t.rot, t.landscape, dest, rs.age, t.pw)
 }
 
-func (n *node) simulate(t *Tree, p, source int, density []likePix) {
+func (n *node) simulate(t *Tree, rng *rand.Rand, p, source int, density []likePix) {
 	n.stages[0].particles[p] = SrcDest{
 		From: source,
 		To:   source,
@@ -135,21 +186,26 @@ func (n *node) simulate(t *Tree, p, source int, density []likePix) {
 
 	for i := 1; i < len(n.stages); i++ {
 		ts := n.stages[i]
-		source = ts.simulate(t, p, source, density)
+		source = ts.simulate(t, rng, p, source, density)
 	}
 
 	for _, cID := range t.t.Children(n.id) {
 		c := t.nodes[cID]
-		c.simulate(t, p, source, density)
+		c.simulate(t, rng, p, source, density)
 	}
 }
 
-func (ts *timeStage) simulate(t *Tree, p, source int, density []likePix) int {
+func (ts *timeStage) simulate(t *Tree, rng *rand.Rand, p, source int, density []likePix) int {
 	var max float64
 
+	if ts.zero {
+		return ts.zeroSimulate(t, rng, p, source, density)
+	}
+
 	// calculate density
 	density = density[:0]
-	for px, p := range ts.scaled {
+	for _, px := range ts.scaledPix {
+		p := ts.scaled[px]
 		p *= ts.pdf.ProbRingDist(t.dm.At(source, px))
 		if p == 0 {
 			continue
@@ -164,14 +220,14 @@ func (ts *timeStage) simulate(t *Tree, p, source int, density []likePix) int {
 	}
 
 	if len(density) > 0 {
-		dest := ts.pick(p, source, max, density)
-		return rotPix(t.rot, t.landscape, dest, ts.age, t.pw)
+		dest := ts.pick(rng, p, source, max, density)
+		return rotPix(rng, t.rot, t.landscape, dest, ts.age, t.pw)
 	}
 
 	// if density is 0 use an slow algorithm
 	max = -math.MaxFloat64
-	for px, p := range ts.scaled {
-		p = math.Log(p) + ts.pdf.LogProbRingDist(t.dm.At(source, px))
+	for _, px := range ts.scaledPix {
+		p := math.Log(ts.scaled[px]) + ts.pdf.LogProbRingDist(t.dm.At(source, px))
 		density = append(density, likePix{
 			px:      px,
 			logLike: p,
@@ -186,20 +242,52 @@ func (ts *timeStage) simulate(t *Tree, p, source int, density []likePix) int {
 		density[i].like = math.Exp(d.logLike - max)
 	}
 
-	dest := ts.pick(p, source, 1, density)
-	return rotPix(t.rot, t.landscape, dest, ts.age, t.pw)
+	dest := ts.pick(rng, p, source, 1, density)
+	return rotPix(rng, t.rot, t.landscape, dest, ts.age, t.pw)
+}
+
+// ZeroSimulate simulates a particle
+// in a zero length time stage.
+// As there is no diffusion,
+// the particle stays in the source pixel,
+// unless the pixel is invalid,
+// in which case a new pixel is picked
+// using the scaled likelihood.
+func (ts *timeStage) zeroSimulate(t *Tree, rng *rand.Rand, p, source int, density []likePix) int {
+	if ts.scaled[source] > 0 {
+		ts.particles[p] = SrcDest{
+			From: source,
+			To:   source,
+		}
+		return rotPix(rng, t.rot, t.landscape, source, ts.age, t.pw)
+	}
+
+	var max float64
+	density = density[:0]
+	for _, px := range ts.scaledPix {
+		p := ts.scaled[px]
+		density = append(density, likePix{
+			px:   px,
+			like: p,
+		})
+		if p > max {
+			max = p
+		}
+	}
+	dest := ts.pick(rng, p, source, max, density)
+	return rotPix(rng, t.rot, t.landscape, dest, ts.age, t.pw)
 }
 
 // Pick pixel picks a pixel from a destination density
 // at the scale of the density,
 // store it,
 // and return the destination pixel.
-func (ts *timeStage) pick(p, source int, scale float64, density []likePix) int {
+func (ts *timeStage) pick(rng *rand.Rand, p, source int, scale float64, density []likePix) int {
 	var dest int
 	for {
-		i := rand.IntN(len(density))
+		i := rng.IntN(len(density))
 		accept := density[i].like / scale
-		if rand.Float64() < accept {
+		if rng.Float64() < accept {
 			dest = density[i].px
 			ts.particles[p] = SrcDest{
 				From: source,
@@ -0,0 +1,168 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package diffusion_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+	"github.com/js-arias/earth/stat/pixweight"
+	"github.com/js-arias/phygeo/infer/diffusion"
+	"github.com/js-arias/ranges"
+	"github.com/js-arias/timetree"
+)
+
+// TestParam returns a small tree
+// and the parameters of a flat landscape
+// with a coarse pixelation.
+func testParam(t testing.TB) (*timetree.Tree, diffusion.Param) {
+	t.Helper()
+
+	pix := earth.NewPixelation(30)
+	stages := []int64{0, 5_000_000, 10_000_000}
+
+	rec := model.NewRecons(pix)
+	tp := model.NewTimePix(pix)
+	for _, a := range stages {
+		loc := make(map[int][]int, pix.Len())
+		for px := 0; px < pix.Len(); px++ {
+			loc[px] = []int{px}
+			tp.Set(a, px, 1)
+		}
+		rec.Add(1, loc, a)
+	}
+	rot := model.NewStageRot(rec)
+
+	dm, err := earth.NewDistMatRingScale(pix)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	pw := pixweight.New()
+	pw.Set(1, 1)
+
+	rc := ranges.New(pix)
+	rc.Add("a", 0, 10, 10)
+	rc.Add("b", 0, 20, 30)
+	rc.Add("c", 0, -10, -20)
+	rc.Add("d", 0, 0, -10)
+
+	tc, err := timetree.Newick(strings.NewReader("((a:4,b:4):4,(c:6,d:6):2);"), "t", 8_000_000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	p := diffusion.Param{
+		Landscape: tp,
+		Rot:       rot,
+		DM:        dm,
+		PW:        pw,
+		Ranges:    rc,
+		Stem:      1_000_000,
+		Lambda:    50,
+		Stages:    stages,
+	}
+	return tc.Tree("t"), p
+}
+
+func TestSimulateSeed(t *testing.T) {
+	tree, p := testParam(t)
+	const particles = 50
+
+	simulate := func(cpu int, seed uint64) *diffusion.Tree {
+		diffusion.SetCPU(cpu)
+		dt := diffusion.New(tree, p)
+		dt.DownPass()
+		dt.SetSeed(seed)
+		dt.Simulate(particles)
+		return dt
+	}
+	defer diffusion.SetCPU(1)
+
+	one := simulate(1, 42)
+	four := simulate(4, 42)
+	other := simulate(4, 43)
+
+	var diff bool
+	for _, n := range one.Nodes() {
+		for _, a := range one.Stages(n) {
+			for i := 0; i < particles; i++ {
+				want := one.SrcDest(n, i, a)
+				if got := four.SrcDest(n, i, a); got != want {
+					t.Fatalf("node %d, age %d, particle %d: got %v, want %v", n, a, i, got, want)
+				}
+				if other.SrcDest(n, i, a) != want {
+					diff = true
+				}
+			}
+		}
+	}
+	if !diff {
+		t.Errorf("different seeds: expecting different particles")
+	}
+}
+
+func TestSimulateContext(t *testing.T) {
+	tree, p := testParam(t)
+	const particles = 20
+
+	dt := diffusion.New(tree, p)
+	dt.DownPass()
+	var done int
+	dt.SetProgress(func(d, total int) {
+		if total != particles {
+			t.Errorf("progress: got total %d, want %d", total, particles)
+		}
+		done = d
+	})
+	if err := dt.SimulateContext(context.Background(), particles); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if done != particles {
+		t.Errorf("progress: got %d particles, want %d", done, particles)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dt.SetProgress(nil)
+	if err := dt.SimulateContext(ctx, particles); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled simulation: got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestSimulateZeroStage(t *testing.T) {
+	_, p := testParam(t)
+	tree := testZeroTree(t)
+	const particles = 50
+
+	dt := diffusion.New(tree, p)
+	dt.DownPass()
+	dt.SetSeed(7)
+	dt.Simulate(particles)
+
+	// node 1 is the parent of node 2,
+	// both with age 5 Ma,
+	// so the branch of node 2 has a zero length
+	const age = 5_000_000
+	y, x := 1, 2
+	for i := 0; i < particles; i++ {
+		src := dt.SrcDest(y, i, age).To
+		if src < 0 {
+			t.Fatalf("particle %d: undefined source pixel", i)
+		}
+		if sd := dt.SrcDest(x, i, age); sd.From != src || sd.To != src {
+			t.Errorf("particle %d: zero length stage: got %v, want %d", i, sd, src)
+		}
+		for _, c := range tree.Children(x) {
+			if sd := dt.SrcDest(c, i, age); sd.From != src {
+				t.Errorf("particle %d: node %d: got source %d, want %d", i, c, sd.From, src)
+			}
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package chart implements a common style
+// for the plots produced by PhyGeo commands,
+// so all the plots share the same fonts,
+// color themes,
+// output formats,
+// and sizes.
+package chart
+
+import (
+	"fmt"
+	"image/color"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/font"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+)
+
+// Font is the typeface used for the text of the plots.
+var Font = font.Font{
+	Typeface: "Liberation",
+	Variant:  "Sans",
+}
+
+// Font sizes.
+const (
+	TitleSize = 12
+	LabelSize = 10
+	TickSize  = 8
+)
+
+// A Theme is a set of colors
+// used to draw a plot.
+type Theme struct {
+	Name string
+
+	// Background color of the plot
+	Background color.Color
+
+	// Foreground is the color of the text,
+	// the axes,
+	// and the main lines of the plot
+	Foreground color.Color
+
+	// Secondary is the color
+	// of secondary lines
+	Secondary color.Color
+
+	// Fill is the color of filled areas
+	// (for example, intervals)
+	Fill color.Color
+}
+
+// Valid themes.
+var (
+	Light = Theme{
+		Name:       "light",
+		Background: color.White,
+		Foreground: color.Black,
+		Secondary:  color.Gray{128},
+		Fill:       color.RGBA{127, 188, 165, 255},
+	}
+
+	Dark = Theme{
+		Name:       "dark",
+		Background: color.RGBA{32, 32, 32, 255},
+		Foreground: color.Gray{230},
+		Secondary:  color.Gray{150},
+		Fill:       color.RGBA{58, 118, 98, 255},
+	}
+)
+
+// ParseTheme returns a theme from its name.
+// An empty name returns the light theme.
+func ParseTheme(name string) (Theme, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "light":
+		return Light, nil
+	case "dark":
+		return Dark, nil
+	}
+	return Theme{}, fmt.Errorf("unknown theme %q", name)
+}
+
+// Ramp returns a color between the background (v = 0)
+// and the foreground (v = 1) of the theme.
+func (t Theme) Ramp(v float64) color.Color {
+	if v < 0 {
+		v = 0
+	}
+	if v > 1 {
+		v = 1
+	}
+
+	br, bg, bb, _ := t.Background.RGBA()
+	fr, fg, fb, _ := t.Foreground.RGBA()
+	mix := func(b, f uint32) uint8 {
+		return uint8((float64(b) + (float64(f)-float64(b))*v) / 257)
+	}
+	return color.RGBA{mix(br, fr), mix(bg, fg), mix(bb, fb), 255}
+}
+
+// Valid output formats.
+const (
+	PNG = "png"
+	SVG = "svg"
+	PDF = "pdf"
+)
+
+// ParseFormat returns an output format from its name.
+// An empty name returns PNG.
+func ParseFormat(name string) (string, error) {
+	switch f := strings.ToLower(strings.TrimSpace(name)); f {
+	case "":
+		return PNG, nil
+	case PNG, SVG, PDF:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown format %q", name)
+}
+
+// ParseSize returns the width and height of a plot
+// from a string of the form "<width>x<height>"
+// with the values in inches,
+// for example "6x4".
+func ParseSize(s string) (w, h vg.Length, err error) {
+	ws, hs, ok := strings.Cut(strings.ToLower(s), "x")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid size %q: expecting <width>x<height>", s)
+	}
+	wv, err := strconv.ParseFloat(strings.TrimSpace(ws), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid size %q: %v", s, err)
+	}
+	hv, err := strconv.ParseFloat(strings.TrimSpace(hs), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid size %q: %v", s, err)
+	}
+	if wv <= 0 || hv <= 0 {
+		return 0, 0, fmt.Errorf("invalid size %q: values must be greater than 0", s)
+	}
+	return vg.Length(wv) * vg.Inch, vg.Length(hv) * vg.Inch, nil
+}
+
+// A Style defines how a plot is drawn
+// and saved.
+type Style struct {
+	Theme  Theme
+	Format string
+	Width  vg.Length
+	Height vg.Length
+}
+
+// NewStyle returns a style
+// from the values of the theme,
+// format,
+// and size flags of a command.
+// If the size is empty,
+// the indicated width and height
+// will be used.
+func NewStyle(theme, format, size string, w, h vg.Length) (Style, error) {
+	t, err := ParseTheme(theme)
+	if err != nil {
+		return Style{}, fmt.Errorf("flag --theme: %v", err)
+	}
+	f, err := ParseFormat(format)
+	if err != nil {
+		return Style{}, fmt.Errorf("flag --format: %v", err)
+	}
+	if size != "" {
+		w, h, err = ParseSize(size)
+		if err != nil {
+			return Style{}, fmt.Errorf("flag --plot-size: %v", err)
+		}
+	}
+	return Style{
+		Theme:  t,
+		Format: f,
+		Width:  w,
+		Height: h,
+	}, nil
+}
+
+// New returns a new plot
+// using the fonts and colors of the style.
+func (s Style) New() *plot.Plot {
+	p := plot.New()
+	fg := s.Theme.Foreground
+
+	p.BackgroundColor = s.Theme.Background
+	p.Title.TextStyle.Color = fg
+	p.Title.TextStyle.Font = font.From(Font, TitleSize)
+	p.Legend.TextStyle.Color = fg
+	p.Legend.TextStyle.Font = font.From(Font, LabelSize)
+
+	for _, a := range []*plot.Axis{&p.X, &p.Y} {
+		a.Color = fg
+		a.Label.TextStyle.Color = fg
+		a.Label.TextStyle.Font = font.From(Font, LabelSize)
+		a.Tick.Color = fg
+		a.Tick.Label.Color = fg
+		a.Tick.Label.Font = font.From(Font, TickSize)
+	}
+	return p
+}
+
+// LineStyle returns the style
+// of the main lines of a plot.
+func (s Style) LineStyle() draw.LineStyle {
+	ls := plotter.DefaultLineStyle
+	ls.Color = s.Theme.Foreground
+	return ls
+}
+
+// FileName returns a file name
+// with the extension of the output format.
+// If the name already has the extension,
+// it is returned unchanged.
+func (s Style) FileName(name string) string {
+	ext := "." + s.Format
+	if strings.EqualFold(filepath.Ext(name), ext) {
+		return name
+	}
+	return name + ext
+}
+
+// Save writes a plot into a file
+// using the format and size of the style.
+// The extension of the format will be added
+// to the file name
+// (if it is not already present).
+func (s Style) Save(p *plot.Plot, name string) error {
+	name = s.FileName(name)
+	if err := p.Save(s.Width, s.Height, name); err != nil {
+		return fmt.Errorf("while writing plot %q: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package chart_test
+
+import (
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/js-arias/phygeo/internal/chart"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+)
+
+func TestNewStyle(t *testing.T) {
+	s, err := chart.NewStyle("", "", "", 5*vg.Inch, 3*vg.Inch)
+	if err != nil {
+		t.Fatalf("default style: unexpected error: %v", err)
+	}
+	if s.Theme.Name != "light" {
+		t.Errorf("default style: theme: got %q, want %q", s.Theme.Name, "light")
+	}
+	if s.Format != chart.PNG {
+		t.Errorf("default style: format: got %q, want %q", s.Format, chart.PNG)
+	}
+	if s.Width != 5*vg.Inch || s.Height != 3*vg.Inch {
+		t.Errorf("default style: size: got %vx%v, want %vx%v", s.Width, s.Height, 5*vg.Inch, 3*vg.Inch)
+	}
+
+	s, err = chart.NewStyle("Dark", "SVG", "8x2.5", 5*vg.Inch, 3*vg.Inch)
+	if err != nil {
+		t.Fatalf("dark style: unexpected error: %v", err)
+	}
+	if s.Theme.Name != "dark" {
+		t.Errorf("dark style: theme: got %q, want %q", s.Theme.Name, "dark")
+	}
+	if s.Format != chart.SVG {
+		t.Errorf("dark style: format: got %q, want %q", s.Format, chart.SVG)
+	}
+	if s.Width != 8*vg.Inch || s.Height != 2.5*vg.Inch {
+		t.Errorf("dark style: size: got %vx%v, want %vx%v", s.Width, s.Height, 8*vg.Inch, 2.5*vg.Inch)
+	}
+
+	bad := []struct {
+		name                string
+		theme, format, size string
+	}{
+		{"theme", "neon", "", ""},
+		{"format", "", "gif", ""},
+		{"size without height", "", "", "6"},
+		{"size with text", "", "", "axb"},
+		{"negative size", "", "", "-6x4"},
+	}
+	for _, b := range bad {
+		if _, err := chart.NewStyle(b.theme, b.format, b.size, 5*vg.Inch, 3*vg.Inch); err == nil {
+			t.Errorf("%s: expecting error", b.name)
+		}
+	}
+}
+
+func TestRamp(t *testing.T) {
+	tests := map[string]struct {
+		theme chart.Theme
+		v     float64
+		want  color.RGBA
+	}{
+		"light background": {chart.Light, 0, color.RGBA{255, 255, 255, 255}},
+		"light foreground": {chart.Light, 1, color.RGBA{0, 0, 0, 255}},
+		"light clamped":    {chart.Light, 2, color.RGBA{0, 0, 0, 255}},
+		"dark background":  {chart.Dark, 0, color.RGBA{32, 32, 32, 255}},
+		"dark foreground":  {chart.Dark, 1, color.RGBA{230, 230, 230, 255}},
+	}
+	for name, test := range tests {
+		if got := test.theme.Ramp(test.v); got != test.want {
+			t.Errorf("%s: got %v, want %v", name, got, test.want)
+		}
+	}
+}
+
+func TestSave(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{chart.PNG, chart.SVG, chart.PDF} {
+		s, err := chart.NewStyle("dark", f, "", 3*vg.Inch, 2*vg.Inch)
+		if err != nil {
+			t.Fatalf("format %q: unexpected error: %v", f, err)
+		}
+		p := s.New()
+		ln, err := plotter.NewLine(plotter.XYs{{X: 0, Y: 0}, {X: 1, Y: 1}})
+		if err != nil {
+			t.Fatalf("format %q: unexpected error: %v", f, err)
+		}
+		ln.LineStyle = s.LineStyle()
+		p.Add(ln)
+
+		name := filepath.Join(dir, "plot")
+		if err := s.Save(p, name); err != nil {
+			t.Fatalf("format %q: unable to save plot: %v", f, err)
+		}
+		if _, err := os.Stat(name + "." + f); err != nil {
+			t.Errorf("format %q: %v", f, err)
+		}
+	}
+
+	s := chart.Style{Format: chart.PNG}
+	if got := s.FileName("plot.PNG"); got != "plot.PNG" {
+		t.Errorf("file name: got %q, want %q", got, "plot.PNG")
+	}
+}
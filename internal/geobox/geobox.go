@@ -0,0 +1,104 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package geobox implements geographic boxes,
+// i.e., regions defined by the coordinates
+// of two opposite corners.
+package geobox
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/js-arias/earth"
+	"github.com/js-arias/earth/model"
+)
+
+// A Box is a region defined
+// by the coordinates of two opposite corners.
+//
+// If West is greater than East,
+// the box crosses the antimeridian.
+type Box struct {
+	South, North float64
+	West, East   float64
+}
+
+// Parse parses a box from a string
+// with the latitude and longitude
+// of two opposite corners,
+// separated by commas,
+// for example "-10,-80,-40,-50".
+//
+// The first corner is the western corner
+// and the second corner is the eastern corner,
+// so if the longitude of the first corner
+// is greater than the longitude of the second corner,
+// the box crosses the antimeridian.
+// The order of the latitudes is irrelevant.
+func Parse(val string) (Box, error) {
+	coords := strings.Split(val, ",")
+	if len(coords) != 4 {
+		return Box{}, fmt.Errorf("expecting 4 coordinates, got %d", len(coords))
+	}
+	var c [4]float64
+	for i, v := range coords {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return Box{}, err
+		}
+		c[i] = f
+	}
+	for _, lat := range []float64{c[0], c[2]} {
+		if lat < -90 || lat > 90 {
+			return Box{}, fmt.Errorf("invalid latitude %.6f", lat)
+		}
+	}
+	for _, lon := range []float64{c[1], c[3]} {
+		if lon < -180 || lon > 180 {
+			return Box{}, fmt.Errorf("invalid longitude %.6f", lon)
+		}
+	}
+
+	return Box{
+		South: math.Min(c[0], c[2]),
+		North: math.Max(c[0], c[2]),
+		West:  c[1],
+		East:  c[3],
+	}, nil
+}
+
+// In returns true if a point
+// is inside the box.
+func (b Box) In(lat, lon float64) bool {
+	if lat < b.South || lat > b.North {
+		return false
+	}
+	if b.West <= b.East {
+		return lon >= b.West && lon <= b.East
+	}
+
+	// the box crosses the antimeridian
+	return lon >= b.West || lon <= b.East
+}
+
+// Region returns the pixels of the box
+// rotated to the given time stage.
+func (b Box) Region(pix *earth.Pixelation, tot *model.Total, age int64) map[int]bool {
+	rot := tot.Rotation(age)
+
+	region := make(map[int]bool)
+	for id := 0; id < pix.Len(); id++ {
+		pt := pix.ID(id).Point()
+		if !b.In(pt.Latitude(), pt.Longitude()) {
+			continue
+		}
+		for _, px := range rot[id] {
+			region[px] = true
+		}
+	}
+	return region
+}
@@ -0,0 +1,85 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package geobox_test
+
+import (
+	"testing"
+
+	"github.com/js-arias/phygeo/internal/geobox"
+)
+
+func TestParse(t *testing.T) {
+	tests := map[string]struct {
+		val  string
+		want geobox.Box
+	}{
+		"simple": {
+			val:  "-10,-80,-40,-50",
+			want: geobox.Box{South: -40, North: -10, West: -80, East: -50},
+		},
+		"spaces": {
+			val:  " 40, 10, 20, 30",
+			want: geobox.Box{South: 20, North: 40, West: 10, East: 30},
+		},
+		"antimeridian": {
+			val:  "-10,170,-30,-170",
+			want: geobox.Box{South: -30, North: -10, West: 170, East: -170},
+		},
+	}
+
+	for name, test := range tests {
+		b, err := geobox.Parse(test.val)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+			continue
+		}
+		if b != test.want {
+			t.Errorf("%s: got %v, want %v", name, b, test.want)
+		}
+	}
+
+	for _, val := range []string{
+		"-10,-80,-40",
+		"-10,-80,-40,x",
+		"-100,-80,-40,-50",
+		"-10,-80,-40,190",
+	} {
+		if _, err := geobox.Parse(val); err == nil {
+			t.Errorf("parse %q: expecting error", val)
+		}
+	}
+}
+
+func TestIn(t *testing.T) {
+	tests := map[string]struct {
+		box geobox.Box
+		in  [][2]float64
+		out [][2]float64
+	}{
+		"simple": {
+			box: geobox.Box{South: -40, North: -10, West: -80, East: -50},
+			in:  [][2]float64{{-20, -60}, {-10, -80}, {-40, -50}},
+			out: [][2]float64{{-20, -90}, {-20, -40}, {0, -60}, {-20, 120}},
+		},
+		"antimeridian": {
+			box: geobox.Box{South: -30, North: -10, West: 170, East: -170},
+			in:  [][2]float64{{-20, 175}, {-20, 180}, {-20, -180}, {-20, -175}},
+			out: [][2]float64{{-20, 0}, {-20, 160}, {-20, -160}, {10, 175}},
+		},
+	}
+
+	for name, test := range tests {
+		for _, pt := range test.in {
+			if !test.box.In(pt[0], pt[1]) {
+				t.Errorf("%s: point %v: expecting point inside box", name, pt)
+			}
+		}
+		for _, pt := range test.out {
+			if test.box.In(pt[0], pt[1]) {
+				t.Errorf("%s: point %v: expecting point outside box", name, pt)
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package input implements the opening
+// of the input files of PhyGeo commands
+// (e.g., the down-pass or particle files),
+// that can be compressed with gzip.
+package input
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Open opens an input file for reading.
+// If name is "-",
+// and stdin is not nil,
+// it will read from stdin.
+// If the file is compressed with gzip,
+// it will be decompressed.
+func Open(name string, stdin io.Reader) (io.ReadCloser, error) {
+	if name == "-" && stdin != nil {
+		return NewReader(io.NopCloser(stdin))
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+	return r, nil
+}
+
+// NewReader returns a reader
+// that decompresses the content of rc
+// if it is compressed with gzip
+// (as detected from the magic number of gzip).
+// Closing the returned reader
+// closes rc.
+func NewReader(rc io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReader(rc)
+	magic, err := br.Peek(2)
+	if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		return readCloser{br, rc}, nil
+	}
+
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return gzipReader{zr, rc}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// A gzipReader closes both
+// the gzip reader,
+// and the underlying reader.
+type gzipReader struct {
+	*gzip.Reader
+	c io.Closer
+}
+
+func (z gzipReader) Close() error {
+	err := z.Reader.Close()
+	if e := z.c.Close(); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package input_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/js-arias/phygeo/internal/input"
+)
+
+const data = "tree\tparticle\tnode\r\nt1\t0\t0\r\n"
+
+func TestOpen(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(data)); err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain.tab")
+	if err := os.WriteFile(plain, []byte(data), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	gz := filepath.Join(dir, "compressed.tab.gz")
+	if err := os.WriteFile(gz, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	tests := map[string]struct {
+		name  string
+		stdin io.Reader
+	}{
+		"plain file":       {name: plain},
+		"compressed file":  {name: gz},
+		"plain stdin":      {name: "-", stdin: strings.NewReader(data)},
+		"compressed stdin": {name: "-", stdin: bytes.NewReader(buf.Bytes())},
+		"empty stdin":      {name: "-", stdin: strings.NewReader("")},
+	}
+	for name, test := range tests {
+		r, err := input.Open(test.name, test.stdin)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+			continue
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Errorf("%s: read: %v", name, err)
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("%s: close: %v", name, err)
+		}
+
+		want := data
+		if name == "empty stdin" {
+			want = ""
+		}
+		if string(b) != want {
+			t.Errorf("%s: got %q, want %q", name, b, want)
+		}
+	}
+
+	if _, err := input.Open(filepath.Join(dir, "none.tab"), nil); err == nil {
+		t.Errorf("undefined file: expecting error")
+	}
+
+	// without stdin,
+	// "-" is a file name
+	if _, err := input.Open("-", nil); err == nil {
+		t.Errorf("undefined stdin: expecting error")
+	}
+}
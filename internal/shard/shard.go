@@ -0,0 +1,63 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package shard implements the splitting
+// of the jobs of a command
+// (e.g., the trees of a project)
+// into shards,
+// so they can be processed in different machines.
+package shard
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Shard is a part of a list of jobs.
+type Shard struct {
+	// I is the shard to be processed
+	// (from 1 to N).
+	I int
+
+	// N is the number of shards.
+	N int
+}
+
+// Parse parses the value of a --shard flag,
+// in the form "i/n",
+// in which n is the number of shards,
+// and i is the shard to be processed
+// (from 1 to n).
+// If the value is empty,
+// it returns a shard that includes all the jobs.
+func Parse(s string) (Shard, error) {
+	if s == "" {
+		return Shard{I: 1, N: 1}, nil
+	}
+	f := strings.Split(s, "/")
+	if len(f) != 2 {
+		return Shard{}, fmt.Errorf("invalid shard %q: expecting \"i/n\"", s)
+	}
+	i, err := strconv.Atoi(strings.TrimSpace(f[0]))
+	if err != nil {
+		return Shard{}, fmt.Errorf("invalid shard %q: %v", s, err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(f[1]))
+	if err != nil {
+		return Shard{}, fmt.Errorf("invalid shard %q: %v", s, err)
+	}
+	if n < 1 || i < 1 || i > n {
+		return Shard{}, fmt.Errorf("invalid shard %q: expecting a value between 1 and %d", s, n)
+	}
+	return Shard{I: i, N: n}, nil
+}
+
+// Has returns true if the element k
+// (starting from 0)
+// of a list
+// is part of the shard.
+func (s Shard) Has(k int) bool {
+	return k%s.N == s.I-1
+}
@@ -0,0 +1,56 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package shard_test
+
+import (
+	"testing"
+
+	"github.com/js-arias/phygeo/internal/shard"
+)
+
+func TestParse(t *testing.T) {
+	tests := map[string]shard.Shard{
+		"":      {I: 1, N: 1},
+		"1/1":   {I: 1, N: 1},
+		"2/3":   {I: 2, N: 3},
+		" 3/ 4": {I: 3, N: 4},
+	}
+	for in, want := range tests {
+		got, err := shard.Parse(in)
+		if err != nil {
+			t.Errorf("shard %q: unexpected error: %v", in, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("shard %q: got %v, want %v", in, got, want)
+		}
+	}
+
+	for _, in := range []string{"1", "0/2", "3/2", "a/2", "1/b", "1/2/3"} {
+		if _, err := shard.Parse(in); err == nil {
+			t.Errorf("shard %q: expecting error", in)
+		}
+	}
+}
+
+func TestHas(t *testing.T) {
+	s := shard.Shard{I: 2, N: 3}
+	var got []int
+	for k := 0; k < 9; k++ {
+		if s.Has(k) {
+			got = append(got, k)
+		}
+	}
+	want := []int{1, 4, 7}
+	if len(got) != len(want) {
+		t.Fatalf("elements: got %v, want %v", got, want)
+	}
+	for i, k := range want {
+		if got[i] != k {
+			t.Errorf("elements: got %v, want %v", got, want)
+			break
+		}
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"image/color"
 	"io"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -22,6 +23,7 @@ import (
 type PixKey struct {
 	color map[int]color.Color
 	gray  map[int]uint8
+	label map[int]string
 }
 
 // Color returns the color associated with a given value.
@@ -52,6 +54,24 @@ func (pk *PixKey) Gray(v int) (color.Color, bool) {
 	return color.RGBA{g, g, g, 255}, true
 }
 
+// Keys returns the values with a defined color,
+// sorted from the smallest to the largest.
+func (pk *PixKey) Keys() []int {
+	keys := make([]int, 0, len(pk.color))
+	for v := range pk.color {
+		keys = append(keys, v)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Label returns the label associated with a given value.
+// If no label is defined for the value,
+// it will return an empty string.
+func (pk *PixKey) Label(v int) string {
+	return pk.label[v]
+}
+
 // SetColor sets a color to be associated with a given value.
 func (pk *PixKey) SetColor(c color.Color, v int) {
 	if pk.color == nil {
@@ -73,6 +93,9 @@ func (pk *PixKey) SetColor(c color.Color, v int) {
 // Optionally it can contain the following columns:
 //
 //	-gray:  for a gray scale value
+//	-label: for a description of the value
+//		(if there is no label column,
+//		the column "comment" will be used as label).
 //
 // Any other columns, will be ignored.
 // Here is an example of a key file:
@@ -91,7 +114,13 @@ func Read(name string) (*PixKey, error) {
 	}
 	defer f.Close()
 
-	r := csv.NewReader(f)
+	return ReadTSV(f)
+}
+
+// ReadTSV reads a key from a TSV stream.
+// The format is the same as the one used by Read.
+func ReadTSV(in io.Reader) (*PixKey, error) {
+	r := csv.NewReader(in)
 	r.Comma = '\t'
 	r.Comment = '#'
 
@@ -110,9 +139,15 @@ func Read(name string) (*PixKey, error) {
 		}
 	}
 
+	labelCol, hasLabel := fields["label"]
+	if !hasLabel {
+		labelCol, hasLabel = fields["comment"]
+	}
+
 	pk := &PixKey{
 		color: make(map[int]color.Color),
 		gray:  make(map[int]uint8),
+		label: make(map[int]string),
 	}
 
 	for {
@@ -162,6 +197,12 @@ func Read(name string) (*PixKey, error) {
 		c := color.RGBA{uint8(red), uint8(green), uint8(blue), 255}
 		pk.color[k] = c
 
+		if hasLabel {
+			if lb := strings.Join(strings.Fields(row[labelCol]), " "); lb != "" {
+				pk.label[k] = lb
+			}
+		}
+
 		f = "gray"
 		if _, ok := fields[f]; !ok {
 			continue
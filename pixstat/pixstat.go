@@ -0,0 +1,176 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package pixstat implements summary statistics
+// of sets of pixels
+// that are aware of the periodic boundary
+// of the longitude
+// (i.e., the anti-meridian at ±180°).
+//
+// A naive average of longitudes
+// near the anti-meridian
+// gives nonsense values
+// (e.g., the average of 179° and -179° is 0°),
+// so all the statistics are calculated
+// either on the sphere,
+// or taking into account the wrap-around
+// of the longitude.
+package pixstat
+
+import (
+	"math"
+	"slices"
+
+	"github.com/js-arias/earth"
+	"gonum.org/v1/gonum/spatial/r3"
+)
+
+// Centroid returns the centroid of a set of pixels
+// weighted by the given values.
+// The centroid is the normalized mean
+// of the pixel locations on the sphere.
+// It returns false if the centroid is undefined
+// (for example,
+// the set is empty
+// or the pixels are evenly spread around the sphere).
+func Centroid(pix *earth.Pixelation, w map[int]float64) (earth.Point, bool) {
+	var sum r3.Vec
+	for px, v := range w {
+		if v <= 0 {
+			continue
+		}
+		sum = r3.Add(sum, r3.Scale(v, pix.ID(px).Point().Vector()))
+	}
+	n := r3.Norm(sum)
+	if n < 1e-12 {
+		return earth.Point{}, false
+	}
+	v := r3.Scale(1/n, sum)
+	lat := earth.ToDegree(math.Asin(v.Z))
+	lon := earth.ToDegree(math.Atan2(v.Y, v.X))
+	return earth.NewPoint(lat, lon), true
+}
+
+// HPDRadius returns the radius,
+// in radians,
+// of the smallest circle around a point
+// that contains the given fraction
+// (a value between 0 and 1)
+// of the total weight of a set of pixels.
+// Distances are great circle distances,
+// so they are not affected by the anti-meridian.
+func HPDRadius(pix *earth.Pixelation, w map[int]float64, c earth.Point, level float64) float64 {
+	type pixDist struct {
+		dist float64
+		w    float64
+	}
+
+	var sum float64
+	pd := make([]pixDist, 0, len(w))
+	for px, v := range w {
+		if v <= 0 {
+			continue
+		}
+		sum += v
+		pd = append(pd, pixDist{
+			dist: earth.Distance(c, pix.ID(px).Point()),
+			w:    v,
+		})
+	}
+	if len(pd) == 0 {
+		return 0
+	}
+	slices.SortFunc(pd, func(a, b pixDist) int {
+		if a.dist < b.dist {
+			return -1
+		}
+		if a.dist > b.dist {
+			return 1
+		}
+		return 0
+	})
+
+	var acc float64
+	for _, p := range pd {
+		acc += p.w
+		if acc >= level*sum {
+			return p.dist
+		}
+	}
+	return pd[len(pd)-1].dist
+}
+
+// A BBox is a bounding box
+// in geographic coordinates.
+//
+// The longitude range goes eastward
+// from West to East,
+// so if the box crosses the anti-meridian,
+// West will be greater than East.
+type BBox struct {
+	South float64
+	North float64
+	West  float64
+	East  float64
+}
+
+// Bounds returns the smallest bounding box
+// that contains the centers of a set of pixels.
+//
+// The longitude range is found
+// as the complement of the largest gap
+// between the longitudes of the pixels,
+// so ranges that cross the anti-meridian
+// have the correct bounds.
+// It returns false if the set is empty.
+func Bounds(pix *earth.Pixelation, pixels []int) (BBox, bool) {
+	if len(pixels) == 0 {
+		return BBox{}, false
+	}
+
+	b := BBox{South: 90, North: -90}
+	lons := make([]float64, 0, len(pixels))
+	for _, px := range pixels {
+		pt := pix.ID(px).Point()
+		if pt.Latitude() < b.South {
+			b.South = pt.Latitude()
+		}
+		if pt.Latitude() > b.North {
+			b.North = pt.Latitude()
+		}
+		lons = append(lons, pt.Longitude())
+	}
+	slices.Sort(lons)
+	lons = slices.Compact(lons)
+
+	// the gap that crosses the anti-meridian
+	b.West = lons[0]
+	b.East = lons[len(lons)-1]
+	gap := lons[0] + 360 - lons[len(lons)-1]
+	for i := 1; i < len(lons); i++ {
+		if g := lons[i] - lons[i-1]; g > gap {
+			gap = g
+			b.West = lons[i]
+			b.East = lons[i-1]
+		}
+	}
+	return b, true
+}
+
+// CrossesAntimeridian returns true
+// if the bounding box crosses the anti-meridian.
+func (b BBox) CrossesAntimeridian() bool {
+	return b.West > b.East
+}
+
+// Width returns the longitude range
+// of the bounding box,
+// in degrees.
+func (b BBox) Width() float64 {
+	w := b.East - b.West
+	if w < 0 {
+		w += 360
+	}
+	return w
+}
@@ -0,0 +1,175 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package pixstat_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/js-arias/earth"
+	"github.com/js-arias/phygeo/pixstat"
+)
+
+type location struct {
+	lat, lon float64
+}
+
+// a range at both sides of the anti-meridian
+// (e.g., Fiji and Samoa)
+var transPacific = []location{
+	{-17, 177},
+	{-18, 178},
+	{-17, 179},
+	{-14, -172},
+	{-13, -171},
+}
+
+func pixels(pix *earth.Pixelation, locs []location) map[int]float64 {
+	w := make(map[int]float64)
+	for _, l := range locs {
+		w[pix.Pixel(l.lat, l.lon).ID()] = 1
+	}
+	return w
+}
+
+func TestCentroid(t *testing.T) {
+	pix := earth.NewPixelation(360)
+
+	tests := map[string]struct {
+		locs []location
+		lat  float64
+		lon  float64
+	}{
+		"trans-pacific": {
+			locs: transPacific,
+			lat:  -16,
+			lon:  -178,
+		},
+		"greenwich": {
+			locs: []location{
+				{10, -5},
+				{10, 5},
+			},
+			lat: 10,
+			lon: 0,
+		},
+		"dateline": {
+			locs: []location{
+				{0, 175},
+				{0, -175},
+			},
+			lat: 0,
+			lon: 180,
+		},
+	}
+
+	for name, test := range tests {
+		w := pixels(pix, test.locs)
+		c, ok := pixstat.Centroid(pix, w)
+		if !ok {
+			t.Errorf("%s: centroid undefined", name)
+			continue
+		}
+
+		// tolerance of about two pixels
+		want := earth.NewPoint(test.lat, test.lon)
+		if d := earth.ToDegree(earth.Distance(c, want)); d > 2*pix.Step() {
+			t.Errorf("%s: centroid: got %.3f, %.3f, want %.3f, %.3f", name, c.Latitude(), c.Longitude(), test.lat, test.lon)
+		}
+		if name == "trans-pacific" && math.Abs(c.Longitude()) < 170 {
+			t.Errorf("%s: centroid longitude %.3f: expecting a value near the anti-meridian", name, c.Longitude())
+		}
+	}
+
+	if _, ok := pixstat.Centroid(pix, nil); ok {
+		t.Errorf("empty: expecting undefined centroid")
+	}
+}
+
+func TestHPDRadius(t *testing.T) {
+	pix := earth.NewPixelation(360)
+
+	w := pixels(pix, transPacific)
+	c, _ := pixstat.Centroid(pix, w)
+
+	r := earth.ToDegree(pixstat.HPDRadius(pix, w, c, 1))
+	if r > 10 {
+		t.Errorf("trans-pacific: radius %.3f: expecting a value smaller than 10", r)
+	}
+
+	// the most distant pixel
+	var max float64
+	for px := range w {
+		if d := earth.ToDegree(earth.Distance(c, pix.ID(px).Point())); d > max {
+			max = d
+		}
+	}
+	if math.Abs(r-max) > 1e-6 {
+		t.Errorf("trans-pacific: radius %.6f, want %.6f", r, max)
+	}
+
+	half := earth.ToDegree(pixstat.HPDRadius(pix, w, c, 0.5))
+	if half > r {
+		t.Errorf("trans-pacific: radius at 0.5 (%.3f) greater than radius at 1.0 (%.3f)", half, r)
+	}
+}
+
+func TestBounds(t *testing.T) {
+	pix := earth.NewPixelation(360)
+
+	tests := map[string]struct {
+		locs    []location
+		west    float64
+		east    float64
+		crosses bool
+	}{
+		"trans-pacific": {
+			locs:    transPacific,
+			west:    177,
+			east:    -171,
+			crosses: true,
+		},
+		"atlantic": {
+			locs: []location{
+				{40, -70},
+				{50, -10},
+				{-10, -35},
+			},
+			west:    -70,
+			east:    -10,
+			crosses: false,
+		},
+	}
+
+	for name, test := range tests {
+		var px []int
+		for id := range pixels(pix, test.locs) {
+			px = append(px, id)
+		}
+		b, ok := pixstat.Bounds(pix, px)
+		if !ok {
+			t.Errorf("%s: bounds undefined", name)
+			continue
+		}
+		if b.CrossesAntimeridian() != test.crosses {
+			t.Errorf("%s: crosses anti-meridian: got %v, want %v", name, b.CrossesAntimeridian(), test.crosses)
+		}
+
+		// tolerance of a pixel
+		if math.Abs(b.West-test.west) > pix.Step() {
+			t.Errorf("%s: west: got %.3f, want %.3f", name, b.West, test.west)
+		}
+		if math.Abs(b.East-test.east) > pix.Step() {
+			t.Errorf("%s: east: got %.3f, want %.3f", name, b.East, test.east)
+		}
+		if b.Width() > 180 {
+			t.Errorf("%s: width: got %.3f, want a value smaller than 180", name, b.Width())
+		}
+	}
+
+	if _, ok := pixstat.Bounds(pix, nil); ok {
+		t.Errorf("empty: expecting undefined bounds")
+	}
+}
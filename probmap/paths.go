@@ -0,0 +1,78 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package probmap
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/js-arias/earth"
+	"gonum.org/v1/gonum/spatial/r3"
+)
+
+// A Path is a movement between two pixels
+// drawn as a great-circle polyline.
+type Path struct {
+	// Pixel IDs of the start and end of the path
+	From, To int
+
+	// Color of the path
+	Color color.Color
+}
+
+// SetLines sets the image pixels
+// used to draw the paths.
+func (i *Image) setLines() {
+	i.lines = nil
+	if len(i.Paths) == 0 {
+		return
+	}
+
+	rows := i.Cols / 2
+	pix := i.Landscape.Pixelation()
+
+	i.lines = make(map[image.Point]color.RGBA)
+	for _, p := range i.Paths {
+		c := color.RGBAModel.Convert(p.Color).(color.RGBA)
+
+		from := pix.ID(p.From).Point().Vector()
+		to := pix.ID(p.To).Point().Vector()
+		angle := math.Acos(math.Max(-1, math.Min(1, r3.Dot(from, to))))
+
+		// sample the great circle
+		// at half the size of an image pixel
+		n := int(math.Ceil(earth.ToDegree(angle)/(i.step/2))) + 1
+		for j := 0; j <= n; j++ {
+			v := slerp(from, to, angle, float64(j)/float64(n))
+			lat := earth.ToDegree(math.Asin(math.Max(-1, math.Min(1, v.Z))))
+			lon := earth.ToDegree(math.Atan2(v.Y, v.X))
+			x := int((lon + 180) / i.step)
+			y := int((90 - lat) / i.step)
+			if y < 0 || y >= rows {
+				continue
+			}
+			i.lines[image.Point{X: (x + i.Cols) % i.Cols, Y: y}] = c
+		}
+	}
+}
+
+// Slerp returns the spherical linear interpolation
+// between two unit vectors
+// separated by the given angle.
+func slerp(a, b r3.Vec, angle, t float64) r3.Vec {
+	s := math.Sin(angle)
+	if s < 1e-9 {
+		// the points are the same,
+		// or antipodal
+		if t < 0.5 {
+			return a
+		}
+		return b
+	}
+	wa := math.Sin((1-t)*angle) / s
+	wb := math.Sin(t*angle) / s
+	return r3.Add(r3.Scale(wa, a), r3.Scale(wb, b))
+}
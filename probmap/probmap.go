@@ -49,8 +49,70 @@ type Image struct {
 	// A Gradient color scheme
 	Gradient Gradienter
 
-	step float64
-	cAge int64
+	// Background is the color used for the landscape pixels
+	// without a color in the color keys.
+	// If nil,
+	// a light gray will be used.
+	Background color.Color
+
+	// LandAlpha is the opacity
+	// (between 0 and 1)
+	// of the landscape colors.
+	// If zero,
+	// the landscape colors will be opaque.
+	LandAlpha float64
+
+	// Landscape values that will be drawn
+	// fully transparent.
+	Transparent map[int]bool
+
+	// Relief is an elevation model
+	// (with values in meters)
+	// used to draw a hillshade
+	// over the landscape colors.
+	// It must use the same pixelation
+	// as the landscape model.
+	// If nil,
+	// the landscape colors will be flat.
+	Relief *model.TimePix
+
+	// Exaggeration is the vertical exaggeration
+	// of the relief.
+	// If zero,
+	// no exaggeration will be used.
+	Exaggeration float64
+
+	// RangeAlpha is the opacity
+	// (between 0 and 1)
+	// of the range colors
+	// when they are drawn over a relief.
+	// If zero,
+	// DefaultRangeAlpha will be used.
+	RangeAlpha float64
+
+	// Pixels with observed records,
+	// drawn as symbols over the map.
+	// If the image uses a total rotation,
+	// the pixels must be from the present time,
+	// otherwise,
+	// they must be from the time stage of the image.
+	Points map[int]bool
+
+	// Paths drawn over the map
+	// (for example, particle trajectories).
+	// As the points,
+	// the pixels must be from the present time
+	// if the image uses a total rotation,
+	// or from the time stage of the image,
+	// otherwise.
+	Paths []Path
+
+	step  float64
+	cAge  int64
+	marks map[image.Point]color.RGBA
+	lines map[image.Point]color.RGBA
+	shade []float64
+	band  int
 }
 
 func (i *Image) Format(tot *model.Total) {
@@ -71,11 +133,64 @@ func (i *Image) Format(tot *model.Total) {
 	if i.Gradient == nil {
 		i.Gradient = RainbowPurpleToRed{}
 	}
+
+	i.setMarks()
+	i.setLines()
+	i.setRelief()
+}
+
+// SetMarks sets the image pixels
+// used to draw the symbols of the points.
+// Each symbol is a white circle with a black border.
+func (i *Image) setMarks() {
+	i.marks = nil
+	if len(i.Points) == 0 {
+		return
+	}
+
+	r := i.Cols / 720
+	if r < 2 {
+		r = 2
+	}
+	rows := i.Cols / 2
+
+	i.marks = make(map[image.Point]color.RGBA)
+	pix := i.Landscape.Pixelation()
+	for px := range i.Points {
+		pt := pix.ID(px).Point()
+		cx := int((pt.Longitude() + 180) / i.step)
+		cy := int((90 - pt.Latitude()) / i.step)
+		for y := cy - r; y <= cy+r; y++ {
+			if y < 0 || y >= rows {
+				continue
+			}
+			for x := cx - r; x <= cx+r; x++ {
+				d := (x-cx)*(x-cx) + (y-cy)*(y-cy)
+				if d > r*r {
+					continue
+				}
+				mp := image.Point{X: (x + i.Cols) % i.Cols, Y: y}
+				if d > (r-1)*(r-1) {
+					i.marks[mp] = color.RGBA{A: 255}
+					continue
+				}
+				if _, ok := i.marks[mp]; !ok {
+					i.marks[mp] = color.RGBA{255, 255, 255, 255}
+				}
+			}
+		}
+	}
 }
 
 func (i *Image) ColorModel() color.Model { return color.RGBAModel }
 func (i *Image) Bounds() image.Rectangle { return image.Rect(0, 0, i.Cols, i.Cols/2) }
 func (i *Image) At(x, y int) color.Color {
+	if c, ok := i.marks[image.Point{X: x, Y: y}]; ok {
+		return c
+	}
+	if c, ok := i.lines[image.Point{X: x, Y: y}]; ok {
+		return c
+	}
 	if i.Contour != nil {
 		_, _, _, a := i.Contour.At(x, y).RGBA()
 		if a > 100 {
@@ -94,33 +209,10 @@ func (i *Image) At(x, y int) color.Color {
 		dst := i.Tot[pix.ID()]
 		if len(dst) == 0 {
 			v, _ := i.Landscape.At(0, pix.ID())
-			if i.Gray {
-				if c, ok := i.Keys.Gray(v); ok {
-					return c
-				}
-			} else if i.Keys != nil {
-				if c, ok := i.Keys.Color(v); ok {
-					return c
-				}
-			}
-			return color.RGBA{211, 211, 211, 255}
-		}
-
-		// Check if the pixel is in the range
-		// of the time stage
-		var max float64
-		for _, px := range dst {
-			p := i.Rng[px]
-			if p > max {
-				max = p
-			}
-		}
-		if max > 0 {
-			return i.Gradient.Gradient(max)
+			return i.shadeColor(x, y, i.landColor(v))
 		}
 
-		// The taxon is absent,
-		// use the landscape value of the pixel
+		// the landscape value of the pixel
 		// at the stage time
 		var v int
 		if i.Present {
@@ -134,38 +226,66 @@ func (i *Image) At(x, y int) color.Color {
 			}
 		}
 
-		if i.Keys != nil {
-			if i.Gray {
-				if c, ok := i.Keys.Gray(v); ok {
-					return c
-				}
-			} else {
-				if c, ok := i.Keys.Color(v); ok {
-					return c
-				}
+		// Check if the pixel is in the range
+		// of the time stage
+		var max float64
+		for _, px := range dst {
+			p := i.Rng[px]
+			if p > max {
+				max = p
 			}
 		}
-		return color.RGBA{211, 211, 211, 255}
+		if max > 0 {
+			return i.rangeColor(x, y, max, v)
+		}
+
+		// The taxon is absent,
+		// use the landscape value
+		return i.shadeColor(x, y, i.landColor(v))
 	}
 
 	// No rotation
+	v, _ := i.Landscape.At(i.cAge, pix.ID())
 	if p, ok := i.Rng[pix.ID()]; ok {
-		return i.Gradient.Gradient(p)
+		return i.rangeColor(x, y, p, v)
 	}
+	return i.shadeColor(x, y, i.landColor(v))
+}
 
-	v, _ := i.Landscape.At(i.cAge, pix.ID())
+// LandColor returns the color
+// of a landscape value.
+func (i *Image) landColor(v int) color.Color {
+	if i.Transparent[v] {
+		return color.RGBA{}
+	}
+
+	var c color.Color = color.RGBA{211, 211, 211, 255}
+	if i.Background != nil {
+		c = i.Background
+	}
 	if i.Keys != nil {
 		if i.Gray {
-			if c, ok := i.Keys.Gray(v); ok {
-				return c
+			if kc, ok := i.Keys.Gray(v); ok {
+				c = kc
 			}
 		} else {
-			if c, ok := i.Keys.Color(v); ok {
-				return c
+			if kc, ok := i.Keys.Color(v); ok {
+				c = kc
 			}
 		}
 	}
-	return color.RGBA{211, 211, 211, 255}
+
+	if i.LandAlpha <= 0 || i.LandAlpha >= 1 {
+		return c
+	}
+	// colors are alpha-premultiplied
+	r, g, b, a := c.RGBA()
+	return color.RGBA64{
+		R: uint16(float64(r) * i.LandAlpha),
+		G: uint16(float64(g) * i.LandAlpha),
+		B: uint16(float64(b) * i.LandAlpha),
+		A: uint16(float64(a) * i.LandAlpha),
+	}
 }
 
 // Gradientes is an interface for types
@@ -256,3 +376,36 @@ func (r RainbowPurpleToRed) Gradient(v float64) color.Color {
 
 	return blind.Sequential(blind.RainbowPurpleToRed, v)
 }
+
+// Sunset is the diverging sunset color scheme
+// of Paul Tol
+// <https://personal.sron.nl/~pault/#fig:scheme_sunset>
+// starting at blue,
+// with a pale yellow at the middle (0.5),
+// and ending at red.
+type Sunset struct{}
+
+var sunset = blind.ColSeq{
+	{R: 54, G: 75, B: 154, A: 255},
+	{R: 74, G: 123, B: 183, A: 255},
+	{R: 110, G: 166, B: 205, A: 255},
+	{R: 152, G: 202, B: 225, A: 255},
+	{R: 194, G: 228, B: 239, A: 255},
+	{R: 234, G: 236, B: 204, A: 255},
+	{R: 254, G: 218, B: 139, A: 255},
+	{R: 253, G: 179, B: 102, A: 255},
+	{R: 246, G: 126, B: 75, A: 255},
+	{R: 221, G: 61, B: 45, A: 255},
+	{R: 165, G: 0, B: 38, A: 255},
+}
+
+func (s Sunset) Gradient(v float64) color.Color {
+	if v < 0 {
+		v = 0
+	}
+	if v > 1 {
+		v = 1
+	}
+
+	return blind.Sequential(sunset, v)
+}
@@ -0,0 +1,216 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package probmap
+
+import (
+	"image/color"
+	"math"
+
+	"github.com/js-arias/earth"
+)
+
+// Position of the light source
+// used for the hillshade,
+// as in most GIS software.
+const (
+	sunAzimuth  = 315 // degrees, clockwise from north
+	sunAltitude = 45  // degrees above the horizon
+)
+
+// DefaultRangeAlpha is the opacity
+// of the range colors
+// when they are drawn over a relief.
+const DefaultRangeAlpha = 0.7
+
+// BandRows is the number of image rows
+// of each band of the hillshade.
+// The hillshade is calculated by bands,
+// so the memory used is bounded
+// regardless of the size of the image.
+const bandRows = 256
+
+// SetRelief prepares the image
+// to draw the hillshade.
+func (i *Image) setRelief() {
+	i.shade = nil
+	i.band = -1
+	if i.Relief == nil {
+		return
+	}
+	i.shade = make([]float64, 0, i.Cols*bandRows)
+}
+
+// ShadeAt returns the hillshade
+// of an image pixel.
+func (i *Image) shadeAt(x, y int) float64 {
+	if b := y / bandRows; b != i.band {
+		i.setBand(b)
+	}
+	return i.shade[(y-i.band*bandRows)*i.Cols+x]
+}
+
+// SetBand calculates the hillshade
+// of each image pixel in a band of rows
+// from the elevation values of the relief model.
+func (i *Image) setBand(band int) {
+	rows := i.Cols / 2
+	start := band * bandRows
+	end := start + bandRows
+	if end > rows {
+		end = rows
+	}
+
+	// the elevation includes the rows
+	// at the north and south of the band
+	first := start - 1
+	if first < 0 {
+		first = 0
+	}
+	last := end
+	if last >= rows {
+		last = rows - 1
+	}
+	elev := make([]float64, i.Cols*(last-first+1))
+	for y := first; y <= last; y++ {
+		for x := 0; x < i.Cols; x++ {
+			elev[(y-first)*i.Cols+x] = i.elevation(x, y)
+		}
+	}
+
+	exag := i.Exaggeration
+	if exag <= 0 {
+		exag = 1
+	}
+
+	// cell size, in meters
+	dy := earth.ToRad(i.step) * earth.Radius
+
+	zenith := earth.ToRad(90 - sunAltitude)
+	azimuth := earth.ToRad(math.Mod(360-sunAzimuth+90, 360))
+
+	i.shade = i.shade[:i.Cols*(end-start)]
+	for y := start; y < end; y++ {
+		lat := 90 - (float64(y)+0.5)*i.step
+		dx := dy * math.Cos(earth.ToRad(lat))
+		if dx < dy/100 {
+			dx = dy / 100
+		}
+
+		north := y - 1
+		if north < 0 {
+			north = 0
+		}
+		south := y + 1
+		if south >= rows {
+			south = rows - 1
+		}
+		north -= first
+		south -= first
+		for x := 0; x < i.Cols; x++ {
+			// the longitude is periodic
+			west := (x - 1 + i.Cols) % i.Cols
+			east := (x + 1) % i.Cols
+
+			row := (y - first) * i.Cols
+			dzdx := (elev[row+east] - elev[row+west]) / (2 * dx)
+			dzdy := (elev[south*i.Cols+x] - elev[north*i.Cols+x]) / (2 * dy)
+			dzdx *= exag
+			dzdy *= exag
+
+			slope := math.Atan(math.Hypot(dzdx, dzdy))
+			aspect := math.Atan2(dzdy, -dzdx)
+			hs := math.Cos(zenith)*math.Cos(slope) + math.Sin(zenith)*math.Sin(slope)*math.Cos(azimuth-aspect)
+			if hs < 0 {
+				hs = 0
+			}
+			i.shade[(y-start)*i.Cols+x] = hs
+		}
+	}
+	i.band = band
+}
+
+// Elevation returns the elevation
+// of an image pixel
+// using the same pixels used for the landscape.
+func (i *Image) elevation(x, y int) float64 {
+	lat := 90 - float64(y)*i.step
+	lon := float64(x)*i.step - 180
+	pix := i.Landscape.Pixelation().Pixel(lat, lon)
+	rAge := i.Relief.ClosestStageAge(i.Age)
+
+	if i.Tot == nil {
+		v, _ := i.Relief.At(rAge, pix.ID())
+		return float64(v)
+	}
+
+	dst := i.Tot[pix.ID()]
+	if len(dst) == 0 || i.Present {
+		v, _ := i.Relief.At(0, pix.ID())
+		return float64(v)
+	}
+
+	max := math.Inf(-1)
+	for _, px := range dst {
+		v, ok := i.Relief.At(rAge, px)
+		if !ok {
+			continue
+		}
+		if float64(v) > max {
+			max = float64(v)
+		}
+	}
+	if math.IsInf(max, -1) {
+		return 0
+	}
+	return max
+}
+
+// ShadeColor returns a landscape color
+// shaded with the hillshade of an image pixel.
+func (i *Image) shadeColor(x, y int, c color.Color) color.Color {
+	if i.shade == nil {
+		return c
+	}
+
+	// a flat surface is slightly darker
+	// than the original color
+	f := 0.3 + 0.7*i.shadeAt(x, y)
+	r, g, b, a := c.RGBA()
+	return color.RGBA64{
+		R: uint16(float64(r) * f),
+		G: uint16(float64(g) * f),
+		B: uint16(float64(b) * f),
+		A: uint16(a),
+	}
+}
+
+// RangeColor returns the color of a range pixel.
+// If a relief is defined,
+// the color is blended over the shaded landscape.
+func (i *Image) rangeColor(x, y int, p float64, v int) color.Color {
+	c := i.Gradient.Gradient(p)
+	if i.shade == nil {
+		return c
+	}
+
+	alpha := i.RangeAlpha
+	if alpha <= 0 {
+		alpha = DefaultRangeAlpha
+	}
+	if alpha >= 1 {
+		return c
+	}
+
+	// colors are alpha-premultiplied
+	bg := i.shadeColor(x, y, i.landColor(v))
+	r, g, b, a := c.RGBA()
+	br, bgG, bb, ba := bg.RGBA()
+	return color.RGBA64{
+		R: uint16(float64(r)*alpha + float64(br)*(1-alpha)),
+		G: uint16(float64(g)*alpha + float64(bgG)*(1-alpha)),
+		B: uint16(float64(b)*alpha + float64(bb)*(1-alpha)),
+		A: uint16(float64(a)*alpha + float64(ba)*(1-alpha)),
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package probmap
+
+import (
+	"image"
+	"image/color"
+)
+
+// TileSize is the size,
+// in pixels,
+// of each side of a map tile.
+const TileSize = 256
+
+// TileCols returns the number of columns
+// of an image at a given zoom level,
+// using a geodetic tiling scheme
+// (i.e., the plate carrée projection of the images),
+// in which the zoom level 0
+// is made of two tiles,
+// one for the western hemisphere,
+// and one for the eastern hemisphere.
+// At each zoom level,
+// the number of tiles in each axis is doubled.
+func TileCols(zoom int) int {
+	return 2 * TileSize << zoom
+}
+
+// Tiles returns the number of tiles
+// in each axis
+// of an image.
+// The number of columns of the image
+// should be defined with TileCols.
+func (i *Image) Tiles() (x, y int) {
+	return i.Cols / TileSize, i.Cols / 2 / TileSize
+}
+
+// Tile returns a tile of the image,
+// using the tile coordinates
+// (i.e., the columns and rows of the tiles,
+// with the tile 0,0 at the north-west corner).
+//
+// The pixels of the hillshade are calculated by bands,
+// so to bound the memory used,
+// tiles should be requested
+// row by row.
+// As the image keeps the last calculated band,
+// the tiles of an image should not be drawn concurrently.
+func (i *Image) Tile(x, y int) image.Image {
+	return &tile{
+		img: i,
+		min: image.Point{X: x * TileSize, Y: y * TileSize},
+	}
+}
+
+// A tile is a section of an image.
+type tile struct {
+	img *Image
+	min image.Point
+}
+
+func (t *tile) ColorModel() color.Model { return color.RGBAModel }
+func (t *tile) Bounds() image.Rectangle { return image.Rect(0, 0, TileSize, TileSize) }
+func (t *tile) At(x, y int) color.Color {
+	return t.img.At(t.min.X+x, t.min.Y+y)
+}
@@ -0,0 +1,142 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// JSONSchema is the identifier
+// of the JSON schema of a project.
+const JSONSchema = "phygeo-project/1"
+
+// JSON is the representation of a project
+// using a JSON schema,
+// so it can be read and written
+// by external programs.
+//
+// Here is an example:
+//
+//	{
+//		"schema": "phygeo-project/1",
+//		"phygeo": "v0.1.0",
+//		"datasets": {
+//			"geomotion": "geo-motion.tab",
+//			"landscape": "landscape.tab",
+//			"pixweight": "pix-weights.tab",
+//			"trees": "trees.tab"
+//		},
+//		"scaled": {
+//			"120": {
+//				"landscape": "landscape-e120.tab"
+//			}
+//		},
+//		"pixweights": [
+//			{"value": 0, "weight": 0},
+//			{"value": 1, "weight": 1}
+//		],
+//		"stages": [0, 5000000, 10000000]
+//	}
+//
+// The fields "scaled", "pixweights", and "stages",
+// are optional.
+type JSON struct {
+	// Schema is the identifier of the schema
+	Schema string `json:"schema"`
+
+	// PhyGeo is the version of the program
+	// that created the file
+	PhyGeo string `json:"phygeo,omitempty"`
+
+	// Datasets is the path of each dataset
+	Datasets map[Dataset]string `json:"datasets"`
+
+	// Scaled are the paths of the datasets
+	// at alternative resolutions,
+	// using the number of pixels at the equator
+	// as key
+	Scaled map[string]map[Dataset]string `json:"scaled,omitempty"`
+
+	// PixWeights are the pixel weights
+	// of the project
+	PixWeights []JSONWeight `json:"pixweights,omitempty"`
+
+	// Stages are the time stages
+	// (in years)
+	// of the project
+	Stages []int64 `json:"stages,omitempty"`
+}
+
+// JSONWeight is the weight
+// of a landscape value.
+type JSONWeight struct {
+	Value  int     `json:"value"`
+	Weight float64 `json:"weight"`
+}
+
+// JSON returns the JSON representation
+// of the datasets of a project.
+func (p *Project) JSON() *JSON {
+	j := &JSON{
+		Schema:   JSONSchema,
+		Datasets: make(map[Dataset]string, len(p.paths)),
+	}
+	for s, path := range p.paths {
+		j.Datasets[s] = path
+	}
+	for eq, st := range p.scaled {
+		if j.Scaled == nil {
+			j.Scaled = make(map[string]map[Dataset]string, len(p.scaled))
+		}
+		sets := make(map[Dataset]string, len(st))
+		for s, path := range st {
+			sets[s] = path
+		}
+		j.Scaled[strconv.Itoa(eq)] = sets
+	}
+	return j
+}
+
+// Project returns the project
+// defined in a JSON representation.
+func (j *JSON) Project() (*Project, error) {
+	if j.Schema != JSONSchema {
+		return nil, fmt.Errorf("invalid schema %q: want %q", j.Schema, JSONSchema)
+	}
+
+	p := New()
+	for s, path := range j.Datasets {
+		p.Add(s, path)
+	}
+	for k, st := range j.Scaled {
+		eq, err := strconv.Atoi(k)
+		if err != nil || eq <= 0 {
+			return nil, fmt.Errorf("scaled: invalid equator %q", k)
+		}
+		for s, path := range st {
+			p.AddScaled(s, eq, path)
+		}
+	}
+	return p, nil
+}
+
+// ReadJSON reads a JSON representation of a project.
+func ReadJSON(r io.Reader) (*JSON, error) {
+	var j JSON
+	if err := json.NewDecoder(r).Decode(&j); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// Encode writes a JSON representation of a project.
+func (j *JSON) Encode(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(j)
+}
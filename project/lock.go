@@ -0,0 +1,80 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrLocked is the error returned
+// when a project is locked by another process.
+var ErrLocked = errors.New("project locked by another process")
+
+// LockFile returns the name of the lock file
+// of a project file.
+func LockFile(name string) string {
+	return name + ".lock"
+}
+
+// LockPoll is the time between attempts
+// to acquire a lock.
+const lockPoll = 200 * time.Millisecond
+
+// Lock acquires an advisory lock on a project file,
+// so commands that update a project,
+// and its datasets,
+// can be run in parallel
+// (for example, in a job script).
+// The lock is a file with the name of the project
+// and the ".lock" extension,
+// that stores the process ID,
+// the host,
+// and the time in which the lock was acquired.
+//
+// If the project is already locked,
+// it will try again until the wait time is exhausted,
+// and then it will return an error
+// that wraps ErrLocked.
+// If wait is zero,
+// it will fail immediately.
+//
+// It returns a function to release the lock.
+func Lock(name string, wait time.Duration) (unlock func() error, err error) {
+	lf := LockFile(name)
+	deadline := time.Now().Add(wait)
+	for {
+		f, err := os.OpenFile(lf, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			host, _ := os.Hostname()
+			fmt.Fprintf(f, "pid %d on host %q since %s\n", os.Getpid(), host, time.Now().Format(time.RFC3339))
+			if err := f.Close(); err != nil {
+				os.Remove(lf)
+				return nil, err
+			}
+			return func() error {
+				return os.Remove(lf)
+			}, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+
+		if !time.Now().Before(deadline) {
+			owner := "unknown owner"
+			if b, err := os.ReadFile(lf); err == nil {
+				if s := strings.TrimSpace(string(b)); s != "" {
+					owner = s
+				}
+			}
+			return nil, fmt.Errorf("on project %q: %w: %s (if no other process is running, remove the file %q)", name, ErrLocked, owner, lf)
+		}
+		time.Sleep(lockPoll)
+	}
+}
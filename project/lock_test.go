@@ -0,0 +1,47 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package project_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/js-arias/phygeo/project"
+)
+
+func TestLock(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "project.tab")
+
+	unlock, err := project.Lock(name, 0)
+	if err != nil {
+		t.Fatalf("lock: unexpected error: %v", err)
+	}
+	if _, err := os.Stat(project.LockFile(name)); err != nil {
+		t.Fatalf("lock file: %v", err)
+	}
+
+	if _, err := project.Lock(name, 0); !errors.Is(err, project.ErrLocked) {
+		t.Errorf("locked project: got error %v, want %v", err, project.ErrLocked)
+	}
+
+	// release the lock while waiting
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		unlock()
+	}()
+	unlock, err = project.Lock(name, 5*time.Second)
+	if err != nil {
+		t.Fatalf("lock with wait: unexpected error: %v", err)
+	}
+	if err := unlock(); err != nil {
+		t.Fatalf("unlock: unexpected error: %v", err)
+	}
+	if _, err := os.Stat(project.LockFile(name)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lock file: got %v, want %v", err, os.ErrNotExist)
+	}
+}
@@ -12,12 +12,15 @@ package project
 
 import (
 	"bufio"
+	"crypto/sha256"
 	"encoding/csv"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -40,6 +43,27 @@ const (
 	// of the taxa in the project.
 	Ranges Dataset = "ranges"
 
+	// File for age-specific geographic ranges
+	// of the taxa in the project
+	// (i.e., taxa with ranges at different ages).
+	AgeRanges Dataset = "ageranges"
+
+	// File for the metadata
+	// of the occurrence records
+	// used to build the ranges
+	// (e.g., the source and ID of each record).
+	Records Dataset = "records"
+
+	// File for geographic constraints
+	// of the lineages of internal nodes
+	// (e.g., a fossil assigned to a stem lineage).
+	Constraints Dataset = "constraints"
+
+	// File for clade labels
+	// (names assigned to the most recent common ancestor
+	// of a set of terminals).
+	Clades Dataset = "clades"
+
 	// File for the landscape pixel values
 	// at different time stages.
 	Landscape Dataset = "landscape"
@@ -51,16 +75,72 @@ const (
 	Stages Dataset = "stages"
 )
 
+// Deprecated dataset types,
+// used by projects created with older versions of PhyGeo.
+// Use "phygeo prj migrate" to upgrade a project
+// that uses these keywords.
+const (
+	// File for presence points of the taxa.
+	// Replaced by Ranges.
+	Points Dataset = "points"
+
+	// File for the landscape pixel values.
+	// Replaced by Landscape.
+	TimePix Dataset = "timepix"
+
+	// File for the plate motion model.
+	// Replaced by GeoMotion.
+	GeoMod Dataset = "geomod"
+)
+
+// Deprecated keywords
+// and the keyword that replaces them.
+var deprecated = map[Dataset]Dataset{
+	Points:  Ranges,
+	TimePix: Landscape,
+	GeoMod:  GeoMotion,
+}
+
+// Replacement returns the dataset keyword
+// that replaces a deprecated keyword.
+// If the keyword is not deprecated,
+// it returns false.
+func Replacement(set Dataset) (Dataset, bool) {
+	r, ok := deprecated[set]
+	return r, ok
+}
+
 // A Project represents a collection of paths
 // for particular datasets.
+//
+// A project can also store the paths
+// of datasets at alternative resolutions
+// (i.e., pixelations with a different number of pixels
+// at the equator),
+// so an analysis can be switched between resolutions
+// without maintaining multiple projects.
 type Project struct {
 	paths map[Dataset]string
+
+	// paths of the datasets
+	// at alternative resolutions
+	scaled map[int]map[Dataset]string
+
+	// SHA-256 checksums of the datasets
+	sums map[Dataset]string
+
+	// datasets added or changed
+	// since the checksums were calculated
+	changed map[Dataset]bool
 }
 
 // New creates a new empty project.
 func New() *Project {
 	return &Project{
-		paths: make(map[Dataset]string),
+		paths:   make(map[Dataset]string),
+		scaled:  make(map[int]map[Dataset]string),
+		sums:    make(map[Dataset]string),
+		changed: make(map[Dataset]bool),
 	}
 }
 
@@ -76,6 +156,24 @@ var header = []string{
 //   - dataset, for the kind of file
 //   - path, for the path of the file
 //
+// Optionally,
+// the TSV can contain the field "equator",
+// with the number of pixels at the equator
+// of a dataset at an alternative resolution.
+// If the field is empty or zero,
+// the path is the path of the dataset
+// used by the analysis.
+//
+// Optionally,
+// the TSV can contain the field "checksum",
+// with the SHA-256 checksum of the dataset file
+// (as an hexadecimal string).
+// If the checksum of a dataset is defined,
+// the file will be checked when the project is read,
+// and an error will be returned
+// if the file was modified
+// outside PhyGeo.
+//
 // Here is an example file:
 //
 //	# phygeo project files
@@ -92,13 +190,30 @@ func Read(name string) (*Project, error) {
 	}
 	defer f.Close()
 
-	tsv := csv.NewReader(f)
+	p, err := ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+	if dep := p.Deprecated(); len(dep) > 0 {
+		r, _ := Replacement(dep[0])
+		return nil, fmt.Errorf("on project %q: dataset %q is deprecated, replaced by %q (use \"phygeo prj migrate\" to upgrade the project)", name, dep[0], r)
+	}
+	if err := p.Verify(); err != nil {
+		return nil, fmt.Errorf("on project %q: %v", name, err)
+	}
+	return p, nil
+}
+
+// ReadTSV reads a project from a TSV stream.
+// The format is the same as the one used by Read.
+func ReadTSV(r io.Reader) (*Project, error) {
+	tsv := csv.NewReader(r)
 	tsv.Comma = '\t'
 	tsv.Comment = '#'
 
 	head, err := tsv.Read()
 	if err != nil {
-		return nil, fmt.Errorf("on file %q: header: %v", name, err)
+		return nil, fmt.Errorf("header: %v", err)
 	}
 	fields := make(map[string]int, len(head))
 	for i, h := range head {
@@ -107,7 +222,7 @@ func Read(name string) (*Project, error) {
 	}
 	for _, h := range header {
 		if _, ok := fields[h]; !ok {
-			return nil, fmt.Errorf("on file %q: expecting field %q", name, h)
+			return nil, fmt.Errorf("expecting field %q", h)
 		}
 	}
 
@@ -119,7 +234,7 @@ func Read(name string) (*Project, error) {
 		}
 		ln, _ := tsv.FieldPos(0)
 		if err != nil {
-			return nil, fmt.Errorf("on file %q: on row %d: %v", name, ln, err)
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
 		}
 
 		f := "dataset"
@@ -127,7 +242,29 @@ func Read(name string) (*Project, error) {
 
 		f = "path"
 		path := row[fields[f]]
+
+		f = "equator"
+		if i, ok := fields[f]; ok && strings.TrimSpace(row[i]) != "" {
+			eq, err := strconv.Atoi(strings.TrimSpace(row[i]))
+			if err != nil {
+				return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+			}
+			if eq > 0 {
+				p.AddScaled(s, eq, path)
+				continue
+			}
+		}
 		p.paths[s] = path
+
+		f = "checksum"
+		if i, ok := fields[f]; ok {
+			if sum := strings.ToLower(strings.TrimSpace(row[i])); sum != "" {
+				if _, err := hex.DecodeString(sum); err != nil {
+					return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+				}
+				p.sums[s] = sum
+			}
+		}
 	}
 
 	return p, nil
@@ -136,22 +273,165 @@ func Read(name string) (*Project, error) {
 // Add adds a filepath of a dataset to a given project.
 // It returns the previous value
 // for the dataset.
+//
+// Add must also be called
+// when the file of a dataset is modified
+// (even if the path is the same).
+// If the project stores checksums,
+// the checksum of the dataset is calculated,
+// and it will be updated again
+// when the project is written.
+// The checksums of other datasets
+// are not modified.
 func (p *Project) Add(set Dataset, path string) string {
 	prev := p.paths[set]
 	if path == "" {
 		delete(p.paths, set)
+		delete(p.sums, set)
+		delete(p.changed, set)
 		return prev
 	}
 
 	p.paths[set] = path
+	if p.Frozen() {
+		p.changed[set] = true
+
+		// the file might not exist yet,
+		// so errors are reported on Write
+		if sum, err := FileChecksum(path); err == nil {
+			p.sums[set] = sum
+		}
+	}
+	return prev
+}
+
+// AddScaled adds a filepath of a dataset
+// at an alternative resolution,
+// defined by the number of pixels at the equator.
+// It returns the previous value
+// for the dataset at that resolution.
+func (p *Project) AddScaled(set Dataset, eq int, path string) string {
+	st := p.scaled[eq]
+	prev := st[set]
+	if path == "" {
+		delete(st, set)
+		if len(st) == 0 {
+			delete(p.scaled, eq)
+		}
+		return prev
+	}
+
+	if st == nil {
+		st = make(map[Dataset]string)
+		p.scaled[eq] = st
+	}
+	st[set] = path
 	return prev
 }
 
+// Checksum returns the stored SHA-256 checksum
+// of the given dataset,
+// as an hexadecimal string.
+// It returns an empty string
+// if the checksum of the dataset is not defined.
+func (p *Project) Checksum(set Dataset) string {
+	return p.sums[set]
+}
+
+// Frozen returns true if the project
+// stores the checksums of its datasets.
+func (p *Project) Frozen() bool {
+	return len(p.sums) > 0
+}
+
+// Freeze calculates and stores the checksums
+// of all the datasets of the project,
+// so any change made to a dataset file
+// outside PhyGeo will be detected
+// when the project is read.
+// If the project is already frozen,
+// the checksums will be updated.
+func (p *Project) Freeze() error {
+	sums := make(map[Dataset]string, len(p.paths))
+	for _, s := range p.Sets() {
+		sum, err := FileChecksum(p.paths[s])
+		if err != nil {
+			return fmt.Errorf("dataset %q: %v", s, err)
+		}
+		sums[s] = sum
+	}
+	p.sums = sums
+	p.changed = make(map[Dataset]bool)
+	return nil
+}
+
+// Unfreeze removes the checksums
+// of the datasets of the project.
+func (p *Project) Unfreeze() {
+	p.sums = make(map[Dataset]string)
+	p.changed = make(map[Dataset]bool)
+}
+
+// Verify checks that the datasets of the project
+// with a stored checksum
+// were not modified outside PhyGeo.
+func (p *Project) Verify() error {
+	for _, s := range p.Sets() {
+		want, ok := p.sums[s]
+		if !ok {
+			continue
+		}
+		sum, err := FileChecksum(p.paths[s])
+		if err != nil {
+			return fmt.Errorf("dataset %q: %v", s, err)
+		}
+		if sum != want {
+			return fmt.Errorf("dataset %q: file %q was modified outside PhyGeo: checksum mismatch (use \"phygeo prj update-checksums\" to accept the changes)", s, p.paths[s])
+		}
+	}
+	return nil
+}
+
+// FileChecksum returns the SHA-256 checksum
+// of a file,
+// as an hexadecimal string.
+func FileChecksum(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("on file %q: %v", name, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Equators returns the number of pixels at the equator
+// of the alternative resolutions
+// defined on a project.
+func (p *Project) Equators() []int {
+	eqs := make([]int, 0, len(p.scaled))
+	for eq := range p.scaled {
+		eqs = append(eqs, eq)
+	}
+	slices.Sort(eqs)
+	return eqs
+}
+
 // Path returns the path of the given dataset.
 func (p *Project) Path(set Dataset) string {
 	return p.paths[set]
 }
 
+// Scaled returns the path of the given dataset
+// at an alternative resolution.
+func (p *Project) Scaled(set Dataset, eq int) string {
+	return p.scaled[eq][set]
+}
+
 // Sets returns the datasets defined on a project.
 func (p *Project) Sets() []Dataset {
 	var sets []Dataset
@@ -162,8 +442,91 @@ func (p *Project) Sets() []Dataset {
 	return sets
 }
 
+// Deprecated returns the deprecated datasets
+// defined on a project,
+// including the datasets at alternative resolutions.
+func (p *Project) Deprecated() []Dataset {
+	var sets []Dataset
+	for s := range deprecated {
+		if _, ok := p.paths[s]; ok {
+			sets = append(sets, s)
+			continue
+		}
+		for _, st := range p.scaled {
+			if _, ok := st[s]; ok {
+				sets = append(sets, s)
+				break
+			}
+		}
+	}
+	slices.Sort(sets)
+	return sets
+}
+
+// Migrate replaces the deprecated datasets of a project
+// with the keyword that replaces them.
+// It returns an error
+// if a deprecated dataset and its replacement
+// are both defined with different paths.
+func (p *Project) Migrate() error {
+	for _, s := range p.Deprecated() {
+		r := deprecated[s]
+		if err := migrateSet(p.paths, s, r); err != nil {
+			return err
+		}
+		if sum, ok := p.sums[s]; ok {
+			delete(p.sums, s)
+			if _, ok := p.sums[r]; !ok {
+				p.sums[r] = sum
+			}
+		}
+		if p.changed[s] {
+			delete(p.changed, s)
+			p.changed[r] = true
+		}
+		for _, eq := range p.Equators() {
+			if err := migrateSet(p.scaled[eq], s, r); err != nil {
+				return fmt.Errorf("equator %d: %v", eq, err)
+			}
+		}
+	}
+	return nil
+}
+
+func migrateSet(paths map[Dataset]string, old, set Dataset) error {
+	path, ok := paths[old]
+	if !ok {
+		return nil
+	}
+	if prev, ok := paths[set]; ok && prev != path {
+		return fmt.Errorf("dataset %q: file %q: replacement %q already defined with file %q", old, path, set, prev)
+	}
+	delete(paths, old)
+	paths[set] = path
+	return nil
+}
+
 // Write writes a project into a file with the indicated name.
+// If the project stores checksums,
+// the checksums of the datasets added,
+// or changed,
+// with Add
+// will be updated before writing the file.
 func (p *Project) Write(name string) (err error) {
+	if p.Frozen() {
+		for _, s := range p.Sets() {
+			if !p.changed[s] {
+				continue
+			}
+			sum, err := FileChecksum(p.paths[s])
+			if err != nil {
+				return fmt.Errorf("on file %q: dataset %q: %v", name, s, err)
+			}
+			p.sums[s] = sum
+		}
+		p.changed = make(map[Dataset]bool)
+	}
+
 	f, err := os.Create(name)
 	if err != nil {
 		return err
@@ -175,15 +538,30 @@ func (p *Project) Write(name string) (err error) {
 		}
 	}()
 
-	bw := bufio.NewWriter(f)
+	if err := p.TSV(f); err != nil {
+		return fmt.Errorf("on file %q: %v", name, err)
+	}
+	return nil
+}
+
+// TSV writes a project as a TSV stream.
+func (p *Project) TSV(w io.Writer) error {
+	bw := bufio.NewWriter(w)
 	fmt.Fprintf(bw, "# phygeo project files\n")
 	fmt.Fprintf(bw, "# data save on: %s\n", time.Now().Format(time.RFC3339))
 	tsv := csv.NewWriter(bw)
 	tsv.Comma = '\t'
 	tsv.UseCRLF = true
 
-	if err := tsv.Write(header); err != nil {
-		return fmt.Errorf("on file %q: while writing header: %v", name, err)
+	head := slices.Clone(header)
+	if len(p.scaled) > 0 {
+		head = append(head, "equator")
+	}
+	if p.Frozen() {
+		head = append(head, "checksum")
+	}
+	if err := tsv.Write(head); err != nil {
+		return fmt.Errorf("while writing header: %v", err)
 	}
 
 	sets := p.Sets()
@@ -192,17 +570,45 @@ func (p *Project) Write(name string) (err error) {
 			string(s),
 			p.paths[s],
 		}
+		if len(p.scaled) > 0 {
+			row = append(row, "")
+		}
+		if p.Frozen() {
+			row = append(row, p.sums[s])
+		}
 		if err := tsv.Write(row); err != nil {
-			return fmt.Errorf("on file %q: %v", name, err)
+			return err
+		}
+	}
+
+	for _, eq := range p.Equators() {
+		st := p.scaled[eq]
+		sets := make([]Dataset, 0, len(st))
+		for s := range st {
+			sets = append(sets, s)
+		}
+		slices.Sort(sets)
+		for _, s := range sets {
+			row := []string{
+				string(s),
+				st[s],
+				strconv.Itoa(eq),
+			}
+			if p.Frozen() {
+				row = append(row, "")
+			}
+			if err := tsv.Write(row); err != nil {
+				return err
+			}
 		}
 	}
 
 	tsv.Flush()
 	if err := tsv.Error(); err != nil {
-		return fmt.Errorf("on file %q: while writing data: %v", name, err)
+		return fmt.Errorf("while writing data: %v", err)
 	}
 	if err := bw.Flush(); err != nil {
-		return fmt.Errorf("on file %q: while writing data: %v", name, err)
+		return fmt.Errorf("while writing data: %v", err)
 	}
 	return nil
 }
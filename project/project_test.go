@@ -5,7 +5,9 @@
 package project_test
 
 import (
+	"bytes"
 	"os"
+	"path/filepath"
 	"reflect"
 	"slices"
 	"testing"
@@ -49,6 +51,264 @@ func TestProject(t *testing.T) {
 	testProject(t, np, sets)
 }
 
+func TestTSV(t *testing.T) {
+	p := project.New()
+
+	sets := []setPath{
+		{project.GeoMotion, "geo-model.tab"},
+		{project.Landscape, "landscape.tab"},
+		{project.Trees, "trees.tab"},
+	}
+	for _, s := range sets {
+		p.Add(s.set, s.path)
+	}
+
+	var buf bytes.Buffer
+	if err := p.TSV(&buf); err != nil {
+		t.Fatalf("error when writing data: %v", err)
+	}
+
+	np, err := project.ReadTSV(&buf)
+	if err != nil {
+		t.Fatalf("error when reading data: %v", err)
+	}
+	testProject(t, np, sets)
+}
+
+func TestScaled(t *testing.T) {
+	p := project.New()
+
+	sets := []setPath{
+		{project.GeoMotion, "geo-model.tab"},
+		{project.Landscape, "landscape.tab"},
+		{project.Trees, "trees.tab"},
+	}
+	for _, s := range sets {
+		p.Add(s.set, s.path)
+	}
+
+	scaled := []setPath{
+		{project.GeoMotion, "geo-model-e120.tab"},
+		{project.Landscape, "landscape-e120.tab"},
+	}
+	for _, s := range scaled {
+		p.AddScaled(s.set, 120, s.path)
+	}
+	p.AddScaled(project.Landscape, 60, "landscape-e60.tab")
+	testScaled(t, p, sets, scaled)
+
+	name := "tmp-project-scaled-for-test.tab"
+	defer os.Remove(name)
+
+	if err := p.Write(name); err != nil {
+		t.Fatalf("error when writing data: %v", err)
+	}
+
+	np, err := project.Read(name)
+	if err != nil {
+		t.Fatalf("error when reading data: %v", err)
+	}
+	testScaled(t, np, sets, scaled)
+
+	// remove a resolution
+	np.AddScaled(project.Landscape, 60, "")
+	if eqs := np.Equators(); !reflect.DeepEqual(eqs, []int{120}) {
+		t.Errorf("equators: got %v, want %v", eqs, []int{120})
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	dir := t.TempDir()
+	trees := filepath.Join(dir, "trees.tab")
+	if err := os.WriteFile(trees, []byte("tree\tnode\tparent\tage\ttaxon\n"), 0644); err != nil {
+		t.Fatalf("error when writing data: %v", err)
+	}
+	ranges := filepath.Join(dir, "ranges.tab")
+	if err := os.WriteFile(ranges, []byte("taxon\ttype\tage\tequator\tpixel\tdensity\n"), 0644); err != nil {
+		t.Fatalf("error when writing data: %v", err)
+	}
+
+	p := project.New()
+	sets := []setPath{
+		{project.Ranges, ranges},
+		{project.Trees, trees},
+	}
+	for _, s := range sets {
+		p.Add(s.set, s.path)
+	}
+	if p.Frozen() {
+		t.Errorf("frozen: got %v, want %v", true, false)
+	}
+	if err := p.Freeze(); err != nil {
+		t.Fatalf("error when freezing project: %v", err)
+	}
+	if !p.Frozen() {
+		t.Errorf("frozen: got %v, want %v", false, true)
+	}
+	want, err := project.FileChecksum(trees)
+	if err != nil {
+		t.Fatalf("error when calculating checksum: %v", err)
+	}
+	if sum := p.Checksum(project.Trees); sum != want {
+		t.Errorf("checksum: got %q, want %q", sum, want)
+	}
+
+	name := filepath.Join(dir, "project.tab")
+	if err := p.Write(name); err != nil {
+		t.Fatalf("error when writing data: %v", err)
+	}
+	np, err := project.Read(name)
+	if err != nil {
+		t.Fatalf("error when reading data: %v", err)
+	}
+	testProject(t, np, sets)
+	if sum := np.Checksum(project.Trees); sum != want {
+		t.Errorf("checksum: got %q, want %q", sum, want)
+	}
+
+	// modify a dataset outside the project
+	if err := os.WriteFile(trees, []byte("tree\tnode\tparent\tage\ttaxon\r\n"), 0644); err != nil {
+		t.Fatalf("error when writing data: %v", err)
+	}
+	if _, err := project.Read(name); err == nil {
+		t.Errorf("read: expecting checksum error")
+	}
+
+	// writing the project does not update
+	// the checksums of unchanged datasets
+	if err := np.Write(name); err != nil {
+		t.Fatalf("error when writing data: %v", err)
+	}
+	if _, err := project.Read(name); err == nil {
+		t.Errorf("read: expecting checksum error")
+	}
+	if sum := np.Checksum(project.Trees); sum != want {
+		t.Errorf("checksum: got %q, want %q", sum, want)
+	}
+
+	// adding a dataset updates only its checksum
+	rangeSum := np.Checksum(project.Ranges)
+	np.Add(project.Trees, trees)
+	want, err = project.FileChecksum(trees)
+	if err != nil {
+		t.Fatalf("error when calculating checksum: %v", err)
+	}
+	if sum := np.Checksum(project.Trees); sum != want {
+		t.Errorf("checksum: got %q, want %q", sum, want)
+	}
+	if err := os.WriteFile(ranges, []byte("taxon\ttype\tage\tequator\tpixel\tdensity\r\n"), 0644); err != nil {
+		t.Fatalf("error when writing data: %v", err)
+	}
+	if err := np.Write(name); err != nil {
+		t.Fatalf("error when writing data: %v", err)
+	}
+	if sum := np.Checksum(project.Ranges); sum != rangeSum {
+		t.Errorf("checksum: got %q, want %q", sum, rangeSum)
+	}
+	if _, err := project.Read(name); err == nil {
+		t.Errorf("read: expecting checksum error")
+	}
+
+	// a dataset changed after it was added
+	// is updated when the project is written
+	np.Add(project.Ranges, ranges)
+	if err := os.WriteFile(trees, []byte("tree\tnode\tparent\tage\ttaxon\n"), 0644); err != nil {
+		t.Fatalf("error when writing data: %v", err)
+	}
+	np.Add(project.Trees, trees)
+	if err := os.WriteFile(trees, []byte("tree\tnode\tparent\tage\ttaxon\r\n"), 0644); err != nil {
+		t.Fatalf("error when writing data: %v", err)
+	}
+	if err := np.Write(name); err != nil {
+		t.Fatalf("error when writing data: %v", err)
+	}
+	if _, err := project.Read(name); err != nil {
+		t.Errorf("error when reading data: %v", err)
+	}
+
+	np.Unfreeze()
+	if np.Frozen() {
+		t.Errorf("frozen: got %v, want %v", true, false)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	legacy := `# phygeo project files
+dataset	path	equator
+geomod	geo-model.tab	
+points	points.tab	
+timepix	landscape.tab	
+trees	trees.tab	
+timepix	landscape-e60.tab	60
+`
+	dir := t.TempDir()
+	name := filepath.Join(dir, "project.tab")
+	if err := os.WriteFile(name, []byte(legacy), 0644); err != nil {
+		t.Fatalf("error when writing data: %v", err)
+	}
+	if _, err := project.Read(name); err == nil {
+		t.Errorf("read: expecting deprecated dataset error")
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatalf("error when opening file: %v", err)
+	}
+	defer f.Close()
+	p, err := project.ReadTSV(f)
+	if err != nil {
+		t.Fatalf("error when reading data: %v", err)
+	}
+	want := []project.Dataset{project.GeoMod, project.Points, project.TimePix}
+	if dep := p.Deprecated(); !reflect.DeepEqual(dep, want) {
+		t.Errorf("deprecated: got %v, want %v", dep, want)
+	}
+
+	if err := p.Migrate(); err != nil {
+		t.Fatalf("error when migrating project: %v", err)
+	}
+	if dep := p.Deprecated(); len(dep) != 0 {
+		t.Errorf("deprecated: got %v, want %v", dep, []project.Dataset{})
+	}
+	sets := []setPath{
+		{project.GeoMotion, "geo-model.tab"},
+		{project.Landscape, "landscape.tab"},
+		{project.Ranges, "points.tab"},
+		{project.Trees, "trees.tab"},
+	}
+	testProject(t, p, sets)
+	if path := p.Scaled(project.Landscape, 60); path != "landscape-e60.tab" {
+		t.Errorf("set %s at e60: got path %q, want %q", project.Landscape, path, "landscape-e60.tab")
+	}
+
+	// a deprecated dataset
+	// with a different replacement
+	p.Add(project.TimePix, "old-landscape.tab")
+	if err := p.Migrate(); err == nil {
+		t.Errorf("migrate: expecting replacement error")
+	}
+}
+
+func testScaled(t testing.TB, p *project.Project, sets, scaled []setPath) {
+	t.Helper()
+
+	testProject(t, p, sets)
+	for _, s := range scaled {
+		if path := p.Scaled(s.set, 120); path != s.path {
+			t.Errorf("set %s at e120: got path %q, want %q", s.set, path, s.path)
+		}
+	}
+	if path := p.Scaled(project.Landscape, 60); path != "landscape-e60.tab" {
+		t.Errorf("set %s at e60: got path %q, want %q", project.Landscape, path, "landscape-e60.tab")
+	}
+	if path := p.Scaled(project.GeoMotion, 60); path != "" {
+		t.Errorf("set %s at e60: got path %q, want %q", project.GeoMotion, path, "")
+	}
+	if eqs := p.Equators(); !reflect.DeepEqual(eqs, []int{60, 120}) {
+		t.Errorf("equators: got %v, want %v", eqs, []int{60, 120})
+	}
+}
+
 func testProject(t testing.TB, p *project.Project, sets []setPath) {
 	t.Helper()
 
@@ -67,3 +327,49 @@ func testProject(t testing.TB, p *project.Project, sets []setPath) {
 		t.Errorf("sets: got %v, want %v", ls, datasets)
 	}
 }
+
+func TestJSON(t *testing.T) {
+	p := project.New()
+
+	sets := []setPath{
+		{project.GeoMotion, "geo-model.tab"},
+		{project.Landscape, "landscape.tab"},
+		{project.Trees, "trees.tab"},
+	}
+	for _, s := range sets {
+		p.Add(s.set, s.path)
+	}
+	scaled := []setPath{
+		{project.Landscape, "landscape-e120.tab"},
+	}
+	for _, s := range scaled {
+		p.AddScaled(s.set, 120, s.path)
+	}
+	p.AddScaled(project.Landscape, 60, "landscape-e60.tab")
+
+	j := p.JSON()
+	j.Stages = []int64{0, 5_000_000}
+
+	var buf bytes.Buffer
+	if err := j.Encode(&buf); err != nil {
+		t.Fatalf("error when writing data: %v", err)
+	}
+
+	nj, err := project.ReadJSON(&buf)
+	if err != nil {
+		t.Fatalf("error when reading data: %v", err)
+	}
+	if !reflect.DeepEqual(nj.Stages, j.Stages) {
+		t.Errorf("stages: got %v, want %v", nj.Stages, j.Stages)
+	}
+	np, err := nj.Project()
+	if err != nil {
+		t.Fatalf("error when building project: %v", err)
+	}
+	testScaled(t, np, sets, scaled)
+
+	nj.Schema = "unknown"
+	if _, err := nj.Project(); err == nil {
+		t.Errorf("invalid schema: expecting error")
+	}
+}
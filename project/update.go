@@ -0,0 +1,121 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// SkipWrite can be returned by the function
+// used to modify a project
+// to indicate that the project was not modified,
+// so the project file will not be written.
+// The update function will return a nil error.
+var SkipWrite = errors.New("skip project write")
+
+// Update locks a project file,
+// reads the project,
+// and calls fn to modify the project
+// (and its datasets).
+// If fn returns without error,
+// the project is written
+// before the lock is released.
+//
+// Commands that modify a project,
+// or any of its datasets,
+// should use Update
+// (or UpdateNew, Repair, or Create),
+// so they can be run in parallel.
+// See Lock for the meaning of wait.
+func Update(name string, wait time.Duration, fn func(p *Project) error) error {
+	return update(name, wait, Read, fn)
+}
+
+// UpdateNew is like Update,
+// but if the project file does not exist,
+// fn will receive a new, empty project.
+func UpdateNew(name string, wait time.Duration, fn func(p *Project) error) error {
+	return update(name, wait, readOrNew, fn)
+}
+
+// Repair is like Update,
+// but the project is read
+// without checking for deprecated datasets,
+// or verifying the checksums,
+// so it can be used by commands
+// that fix a project.
+func Repair(name string, wait time.Duration, fn func(p *Project) error) error {
+	return update(name, wait, readUnverified, fn)
+}
+
+// Create locks a project file,
+// and calls fn to build a new project,
+// that will be written
+// before the lock is released.
+// The project file must not exist.
+// If the project is locked,
+// it will fail immediately.
+func Create(name string, fn func() (*Project, error)) error {
+	create := func(name string) (*Project, error) {
+		if _, err := os.Stat(name); err == nil {
+			return nil, fmt.Errorf("project %q already exists", name)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		return fn()
+	}
+	return update(name, 0, create, func(p *Project) error { return nil })
+}
+
+func update(name string, wait time.Duration, read func(string) (*Project, error), fn func(p *Project) error) (err error) {
+	unlock, err := Lock(name, wait)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := unlock()
+		if err == nil && e != nil {
+			err = e
+		}
+	}()
+
+	p, err := read(name)
+	if err != nil {
+		return err
+	}
+	if err := fn(p); err != nil {
+		if errors.Is(err, SkipWrite) {
+			return nil
+		}
+		return err
+	}
+	return p.Write(name)
+}
+
+func readOrNew(name string) (*Project, error) {
+	p, err := Read(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return New(), nil
+	}
+	return p, err
+}
+
+func readUnverified(name string) (*Project, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p, err := ReadTSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("on file %q: %v", name, err)
+	}
+	return p, nil
+}
@@ -0,0 +1,98 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package project_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/js-arias/phygeo/project"
+)
+
+func TestUpdate(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "project.tab")
+
+	err := project.Update(name, 0, func(p *project.Project) error {
+		t.Fatalf("update: called on undefined project")
+		return nil
+	})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("undefined project: got error %v, want %v", err, os.ErrNotExist)
+	}
+
+	err = project.Create(name, func() (*project.Project, error) {
+		// the project is locked while it is built
+		if _, err := os.Stat(project.LockFile(name)); err != nil {
+			t.Errorf("lock file: %v", err)
+		}
+		p := project.New()
+		p.Add(project.Trees, "trees.tab")
+		return p, nil
+	})
+	if err != nil {
+		t.Fatalf("create: unexpected error: %v", err)
+	}
+	if _, err := os.Stat(project.LockFile(name)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lock file: got %v, want %v", err, os.ErrNotExist)
+	}
+	if err := project.Create(name, func() (*project.Project, error) { return project.New(), nil }); err == nil {
+		t.Errorf("create: expecting error on existing project")
+	}
+
+	err = project.Update(name, 0, func(p *project.Project) error {
+		if got := p.Path(project.Trees); got != "trees.tab" {
+			t.Errorf("update: got path %q, want %q", got, "trees.tab")
+		}
+		p.Add(project.Ranges, "ranges.tab")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("update: unexpected error: %v", err)
+	}
+
+	// changes are not written
+	// if the function fails
+	// or skips the write
+	for _, ret := range []error{errors.New("failed"), project.SkipWrite} {
+		err := project.Update(name, 0, func(p *project.Project) error {
+			p.Add(project.Landscape, "landscape.tab")
+			return ret
+		})
+		if ret == project.SkipWrite {
+			ret = nil
+		}
+		if !errors.Is(err, ret) {
+			t.Errorf("update: got error %v, want %v", err, ret)
+		}
+	}
+
+	p, err := project.Read(name)
+	if err != nil {
+		t.Fatalf("read: unexpected error: %v", err)
+	}
+	want := map[project.Dataset]string{
+		project.Trees:     "trees.tab",
+		project.Ranges:    "ranges.tab",
+		project.Landscape: "",
+	}
+	for s, w := range want {
+		if got := p.Path(s); got != w {
+			t.Errorf("dataset %q: got path %q, want %q", s, got, w)
+		}
+	}
+
+	// a locked project is not modified
+	unlock, err := project.Lock(name, 0)
+	if err != nil {
+		t.Fatalf("lock: unexpected error: %v", err)
+	}
+	defer unlock()
+	err = project.UpdateNew(name, 0, func(p *project.Project) error { return nil })
+	if !errors.Is(err, project.ErrLocked) {
+		t.Errorf("locked project: got error %v, want %v", err, project.ErrLocked)
+	}
+}
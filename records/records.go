@@ -0,0 +1,316 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package records implements a collection
+// of the metadata of the occurrence records
+// used to build the distribution ranges
+// of the taxa in a project.
+//
+// A range collection
+// (as implemented in github.com/js-arias/ranges)
+// only stores the pixels of a taxon.
+// A record collection stores,
+// for each pixel of a taxon,
+// the provenance of the original records
+// (for example,
+// the database,
+// the record ID,
+// and the basis of record of a GBIF occurrence),
+// so data issues can be traced
+// to the original records.
+package records
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/js-arias/earth"
+)
+
+// A Record is the metadata
+// of an occurrence record
+// of a taxon.
+type Record struct {
+	// Taxon is the name of the taxon
+	Taxon string
+
+	// Pixel is the ID of the pixel
+	// of the record
+	Pixel int
+
+	// Source is the source of the record
+	// (for example, the name of the input file)
+	Source string
+
+	// ID is the identifier of the record
+	// in the source
+	ID string
+
+	// Basis is the basis of the record
+	// (for example, "PreservedSpecimen",
+	// or "HumanObservation")
+	Basis string
+
+	// Date is the date of the record,
+	// as given in the source
+	Date string
+}
+
+// A Collection is a collection of records
+// with an associated pixelation.
+type Collection struct {
+	pix  *earth.Pixelation
+	taxa map[string][]Record
+}
+
+// New creates a new empty collection
+// using an isolatitude pixelation.
+func New(pix *earth.Pixelation) *Collection {
+	return &Collection{
+		pix:  pix,
+		taxa: make(map[string][]Record),
+	}
+}
+
+// Add adds a record to the collection.
+// If an identical record is already in the collection,
+// the record will be ignored.
+func (c *Collection) Add(r Record) error {
+	r.Taxon = canon(r.Taxon)
+	if r.Taxon == "" {
+		return nil
+	}
+	if r.Pixel < 0 || r.Pixel >= c.pix.Len() {
+		return fmt.Errorf("taxon %q: invalid pixel value %d", r.Taxon, r.Pixel)
+	}
+	r.Source = strings.Join(strings.Fields(r.Source), " ")
+	r.ID = strings.TrimSpace(r.ID)
+	r.Basis = strings.TrimSpace(r.Basis)
+	r.Date = strings.TrimSpace(r.Date)
+
+	if slices.Contains(c.taxa[r.Taxon], r) {
+		return nil
+	}
+	c.taxa[r.Taxon] = append(c.taxa[r.Taxon], r)
+	return nil
+}
+
+// Delete removes the records of a taxon.
+func (c *Collection) Delete(name string) {
+	delete(c.taxa, canon(name))
+}
+
+// Merge adds the records of another collection.
+// Both collections must have the same pixelation.
+func (c *Collection) Merge(o *Collection) error {
+	if o.pix.Equator() != c.pix.Equator() {
+		return fmt.Errorf("invalid pixelation: got %d, want %d", o.pix.Equator(), c.pix.Equator())
+	}
+	for _, nm := range o.Taxa() {
+		for _, r := range o.taxa[nm] {
+			if err := c.Add(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Pixelation returns the underlying pixelation
+// of the collection.
+func (c *Collection) Pixelation() *earth.Pixelation {
+	return c.pix
+}
+
+// Records returns the records of a taxon,
+// sorted by pixel, source, and ID.
+func (c *Collection) Records(name string) []Record {
+	recs := slices.Clone(c.taxa[canon(name)])
+	slices.SortFunc(recs, func(a, b Record) int {
+		if n := cmp.Compare(a.Pixel, b.Pixel); n != 0 {
+			return n
+		}
+		if n := strings.Compare(a.Source, b.Source); n != 0 {
+			return n
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return recs
+}
+
+// Taxa returns an sorted slice
+// with the names of the taxa
+// in the collection.
+func (c *Collection) Taxa() []string {
+	taxa := make([]string, 0, len(c.taxa))
+	for name := range c.taxa {
+		taxa = append(taxa, name)
+	}
+	slices.Sort(taxa)
+	return taxa
+}
+
+var headerFields = []string{
+	"taxon",
+	"equator",
+	"pixel",
+	"source",
+	"record",
+	"basis",
+	"date",
+}
+
+// ReadTSV reads a collection of records
+// from a TSV file.
+//
+// The TSV must contain the following columns:
+//
+//   - taxon, the name of the taxon
+//   - equator, for the number of pixels in the equator
+//   - pixel, the ID of a pixel (from the pixelation)
+//   - source, the source of the record
+//   - record, the ID of the record in the source
+//   - basis, the basis of the record
+//   - date, the date of the record
+//
+// Here is an example file:
+//
+//	# occurrence records
+//	taxon	equator	pixel	source	record	basis	date
+//	Panthera onca	360	19117	gbif-onca.tab	1234567	PreservedSpecimen	1998-03-12
+//	Panthera onca	360	19118	gbif-onca.tab	1234601	HumanObservation	2015-07-30
+func ReadTSV(r io.Reader, pix *earth.Pixelation) (*Collection, error) {
+	tab := csv.NewReader(r)
+	tab.Comma = '\t'
+	tab.Comment = '#'
+
+	head, err := tab.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading header: %v", err)
+	}
+	fields := make(map[string]int, len(head))
+	for i, h := range head {
+		h = strings.ToLower(h)
+		fields[h] = i
+	}
+	for _, h := range headerFields {
+		if _, ok := fields[h]; !ok {
+			return nil, fmt.Errorf("expecting field %q", h)
+		}
+	}
+
+	var c *Collection
+	for {
+		row, err := tab.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		ln, _ := tab.FieldPos(0)
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+
+		f := "equator"
+		eq, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+		if pix == nil {
+			pix = earth.NewPixelation(eq)
+		}
+		if pix.Equator() != eq {
+			return nil, fmt.Errorf("on row %d: field %q: got %d, want %d", ln, f, eq, pix.Equator())
+		}
+		if c == nil {
+			c = New(pix)
+		}
+
+		f = "pixel"
+		px, err := strconv.Atoi(row[fields[f]])
+		if err != nil {
+			return nil, fmt.Errorf("on row %d: field %q: %v", ln, f, err)
+		}
+
+		rec := Record{
+			Taxon:  row[fields["taxon"]],
+			Pixel:  px,
+			Source: row[fields["source"]],
+			ID:     row[fields["record"]],
+			Basis:  row[fields["basis"]],
+			Date:   row[fields["date"]],
+		}
+		if err := c.Add(rec); err != nil {
+			return nil, fmt.Errorf("on row %d: %v", ln, err)
+		}
+	}
+	if c == nil {
+		return nil, fmt.Errorf("while reading data: %v", io.EOF)
+	}
+	return c, nil
+}
+
+// TSV encodes the records of a collection
+// to a TSV file.
+func (c *Collection) TSV(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# occurrence records\n")
+	fmt.Fprintf(bw, "# data save on: %s\n", time.Now().Format(time.RFC3339))
+
+	tab := csv.NewWriter(bw)
+	tab.Comma = '\t'
+	tab.UseCRLF = true
+
+	if err := tab.Write(headerFields); err != nil {
+		return fmt.Errorf("unable to write header: %v", err)
+	}
+
+	eq := strconv.Itoa(c.pix.Equator())
+	for _, nm := range c.Taxa() {
+		for _, r := range c.Records(nm) {
+			row := []string{
+				r.Taxon,
+				eq,
+				strconv.Itoa(r.Pixel),
+				r.Source,
+				r.ID,
+				r.Basis,
+				r.Date,
+			}
+			if err := tab.Write(row); err != nil {
+				return fmt.Errorf("unable to write data: %v", err)
+			}
+		}
+	}
+
+	tab.Flush()
+	if err := tab.Error(); err != nil {
+		return fmt.Errorf("unable to write data: %v", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("unable to write data: %v", err)
+	}
+	return nil
+}
+
+// Canon returns a taxon name
+// in its canonical form.
+func canon(name string) string {
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" {
+		return ""
+	}
+	name = strings.ToLower(name)
+	r, n := utf8.DecodeRuneInString(name)
+	return string(unicode.ToUpper(r)) + name[n:]
+}
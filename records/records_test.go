@@ -0,0 +1,96 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+package records_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/js-arias/earth"
+	"github.com/js-arias/phygeo/records"
+)
+
+func TestReadTSV(t *testing.T) {
+	data := `# occurrence records
+taxon	equator	pixel	source	record	basis	date
+panthera onca	360	19118	gbif-onca.tab	1234601	HumanObservation	2015-07-30
+Panthera onca	360	19117	gbif-onca.tab	1234567	PreservedSpecimen	1998-03-12
+Panthera onca	360	19117	gbif-onca.tab	1234567	PreservedSpecimen	1998-03-12
+Smilodon populator	360	20113	pbdb.tsv	98765	FossilSpecimen	
+`
+	c, err := records.ReadTSV(strings.NewReader(data), nil)
+	if err != nil {
+		t.Fatalf("unable to read data: %v", err)
+	}
+	testCollection(t, "read", c)
+
+	var buf bytes.Buffer
+	if err := c.TSV(&buf); err != nil {
+		t.Fatalf("unable to write data: %v", err)
+	}
+	c, err = records.ReadTSV(&buf, nil)
+	if err != nil {
+		t.Fatalf("unable to read written data: %v", err)
+	}
+	testCollection(t, "write", c)
+}
+
+func TestMerge(t *testing.T) {
+	pix := earth.NewPixelation(360)
+	c := records.New(pix)
+	if err := c.Add(records.Record{Taxon: "Panthera onca", Pixel: 19117, Source: "a.tab", ID: "1"}); err != nil {
+		t.Fatalf("unable to add record: %v", err)
+	}
+	if err := c.Add(records.Record{Taxon: "Panthera onca", Pixel: -1}); err == nil {
+		t.Errorf("invalid pixel: expecting error")
+	}
+
+	o := records.New(pix)
+	o.Add(records.Record{Taxon: "panthera onca", Pixel: 19117, Source: "a.tab", ID: "1"})
+	o.Add(records.Record{Taxon: "Panthera leo", Pixel: 30000, Source: "b.tab", ID: "2"})
+	if err := c.Merge(o); err != nil {
+		t.Fatalf("unable to merge: %v", err)
+	}
+	if got, want := c.Taxa(), []string{"Panthera leo", "Panthera onca"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("taxa: got %v, want %v", got, want)
+	}
+	if got := len(c.Records("Panthera onca")); got != 1 {
+		t.Errorf("records: got %d, want %d", got, 1)
+	}
+
+	c.Delete("panthera leo")
+	if got, want := c.Taxa(), []string{"Panthera onca"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("taxa: got %v, want %v", got, want)
+	}
+
+	if err := c.Merge(records.New(earth.NewPixelation(60))); err == nil {
+		t.Errorf("different pixelation: expecting error")
+	}
+}
+
+func testCollection(t testing.TB, name string, c *records.Collection) {
+	t.Helper()
+
+	if got, want := c.Taxa(), []string{"Panthera onca", "Smilodon populator"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: taxa: got %v, want %v", name, got, want)
+	}
+
+	want := []records.Record{
+		{Taxon: "Panthera onca", Pixel: 19117, Source: "gbif-onca.tab", ID: "1234567", Basis: "PreservedSpecimen", Date: "1998-03-12"},
+		{Taxon: "Panthera onca", Pixel: 19118, Source: "gbif-onca.tab", ID: "1234601", Basis: "HumanObservation", Date: "2015-07-30"},
+	}
+	if got := c.Records("Panthera onca"); !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: records: got %v, want %v", name, got, want)
+	}
+
+	want = []records.Record{
+		{Taxon: "Smilodon populator", Pixel: 20113, Source: "pbdb.tsv", ID: "98765", Basis: "FossilSpecimen"},
+	}
+	if got := c.Records("smilodon populator"); !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: records: got %v, want %v", name, got, want)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright © 2023 J. Salvador Arias <jsalarias@gmail.com>
+// All rights reserved.
+// Distributed under BSD2 license that can be found in the LICENSE file.
+
+// Package version reports the version of PhyGeo
+// and the versions of the main libraries
+// used to build it.
+//
+// The versions are read from the build information
+// embedded by the Go toolchain in the binary.
+package version
+
+import (
+	"runtime/debug"
+	"strings"
+)
+
+// Devel is the version reported
+// when the version of the main module is unknown.
+const Devel = "(devel)"
+
+// Module is a Go module used to build PhyGeo.
+type Module struct {
+	// Path of the module
+	Path string
+
+	// Version of the module
+	Version string
+}
+
+// Libraries are the paths of the modules
+// reported by Deps.
+var Libraries = []string{
+	"github.com/js-arias/earth",
+	"github.com/js-arias/ranges",
+	"github.com/js-arias/timetree",
+}
+
+// String returns the version of PhyGeo.
+//
+// If the binary was built from a version control checkout,
+// the short revision hash will be added to the version,
+// with the suffix "+dirty"
+// if the working tree has uncommitted changes.
+func String() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return Devel
+	}
+
+	v := bi.Main.Version
+	if v == "" {
+		v = Devel
+	}
+
+	var rev string
+	var dirty bool
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			rev = s.Value
+		case "vcs.modified":
+			dirty = s.Value == "true"
+		}
+	}
+	if rev == "" || strings.Contains(v, rev[:min(12, len(rev))]) {
+		return v
+	}
+	if len(rev) > 12 {
+		rev = rev[:12]
+	}
+	if dirty {
+		rev += "+dirty"
+	}
+	return v + " " + rev
+}
+
+// Deps returns the versions of the libraries
+// used to build PhyGeo.
+// If a library is not found in the build information
+// its version will be reported as unknown.
+func Deps() []Module {
+	vs := make(map[string]string)
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, d := range bi.Deps {
+			if d.Replace != nil {
+				vs[d.Path] = d.Replace.Version + " (replaced by " + d.Replace.Path + ")"
+				continue
+			}
+			vs[d.Path] = d.Version
+		}
+	}
+
+	mods := make([]Module, 0, len(Libraries))
+	for _, p := range Libraries {
+		v, ok := vs[p]
+		if !ok {
+			v = "unknown"
+		}
+		mods = append(mods, Module{Path: p, Version: v})
+	}
+	return mods
+}